@@ -165,6 +165,12 @@ CAPDEFS = [
         url="https://oragono.io/nope",
         standard="Oragono vendor",
     ),
+    CapDef(
+        identifier="MessageRedaction",
+        name="draft/message-redaction",
+        url="https://github.com/ircv3/ircv3-specifications/pull/524",
+        standard="proposed IRCv3",
+    ),
     CapDef(
         identifier="Multiline",
         name="draft/multiline",
@@ -183,6 +189,12 @@ CAPDEFS = [
         url="https://gist.github.com/edk0/bf3b50fc219fd1bed1aa15d98bfb6495",
         standard="proposed IRCv3",
     ),
+    CapDef(
+        identifier="StandardReplies",
+        name="standard-replies",
+        url="https://github.com/ircv3/ircv3-specifications/pull/506",
+        standard="proposed IRCv3",
+    ),
 ]
 
 def validate_defs():
@@ -11,6 +11,7 @@ require (
 	github.com/go-test/deep v1.0.6 // indirect
 	github.com/gorilla/websocket v1.4.2
 	github.com/goshuirc/irc-go v0.0.0-20201118022549-7209d10d54a8
+	github.com/lib/pq v1.8.0
 	github.com/onsi/ginkgo v1.12.0 // indirect
 	github.com/onsi/gomega v1.9.0 // indirect
 	github.com/oragono/confusables v0.0.0-20201108231250-4ab98ab61fb1
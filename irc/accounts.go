@@ -15,8 +15,10 @@ import (
 	"time"
 	"unicode"
 
+	"github.com/oragono/oragono/irc/caps"
 	"github.com/oragono/oragono/irc/connection_limits"
 	"github.com/oragono/oragono/irc/email"
+	"github.com/oragono/oragono/irc/flatip"
 	"github.com/oragono/oragono/irc/migrations"
 	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/passwd"
@@ -30,6 +32,8 @@ const (
 	keyAccountUnregistered     = "account.unregistered %s"
 	keyAccountCallback         = "account.callback %s"
 	keyAccountVerificationCode = "account.verificationcode %s"
+	keyAccountPendingEmail     = "account.pendingemail %s"
+	keyAccountPasswordReset    = "account.pwreset %s"
 	keyAccountName             = "account.name %s" // stores the 'preferred name' of the account, not casemapped
 	keyAccountRegTime          = "account.registered.time %s"
 	keyAccountCredentials      = "account.credentials %s"
@@ -42,11 +46,12 @@ const (
 	keyAccountModes            = "account.modes %s"     // user modes for the always-on client as a string
 	keyAccountRealname         = "account.realname %s"  // client realname stored as string
 	keyAccountSuspended        = "account.suspended %s" // client realname stored as string
+	keyAccountDrafts           = "account.drafts %s"    // DRAFTS key-value store, as JSON
 	// for an always-on client, a map of channel names they're in to their current modes
 	// (not to be confused with their amodes, which a non-always-on client can have):
 	keyAccountChannelToModes = "account.channeltomodes %s"
 
-	maxCertfpsPerAccount = 5
+	defaultMaxCertfps = 5
 )
 
 // everything about accounts is persistent; therefore, the database is the authoritative
@@ -62,6 +67,7 @@ type AccountManager struct {
 	skeletonToAccount map[string]string
 	accountToMethod   map[string]NickEnforcementMethod
 	registerThrottle  connection_limits.GenericThrottle
+	authScriptCache   authScriptCache
 }
 
 func (am *AccountManager) Initialize(server *Server) {
@@ -120,19 +126,28 @@ func (am *AccountManager) createAlwaysOnClients(config *Config) {
 
 	for _, accountName := range accounts {
 		account, err := am.LoadAccount(accountName)
-		if err == nil && (account.Verified && account.Suspended == nil) &&
-			persistenceEnabled(config.Accounts.Multiclient.AlwaysOn, account.Settings.AlwaysOn) {
-			am.server.AddAlwaysOnClient(
-				account,
-				am.loadChannels(accountName),
-				am.loadLastSeen(accountName),
-				am.loadModes(accountName),
-				am.loadRealname(accountName),
-			)
+		if err == nil {
+			am.restoreAlwaysOnClient(config, account)
 		}
 	}
 }
 
+// restoreAlwaysOnClient creates the always-on client for an account from its
+// persisted state, if the account should have one
+func (am *AccountManager) restoreAlwaysOnClient(config *Config, account ClientAccount) {
+	if (account.Verified && account.Suspended == nil) &&
+		persistenceEnabled(config.Accounts.Multiclient.AlwaysOn, account.Settings.AlwaysOn) {
+		accountName := account.NameCasefolded
+		am.server.AddAlwaysOnClient(
+			account,
+			am.loadChannels(accountName),
+			am.loadLastSeen(accountName),
+			am.loadModes(accountName),
+			am.loadRealname(accountName),
+		)
+	}
+}
+
 func (am *AccountManager) buildNickToAccountIndex(config *Config) {
 	if !config.Accounts.NickReservation.Enabled {
 		return
@@ -236,6 +251,20 @@ func (am *AccountManager) NickToAccount(nick string) string {
 	return am.skeletonToAccount[skel]
 }
 
+// ConfusableAccount returns the account whose name or reserved nickname is
+// confusable with (has the same skeleton as, but is not a case variant of)
+// the given nickname, if there is one.
+func (am *AccountManager) ConfusableAccount(cfnick, skeleton string) (account string) {
+	am.RLock()
+	defer am.RUnlock()
+	account = am.skeletonToAccount[skeleton]
+	if account != "" && am.nickToAccount[cfnick] == account {
+		// not a confusable, just the nickname itself
+		return ""
+	}
+	return
+}
+
 // given an account, combine stored enforcement method with the config settings
 // to compute the actual enforcement method
 func configuredEnforcementMethod(config *Config, storedMethod NickEnforcementMethod) (result NickEnforcementMethod) {
@@ -338,6 +367,27 @@ func (am *AccountManager) AccountToClients(account string) (result []*Client) {
 	return am.accountToClients[cfaccount]
 }
 
+// checkSessionLimits enforces the per-account limits from ip-limits on a
+// client that is about to log into `account`.
+func (am *AccountManager) checkSessionLimits(client *Client, account string) error {
+	sessions := 0
+	for _, otherClient := range am.AccountToClients(account) {
+		if otherClient != client {
+			sessions += len(otherClient.Sessions())
+		}
+	}
+	switch am.server.connectionLimiter.AddAccountSession(account, flatip.FromNetIP(client.IP()), sessions) {
+	case connection_limits.ErrLimitExceeded:
+		am.server.logger.Info("accounts", "login rejected for account session limit", account, client.IP().String())
+		return errAccountTooManySessions
+	case connection_limits.ErrThrottleExceeded:
+		am.server.logger.Info("accounts", "login rejected for account session throttle", account, client.IP().String())
+		return errAccountSessionsThrottled
+	default:
+		return nil
+	}
+}
+
 func (am *AccountManager) Register(client *Client, account string, callbackNamespace string, callbackValue string, passphrase string, certfp string) error {
 	casefoldedAccount, err := CasefoldName(account)
 	skeleton, skerr := Skeleton(account)
@@ -345,11 +395,17 @@ func (am *AccountManager) Register(client *Client, account string, callbackNames
 		return errAccountCreation
 	}
 
-	if restrictedCasefoldedNicks.Has(casefoldedAccount) || restrictedSkeletons.Has(skeleton) {
+	config := am.server.Config()
+
+	if config.isRestrictedNick(casefoldedAccount, skeleton) {
 		return errAccountAlreadyRegistered
 	}
 
-	config := am.server.Config()
+	// this is checked again when the account is verified, but fail early
+	// rather than sending a verification email that can't be used:
+	if confusable := am.ConfusableAccount(casefoldedAccount, skeleton); confusable != "" && confusable != casefoldedAccount {
+		return errConfusableIdentifier
+	}
 
 	// final "is registration allowed" check:
 	if !(config.Accounts.Registration.Enabled || callbackNamespace == "admin") || am.server.Defcon() <= 4 {
@@ -399,7 +455,7 @@ func (am *AccountManager) Register(client *Client, account string, callbackNames
 	if err != nil {
 		return err
 	}
-	creds.AddCertfp(certfp)
+	creds.AddCertfp(certfp, am.server.Config().Accounts.MaxCertfps)
 	credStr, err := creds.Serialize()
 	if err != nil {
 		return err
@@ -686,7 +742,7 @@ func (am *AccountManager) addRemoveCertfp(account, certfp string, add bool, hasP
 	}
 
 	if add {
-		err = creds.AddCertfp(certfp)
+		err = creds.AddCertfp(certfp, am.server.Config().Accounts.MaxCertfps)
 	} else {
 		err = creds.RemoveCertfp(certfp)
 	}
@@ -744,31 +800,197 @@ func (am *AccountManager) dispatchMailtoCallback(client *Client, account string,
 		subject = fmt.Sprintf(client.t("Verify your account on %s"), am.server.name)
 	}
 
+	err = am.sendMail(callbackValue, subject, []string{
+		fmt.Sprintf(client.t("Account: %s"), account),
+		fmt.Sprintf(client.t("Verification code: %s"), code),
+		"",
+		client.t("To verify your account, issue the following command:"),
+		fmt.Sprintf("/MSG NickServ VERIFY %s %s", account, code),
+	})
+	return
+}
+
+// sendMail sends an e-mail from the configured sender address; each entry
+// of `body` is a line of the message.
+func (am *AccountManager) sendMail(recipient, subject string, body []string) (err error) {
+	config := am.server.Config().Accounts.Registration.EmailVerification
+
 	var message bytes.Buffer
 	fmt.Fprintf(&message, "From: %s\r\n", config.Sender)
-	fmt.Fprintf(&message, "To: %s\r\n", callbackValue)
+	fmt.Fprintf(&message, "To: %s\r\n", recipient)
 	if config.DKIM.Domain != "" {
 		fmt.Fprintf(&message, "Message-ID: <%s@%s>\r\n", utils.GenerateSecretKey(), config.DKIM.Domain)
 	}
 	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
 	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
 	message.WriteString("\r\n") // blank line: end headers, begin message body
-	fmt.Fprintf(&message, client.t("Account: %s"), account)
-	message.WriteString("\r\n")
-	fmt.Fprintf(&message, client.t("Verification code: %s"), code)
-	message.WriteString("\r\n")
-	message.WriteString("\r\n")
-	message.WriteString(client.t("To verify your account, issue the following command:"))
-	message.WriteString("\r\n")
-	fmt.Fprintf(&message, "/MSG NickServ VERIFY %s %s\r\n", account, code)
-
-	err = email.SendMail(config, callbackValue, message.Bytes())
+	for _, line := range body {
+		message.WriteString(line)
+		message.WriteString("\r\n")
+	}
+
+	err = email.SendMail(config, recipient, message.Bytes())
 	if err != nil {
-		am.server.logger.Error("internal", "Failed to dispatch e-mail to", callbackValue, err.Error())
+		am.server.logger.Error("internal", "Failed to dispatch e-mail to", recipient, err.Error())
 	}
 	return
 }
 
+// emailFromCallback returns the e-mail address from a stored callback spec,
+// or "" if the account has none.
+func emailFromCallback(callback string) string {
+	if strings.HasPrefix(callback, "mailto:") {
+		return strings.TrimPrefix(callback, "mailto:")
+	}
+	return ""
+}
+
+const (
+	// minimum time between two e-mail change requests for the same account
+	emailChangeCooldown = 10 * time.Minute
+)
+
+// an e-mail change that is waiting for the confirmation code sent to the new address
+type pendingEmailChange struct {
+	Email     string
+	Code      string
+	Timestamp time.Time
+}
+
+// RequestEmailChange begins changing the e-mail address of a verified account:
+// a confirmation code is sent to the new address, and the change takes effect
+// once the code is passed to ConfirmEmailChange.
+func (am *AccountManager) RequestEmailChange(client *Client, account string, newEmail string) (err error) {
+	config := am.server.Config()
+	if !config.Accounts.Registration.EmailVerification.Enabled {
+		return errFeatureDisabled
+	}
+	newEmail, err = parseEmail(newEmail)
+	if err != nil {
+		return
+	}
+	accountData, err := am.LoadAccount(account)
+	if err != nil {
+		return
+	} else if !accountData.Verified {
+		return errAccountUnverified
+	} else if accountData.Email == newEmail {
+		return errNoop
+	}
+
+	now := time.Now().UTC()
+	code := utils.GenerateSecretToken()
+	pendingStr, err := json.Marshal(pendingEmailChange{Email: newEmail, Code: code, Timestamp: now})
+	if err != nil {
+		return
+	}
+	var setOptions *buntdb.SetOptions
+	if ttl := time.Duration(config.Accounts.Registration.VerifyTimeout); ttl != 0 {
+		setOptions = &buntdb.SetOptions{Expires: true, TTL: ttl}
+	}
+	pendingKey := fmt.Sprintf(keyAccountPendingEmail, accountData.NameCasefolded)
+	// a pending code within the cooldown stays valid, rather than being replaced:
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		if oldStr, err := tx.Get(pendingKey); err == nil {
+			var old pendingEmailChange
+			if json.Unmarshal([]byte(oldStr), &old) == nil && now.Sub(old.Timestamp) < emailChangeCooldown {
+				return errLimitExceeded
+			}
+		}
+		_, _, err := tx.Set(pendingKey, string(pendingStr), setOptions)
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	subject := fmt.Sprintf(client.t("Confirm your new e-mail address on %s"), am.server.name)
+	err = am.sendMail(newEmail, subject, []string{
+		fmt.Sprintf(client.t("Account: %s"), accountData.Name),
+		fmt.Sprintf(client.t("Confirmation code: %s"), code),
+		"",
+		client.t("To confirm your new e-mail address, issue the following command:"),
+		fmt.Sprintf("/MSG NickServ SET EMAIL %s %s", newEmail, code),
+	})
+	if err != nil {
+		// let them try again
+		am.server.store.Update(func(tx *buntdb.Tx) error {
+			tx.Delete(pendingKey)
+			return nil
+		})
+		return errCallbackFailed
+	}
+	return
+}
+
+// ConfirmEmailChange completes an e-mail change begun with RequestEmailChange.
+func (am *AccountManager) ConfirmEmailChange(client *Client, account string, newEmail string, code string) (err error) {
+	newEmail, err = parseEmail(newEmail)
+	if err != nil {
+		return
+	}
+	return am.changeEmail(client, account, newEmail, code, true)
+}
+
+// SetEmail changes the e-mail address of an account without confirmation.
+func (am *AccountManager) SetEmail(client *Client, account string, newEmail string) (err error) {
+	newEmail, err = parseEmail(newEmail)
+	if err != nil {
+		return
+	}
+	return am.changeEmail(client, account, newEmail, "", false)
+}
+
+func (am *AccountManager) changeEmail(client *Client, account, newEmail, code string, checkCode bool) (err error) {
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+	callbackKey := fmt.Sprintf(keyAccountCallback, casefoldedAccount)
+	pendingKey := fmt.Sprintf(keyAccountPendingEmail, casefoldedAccount)
+	// a password reset token sent to the old address is no longer valid:
+	passwordResetKey := fmt.Sprintf(keyAccountPasswordReset, casefoldedAccount)
+
+	var raw rawClientAccount
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		raw, err = am.loadRawAccount(tx, casefoldedAccount)
+		if err != nil {
+			return err
+		} else if !raw.Verified {
+			return errAccountUnverified
+		}
+		if checkCode {
+			var pending pendingEmailChange
+			pendingStr, err := tx.Get(pendingKey)
+			if err == nil {
+				err = json.Unmarshal([]byte(pendingStr), &pending)
+			}
+			if err != nil || pending.Email != newEmail || !utils.SecretTokensMatch(pending.Code, code) {
+				return errAccountVerificationInvalidCode
+			}
+		}
+		tx.Delete(pendingKey)
+		tx.Delete(passwordResetKey)
+		_, _, err := tx.Set(callbackKey, "mailto:"+newEmail, nil)
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	// let the owner of the old address know, in case the account was compromised
+	oldEmail := emailFromCallback(raw.Callback)
+	if oldEmail != "" && oldEmail != newEmail && am.server.Config().Accounts.Registration.EmailVerification.Enabled {
+		subject := fmt.Sprintf(client.t("Your e-mail address on %s has changed"), am.server.name)
+		go am.sendMail(oldEmail, subject, []string{
+			fmt.Sprintf(client.t("Account: %s"), raw.Name),
+			"",
+			client.t("This address is no longer associated with the account. If you did not make this change, please contact the server administrators."),
+		})
+	}
+	return nil
+}
+
 func (am *AccountManager) Verify(client *Client, account string, code string) error {
 	casefoldedAccount, err := CasefoldName(account)
 	var skeleton string
@@ -1049,7 +1271,7 @@ func (am *AccountManager) checkPassphrase(accountName, passphrase string) (accou
 		err = errAccountUnverified
 		return
 	} else if account.Suspended != nil {
-		err = errAccountSuspended
+		err = &AccountSuspendedError{*account.Suspended}
 		return
 	}
 
@@ -1116,6 +1338,9 @@ func (am *AccountManager) AuthenticateByPassphrase(client *Client, accountName s
 	var account ClientAccount
 
 	defer func() {
+		if err == nil {
+			err = am.checkSessionLimits(client, account.NameCasefolded)
+		}
 		if err == nil {
 			am.Login(client, account)
 		}
@@ -1124,7 +1349,7 @@ func (am *AccountManager) AuthenticateByPassphrase(client *Client, accountName s
 	config := am.server.Config()
 	if config.Accounts.AuthScript.Enabled {
 		var output AuthScriptOutput
-		output, err = CheckAuthScript(am.server.semaphores.AuthScript, config.Accounts.AuthScript.ScriptConfig,
+		output, err = am.checkAuthScript(config,
 			AuthScriptInput{AccountName: accountName, Passphrase: passphrase, IP: client.IP().String()})
 		if err != nil {
 			am.server.logger.Error("internal", "failed shell auth invocation", err.Error())
@@ -1133,6 +1358,9 @@ func (am *AccountManager) AuthenticateByPassphrase(client *Client, accountName s
 				accountName = output.AccountName
 			}
 			account, err = am.loadWithAutocreation(accountName, config.Accounts.AuthScript.Autocreate)
+			if err == nil && account.Suspended != nil {
+				err = &AccountSuspendedError{*account.Suspended}
+			}
 			return
 		}
 	}
@@ -1233,6 +1461,7 @@ func (am *AccountManager) deserializeRawAccount(raw rawClientAccount, cfName str
 	}
 	result.AdditionalNicks = unmarshalReservedNicks(raw.AdditionalNicks)
 	result.Verified = raw.Verified
+	result.Email = emailFromCallback(raw.Callback)
 	if raw.VHost != "" {
 		e := json.Unmarshal([]byte(raw.VHost), &result.VHost)
 		if e != nil {
@@ -1382,6 +1611,14 @@ func (am *AccountManager) Unsuspend(accountName string) (err error) {
 		return nil
 	})
 
+	// the always-on client was destroyed by the suspension, but its channels,
+	// modes etc. were retained; bring it back unless someone took the nick
+	if err == nil {
+		if account, err := am.LoadAccount(cfaccount); err == nil && am.server.clients.Get(cfaccount) == nil {
+			am.restoreAlwaysOnClient(am.server.Config(), account)
+		}
+	}
+
 	return err
 }
 
@@ -1418,36 +1655,313 @@ func (am *AccountManager) ListSuspended() (result []AccountSuspension) {
 	return
 }
 
-// renames an account (within very restrictive limits); see #1380
+// per-account keys that are moved to the new name when an account is renamed;
+// the account name itself and the certfp index are handled separately
+var renamedAccountKeys = []string{
+	keyAccountExists,
+	keyAccountVerified,
+	keyAccountCallback,
+	keyAccountVerificationCode,
+	keyAccountRegTime,
+	keyAccountCredentials,
+	keyAccountAdditionalNicks,
+	keyAccountSettings,
+	keyAccountVHost,
+	keyAccountChannels,
+	keyAccountLastSeen,
+	keyAccountModes,
+	keyAccountRealname,
+	keyAccountSuspended,
+	keyAccountChannelToModes,
+	keyAccountDrafts,
+	keyAccountPendingEmail,
+	keyAccountPasswordReset,
+}
+
+// Rename renames an account. Its stored data moves to the new name in a single
+// transaction, together with the channel founder, amode and successor entries
+// that refer to it; then the in-memory indexes, logged-in clients, and history
+// attributions are updated. The old name is released.
 func (am *AccountManager) Rename(oldName, newName string) (err error) {
 	accountData, err := am.LoadAccount(oldName)
 	if err != nil {
 		return
 	}
+	if !accountData.Verified {
+		return errAccountUnverified
+	}
+	oldCfName := accountData.NameCasefolded
 	newCfName, err := CasefoldName(newName)
-	if err != nil {
+	newSkeleton, skerr := Skeleton(newName)
+	if err != nil || skerr != nil || newName == "*" {
 		return errNicknameInvalid
 	}
-	if newCfName != accountData.NameCasefolded {
-		return errInvalidAccountRename
+	if newName == accountData.Name {
+		return errNoop
+	}
+
+	config := am.server.Config()
+	if newCfName != oldCfName {
+		if config.isRestrictedNick(newCfName, newSkeleton) || config.Accounts.NickReservation.guestRegexpFolded.MatchString(newCfName) {
+			return errAccountAlreadyRegistered
+		}
+		if confusable := am.ConfusableAccount(newCfName, newSkeleton); confusable != "" && confusable != oldCfName {
+			return errConfusableIdentifier
+		}
+		if reservedBy := am.NickToAccount(newName); reservedBy != "" && reservedBy != oldCfName {
+			return errAccountAlreadyRegistered
+		}
 	}
-	key := fmt.Sprintf(keyAccountName, accountData.NameCasefolded)
+
+	am.serialCacheUpdateMutex.Lock()
+	defer am.serialCacheUpdateMutex.Unlock()
+
+	var additionalNicks []string
 	err = am.server.store.Update(func(tx *buntdb.Tx) error {
-		tx.Set(key, newName, nil)
+		if _, err := tx.Get(fmt.Sprintf(keyAccountExists, oldCfName)); err != nil {
+			return errAccountDoesNotExist
+		}
+
+		if newCfName != oldCfName {
+			for _, keyFmt := range []string{keyAccountExists, keyAccountUnregistered} {
+				if _, err := tx.Get(fmt.Sprintf(keyFmt, newCfName)); err == nil {
+					return errAccountAlreadyRegistered
+				}
+			}
+
+			for _, keyFmt := range renamedAccountKeys {
+				oldKey := fmt.Sprintf(keyFmt, oldCfName)
+				value, err := tx.Get(oldKey)
+				if err != nil {
+					continue
+				}
+				var setOptions *buntdb.SetOptions
+				if ttl, err := tx.TTL(oldKey); err == nil && ttl > 0 {
+					setOptions = &buntdb.SetOptions{Expires: true, TTL: ttl}
+				}
+				tx.Delete(oldKey)
+				tx.Set(fmt.Sprintf(keyFmt, newCfName), value, setOptions)
+			}
+			tx.Delete(fmt.Sprintf(keyAccountName, oldCfName))
+
+			credText, _ := tx.Get(fmt.Sprintf(keyAccountCredentials, newCfName))
+			var creds AccountCredentials
+			if json.Unmarshal([]byte(credText), &creds) == nil {
+				for _, certfp := range creds.Certfps {
+					tx.Set(fmt.Sprintf(keyCertToAccount, certfp), newCfName, nil)
+				}
+			}
+
+			// the new name may have been one of the account's reserved nicknames
+			nicksKey := fmt.Sprintf(keyAccountAdditionalNicks, newCfName)
+			rawNicks, _ := tx.Get(nicksKey)
+			for _, nick := range unmarshalReservedNicks(rawNicks) {
+				if cfnick, _ := CasefoldName(nick); cfnick != newCfName {
+					additionalNicks = append(additionalNicks, nick)
+				}
+			}
+			if rawNicks != "" {
+				tx.Set(nicksKey, marshalReservedNicks(additionalNicks), nil)
+			}
+
+			am.server.channelRegistry.reassignAccount(tx, oldCfName, newCfName)
+		}
+
+		tx.Set(fmt.Sprintf(keyAccountName, newCfName), newName, nil)
 		return nil
 	})
 	if err != nil {
-		return err
+		return
 	}
 
-	am.RLock()
-	defer am.RUnlock()
-	for _, client := range am.accountToClients[accountData.NameCasefolded] {
-		client.setAccountName(newName)
+	am.Lock()
+	clients := am.accountToClients[oldCfName]
+	if newCfName != oldCfName {
+		oldSkeleton, _ := Skeleton(accountData.Name)
+		if am.nickToAccount[oldCfName] == oldCfName {
+			delete(am.nickToAccount, oldCfName)
+		}
+		if am.skeletonToAccount[oldSkeleton] == oldCfName {
+			delete(am.skeletonToAccount, oldSkeleton)
+		}
+		if config.Accounts.NickReservation.Enabled {
+			am.nickToAccount[newCfName] = newCfName
+			am.skeletonToAccount[newSkeleton] = newCfName
+			for _, nick := range additionalNicks {
+				cfnick, _ := CasefoldName(nick)
+				am.nickToAccount[cfnick] = newCfName
+				skeleton, _ := Skeleton(nick)
+				am.skeletonToAccount[skeleton] = newCfName
+			}
+		}
+		if method, ok := am.accountToMethod[oldCfName]; ok {
+			delete(am.accountToMethod, oldCfName)
+			am.accountToMethod[newCfName] = method
+		}
+		delete(am.accountToClients, oldCfName)
+		if len(clients) != 0 {
+			am.accountToClients[newCfName] = clients
+		}
+	}
+	for _, client := range clients {
+		client.setAccountName(newCfName, newName)
+	}
+	am.Unlock()
+
+	if newCfName != oldCfName {
+		for _, channel := range am.server.channels.Channels() {
+			channel.reassignAccount(oldCfName, newCfName)
+		}
 	}
+
+	for _, client := range clients {
+		am.sendAccountChange(client)
+	}
+
+	am.server.renameHistoryAccount(oldCfName, newCfName, newName)
 	return nil
 }
 
+// Merge merges the account `sourceName` into `targetName`. The source's name
+// and reserved nicknames become reserved nicknames of the target, its certfps
+// are added to the target's credentials, its channel registrations and amodes
+// pass to the target, and its messages are reattributed to the target. The
+// source account is then deleted; its clients are logged into the target,
+// except for always-on clients, which are disconnected.
+func (am *AccountManager) Merge(sourceName, targetName string) (err error) {
+	source, err := am.LoadAccount(sourceName)
+	if err != nil {
+		return
+	}
+	target, err := am.LoadAccount(targetName)
+	if err != nil {
+		return
+	}
+	if !(source.Verified && target.Verified) {
+		return errAccountUnverified
+	}
+	sourceCfName, targetCfName := source.NameCasefolded, target.NameCasefolded
+	if sourceCfName == targetCfName {
+		return errNoop
+	}
+
+	var mergedNicks []string
+	var clients []*Client
+	err = func() error {
+		am.serialCacheUpdateMutex.Lock()
+		defer am.serialCacheUpdateMutex.Unlock()
+
+		err := am.server.store.Update(func(tx *buntdb.Tx) error {
+			for _, account := range []string{sourceCfName, targetCfName} {
+				if _, err := tx.Get(fmt.Sprintf(keyAccountExists, account)); err != nil {
+					return errAccountDoesNotExist
+				}
+			}
+
+			// the source's name and reserved nicknames are reserved for the target
+			sourceNicks, _ := tx.Get(fmt.Sprintf(keyAccountAdditionalNicks, sourceCfName))
+			mergedNicks = append([]string{source.Name}, unmarshalReservedNicks(sourceNicks)...)
+			targetNicksKey := fmt.Sprintf(keyAccountAdditionalNicks, targetCfName)
+			targetNicks, _ := tx.Get(targetNicksKey)
+			nicks := append(unmarshalReservedNicks(targetNicks), mergedNicks...)
+			tx.Set(targetNicksKey, marshalReservedNicks(nicks), nil)
+
+			// the source's certfps can be used to log into the target
+			// (the max-certfps limit is not enforced, so that none are lost)
+			targetCredsKey := fmt.Sprintf(keyAccountCredentials, targetCfName)
+			var sourceCreds, targetCreds AccountCredentials
+			sourceCredText, _ := tx.Get(fmt.Sprintf(keyAccountCredentials, sourceCfName))
+			targetCredText, _ := tx.Get(targetCredsKey)
+			if err := json.Unmarshal([]byte(targetCredText), &targetCreds); err != nil {
+				return err
+			}
+			if json.Unmarshal([]byte(sourceCredText), &sourceCreds) == nil && len(sourceCreds.Certfps) != 0 {
+				for _, certfp := range sourceCreds.Certfps {
+					targetCreds.AddCertfp(certfp, len(targetCreds.Certfps)+1)
+					tx.Set(fmt.Sprintf(keyCertToAccount, certfp), targetCfName, nil)
+				}
+				credText, err := targetCreds.Serialize()
+				if err != nil {
+					return err
+				}
+				tx.Set(targetCredsKey, credText, nil)
+			}
+
+			// the source's registered channels pass to the target
+			targetChannelsKey := fmt.Sprintf(keyAccountChannels, targetCfName)
+			sourceChannels, _ := tx.Get(fmt.Sprintf(keyAccountChannels, sourceCfName))
+			targetChannels, _ := tx.Get(targetChannelsKey)
+			if channels := unmarshalRegisteredChannels(sourceChannels); len(channels) != 0 {
+				channels = append(unmarshalRegisteredChannels(targetChannels), channels...)
+				tx.Set(targetChannelsKey, strings.Join(channels, ","), nil)
+			}
+			am.server.channelRegistry.reassignAccount(tx, sourceCfName, targetCfName)
+
+			for _, keyFmt := range renamedAccountKeys {
+				tx.Delete(fmt.Sprintf(keyFmt, sourceCfName))
+			}
+			tx.Delete(fmt.Sprintf(keyAccountName, sourceCfName))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		config := am.server.Config()
+		am.Lock()
+		if config.Accounts.NickReservation.Enabled {
+			for _, nick := range mergedNicks {
+				cfnick, _ := CasefoldName(nick)
+				am.nickToAccount[cfnick] = targetCfName
+				skeleton, _ := Skeleton(nick)
+				am.skeletonToAccount[skeleton] = targetCfName
+			}
+		}
+		delete(am.accountToMethod, sourceCfName)
+		clients = am.accountToClients[sourceCfName]
+		delete(am.accountToClients, sourceCfName)
+		am.Unlock()
+		return nil
+	}()
+	if err != nil {
+		return
+	}
+
+	for _, channel := range am.server.channels.Channels() {
+		channel.reassignAccount(sourceCfName, targetCfName)
+	}
+
+	// reload the target to pick up the merged credentials
+	if merged, err := am.LoadAccount(targetCfName); err == nil {
+		target = merged
+	}
+	for _, client := range clients {
+		if client.AlwaysOn() {
+			client.Logout()
+			client.Quit(fmt.Sprintf(client.t("Your account was merged into %s"), target.Name), nil)
+			client.destroy(nil)
+			continue
+		}
+		am.Login(client, target)
+		am.sendAccountChange(client)
+	}
+
+	am.server.renameHistoryAccount(sourceCfName, targetCfName, target.Name)
+	return nil
+}
+
+// sendAccountChange tells a client, and its friends with account-notify,
+// that the account it is logged into was renamed or merged
+func (am *AccountManager) sendAccountChange(client *Client) {
+	details := client.Details()
+	for _, session := range client.Sessions() {
+		session.Send(nil, am.server.name, RPL_LOGGEDIN, details.nick, details.nickMask, details.accountName, fmt.Sprintf(client.t("You are now logged in as %s"), details.accountName))
+	}
+	for friend := range client.Friends(caps.AccountNotify) {
+		friend.Send(nil, details.nickMask, "ACCOUNT", details.accountName)
+	}
+}
+
 func (am *AccountManager) Unregister(account string, erase bool) error {
 	config := am.server.Config()
 	casefoldedAccount, err := CasefoldName(account)
@@ -1472,6 +1986,9 @@ func (am *AccountManager) Unregister(account string, erase bool) error {
 	modesKey := fmt.Sprintf(keyAccountModes, casefoldedAccount)
 	realnameKey := fmt.Sprintf(keyAccountRealname, casefoldedAccount)
 	suspendedKey := fmt.Sprintf(keyAccountSuspended, casefoldedAccount)
+	draftsKey := fmt.Sprintf(keyAccountDrafts, casefoldedAccount)
+	pendingEmailKey := fmt.Sprintf(keyAccountPendingEmail, casefoldedAccount)
+	passwordResetKey := fmt.Sprintf(keyAccountPasswordReset, casefoldedAccount)
 
 	var clients []*Client
 	defer func() {
@@ -1479,9 +1996,13 @@ func (am *AccountManager) Unregister(account string, erase bool) error {
 	}()
 
 	var registeredChannels []string
-	// on our way out, unregister all the account's channels and delete them from the db
+	// on our way out, pass the account's channels to their successors, or else
+	// unregister them and delete them from the db
 	defer func() {
 		for _, channelName := range registeredChannels {
+			if am.server.passChannelToSuccessor(channelName, casefoldedAccount) {
+				continue
+			}
 			err := am.server.channels.SetUnregistered(channelName, casefoldedAccount)
 			if err != nil {
 				am.server.logger.Error("internal", "couldn't unregister channel", channelName, err.Error())
@@ -1532,6 +2053,9 @@ func (am *AccountManager) Unregister(account string, erase bool) error {
 		tx.Delete(modesKey)
 		tx.Delete(realnameKey)
 		tx.Delete(suspendedKey)
+		tx.Delete(draftsKey)
+		tx.Delete(pendingEmailKey)
+		tx.Delete(passwordResetKey)
 
 		return nil
 	})
@@ -1614,7 +2138,7 @@ func (am *AccountManager) AuthenticateByCertificate(client *Client, certfp strin
 			err = errAccountUnverified
 			return
 		} else if clientAccount.Suspended != nil {
-			err = errAccountSuspended
+			err = &AccountSuspendedError{*clientAccount.Suspended}
 			return
 		}
 		// TODO(#1109) clean this check up?
@@ -1624,6 +2148,9 @@ func (am *AccountManager) AuthenticateByCertificate(client *Client, certfp strin
 				return
 			}
 		}
+		if err = am.checkSessionLimits(client, clientAccount.NameCasefolded); err != nil {
+			return
+		}
 		am.Login(client, clientAccount)
 		return
 	}()
@@ -1631,7 +2158,7 @@ func (am *AccountManager) AuthenticateByCertificate(client *Client, certfp strin
 	config := am.server.Config()
 	if config.Accounts.AuthScript.Enabled {
 		var output AuthScriptOutput
-		output, err = CheckAuthScript(am.server.semaphores.AuthScript, config.Accounts.AuthScript.ScriptConfig,
+		output, err = am.checkAuthScript(config,
 			AuthScriptInput{Certfp: certfp, IP: client.IP().String(), peerCerts: peerCerts})
 		if err != nil {
 			am.server.logger.Error("internal", "failed shell auth invocation", err.Error())
@@ -1710,6 +2237,7 @@ func (am *AccountManager) ModifyAccountSettings(account string, munger settingsM
 type VHostInfo struct {
 	ApprovedVHost string
 	Enabled       bool
+	LastTake      time.Time // last time a vhost was taken from the offer list
 }
 
 // callback type implementing the actual business logic of vhost operations
@@ -1726,6 +2254,24 @@ func (am *AccountManager) VHostSet(account string, vhost string) (result VHostIn
 	return am.performVHostChange(account, munger)
 }
 
+// VHostTake sets a vhost from the offer list, subject to the cooldown.
+func (am *AccountManager) VHostTake(client *Client, vhost string, cooldown time.Duration) (result VHostInfo, err error) {
+	munger := func(input VHostInfo) (output VHostInfo, err error) {
+		now := time.Now().UTC()
+		if cooldown != 0 && now.Sub(input.LastTake) < cooldown {
+			err = errVhostTakeCooldown
+			return
+		}
+		output = input
+		output.Enabled = true
+		output.ApprovedVHost = vhost
+		output.LastTake = now
+		return
+	}
+
+	return am.performVHostChange(client.Account(), munger)
+}
+
 func (am *AccountManager) VHostSetEnabled(client *Client, enabled bool) (result VHostInfo, err error) {
 	munger := func(input VHostInfo) (output VHostInfo, err error) {
 		if input.ApprovedVHost == "" {
@@ -1913,7 +2459,7 @@ func (ac *AccountCredentials) SetPassphrase(passphrase string, bcryptCost uint)
 	return nil
 }
 
-func (ac *AccountCredentials) AddCertfp(certfp string) (err error) {
+func (ac *AccountCredentials) AddCertfp(certfp string, limit int) (err error) {
 	// XXX we require that certfp is already normalized (rather than normalize here
 	// and pass back the normalized version as an additional return parameter);
 	// this is just a final sanity check:
@@ -1927,7 +2473,7 @@ func (ac *AccountCredentials) AddCertfp(certfp string) (err error) {
 		}
 	}
 
-	if maxCertfpsPerAccount <= len(ac.Certfps) {
+	if limit <= len(ac.Certfps) {
 		return errLimitExceeded
 	}
 
@@ -1997,6 +2543,23 @@ type AccountSettings struct {
 	AutoreplayMissed bool
 	DMHistory        HistoryStatus
 	AutoAway         PersistentStatus
+	// BlockedReportsDisabled opts out of summaries of DMs blocked by +R or +T
+	BlockedReportsDisabled bool
+	// AuthoredHistory caps the storage of messages sent by the account,
+	// regardless of where they would otherwise be stored
+	AuthoredHistory HistoryStatus
+	// Silence is the account's server-side ignore list, as canonicalized masks
+	Silence []string `json:",omitempty"`
+	// Protected accounts can't be KILLed or KLINEd without a second oper's
+	// confirmation; only opers can set this (NS PROTECT)
+	Protected bool `json:",omitempty"`
+	// AutoJoin replaces channels.auto-join for the account, if non-nil
+	AutoJoin *[]string `json:",omitempty"`
+	// these hide parts of the account's WHOIS and WHO replies from
+	// everyone except the account itself and opers
+	HideChannels bool `json:",omitempty"`
+	HideIdle     bool `json:",omitempty"`
+	HideTLS      bool `json:",omitempty"`
 }
 
 // ClientAccount represents a user account.
@@ -2007,6 +2570,7 @@ type ClientAccount struct {
 	RegisteredAt    time.Time
 	Credentials     AccountCredentials
 	Verified        bool
+	Email           string
 	Suspended       *AccountSuspension
 	AdditionalNicks []string
 	VHost           VHostInfo
@@ -0,0 +1,133 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/utils"
+	"github.com/tidwall/buntdb"
+)
+
+func TestAccountCredentialsCertfps(t *testing.T) {
+	certfp := func(c string) string {
+		return strings.Repeat(c, 64)
+	}
+
+	var creds AccountCredentials
+	assertEqual(creds.AddCertfp(certfp("a"), 2), nil, t)
+	assertEqual(creds.AddCertfp(certfp("a"), 2), errNoop, t)
+	assertEqual(creds.AddCertfp(certfp("b"), 2), nil, t)
+	assertEqual(creds.AddCertfp(certfp("c"), 2), errLimitExceeded, t)
+	assertEqual(creds.AddCertfp("abc", 2), utils.ErrInvalidCertfp, t)
+	assertEqual(creds.Certfps, []string{certfp("a"), certfp("b")}, t)
+
+	assertEqual(creds.RemoveCertfp(certfp("c")), errNoop, t)
+	assertEqual(creds.RemoveCertfp(certfp("a")), nil, t)
+	assertEqual(creds.AddCertfp(certfp("c"), 2), nil, t)
+	assertEqual(creds.Certfps, []string{certfp("b"), certfp("c")}, t)
+}
+
+func TestConfusableAccount(t *testing.T) {
+	var am AccountManager
+	am.nickToAccount = make(map[string]string)
+	am.skeletonToAccount = make(map[string]string)
+	reserve := func(nick, account string) {
+		cfnick, _ := CasefoldName(nick)
+		skeleton, _ := Skeleton(nick)
+		am.nickToAccount[cfnick] = account
+		am.skeletonToAccount[skeleton] = account
+	}
+	reserve("Dan", "dan")
+	reserve("shivaram", "slingamn")
+
+	confusable := func(nick string) string {
+		cfnick, err := CasefoldName(nick)
+		if err != nil {
+			t.Fatal(err)
+		}
+		skeleton, _ := Skeleton(nick)
+		return am.ConfusableAccount(cfnick, skeleton)
+	}
+	// the reserved nicknames themselves, and their case variants, aren't confusables:
+	assertEqual(confusable("dan"), "", t)
+	assertEqual(confusable("DAN"), "", t)
+	assertEqual(confusable("shivaram"), "", t)
+	assertEqual(confusable("dave"), "", t)
+	// homoglyphs (Cyrillic a, Cyrillic i) are:
+	assertEqual(confusable("dаn"), "dan", t)
+	assertEqual(confusable("shivarаm"), "slingamn", t)
+	assertEqual(confusable("shіvaram"), "slingamn", t)
+}
+
+func TestEmailChange(t *testing.T) {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	server := newTestServer()
+	server.store = store
+	am := &AccountManager{server: server}
+	store.Update(func(tx *buntdb.Tx) error {
+		tx.Set(fmt.Sprintf(keyAccountExists, "alice"), "1", nil)
+		tx.Set(fmt.Sprintf(keyAccountVerified, "alice"), "1", nil)
+		tx.Set(fmt.Sprintf(keyAccountName, "alice"), "Alice", nil)
+		tx.Set(fmt.Sprintf(keyAccountCredentials, "alice"), "{}", nil)
+		tx.Set(fmt.Sprintf(keyAccountCallback, "alice"), "mailto:alice@example.com", nil)
+		tx.Set(fmt.Sprintf(keyAccountPendingEmail, "alice"), `{"Email":"alice@example.org","Code":"s3cret"}`, nil)
+		return nil
+	})
+	email := func() string {
+		account, err := am.LoadAccount("alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return account.Email
+	}
+	assertEqual(email(), "alice@example.com", t)
+
+	// the code is only valid for the address it was sent to:
+	assertEqual(am.ConfirmEmailChange(nil, "alice", "alice@example.net", "s3cret"), errAccountVerificationInvalidCode, t)
+	assertEqual(am.ConfirmEmailChange(nil, "alice", "alice@example.org", "wrong"), errAccountVerificationInvalidCode, t)
+	assertEqual(email(), "alice@example.com", t)
+	assertEqual(am.ConfirmEmailChange(nil, "alice", "MAILTO:Alice@example.org", "s3cret"), nil, t)
+	assertEqual(email(), "alice@example.org", t)
+	// the code can't be reused:
+	assertEqual(am.ConfirmEmailChange(nil, "alice", "alice@example.org", "s3cret"), errAccountVerificationInvalidCode, t)
+
+	assertEqual(am.SetEmail(nil, "alice", "alice@example.net"), nil, t)
+	assertEqual(email(), "alice@example.net", t)
+	assertEqual(am.SetEmail(nil, "alice", "example.net"), errValidEmailRequired, t)
+	assertEqual(am.SetEmail(nil, "bob", "bob@example.net"), errAccountDoesNotExist, t)
+
+	// e-mail changes can't be requested unless verification is enabled:
+	assertEqual(am.RequestEmailChange(nil, "alice", "alice@example.com"), errFeatureDisabled, t)
+
+	// nor again while a recent request is pending, which doesn't replace its code:
+	server.Config().Accounts.Registration.EmailVerification.Enabled = true
+	pending := fmt.Sprintf(`{"Email":"alice@example.org","Code":"s3cret","Timestamp":%q}`, time.Now().UTC().Format(time.RFC3339Nano))
+	store.Update(func(tx *buntdb.Tx) error {
+		tx.Set(fmt.Sprintf(keyAccountPendingEmail, "alice"), pending, nil)
+		return nil
+	})
+	assertEqual(am.RequestEmailChange(nil, "alice", "alice@example.com"), errLimitExceeded, t)
+	server.Config().Accounts.Registration.EmailVerification.Enabled = false
+	assertEqual(am.ConfirmEmailChange(nil, "alice", "alice@example.org", "s3cret"), nil, t)
+	assertEqual(email(), "alice@example.org", t)
+}
+
+func TestAccountSuspendedError(t *testing.T) {
+	server := newTestServer()
+	suspended := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+	err := &AccountSuspendedError{AccountSuspension{TimeCreated: suspended}}
+	assertEqual(authErrorToMessage(server, err), "Account has been suspended", t)
+	err.Reason = "spamming"
+	assertEqual(authErrorToMessage(server, err), "Account has been suspended: spamming", t)
+	err.Duration = 24 * time.Hour
+	assertEqual(authErrorToMessage(server, err), "Account has been suspended: spamming (until Mon, 02 Mar 2020 12:00:00 UTC)", t)
+}
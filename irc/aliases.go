@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// command aliases let the server accept additional commands (e.g., `ID`
+// or `OS`) that are rewritten into existing ones according to a template
+// from the config, e.g., `NS IDENTIFY $*`. In a template, `$1` through `$9`
+// are replaced with the corresponding parameter, `$1-` through `$9-` with
+// that parameter and all the following ones, `$*` with all the parameters,
+// and `$nick` with the client's current nickname. A template parameter that
+// consists only of `$*` or `$N-` is replaced with the client's parameters as
+// separate parameters, unless it is the trailing parameter (written with a
+// colon), in which case they are joined with spaces. Otherwise, each
+// parameter of the template is expanded separately, so parameters supplied
+// by the client can't add parameters to the rewritten command.
+
+var (
+	aliasTokenRegex = regexp.MustCompile(`\$(nick|\*|[1-9]-?)`)
+)
+
+type commandAlias struct {
+	name      string
+	command   string
+	params    []string
+	minParams int
+	trailing  bool // whether the last parameter of the template is a trailing one
+	// whether raw I/O logging must redact uses of the alias, because the
+	// rewritten command is sensitive (e.g., it contains a password)
+	sensitive bool
+}
+
+func compileAlias(name, template string) (alias *commandAlias, err error) {
+	name = strings.ToUpper(name)
+	if name == "" || strings.IndexAny(name, " :$") != -1 {
+		return nil, fmt.Errorf("invalid command alias name: %s", name)
+	}
+	if _, ok := Commands[name]; ok {
+		return nil, fmt.Errorf("command alias %s conflicts with an existing command", name)
+	}
+	msg, err := ircmsg.ParseLine(template)
+	if err != nil || len(msg.AllTags()) != 0 || msg.Prefix != "" {
+		return nil, fmt.Errorf("invalid template for command alias %s: %s", name, template)
+	}
+	if _, ok := Commands[msg.Command]; !ok {
+		return nil, fmt.Errorf("command alias %s refers to unknown command %s", name, msg.Command)
+	}
+	alias = &commandAlias{
+		name:    name,
+		command: msg.Command,
+		params:  msg.Params,
+		// tags and prefixes are disallowed, so the first " :" begins the trailing parameter
+		trailing: strings.Contains(template, " :"),
+	}
+	for _, param := range msg.Params {
+		for _, token := range aliasTokenRegex.FindAllStringSubmatch(param, -1) {
+			if n, err := strconv.Atoi(strings.TrimSuffix(token[1], "-")); err == nil && alias.minParams < n {
+				alias.minParams = n
+			}
+		}
+	}
+	alias.sensitive = redactRawLine(template, false, nil) != template
+	return alias, nil
+}
+
+// expand returns the rewritten command for a use of the alias, whose
+// parameters must already have been checked against minParams.
+func (alias *commandAlias) expand(msg ircmsg.IrcMessage, nick string) (result ircmsg.IrcMessage) {
+	result = msg // keep the tags, e.g., the label
+	result.Command = alias.command
+	result.Params = make([]string, 0, len(alias.params)+len(msg.Params))
+	for i, param := range alias.params {
+		if spliced, ok := alias.splice(param, i, msg.Params); ok {
+			result.Params = append(result.Params, spliced...)
+			continue
+		}
+		result.Params = append(result.Params, aliasTokenRegex.ReplaceAllStringFunc(param, func(token string) string {
+			switch token = token[1:]; token {
+			case "nick":
+				return nick
+			case "*":
+				return strings.Join(msg.Params, " ")
+			default:
+				n, _ := strconv.Atoi(strings.TrimSuffix(token, "-"))
+				if strings.HasSuffix(token, "-") {
+					return strings.Join(msg.Params[n-1:], " ")
+				}
+				return msg.Params[n-1]
+			}
+		}))
+	}
+	// omit trailing parameters that expanded to nothing (e.g., `$*` with
+	// no parameters), which the target command would treat as given
+	for len(result.Params) != 0 && result.Params[len(result.Params)-1] == "" {
+		result.Params = result.Params[:len(result.Params)-1]
+	}
+	return
+}
+
+// splice returns the client's parameters that replace the template
+// parameter at index i, if it stands for several separate parameters.
+func (alias *commandAlias) splice(param string, i int, params []string) (result []string, ok bool) {
+	if alias.trailing && i == len(alias.params)-1 {
+		return nil, false
+	}
+	if param == "$*" {
+		return params, true
+	}
+	if len(param) == 3 && param[0] == '$' && param[2] == '-' && '1' <= param[1] && param[1] <= '9' {
+		return params[param[1]-'1':], true
+	}
+	return nil, false
+}
+
+// resolve returns the command to run for a use of the alias, together with
+// the message to run it on.
+func (alias *commandAlias) resolve(msg ircmsg.IrcMessage, nick string) (Command, ircmsg.IrcMessage) {
+	if len(msg.Params) < alias.minParams {
+		// Command.Run will reject this with ERR_NEEDMOREPARAMS for the alias
+		return Command{
+			handler:      unknownCommandHandler,
+			usablePreReg: true,
+			minParams:    alias.minParams,
+		}, msg
+	}
+	expanded := alias.expand(msg, nick)
+	return Commands[expanded.Command], expanded
+}
+
+func (config *Config) processAliases() (err error) {
+	config.aliases = make(map[string]*commandAlias, len(config.Aliases))
+	for name, template := range config.Aliases {
+		alias, err := compileAlias(name, template)
+		if err != nil {
+			return err
+		}
+		if _, ok := config.aliases[alias.name]; ok {
+			return fmt.Errorf("duplicate command alias: %s", alias.name)
+		}
+		config.aliases[alias.name] = alias
+	}
+	return nil
+}
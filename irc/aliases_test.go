@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+func TestCompileAlias(t *testing.T) {
+	alias, err := compileAlias("id", "NS IDENTIFY $*")
+	assertEqual(err, nil, t)
+	assertEqual(alias.name, "ID", t)
+	assertEqual(alias.minParams, 0, t)
+	assertEqual(alias.sensitive, true, t)
+
+	alias, err = compileAlias("OS", "PRIVMSG OperServ :$1 $2-")
+	assertEqual(err, nil, t)
+	assertEqual(alias.minParams, 2, t)
+	assertEqual(alias.sensitive, false, t)
+
+	for _, bad := range [][2]string{
+		{"PRIVMSG", "NOTICE $1 :$2-"},
+		{"NS", "NICKSERV $*"},
+		{"FOO", "NOSUCHCOMMAND $*"},
+		{"FOO", "@tag=1 PRIVMSG $1 :$2-"},
+		{"FOO BAR", "PRIVMSG $1 :$2-"},
+		{"", "PRIVMSG $1 :$2-"},
+	} {
+		if _, err := compileAlias(bad[0], bad[1]); err == nil {
+			t.Errorf("expected alias %s: %s to be rejected", bad[0], bad[1])
+		}
+	}
+}
+
+func TestExpandAlias(t *testing.T) {
+	expand := func(template, line, nick string) ircmsg.IrcMessage {
+		t.Helper()
+		alias, err := compileAlias("ALIAS", template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg, err := ircmsg.ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, expanded := alias.resolve(msg, nick)
+		if cmd.minParams > len(expanded.Params) {
+			t.Fatalf("%s did not expand", line)
+		}
+		return expanded
+	}
+
+	msg := expand("NS IDENTIFY $*", "ALIAS dan hunter2", "dan")
+	assertEqual(msg.Command, "NS", t)
+	assertEqual(msg.Params, []string{"IDENTIFY", "dan", "hunter2"}, t)
+
+	msg = expand("NS IDENTIFY :$*", "ALIAS dan hunter2", "dan")
+	assertEqual(msg.Params, []string{"IDENTIFY", "dan hunter2"}, t)
+
+	msg = expand("KICK $1 $2- :bye", "ALIAS #chan dan shivaram", "dan")
+	assertEqual(msg.Params, []string{"#chan", "dan", "shivaram", "bye"}, t)
+
+	msg = expand("NS IDENTIFY $*", "ALIAS", "dan")
+	assertEqual(msg.Params, []string{"IDENTIFY"}, t)
+
+	msg = expand("PRIVMSG $1 :$nick says $2-", "@label=x ALIAS #chan :hello  world", "dan")
+	assertEqual(msg.Command, "PRIVMSG", t)
+	assertEqual(msg.Params, []string{"#chan", "dan says hello  world"}, t)
+	present, label := msg.GetTag("label")
+	assertEqual(present, true, t)
+	assertEqual(label, "x", t)
+
+	// client-supplied parameters can't inject parameters into the template:
+	msg = expand("KICK #chan $1 :kicked by $nick", "ALIAS :dan :hi", "shivaram")
+	assertEqual(msg.Params, []string{"#chan", "dan :hi", "kicked by shivaram"}, t)
+}
+
+func TestAliasMissingParams(t *testing.T) {
+	alias, err := compileAlias("SEND", "PRIVMSG $1 :$2-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, _ := ircmsg.ParseLine("SEND #chan")
+	cmd, resolved := alias.resolve(msg, "dan")
+	assertEqual(cmd.minParams, 2, t)
+	assertEqual(resolved.Command, "SEND", t)
+}
+
+func TestRedactAlias(t *testing.T) {
+	aliases := make(map[string]*commandAlias)
+	for name, template := range map[string]string{"ID": "NS IDENTIFY $*", "SAY": "PRIVMSG $1 :$2-"} {
+		alias, err := compileAlias(name, template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		aliases[name] = alias
+	}
+	assertEqual(redactRawLine("ID dan hunter2", false, aliases), "ID <redacted> <redacted>", t)
+	assertEqual(redactRawLine("SAY #chan :hi there", false, aliases), "SAY #chan :hi there", t)
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+const (
+	// pseudonyms in anonymous (+A) channels change this often:
+	anonPseudonymRotation = time.Hour
+	anonPseudonymPrefix   = "anon-"
+	anonPseudonymHost     = "anon@anonymous"
+)
+
+// anonSource records who was behind a pseudonym, for DEANONYMIZE.
+type anonSource struct {
+	nickMask    string
+	accountName string
+	ip          string
+	epoch       int64
+}
+
+// pseudonymFor returns the nickmask under which `client`'s messages are
+// relayed to an anonymous channel. It is stable for the current rotation
+// period, then changes unpredictably.
+func (channel *Channel) pseudonymFor(client *Client) (nickMask string) {
+	return channel.pseudonymAt(client, time.Now())
+}
+
+func (channel *Channel) pseudonymAt(client *Client, now time.Time) (nickMask string) {
+	details := client.Details()
+	identity := details.account
+	if identity == "" {
+		identity = "*" + details.nickCasefolded
+	}
+	epoch := now.Unix() / int64(anonPseudonymRotation/time.Second)
+
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+
+	if channel.anonSecret == "" {
+		channel.anonSecret = utils.GenerateSecretKey()
+	}
+	mac := hmac.New(sha256.New, []byte(channel.anonSecret))
+	mac.Write([]byte(identity))
+	mac.Write([]byte{0})
+	mac.Write([]byte(strconv.FormatInt(epoch, 10)))
+	nick := anonPseudonymPrefix + hex.EncodeToString(mac.Sum(nil))[:8]
+
+	// keep the sources for the current and previous periods only
+	if channel.anonSources == nil {
+		channel.anonSources = make(map[string]anonSource)
+	}
+	for pseudonym, source := range channel.anonSources {
+		if source.epoch < epoch-1 {
+			delete(channel.anonSources, pseudonym)
+		}
+	}
+	channel.anonSources[nick] = anonSource{
+		nickMask:    details.nickMask,
+		accountName: details.accountName,
+		ip:          client.IP().String(),
+		epoch:       epoch,
+	}
+	return nick + "!" + anonPseudonymHost
+}
+
+// deanonymize returns the client behind a recently used pseudonym.
+func (channel *Channel) deanonymize(pseudonym string) (source anonSource, ok bool) {
+	if bang := strings.IndexByte(pseudonym, '!'); bang != -1 {
+		pseudonym = pseudonym[:bang]
+	}
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	source, ok = channel.anonSources[strings.ToLower(pseudonym)]
+	return
+}
@@ -0,0 +1,78 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPseudonymStability(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	alice := newTestClient(server, "alice")
+	bob := newTestClient(server, "bob")
+
+	start := time.Unix(0, 0).Add(100 * anonPseudonymRotation)
+	first := channel.pseudonymAt(alice, start)
+	if again := channel.pseudonymAt(alice, start.Add(anonPseudonymRotation-time.Second)); again != first {
+		t.Errorf("pseudonym changed within a rotation period: %s != %s", first, again)
+	}
+	if other := channel.pseudonymAt(bob, start); other == first {
+		t.Errorf("two clients share the pseudonym %s", first)
+	}
+
+	// a different channel has a different secret
+	if other := newTestChannel(server, "#other").pseudonymAt(alice, start); other == first {
+		t.Errorf("pseudonym is shared across channels: %s", first)
+	}
+
+	source, ok := channel.deanonymize(first)
+	if !ok || source.nickMask != "alice!u@example.com" {
+		t.Errorf("could not deanonymize %s: %#v", first, source)
+	}
+}
+
+func TestPseudonymRotation(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	alice := newTestClient(server, "alice")
+
+	start := time.Unix(0, 0).Add(100 * anonPseudonymRotation)
+	first := channel.pseudonymAt(alice, start)
+	second := channel.pseudonymAt(alice, start.Add(anonPseudonymRotation))
+	if first == second {
+		t.Errorf("pseudonym did not rotate: %s", first)
+	}
+	// the previous period's pseudonym can still be traced
+	if _, ok := channel.deanonymize(first); !ok {
+		t.Errorf("previous pseudonym %s was pruned too early", first)
+	}
+	if _, ok := channel.deanonymize(second); !ok {
+		t.Errorf("could not deanonymize %s", second)
+	}
+}
+
+func TestPseudonymPruning(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	alice := newTestClient(server, "alice")
+	bob := newTestClient(server, "bob")
+
+	start := time.Unix(0, 0).Add(100 * anonPseudonymRotation)
+	first := channel.pseudonymAt(alice, start)
+	channel.pseudonymAt(alice, start.Add(anonPseudonymRotation))
+	// any use of the channel two periods later prunes the oldest sources
+	latest := channel.pseudonymAt(bob, start.Add(2*anonPseudonymRotation))
+
+	if _, ok := channel.deanonymize(first); ok {
+		t.Errorf("stale pseudonym %s was not pruned", first)
+	}
+	if _, ok := channel.deanonymize(latest); !ok {
+		t.Errorf("could not deanonymize %s", latest)
+	}
+	if len(channel.anonSources) != 2 {
+		t.Errorf("expected 2 remaining sources, got %d", len(channel.anonSources))
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oragono/oragono/irc/flatip"
+)
+
+// D-lines can ban entire autonomous systems (e.g., a hosting provider whose
+// IPs are rotated faster than CIDR bans can keep up with). This requires a
+// database mapping IP ranges to AS numbers, in the tab-separated format
+// published by https://iptoasn.com/ :
+//
+// range_start	range_end	AS_number	country_code	AS_description
+
+type asnRange struct {
+	start flatip.IP
+	end   flatip.IP // inclusive
+	asn   uint32
+}
+
+// ASNDatabase maps IP addresses to the autonomous systems announcing them.
+type ASNDatabase struct {
+	ranges []asnRange // sorted and nonoverlapping
+}
+
+// LoadASNDatabase loads an ASN database from a file.
+func LoadASNDatabase(filename string) (db *ASNDatabase, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	return parseASNDatabase(f)
+}
+
+func parseASNDatabase(r io.Reader) (db *ASNDatabase, err error) {
+	db = new(ASNDatabase)
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid ASN database entry on line %d", lineNo)
+		}
+		var entry asnRange
+		var startErr, endErr error
+		entry.start, startErr = flatip.ParseIP(fields[0])
+		entry.end, endErr = flatip.ParseIP(fields[1])
+		asn, asnErr := strconv.ParseUint(fields[2], 10, 32)
+		if startErr != nil || endErr != nil || asnErr != nil || compareIPs(entry.end, entry.start) < 0 {
+			return nil, fmt.Errorf("invalid ASN database entry on line %d", lineNo)
+		}
+		// AS0 means "not routed"
+		if asn == 0 {
+			continue
+		}
+		entry.asn = uint32(asn)
+		db.ranges = append(db.ranges, entry)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return compareIPs(db.ranges[i].start, db.ranges[j].start) < 0
+	})
+	for i := 1; i < len(db.ranges); i++ {
+		if compareIPs(db.ranges[i].start, db.ranges[i-1].end) <= 0 {
+			return nil, fmt.Errorf("overlapping ranges in ASN database: %s and %s", db.ranges[i-1].start, db.ranges[i].start)
+		}
+	}
+	return db, nil
+}
+
+func compareIPs(a, b flatip.IP) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+// Lookup returns the number of the autonomous system announcing the IP,
+// or 0 if it is unknown (including if no database is loaded).
+func (db *ASNDatabase) Lookup(ip flatip.IP) (asn uint32) {
+	if db == nil {
+		return 0
+	}
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return compareIPs(ip, db.ranges[i].end) <= 0
+	})
+	if i < len(db.ranges) && compareIPs(db.ranges[i].start, ip) <= 0 {
+		return db.ranges[i].asn
+	}
+	return 0
+}
+
+// parseASN parses an AS number in the form AS64496.
+func parseASN(str string) (asn uint32, ok bool) {
+	if len(str) < 3 || !strings.EqualFold(str[:2], "AS") {
+		return
+	}
+	val, err := strconv.ParseUint(str[2:], 10, 32)
+	if err != nil || val == 0 {
+		return
+	}
+	return uint32(val), true
+}
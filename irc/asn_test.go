@@ -0,0 +1,113 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/buntdb"
+
+	"github.com/oragono/oragono/irc/flatip"
+)
+
+const testASNDatabase = `1.0.0.0	1.0.0.255	13335	US	CLOUDFLARENET
+1.0.1.0	1.0.3.255	0	None	Not routed
+192.0.2.0	192.0.2.127	64496	ZZ	EXAMPLE-HOSTING
+2001:db8::	2001:db8:ffff:ffff:ffff:ffff:ffff:ffff	64497	ZZ	EXAMPLE-V6
+`
+
+func TestASNDatabase(t *testing.T) {
+	db, err := parseASNDatabase(strings.NewReader(testASNDatabase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(ipStr string) uint32 {
+		ip, err := flatip.ParseIP(ipStr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db.Lookup(ip)
+	}
+	assertEqual(lookup("1.0.0.1"), uint32(13335), t)
+	assertEqual(lookup("1.0.2.1"), uint32(0), t)
+	assertEqual(lookup("192.0.2.0"), uint32(64496), t)
+	assertEqual(lookup("192.0.2.127"), uint32(64496), t)
+	assertEqual(lookup("192.0.2.128"), uint32(0), t)
+	assertEqual(lookup("2001:db8::1"), uint32(64497), t)
+	assertEqual(lookup("8.8.8.8"), uint32(0), t)
+
+	var nilDB *ASNDatabase
+	assertEqual(nilDB.Lookup(flatip.IPv4(192, 0, 2, 1)), uint32(0), t)
+
+	_, err = parseASNDatabase(strings.NewReader("192.0.2.0\t192.0.2.255\t1\n192.0.2.128\t192.0.3.0\t2\n"))
+	if err == nil {
+		t.Errorf("accepted overlapping ranges")
+	}
+	_, err = parseASNDatabase(strings.NewReader("192.0.2.0\tbogus\t1\n"))
+	if err == nil {
+		t.Errorf("accepted invalid range")
+	}
+}
+
+func TestParseDlineTarget(t *testing.T) {
+	target, err := parseDlineTarget("as64496")
+	assertEqual(err, nil, t)
+	assertEqual(target.String(), "AS64496", t)
+
+	target, err = parseDlineTarget("192.0.2.1")
+	assertEqual(err, nil, t)
+	assertEqual(target.String(), "192.0.2.1/32", t)
+	assertEqual(target.Display(), "192.0.2.1", t)
+
+	target, err = parseDlineTarget("*.VPS.example.com")
+	assertEqual(err, nil, t)
+	assertEqual(target.String(), "*.vps.example.com", t)
+
+	for _, invalid := range []string{"AS0", "192.0.2.300", "*!*@example.com", "10.0.*"} {
+		if _, err := parseDlineTarget(invalid); err == nil {
+			t.Errorf("accepted invalid D-line target %s", invalid)
+		}
+	}
+}
+
+func TestHostnameAndASNDlines(t *testing.T) {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	server := newTestServer()
+	server.store = store
+	dm := NewDLineManager(server)
+
+	hostTarget, _ := parseDlineTarget("*.vps.example.com")
+	asnTarget, _ := parseDlineTarget("AS64496")
+	assertEqual(dm.AddTarget(hostTarget, 0, "vps", "", "admin"), nil, t)
+	assertEqual(dm.AddTarget(asnTarget, time.Hour, "hosting", "", "admin"), nil, t)
+
+	banned, info := dm.CheckHostname("Node1.VPS.example.com")
+	assertEqual(banned, true, t)
+	assertEqual(info.Reason, "vps", t)
+	banned, _ = dm.CheckHostname("vps.example.com.evil")
+	assertEqual(banned, false, t)
+	banned, info = dm.CheckASN(64496)
+	assertEqual(banned, true, t)
+	assertEqual(info.Reason, "hosting", t)
+	banned, _ = dm.CheckASN(64497)
+	assertEqual(banned, false, t)
+
+	// bans are persisted, and reloaded on startup:
+	reloaded := NewDLineManager(server)
+	allBans := reloaded.AllBans()
+	assertEqual(len(allBans), 2, t)
+	assertEqual(allBans["AS64496"].Reason, "hosting", t)
+	assertEqual(allBans["*.vps.example.com"].Reason, "vps", t)
+
+	assertEqual(dm.RemoveTarget(asnTarget), nil, t)
+	assertEqual(dm.RemoveTarget(asnTarget), errNoExistingBan, t)
+	banned, _ = dm.CheckASN(64496)
+	assertEqual(banned, false, t)
+}
@@ -4,11 +4,19 @@
 package irc
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/oragono/oragono/irc/utils"
 )
@@ -29,12 +37,19 @@ type AuthScriptOutput struct {
 	Error       string `json:"error"`
 }
 
-func CheckAuthScript(sem utils.Semaphore, config ScriptConfig, input AuthScriptInput) (output AuthScriptOutput, err error) {
+// CheckAuthScript checks credentials against the configured external
+// authentication source: an OAuth2 token endpoint, an HTTP endpoint, or
+// (by default) a script.
+func CheckAuthScript(sem utils.Semaphore, config AuthScriptConfig, input AuthScriptInput) (output AuthScriptOutput, err error) {
 	if sem != nil {
 		sem.Acquire()
 		defer sem.Release()
 	}
 
+	if config.OAuth2.Enabled {
+		return checkAuthOAuth2(config, input)
+	}
+
 	// PEM-encode the peer certificates before applying JSON
 	if len(input.peerCerts) != 0 {
 		input.PeerCerts = make([]string, len(input.peerCerts))
@@ -47,7 +62,12 @@ func CheckAuthScript(sem utils.Semaphore, config ScriptConfig, input AuthScriptI
 	if err != nil {
 		return
 	}
-	outBytes, err := RunScript(config.Command, config.Args, inputBytes, config.Timeout, config.KillTimeout)
+	var outBytes []byte
+	if config.URL != "" {
+		outBytes, err = checkAuthHTTP(config, inputBytes)
+	} else {
+		outBytes, err = RunScript(config.Command, config.Args, inputBytes, config.Timeout, config.KillTimeout)
+	}
 	if err != nil {
 		return
 	}
@@ -62,6 +82,139 @@ func CheckAuthScript(sem utils.Semaphore, config ScriptConfig, input AuthScriptI
 	return
 }
 
+// checkAuthHTTP POSTs the JSON input to the configured URL; the response body
+// is the same JSON output that a script would produce.
+func checkAuthHTTP(config AuthScriptConfig, inputBytes []byte) (outBytes []byte, err error) {
+	httpClient := http.Client{Timeout: config.Timeout}
+	resp, err := httpClient.Post(config.URL, "application/json", bytes.NewReader(inputBytes))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Authentication endpoint returned status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// checkAuthOAuth2 performs an OAuth2 resource owner password credentials
+// grant (RFC 6749, section 4.3) against the configured token endpoint; the
+// token itself is discarded, since its issuance is what proves the password.
+func checkAuthOAuth2(config AuthScriptConfig, input AuthScriptInput) (output AuthScriptOutput, err error) {
+	if input.Passphrase == "" {
+		return // only passphrases can be checked this way, not certificates
+	}
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("username", input.AccountName)
+	form.Set("password", input.Passphrase)
+	if len(config.OAuth2.Scopes) != 0 {
+		form.Set("scope", strings.Join(config.OAuth2.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", config.OAuth2.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if config.OAuth2.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(config.OAuth2.ClientID), url.QueryEscape(config.OAuth2.ClientSecret))
+	}
+
+	httpClient := http.Client{Timeout: config.Timeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var token struct {
+			AccessToken string `json:"access_token"`
+		}
+		if err = json.NewDecoder(resp.Body).Decode(&token); err != nil {
+			return
+		}
+		output.Success = token.AccessToken != ""
+		output.AccountName = input.AccountName
+	case http.StatusBadRequest, http.StatusUnauthorized:
+		// invalid_grant (bad credentials) or invalid_client; either way, no login
+	default:
+		err = fmt.Errorf("OAuth2 token endpoint returned status %d", resp.StatusCode)
+	}
+	return
+}
+
+// authScriptCache remembers successful external authentications for
+// accounts.auth-script.cache-duration, to spare the external source from
+// checking the same credentials on every reconnection. Only a hash of the
+// credentials is kept.
+type authScriptCache struct {
+	sync.Mutex
+	entries map[[sha256.Size]byte]authScriptCacheEntry
+}
+
+type authScriptCacheEntry struct {
+	accountName string
+	expires     time.Time
+}
+
+func authScriptCacheKey(input AuthScriptInput) [sha256.Size]byte {
+	return sha256.Sum256([]byte(input.AccountName + "\x00" + input.Passphrase + "\x00" + input.Certfp))
+}
+
+func (cache *authScriptCache) get(input AuthScriptInput) (accountName string, ok bool) {
+	key := authScriptCacheKey(input)
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[key]
+	if ok && time.Now().After(entry.expires) {
+		delete(cache.entries, key)
+		return "", false
+	}
+	return entry.accountName, ok
+}
+
+func (cache *authScriptCache) add(input AuthScriptInput, accountName string, duration time.Duration) {
+	key := authScriptCacheKey(input)
+	now := time.Now()
+	cache.Lock()
+	defer cache.Unlock()
+	if cache.entries == nil {
+		cache.entries = make(map[[sha256.Size]byte]authScriptCacheEntry)
+	}
+	for k, entry := range cache.entries {
+		if now.After(entry.expires) {
+			delete(cache.entries, k)
+		}
+	}
+	cache.entries[key] = authScriptCacheEntry{accountName: accountName, expires: now.Add(duration)}
+}
+
+// checkAuthScript runs the external authentication check, consulting the
+// cache first; on success, it maps the external identity to a local account.
+func (am *AccountManager) checkAuthScript(config *Config, input AuthScriptInput) (output AuthScriptOutput, err error) {
+	scriptConfig := &config.Accounts.AuthScript
+	if scriptConfig.CacheDuration > 0 {
+		if accountName, ok := am.authScriptCache.get(input); ok {
+			return AuthScriptOutput{AccountName: accountName, Success: true}, nil
+		}
+	}
+	output, err = CheckAuthScript(am.server.semaphores.AuthScript, *scriptConfig, input)
+	if err != nil || !output.Success {
+		return
+	}
+	if output.AccountName == "" {
+		output.AccountName = input.AccountName
+	}
+	if output.AccountName != "" {
+		output.AccountName = scriptConfig.mapAccount(output.AccountName)
+	}
+	if scriptConfig.CacheDuration > 0 {
+		am.authScriptCache.add(input, output.AccountName, scriptConfig.CacheDuration)
+	}
+	return
+}
+
 type IPScriptResult uint
 
 const (
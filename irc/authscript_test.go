@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuthOAuth2(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, _, _ := r.BasicAuth()
+		if r.Form.Get("grant_type") != "password" || clientID != "oragono" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Form.Get("username") == "alice" && r.Form.Get("password") == "hunter2" {
+			w.Write([]byte(`{"access_token": "abc", "token_type": "bearer"}`))
+		} else if r.Form.Get("username") == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+		}
+	}))
+	defer ts.Close()
+
+	var config AuthScriptConfig
+	config.Timeout = time.Second
+	config.OAuth2.Enabled = true
+	config.OAuth2.TokenURL = ts.URL
+	config.OAuth2.ClientID = "oragono"
+
+	output, err := CheckAuthScript(nil, config, AuthScriptInput{AccountName: "alice", Passphrase: "hunter2"})
+	if err != nil || !output.Success || output.AccountName != "alice" {
+		t.Errorf("valid credentials were rejected: %#v %v", output, err)
+	}
+	output, err = CheckAuthScript(nil, config, AuthScriptInput{AccountName: "alice", Passphrase: "wrong"})
+	if err != nil || output.Success {
+		t.Errorf("invalid credentials were accepted: %#v %v", output, err)
+	}
+	if _, err = CheckAuthScript(nil, config, AuthScriptInput{AccountName: "broken", Passphrase: "x"}); err == nil {
+		t.Errorf("server errors should be reported")
+	}
+	output, err = CheckAuthScript(nil, config, AuthScriptInput{Certfp: "abcd"})
+	if err != nil || output.Success {
+		t.Errorf("certfps can't be checked via OAuth2: %#v %v", output, err)
+	}
+}
+
+func TestAuthHTTP(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"accountName": "Jdoe@Example.com", "success": true}`))
+	}))
+	defer ts.Close()
+
+	var config AuthScriptConfig
+	config.Timeout = time.Second
+	config.URL = ts.URL
+	config.AccountMap = map[string]string{"jdoe@example.com": "jdoe"}
+
+	output, err := CheckAuthScript(nil, config, AuthScriptInput{AccountName: "x", Passphrase: "y"})
+	if err != nil || !output.Success || output.AccountName != "Jdoe@Example.com" {
+		t.Errorf("unexpected output: %#v %v", output, err)
+	}
+	if mapped := config.mapAccount(output.AccountName); mapped != "jdoe" {
+		t.Errorf("identity was not mapped: %s", mapped)
+	}
+	if unmapped := config.mapAccount("someone"); unmapped != "someone" {
+		t.Errorf("unmapped identity was changed: %s", unmapped)
+	}
+}
+
+func TestAuthScriptCache(t *testing.T) {
+	var cache authScriptCache
+	input := AuthScriptInput{AccountName: "alice", Passphrase: "hunter2"}
+	if _, ok := cache.get(input); ok {
+		t.Errorf("empty cache returned an entry")
+	}
+	cache.add(input, "alice", time.Hour)
+	if account, ok := cache.get(input); !ok || account != "alice" {
+		t.Errorf("cached entry was not found")
+	}
+	if _, ok := cache.get(AuthScriptInput{AccountName: "alice", Passphrase: "wrong"}); ok {
+		t.Errorf("cache matched a different passphrase")
+	}
+	expired := AuthScriptInput{Certfp: "abcd"}
+	cache.add(expired, "bob", -time.Second)
+	if _, ok := cache.get(expired); ok {
+		t.Errorf("expired entry was returned")
+	}
+}
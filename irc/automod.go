@@ -0,0 +1,330 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// ChanServ's built-in moderation for registered channels: the autokick list
+// (CS AKICK), whose entries are kickbanned on sight, and the badword list
+// (CS BADWORDS), which is checked against every message sent to the channel.
+
+// BadwordAction is what happens to a message containing a badword.
+type BadwordAction uint
+
+const (
+	// BadwordCensor replaces the word with asterisks
+	BadwordCensor BadwordAction = iota
+	// BadwordKick drops the message and kicks its sender
+	BadwordKick
+	// BadwordBan drops the message and kickbans its sender
+	BadwordBan
+)
+
+func badwordActionFromString(str string) (result BadwordAction, err error) {
+	switch strings.ToLower(str) {
+	case "censor":
+		return BadwordCensor, nil
+	case "kick":
+		return BadwordKick, nil
+	case "ban":
+		return BadwordBan, nil
+	default:
+		return BadwordCensor, errInvalidParams
+	}
+}
+
+func (action BadwordAction) String() string {
+	switch action {
+	case BadwordKick:
+		return "kick"
+	case BadwordBan:
+		return "ban"
+	default:
+		return "censor"
+	}
+}
+
+// Badword is an entry on a channel's badword list: a glob that is matched
+// against each word of a message, case-insensitively.
+type Badword struct {
+	Pattern        string
+	Action         BadwordAction
+	CreatorAccount string
+	TimeCreated    time.Time
+}
+
+type badwordMatcher struct {
+	pattern *regexp.Regexp
+	action  BadwordAction
+}
+
+func compileBadwords(badwords []Badword) (result []badwordMatcher) {
+	for _, badword := range badwords {
+		if pattern, err := utils.CompileGlob(badword.Pattern, false); err == nil {
+			result = append(result, badwordMatcher{pattern: pattern, action: badword.Action})
+		}
+	}
+	return
+}
+
+// compileCensorWords compiles the network-wide censor list for channel mode +G.
+func compileCensorWords(words []string) (result []badwordMatcher, err error) {
+	badwords := make([]Badword, len(words))
+	for i, word := range words {
+		if badwords[i].Pattern, err = canonicalizeBadword(word); err != nil {
+			return nil, fmt.Errorf("invalid channels.censor-words entry: %s", word)
+		}
+	}
+	return compileBadwords(badwords), nil
+}
+
+// canonicalizeBadword validates a badword pattern, which must be a single word
+// (optionally with wildcards).
+func canonicalizeBadword(pattern string) (result string, err error) {
+	result = strings.ToLower(pattern)
+	if result == "" || strings.Trim(result, "*?") == "" {
+		return "", errInvalidParams
+	}
+	for _, r := range result {
+		if !(isWordRune(r) || r == '*' || r == '?') {
+			return "", errInvalidParams
+		}
+	}
+	return
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '\''
+}
+
+// censorLine matches each word of a line against the badwords, returning the
+// line with censored words replaced by asterisks, and the strongest action
+// of any badword that matched.
+func censorLine(line string, matchers []badwordMatcher) (result string, action BadwordAction, matched bool) {
+	var buf strings.Builder
+	runes := []rune(line)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			buf.WriteRune(runes[i])
+			i++
+			continue
+		}
+		j := i
+		for j < len(runes) && isWordRune(runes[j]) {
+			j++
+		}
+		word := string(runes[i:j])
+		censored := false
+		for _, matcher := range matchers {
+			if matcher.pattern.MatchString(strings.ToLower(word)) {
+				if !matched || action < matcher.action {
+					action = matcher.action
+				}
+				matched, censored = true, true
+			}
+		}
+		if censored {
+			buf.WriteString(strings.Repeat("*", j-i))
+		} else {
+			buf.WriteString(word)
+		}
+		i = j
+	}
+	return buf.String(), action, matched
+}
+
+// censorMessage applies censorLine to every line of a message.
+func censorMessage(message utils.SplitMessage, matchers []badwordMatcher) (result utils.SplitMessage, action BadwordAction, matched bool) {
+	result = message
+	apply := func(line string) string {
+		censored, lineAction, lineMatched := censorLine(line, matchers)
+		if lineMatched {
+			if !matched || action < lineAction {
+				action = lineAction
+			}
+			matched = true
+		}
+		return censored
+	}
+	result.Message = apply(message.Message)
+	if message.Split != nil {
+		result.Split = make([]utils.MessagePair, len(message.Split))
+		for i, pair := range message.Split {
+			result.Split[i] = utils.MessagePair{Message: apply(pair.Message), Concat: pair.Concat}
+		}
+	}
+	return
+}
+
+// canonicalizeAkick canonicalizes an autokick entry: either a hostmask or
+// extban, or the name of an account, which is stored as an ~a: extban.
+func canonicalizeAkick(target string) (result string, err error) {
+	if !strings.HasPrefix(target, extbanPrefix) && !strings.ContainsAny(target, "!@*?") {
+		target = fmt.Sprintf("%sa:%s", extbanPrefix, target)
+	}
+	if kind, _, isExtban := splitExtban(target); (isExtban && kind == extbanMute) || strings.HasPrefix(target, "m:") {
+		return "", errInvalidParams
+	}
+	return canonicalizeListMask(target)
+}
+
+// Badwords returns the channel's badword list.
+func (channel *Channel) Badwords() (result []Badword) {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	return append(result, channel.badwords...)
+}
+
+// SetBadwords replaces the channel's badword list.
+func (channel *Channel) SetBadwords(badwords []Badword) {
+	matchers := compileBadwords(badwords)
+	channel.stateMutex.Lock()
+	channel.badwords = badwords
+	channel.badwordMatchers = matchers
+	channel.stateMutex.Unlock()
+	channel.MarkDirty(IncludeLists)
+}
+
+// applyBadwords checks a message from `client` against the badword list;
+// members with halfop or higher are exempt. It returns the (possibly
+// censored) message, or ok=false if the message was dropped, in which case
+// the sender has been kicked or kickbanned.
+func (channel *Channel) applyBadwords(client *Client, message utils.SplitMessage) (result utils.SplitMessage, ok bool) {
+	channel.stateMutex.RLock()
+	matchers := channel.badwordMatchers
+	channel.stateMutex.RUnlock()
+
+	if len(matchers) == 0 || channel.ClientIsAtLeast(client, modes.Halfop) {
+		return message, true
+	}
+	result, action, matched := censorMessage(message, matchers)
+	if !matched {
+		return result, true
+	}
+	channel.server.webhooks.Send(WebhookAutomod, webhookData{
+		"type":    "badword",
+		"action":  action.String(),
+		"channel": channel.Name(),
+		"message": splitMessageText(message),
+		"client":  webhookClientData(client, client.Details()),
+	})
+	if action == BadwordCensor {
+		return result, true
+	}
+	if action == BadwordBan {
+		channel.serviceBan(chanservService.prefix, fmt.Sprintf("*!*@%s", client.Hostname()))
+	}
+	channel.serviceKick(chanservService.prefix, client, client.t("Your message contained a forbidden word"))
+	return result, false
+}
+
+// applyCensor replaces words on the network's censor list with asterisks, if
+// the channel has mode +G. Unlike the badword list, nobody is exempt.
+func (channel *Channel) applyCensor(message utils.SplitMessage) utils.SplitMessage {
+	matchers := channel.server.Config().Channels.censorMatchers
+	if len(matchers) == 0 || !channel.flags.HasMode(modes.Censor) {
+		return message
+	}
+	result, _, _ := censorMessage(message, matchers)
+	return result
+}
+
+// splitMessageText returns the text of a message, with the lines of
+// a multiline message separated by newlines
+func splitMessageText(message utils.SplitMessage) string {
+	if message.Split == nil {
+		return message.Message
+	}
+	lines := make([]string, len(message.Split))
+	for i, line := range message.Split {
+		lines[i] = line.Message
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reportAutokick sends the webhook event for an autokick
+func (channel *Channel) reportAutokick(client *Client, mask string) {
+	channel.server.webhooks.Send(WebhookAutomod, webhookData{
+		"type":    "autokick",
+		"action":  "ban",
+		"channel": channel.Name(),
+		"mask":    mask,
+		"client":  webhookClientData(client, client.Details()),
+	})
+}
+
+// isAutokickExempt returns whether a client is exempt from autokicks by
+// ban or invite exceptions.
+func (channel *Channel) isAutokickExempt(client *Client) bool {
+	return channel.lists[modes.ExceptMask].MatchClient(client) ||
+		channel.lists[modes.InviteMask].MatchClient(client)
+}
+
+// checkAutokick returns the autokick entry that `client` matches, if any.
+func (channel *Channel) checkAutokick(client *Client) (mask string, info MaskInfo, autokicked bool) {
+	if channel.akicks.Length() == 0 || !channel.akicks.MatchClient(client) || channel.isAutokickExempt(client) {
+		return
+	}
+	// find the entry that matched, for its reason:
+	for mask, info := range channel.akicks.Masks() {
+		if autokickEntryMatches(mask, info, client) {
+			return mask, info, true
+		}
+	}
+	return
+}
+
+func autokickEntryMatches(mask string, info MaskInfo, client *Client) bool {
+	var entry UserMaskSet
+	entry.SetMasks(map[string]MaskInfo{mask: info})
+	return entry.MatchClient(client)
+}
+
+func autokickReason(info MaskInfo) string {
+	if info.Reason != "" {
+		return info.Reason
+	}
+	return "Autokicked"
+}
+
+// applyAutokick bans an autokick entry and kicks the current members who
+// match it; members with halfop or higher are exempt.
+func (channel *Channel) applyAutokick(source, mask string, info MaskInfo) {
+	channel.serviceBan(source, mask)
+	for _, member := range channel.Members() {
+		if autokickEntryMatches(mask, info, member) && !channel.isAutokickExempt(member) &&
+			!channel.ClientIsAtLeast(member, modes.Halfop) {
+			channel.reportAutokick(member, mask)
+			channel.serviceKick(source, member, autokickReason(info))
+		}
+	}
+}
+
+// serviceBan adds a ban on behalf of a service, whose prefix is `source`.
+func (channel *Channel) serviceBan(source, mask string) {
+	added, err := channel.lists[modes.BanMask].Add(mask, source, "")
+	if err != nil || added == "" {
+		return
+	}
+	channel.MarkDirty(IncludeLists)
+	change := modes.ModeChange{Mode: modes.BanMask, Op: modes.Add, Arg: added}
+	announceCmodeChanges(channel, modes.ModeChanges{change}, source, "*", "", nil)
+}
+
+// serviceKick kicks a member on behalf of a service.
+func (channel *Channel) serviceKick(source string, target *Client, comment string) {
+	if !channel.hasClient(target) {
+		return
+	}
+	channel.kickInternal(source, "*", "", target, comment, nil)
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+func TestCanonicalizeBadword(t *testing.T) {
+	for _, good := range []string{"Darn", "darn*", "d?rn", "don't"} {
+		if _, err := canonicalizeBadword(good); err != nil {
+			t.Errorf("rejected valid badword %s", good)
+		}
+	}
+	for _, bad := range []string{"", "*", "*?", "two words", "dar.n"} {
+		if _, err := canonicalizeBadword(bad); err == nil {
+			t.Errorf("accepted invalid badword %s", bad)
+		}
+	}
+	result, _ := canonicalizeBadword("DARN*")
+	assertEqual(result, "darn*", t)
+}
+
+func TestCensorLine(t *testing.T) {
+	matchers := compileBadwords([]Badword{
+		{Pattern: "darn*"},
+		{Pattern: "heck", Action: BadwordKick},
+	})
+
+	result, _, matched := censorLine("nothing to see here", matchers)
+	assertEqual(result, "nothing to see here", t)
+	assertEqual(matched, false, t)
+
+	result, action, matched := censorLine("Darnit, that's darn annoying", matchers)
+	assertEqual(result, "******, that's **** annoying", t)
+	assertEqual(action, BadwordCensor, t)
+	assertEqual(matched, true, t)
+
+	// only whole words match:
+	result, _, matched = censorLine("checking", matchers)
+	assertEqual(result, "checking", t)
+	assertEqual(matched, false, t)
+
+	// the strongest action wins:
+	result, action, _ = censorLine("what the HECK, darn", matchers)
+	assertEqual(result, "what the ****, ****", t)
+	assertEqual(action, BadwordKick, t)
+
+	var message utils.SplitMessage
+	message.Append("fine", false)
+	message.Append("heck", false)
+	censored, action, matched := censorMessage(message, matchers)
+	assertEqual(censored.Split[1].Message, "****", t)
+	assertEqual(message.Split[1].Message, "heck", t)
+	assertEqual(action, BadwordKick, t)
+	assertEqual(matched, true, t)
+}
+
+func TestCompileCensorWords(t *testing.T) {
+	matchers, err := compileCensorWords([]string{"Darn", "heck*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, action, _ := censorLine("darn it, HECKIN' heck", matchers)
+	assertEqual(result, "**** it, ******* ****", t)
+	// censor words never kick or ban:
+	assertEqual(action, BadwordCensor, t)
+
+	if _, err := compileCensorWords([]string{"darn", "two words"}); err == nil {
+		t.Errorf("accepted an invalid censor word")
+	}
+	matchers, err = compileCensorWords(nil)
+	assertEqual(len(matchers), 0, t)
+	assertEqual(err, nil, t)
+}
+
+func TestCanonicalizeAkick(t *testing.T) {
+	result, err := canonicalizeAkick("Spammer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(result, "~a:spammer", t)
+
+	result, err = canonicalizeAkick("*!*@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(result, "*!*@example.com", t)
+
+	if _, err := canonicalizeAkick("~m:*!*@*"); err == nil {
+		t.Errorf("accepted a mute extban as an autokick")
+	}
+}
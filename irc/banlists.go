@@ -0,0 +1,419 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tidwall/buntdb"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// import and export of K-lines and D-lines, for migrating ban lists
+// between servers (including from other ircds). two formats are supported:
+// "plain", one mask per line, optionally followed by a reason (and, after
+// a "|", an oper reason), and "json", which preserves all ban metadata:
+//
+// {"version": 1, "bans": [{"type": "dline", "mask": "192.0.2.0/24",
+//   "reason": "...", "oper_reason": "...", "oper_name": "...",
+//   "created": "2020-01-01T00:00:00Z", "expires": "2020-02-01T00:00:00Z"}]}
+//
+// "type" may be omitted, in which case it is inferred from the mask.
+// "created" and "expires" may be omitted; a ban without "expires" is permanent.
+
+const (
+	banListVersion = 1
+
+	banListFormatPlain = "plain"
+	banListFormatJSON  = "json"
+)
+
+var (
+	errInvalidBanListFormat = errors.New("Invalid ban list format (must be plain or json)")
+)
+
+type banListEntry struct {
+	Type       string     `json:"type,omitempty"`
+	Mask       string     `json:"mask"`
+	Reason     string     `json:"reason,omitempty"`
+	OperReason string     `json:"oper_reason,omitempty"`
+	OperName   string     `json:"oper_name,omitempty"`
+	Created    *time.Time `json:"created,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+type banList struct {
+	Version int            `json:"version"`
+	Bans    []banListEntry `json:"bans"`
+}
+
+// a validated entry from an imported ban list
+type importedBan struct {
+	dline  bool
+	target dlineTarget // if dline
+	mask   string      // canonical form, as used in the datastore
+	info   IPBanInfo
+}
+
+// BanImportResult summarizes the outcome of a ban list import.
+type BanImportResult struct {
+	Added    int
+	Replaced int
+	// bans that were skipped because a ban already exists on the same mask
+	Kept int
+	// bans that had already expired
+	Expired int
+	// validation and persistence errors, one per rejected entry
+	Errors []string
+}
+
+func (result *BanImportResult) Summary() string {
+	return fmt.Sprintf("%d added, %d replaced, %d kept, %d expired, %d invalid",
+		result.Added, result.Replaced, result.Kept, result.Expired, len(result.Errors))
+}
+
+// isDLineMask infers whether an untyped mask is a D-line (D-lines on
+// hostname globs must be given an explicit type)
+func isDLineMask(mask string) bool {
+	if _, ok := parseASN(mask); ok {
+		return true
+	}
+	return !strings.ContainsAny(mask, "!@*?") && (strings.Contains(mask, ".") || strings.Contains(mask, ":"))
+}
+
+func parseBanListEntry(entry banListEntry, defaultOperName string, now time.Time) (ban importedBan, expired bool, err error) {
+	entry.Mask = strings.TrimSpace(entry.Mask)
+	if entry.Mask == "" {
+		return ban, false, errors.New("empty mask")
+	}
+
+	switch strings.ToLower(entry.Type) {
+	case "dline":
+		ban.dline = true
+	case "kline":
+		ban.dline = false
+	case "":
+		ban.dline = isDLineMask(entry.Mask)
+	default:
+		return ban, false, fmt.Errorf("unknown ban type %s", entry.Type)
+	}
+
+	if ban.dline {
+		ban.target, err = parseDlineTarget(entry.Mask)
+		if err != nil {
+			return ban, false, fmt.Errorf("invalid IP, CIDR, hostname, or ASN %s", entry.Mask)
+		}
+		ban.mask = ban.target.String()
+	} else {
+		ban.mask, err = CanonicalizeMaskWildcard(entry.Mask)
+		if err == nil {
+			_, err = utils.CompileGlob(ban.mask, false)
+		}
+		if err != nil {
+			return ban, false, fmt.Errorf("invalid mask %s", entry.Mask)
+		}
+	}
+
+	ban.info = IPBanInfo{
+		Reason:      entry.Reason,
+		OperReason:  entry.OperReason,
+		OperName:    entry.OperName,
+		TimeCreated: now,
+	}
+	if ban.info.Reason == "" {
+		ban.info.Reason = "No reason given"
+	}
+	if ban.info.OperName == "" {
+		ban.info.OperName = defaultOperName
+	}
+	if entry.Created != nil && !entry.Created.IsZero() {
+		ban.info.TimeCreated = entry.Created.UTC()
+	}
+	if entry.Expires != nil && !entry.Expires.IsZero() {
+		if !entry.Expires.After(now) {
+			return ban, true, nil
+		}
+		if ban.info.TimeCreated.After(*entry.Expires) {
+			ban.info.TimeCreated = now
+		}
+		ban.info.Duration = entry.Expires.Sub(ban.info.TimeCreated)
+	}
+	return ban, false, nil
+}
+
+// parseBanList validates a ban list; entries that fail validation are reported
+// in the result rather than aborting the whole import.
+func parseBanList(data []byte, format, defaultOperName string) (bans []importedBan, result BanImportResult, err error) {
+	format = strings.ToLower(format)
+	if format == "" {
+		if trimmed := bytes.TrimSpace(data); len(trimmed) != 0 && trimmed[0] == '{' {
+			format = banListFormatJSON
+		} else {
+			format = banListFormatPlain
+		}
+	}
+
+	var entries []banListEntry
+	var labels []string
+	switch format {
+	case banListFormatJSON:
+		var list banList
+		if err = json.Unmarshal(data, &list); err != nil {
+			return
+		}
+		if list.Version > banListVersion {
+			err = fmt.Errorf("Unsupported ban list version %d", list.Version)
+			return
+		}
+		entries = list.Bans
+		labels = make([]string, len(entries))
+		for i := range entries {
+			labels[i] = fmt.Sprintf("entry %d", i+1)
+		}
+	case banListFormatPlain:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		lineNo := 0
+		for scanner.Scan() {
+			lineNo++
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			// mask [reason [| oper reason]], as in the arguments to KLINE and DLINE
+			entry := banListEntry{Mask: line}
+			if idx := strings.IndexAny(line, " \t"); idx != -1 {
+				entry.Mask = line[:idx]
+				reasons := strings.SplitN(line[idx+1:], "|", 2)
+				entry.Reason = strings.TrimSpace(reasons[0])
+				if len(reasons) == 2 {
+					entry.OperReason = strings.TrimSpace(reasons[1])
+				}
+			}
+			entries = append(entries, entry)
+			labels = append(labels, fmt.Sprintf("line %d", lineNo))
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+	default:
+		err = errInvalidBanListFormat
+		return
+	}
+
+	now := time.Now().UTC()
+	for i, entry := range entries {
+		ban, expired, entryErr := parseBanListEntry(entry, defaultOperName, now)
+		if entryErr != nil {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", labels[i], entryErr.Error()))
+		} else if expired {
+			result.Expired++
+		} else {
+			bans = append(bans, ban)
+		}
+	}
+	return
+}
+
+// serializeBanList produces a ban list containing the given D-lines and K-lines
+func serializeBanList(dlines, klines map[string]IPBanInfo, format string) (data []byte, err error) {
+	switch strings.ToLower(format) {
+	case "", banListFormatJSON:
+		list := banList{Version: banListVersion, Bans: make([]banListEntry, 0, len(dlines)+len(klines))}
+		appendBans := func(banType string, bans map[string]IPBanInfo) {
+			for _, mask := range sortedBanMasks(bans) {
+				info := bans[mask]
+				created := info.TimeCreated
+				entry := banListEntry{
+					Type:       banType,
+					Mask:       mask,
+					Reason:     info.Reason,
+					OperReason: info.OperReason,
+					OperName:   info.OperName,
+					Created:    &created,
+				}
+				if info.Duration != 0 {
+					expires := info.TimeCreated.Add(info.Duration)
+					entry.Expires = &expires
+				}
+				list.Bans = append(list.Bans, entry)
+			}
+		}
+		appendBans("dline", dlines)
+		appendBans("kline", klines)
+		return json.MarshalIndent(list, "", "\t")
+	case banListFormatPlain:
+		var buf bytes.Buffer
+		for _, bans := range []map[string]IPBanInfo{dlines, klines} {
+			for _, mask := range sortedBanMasks(bans) {
+				// reasons can't contain newlines, but be safe:
+				info := bans[mask]
+				reason := strings.Join(strings.Fields(info.Reason), " ")
+				if info.OperReason != "" {
+					reason = fmt.Sprintf("%s | %s", reason, strings.Join(strings.Fields(info.OperReason), " "))
+				}
+				fmt.Fprintf(&buf, "%s %s\n", mask, reason)
+			}
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, errInvalidBanListFormat
+	}
+}
+
+func sortedBanMasks(bans map[string]IPBanInfo) (result []string) {
+	result = make([]string, 0, len(bans))
+	for mask := range bans {
+		result = append(result, mask)
+	}
+	sort.Strings(result)
+	return
+}
+
+// ImportBans adds the bans from a ban list to the running server. Unless
+// `overwrite` is set, existing bans on the same mask take precedence over
+// the imported ones. With `dryRun`, the list is only validated.
+func (server *Server) ImportBans(data []byte, format, operName string, overwrite, dryRun bool) (result BanImportResult, err error) {
+	bans, result, err := parseBanList(data, format, operName)
+	if err != nil {
+		return
+	}
+	for _, ban := range bans {
+		var present bool
+		var banErr error
+		if ban.dline {
+			present, banErr = server.dlines.ImportTarget(ban.target, ban.info, overwrite, dryRun)
+		} else {
+			present, banErr = server.klines.ImportMask(ban.mask, ban.info, overwrite, dryRun)
+		}
+		result.record(ban.mask, present, overwrite, banErr)
+	}
+	return
+}
+
+// ExportBans serializes all of the running server's D-lines and K-lines.
+func (server *Server) ExportBans(format string) (data []byte, err error) {
+	return serializeBanList(server.dlines.AllBans(), server.klines.AllBans(), format)
+}
+
+func (result *BanImportResult) record(mask string, present, overwrite bool, err error) {
+	switch {
+	case err != nil:
+		result.Errors = append(result.Errors, fmt.Sprintf("%s: %s", mask, err.Error()))
+	case present && !overwrite:
+		result.Kept++
+	case present:
+		result.Replaced++
+	default:
+		result.Added++
+	}
+}
+
+// offline import and export, operating directly on the datastore
+// (for `oragono importbans` and `oragono exportbans`)
+
+func loadBansFromDatastore(tx *buntdb.Tx, keyFormat string) (bans map[string]IPBanInfo) {
+	bans = make(map[string]IPBanInfo)
+	prefix := fmt.Sprintf(keyFormat, "")
+	tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+		if !strings.HasPrefix(key, prefix) {
+			return false
+		}
+		var info IPBanInfo
+		if json.Unmarshal([]byte(value), &info) == nil {
+			bans[strings.TrimPrefix(key, prefix)] = info
+		}
+		return true
+	})
+	return
+}
+
+// ImportBanListFile imports a ban list into the datastore of a server
+// that is not running.
+func ImportBanListFile(config *Config, filename, format string, overwrite, dryRun bool) (result BanImportResult, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	bans, result, err := parseBanList(data, format, config.Server.Name)
+	if err != nil {
+		return
+	}
+
+	store, err := buntdb.Open(config.Datastore.Path)
+	if err != nil {
+		return
+	}
+	defer store.Close()
+
+	err = store.Update(func(tx *buntdb.Tx) error {
+		dlines := loadBansFromDatastore(tx, keyDlineEntry)
+		klines := loadBansFromDatastore(tx, keyKlineEntry)
+		for _, ban := range bans {
+			keyFormat, existing := keyKlineEntry, klines
+			if ban.dline {
+				keyFormat, existing = keyDlineEntry, dlines
+			}
+			_, present := existing[ban.mask]
+			var banErr error
+			if !dryRun && (overwrite || !present) {
+				banErr = persistBan(tx, fmt.Sprintf(keyFormat, ban.mask), ban.info)
+			}
+			result.record(ban.mask, present, overwrite, banErr)
+		}
+		return nil
+	})
+	return
+}
+
+// ExportBanListFile writes out the bans in the datastore of a server
+// that is not running.
+func ExportBanListFile(config *Config, filename, format string) (count int, err error) {
+	store, err := buntdb.Open(config.Datastore.Path)
+	if err != nil {
+		return
+	}
+	defer store.Close()
+
+	var dlines, klines map[string]IPBanInfo
+	err = store.View(func(tx *buntdb.Tx) error {
+		dlines = loadBansFromDatastore(tx, keyDlineEntry)
+		klines = loadBansFromDatastore(tx, keyKlineEntry)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	data, err := serializeBanList(dlines, klines, format)
+	if err != nil {
+		return
+	}
+	return len(dlines) + len(klines), ioutil.WriteFile(filename, data, 0600)
+}
+
+// persistBan stores a ban in the datastore, expiring it when the ban expires
+func persistBan(tx *buntdb.Tx, key string, info IPBanInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	var setOptions *buntdb.SetOptions
+	if info.Duration != 0 {
+		timeLeft := info.timeLeft()
+		if timeLeft <= 0 {
+			return nil
+		}
+		setOptions = &buntdb.SetOptions{Expires: true, TTL: timeLeft}
+	}
+	_, _, err = tx.Set(key, string(b), setOptions)
+	return err
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePlainBanList(t *testing.T) {
+	data := []byte(`# comment
+
+192.0.2.0/24 open proxy | from the old server
+2001:db8::1
+*!*@evil.example.com	spam
+evilnick
+192.0.2.300/24
+`)
+	bans, result, err := parseBanList(data, "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(bans), 4, t)
+	assertEqual(len(result.Errors), 1, t)
+
+	assertEqual(bans[0].dline, true, t)
+	assertEqual(bans[0].mask, "192.0.2.0/24", t)
+	assertEqual(bans[0].info.Reason, "open proxy", t)
+	assertEqual(bans[0].info.OperReason, "from the old server", t)
+	assertEqual(bans[0].info.OperName, "admin", t)
+	assertEqual(bans[0].info.Duration, time.Duration(0), t)
+
+	assertEqual(bans[1].dline, true, t)
+	assertEqual(bans[1].mask, "2001:db8::1/128", t)
+	assertEqual(bans[1].info.Reason, "No reason given", t)
+
+	assertEqual(bans[2].dline, false, t)
+	assertEqual(bans[2].mask, "*!*@evil.example.com", t)
+	assertEqual(bans[2].info.Reason, "spam", t)
+
+	assertEqual(bans[3].dline, false, t)
+	assertEqual(bans[3].mask, "evilnick!*@*", t)
+}
+
+func TestParseJSONBanList(t *testing.T) {
+	data := []byte(`{"version": 1, "bans": [
+		{"type": "dline", "mask": "192.0.2.1", "reason": "a", "oper_name": "dan", "created": "2020-01-01T00:00:00Z", "expires": "2100-01-01T00:00:00Z"},
+		{"mask": "*!*@*.example.com", "reason": "b"},
+		{"type": "kline", "mask": "old!*@*", "expires": "2020-01-01T00:00:00Z"},
+		{"type": "gline", "mask": "x!*@*"}
+	]}`)
+	bans, result, err := parseBanList(data, "", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(bans), 2, t)
+	assertEqual(result.Expired, 1, t)
+	assertEqual(len(result.Errors), 1, t)
+
+	assertEqual(bans[0].mask, "192.0.2.1/32", t)
+	assertEqual(bans[0].info.OperName, "dan", t)
+	assertEqual(bans[0].info.TimeCreated, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), t)
+	assertEqual(bans[0].info.TimeCreated.Add(bans[0].info.Duration), time.Date(2100, 1, 1, 0, 0, 0, 0, time.UTC), t)
+
+	assertEqual(bans[1].dline, false, t)
+	assertEqual(bans[1].info.OperName, "admin", t)
+
+	if _, _, err := parseBanList([]byte(`{"version": 2, "bans": []}`), "json", "admin"); err == nil {
+		t.Errorf("should reject unknown versions")
+	}
+	if _, _, err := parseBanList(data, "csv", "admin"); err != errInvalidBanListFormat {
+		t.Errorf("should reject unknown formats")
+	}
+}
+
+func TestBanListRoundTrip(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dlines := map[string]IPBanInfo{
+		"192.0.2.0/24": {Reason: "a", OperReason: "b", OperName: "dan", TimeCreated: created, Duration: 1000000 * time.Hour},
+	}
+	klines := map[string]IPBanInfo{
+		"*!*@evil.example.com": {Reason: "spam", OperName: "dan", TimeCreated: created},
+	}
+
+	for _, format := range []string{"json", "plain"} {
+		data, err := serializeBanList(dlines, klines, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bans, result, err := parseBanList(data, "", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(len(result.Errors), 0, t)
+		assertEqual(len(bans), 2, t)
+		assertEqual(bans[0].mask, "192.0.2.0/24", t)
+		assertEqual(bans[0].info.Reason, "a", t)
+		assertEqual(bans[0].info.OperReason, "b", t)
+		assertEqual(bans[1].mask, "*!*@evil.example.com", t)
+		if format == "json" {
+			// JSON preserves all the metadata:
+			assertEqual(bans[0].info, dlines["192.0.2.0/24"], t)
+			assertEqual(bans[1].info, klines["*!*@evil.example.com"], t)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// blocked messages are reported to their would-be recipient this long
+	// after the first one
+	blockedReportInterval = time.Hour
+	// maximum number of senders listed individually in a report
+	blockedReportMaxSenders = 10
+	// maximum number of senders counted individually for a report; messages
+	// from any further senders are only counted in total
+	blockedReportMaxTracked = 100
+	// maximum number of senders tracked for BLOCKED in DEBUG
+	blockedCountersMaxSenders = 4096
+)
+
+// blockedMessageReport aggregates the direct messages that were silently
+// blocked for a client (by +R or +T), for delivery as a periodic summary.
+type blockedMessageReport struct {
+	sync.Mutex
+	counts map[string]int // sender nick to count
+	others int            // messages from senders past blockedReportMaxTracked
+	timer  *time.Timer
+}
+
+// blockedSenderCount is a server-wide counter of a sender's blocked messages.
+type blockedSenderCount struct {
+	nickMask string // most recent nickmask seen for this sender
+	count    uint64
+}
+
+// blockedMessageCounters tracks which senders have had messages blocked,
+// to help opers investigate abuse.
+type blockedMessageCounters struct {
+	sync.Mutex
+	bySender map[string]*blockedSenderCount // IP to count
+	total    uint64
+}
+
+func (counters *blockedMessageCounters) add(ip, nickMask string) {
+	counters.Lock()
+	defer counters.Unlock()
+
+	counters.total++
+	if counters.bySender == nil {
+		counters.bySender = make(map[string]*blockedSenderCount)
+	}
+	entry, ok := counters.bySender[ip]
+	if !ok {
+		if len(counters.bySender) >= blockedCountersMaxSenders {
+			return // total is still updated
+		}
+		entry = new(blockedSenderCount)
+		counters.bySender[ip] = entry
+	}
+	entry.nickMask = nickMask
+	entry.count++
+}
+
+// top returns the senders with the most blocked messages, most first.
+func (counters *blockedMessageCounters) top(limit int) (total uint64, ips []string, entries []blockedSenderCount) {
+	counters.Lock()
+	defer counters.Unlock()
+
+	total = counters.total
+	for ip := range counters.bySender {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return counters.bySender[ips[i]].count > counters.bySender[ips[j]].count
+	})
+	if len(ips) > limit {
+		ips = ips[:limit]
+	}
+	for _, ip := range ips {
+		entries = append(entries, *counters.bySender[ip])
+	}
+	return
+}
+
+// recordBlockedMessage is called when a direct message from `sender` to
+// `client` is silently dropped.
+func (client *Client) recordBlockedMessage(sender *Client) {
+	senderDetails := sender.Details()
+	client.server.blockedCounters.add(sender.IPString(), senderDetails.nickMask)
+
+	if client.AccountSettings().BlockedReportsDisabled {
+		return
+	}
+
+	report := &client.blockedReport
+	report.Lock()
+	defer report.Unlock()
+	if report.counts == nil {
+		report.counts = make(map[string]int)
+	}
+	if _, ok := report.counts[senderDetails.nick]; ok || len(report.counts) < blockedReportMaxTracked {
+		report.counts[senderDetails.nick]++
+	} else {
+		report.others++
+	}
+	if report.timer == nil {
+		report.timer = time.AfterFunc(blockedReportInterval, client.sendBlockedReport)
+	}
+}
+
+// stopBlockedReport discards any pending report; called when the client is destroyed.
+func (client *Client) stopBlockedReport() {
+	report := &client.blockedReport
+	report.Lock()
+	defer report.Unlock()
+	if report.timer != nil {
+		report.timer.Stop()
+	}
+	report.counts, report.others, report.timer = nil, 0, nil
+}
+
+func (client *Client) sendBlockedReport() {
+	report := &client.blockedReport
+	report.Lock()
+	counts, others := report.counts, report.others
+	report.counts, report.others, report.timer = nil, 0, nil
+	report.Unlock()
+
+	senders := make([]string, 0, len(counts))
+	for sender := range counts {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		return counts[senders[i]] > counts[senders[j]]
+	})
+	for i, sender := range senders {
+		if i < blockedReportMaxSenders {
+			if counts[sender] == 1 {
+				client.Notice(fmt.Sprintf(client.t("1 message from %s was blocked in the last hour"), sender))
+			} else {
+				client.Notice(fmt.Sprintf(client.t("%[1]d messages from %[2]s were blocked in the last hour"), counts[sender], sender))
+			}
+		} else {
+			others += counts[sender]
+		}
+	}
+	if others == 1 {
+		client.Notice(client.t("1 message from another user was also blocked"))
+	} else if others != 0 {
+		client.Notice(fmt.Sprintf(client.t("%d messages from other users were also blocked"), others))
+	}
+	if len(senders) != 0 && client.Account() != "" {
+		client.Notice(client.t("To stop receiving these reports, use /NS SET BLOCKED-REPORTS OFF"))
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/goshuirc/irc-go/ircmsg"
+
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/connection_limits"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// bridges (e.g., Matrix appservices) authenticate a single connection with
+// BRIDGE AUTH, then use it to introduce and control "puppet" clients, one
+// per remote user. Puppets are ordinary clients as far as everyone else is
+// concerned, but they skip DNS, ident, connection limits and the registration
+// burst, and everything they would be sent is forwarded to the bridge connection,
+// tagged with the puppet's nickname; see docs/MANUAL.md for details.
+
+const (
+	// tag identifying the puppet a forwarded message was addressed to
+	bridgePuppetTagName = "oragono.io/bridge-puppet"
+)
+
+var (
+	errBridgeAuth        = errors.New("invalid bridge credentials")
+	errBridgeTooMany     = errors.New("too many puppets")
+	errBridgeNotAPuppet  = errors.New("not a puppet of this bridge")
+	errBridgeNeedsTags   = errors.New("bridges must negotiate the message-tags capability")
+	errBridgeAlreadyAuth = errors.New("already authenticated as a bridge")
+)
+
+// BridgeConfig is a bridge that is allowed to introduce puppets.
+type BridgeConfig struct {
+	Token string
+	// hostname shown for the bridge's puppets; defaults to the server name
+	Hostname   string
+	MaxPuppets int `yaml:"max-puppets"`
+}
+
+// bridgeLink is the state of a session that has authenticated as a bridge.
+type bridgeLink struct {
+	name string
+
+	sync.Mutex // tier 1
+	puppets    ClientSet
+}
+
+func (link *bridgeLink) add(puppet *Client, maxPuppets int) (err error) {
+	link.Lock()
+	defer link.Unlock()
+	if maxPuppets != 0 && maxPuppets <= len(link.puppets) {
+		return errBridgeTooMany
+	}
+	link.puppets.Add(puppet)
+	return nil
+}
+
+func (link *bridgeLink) remove(puppet *Client) {
+	link.Lock()
+	link.puppets.Remove(puppet)
+	link.Unlock()
+}
+
+func (link *bridgeLink) has(puppet *Client) bool {
+	link.Lock()
+	defer link.Unlock()
+	return link.puppets.Has(puppet)
+}
+
+func (link *bridgeLink) Puppets() (result []*Client) {
+	link.Lock()
+	defer link.Unlock()
+	result = make([]*Client, 0, len(link.puppets))
+	for puppet := range link.puppets {
+		result = append(result, puppet)
+	}
+	return
+}
+
+// authenticateBridge makes `session` the controlling connection of the named bridge.
+func (server *Server) authenticateBridge(session *Session, name, token string) (err error) {
+	client := session.client
+	if session.bridge != nil {
+		return errBridgeAlreadyAuth
+	}
+	if !session.capabilities.Has(caps.MessageTags) {
+		return errBridgeNeedsTags
+	}
+	if throttled, remainingTime := client.checkLoginThrottle(); throttled {
+		return &ThrottleError{remainingTime}
+	}
+	bridgeConfig, ok := server.Config().Bridges[name]
+	if !ok || bridgeConfig.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(bridgeConfig.Token)) != 1 {
+		server.logger.Info("bridge", "client", client.Nick(), "failed to authenticate as bridge", name)
+		return errBridgeAuth
+	}
+
+	session.bridge = &bridgeLink{
+		name:    name,
+		puppets: make(ClientSet),
+	}
+	// the bridge speaks for all its puppets, so fakelag would throttle them collectively:
+	session.fakelag.Initialize(FakelagConfig{})
+	server.snomasks.Send(sno.LocalAnnouncements, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] authenticated as bridge $c[grey][$r%s$c[grey]]"), client.NickMaskString(), name))
+	server.logger.Info("bridge", "client", client.Nick(), "authenticated as bridge", name)
+	return nil
+}
+
+// introducePuppet creates and registers a puppet controlled by the bridge
+// session `controller`. It returns the puppet's nickname, which may differ
+// from the requested one (e.g., if guest nicknames are enforced).
+func (server *Server) introducePuppet(controller *Session, nick, username, realname string) (result string, err error) {
+	config := server.Config()
+	link := controller.bridge
+	bridgeConfig := config.Bridges[link.name]
+	hostname := bridgeConfig.Hostname
+	if hostname == "" {
+		hostname = server.name
+	}
+
+	now := time.Now().UTC()
+	puppet := &Client{
+		lastActive: now,
+		channels:   make(ChannelSet),
+		ctime:      now,
+		languages:  server.Languages().Default(),
+		loginThrottle: connection_limits.GenericThrottle{
+			Duration: config.Accounts.LoginThrottling.Duration,
+			Limit:    config.Accounts.LoginThrottling.MaxAttempts,
+		},
+		server:         server,
+		accountName:    "*",
+		nick:           "*",
+		nickCasefolded: "*",
+		nickMaskString: "*",
+		rawHostname:    hostname,
+		realIP:         controller.IP(),
+		bridge:         link.name,
+		nextSessionID:  1,
+	}
+	puppet.writerSemaphore.Initialize(1)
+	puppet.history.Initialize(config.History.ClientLength, time.Duration(config.History.AutoresizeWindow))
+	puppet.brbTimer.Initialize(puppet)
+	session := &Session{
+		client:           puppet,
+		socket:           controller.socket,
+		bridgeController: controller,
+		capabilities:     controller.capabilities,
+		capVersion:       controller.capVersion,
+		capState:         caps.NegotiatedState,
+		ctime:            now,
+		lastActive:       now,
+		realIP:           controller.IP(),
+		rawHostname:      hostname,
+	}
+	puppet.sessions = []*Session{session}
+	if controller.client.HasMode(modes.TLS) {
+		puppet.SetMode(modes.TLS, true)
+	}
+
+	if err = puppet.SetNames(username, realname, false); err != nil {
+		return
+	}
+	if err = link.add(puppet, bridgeConfig.MaxPuppets); err != nil {
+		return
+	}
+	// from here on, failures must clean up with destroy(), which removes
+	// the puppet from the link
+	server.stats.Add()
+	result, err, _ = server.clients.SetNick(puppet, nil, nick, false)
+	if err != nil {
+		puppet.destroy(nil)
+		return
+	}
+	// XXX set this last to avoid confusing SetNick:
+	puppet.registered = true
+	for _, defaultMode := range config.Accounts.defaultUserModes {
+		puppet.SetMode(defaultMode, true)
+	}
+	server.stats.Register(puppet.HasMode(modes.Invisible))
+
+	if isBanned, info := server.klines.CheckMasks(puppet.AllNickmasks()...); isBanned {
+		puppet.Quit(info.BanMessage(puppet.t("You are banned from this server (%s)")), nil)
+		puppet.destroy(nil)
+		return "", errBanned
+	}
+
+	d := puppet.Details()
+	server.logger.Info("connect", fmt.Sprintf("Puppet connected via bridge %s [%s] [u:%s] [r:%s]", link.name, d.nick, d.username, d.realname))
+	server.snomasks.Send(sno.LocalConnects, fmt.Sprintf("Client connected [%s] [u:%s] [h:%s] [ip:%s] [r:%s] [bridge:%s]", d.nick, d.username, hostname, session.IP().String(), d.realname, link.name))
+	server.webhooks.Send(WebhookConnect, webhookData{"client": webhookClientData(puppet, d), "bridge": link.name})
+	return
+}
+
+// getPuppet returns the puppet with the given nickname, if it is controlled by `controller`.
+func (server *Server) getPuppet(controller *Session, nick string) (puppet *Client, err error) {
+	puppet = server.clients.Get(nick)
+	if puppet == nil {
+		return nil, errNoSuchNick
+	}
+	if !controller.bridge.has(puppet) {
+		return nil, errBridgeNotAPuppet
+	}
+	return puppet, nil
+}
+
+// puppetSession returns the (unique) session of a puppet.
+func (client *Client) puppetSession() *Session {
+	sessions := client.Sessions()
+	if len(sessions) == 0 {
+		return nil
+	}
+	return sessions[0]
+}
+
+// removePuppets quits all of a bridge's puppets, when the bridge disconnects.
+func (link *bridgeLink) removePuppets(message string) {
+	for _, puppet := range link.Puppets() {
+		puppet.Quit(message, nil)
+		puppet.destroy(nil)
+	}
+}
+
+// shouldForward determines whether a message sent to a puppet concerns the
+// bridge. Channel traffic between other clients is dropped: every puppet in
+// the channel would receive a copy, and the bridge can observe channels
+// with its own client instead.
+func (session *Session) shouldForward(message *ircmsg.IrcMessage) bool {
+	source := message.Prefix
+	if bang := strings.IndexByte(source, '!'); bang != -1 {
+		source = source[:bang]
+	} else {
+		// the server, or no source at all
+		return true
+	}
+	cfnick := session.client.NickCasefolded()
+	isPuppet := func(nick string) bool {
+		cfname, err := CasefoldName(nick)
+		return err == nil && cfname == cfnick
+	}
+	if isPuppet(source) {
+		return true
+	}
+	if 0 < len(message.Params) && isPuppet(message.Params[0]) {
+		// DMs, INVITE, MODE, etc. addressed to the puppet
+		return true
+	}
+	return message.Command == "KICK" && 1 < len(message.Params) && isPuppet(message.Params[1])
+}
+
+// forwardToBridge sends a message addressed to a puppet to its bridge.
+func (session *Session) forwardToBridge(message ircmsg.IrcMessage, blocking bool) error {
+	if !session.shouldForward(&message) {
+		return nil
+	}
+	return session.relayToBridge(message, blocking)
+}
+
+// relayToBridge sends a message to a puppet's bridge without filtering it.
+func (session *Session) relayToBridge(message ircmsg.IrcMessage, blocking bool) error {
+	message.SetTag(bridgePuppetTagName, session.client.Nick())
+	return session.bridgeController.SendRawMessage(message, blocking)
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+func TestBridgeForwarding(t *testing.T) {
+	server := newTestServer()
+	puppet := newTestClient(server, "alice")
+	session := &Session{client: puppet}
+
+	forwarded := func(prefix, command string, params ...string) bool {
+		message := ircmsg.MakeMessage(nil, prefix, command, params...)
+		return session.shouldForward(&message)
+	}
+
+	// replies from the server, and the puppet's own actions:
+	assertEqual(forwarded("oragono.test", RPL_WHOISUSER, "alice", "bob"), true, t)
+	assertEqual(forwarded("oragono.test", "MODE", "#chan", "+o", "bob"), true, t)
+	assertEqual(forwarded("", "PING", "alice"), true, t)
+	assertEqual(forwarded("alice!u@example.com", "JOIN", "#chan"), true, t)
+	assertEqual(forwarded("Alice!u@example.com", "PRIVMSG", "#chan", "hi"), true, t)
+	// a nick change is seen by the puppet under its new nick:
+	assertEqual(forwarded("al!u@example.com", "NICK", "alice"), true, t)
+	// messages addressed to the puppet:
+	assertEqual(forwarded("bob!u@example.com", "PRIVMSG", "alice", "hi"), true, t)
+	assertEqual(forwarded("bob!u@example.com", "INVITE", "alice", "#chan"), true, t)
+	assertEqual(forwarded("bob!u@example.com", "KICK", "#chan", "alice", "bye"), true, t)
+	// traffic between other clients:
+	assertEqual(forwarded("bob!u@example.com", "PRIVMSG", "#chan", "hi"), false, t)
+	assertEqual(forwarded("bob!u@example.com", "KICK", "#chan", "carol", "bye"), false, t)
+	assertEqual(forwarded("bob!u@example.com", "NICK", "robert"), false, t)
+	assertEqual(forwarded("bob!u@example.com", "QUIT", "bye"), false, t)
+}
+
+func TestBridgeLinkLimit(t *testing.T) {
+	server := newTestServer()
+	link := &bridgeLink{name: "matrix", puppets: make(ClientSet)}
+	alice, bob, carol := newTestClient(server, "alice"), newTestClient(server, "bob"), newTestClient(server, "carol")
+
+	assertEqual(link.add(alice, 2), nil, t)
+	assertEqual(link.add(bob, 2), nil, t)
+	assertEqual(link.add(carol, 2), errBridgeTooMany, t)
+	assertEqual(link.has(bob), true, t)
+	assertEqual(link.has(carol), false, t)
+
+	link.remove(bob)
+	assertEqual(link.add(carol, 2), nil, t)
+	assertEqual(len(link.Puppets()), 2, t)
+	// 0 means no limit:
+	assertEqual(link.add(bob, 0), nil, t)
+}
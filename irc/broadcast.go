@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Some changes (e.g., to ISUPPORT or to the available capabilities after
+// a rehash) have to be announced to every client. On a large server, doing
+// this synchronously would stall the rehash, and sending everything at once
+// would cause a burst of CPU usage and network traffic. Instead, the
+// notifications are queued and delivered on a separate goroutine, which
+// pauses after each batch of clients. Notifications are delivered in the
+// order they were queued.
+
+const (
+	broadcastBatchSize     = 1000
+	broadcastBatchInterval = 10 * time.Millisecond
+)
+
+type broadcastJob struct {
+	name   string
+	notify func(client *Client)
+}
+
+type clientBroadcaster struct {
+	sync.Mutex
+	server  *Server
+	queue   []broadcastJob
+	running bool
+}
+
+func (broadcaster *clientBroadcaster) Initialize(server *Server) {
+	broadcaster.server = server
+}
+
+// Broadcast queues a call to notify for every client; `name` describes the
+// notification for logging purposes.
+func (broadcaster *clientBroadcaster) Broadcast(name string, notify func(client *Client)) {
+	broadcaster.Lock()
+	defer broadcaster.Unlock()
+	broadcaster.queue = append(broadcaster.queue, broadcastJob{name: name, notify: notify})
+	if !broadcaster.running {
+		broadcaster.running = true
+		go broadcaster.run()
+	}
+}
+
+func (broadcaster *clientBroadcaster) next() (job broadcastJob, ok bool) {
+	broadcaster.Lock()
+	defer broadcaster.Unlock()
+	if len(broadcaster.queue) == 0 {
+		broadcaster.running = false
+		return
+	}
+	job = broadcaster.queue[0]
+	broadcaster.queue[0] = broadcastJob{}
+	broadcaster.queue = broadcaster.queue[1:]
+	return job, true
+}
+
+func (broadcaster *clientBroadcaster) run() {
+	for {
+		job, ok := broadcaster.next()
+		if !ok {
+			return
+		}
+		broadcaster.deliver(job)
+	}
+}
+
+func (broadcaster *clientBroadcaster) deliver(job broadcastJob) {
+	server := broadcaster.server
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger.Error("internal",
+				fmt.Sprintf("Panic while delivering %s: %v\n%s", job.name, r, debug.Stack()))
+		}
+	}()
+
+	start := time.Now()
+	count := 0
+	server.clients.Range(func(client *Client) bool {
+		job.notify(client)
+		count++
+		if count%broadcastBatchSize == 0 {
+			time.Sleep(broadcastBatchInterval)
+		}
+		return true
+	})
+	server.logger.Debug("server", fmt.Sprintf("delivered %s to %d clients in %v", job.name, count, time.Since(start)))
+}
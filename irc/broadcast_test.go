@@ -0,0 +1,46 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestBroadcast(t *testing.T) {
+	server := newTestClientManager()
+	server.broadcaster.Initialize(server)
+	numClients := 2*broadcastBatchSize + 1
+	addTestClients(t, server, numClients)
+
+	var mutex sync.Mutex
+	received := make(map[*Client][]string)
+	var wg sync.WaitGroup
+	wg.Add(3 * numClients)
+	for _, name := range []string{"first", "second", "third"} {
+		name := name
+		server.broadcaster.Broadcast(name, func(client *Client) {
+			mutex.Lock()
+			received[client] = append(received[client], name)
+			mutex.Unlock()
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	assertEqual(len(received), numClients, t)
+	for _, notifications := range received {
+		assertEqual(notifications, []string{"first", "second", "third"}, t)
+	}
+
+	// a panicking notification doesn't stop later ones:
+	wg.Add(numClients)
+	server.broadcaster.Broadcast("panic", func(client *Client) {
+		panic("oops")
+	})
+	server.broadcaster.Broadcast("after", func(client *Client) {
+		wg.Done()
+	})
+	wg.Wait()
+}
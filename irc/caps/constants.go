@@ -58,6 +58,16 @@ const (
 	// More draft names associated with draft/multiline:
 	MultilineBatchType = "draft/multiline"
 	MultilineConcatTag = "draft/multiline-concat"
+	// batch wrapping the channel state and history replayed to a session
+	// that reattaches to an existing client:
+	ReattachBatchType = "oragono.io/reattach"
+	// batch wrapping the reply to CHATHISTORY TARGETS:
+	ChathistoryTargetsBatchType = "draft/chathistory-targets"
+	// batch wrapping the reply to RELATIONS:
+	RelationsBatchType = "oragono.io/relations"
+	// tag marking a message sent by a roleplay command (NPC, NPCA, or SCENE);
+	// the value is "npc" or "scene":
+	RoleplayTagName = "oragono.io/roleplay"
 )
 
 func init() {
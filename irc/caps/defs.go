@@ -7,7 +7,7 @@ package caps
 
 const (
 	// number of recognized capabilities:
-	numCapabs = 28
+	numCapabs = 30
 	// length of the uint64 array that represents the bitset:
 	bitsetLen = 1
 )
@@ -53,6 +53,10 @@ const (
 	// https://gist.github.com/DanielOaks/8126122f74b26012a3de37db80e4e0c6
 	Languages Capability = iota
 
+	// MessageRedaction is the proposed IRCv3 capability named "draft/message-redaction":
+	// https://github.com/ircv3/ircv3-specifications/pull/524
+	MessageRedaction Capability = iota
+
 	// Multiline is the proposed IRCv3 capability named "draft/multiline":
 	// https://github.com/ircv3/ircv3-specifications/pull/398
 	Multiline Capability = iota
@@ -109,6 +113,10 @@ const (
 	// https://ircv3.net/specs/extensions/setname.html
 	SetName Capability = iota
 
+	// StandardReplies is the proposed IRCv3 capability named "standard-replies":
+	// https://github.com/ircv3/ircv3-specifications/pull/506
+	StandardReplies Capability = iota
+
 	// STS is the IRCv3 capability named "sts":
 	// https://ircv3.net/specs/extensions/sts.html
 	STS Capability = iota
@@ -139,6 +147,7 @@ var (
 		"draft/chathistory",
 		"draft/event-playback",
 		"draft/languages",
+		"draft/message-redaction",
 		"draft/multiline",
 		"draft/register",
 		"draft/relaymsg",
@@ -153,6 +162,7 @@ var (
 		"sasl",
 		"server-time",
 		"setname",
+		"standard-replies",
 		"sts",
 		"userhost-in-names",
 		"znc.in/playback",
@@ -0,0 +1,147 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"hash/fnv"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// CHALLENGE authenticates an operator by their RSA public key, as in ratbox
+// and charybdis, so that no password is sent over the connection: the server
+// encrypts a random nonce with the key (RSA-OAEP with SHA-1), and the client
+// proves that it could decrypt it by sending back the base64-encoded SHA-1
+// digest of the nonce. Tools written for those servers (e.g., `respond`)
+// can compute the response.
+
+const (
+	operChallengeNonceLength = 32
+	// the encrypted nonce is sent in base64, in chunks of this length:
+	operChallengeLineLength = 60
+	operChallengeTimeout    = time.Minute
+	// decoy length if no operator has a key (a 2048-bit modulus):
+	defaultOperChallengeKeySize = 256
+)
+
+var (
+	errInvalidOperPublicKey = errors.New("not a PEM-encoded RSA public key")
+)
+
+// operChallenge is a CHALLENGE that a session has been issued
+type operChallenge struct {
+	operName  string
+	publicKey *rsa.PublicKey // nil if there is no such operator
+	response  []byte
+	expires   time.Time
+}
+
+// loadOperPublicKey reads an RSA public key from a PEM file, in either
+// PKIX ("PUBLIC KEY") or PKCS #1 ("RSA PUBLIC KEY") format.
+func loadOperPublicKey(filename string) (key *rsa.PublicKey, err error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errInvalidOperPublicKey
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := parsed.(*rsa.PublicKey); ok {
+			return key, nil
+		}
+	}
+	return nil, errInvalidOperPublicKey
+}
+
+// operChallengeKeySizes returns the sizes (in bytes) of the operators' public
+// keys, one entry per key, in sorted order.
+func operChallengeKeySizes(opers map[string]*Oper) (result []int) {
+	for _, oper := range opers {
+		if oper.PublicKey != nil {
+			result = append(result, oper.PublicKey.Size())
+		}
+	}
+	sort.Ints(result)
+	return
+}
+
+// operChallengeDecoySize returns the length of the decoy challenge for `name`:
+// one of the configured key sizes, chosen consistently for each name, so that
+// decoys are as long as real challenges and don't change between attempts.
+func operChallengeDecoySize(name string, keySizes []int) int {
+	if len(keySizes) == 0 {
+		return defaultOperChallengeKeySize
+	}
+	if cfname, err := CasefoldName(name); err == nil {
+		name = cfname
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return keySizes[hash.Sum32()%uint32(len(keySizes))]
+}
+
+// newOperChallenge creates a challenge for the operator `name`, which is `oper`.
+// If there is no such operator, or they have no public key, the challenge is
+// random data that can't be answered, as long as a real challenge under one of
+// `keySizes`, so as not to reveal which operators exist.
+func newOperChallenge(name string, oper *Oper, keySizes []int) (challenge *operChallenge, encoded string, err error) {
+	var key *rsa.PublicKey
+	if oper != nil {
+		key = oper.PublicKey
+	}
+	nonce := make([]byte, operChallengeNonceLength)
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	var ciphertext []byte
+	if key != nil {
+		ciphertext, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, key, nonce, nil)
+		if err != nil {
+			return
+		}
+	} else {
+		ciphertext = make([]byte, operChallengeDecoySize(name, keySizes))
+		if _, err = rand.Read(ciphertext); err != nil {
+			return
+		}
+	}
+	digest := sha1.Sum(nonce)
+	challenge = &operChallenge{
+		operName:  name,
+		publicKey: key,
+		response:  digest[:],
+		expires:   time.Now().Add(operChallengeTimeout),
+	}
+	return challenge, base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// check returns whether `response` (in base64) answers the challenge
+func (challenge *operChallenge) check(response string) bool {
+	if challenge.publicKey == nil || time.Now().After(challenge.expires) {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(decoded, challenge.response) == 1
+}
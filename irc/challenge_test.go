@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestPublicKey(t *testing.T, blockType string, der []byte) (filename string) {
+	filename = filepath.Join(t.TempDir(), "oper.pub")
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// respondToChallenge computes the response the way `respond` does
+func respondToChallenge(t *testing.T, key *rsa.PrivateKey, encoded string) string {
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha1.Sum(nonce)
+	return base64.StdEncoding.EncodeToString(digest[:])
+}
+
+func TestOperChallenge(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkix, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadOperPublicKey(writeTestPublicKey(t, "PUBLIC KEY", pkix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(&privateKey.PublicKey) {
+		t.Errorf("loaded the wrong PKIX public key")
+	}
+	pkcs1 := x509.MarshalPKCS1PublicKey(&privateKey.PublicKey)
+	key, err = loadOperPublicKey(writeTestPublicKey(t, "RSA PUBLIC KEY", pkcs1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !key.Equal(&privateKey.PublicKey) {
+		t.Errorf("loaded the wrong PKCS #1 public key")
+	}
+	if _, err := loadOperPublicKey(writeTestPublicKey(t, "CERTIFICATE", pkcs1)); err != errInvalidOperPublicKey {
+		t.Errorf("accepted an invalid public key: %v", err)
+	}
+
+	oper := &Oper{Name: "admin", PublicKey: key}
+	challenge, encoded, err := newOperChallenge("admin", oper, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := respondToChallenge(t, privateKey, encoded)
+	assertEqual(challenge.check(response), true, t)
+	assertEqual(challenge.check(base64.StdEncoding.EncodeToString(make([]byte, sha1.Size))), false, t)
+	assertEqual(challenge.check("not base64!"), false, t)
+
+	challenge.expires = time.Now().Add(-time.Second)
+	assertEqual(challenge.check(response), false, t)
+
+	// challenges for nonexistent operators look the same, but can't be answered:
+	challenge, fake, err := newOperChallenge("nobody", nil, []int{key.Size()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(fake), len(encoded), t)
+	assertEqual(challenge.check(base64.StdEncoding.EncodeToString(challenge.response)), false, t)
+	assertEqual(challenge.check(""), false, t)
+
+	// decoys match the configured key sizes, consistently for each name:
+	sizes := operChallengeKeySizes(map[string]*Oper{"a": oper, "b": {}})
+	assertEqual(sizes, []int{256}, t)
+	mixed := []int{128, 384, 512}
+	for _, name := range []string{"nobody", "somebody", "Admin2"} {
+		size := operChallengeDecoySize(name, mixed)
+		if size != 128 && size != 384 && size != 512 {
+			t.Errorf("decoy size %d isn't a configured key size", size)
+		}
+		assertEqual(operChallengeDecoySize(name, mixed), size, t)
+	}
+	assertEqual(operChallengeDecoySize("admin2", mixed), operChallengeDecoySize("Admin2", mixed), t)
+	assertEqual(operChallengeDecoySize("nobody", nil), defaultOperChallengeKeySize, t)
+}
@@ -7,6 +7,8 @@ package irc
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,16 +22,71 @@ import (
 )
 
 type ChannelSettings struct {
-	History HistoryStatus
+	History    HistoryStatus
+	OpenHours  OpenHours
+	Visibility MembershipVisibility
+	// casefolded account that becomes the founder if the founder's account
+	// is unregistered:
+	Successor string
+	Retention HistoryRetention
+	// when the founder or successor last joined, for registration expiry:
+	LastUsed time.Time
+	// when the channel was last warned that its registration will expire:
+	ExpiryWarned time.Time
+	// exempts the channel from registration expiry (set by CS HOLD):
+	Held bool `json:",omitempty"`
+}
+
+// MembershipVisibility controls what non-members of a channel can learn about
+// its membership, via NAMES, WHO, and WHOIS.
+type MembershipVisibility uint
+
+const (
+	// VisibilityFull: all members who aren't +i are visible
+	VisibilityFull MembershipVisibility = iota
+	// VisibilityOps: only members with halfop or higher are visible
+	VisibilityOps
+	// VisibilityNone: no members are visible
+	VisibilityNone
+)
+
+func membershipVisibilityFromString(str string) (result MembershipVisibility, err error) {
+	switch strings.ToLower(str) {
+	case "full", "default":
+		return VisibilityFull, nil
+	case "ops", "ops-only":
+		return VisibilityOps, nil
+	case "none":
+		return VisibilityNone, nil
+	default:
+		return VisibilityFull, errInvalidParams
+	}
+}
+
+func membershipVisibilityToString(visibility MembershipVisibility) string {
+	switch visibility {
+	case VisibilityFull:
+		return "full"
+	case VisibilityOps:
+		return "ops"
+	case VisibilityNone:
+		return "none"
+	default:
+		return ""
+	}
 }
 
 // Channel represents a channel that clients can join.
 type Channel struct {
 	flags             modes.ModeSet
 	lists             map[modes.Mode]*UserMaskSet
+	expiryTimer       *time.Timer // removes expiring list masks and timed modes, e.g., timed bans
 	key               string
 	members           MemberSet
 	membersCache      []*Client // allow iteration over channel members without holding the lock
+	delayedJoins      ClientSet // members whose JOIN is hidden until they speak (+D), or at all (+A)
+	anonSecret        string    // keys the pseudonyms of anonymous members (+A)
+	anonSources       map[string]anonSource
 	name              string
 	nameCasefolded    string
 	server            *Server
@@ -40,6 +97,7 @@ type Channel struct {
 	topic             string
 	topicSetBy        string
 	topicSetTime      time.Time
+	topicHistory      []TopicHistoryEntry // previous topics, oldest first
 	userLimit         int
 	accountToUMode    map[string]modes.Mode
 	history           history.Buffer
@@ -49,6 +107,12 @@ type Channel struct {
 	ensureLoaded      utils.Once      // manages loading stored registration info from the database
 	dirtyBits         uint
 	settings          ChannelSettings
+	akicks            *UserMaskSet // CS AKICK
+	badwords          []Badword    // CS BADWORDS
+	badwordMatchers   []badwordMatcher
+	timedModes        []TimedMode // TIMEDMODE
+
+	memberListCache memberListCache // rendered WHO and NAMES replies
 }
 
 // NewChannel creates a new channel from a `Server` and a `name`
@@ -59,12 +123,14 @@ func NewChannel(s *Server, name, casefoldedName string, registered bool) *Channe
 	channel := &Channel{
 		createdTime:    time.Now().UTC(), // may be overwritten by applyRegInfo
 		members:        make(MemberSet),
+		delayedJoins:   make(ClientSet),
 		name:           name,
 		nameCasefolded: casefoldedName,
 		server:         s,
 	}
 
 	channel.initializeLists()
+	channel.akicks = NewUserMaskSet()
 	channel.writerSemaphore.Initialize(1)
 	channel.history.Initialize(0, 0)
 
@@ -110,7 +176,8 @@ func (channel *Channel) IsLoaded() bool {
 func (channel *Channel) resizeHistory(config *Config) {
 	status, _ := channel.historyStatus(config)
 	if status == HistoryEphemeral {
-		channel.history.Resize(config.History.ChannelLength, time.Duration(config.History.AutoresizeWindow))
+		length := channel.Settings().Retention.limitLength(config.History.ChannelLength)
+		channel.history.Resize(length, time.Duration(config.History.AutoresizeWindow))
 	} else {
 		channel.history.Resize(0, 0)
 	}
@@ -118,6 +185,7 @@ func (channel *Channel) resizeHistory(config *Config) {
 
 // read in channel state that was persisted in the DB
 func (channel *Channel) applyRegInfo(chanReg RegisteredChannel) {
+	defer channel.scheduleExpiry()
 	defer channel.resizeHistory(channel.server.Config())
 
 	channel.stateMutex.Lock()
@@ -128,6 +196,7 @@ func (channel *Channel) applyRegInfo(chanReg RegisteredChannel) {
 	channel.topic = chanReg.Topic
 	channel.topicSetBy = chanReg.TopicSetBy
 	channel.topicSetTime = chanReg.TopicSetTime
+	channel.topicHistory = chanReg.TopicHistory
 	channel.name = chanReg.Name
 	channel.createdTime = chanReg.RegisteredAt
 	channel.key = chanReg.Key
@@ -137,12 +206,63 @@ func (channel *Channel) applyRegInfo(chanReg RegisteredChannel) {
 	for _, mode := range chanReg.Modes {
 		channel.flags.SetMode(mode, true)
 	}
+	channel.timedModes = chanReg.TimedModes
 	for account, mode := range chanReg.AccountToUMode {
 		channel.accountToUMode[account] = mode
 	}
 	channel.lists[modes.BanMask].SetMasks(chanReg.Bans)
 	channel.lists[modes.InviteMask].SetMasks(chanReg.Invites)
 	channel.lists[modes.ExceptMask].SetMasks(chanReg.Excepts)
+	channel.akicks.SetMasks(chanReg.Akicks)
+	channel.badwords = chanReg.Badwords
+	channel.badwordMatchers = compileBadwords(chanReg.Badwords)
+}
+
+// scheduleExpiry arms a timer to remove the next list mask or timed mode
+// to expire, if any
+func (channel *Channel) scheduleExpiry() {
+	next := channel.nextTimedModeExpiration()
+	for _, list := range channel.lists {
+		if expiry := list.NextExpiration(); !expiry.IsZero() && (next.IsZero() || expiry.Before(next)) {
+			next = expiry
+		}
+	}
+
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+	if channel.expiryTimer != nil {
+		channel.expiryTimer.Stop()
+		channel.expiryTimer = nil
+	}
+	if !next.IsZero() {
+		channel.expiryTimer = time.AfterFunc(time.Until(next), channel.processExpiry)
+	}
+}
+
+// processExpiry removes expired list masks, reverts expired timed modes,
+// and announces the changes
+func (channel *Channel) processExpiry() {
+	// if the channel was unloaded, it will be rescheduled when it's loaded again
+	if channel.server.channels.Get(channel.Name()) != channel {
+		return
+	}
+
+	now := time.Now().UTC()
+	changes := channel.expireTimedModes(now)
+	listsChanged := false
+	for _, mode := range []modes.Mode{modes.BanMask, modes.ExceptMask, modes.InviteMask} {
+		for _, mask := range channel.lists[mode].Expire(now) {
+			changes = append(changes, modes.ModeChange{Mode: mode, Op: modes.Remove, Arg: mask})
+			listsChanged = true
+		}
+	}
+	if listsChanged {
+		channel.MarkDirty(IncludeLists)
+	}
+	if len(changes) != 0 {
+		announceCmodeChanges(channel, changes, channel.server.name, "*", "", nil)
+	}
+	channel.scheduleExpiry()
 }
 
 // obtain a consistent snapshot of the channel state that can be persisted to the DB
@@ -159,12 +279,14 @@ func (channel *Channel) ExportRegistration(includeFlags uint) (info RegisteredCh
 		info.Topic = channel.topic
 		info.TopicSetBy = channel.topicSetBy
 		info.TopicSetTime = channel.topicSetTime
+		info.TopicHistory = append([]TopicHistoryEntry(nil), channel.topicHistory...)
 	}
 
 	if includeFlags&IncludeModes != 0 {
 		info.Key = channel.key
 		info.Modes = channel.flags.AllModes()
 		info.UserLimit = channel.userLimit
+		info.TimedModes = append([]TimedMode(nil), channel.timedModes...)
 	}
 
 	if includeFlags&IncludeLists != 0 {
@@ -175,6 +297,8 @@ func (channel *Channel) ExportRegistration(includeFlags uint) (info RegisteredCh
 		for account, mode := range channel.accountToUMode {
 			info.AccountToUMode[account] = mode
 		}
+		info.Akicks = channel.akicks.Masks()
+		info.Badwords = append([]Badword(nil), channel.badwords...)
 	}
 
 	if includeFlags&IncludeSettings != 0 {
@@ -238,8 +362,11 @@ func (channel *Channel) wakeWriter() {
 func (channel *Channel) writeLoop() {
 	for {
 		// TODO(#357) check the error value of this and implement timed backoff
-		channel.performWrite(0)
+		err := channel.performWrite(0)
 		channel.writerSemaphore.Release()
+		if err == errReadOnly {
+			return // we'll be woken up again when read-only mode is disabled
+		}
 
 		channel.stateMutex.RLock()
 		isDirty := channel.dirtyBits != 0
@@ -284,6 +411,11 @@ func (channel *Channel) Store(dirtyBits uint) (err error) {
 // do an individual write; equivalent of Socket.send()
 func (channel *Channel) performWrite(additionalDirtyBits uint) (err error) {
 	channel.stateMutex.Lock()
+	if channel.server.ReadOnly() {
+		channel.dirtyBits = channel.dirtyBits | additionalDirtyBits
+		channel.stateMutex.Unlock()
+		return errReadOnly
+	}
 	dirtyBits := channel.dirtyBits | additionalDirtyBits
 	channel.dirtyBits = 0
 	isRegistered := channel.registeredFounder != ""
@@ -313,6 +445,8 @@ func (channel *Channel) SetRegistered(founder string) error {
 	}
 	channel.registeredFounder = founder
 	channel.registeredTime = time.Now().UTC()
+	channel.settings.LastUsed = channel.registeredTime
+	channel.settings.ExpiryWarned = time.Time{}
 	channel.accountToUMode[founder] = modes.ChannelFounder
 	return nil
 }
@@ -399,6 +533,60 @@ func (channel *Channel) transferOwnership(newOwner string) {
 	channel.registeredFounder = newOwner
 	channel.accountToUMode[channel.registeredFounder] = modes.ChannelFounder
 	channel.transferPendingTo = ""
+	// the successor was chosen by the previous founder:
+	channel.settings.Successor = ""
+}
+
+// TransferToSuccessor makes `successor` the founder, if the channel is still
+// owned by `founder` and `successor` is still its designated successor.
+func (channel *Channel) TransferToSuccessor(founder, successor string) (success bool) {
+	channel.stateMutex.Lock()
+	success = channel.registeredFounder == founder && channel.settings.Successor == successor
+	if success {
+		channel.transferOwnership(successor)
+	}
+	channel.stateMutex.Unlock()
+
+	if success {
+		channel.Store(IncludeAllAttrs)
+	}
+	return
+}
+
+// reassignAccount replaces references to an account that was renamed, or
+// merged into another account, in the in-memory channel state; the database
+// is updated by ChannelRegistry.reassignAccount.
+func (channel *Channel) reassignAccount(oldAccount, newAccount string) {
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+
+	if channel.registeredFounder == oldAccount {
+		channel.registeredFounder = newAccount
+	}
+	channel.accountToUMode = reassignAccountUMode(channel.accountToUMode, oldAccount, newAccount)
+	if channel.settings.Successor == oldAccount {
+		channel.settings.Successor = newAccount
+	}
+	if channel.settings.Successor == channel.registeredFounder {
+		channel.settings.Successor = ""
+	}
+	if channel.transferPendingTo == oldAccount {
+		channel.transferPendingTo = newAccount
+	}
+}
+
+// reassignAccountUMode moves the amode of oldAccount to newAccount, keeping
+// newAccount's existing amode if that is higher.
+func reassignAccountUMode(accountToUMode map[string]modes.Mode, oldAccount, newAccount string) map[string]modes.Mode {
+	mode, ok := accountToUMode[oldAccount]
+	if !ok {
+		return accountToUMode
+	}
+	delete(accountToUMode, oldAccount)
+	if current, ok := accountToUMode[newAccount]; !ok || umodeGreaterThan(mode, current) {
+		accountToUMode[newAccount] = mode
+	}
+	return accountToUMode
 }
 
 // AcceptTransfer implements `CS TRANSFER #chan ACCEPT`
@@ -435,56 +623,66 @@ func (channel *Channel) regenerateMembersCache() {
 	channel.stateMutex.Lock()
 	channel.membersCache = result
 	channel.stateMutex.Unlock()
+	channel.memberListCache.Invalidate()
 }
 
 // Names sends the list of users joined to the channel to the given client.
 func (channel *Channel) Names(client *Client, rb *ResponseBuffer) {
-	channel.stateMutex.RLock()
-	clientModes, isJoined := channel.members[client]
-	channel.stateMutex.RUnlock()
-	isOper := client.HasMode(modes.Operator)
-	respectAuditorium := channel.flags.HasMode(modes.Auditorium) && !isOper &&
-		(!isJoined || clientModes.HighestChannelUserMode() == modes.Mode(0))
 	isMultiPrefix := rb.session.capabilities.Has(caps.MultiPrefix)
 	isUserhostInNames := rb.session.capabilities.Has(caps.UserhostInNames)
 
+	renderName := func(target *Client) (name string, ok bool) {
+		var nick string
+		if isUserhostInNames {
+			nick = target.NickMaskString()
+		} else {
+			nick = target.Nick()
+		}
+		channel.stateMutex.RLock()
+		modeSet := channel.members[target]
+		channel.stateMutex.RUnlock()
+		if modeSet == nil {
+			return "", false
+		}
+		return modeSet.Prefixes(isMultiPrefix) + nick, true
+	}
+	var names []string
+	if view, ok := channel.cacheableMemberListView(client, false); ok {
+		kind := fmt.Sprintf("NAMES %t %t", isMultiPrefix, isUserhostInNames)
+		rows := channel.cachedMemberList(client, view, kind, func(member *Client) ([]string, bool) {
+			name, ok := renderName(member)
+			return []string{name}, ok
+		})
+		for _, row := range rows {
+			if row.params != nil {
+				names = append(names, row.params[0])
+			} else if name, ok := renderName(row.member); ok {
+				names = append(names, name)
+			}
+		}
+	} else {
+		for _, target := range channel.visibleMembers(client) {
+			if name, ok := renderName(target); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
 	maxNamLen := 480 - len(client.server.name) - len(client.Nick())
 	var namesLines []string
 	var buffer strings.Builder
-	if isJoined || !channel.flags.HasMode(modes.Secret) || isOper {
-		for _, target := range channel.Members() {
-			var nick string
-			if isUserhostInNames {
-				nick = target.NickMaskString()
-			} else {
-				nick = target.Nick()
-			}
-			channel.stateMutex.RLock()
-			modeSet := channel.members[target]
-			channel.stateMutex.RUnlock()
-			if modeSet == nil {
-				continue
-			}
-			if !isJoined && target.HasMode(modes.Invisible) && !isOper {
-				continue
-			}
-			if respectAuditorium && modeSet.HighestChannelUserMode() == modes.Mode(0) {
-				continue
-			}
-			prefix := modeSet.Prefixes(isMultiPrefix)
-			if buffer.Len()+len(nick)+len(prefix)+1 > maxNamLen {
-				namesLines = append(namesLines, buffer.String())
-				buffer.Reset()
-			}
-			if buffer.Len() > 0 {
-				buffer.WriteString(" ")
-			}
-			buffer.WriteString(prefix)
-			buffer.WriteString(nick)
+	for _, name := range names {
+		if buffer.Len()+len(name)+1 > maxNamLen {
+			namesLines = append(namesLines, buffer.String())
+			buffer.Reset()
 		}
 		if buffer.Len() > 0 {
-			namesLines = append(namesLines, buffer.String())
+			buffer.WriteString(" ")
 		}
+		buffer.WriteString(name)
+	}
+	if buffer.Len() > 0 {
+		namesLines = append(namesLines, buffer.String())
 	}
 
 	for _, line := range namesLines {
@@ -575,6 +773,7 @@ func (channel *Channel) setModesForClient(client *Client, modeStr string) {
 		return
 	}
 	channel.members[client] = newModes
+	channel.memberListCache.Invalidate()
 }
 
 func (channel *Channel) ClientHasPrivsOver(client *Client, target *Client) bool {
@@ -680,13 +879,24 @@ func channelHistoryStatus(config *Config, registered bool, storedStatus HistoryS
 }
 
 func (channel *Channel) AddHistoryItem(item history.Item, account string) (err error) {
+	return channel.addLimitedHistoryItem(item, account, HistoryDefault)
+}
+
+// addLimitedHistoryItem adds a history item, respecting the author's
+// AuthoredHistory setting (see limitHistoryStatus).
+func (channel *Channel) addLimitedHistoryItem(item history.Item, account string, authorLimit HistoryStatus) (err error) {
 	if !itemIsStorable(&item, channel.server.Config()) {
 		return
 	}
 
 	status, target := channel.historyStatus(channel.server.Config())
+	status = limitHistoryStatus(status, authorLimit)
 	if status == HistoryPersistent {
-		err = channel.server.historyDB.AddChannelItem(target, item, account)
+		channel.server.historyQueue.Enqueue(channel.server, history.PersistentWrite{
+			Item:    item,
+			Channel: target,
+			Account: account,
+		})
 	} else if status == HistoryEphemeral {
 		channel.history.Add(item)
 	}
@@ -707,6 +917,7 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 	chcount := len(channel.members)
 	_, alreadyJoined := channel.members[client]
 	persistentMode := channel.accountToUMode[details.account]
+	openHours := channel.settings.OpenHours
 	channel.stateMutex.RUnlock()
 
 	if alreadyJoined {
@@ -731,13 +942,22 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 		}
 
 		if channel.flags.HasMode(modes.InviteOnly) &&
-			!channel.lists[modes.InviteMask].Match(details.nickMaskCasefolded) {
+			!channel.lists[modes.InviteMask].MatchClient(client) {
 			return errInviteOnly
 		}
 
-		if channel.lists[modes.BanMask].Match(details.nickMaskCasefolded) &&
-			!channel.lists[modes.ExceptMask].Match(details.nickMaskCasefolded) &&
-			!channel.lists[modes.InviteMask].Match(details.nickMaskCasefolded) {
+		if channel.lists[modes.BanMask].MatchClient(client) &&
+			!channel.lists[modes.ExceptMask].MatchClient(client) &&
+			!channel.lists[modes.InviteMask].MatchClient(client) {
+			return errBanned
+		}
+
+		if mask, info, autokicked := channel.checkAutokick(client); autokicked {
+			channel.reportAutokick(client, mask)
+			channel.serviceBan(chanservService.prefix, mask)
+			if rb != nil {
+				rb.Add(nil, chanservService.prefix, "NOTICE", details.nick, fmt.Sprintf(client.t("You are autokicked from %[1]s: %[2]s"), chname, autokickReason(info)))
+			}
 			return errBanned
 		}
 
@@ -745,6 +965,10 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 			(channel.flags.HasMode(modes.RegisteredOnly) || channel.server.Defcon() <= 2) {
 			return errRegisteredOnly
 		}
+
+		if now := time.Now(); !openHours.IsOpen(now) {
+			return &channelClosedError{nextOpen: openHours.NextOpen(now)}
+		}
 	}
 
 	if joinErr := client.addChannel(channel, rb == nil); joinErr != nil {
@@ -753,6 +977,7 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 
 	client.server.logger.Debug("join", fmt.Sprintf("%s joined channel %s", details.nick, chname))
 
+	var touched bool
 	givenMode := func() (givenMode modes.Mode) {
 		channel.joinPartMutex.Lock()
 		defer channel.joinPartMutex.Unlock()
@@ -762,6 +987,7 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 			defer channel.stateMutex.Unlock()
 
 			channel.members.Add(client)
+			touched = channel.touchRegistrationNoMutex(details.account)
 			firstJoin := len(channel.members) == 1
 			newChannel := firstJoin && channel.registeredFounder == ""
 			if newChannel {
@@ -771,6 +997,9 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 			}
 			if givenMode != 0 {
 				channel.members[client].SetMode(givenMode, true)
+			} else if rb != nil && (channel.flags.HasMode(modes.DelayedJoin) || channel.flags.HasMode(modes.Anonymous)) {
+				// no JOIN line or history item until they speak (or ever, for +A)
+				channel.delayedJoins.Add(client)
 			}
 		}()
 
@@ -779,10 +1008,15 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 		return
 	}()
 
+	if touched {
+		channel.MarkDirty(IncludeSettings)
+	}
+
 	var message utils.SplitMessage
 	respectAuditorium := givenMode == modes.Mode(0) && channel.flags.HasMode(modes.Auditorium)
+	delayJoin := channel.joinIsDelayed(client)
 	// no history item for fake persistent joins
-	if rb != nil && !respectAuditorium {
+	if rb != nil && !respectAuditorium && !delayJoin {
 		message = utils.MakeMessage("")
 		histItem := history.Item{
 			Type:        history.Join,
@@ -808,6 +1042,9 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 	cache.Initialize(channel.server, message.Time, message.Msgid, details.nickMask, details.accountName, nil, "JOIN", chname)
 	isAway, awayMessage := client.Away()
 	for _, member := range channel.Members() {
+		if delayJoin && member != client {
+			continue
+		}
 		if respectAuditorium {
 			channel.stateMutex.RLock()
 			memberModes, ok := channel.members[member]
@@ -861,6 +1098,88 @@ func (channel *Channel) Join(client *Client, key string, isSajoin bool, rb *Resp
 	return nil
 }
 
+func (channel *Channel) joinIsDelayed(client *Client) (delayed bool) {
+	channel.stateMutex.RLock()
+	delayed = channel.delayedJoins.Has(client)
+	channel.stateMutex.RUnlock()
+	return
+}
+
+// revealDelayedJoin sends the JOIN line that was withheld from the other
+// members of a +D channel, then records the join in history.
+func (channel *Channel) revealDelayedJoin(client *Client) {
+	channel.stateMutex.Lock()
+	clientModes := channel.members[client]
+	delayed := channel.delayedJoins.Has(client) &&
+		!(channel.flags.HasMode(modes.Anonymous) && clientModes.HighestChannelUserMode() == modes.Mode(0))
+	if delayed {
+		channel.delayedJoins.Remove(client)
+	}
+	chname := channel.name
+	channel.stateMutex.Unlock()
+
+	if !delayed {
+		return
+	}
+	channel.memberListCache.Invalidate()
+
+	details := client.Details()
+	message := utils.MakeMessage("")
+	respectAuditorium := channel.flags.HasMode(modes.Auditorium) &&
+		clientModes.HighestChannelUserMode() == modes.Mode(0)
+	var cache MessageCache
+	cache.Initialize(channel.server, message.Time, message.Msgid, details.nickMask, details.accountName, nil, "JOIN", chname)
+	isAway, awayMessage := client.Away()
+	for _, member := range channel.Members() {
+		if member == client {
+			continue
+		}
+		if respectAuditorium {
+			channel.stateMutex.RLock()
+			memberModes, ok := channel.members[member]
+			channel.stateMutex.RUnlock()
+			if !ok || memberModes.HighestChannelUserMode() == modes.Mode(0) {
+				continue
+			}
+		}
+		for _, session := range member.Sessions() {
+			if session.capabilities.Has(caps.ExtendedJoin) {
+				session.sendFromClientInternal(false, message.Time, message.Msgid, details.nickMask, details.accountName, nil, "JOIN", chname, details.accountName, details.realname)
+			} else {
+				cache.Send(session)
+			}
+			if isAway && session.capabilities.Has(caps.AwayNotify) {
+				session.sendFromClientInternal(false, time.Time{}, "", details.nickMask, details.accountName, nil, "AWAY", awayMessage)
+			}
+		}
+	}
+
+	if !respectAuditorium {
+		histItem := history.Item{
+			Type:        history.Join,
+			Nick:        details.nickMask,
+			AccountName: details.accountName,
+			Message:     message,
+		}
+		histItem.Params[0] = details.realname
+		channel.AddHistoryItem(histItem, details.account)
+	}
+}
+
+// revealAllDelayedJoins is called when +D or +A is removed from the channel.
+func (channel *Channel) revealAllDelayedJoins() {
+	channel.stateMutex.RLock()
+	delayed := make([]*Client, 0, len(channel.delayedJoins))
+	for client := range channel.delayedJoins {
+		delayed = append(delayed, client)
+	}
+	channel.stateMutex.RUnlock()
+
+	for _, client := range delayed {
+		channel.revealDelayedJoin(client)
+	}
+}
+
 func (channel *Channel) autoReplayHistory(client *Client, rb *ResponseBuffer, skipMsgid string) {
 	// autoreplay any messages as necessary
 	var items []history.Item
@@ -923,17 +1242,23 @@ func (channel *Channel) autoReplayHistory(client *Client, rb *ResponseBuffer, sk
 // channels, and also when one session of a client initiates a JOIN and the other
 // sessions need to receive the state change
 func (channel *Channel) playJoinForSession(session *Session) {
-	client := session.client
 	sessionRb := NewResponseBuffer(session)
+	channel.addJoinForSession(sessionRb)
+	sessionRb.Send(false)
+}
+
+// addJoinForSession adds the JOIN, topic, and NAMES lines that show an
+// additional session of a member that it is joined to the channel.
+func (channel *Channel) addJoinForSession(rb *ResponseBuffer) {
+	client := rb.target
 	details := client.Details()
-	if session.capabilities.Has(caps.ExtendedJoin) {
-		sessionRb.Add(nil, details.nickMask, "JOIN", channel.Name(), details.accountName, details.realname)
+	if rb.session.capabilities.Has(caps.ExtendedJoin) {
+		rb.Add(nil, details.nickMask, "JOIN", channel.Name(), details.accountName, details.realname)
 	} else {
-		sessionRb.Add(nil, details.nickMask, "JOIN", channel.Name())
+		rb.Add(nil, details.nickMask, "JOIN", channel.Name())
 	}
-	channel.SendTopic(client, sessionRb, false)
-	channel.Names(client, sessionRb)
-	sessionRb.Send(false)
+	channel.SendTopic(client, rb, false)
+	channel.Names(client, rb)
 }
 
 // Part parts the given client from this channel, with the given message.
@@ -941,6 +1266,7 @@ func (channel *Channel) Part(client *Client, message string, rb *ResponseBuffer)
 	channel.stateMutex.RLock()
 	chname := channel.name
 	clientModes, ok := channel.members[client]
+	isDelayed := channel.delayedJoins.Has(client)
 	channel.stateMutex.RUnlock()
 
 	if !ok {
@@ -962,17 +1288,20 @@ func (channel *Channel) Part(client *Client, message string, rb *ResponseBuffer)
 		clientModes.HighestChannelUserMode() == modes.Mode(0)
 	var cache MessageCache
 	cache.Initialize(channel.server, splitMessage.Time, splitMessage.Msgid, details.nickMask, details.accountName, nil, "PART", params...)
-	for _, member := range channel.Members() {
-		if respectAuditorium {
-			channel.stateMutex.RLock()
-			memberModes, ok := channel.members[member]
-			channel.stateMutex.RUnlock()
-			if !ok || memberModes.HighestChannelUserMode() == modes.Mode(0) {
-				continue
+	// if their join was delayed, nobody saw them join, so nobody sees them leave
+	if !isDelayed {
+		for _, member := range channel.Members() {
+			if respectAuditorium {
+				channel.stateMutex.RLock()
+				memberModes, ok := channel.members[member]
+				channel.stateMutex.RUnlock()
+				if !ok || memberModes.HighestChannelUserMode() == modes.Mode(0) {
+					continue
+				}
+			}
+			for _, session := range member.Sessions() {
+				cache.Send(session)
 			}
-		}
-		for _, session := range member.Sessions() {
-			cache.Send(session)
 		}
 	}
 	rb.AddFromClient(splitMessage.Time, splitMessage.Msgid, details.nickMask, details.accountName, nil, "PART", params...)
@@ -982,7 +1311,7 @@ func (channel *Channel) Part(client *Client, message string, rb *ResponseBuffer)
 		}
 	}
 
-	if !respectAuditorium {
+	if !respectAuditorium && !isDelayed {
 		channel.AddHistoryItem(history.Item{
 			Type:        history.Part,
 			Nick:        details.nickMask,
@@ -1016,13 +1345,14 @@ func (channel *Channel) resumeAndAnnounce(session *Session) {
 	if 0 < len(oldModes) {
 		oldModes = "+" + oldModes
 	}
+	isDelayed := channel.joinIsDelayed(session.client)
 
 	// send join for old clients
 	chname := channel.Name()
 	details := session.client.Details()
 	// TODO: for now, skip this entirely for auditoriums,
 	// but really we should send it to voiced clients
-	if !channel.flags.HasMode(modes.Auditorium) {
+	if !channel.flags.HasMode(modes.Auditorium) && !isDelayed {
 		for _, member := range channel.Members() {
 			for _, mSes := range member.Sessions() {
 				if mSes == session || mSes.capabilities.Has(caps.Resume) {
@@ -1081,6 +1411,16 @@ func stripMaskFromNick(nickMask string) (nick string) {
 	return nickMask[0:index]
 }
 
+// historyItemIsVisible returns whether `client` could have received the
+// original message (i.e., respecting STATUSMSG).
+func (channel *Channel) historyItemIsVisible(client *Client, item *history.Item) bool {
+	if item.StatusPrefix == "" {
+		return true
+	}
+	minPrefixMode := modes.GetLowestChannelModePrefix(item.StatusPrefix)
+	return minPrefixMode != modes.Mode(0) && channel.ClientIsAtLeast(client, minPrefixMode)
+}
+
 func (channel *Channel) replayHistoryItems(rb *ResponseBuffer, items []history.Item, autoreplay bool) {
 	// send an empty batch if necessary, as per the CHATHISTORY spec
 	chname := channel.Name()
@@ -1103,15 +1443,18 @@ func (channel *Channel) replayHistoryItems(rb *ResponseBuffer, items []history.I
 	defer rb.EndNestedBatch(batchID)
 
 	for _, item := range items {
+		if !channel.historyItemIsVisible(client, &item) {
+			continue
+		}
 		nick := stripMaskFromNick(item.Nick)
 		switch item.Type {
 		case history.Privmsg:
-			rb.AddSplitMessageFromClient(item.Nick, item.AccountName, item.Tags, "PRIVMSG", chname, item.Message)
+			rb.AddSplitMessageFromClient(item.Nick, item.AccountName, item.Tags, "PRIVMSG", item.StatusPrefix+chname, item.Message)
 		case history.Notice:
-			rb.AddSplitMessageFromClient(item.Nick, item.AccountName, item.Tags, "NOTICE", chname, item.Message)
+			rb.AddSplitMessageFromClient(item.Nick, item.AccountName, item.Tags, "NOTICE", item.StatusPrefix+chname, item.Message)
 		case history.Tagmsg:
 			if eventPlayback {
-				rb.AddSplitMessageFromClient(item.Nick, item.AccountName, item.Tags, "TAGMSG", chname, item.Message)
+				rb.AddSplitMessageFromClient(item.Nick, item.AccountName, item.Tags, "TAGMSG", item.StatusPrefix+chname, item.Message)
 			}
 		case history.Join:
 			if eventPlayback {
@@ -1228,13 +1571,23 @@ func (channel *Channel) SetTopic(client *Client, topic string, rb *ResponseBuffe
 		return
 	}
 
-	topicLimit := client.server.Config().Limits.TopicLen
+	config := client.server.Config()
+	topicLimit := config.Limits.TopicLen
 	if len(topic) > topicLimit {
 		topic = topic[:topicLimit]
 	}
 
+	channel.revealDelayedJoin(client)
+
 	channel.stateMutex.Lock()
 	chname := channel.name
+	if channel.topic != "" && channel.topic != topic {
+		channel.topicHistory = appendTopicHistory(channel.topicHistory, TopicHistoryEntry{
+			Topic:   channel.topic,
+			SetBy:   channel.topicSetBy,
+			SetTime: channel.topicSetTime,
+		}, config.Channels.TopicHistoryLength)
+	}
 	channel.topic = topic
 	channel.topicSetBy = client.nickMaskString
 	channel.topicSetTime = time.Now().UTC()
@@ -1261,6 +1614,30 @@ func (channel *Channel) SetTopic(client *Client, topic string, rb *ResponseBuffe
 	channel.MarkDirty(IncludeTopic)
 }
 
+// appendTopicHistory adds a replaced topic to a channel's topic history,
+// discarding the oldest entries beyond maxLength.
+func appendTopicHistory(topicHistory []TopicHistoryEntry, entry TopicHistoryEntry, maxLength int) []TopicHistoryEntry {
+	if maxLength <= 0 {
+		return nil
+	}
+	topicHistory = append(topicHistory, entry)
+	if excess := len(topicHistory) - maxLength; excess > 0 {
+		topicHistory = append([]TopicHistoryEntry(nil), topicHistory[excess:]...)
+	}
+	return topicHistory
+}
+
+// TopicHistory returns the channel's previous topics, most recent first.
+func (channel *Channel) TopicHistory() (result []TopicHistoryEntry) {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	result = make([]TopicHistoryEntry, len(channel.topicHistory))
+	for i, entry := range channel.topicHistory {
+		result[len(result)-1-i] = entry
+	}
+	return
+}
+
 // CanSpeak returns true if the client can speak on this channel, otherwise it returns false along with the channel mode preventing the client from speaking.
 func (channel *Channel) CanSpeak(client *Client) (bool, modes.Mode) {
 	channel.stateMutex.RLock()
@@ -1288,12 +1665,8 @@ func (channel *Channel) CanSpeak(client *Client) (bool, modes.Mode) {
 }
 
 func (channel *Channel) isMuted(client *Client) bool {
-	muteRe := channel.lists[modes.BanMask].MuteRegexp()
-	if muteRe == nil {
-		return false
-	}
-	nuh := client.NickMaskCasefolded()
-	return muteRe.MatchString(nuh) && !channel.lists[modes.ExceptMask].MatchMute(nuh)
+	return channel.lists[modes.BanMask].MatchMuteClient(client) &&
+		!channel.lists[modes.ExceptMask].MatchMuteClient(client)
 }
 
 func msgCommandToHistType(command string) (history.ItemType, error) {
@@ -1317,7 +1690,7 @@ func (channel *Channel) SendSplitMessage(command string, minPrefixMode modes.Mod
 
 	if canSpeak, mode := channel.CanSpeak(client); !canSpeak {
 		if histType != history.Notice {
-			rb.Add(nil, client.server.name, ERR_CANNOTSENDTOCHAN, client.Nick(), channel.Name(), fmt.Sprintf(client.t("Cannot send to channel (+%s)"), mode))
+			rb.FailNumeric(ERR_CANNOTSENDTOCHAN, command, "CANNOT_SEND", channel.Name(), fmt.Sprintf(client.t("Cannot send to channel (+%s)"), mode))
 		}
 		return
 	}
@@ -1325,19 +1698,50 @@ func (channel *Channel) SendSplitMessage(command string, minPrefixMode modes.Mod
 	isCTCP := message.IsRestrictedCTCPMessage()
 	if isCTCP && channel.flags.HasMode(modes.NoCTCP) {
 		if histType != history.Notice {
-			rb.Add(nil, client.server.name, ERR_CANNOTSENDTOCHAN, client.Nick(), channel.Name(), fmt.Sprintf(client.t("Cannot send to channel (+%s)"), "C"))
+			rb.FailNumeric(ERR_CANNOTSENDTOCHAN, command, "CANNOT_SEND", channel.Name(), fmt.Sprintf(client.t("Cannot send to channel (+%s)"), "C"))
 		}
 		return
 	}
 
+	// typing notifications are silently dropped under +Y, and from users
+	// whose join is still hidden (+D), since they shouldn't reveal it
+	isTyping := histType == history.Tagmsg && isTypingNotification(clientOnlyTags)
+	if isTyping {
+		channel.stateMutex.RLock()
+		delayed := channel.delayedJoins.Has(client)
+		channel.stateMutex.RUnlock()
+		if delayed || channel.flags.HasMode(modes.NoTyping) {
+			return
+		}
+	} else {
+		channel.revealDelayedJoin(client)
+	}
+
+	if histType != history.Tagmsg {
+		var ok bool
+		if message, ok = channel.applyBadwords(client, message); !ok {
+			return
+		}
+		message = channel.applyCensor(message)
+	}
+
 	details := client.Details()
+	if channel.flags.HasMode(modes.Anonymous) && !channel.ClientIsAtLeast(client, modes.Voice) {
+		// relay the message from a pseudonym (+A)
+		details.nickMask = channel.pseudonymFor(client)
+		details.accountName = "*"
+		details.account = ""
+	}
 	chname := channel.Name()
 
 	// STATUSMSG targets are prefixed with the supplied min-prefix, e.g., @#channel
+	var statusPrefix string
 	if minPrefixMode != modes.Mode(0) {
-		chname = fmt.Sprintf("%s%s", modes.ChannelModePrefixes[minPrefixMode], chname)
+		statusPrefix = modes.ChannelModePrefixes[minPrefixMode]
+		chname = fmt.Sprintf("%s%s", statusPrefix, chname)
 	}
 
+	isOpModerated := false
 	if channel.flags.HasMode(modes.OpModerated) {
 		channel.stateMutex.RLock()
 		cuModes := channel.members[client]
@@ -1346,6 +1750,7 @@ func (channel *Channel) SendSplitMessage(command string, minPrefixMode modes.Mod
 			// max(statusmsg_minmode, halfop)
 			if minPrefixMode == modes.Mode(0) || minPrefixMode == modes.Voice {
 				minPrefixMode = modes.Halfop
+				isOpModerated = true
 			}
 		}
 	}
@@ -1355,10 +1760,16 @@ func (channel *Channel) SendSplitMessage(command string, minPrefixMode modes.Mod
 
 	var cache MessageCache
 	cache.InitializeSplitMessage(channel.server, details.nickMask, details.accountName, clientOnlyTags, command, chname, message)
-	for _, member := range channel.Members() {
+	channel.server.fanout(channel.Members(), func(member *Client) {
 		if minPrefixMode != modes.Mode(0) && !channel.ClientIsAtLeast(member, minPrefixMode) {
 			// STATUSMSG or OpModerated
-			continue
+			return
+		}
+		if isTyping && member.HasMode(modes.UserNoTyping) {
+			return
+		}
+		if member != client && member.HasMode(modes.UserDeaf) {
+			return
 		}
 
 		for _, session := range member.Sessions() {
@@ -1372,18 +1783,29 @@ func (channel *Channel) SendSplitMessage(command string, minPrefixMode modes.Mod
 
 			cache.Send(session)
 		}
+	})
+
+	// #959: don't save OpModerated messages; STATUSMSG is saved with its prefix,
+	// so that it is only replayed to members who could have received it
+	if !isOpModerated {
+		channel.addLimitedHistoryItem(history.Item{
+			Type:         histType,
+			Message:      message,
+			Nick:         details.nickMask,
+			AccountName:  details.accountName,
+			Tags:         clientOnlyTags,
+			StatusPrefix: statusPrefix,
+		}, details.account, client.authoredHistoryLimit())
 	}
+}
 
-	// #959: don't save STATUSMSG (or OpModerated)
-	if minPrefixMode == modes.Mode(0) {
-		channel.AddHistoryItem(history.Item{
-			Type:        histType,
-			Message:     message,
-			Nick:        details.nickMask,
-			AccountName: details.accountName,
-			Tags:        clientOnlyTags,
-		}, details.account)
+// authoredHistoryLimit returns the limit the client places on storage of
+// messages it sends to channels (NS SET HISTORY).
+func (client *Client) authoredHistoryLimit() HistoryStatus {
+	if client.server.Config().History.Retention.AllowChannelOptOut {
+		return client.AccountSettings().AuthoredHistory
 	}
+	return HistoryDefault
 }
 
 func (channel *Channel) applyModeToMember(client *Client, change modes.ModeChange, rb *ResponseBuffer) (applied bool, result modes.ModeChange) {
@@ -1403,18 +1825,42 @@ func (channel *Channel) applyModeToMember(client *Client, change modes.ModeChang
 		}
 	}
 	channel.stateMutex.Unlock()
+	if applied {
+		channel.memberListCache.Invalidate()
+	}
 
 	if !exists {
 		rb.Add(nil, client.server.name, ERR_USERNOTINCHANNEL, client.Nick(), channel.Name(), client.t("They aren't on that channel"))
 	}
 	if applied {
+		// the MODE line would otherwise refer to an invisible member:
+		channel.revealDelayedJoin(target)
 		target.markDirty(IncludeChannels)
 	}
 	return
 }
 
-// ShowMaskList shows the given list to the client.
-func (channel *Channel) ShowMaskList(client *Client, mode modes.Mode, rb *ResponseBuffer) {
+// maskListPage returns the masks of a list mode in sorted order, starting
+// after the mask `after` (if any) and including only masks matched by
+// `matcher` (if any), up to `limit` of them. `more` reports whether
+// matching masks were left out because of the limit.
+func (channel *Channel) maskListPage(mode modes.Mode, matcher *regexp.Regexp, after string, limit int) (masks []string, infos map[string]MaskInfo, more bool) {
+	infos = channel.lists[mode].Masks()
+	for mask := range infos {
+		if (after == "" || after < mask) && (matcher == nil || matcher.MatchString(mask)) {
+			masks = append(masks, mask)
+		}
+	}
+	sort.Strings(masks)
+	if 0 < limit && limit < len(masks) {
+		masks, more = masks[:limit], true
+	}
+	return
+}
+
+// ShowMaskList shows the given list to the client, one page at a time
+// (see maskListPage); MODE shows the first page, and LISTMODE the rest.
+func (channel *Channel) ShowMaskList(client *Client, mode modes.Mode, matcher *regexp.Regexp, after string, limit int, rb *ResponseBuffer) {
 	// choose appropriate modes
 	var rpllist, rplendoflist string
 	if mode == modes.BanMask {
@@ -1428,11 +1874,21 @@ func (channel *Channel) ShowMaskList(client *Client, mode modes.Mode, rb *Respon
 		rplendoflist = RPL_ENDOFINVITELIST
 	}
 
+	pageSize := client.server.Config().Limits.ChanListPageSize
+	if limit <= 0 || pageSize < limit {
+		limit = pageSize
+	}
+
 	nick := client.Nick()
 	chname := channel.Name()
-	for mask, info := range channel.lists[mode].Masks() {
+	masks, infos, more := channel.maskListPage(mode, matcher, after, limit)
+	for _, mask := range masks {
+		info := infos[mask]
 		rb.Add(nil, client.server.name, rpllist, nick, chname, mask, info.CreatorNickmask, strconv.FormatInt(info.TimeCreated.Unix(), 10))
 	}
+	if more {
+		rb.Note("LISTMODE", "MORE_ENTRIES", chname, mode.String(), masks[len(masks)-1], fmt.Sprintf(client.t("The list was truncated; use LISTMODE %[1]s %[2]s AFTER %[3]s to see more"), chname, mode.String(), masks[len(masks)-1]))
+	}
 
 	rb.Add(nil, client.server.name, rplendoflist, nick, chname, client.t("End of list"))
 }
@@ -1445,6 +1901,7 @@ func (channel *Channel) Quit(client *Client) {
 
 		channel.stateMutex.Lock()
 		channel.members.Remove(client)
+		channel.delayedJoins.Remove(client)
 		channelEmpty := len(channel.members) == 0
 		channel.stateMutex.Unlock()
 		channel.regenerateMembersCache()
@@ -1458,18 +1915,7 @@ func (channel *Channel) Quit(client *Client) {
 }
 
 func (channel *Channel) Kick(client *Client, target *Client, comment string, rb *ResponseBuffer, hasPrivs bool) {
-	if !hasPrivs {
-		if !(client.HasMode(modes.Operator) || channel.hasClient(client)) {
-			rb.Add(nil, client.server.name, ERR_NOTONCHANNEL, client.Nick(), channel.Name(), client.t("You're not on that channel"))
-			return
-		}
-		if !channel.ClientHasPrivsOver(client, target) {
-			rb.Add(nil, client.server.name, ERR_CHANOPRIVSNEEDED, client.Nick(), channel.Name(), client.t("You don't have enough channel privileges"))
-			return
-		}
-	}
-	if !channel.hasClient(target) {
-		rb.Add(nil, client.server.name, ERR_USERNOTINCHANNEL, client.Nick(), channel.Name(), client.t("They aren't on that channel"))
+	if !channel.checkKick(client, target, rb, hasPrivs) {
 		return
 	}
 
@@ -1478,32 +1924,96 @@ func (channel *Channel) Kick(client *Client, target *Client, comment string, rb
 		comment = comment[:kicklimit]
 	}
 
-	message := utils.MakeMessage(comment)
 	details := client.Details()
+	channel.kickInternal(details.nickMask, details.accountName, details.account, target, comment, rb)
+}
+
+// kickInternal sends a KICK from `source` (which may be a service) and
+// removes the target from the channel.
+func (channel *Channel) kickInternal(source, accountName, account string, target *Client, comment string, rb *ResponseBuffer) {
+	message := utils.MakeMessage(comment)
 
 	targetNick := target.Nick()
 	chname := channel.Name()
+	channel.revealDelayedJoin(target)
 	for _, member := range channel.Members() {
 		for _, session := range member.Sessions() {
-			if session != rb.session {
-				session.sendFromClientInternal(false, message.Time, message.Msgid, details.nickMask, details.accountName, nil, "KICK", chname, targetNick, comment)
+			if rb == nil || session != rb.session {
+				session.sendFromClientInternal(false, message.Time, message.Msgid, source, accountName, nil, "KICK", chname, targetNick, comment)
 			}
 		}
 	}
-	rb.AddFromClient(message.Time, message.Msgid, details.nickMask, details.accountName, nil, "KICK", chname, targetNick, comment)
+	if rb != nil {
+		rb.AddFromClient(message.Time, message.Msgid, source, accountName, nil, "KICK", chname, targetNick, comment)
+	}
 
 	histItem := history.Item{
 		Type:        history.Kick,
-		Nick:        details.nickMask,
-		AccountName: details.accountName,
+		Nick:        source,
+		AccountName: accountName,
 		Message:     message,
 	}
 	histItem.Params[0] = targetNick
-	channel.AddHistoryItem(histItem, details.account)
+	channel.AddHistoryItem(histItem, account)
 
 	channel.Quit(target)
 }
 
+// checkKick checks whether `client` may remove `target` from the channel,
+// by KICK or by REMOVE, sending an error if not.
+func (channel *Channel) checkKick(client *Client, target *Client, rb *ResponseBuffer, hasPrivs bool) bool {
+	if !hasPrivs {
+		if !(client.HasMode(modes.Operator) || channel.hasClient(client)) {
+			rb.Add(nil, client.server.name, ERR_NOTONCHANNEL, client.Nick(), channel.Name(), client.t("You're not on that channel"))
+			return false
+		}
+		if !channel.ClientHasPrivsOver(client, target) {
+			rb.Add(nil, client.server.name, ERR_CHANOPRIVSNEEDED, client.Nick(), channel.Name(), client.t("You don't have enough channel privileges"))
+			return false
+		}
+	}
+	if !channel.hasClient(target) {
+		rb.Add(nil, client.server.name, ERR_USERNOTINCHANNEL, client.Nick(), channel.Name(), client.t("They aren't on that channel"))
+		return false
+	}
+	return true
+}
+
+// Remove forces `target` to part the channel (REMOVE); unlike a KICK,
+// everyone sees an ordinary PART, which discourages automatic rejoins.
+func (channel *Channel) Remove(client *Client, target *Client, reason string, rb *ResponseBuffer) {
+	if channel.flags.HasMode(modes.NoRemove) {
+		rb.Fail("REMOVE", "DISABLED", channel.Name(), client.t("REMOVE is disabled in this channel; use KICK instead"))
+		return
+	}
+	if !channel.checkKick(client, target, rb, false) {
+		return
+	}
+
+	message := fmt.Sprintf("requested by %s", client.Nick())
+	if reason != "" {
+		message = fmt.Sprintf("%s (%s)", message, reason)
+	}
+	if kicklimit := channel.server.Config().Limits.KickLen; len(message) > kicklimit {
+		message = message[:kicklimit]
+	}
+	channel.ForcePart(target, message)
+}
+
+// ForcePart parts `target` from the channel on someone else's behalf
+// (REMOVE, SAPART); the PART is delivered to the target's own sessions.
+func (channel *Channel) ForcePart(target *Client, message string) {
+	if sessions := target.Sessions(); len(sessions) != 0 {
+		// arbitrarily pick the first session to receive the PART via the buffer
+		rb := NewResponseBuffer(sessions[0])
+		channel.Part(target, message, rb)
+		rb.Send(false)
+	} else {
+		// always-on client with no attached sessions
+		channel.Part(target, message, NewResponseBuffer(&Session{client: target}))
+	}
+}
+
 // Invite invites the given client to the channel, if the inviter can do so.
 func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuffer) {
 	channel.stateMutex.RLock()
@@ -1530,7 +2040,10 @@ func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuf
 		return
 	}
 
-	if inviteOnly {
+	// if the invitee has the inviter on their SILENCE list, drop the invite,
+	// but let the inviter think it went through
+	silenced := invitee.isSilencing(inviter)
+	if inviteOnly && !silenced {
 		invitee.Invite(chcfname, createdAt)
 	}
 
@@ -1554,8 +2067,19 @@ func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuf
 			}
 		}
 	}
+	// the inviter's other sessions are notified on the same terms as other members
+	if channel.ClientIsAtLeast(inviter, modes.Halfop) {
+		for _, session := range inviter.Sessions() {
+			if session != rb.session && session.capabilities.Has(caps.InviteNotify) {
+				session.sendFromClientInternal(false, message.Time, message.Msgid, details.nickMask, details.accountName, nil, "INVITE", tnick, chname)
+			}
+		}
+	}
 
 	rb.Add(nil, inviter.server.name, RPL_INVITING, details.nick, tnick, chname)
+	if silenced {
+		return
+	}
 	invitee.sendFromClientInternal(false, message.Time, message.Msgid, details.nickMask, details.accountName, nil, "INVITE", tnick, chname)
 	if away, awayMessage := invitee.Away(); away {
 		rb.Add(nil, inviter.server.name, RPL_AWAY, details.nick, tnick, awayMessage)
@@ -1566,12 +2090,12 @@ func (channel *Channel) Invite(invitee *Client, inviter *Client, rb *ResponseBuf
 // Uninvite rescinds a channel invitation, if the inviter can do so.
 func (channel *Channel) Uninvite(invitee *Client, inviter *Client, rb *ResponseBuffer) {
 	if !channel.flags.HasMode(modes.InviteOnly) {
-		rb.Add(nil, channel.server.name, "FAIL", "UNINVITE", "NOT_INVITE_ONLY", channel.Name(), inviter.t("Channel is not invite-only"))
+		rb.Fail("UNINVITE", "NOT_INVITE_ONLY", channel.Name(), inviter.t("Channel is not invite-only"))
 		return
 	}
 
 	if !channel.ClientIsAtLeast(inviter, modes.ChannelOperator) {
-		rb.Add(nil, channel.server.name, "FAIL", "UNINVITE", "PRIVS_NEEDED", channel.Name(), inviter.t("You're not a channel operator"))
+		rb.Fail("UNINVITE", "PRIVS_NEEDED", channel.Name(), inviter.t("You're not a channel operator"))
 		return
 	}
 
@@ -1588,6 +2112,9 @@ func (channel *Channel) auditoriumFriends(client *Client) (friends []*Client) {
 	if clientModes == nil {
 		return // non-members have no friends
 	}
+	if channel.delayedJoins.Has(client) {
+		return // nobody knows they're here yet (+D)
+	}
 	if !channel.flags.HasMode(modes.Auditorium) {
 		return channel.membersCache // default behavior for members
 	}
@@ -1603,6 +2130,61 @@ func (channel *Channel) auditoriumFriends(client *Client) (friends []*Client) {
 	return
 }
 
+// visibleMembers returns the members whose membership is apparent to `client`,
+// for NAMES and WHO; see canSeeMember.
+func (channel *Channel) visibleMembers(client *Client) (result []*Client) {
+	for _, member := range channel.Members() {
+		if channel.canSeeMember(client, member) {
+			result = append(result, member)
+		}
+	}
+	return
+}
+
+// canSeeMember returns whether `client` can learn (via NAMES, WHO, or WHOIS)
+// that `target` is a member of the channel. This respects secret channels,
+// invisible users, the auditorium and delayed-join modes, and the
+// channel's visibility setting for non-members.
+func (channel *Channel) canSeeMember(client, target *Client) bool {
+	if client == target || client.HasMode(modes.Operator) {
+		return true
+	}
+
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+
+	clientModes, isJoined := channel.members[client]
+	return channel.viewCanSeeMemberNoMutex(isJoined, clientModes.HighestChannelUserMode() != modes.Mode(0), target)
+}
+
+// viewCanSeeMemberNoMutex is canSeeMember for any viewer other than `target`
+// who isn't an operator: only whether they're joined, and whether they have a
+// channel prefix, make a difference.
+func (channel *Channel) viewCanSeeMemberNoMutex(isJoined, isPrivileged bool, target *Client) bool {
+	targetModes, targetIsJoined := channel.members[target]
+	if !targetIsJoined || channel.delayedJoins.Has(target) {
+		return false
+	}
+	if !isJoined {
+		if channel.flags.HasMode(modes.Secret) || target.HasMode(modes.Invisible) {
+			return false
+		}
+		switch channel.settings.Visibility {
+		case VisibilityNone:
+			return false
+		case VisibilityOps:
+			if !targetModes.HasMode(modes.Halfop) && !targetModes.HasMode(modes.ChannelOperator) &&
+				!targetModes.HasMode(modes.ChannelAdmin) && !targetModes.HasMode(modes.ChannelFounder) {
+				return false
+			}
+		}
+	}
+	if channel.flags.HasMode(modes.Auditorium) {
+		return isPrivileged || targetModes.HighestChannelUserMode() != modes.Mode(0)
+	}
+	return true
+}
+
 // data for RPL_LIST
 func (channel *Channel) listData() (memberCount int, name, topic string) {
 	channel.stateMutex.RLock()
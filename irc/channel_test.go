@@ -0,0 +1,305 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/languages"
+	"github.com/oragono/oragono/irc/logger"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+func newTestServer() *Server {
+	server := &Server{name: "oragono.test", logger: new(logger.Manager)}
+	config := &Config{}
+	config.languageManager, _ = languages.NewManager(false, "", "en")
+	config.Limits.KickLen = 390
+	server.SetConfig(config)
+	return server
+}
+
+func newTestClient(server *Server, nick string) *Client {
+	return &Client{
+		server:         server,
+		nick:           nick,
+		nickCasefolded: nick,
+		nickMaskString: nick + "!u@example.com",
+		username:       "u",
+		hostname:       "example.com",
+		accountName:    "*",
+	}
+}
+
+func newTestChannel(server *Server, name string) *Channel {
+	channel := &Channel{
+		name:           name,
+		nameCasefolded: name,
+		members:        make(MemberSet),
+		delayedJoins:   make(ClientSet),
+		server:         server,
+	}
+	channel.initializeLists()
+	channel.history.Initialize(0, 0)
+	return channel
+}
+
+// addTestMember joins `client` to the channel as Join would, including
+// hiding the join under +D
+func addTestMember(channel *Channel, client *Client, mode modes.Mode) {
+	channel.stateMutex.Lock()
+	channel.members.Add(client)
+	if mode != modes.Mode(0) {
+		channel.members[client].SetMode(mode, true)
+	} else if channel.flags.HasMode(modes.DelayedJoin) {
+		channel.delayedJoins.Add(client)
+	}
+	channel.stateMutex.Unlock()
+	channel.regenerateMembersCache()
+}
+
+func assertVisible(t *testing.T, channel *Channel, viewer, target *Client, expected bool) {
+	t.Helper()
+	if channel.canSeeMember(viewer, target) != expected {
+		t.Errorf("%s seeing %s: expected %t", viewer.nick, target.nick, expected)
+	}
+	found := false
+	for _, member := range channel.visibleMembers(viewer) {
+		if member == target {
+			found = true
+		}
+	}
+	if found != expected {
+		t.Errorf("%s seeing %s in NAMES/WHO: expected %t", viewer.nick, target.nick, expected)
+	}
+}
+
+func TestDelayedJoinHidesMembers(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	channel.flags.SetMode(modes.DelayedJoin, true)
+
+	op := newTestClient(server, "op")
+	lurker := newTestClient(server, "lurker")
+	outsider := newTestClient(server, "outsider")
+	addTestMember(channel, op, modes.ChannelOperator)
+	addTestMember(channel, lurker, modes.Mode(0))
+
+	if !channel.joinIsDelayed(lurker) || channel.joinIsDelayed(op) {
+		t.Fatal("only the unprivileged join should be delayed")
+	}
+	assertVisible(t, channel, op, lurker, false)
+	assertVisible(t, channel, outsider, lurker, false)
+	assertVisible(t, channel, lurker, lurker, true)
+	assertVisible(t, channel, lurker, op, true)
+	assertVisible(t, channel, outsider, op, true)
+}
+
+func TestDelayedJoinRevealedOnSpeaking(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	channel.flags.SetMode(modes.DelayedJoin, true)
+
+	op := newTestClient(server, "op")
+	lurker := newTestClient(server, "lurker")
+	addTestMember(channel, op, modes.ChannelOperator)
+	addTestMember(channel, lurker, modes.Mode(0))
+	assertVisible(t, channel, op, lurker, false)
+
+	rb := NewResponseBuffer(&Session{client: lurker})
+	channel.SendSplitMessage("PRIVMSG", modes.Mode(0), nil, lurker, utils.MakeMessage("hi"), rb)
+
+	if channel.joinIsDelayed(lurker) {
+		t.Error("speaking should reveal a delayed join")
+	}
+	assertVisible(t, channel, op, lurker, true)
+}
+
+func TestDelayedJoinRevealedOnModeRemoval(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	channel.flags.SetMode(modes.DelayedJoin, true)
+
+	op := newTestClient(server, "op")
+	lurkers := []*Client{newTestClient(server, "lurker1"), newTestClient(server, "lurker2")}
+	addTestMember(channel, op, modes.ChannelOperator)
+	for _, lurker := range lurkers {
+		addTestMember(channel, lurker, modes.Mode(0))
+		assertVisible(t, channel, op, lurker, false)
+	}
+
+	changes := modes.ModeChanges{{Mode: modes.DelayedJoin, Op: modes.Remove}}
+	applied := channel.ApplyChannelModeChanges(op, true, changes, NewResponseBuffer(&Session{client: op}))
+	if len(applied) != 1 {
+		t.Fatalf("expected -D to be applied, got %v", applied)
+	}
+
+	for _, lurker := range lurkers {
+		if channel.joinIsDelayed(lurker) {
+			t.Errorf("-D should reveal %s", lurker.nick)
+		}
+		assertVisible(t, channel, op, lurker, true)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	op := newTestClient(server, "op")
+	user := newTestClient(server, "user")
+	addTestMember(channel, op, modes.ChannelOperator)
+	addTestMember(channel, user, modes.Mode(0))
+
+	// unprivileged users can't REMOVE
+	rb := NewResponseBuffer(&Session{client: user})
+	channel.Remove(user, op, "", rb)
+	if !channel.hasClient(op) {
+		t.Errorf("unprivileged user removed an op")
+	}
+
+	channel.flags.SetMode(modes.NoRemove, true)
+	rb = NewResponseBuffer(&Session{client: op})
+	channel.Remove(op, user, "spam", rb)
+	if !channel.hasClient(user) {
+		t.Errorf("REMOVE should be disabled under +Q")
+	}
+
+	channel.flags.SetMode(modes.NoRemove, false)
+	channel.Remove(op, user, "spam", rb)
+	if channel.hasClient(user) {
+		t.Errorf("REMOVE did not part the user")
+	}
+}
+
+func TestChannelSuccessor(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#chan")
+	channel.registeredFounder = "alice"
+	channel.accountToUMode = map[string]modes.Mode{"alice": modes.ChannelFounder}
+	channel.settings.Successor = "bob"
+
+	// the founder or the successor changed in the meantime:
+	assertEqual(channel.TransferToSuccessor("carol", "bob"), false, t)
+	assertEqual(channel.TransferToSuccessor("alice", "carol"), false, t)
+	assertEqual(channel.Founder(), "alice", t)
+
+	// a transfer to a new founder clears the successor they didn't choose:
+	channel.transferOwnership("dan")
+	assertEqual(channel.Founder(), "dan", t)
+	assertEqual(channel.settings.Successor, "", t)
+	assertEqual(channel.accountToUMode["dan"], modes.ChannelFounder, t)
+	_, ok := channel.accountToUMode["alice"]
+	assertEqual(ok, false, t)
+}
+
+func TestChannelReassignAccount(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#chan")
+	channel.registeredFounder = "alice"
+	channel.accountToUMode = map[string]modes.Mode{"alice": modes.ChannelFounder, "bob": modes.ChannelOperator}
+	channel.settings.Successor = "bob"
+	channel.transferPendingTo = "bob"
+
+	channel.reassignAccount("bob", "robert")
+	assertEqual(channel.Founder(), "alice", t)
+	assertEqual(channel.settings.Successor, "robert", t)
+	assertEqual(channel.transferPendingTo, "robert", t)
+	assertEqual(channel.accountToUMode, map[string]modes.Mode{"alice": modes.ChannelFounder, "robert": modes.ChannelOperator}, t)
+
+	channel.reassignAccount("alice", "amanda")
+	assertEqual(channel.Founder(), "amanda", t)
+	assertEqual(channel.accountToUMode["amanda"], modes.ChannelFounder, t)
+	_, ok := channel.accountToUMode["alice"]
+	assertEqual(ok, false, t)
+
+	// merging keeps the higher of the two amodes:
+	channel.accountToUMode["carol"] = modes.Voice
+	channel.reassignAccount("robert", "carol")
+	assertEqual(channel.accountToUMode["carol"], modes.ChannelOperator, t)
+	channel.accountToUMode["dan"] = modes.Halfop
+	channel.reassignAccount("dan", "carol")
+	assertEqual(channel.accountToUMode, map[string]modes.Mode{"amanda": modes.ChannelFounder, "carol": modes.ChannelOperator}, t)
+
+	// merging the successor into the founder clears the successor:
+	assertEqual(channel.settings.Successor, "carol", t)
+	channel.reassignAccount("carol", "amanda")
+	assertEqual(channel.settings.Successor, "", t)
+	assertEqual(channel.accountToUMode, map[string]modes.Mode{"amanda": modes.ChannelFounder}, t)
+}
+
+func TestChannelTouchRegistration(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#chan")
+
+	// unregistered channels are never touched:
+	assertEqual(channel.touchRegistrationNoMutex("alice"), false, t)
+
+	channel.registeredFounder = "alice"
+	channel.settings.Successor = "bob"
+	channel.settings.ExpiryWarned = time.Now().UTC()
+	assertEqual(channel.touchRegistrationNoMutex(""), false, t)
+	assertEqual(channel.touchRegistrationNoMutex("carol"), false, t)
+	assertEqual(channel.settings.LastUsed.IsZero(), true, t)
+
+	assertEqual(channel.touchRegistrationNoMutex("bob"), true, t)
+	assertEqual(channel.settings.LastUsed.IsZero(), false, t)
+	assertEqual(channel.settings.ExpiryWarned.IsZero(), true, t)
+	// a recent touch doesn't require another write:
+	assertEqual(channel.touchRegistrationNoMutex("alice"), false, t)
+
+	channel.settings.LastUsed = time.Now().UTC().Add(-2 * channelLastUsedResolution)
+	assertEqual(channel.touchRegistrationNoMutex("alice"), true, t)
+}
+
+func TestTopicHistory(t *testing.T) {
+	server := newTestServer()
+	server.Config().Limits.TopicLen = 390
+	server.Config().Channels.TopicHistoryLength = 2
+	channel := newTestChannel(server, "#test")
+	op := newTestClient(server, "op")
+	addTestMember(channel, op, modes.ChannelOperator)
+	rb := NewResponseBuffer(&Session{client: op})
+
+	for _, topic := range []string{"first", "second", "second", "third", "vandalized"} {
+		channel.SetTopic(op, topic, rb)
+	}
+	topicHistory := channel.TopicHistory()
+	assertEqual(len(topicHistory), 2, t)
+	assertEqual(topicHistory[0].Topic, "third", t)
+	assertEqual(topicHistory[0].SetBy, "op!u@example.com", t)
+	assertEqual(topicHistory[1].Topic, "second", t)
+	assertEqual(channel.ExportRegistration(IncludeTopic).TopicHistory[1].Topic, "third", t)
+
+	server.Config().Channels.TopicHistoryLength = 0
+	channel.SetTopic(op, "fourth", rb)
+	assertEqual(len(channel.TopicHistory()), 0, t)
+}
+
+func TestMaskListPage(t *testing.T) {
+	server := newTestServer()
+	channel := newTestChannel(server, "#test")
+	for _, mask := range []string{"c!*@*", "a!*@*", "*!*@evil.com", "b!*@*", "*!*@evil.net"} {
+		channel.lists[modes.BanMask].Add(mask, "op!u@example.com", "")
+	}
+
+	masks, _, more := channel.maskListPage(modes.BanMask, nil, "", 0)
+	assertEqual(masks, []string{"*!*@evil.com", "*!*@evil.net", "a!*@*", "b!*@*", "c!*@*"}, t)
+	assertEqual(more, false, t)
+
+	masks, _, more = channel.maskListPage(modes.BanMask, nil, "", 2)
+	assertEqual(masks, []string{"*!*@evil.com", "*!*@evil.net"}, t)
+	assertEqual(more, true, t)
+	masks, _, more = channel.maskListPage(modes.BanMask, nil, "*!*@evil.net", 2)
+	assertEqual(masks, []string{"a!*@*", "b!*@*"}, t)
+	assertEqual(more, true, t)
+	masks, _, more = channel.maskListPage(modes.BanMask, nil, "b!*@*", 2)
+	assertEqual(masks, []string{"c!*@*"}, t)
+	assertEqual(more, false, t)
+
+	matcher, _ := utils.CompileGlob("*evil*", false)
+	masks, _, _ = channel.maskListPage(modes.BanMask, matcher, "", 0)
+	assertEqual(masks, []string{"*!*@evil.com", "*!*@evil.net"}, t)
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	// how often registrations are checked for expiry
+	channelExpiryCheckInterval = time.Hour
+	// LastUsed is only rewritten once it's this old, to avoid a database
+	// write on every join by the founder
+	channelLastUsedResolution = time.Hour
+)
+
+// touchRegistrationNoMutex records that the channel's founder or successor
+// joined, returning whether the settings need to be stored. The caller must
+// hold channel.stateMutex.
+func (channel *Channel) touchRegistrationNoMutex(account string) (touched bool) {
+	if account == "" || channel.registeredFounder == "" {
+		return false
+	}
+	if account != channel.registeredFounder && account != channel.settings.Successor {
+		return false
+	}
+	now := time.Now().UTC()
+	if now.Sub(channel.settings.LastUsed) < channelLastUsedResolution {
+		return false
+	}
+	channel.settings.LastUsed = now
+	channel.settings.ExpiryWarned = time.Time{}
+	return true
+}
+
+// hasAccountMember returns whether a member of the channel is logged into
+// one of the given accounts.
+func (channel *Channel) hasAccountMember(accounts ...string) bool {
+	for _, member := range channel.Members() {
+		account := member.Account()
+		if account == "" {
+			continue
+		}
+		for _, candidate := range accounts {
+			if account == candidate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// UpdateSettings applies `update` to the settings of a registered channel,
+// which need not be loaded.
+func (cm *ChannelManager) UpdateSettings(channelName string, update func(settings *ChannelSettings)) (err error) {
+	cfname, err := CasefoldChannel(channelName)
+	if err != nil {
+		return errNoSuchChannel
+	}
+
+	if channel := cm.Get(cfname); channel != nil {
+		if !channel.IsRegistered() {
+			return errChannelNotRegistered
+		}
+		settings := channel.Settings()
+		update(&settings)
+		channel.SetSettings(settings)
+		return nil
+	}
+
+	info, err := cm.server.channelRegistry.LoadChannel(cfname)
+	if err != nil {
+		return err
+	}
+	update(&info.Settings)
+	return cm.server.channelRegistry.StoreChannel(info, IncludeSettings)
+}
+
+func (server *Server) channelExpiryLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger.Error("internal",
+				fmt.Sprintf("Panic in channel expiry routine: %v\n%s", r, debug.Stack()))
+			time.Sleep(channelExpiryCheckInterval)
+			go server.channelExpiryLoop()
+		}
+	}()
+
+	for {
+		time.Sleep(channelExpiryCheckInterval)
+		server.expireChannelRegistrations(time.Now().UTC())
+	}
+}
+
+// expireChannelRegistrations warns about, and then drops, registered channels
+// whose founder and successor haven't joined for the configured expire-time.
+func (server *Server) expireChannelRegistrations(now time.Time) {
+	config := server.Config()
+	expireTime := time.Duration(config.Channels.Registration.ExpireTime)
+	if expireTime == 0 || !config.Channels.Registration.Enabled || server.ReadOnly() {
+		return
+	}
+	warnTime := expireTime - time.Duration(config.Channels.Registration.ExpireWarning)
+
+	for cfname, settings := range server.channelRegistry.AllSettings() {
+		if settings.Held {
+			continue
+		}
+		if settings.LastUsed.IsZero() {
+			// registered before expiry was tracked; start the clock now
+			server.channels.UpdateSettings(cfname, func(settings *ChannelSettings) {
+				settings.LastUsed = now
+			})
+			continue
+		}
+		idle := now.Sub(settings.LastUsed)
+		if idle < warnTime {
+			continue
+		}
+
+		info, err := server.channelRegistry.LoadChannel(cfname)
+		if err != nil {
+			continue
+		}
+		channel := server.channels.Get(cfname)
+		if channel != nil && channel.hasAccountMember(info.Founder, info.Settings.Successor) {
+			// e.g., an always-on founder who never needs to rejoin
+			server.channels.UpdateSettings(cfname, func(settings *ChannelSettings) {
+				settings.LastUsed = now
+				settings.ExpiryWarned = time.Time{}
+			})
+			continue
+		}
+
+		if idle >= expireTime {
+			server.expireChannelRegistration(channel, info)
+		} else if settings.ExpiryWarned.IsZero() {
+			server.warnChannelExpiry(channel, info, settings.LastUsed.Add(expireTime))
+			server.channels.UpdateSettings(cfname, func(settings *ChannelSettings) {
+				settings.ExpiryWarned = now
+			})
+		}
+	}
+}
+
+func (server *Server) warnChannelExpiry(channel *Channel, info RegisteredChannel, expiresAt time.Time) {
+	date := expiresAt.Format(time.RFC1123)
+	for _, account := range []string{info.Founder, info.Settings.Successor} {
+		if account == "" {
+			continue
+		}
+		for _, client := range server.accounts.AccountToClients(account) {
+			client.Send(nil, chanservService.prefix, "NOTICE", client.Nick(), fmt.Sprintf(client.t("The registration of channel %[1]s will expire on %[2]s, unless its founder or successor joins it"), info.Name, date))
+		}
+	}
+	if channel != nil {
+		for _, member := range channel.Members() {
+			member.Send(nil, chanservService.prefix, "NOTICE", info.Name, fmt.Sprintf(member.t("This channel's registration will expire on %s, unless its founder or successor joins it"), date))
+		}
+	}
+	server.logger.Info("services", "Channel", info.Name, "will expire on", date)
+}
+
+func (server *Server) expireChannelRegistration(channel *Channel, info RegisteredChannel) {
+	err := server.channels.SetUnregistered(info.NameCasefolded, info.Founder)
+	if err != nil {
+		server.logger.Error("services", "couldn't expire channel registration", info.Name, err.Error())
+		return
+	}
+	server.auditChannelOwnership(info.Name, "was unregistered, since its founder and successor hadn't joined it recently")
+	for _, client := range server.accounts.AccountToClients(info.Founder) {
+		client.Send(nil, chanservService.prefix, "NOTICE", client.Nick(), fmt.Sprintf(client.t("The registration of channel %s has expired"), info.Name))
+	}
+	if channel != nil {
+		for _, member := range channel.Members() {
+			member.Send(nil, chanservService.prefix, "NOTICE", info.Name, member.t("This channel's registration has expired"))
+		}
+	}
+}
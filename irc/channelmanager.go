@@ -6,6 +6,7 @@ package irc
 import (
 	"sync"
 
+	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/utils"
 )
 
@@ -101,8 +102,8 @@ func (cm *ChannelManager) Join(client *Client, name string, key string, isSajoin
 		entry := cm.chans[casefoldedName]
 		if entry == nil {
 			registered := cm.registeredChannels.Has(casefoldedName)
-			// enforce OpOnlyCreation
-			if !registered && server.Config().Channels.OpOnlyCreation && !client.HasRoleCapabs("chanreg") {
+			// enforce OpOnlyCreation (which is implied by DEFCON 3)
+			if !registered && (server.Config().Channels.OpOnlyCreation || server.Defcon() <= 3) && !client.HasRoleCapabs("chanreg") {
 				return nil, errInsufficientPrivs
 			}
 			// enforce confusables
@@ -243,6 +244,7 @@ func (cm *ChannelManager) SetUnregistered(channelName string, account string) (e
 	defer func() {
 		if err == nil {
 			err = cm.server.channelRegistry.Delete(info)
+			cm.server.setHistoryRetention(cfname, HistoryRetention{})
 		}
 	}()
 
@@ -259,6 +261,42 @@ func (cm *ChannelManager) SetUnregistered(channelName string, account string) (e
 	return nil
 }
 
+// PassToSuccessor makes `successor` the founder of a registered channel, which
+// need not be loaded, if it is still owned by `founder` and `successor` is
+// still its designated successor.
+func (cm *ChannelManager) PassToSuccessor(channelName, founder, successor string) (err error) {
+	cfname, err := CasefoldChannel(channelName)
+	if err != nil {
+		return err
+	}
+
+	cm.RLock()
+	entry := cm.chans[cfname]
+	cm.RUnlock()
+	if entry != nil && entry.channel.IsLoaded() {
+		if !entry.channel.TransferToSuccessor(founder, successor) {
+			return errChannelNotOwnedByAccount
+		}
+		return nil
+	}
+
+	info, err := cm.server.channelRegistry.LoadChannel(cfname)
+	if err != nil {
+		return err
+	}
+	if info.Founder != founder || info.Settings.Successor != successor {
+		return errChannelNotOwnedByAccount
+	}
+	if info.AccountToUMode == nil {
+		info.AccountToUMode = make(map[string]modes.Mode)
+	}
+	delete(info.AccountToUMode, founder)
+	info.Founder = successor
+	info.AccountToUMode[successor] = modes.ChannelFounder
+	info.Settings.Successor = ""
+	return cm.server.channelRegistry.StoreChannel(info, IncludeAllAttrs)
+}
+
 // Rename renames a channel (but does not notify the members)
 func (cm *ChannelManager) Rename(name string, newName string) (err error) {
 	cfname, err := CasefoldChannel(name)
@@ -283,6 +321,7 @@ func (cm *ChannelManager) Rename(name string, newName string) (err error) {
 			// we just flushed the channel under its new name, therefore this delete
 			// cannot be overwritten by a write to the old name:
 			cm.server.channelRegistry.Delete(info)
+			cm.server.setHistoryRetention(channel.NameCasefolded(), channel.Settings().Retention)
 		}
 	}()
 
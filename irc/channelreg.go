@@ -27,6 +27,7 @@ const (
 	keyChannelTopic          = "channel.topic %s"
 	keyChannelTopicSetBy     = "channel.topic.setby %s"
 	keyChannelTopicSetTime   = "channel.topic.settime %s"
+	keyChannelTopicHistory   = "channel.topic.history %s"
 	keyChannelBanlist        = "channel.banlist %s"
 	keyChannelExceptlist     = "channel.exceptlist %s"
 	keyChannelInvitelist     = "channel.invitelist %s"
@@ -35,6 +36,9 @@ const (
 	keyChannelAccountToUMode = "channel.accounttoumode %s"
 	keyChannelUserLimit      = "channel.userlimit %s"
 	keyChannelSettings       = "channel.settings %s"
+	keyChannelAkicks         = "channel.akicks %s"
+	keyChannelBadwords       = "channel.badwords %s"
+	keyChannelTimedModes     = "channel.timedmodes %s"
 
 	keyChannelPurged = "channel.purged %s"
 )
@@ -48,6 +52,7 @@ var (
 		keyChannelTopic,
 		keyChannelTopicSetBy,
 		keyChannelTopicSetTime,
+		keyChannelTopicHistory,
 		keyChannelBanlist,
 		keyChannelExceptlist,
 		keyChannelInvitelist,
@@ -56,6 +61,9 @@ var (
 		keyChannelAccountToUMode,
 		keyChannelUserLimit,
 		keyChannelSettings,
+		keyChannelAkicks,
+		keyChannelBadwords,
+		keyChannelTimedModes,
 	}
 )
 
@@ -90,12 +98,16 @@ type RegisteredChannel struct {
 	TopicSetBy string
 	// TopicSetTime represents the time the topic was set.
 	TopicSetTime time.Time
+	// TopicHistory holds the previous topics, oldest first.
+	TopicHistory []TopicHistoryEntry
 	// Modes represents the channel modes
 	Modes []modes.Mode
 	// Key represents the channel key / password
 	Key string
 	// UserLimit is the user limit (0 for no limit)
 	UserLimit int
+	// TimedModes are the pending expirations of modes set with TIMEDMODE
+	TimedModes []TimedMode
 	// AccountToUMode maps user accounts to their persistent channel modes (e.g., +q, +h)
 	AccountToUMode map[string]modes.Mode
 	// Bans represents the bans set on the channel.
@@ -104,10 +116,21 @@ type RegisteredChannel struct {
 	Excepts map[string]MaskInfo
 	// Invites represents the invite exceptions set on the channel.
 	Invites map[string]MaskInfo
+	// Akicks represents the autokick list (CS AKICK).
+	Akicks map[string]MaskInfo
+	// Badwords represents the badword list (CS BADWORDS).
+	Badwords []Badword
 	// Settings are the chanserv-modifiable settings
 	Settings ChannelSettings
 }
 
+// TopicHistoryEntry is a previous topic of a channel.
+type TopicHistoryEntry struct {
+	Topic   string
+	SetBy   string
+	SetTime time.Time
+}
+
 type ChannelPurgeRecord struct {
 	Oper     string
 	PurgedAt time.Time
@@ -140,6 +163,99 @@ func (reg *ChannelRegistry) AllChannels() (result []string) {
 	return
 }
 
+// AllSettings returns the settings of all registered channels, keyed by
+// casefolded name.
+func (reg *ChannelRegistry) AllSettings() (result map[string]ChannelSettings) {
+	result = make(map[string]ChannelSettings)
+	prefix := fmt.Sprintf(keyChannelSettings, "")
+	reg.server.store.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", prefix, func(key, value string) bool {
+			if !strings.HasPrefix(key, prefix) {
+				return false
+			}
+			var settings ChannelSettings
+			if json.Unmarshal([]byte(value), &settings) == nil {
+				result[strings.TrimPrefix(key, prefix)] = settings
+			}
+			return true
+		})
+	})
+
+	return
+}
+
+// reassignAccount rewrites the founder, amode, and successor references to an
+// account that was renamed, or merged into another account, in all registered
+// channels. (The account's own list of registered channels is maintained by
+// the caller.)
+func (reg *ChannelRegistry) reassignAccount(tx *buntdb.Tx, oldAccount, newAccount string) {
+	// buntdb doesn't allow writes during iteration, so collect them first
+	updates := make(map[string]string)
+
+	// casefolded channel name to its (new) founder
+	founders := make(map[string]string)
+	founderPrefix := fmt.Sprintf(keyChannelFounder, "")
+	tx.AscendGreaterOrEqual("", founderPrefix, func(key, value string) bool {
+		if !strings.HasPrefix(key, founderPrefix) {
+			return false
+		}
+		if value == oldAccount {
+			updates[key] = newAccount
+			value = newAccount
+		}
+		founders[strings.TrimPrefix(key, founderPrefix)] = value
+		return true
+	})
+
+	amodePrefix := fmt.Sprintf(keyChannelAccountToUMode, "")
+	tx.AscendGreaterOrEqual("", amodePrefix, func(key, value string) bool {
+		if !strings.HasPrefix(key, amodePrefix) {
+			return false
+		}
+		var accountToUMode map[string]modes.Mode
+		if json.Unmarshal([]byte(value), &accountToUMode) != nil {
+			return true
+		}
+		if _, ok := accountToUMode[oldAccount]; ok {
+			accountToUMode = reassignAccountUMode(accountToUMode, oldAccount, newAccount)
+			if newValue, err := json.Marshal(accountToUMode); err == nil {
+				updates[key] = string(newValue)
+			}
+		}
+		return true
+	})
+
+	settingsPrefix := fmt.Sprintf(keyChannelSettings, "")
+	tx.AscendGreaterOrEqual("", settingsPrefix, func(key, value string) bool {
+		if !strings.HasPrefix(key, settingsPrefix) {
+			return false
+		}
+		var settings ChannelSettings
+		if json.Unmarshal([]byte(value), &settings) != nil {
+			return true
+		}
+		successor := settings.Successor
+		if successor == oldAccount {
+			successor = newAccount
+		}
+		// after a merge, the successor may have become the founder:
+		if successor != "" && successor == founders[strings.TrimPrefix(key, settingsPrefix)] {
+			successor = ""
+		}
+		if successor != settings.Successor {
+			settings.Successor = successor
+			if newValue, err := json.Marshal(settings); err == nil {
+				updates[key] = string(newValue)
+			}
+		}
+		return true
+	})
+
+	for key, value := range updates {
+		tx.Set(key, value, nil)
+	}
+}
+
 // PurgedChannels returns the set of all casefolded channel names that have been purged
 func (reg *ChannelRegistry) PurgedChannels() (result utils.StringSet) {
 	result = make(utils.StringSet)
@@ -205,21 +321,30 @@ func (reg *ChannelRegistry) LoadChannel(nameCasefolded string) (info RegisteredC
 		if topicSetTimeInt, topicSetTimeErr := strconv.ParseInt(topicSetTimeStr, 10, 64); topicSetTimeErr == nil {
 			topicSetTime = time.Unix(0, topicSetTimeInt).UTC()
 		}
+		topicHistoryString, _ := tx.Get(fmt.Sprintf(keyChannelTopicHistory, channelKey))
 		password, _ := tx.Get(fmt.Sprintf(keyChannelPassword, channelKey))
 		modeString, _ := tx.Get(fmt.Sprintf(keyChannelModes, channelKey))
 		userLimitString, _ := tx.Get(fmt.Sprintf(keyChannelUserLimit, channelKey))
+		timedModesString, _ := tx.Get(fmt.Sprintf(keyChannelTimedModes, channelKey))
 		banlistString, _ := tx.Get(fmt.Sprintf(keyChannelBanlist, channelKey))
 		exceptlistString, _ := tx.Get(fmt.Sprintf(keyChannelExceptlist, channelKey))
 		invitelistString, _ := tx.Get(fmt.Sprintf(keyChannelInvitelist, channelKey))
 		accountToUModeString, _ := tx.Get(fmt.Sprintf(keyChannelAccountToUMode, channelKey))
 		settingsString, _ := tx.Get(fmt.Sprintf(keyChannelSettings, channelKey))
+		akicksString, _ := tx.Get(fmt.Sprintf(keyChannelAkicks, channelKey))
+		badwordsString, _ := tx.Get(fmt.Sprintf(keyChannelBadwords, channelKey))
 
 		modeSlice := make([]modes.Mode, len(modeString))
 		for i, mode := range modeString {
 			modeSlice[i] = modes.Mode(mode)
 		}
 
+		var topicHistory []TopicHistoryEntry
+		_ = json.Unmarshal([]byte(topicHistoryString), &topicHistory)
+
 		userLimit, _ := strconv.Atoi(userLimitString)
+		var timedModes []TimedMode
+		_ = json.Unmarshal([]byte(timedModesString), &timedModes)
 
 		var banlist map[string]MaskInfo
 		_ = json.Unmarshal([]byte(banlistString), &banlist)
@@ -229,6 +354,10 @@ func (reg *ChannelRegistry) LoadChannel(nameCasefolded string) (info RegisteredC
 		_ = json.Unmarshal([]byte(invitelistString), &invitelist)
 		accountToUMode := make(map[string]modes.Mode)
 		_ = json.Unmarshal([]byte(accountToUModeString), &accountToUMode)
+		var akicks map[string]MaskInfo
+		_ = json.Unmarshal([]byte(akicksString), &akicks)
+		var badwords []Badword
+		_ = json.Unmarshal([]byte(badwordsString), &badwords)
 
 		var settings ChannelSettings
 		_ = json.Unmarshal([]byte(settingsString), &settings)
@@ -241,13 +370,17 @@ func (reg *ChannelRegistry) LoadChannel(nameCasefolded string) (info RegisteredC
 			Topic:          topic,
 			TopicSetBy:     topicSetBy,
 			TopicSetTime:   topicSetTime,
+			TopicHistory:   topicHistory,
 			Key:            password,
 			Modes:          modeSlice,
 			Bans:           banlist,
 			Excepts:        exceptlist,
 			Invites:        invitelist,
+			Akicks:         akicks,
+			Badwords:       badwords,
 			AccountToUMode: accountToUMode,
 			UserLimit:      int(userLimit),
+			TimedModes:     timedModes,
 			Settings:       settings,
 		}
 		return nil
@@ -354,6 +487,8 @@ func (reg *ChannelRegistry) saveChannel(tx *buntdb.Tx, channelInfo RegisteredCha
 		}
 		tx.Set(fmt.Sprintf(keyChannelTopicSetTime, channelKey), topicSetTimeStr, nil)
 		tx.Set(fmt.Sprintf(keyChannelTopicSetBy, channelKey), channelInfo.TopicSetBy, nil)
+		topicHistoryString, _ := json.Marshal(channelInfo.TopicHistory)
+		tx.Set(fmt.Sprintf(keyChannelTopicHistory, channelKey), string(topicHistoryString), nil)
 	}
 
 	if includeFlags&IncludeModes != 0 {
@@ -361,6 +496,8 @@ func (reg *ChannelRegistry) saveChannel(tx *buntdb.Tx, channelInfo RegisteredCha
 		modeString := modes.Modes(channelInfo.Modes).String()
 		tx.Set(fmt.Sprintf(keyChannelModes, channelKey), modeString, nil)
 		tx.Set(fmt.Sprintf(keyChannelUserLimit, channelKey), strconv.Itoa(channelInfo.UserLimit), nil)
+		timedModesString, _ := json.Marshal(channelInfo.TimedModes)
+		tx.Set(fmt.Sprintf(keyChannelTimedModes, channelKey), string(timedModesString), nil)
 	}
 
 	if includeFlags&IncludeLists != 0 {
@@ -372,6 +509,10 @@ func (reg *ChannelRegistry) saveChannel(tx *buntdb.Tx, channelInfo RegisteredCha
 		tx.Set(fmt.Sprintf(keyChannelInvitelist, channelKey), string(invitelistString), nil)
 		accountToUModeString, _ := json.Marshal(channelInfo.AccountToUMode)
 		tx.Set(fmt.Sprintf(keyChannelAccountToUMode, channelKey), string(accountToUModeString), nil)
+		akicksString, _ := json.Marshal(channelInfo.Akicks)
+		tx.Set(fmt.Sprintf(keyChannelAkicks, channelKey), string(akicksString), nil)
+		badwordsString, _ := json.Marshal(channelInfo.Badwords)
+		tx.Set(fmt.Sprintf(keyChannelBadwords, channelKey), string(badwordsString), nil)
 	}
 
 	if includeFlags&IncludeSettings != 0 {
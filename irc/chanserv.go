@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircfmt"
+	"github.com/oragono/oragono/irc/custime"
 	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/sno"
 	"github.com/oragono/oragono/irc/utils"
@@ -52,10 +54,11 @@ this command if you're the founder of the channel.`,
 REGISTER lets you own the given channel. If you rejoin this channel, you'll be
 given admin privs on it. Modes set on the channel and the topic will also be
 remembered.`,
-			helpShort:    `$bREGISTER$b lets you own a given channel.`,
-			authRequired: true,
-			enabled:      chanregEnabled,
-			minParams:    1,
+			helpShort:     `$bREGISTER$b lets you own a given channel.`,
+			authRequired:  true,
+			enabled:       chanregEnabled,
+			minParams:     1,
+			modifiesState: true,
 		},
 		"unregister": {
 			handler: csUnregisterHandler,
@@ -64,13 +67,32 @@ remembered.`,
 UNREGISTER deletes a channel registration, allowing someone else to claim it.
 To prevent accidental unregistrations, a verification code is required;
 invoking the command without a code will display the necessary code.`,
-			helpShort: `$bUNREGISTER$b deletes a channel registration.`,
-			enabled:   chanregEnabled,
-			minParams: 1,
+			helpShort:     `$bUNREGISTER$b deletes a channel registration.`,
+			enabled:       chanregEnabled,
+			minParams:     1,
+			modifiesState: true,
 		},
 		"drop": {
 			aliasOf: "unregister",
 		},
+		"akick": {
+			handler: csAkickHandler,
+			help: `Syntax: $bAKICK #channel <ADD|DEL|LIST> [mask|account] [reason]$b
+
+AKICK manages the channel's autokick list. Users matching an entry are banned
+and kicked when they join, or right away if they are already in the channel;
+users with halfop or higher, or matching a ban exception (+e) or an invite
+exception (+I), are exempt. An entry is either a hostmask like *!*@example.com
+or an account name. For example:
+	$bAKICK #channel ADD spammer Repeated spam$b
+	$bAKICK #channel DEL spammer$b
+	$bAKICK #channel LIST$b`,
+			helpShort:         `$bAKICK$b manages a channel's autokick list.`,
+			enabled:           chanregEnabled,
+			minParams:         2,
+			maxParams:         4,
+			unsplitFinalParam: true,
+		},
 		"amode": {
 			handler: csAmodeHandler,
 			help: `Syntax: $bAMODE #channel [mode change] [account]$b
@@ -84,6 +106,61 @@ referenced by their registered account names, not their nicknames.`,
 			enabled:   chanregEnabled,
 			minParams: 1,
 		},
+		"badwords": {
+			handler: csBadwordsHandler,
+			help: `Syntax: $bBADWORDS #channel <ADD|DEL|LIST> [word] [action]$b
+
+BADWORDS manages the channel's list of forbidden words. Each entry is a word,
+which may contain the wildcards * and ?, and is matched against each word of
+every message sent to the channel, regardless of case. The action is one of:
+1. 'censor'     [replace the word with asterisks; the default]
+2. 'kick'       [drop the message and kick the sender]
+3. 'ban'        [drop the message and kickban the sender]
+Users with halfop or higher are exempt. For example:
+	$bBADWORDS #channel ADD darn* censor$b`,
+			helpShort: `$bBADWORDS$b manages a channel's forbidden words.`,
+			enabled:   chanregEnabled,
+			minParams: 2,
+			maxParams: 4,
+		},
+		"ban": {
+			handler: csBanHandler,
+			help: `Syntax: $bBAN #channel <mask> [duration] [reason]$b
+
+BAN adds a ban (+b) to the channel, like $bMODE #channel +b <mask>$b, but lets
+you record a reason for it and optionally make it expire automatically after
+the given duration (e.g., 30m, 1d, 2w). Use $bBANLIST$b to see the reasons and
+expiration times of the channel's bans.`,
+			helpShort:         `$bBAN$b adds a ban with a reason and an optional expiration.`,
+			enabled:           chanregEnabled,
+			minParams:         2,
+			maxParams:         4,
+			unsplitFinalParam: true,
+			modifiesState:     true,
+		},
+		"banlist": {
+			handler: csBanlistHandler,
+			help: `Syntax: $bBANLIST #channel$b
+
+BANLIST lists the channel's bans, along with who set them and when, their
+reasons, and when they expire.`,
+			helpShort: `$bBANLIST$b lists a channel's bans with their details.`,
+			enabled:   chanregEnabled,
+			minParams: 1,
+		},
+		"topic": {
+			handler: csTopicHandler,
+			help: `Syntax: $bTOPIC #channel [HISTORY|REVERT <number>]$b
+
+TOPIC lists the channel's previous topics, most recent first, along with who
+set them and when. $bTOPIC #channel REVERT <number>$b restores one of them,
+e.g., after the topic was vandalized; this requires the same privileges as
+setting the topic yourself.`,
+			helpShort: `$bTOPIC$b lists and restores a channel's previous topics.`,
+			enabled:   chanregEnabled,
+			minParams: 1,
+			maxParams: 3,
+		},
 		"clear": {
 			handler: csClearHandler,
 			help: `Syntax: $bCLEAR #channel target$b
@@ -93,9 +170,10 @@ CLEAR removes users or settings from a channel. Specifically:
 $bCLEAR #channel users$b kicks all users except for you.
 $bCLEAR #channel access$b resets all stored bans, invites, ban exceptions,
 and persistent user-mode grants made with CS AMODE.`,
-			helpShort: `$bCLEAR$b removes users or settings from a channel.`,
-			enabled:   chanregEnabled,
-			minParams: 2,
+			helpShort:     `$bCLEAR$b removes users or settings from a channel.`,
+			enabled:       chanregEnabled,
+			minParams:     2,
+			modifiesState: true,
 		},
 		"transfer": {
 			handler: csTransferHandler,
@@ -108,9 +186,10 @@ code, then $bTRANSFER #channel alice 2930242125$b initiates the transfer.
 Unless you are an IRC operator with the correct permissions, alice must
 then accept the transfer, which she can do with $bTRANSFER accept #channel$b.
 To cancel a pending transfer, transfer the channel to yourself.`,
-			helpShort: `$bTRANSFER$b transfers ownership of a channel to another user.`,
-			enabled:   chanregEnabled,
-			minParams: 2,
+			helpShort:     `$bTRANSFER$b transfers ownership of a channel to another user.`,
+			enabled:       chanregEnabled,
+			minParams:     2,
+			modifiesState: true,
 		},
 		"purge": {
 			handler: csPurgeHandler,
@@ -125,6 +204,7 @@ channels that do not currently have members.`,
 			minParams:         1,
 			maxParams:         2,
 			unsplitFinalParam: true,
+			modifiesState:     true,
 		},
 		"unpurge": {
 			handler: csUnpurgeHandler,
@@ -132,9 +212,24 @@ channels that do not currently have members.`,
 
 UNPURGE removes any blacklisting of a channel that was previously
 set using PURGE.`,
-			helpShort: `$bUNPURGE$b undoes a previous PURGE command.`,
-			capabs:    []string{"chanreg"},
-			minParams: 1,
+			helpShort:     `$bUNPURGE$b undoes a previous PURGE command.`,
+			capabs:        []string{"chanreg"},
+			minParams:     1,
+			modifiesState: true,
+		},
+		"hold": {
+			handler: csHoldHandler,
+			help: `Syntax: $bHOLD #channel [ON|OFF]$b
+
+HOLD exempts a registered channel from expiry, so that it stays registered
+even if its founder and successor never join it. With no argument, HOLD
+displays whether the channel is currently held.`,
+			helpShort:     `$bHOLD$b exempts a registered channel from expiry.`,
+			capabs:        []string{"chanreg"},
+			enabled:       chanregEnabled,
+			minParams:     1,
+			maxParams:     2,
+			modifiesState: true,
 		},
 		"list": {
 			handler: csListHandler,
@@ -180,9 +275,41 @@ SET modifies a channel's settings. The following settings are available:`,
 2. 'ephemeral'  [a limited amount of temporary history, not stored on disk]
 3. 'on'         [history stored in a permanent database, if available]
 4. 'default'    [use the server default]`,
+
+				`$bVISIBILITY$b
+'visibility' controls what users outside the channel can learn about who is
+in it, via NAMES, WHO, and WHOIS. Your options are:
+1. 'full'       [all members who aren't invisible (+i) are visible]
+2. 'ops'        [only members with halfop or higher are visible]
+3. 'none'       [no members are visible]`,
+
+				`$bOPENHOURS$b
+'openhours' restricts joins to scheduled windows of time. It takes a list
+of windows, each a range of days and a range of times, optionally followed
+by a timezone (the default is UTC). For example:
+	mon-fri/18:00-22:00 sat,sun/10:00-02:00 Europe/Berlin
+Windows ending before they start run past midnight. Users with halfop or
+higher, invited users, and the founder can always join. Use 'off' to
+remove the restriction.`,
+
+				`$bSUCCESSOR$b
+'successor' designates an account that will become the channel's founder
+if the founder's account is unregistered; otherwise, the channel is
+unregistered along with the account. Use 'none' to remove the successor.`,
+
+				`$bRETENTION$b
+'retention' limits how much of the channel's history is kept, beyond the
+server's own limits. It takes a maximum age, a maximum number of lines, or
+both, for example:
+	30d 500
+Use 'default' to remove the limits. To keep no history at all, use
+SET HISTORY instead.`,
 			},
-			enabled:   chanregEnabled,
-			minParams: 3,
+			enabled:           chanregEnabled,
+			minParams:         3,
+			maxParams:         3,
+			unsplitFinalParam: true,
+			modifiesState:     true,
 		},
 	}
 )
@@ -230,6 +357,9 @@ func csAmodeHandler(service *ircService, server *Server, client *Client, command
 		service.Notice(rb, client.t("Account does not exist"))
 		return
 	}
+	if change.Op != modes.List && serviceReadOnly(service, server, client, rb) {
+		return
+	}
 
 	affectedModes, err := channel.ProcessAccountToUmodeChange(client, change)
 
@@ -399,6 +529,11 @@ func csRegisterHandler(service *ircService, server *Server, client *Client, comm
 
 	server.logger.Info("services", fmt.Sprintf("Client %s registered channel %s", client.Nick(), channelName))
 	server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel registered $c[grey][$r%s$c[grey]] by $c[grey][$r%s$c[grey]]"), channelName, client.nickMaskString))
+	server.webhooks.Send(WebhookChannelRegister, webhookData{
+		"channel": channelName,
+		"account": account,
+		"client":  webhookClientData(client, client.Details()),
+	})
 
 	// give them founder privs
 	applied, change := channelInfo.applyModeToMember(client,
@@ -470,6 +605,306 @@ func csUnregisterHandler(service *ircService, server *Server, client *Client, co
 	service.Notice(rb, fmt.Sprintf(client.t("Channel %s is now unregistered"), channelKey))
 }
 
+func csBanHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	channel := server.channels.Get(params[0])
+	if channel == nil {
+		service.Notice(rb, client.t("Channel does not exist"))
+		return
+	}
+	if !(channel.ClientIsAtLeast(client, modes.ChannelOperator) || client.HasRoleCapabs("chanreg")) {
+		service.Notice(rb, client.t("Insufficient privileges"))
+		return
+	}
+
+	details := client.Details()
+	info := MaskInfo{
+		CreatorNickmask: details.nickMask,
+		CreatorAccount:  details.accountName,
+	}
+	reasonParams := params[2:]
+	if len(reasonParams) != 0 {
+		if duration, err := custime.ParseDuration(reasonParams[0]); err == nil {
+			info.Expires = time.Now().UTC().Add(duration)
+			reasonParams = reasonParams[1:]
+		}
+	}
+	info.Reason = strings.Join(reasonParams, " ")
+
+	list := channel.lists[modes.BanMask]
+	if list.Length() >= server.Config().Limits.ChanListModes {
+		service.Notice(rb, client.t("Channel list is full"))
+		return
+	}
+	maskAdded, err := list.AddWithInfo(params[1], info)
+	if err != nil {
+		service.Notice(rb, client.t("Invalid mask"))
+		return
+	} else if maskAdded == "" {
+		service.Notice(rb, client.t("That mask is already banned"))
+		return
+	}
+
+	channel.MarkDirty(IncludeLists)
+	if !info.Expires.IsZero() {
+		channel.scheduleExpiry()
+	}
+	change := modes.ModeChange{Mode: modes.BanMask, Op: modes.Add, Arg: maskAdded}
+	announceCmodeChanges(channel, modes.ModeChanges{change}, service.prefix, "*", "", rb)
+	if info.Expires.IsZero() {
+		service.Notice(rb, fmt.Sprintf(client.t("Banned %[1]s from %[2]s"), maskAdded, channel.Name()))
+	} else {
+		service.Notice(rb, fmt.Sprintf(client.t("Banned %[1]s from %[2]s until %[3]s"), maskAdded, channel.Name(), info.Expires.Format(time.RFC1123)))
+	}
+}
+
+// csModerationPrivsCheck checks that the client may manage the moderation
+// lists (AKICK and BADWORDS) of a registered channel.
+func csModerationPrivsCheck(service *ircService, channel *Channel, client *Client, rb *ResponseBuffer) bool {
+	if channel.Founder() == "" {
+		service.Notice(rb, client.t("Channel is not registered"))
+		return false
+	}
+	if !(channel.ClientIsAtLeast(client, modes.ChannelOperator) || client.HasRoleCapabs("chanreg")) {
+		service.Notice(rb, client.t("Insufficient privileges"))
+		return false
+	}
+	return true
+}
+
+func csAkickHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	channel := server.channels.Get(params[0])
+	if channel == nil {
+		service.Notice(rb, client.t("Channel does not exist"))
+		return
+	}
+	if !csModerationPrivsCheck(service, channel, client, rb) {
+		return
+	}
+
+	subcommand := strings.ToLower(params[1])
+	if subcommand == "list" {
+		akicks := channel.akicks.Masks()
+		if len(akicks) == 0 {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s has no autokicks"), channel.Name()))
+			return
+		}
+		masks := make([]string, 0, len(akicks))
+		for mask := range akicks {
+			masks = append(masks, mask)
+		}
+		sort.Strings(masks)
+		service.Notice(rb, fmt.Sprintf(client.t("Autokicks on %s:"), channel.Name()))
+		for _, mask := range masks {
+			info := akicks[mask]
+			service.Notice(rb, fmt.Sprintf(client.t("%[1]s  set by %[2]s at %[3]s"), mask, info.CreatorNickmask, info.TimeCreated.Format(time.RFC1123)))
+			if info.Reason != "" {
+				service.Notice(rb, fmt.Sprintf(client.t("    Reason: %s"), info.Reason))
+			}
+		}
+		return
+	}
+
+	if len(params) < 3 || !(subcommand == "add" || subcommand == "del") {
+		service.Notice(rb, client.t("Invalid parameters"))
+		return
+	}
+	if serviceReadOnly(service, server, client, rb) {
+		return
+	}
+	mask, err := canonicalizeAkick(params[2])
+	if err != nil {
+		service.Notice(rb, client.t("Invalid mask"))
+		return
+	}
+
+	if subcommand == "del" {
+		if removed, _ := channel.akicks.Remove(mask); removed == "" {
+			service.Notice(rb, client.t("That mask is not on the autokick list"))
+			return
+		}
+		channel.MarkDirty(IncludeLists)
+		service.Notice(rb, fmt.Sprintf(client.t("Removed %[1]s from the autokick list of %[2]s"), mask, channel.Name()))
+		return
+	}
+
+	if channel.akicks.Length() >= server.Config().Limits.ChanListModes {
+		service.Notice(rb, client.t("Channel list is full"))
+		return
+	}
+	details := client.Details()
+	info := MaskInfo{
+		CreatorNickmask: details.nickMask,
+		CreatorAccount:  details.accountName,
+	}
+	if len(params) > 3 {
+		info.Reason = params[3]
+	}
+	if added, _ := channel.akicks.AddWithInfo(mask, info); added == "" {
+		service.Notice(rb, client.t("That mask is already on the autokick list"))
+		return
+	}
+	channel.MarkDirty(IncludeLists)
+	service.Notice(rb, fmt.Sprintf(client.t("Added %[1]s to the autokick list of %[2]s"), mask, channel.Name()))
+	channel.applyAutokick(service.prefix, mask, info)
+}
+
+func csBadwordsHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	channel := server.channels.Get(params[0])
+	if channel == nil {
+		service.Notice(rb, client.t("Channel does not exist"))
+		return
+	}
+	if !csModerationPrivsCheck(service, channel, client, rb) {
+		return
+	}
+
+	badwords := channel.Badwords()
+	subcommand := strings.ToLower(params[1])
+	if subcommand == "list" {
+		if len(badwords) == 0 {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s has no forbidden words"), channel.Name()))
+			return
+		}
+		service.Notice(rb, fmt.Sprintf(client.t("Forbidden words on %s:"), channel.Name()))
+		for _, badword := range badwords {
+			service.Notice(rb, fmt.Sprintf(client.t("%[1]s  (%[2]s)  set by %[3]s at %[4]s"), badword.Pattern, badword.Action.String(), badword.CreatorAccount, badword.TimeCreated.Format(time.RFC1123)))
+		}
+		return
+	}
+
+	if len(params) < 3 || !(subcommand == "add" || subcommand == "del") {
+		service.Notice(rb, client.t("Invalid parameters"))
+		return
+	}
+	if serviceReadOnly(service, server, client, rb) {
+		return
+	}
+	pattern, err := canonicalizeBadword(params[2])
+	if err != nil {
+		service.Notice(rb, client.t("Invalid word"))
+		return
+	}
+	index := -1
+	for i, badword := range badwords {
+		if badword.Pattern == pattern {
+			index = i
+			break
+		}
+	}
+
+	if subcommand == "del" {
+		if index == -1 {
+			service.Notice(rb, client.t("That word is not forbidden"))
+			return
+		}
+		channel.SetBadwords(append(badwords[:index], badwords[index+1:]...))
+		service.Notice(rb, fmt.Sprintf(client.t("Removed %[1]s from the forbidden words of %[2]s"), pattern, channel.Name()))
+		return
+	}
+
+	action := BadwordCensor
+	if len(params) > 3 {
+		if action, err = badwordActionFromString(params[3]); err != nil {
+			service.Notice(rb, client.t("Invalid action"))
+			return
+		}
+	}
+	badword := Badword{
+		Pattern:        pattern,
+		Action:         action,
+		CreatorAccount: client.AccountName(),
+		TimeCreated:    time.Now().UTC(),
+	}
+	if index != -1 {
+		// adding an existing word changes its action
+		badwords[index] = badword
+	} else if len(badwords) >= server.Config().Limits.ChanListModes {
+		service.Notice(rb, client.t("Channel list is full"))
+		return
+	} else {
+		badwords = append(badwords, badword)
+	}
+	channel.SetBadwords(badwords)
+	service.Notice(rb, fmt.Sprintf(client.t("Forbade %[1]s in %[2]s (action: %[3]s)"), pattern, channel.Name(), action.String()))
+}
+
+func csBanlistHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	channel := server.channels.Get(params[0])
+	if channel == nil {
+		service.Notice(rb, client.t("Channel does not exist"))
+		return
+	}
+
+	bans := channel.lists[modes.BanMask].Masks()
+	if len(bans) == 0 {
+		service.Notice(rb, fmt.Sprintf(client.t("Channel %s has no bans"), channel.Name()))
+		return
+	}
+	masks := make([]string, 0, len(bans))
+	for mask := range bans {
+		masks = append(masks, mask)
+	}
+	sort.Strings(masks)
+
+	service.Notice(rb, fmt.Sprintf(client.t("Bans on %s:"), channel.Name()))
+	for _, mask := range masks {
+		info := bans[mask]
+		service.Notice(rb, fmt.Sprintf(client.t("%[1]s  set by %[2]s at %[3]s"), mask, info.CreatorNickmask, info.TimeCreated.Format(time.RFC1123)))
+		if info.Reason != "" {
+			service.Notice(rb, fmt.Sprintf(client.t("    Reason: %s"), info.Reason))
+		}
+		if !info.Expires.IsZero() {
+			service.Notice(rb, fmt.Sprintf(client.t("    Expires: %s"), info.Expires.Format(time.RFC1123)))
+		}
+	}
+}
+
+func csTopicHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	channel := server.channels.Get(params[0])
+	if channel == nil {
+		service.Notice(rb, client.t("Channel does not exist"))
+		return
+	}
+	if channel.flags.HasMode(modes.Secret) && !channel.hasClient(client) && !client.HasRoleCapabs("chanreg") {
+		service.Notice(rb, client.t("You're not on that channel"))
+		return
+	}
+
+	topicHistory := channel.TopicHistory()
+	subcommand := "history"
+	if len(params) > 1 {
+		subcommand = strings.ToLower(params[1])
+	}
+	switch subcommand {
+	case "history":
+		if len(topicHistory) == 0 {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s has no previous topics"), channel.Name()))
+			return
+		}
+		service.Notice(rb, fmt.Sprintf(client.t("Previous topics of %s:"), channel.Name()))
+		for i, entry := range topicHistory {
+			service.Notice(rb, fmt.Sprintf("%d. %s", i+1, entry.Topic))
+			service.Notice(rb, fmt.Sprintf(client.t("    set by %[1]s at %[2]s"), entry.SetBy, entry.SetTime.Format(time.RFC1123)))
+		}
+	case "revert":
+		if len(params) < 3 {
+			service.Notice(rb, client.t("Invalid parameters"))
+			return
+		}
+		index, err := strconv.Atoi(params[2])
+		if err != nil || index < 1 || len(topicHistory) < index {
+			service.Notice(rb, client.t("No such topic; see the numbers in the topic history"))
+			return
+		}
+		if serviceReadOnly(service, server, client, rb) {
+			return
+		}
+		channel.SetTopic(client, topicHistory[index-1].Topic, rb)
+	default:
+		service.Notice(rb, client.t("Invalid parameters"))
+	}
+}
+
 func csClearHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	channel := server.channels.Get(params[0])
 	if channel == nil {
@@ -535,11 +970,14 @@ func csTransferHandler(service *ircService, server *Server, client *Client, comm
 	if err == nil {
 		switch status {
 		case channelTransferComplete:
+			server.auditChannelOwnership(chname, fmt.Sprintf("was transferred to account %s by %s", targetAccount.Name, client.NickMaskString()))
 			service.Notice(rb, fmt.Sprintf(client.t("Successfully transferred channel %[1]s to account %[2]s"), chname, target))
 		case channelTransferPending:
+			server.auditChannelOwnership(chname, fmt.Sprintf("was offered to account %s by %s", targetAccount.Name, client.NickMaskString()))
 			sendTransferPendingNotice(service, server, target, chname)
 			service.Notice(rb, fmt.Sprintf(client.t("Transfer of channel %[1]s to account %[2]s succeeded, pending acceptance"), chname, target))
 		case channelTransferCancelled:
+			server.auditChannelOwnership(chname, fmt.Sprintf("had its pending transfer cancelled by %s", client.NickMaskString()))
 			service.Notice(rb, fmt.Sprintf(client.t("Cancelled pending transfer of channel %s"), chname))
 		}
 	} else {
@@ -573,6 +1011,7 @@ func processTransferAccept(service *ircService, client *Client, chname string, r
 	}
 	switch channel.AcceptTransfer(client) {
 	case nil:
+		client.server.auditChannelOwnership(channel.Name(), fmt.Sprintf("was accepted by account %s (%s)", client.AccountName(), client.NickMaskString()))
 		service.Notice(rb, fmt.Sprintf(client.t("Successfully accepted ownership of channel %s"), channel.Name()))
 	case errChannelTransferNotOffered:
 		service.Notice(rb, fmt.Sprintf(client.t("You weren't offered ownership of channel %s"), channel.Name()))
@@ -581,6 +1020,41 @@ func processTransferAccept(service *ircService, client *Client, chname string, r
 	}
 }
 
+// auditChannelOwnership records a change to the ownership of a registered
+// channel in the logs and the channel snomask.
+func (server *Server) auditChannelOwnership(chname, event string) {
+	server.logger.Info("services", fmt.Sprintf("Channel %s %s", chname, event))
+	server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Channel $c[grey][$r%s$c[grey]]$r %s"), chname, event))
+}
+
+// passChannelToSuccessor makes a channel's successor its founder, when the
+// account of its founder `founder` is being unregistered. It returns whether
+// there was a valid successor.
+func (server *Server) passChannelToSuccessor(chname, founder string) bool {
+	// the channel may not be loaded, in which case we consult the registry:
+	var name, successor string
+	if channel := server.channels.Get(chname); channel != nil {
+		name, successor = channel.Name(), channel.Settings().Successor
+	} else if info, err := server.channelRegistry.LoadChannel(chname); err == nil {
+		name, successor = info.Name, info.Settings.Successor
+	}
+	if successor == "" || successor == founder {
+		return false
+	}
+	account, err := server.accounts.LoadAccount(successor)
+	if err != nil || !account.Verified || account.Suspended != nil {
+		return false
+	}
+	if server.channels.PassToSuccessor(chname, founder, successor) != nil {
+		return false
+	}
+	server.auditChannelOwnership(name, fmt.Sprintf("passed to its successor %s after the founder account %s was unregistered", account.Name, founder))
+	for _, client := range server.accounts.AccountToClients(successor) {
+		client.Send(nil, chanservService.prefix, "NOTICE", client.Nick(), fmt.Sprintf(client.t("You are now the founder of channel %s, as its previous founder's account was unregistered"), name))
+	}
+	return true
+}
+
 func csPurgeHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	oper := client.Oper()
 	if oper == nil {
@@ -680,7 +1154,7 @@ func csInfoHandler(service *ircService, server *Server, client *Client, command
 	var chinfo RegisteredChannel
 	channel := server.channels.Get(params[0])
 	if channel != nil {
-		chinfo = channel.ExportRegistration(0)
+		chinfo = channel.ExportRegistration(IncludeSettings)
 	} else {
 		chinfo, err = server.channelRegistry.LoadChannel(chname)
 		if err != nil && !(err == errNoSuchChannel || err == errFeatureDisabled) {
@@ -697,6 +1171,66 @@ func csInfoHandler(service *ircService, server *Server, client *Client, command
 	service.Notice(rb, fmt.Sprintf(client.t("Channel %s is registered"), chinfo.Name))
 	service.Notice(rb, fmt.Sprintf(client.t("Founder: %s"), chinfo.Founder))
 	service.Notice(rb, fmt.Sprintf(client.t("Registered at: %s"), chinfo.RegisteredAt.Format(time.RFC1123)))
+	if chinfo.Settings.Held {
+		service.Notice(rb, client.t("This channel is held, and will not expire"))
+	} else if expireTime := time.Duration(server.Config().Channels.Registration.ExpireTime); expireTime != 0 && !chinfo.Settings.LastUsed.IsZero() {
+		service.Notice(rb, fmt.Sprintf(client.t("Last used by its founder at: %s"), chinfo.Settings.LastUsed.Format(time.RFC1123)))
+		service.Notice(rb, fmt.Sprintf(client.t("Expires at: %s"), chinfo.Settings.LastUsed.Add(expireTime).Format(time.RFC1123)))
+	}
+}
+
+func csHoldHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	chname := params[0]
+	if len(params) == 1 {
+		var chinfo RegisteredChannel
+		if channel := server.channels.Get(chname); channel != nil {
+			chinfo = channel.ExportRegistration(IncludeSettings)
+		} else if cfname, err := CasefoldChannel(chname); err == nil {
+			chinfo, _ = server.channelRegistry.LoadChannel(cfname)
+		}
+		if chinfo.Founder == "" {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s is not registered"), chname))
+		} else if chinfo.Settings.Held {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s is held, and will not expire"), chname))
+		} else {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s is not held"), chname))
+		}
+		return
+	}
+
+	var held bool
+	switch strings.ToLower(params[1]) {
+	case "on":
+		held = true
+	case "off":
+		held = false
+	default:
+		service.Notice(rb, client.t("Invalid parameters"))
+		return
+	}
+
+	err := server.channels.UpdateSettings(chname, func(settings *ChannelSettings) {
+		settings.Held = held
+		if !held {
+			// restart the clock, so the channel doesn't expire immediately
+			settings.LastUsed = time.Now().UTC()
+			settings.ExpiryWarned = time.Time{}
+		}
+	})
+	switch err {
+	case nil:
+		if held {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s is now held, and will not expire"), chname))
+			server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] held channel $c[grey][$r%s$c[grey]]"), client.Oper().Name, chname))
+		} else {
+			service.Notice(rb, fmt.Sprintf(client.t("Channel %s is no longer held"), chname))
+			server.snomasks.Send(sno.LocalChannels, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] released the hold on channel $c[grey][$r%s$c[grey]]"), client.Oper().Name, chname))
+		}
+	case errNoSuchChannel, errChannelNotRegistered:
+		service.Notice(rb, fmt.Sprintf(client.t("Channel %s is not registered"), chname))
+	default:
+		service.Notice(rb, client.t("An error occurred"))
+	}
 }
 
 func displayChannelSetting(service *ircService, settingName string, settings ChannelSettings, client *Client, rb *ResponseBuffer) {
@@ -707,6 +1241,26 @@ func displayChannelSetting(service *ircService, settingName string, settings Cha
 		effectiveValue := historyEnabled(config.History.Persistent.RegisteredChannels, settings.History)
 		service.Notice(rb, fmt.Sprintf(client.t("The stored channel history setting is: %s"), historyStatusToString(settings.History)))
 		service.Notice(rb, fmt.Sprintf(client.t("Given current server settings, the channel history setting is: %s"), historyStatusToString(effectiveValue)))
+	case "visibility":
+		service.Notice(rb, fmt.Sprintf(client.t("The channel's visibility to non-members is: %s"), membershipVisibilityToString(settings.Visibility)))
+	case "successor":
+		if settings.Successor == "" {
+			service.Notice(rb, client.t("The channel has no successor"))
+		} else {
+			service.Notice(rb, fmt.Sprintf(client.t("The channel's successor is: %s"), settings.Successor))
+		}
+	case "retention":
+		service.Notice(rb, fmt.Sprintf(client.t("The channel's history retention limit is: %s"), settings.Retention.String()))
+	case "openhours":
+		service.Notice(rb, fmt.Sprintf(client.t("The channel's open hours are: %s"), settings.OpenHours.String()))
+		if settings.OpenHours.IsRestricted() {
+			now := time.Now()
+			if settings.OpenHours.IsOpen(now) {
+				service.Notice(rb, client.t("The channel is currently open"))
+			} else if nextOpen := settings.OpenHours.NextOpen(now); !nextOpen.IsZero() {
+				service.Notice(rb, fmt.Sprintf(client.t("The channel is currently closed; it will next open at %s"), nextOpen.UTC().Format(time.RFC1123)))
+			}
+		}
 	default:
 		service.Notice(rb, client.t("Invalid params"))
 	}
@@ -727,6 +1281,23 @@ func csGetHandler(service *ircService, server *Server, client *Client, command s
 	displayChannelSetting(service, setting, info.Settings, client, rb)
 }
 
+// parseChannelSuccessor validates a new successor for a channel, returning it
+// casefolded; "none" (or "*") removes the successor.
+func parseChannelSuccessor(server *Server, info RegisteredChannel, value string) (successor string, err error) {
+	switch strings.ToLower(value) {
+	case "none", "*":
+		return "", nil
+	}
+	account, err := server.accounts.LoadAccount(value)
+	if err != nil || !account.Verified {
+		return "", errAccountDoesNotExist
+	}
+	if account.NameCasefolded == info.Founder {
+		return "", errInvalidParams
+	}
+	return account.NameCasefolded, nil
+}
+
 func csSetHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	chname, setting, value := params[0], params[1], params[2]
 	channel := server.channels.Get(chname)
@@ -750,6 +1321,38 @@ func csSetHandler(service *ircService, server *Server, client *Client, command s
 		}
 		channel.SetSettings(settings)
 		channel.resizeHistory(server.Config())
+	case "visibility":
+		settings.Visibility, err = membershipVisibilityFromString(value)
+		if err != nil {
+			break
+		}
+		channel.SetSettings(settings)
+	case "openhours":
+		settings.OpenHours, err = ParseOpenHours(value)
+		if err != nil {
+			err = errInvalidParams
+			break
+		}
+		channel.SetSettings(settings)
+	case "retention":
+		settings.Retention, err = ParseHistoryRetention(value)
+		if err != nil {
+			break
+		}
+		channel.SetSettings(settings)
+		channel.resizeHistory(server.Config())
+		server.setHistoryRetention(channel.NameCasefolded(), settings.Retention)
+	case "successor":
+		settings.Successor, err = parseChannelSuccessor(server, info, value)
+		if err != nil {
+			break
+		}
+		channel.SetSettings(settings)
+		if settings.Successor != "" {
+			server.auditChannelOwnership(info.Name, fmt.Sprintf("had its successor set to %s by %s", settings.Successor, client.NickMaskString()))
+		} else {
+			server.auditChannelOwnership(info.Name, fmt.Sprintf("had its successor removed by %s", client.NickMaskString()))
+		}
 	}
 
 	switch err {
@@ -758,6 +1361,8 @@ func csSetHandler(service *ircService, server *Server, client *Client, command s
 		displayChannelSetting(service, setting, settings, client, rb)
 	case errInvalidParams:
 		service.Notice(rb, client.t("Invalid parameters"))
+	case errAccountDoesNotExist:
+		service.Notice(rb, client.t("Account does not exist"))
 	default:
 		server.logger.Error("internal", "CS SET error:", err.Error())
 		service.Notice(rb, client.t("An error occurred"))
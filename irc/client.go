@@ -9,6 +9,7 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net"
+	"regexp"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -40,6 +41,13 @@ const (
 	// controls how often often we write an autoreplay-missed client's
 	// deviceid->lastseentime mapping to the database
 	lastSeenWriteInterval = time.Hour
+
+	// at DEFCON 3 and below, clients can join at most this many channels per window:
+	defconJoinLimit  = 3
+	defconJoinWindow = 30 * time.Second
+
+	// history.chathistory-maxmessages-per-minute is enforced over this window:
+	chathistoryThrottleWindow = time.Minute
 )
 
 const (
@@ -76,8 +84,10 @@ type Client struct {
 	accountName        string // display name of the account: uncasefolded, '*' if not logged in
 	accountRegDate     time.Time
 	accountSettings    AccountSettings
+	silenced           *regexp.Regexp // compiled from accountSettings.Silence
 	away               bool
 	autoAway           bool
+	autoDeaf           bool // whether +D was set by auto-away
 	awayMessage        string
 	brbTimer           BrbTimer
 	channels           ChannelSet
@@ -92,12 +102,18 @@ type Client struct {
 	lastSeen           map[string]time.Time // maps device ID (including "") to time of last received command
 	lastSeenLastWrite  time.Time            // last time `lastSeen` was written to the datastore
 	loginThrottle      connection_limits.GenericThrottle
-	nextSessionID      int64 // Incremented when a new session is established
+	nickThrottle       connection_limits.GenericThrottle
+	announceThrottle   connection_limits.GenericThrottle
+	joinThrottle       connection_limits.GenericThrottle // only enforced at DEFCON 3 and below
+	connectionClass    string                            // name of the client's connection class, if any
+	nextSessionID      int64                             // Incremented when a new session is established
 	nick               string
 	nickCasefolded     string
 	nickMaskCasefolded string
 	nickMaskString     string // cache for nickmask string since it's used with lots of replies
 	oper               *Oper
+	operExpiresAt      time.Time   // zero unless operator status was granted temporarily
+	operExpiration     *time.Timer // removes temporary operator status
 	preregNick         string
 	proxiedIP          net.IP // actual remote IP if using the PROXY protocol
 	rawHostname        string
@@ -120,6 +136,11 @@ type Client struct {
 	history            history.Buffer
 	dirtyBits          uint
 	writerSemaphore    utils.Semaphore // tier 1.5
+	blockedReport      blockedMessageReport
+	bridge             string // for a puppet, the name of the bridge that controls it
+
+	// counts CHATHISTORY messages retrieved, not requests:
+	chathistoryThrottle connection_limits.GenericThrottle
 }
 
 type saslStatus struct {
@@ -161,16 +182,28 @@ type Session struct {
 	rawHostname string
 	isTor       bool
 	hideSTS     bool
+	listener    string // address of the listener the session connected to
+
+	// the lookup of rawHostname, if it's in progress
+	hostnameLookup *hostnameLookup
 
 	fakelag              Fakelag
 	deferredFakelagCount int
 	destroyed            uint32
 
+	label string // human-readable name for the session, set with SESSION LABEL
+
+	draftsSubscribed uint32 // whether changes to the account's drafts are pushed to the session
+
 	certfp     string
 	peerCerts  []*x509.Certificate
+	proxiedTLS *utils.ProxiedTLS // TLS status reported by a TLS-terminating proxy
 	sasl       saslStatus
 	passStatus serverPassStatus
 
+	// pending CHALLENGE for oper authentication
+	operChallenge *operChallenge
+
 	batchCounter uint32
 
 	quitMessage string
@@ -180,6 +213,9 @@ type Session struct {
 	capVersion   caps.Version
 
 	registrationMessages int
+	registrationBytes    int
+	// 1 while the session counts against its IP's limit on unregistered connections
+	unregistered uint32
 
 	resumeID              string
 	resumeDetails         *ResumeDetails
@@ -187,6 +223,12 @@ type Session struct {
 	autoreplayMissedSince time.Time
 
 	batch MultilineBatch
+
+	typingLimiter TypingLimiter
+	ctcpThrottle  *connection_limits.GenericThrottle
+
+	bridge           *bridgeLink // set if this session has authenticated as a bridge
+	bridgeController *Session    // for a puppet's session, the bridge session it's forwarded to
 }
 
 // MultilineBatch tracks the state of a client-to-server multiline batch.
@@ -270,17 +312,39 @@ func (session *Session) SetDestroyed() {
 	atomic.StoreUint32(&session.destroyed, 1)
 }
 
+// stops counting the session against its IP's limit on unregistered
+// connections, once it registers or disconnects
+func (session *Session) releaseUnregistered() {
+	if atomic.CompareAndSwapUint32(&session.unregistered, 1, 0) {
+		ip := session.realIP
+		if session.proxiedIP != nil {
+			ip = session.proxiedIP
+		}
+		session.client.server.connectionLimiter.RemoveUnregistered(flatip.FromNetIP(ip))
+	}
+}
+
 // returns whether the client supports a smart history replay cap,
 // and therefore autoreplay-on-join and similar should be suppressed
 func (session *Session) HasHistoryCaps() bool {
 	return session.capabilities.Has(caps.Chathistory) || session.capabilities.Has(caps.ZNCPlayback)
 }
 
+// returns whether the session should be notified of changes to the
+// available capabilities (cap-notify is implicit in cap version 302 and above)
+func (session *Session) hasCapNotify() bool {
+	return session.capabilities.Has(caps.CapNotify) || 302 <= session.capVersion
+}
+
 // generates a batch ID. the uniqueness requirements for this are fairly weak:
 // any two batch IDs that are active concurrently (either through interleaving
 // or nesting) on an individual session connection need to be unique.
 // this allows ~4 billion such batches which should be fine.
 func (session *Session) generateBatchID() string {
+	// a puppet's batches are interleaved with its bridge's:
+	if session.bridgeController != nil {
+		return session.bridgeController.generateBatchID()
+	}
 	id := atomic.AddUint32(&session.batchCounter, 1)
 	return strconv.FormatInt(int64(id), 32)
 }
@@ -316,7 +380,10 @@ func (server *Server) RunClient(conn IRCConn) {
 		// cover up details of the tor proxying infrastructure (not a user privacy concern,
 		// but a hardening measure):
 		proxiedIP = utils.IPv4LoopbackAddress
-		isBanned, banMsg = server.checkTorLimits()
+		isBanned, banMsg = server.checkMaintenance(nil)
+		if !isBanned {
+			isBanned, banMsg = server.checkTorLimits()
+		}
 	} else {
 		ipToCheck := realIP
 		if wConn.ProxiedIP != nil {
@@ -379,18 +446,39 @@ func (server *Server) RunClient(conn IRCConn) {
 		proxiedIP:  proxiedIP,
 		isTor:      wConn.Config.Tor,
 		hideSTS:    wConn.Config.Tor || wConn.Config.HideSTS,
+		listener:   wConn.Config.Name,
 	}
 	client.sessions = []*Session{session}
+	if !session.isTor {
+		// checkBans counted the connection as unregistered
+		session.unregistered = 1
+	}
 
-	session.resetFakelag()
+	if wsConn, ok := conn.(*IRCWSConn); ok && wsConn.webchatAccount != "" {
+		server.applyWebchatLogin(client, session, wsConn.webchatAccount)
+	}
 
 	if wConn.Secure {
 		client.SetMode(modes.TLS, true)
 	}
 
+	client.updateConnectionClass()
+	session.resetFakelag()
+
+	// the registration deadline runs from here, so it also covers the TLS
+	// handshake and the ident lookup (slow-loris hardening):
+	server.stats.Add()
+	registrationTimeout := client.registrationTimeout()
+	client.registrationTimer = time.AfterFunc(registrationTimeout, func() {
+		client.handleRegisterTimeout(registrationTimeout)
+	})
+
 	if wConn.Config.TLSConfig != nil {
 		// error is not useful to us here anyways so we can ignore it
-		session.certfp, session.peerCerts, _ = utils.GetCertFP(wConn.Conn, RegisterTimeout)
+		session.certfp, session.peerCerts, _ = utils.GetCertFP(wConn.Conn, registrationTimeout)
+	} else if wConn.ProxiedTLS != nil {
+		session.proxiedTLS = wConn.ProxiedTLS
+		session.certfp = wConn.ProxiedTLS.CertFP
 	}
 
 	if session.isTor {
@@ -402,8 +490,6 @@ func (server *Server) RunClient(conn IRCConn) {
 		}
 	}
 
-	client.registrationTimer = time.AfterFunc(RegisterTimeout, client.handleRegisterTimeout)
-	server.stats.Add()
 	client.run(session)
 }
 
@@ -480,7 +566,26 @@ func (server *Server) AddAlwaysOnClient(account ClientAccount, channelToModes ma
 	if persistenceEnabled(config.Accounts.Multiclient.AutoAway, client.accountSettings.AutoAway) {
 		client.autoAway = true
 		client.away = true
-		client.awayMessage = client.t("User is currently disconnected")
+		client.awayMessage = autoAwayMessage(config, client.languages)
+		client.setAutoDeaf(config)
+	}
+}
+
+// autoAwayMessage returns the away message for an always-on client with
+// no attached sessions.
+func autoAwayMessage(config *Config, languages []string) string {
+	if config.Accounts.Multiclient.AutoAwayMessage != "" {
+		return config.Accounts.Multiclient.AutoAwayMessage
+	}
+	return config.languageManager.Translate(languages, `User is currently disconnected`)
+}
+
+// setAutoDeaf sets +D on an auto-away client, if so configured, so that it
+// doesn't accumulate channel messages while nobody is attached to it.
+// It must be called with the stateMutex held.
+func (client *Client) setAutoDeaf(config *Config) {
+	if config.Accounts.Multiclient.AutoAwayDeaf && client.SetMode(modes.UserDeaf, true) {
+		client.autoDeaf = true
 	}
 }
 
@@ -493,43 +598,36 @@ func (client *Client) resizeHistory(config *Config) {
 	}
 }
 
+// startHostnameLookup starts resolving the session's IP to a hostname in
+// the background (see hostnames.go); lookupHostname collects the result.
+func (session *Session) startHostnameLookup() {
+	config := session.client.server.Config()
+	if session.isTor || !config.Server.lookupHostnames {
+		return
+	} // else: even if cloaking is enabled, look up the real hostname to show to operators
+
+	session.Notice("*** Looking up your hostname...")
+	session.hostnameLookup = session.client.server.hostnames.Lookup(session.IP(), config)
+}
+
 // resolve an IP to an IRC-ready hostname, using reverse DNS, forward-confirming if necessary,
 // and sending appropriate notices to the client
 func (client *Client) lookupHostname(session *Session, overwrite bool) {
 	if session.isTor {
 		return
-	} // else: even if cloaking is enabled, look up the real hostname to show to operators
+	}
 
 	config := client.server.Config()
-	ip := session.realIP
-	if session.proxiedIP != nil {
-		ip = session.proxiedIP
-	}
+	ip := session.IP()
 	ipString := ip.String()
 
-	var hostname, candidate string
+	var hostname string
 	if config.Server.lookupHostnames {
-		session.Notice("*** Looking up your hostname...")
-
-		names, err := net.LookupAddr(ipString)
-		if err == nil && 0 < len(names) {
-			candidate = strings.TrimSuffix(names[0], ".")
-		}
-		if utils.IsHostname(candidate) {
-			if config.Server.ForwardConfirmHostnames {
-				addrs, err := net.LookupHost(candidate)
-				if err == nil {
-					for _, addr := range addrs {
-						if addr == ipString {
-							hostname = candidate // successful forward confirmation
-							break
-						}
-					}
-				}
-			} else {
-				hostname = candidate
-			}
+		if session.hostnameLookup == nil {
+			session.startHostnameLookup()
 		}
+		hostname = session.hostnameLookup.Wait(config.Server.HostnameLookup.Timeout)
+		session.hostnameLookup = nil
 	}
 
 	if hostname != "" {
@@ -609,10 +707,27 @@ func (client *Client) isAuthorized(server *Server, config *Config, session *Sess
 
 func (session *Session) resetFakelag() {
 	var flc FakelagConfig = session.client.server.Config().Fakelag
+	if class := session.client.ConnectionClass(); class != nil && class.Fakelag != nil {
+		flc = *class.Fakelag
+	}
 	flc.Enabled = flc.Enabled && !session.client.HasRoleCapabs("nofakelag")
 	session.fakelag.Initialize(flc)
 }
 
+// listenerOverrides returns the presentation overrides (network name, MOTD,
+// and capabilities) for the session's listener, or nil if there are none.
+func (session *Session) listenerOverrides(config *Config) *listenerOverrides {
+	return config.Server.listenerOverrides[session.listener]
+}
+
+// networkName returns the network name to present to the session.
+func (session *Session) networkName(config *Config) string {
+	if overrides := session.listenerOverrides(config); overrides != nil && overrides.networkName != "" {
+		return overrides.networkName
+	}
+	return config.Network.Name
+}
+
 // IP returns the IP address of this client.
 func (client *Client) IP() net.IP {
 	client.stateMutex.RLock()
@@ -663,6 +778,9 @@ func (client *Client) run(session *Session) {
 	isReattach := client.Registered()
 	if isReattach {
 		client.Touch(session)
+		// apply the connection class's limits to the new session
+		client.updateConnectionClass()
+		session.resetFakelag()
 		if session.resumeDetails != nil {
 			session.playResume()
 			session.resumeDetails = nil
@@ -695,7 +813,7 @@ func (client *Client) run(session *Session) {
 		}
 
 		if client.server.logger.IsLoggingRawIO() {
-			client.server.logger.Debug("userinput", client.nick, "<- ", line)
+			client.server.logger.Debug("userinput", client.nick, "<- ", redactRawLine(line, false, client.server.Config().aliases))
 		}
 
 		// special-cased handling of PROXY protocol, see `handleProxyCommand` for details:
@@ -720,9 +838,14 @@ func (client *Client) run(session *Session) {
 		} else {
 			// DoS hardening, #505
 			session.registrationMessages++
-			if client.server.Config().Limits.RegistrationMessages < session.registrationMessages {
+			session.registrationBytes += len(line)
+			limits := client.server.Config().Limits
+			if limits.RegistrationMessages < session.registrationMessages {
 				client.Send(nil, client.server.name, ERR_UNKNOWNERROR, "*", client.t("You have sent too many registration messages"))
 				break
+			} else if limits.RegistrationBytes < session.registrationBytes {
+				client.Send(nil, client.server.name, ERR_UNKNOWNERROR, "*", client.t("You have sent too much data during registration"))
+				break
 			}
 		}
 
@@ -739,8 +862,14 @@ func (client *Client) run(session *Session) {
 
 		cmd, exists := Commands[msg.Command]
 		if !exists {
-			cmd = unknownCommand
-		} else if invalidUtf8 {
+			if alias := client.server.Config().aliases[msg.Command]; alias != nil {
+				cmd, msg = alias.resolve(msg, client.Nick())
+				exists = true
+			} else {
+				cmd = unknownCommand
+			}
+		}
+		if exists && invalidUtf8 {
 			cmd = invalidUtf8Command
 		}
 
@@ -758,24 +887,29 @@ func (client *Client) run(session *Session) {
 func (client *Client) playReattachMessages(session *Session) {
 	client.server.playRegistrationBurst(session)
 	hasHistoryCaps := session.HasHistoryCaps()
+	// wrap the channel state and history in a batch, so that capable clients
+	// can present the whole burst as a unit:
+	rb := NewResponseBuffer(session)
+	var batchID string
+	if session.capabilities.Has(caps.Batch) {
+		batchID = rb.StartNestedBatch(caps.ReattachBatchType)
+	}
 	for _, channel := range session.client.Channels() {
-		channel.playJoinForSession(session)
-		// clients should receive autoreplay-on-join lines, if applicable:
-		if hasHistoryCaps {
-			continue
-		}
+		channel.addJoinForSession(rb)
+		// clients should receive autoreplay-on-join lines, if applicable.
 		// if they negotiated znc.in/playback or chathistory, they will receive nothing,
 		// because those caps disable autoreplay-on-join and they haven't sent the relevant
 		// *playback PRIVMSG or CHATHISTORY command yet
-		rb := NewResponseBuffer(session)
-		channel.autoReplayHistory(client, rb, "")
-		rb.Send(true)
+		if !hasHistoryCaps {
+			channel.autoReplayHistory(client, rb, "")
+		}
+		rb.Flush(true)
 	}
 	if !session.autoreplayMissedSince.IsZero() && !hasHistoryCaps {
-		rb := NewResponseBuffer(session)
 		zncPlayPrivmsgs(client, rb, "*", time.Now().UTC(), session.autoreplayMissedSince)
-		rb.Send(true)
 	}
+	rb.EndNestedBatch(batchID)
+	rb.Send(true)
 	session.autoreplayMissedSince = time.Time{}
 }
 
@@ -825,26 +959,16 @@ func (client *Client) updateIdleTimer(session *Session, now time.Time) {
 	session.lastTouch = now
 	session.pingSent = false
 
-	if session.idleTimer == nil {
-		pingTimeout := DefaultIdleTimeout
-		if session.isTor {
-			pingTimeout = TorIdleTimeout
-		}
-		session.idleTimer = time.AfterFunc(pingTimeout, session.handleIdleTimeout)
+	// puppets live as long as their bridge does
+	if session.idleTimer == nil && session.bridgeController == nil {
+		session.idleTimer = time.AfterFunc(session.idleTimeoutNoMutex(), session.handleIdleTimeout)
 	}
 }
 
 func (session *Session) handleIdleTimeout() {
-	totalTimeout := DefaultTotalTimeout
-	if session.capabilities.Has(caps.Resume) {
-		totalTimeout = ResumeableTotalTimeout
-	}
-	pingTimeout := DefaultIdleTimeout
-	if session.isTor {
-		pingTimeout = TorIdleTimeout
-	}
-
 	session.client.stateMutex.Lock()
+	pingTimeout := session.idleTimeoutNoMutex()
+	totalTimeout := session.totalTimeoutNoMutex()
 	now := time.Now()
 	timeUntilDestroy := session.lastTouch.Add(totalTimeout).Sub(now)
 	timeUntilPing := session.lastTouch.Add(pingTimeout).Sub(now)
@@ -875,6 +999,7 @@ func (session *Session) handleIdleTimeout() {
 	session.client.stateMutex.Unlock()
 
 	if shouldDestroy {
+		atomic.AddUint64(&session.client.server.reapStats.ping, 1)
 		session.client.Quit(fmt.Sprintf("Ping timeout: %v", totalTimeout), session)
 		session.client.destroy(session)
 	} else if shouldSendPing {
@@ -917,19 +1042,19 @@ func (session *Session) tryResume() (success bool) {
 
 	oldClient, oldResumeID := server.resumeManager.VerifyToken(client, session.resumeDetails.PresentedToken)
 	if oldClient == nil {
-		session.Send(nil, server.name, "FAIL", "RESUME", "INVALID_TOKEN", client.t("Cannot resume connection, token is not valid"))
+		session.Fail("RESUME", "INVALID_TOKEN", client.t("Cannot resume connection, token is not valid"))
 		return
 	}
 
 	resumeAllowed := config.Server.AllowPlaintextResume || (oldClient.HasMode(modes.TLS) && client.HasMode(modes.TLS))
 	if !resumeAllowed {
-		session.Send(nil, server.name, "FAIL", "RESUME", "INSECURE_SESSION", client.t("Cannot resume connection, old and new clients must have TLS"))
+		session.Fail("RESUME", "INSECURE_SESSION", client.t("Cannot resume connection, old and new clients must have TLS"))
 		return
 	}
 
 	err := server.clients.Resume(oldClient, session)
 	if err != nil {
-		session.Send(nil, server.name, "FAIL", "RESUME", "CANNOT_RESUME", client.t("Cannot resume connection"))
+		session.Fail("RESUME", "CANNOT_RESUME", client.t("Cannot resume connection"))
 		return
 	}
 
@@ -1021,9 +1146,9 @@ func (session *Session) playResume() {
 
 	if session.resumeDetails.HistoryIncomplete {
 		if !timestamp.IsZero() {
-			session.Send(nil, client.server.name, "WARN", "RESUME", "HISTORY_LOST", fmt.Sprintf(client.t("Resume may have lost up to %d seconds of history"), gapSeconds))
+			session.Warn("RESUME", "HISTORY_LOST", fmt.Sprintf(client.t("Resume may have lost up to %d seconds of history"), gapSeconds))
 		} else {
-			session.Send(nil, client.server.name, "WARN", "RESUME", "HISTORY_LOST", client.t("Resume may have lost some message history"))
+			session.Warn("RESUME", "HISTORY_LOST", client.t("Resume may have lost some message history"))
 		}
 	}
 
@@ -1094,6 +1219,9 @@ func (client *Client) replayPrivmsgHistory(rb *ResponseBuffer, items []history.I
 		// incoming message if Params[0] (the recipient's nick) equals the client's nick:
 		if item.Params[0] == "" || item.Params[0] == nick {
 			rb.AddSplitMessageFromClient(item.Nick, item.AccountName, tags, command, nick, item.Message)
+		} else if isRoleplayItem(&item) {
+			// an outgoing roleplay message keeps its fake source
+			rb.AddSplitMessageFromClient(item.Nick, item.AccountName, tags, command, item.Params[0], item.Message)
 		} else {
 			// this message was sent *from* the client to another nick; the target is item.Params[0]
 			// substitute client's current nickmask in case client changed nick
@@ -1167,7 +1295,7 @@ func (client *Client) HasRoleCapabs(capabs ...string) bool {
 	}
 
 	for _, capab := range capabs {
-		if !oper.Class.Capabilities.Has(capab) {
+		if !oper.HasRoleCapab(capab) {
 			return false
 		}
 	}
@@ -1215,6 +1343,55 @@ func (client *Client) SetOper(oper *Oper) {
 	client.updateNickMaskNoMutex()
 }
 
+// setOperExpiration schedules the removal of the client's operator status
+// after `duration`, or cancels a scheduled removal if `duration` is 0.
+func (client *Client) setOperExpiration(duration time.Duration) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+
+	if client.operExpiration != nil {
+		client.operExpiration.Stop()
+		client.operExpiration = nil
+	}
+	client.operExpiresAt = time.Time{}
+	if duration > 0 {
+		client.operExpiresAt = time.Now().Add(duration)
+		client.operExpiration = time.AfterFunc(duration, client.expireOper)
+	}
+}
+
+// OperExpiresAt returns when the client's temporary operator status expires,
+// or the zero time if its status is permanent (or it isn't an operator).
+func (client *Client) OperExpiresAt() time.Time {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.operExpiresAt
+}
+
+// expireOper de-opers a client whose temporary operator status has expired
+func (client *Client) expireOper() {
+	client.stateMutex.Lock()
+	expired := !client.destroyed && client.oper != nil && !client.operExpiresAt.IsZero() &&
+		!time.Now().Before(client.operExpiresAt)
+	client.stateMutex.Unlock()
+	if !expired {
+		return
+	}
+
+	// pretend they sent /MODE $nick -o, but don't tell anyone else
+	changes := modes.ModeChanges{{Mode: modes.Operator, Op: modes.Remove}}
+	applied := ApplyUserModeChanges(client, changes, false, nil)
+	if len(applied) == 0 {
+		return
+	}
+	details := client.Details()
+	args := append([]string{details.nick}, applied.Strings()...)
+	for _, session := range client.Sessions() {
+		session.Send(nil, details.nickMask, "MODE", args...)
+		session.Send(nil, client.server.name, "NOTICE", details.nick, client.t("Your temporary operator status has expired"))
+	}
+}
+
 // XXX: CHGHOST requires prefix nickmask to have original hostname,
 // this is annoying to do correctly
 func (client *Client) sendChghost(oldNickMask string, vhost string) {
@@ -1288,6 +1465,27 @@ func (client *Client) updateNickMaskNoMutex() {
 	client.nickMaskCasefolded = fmt.Sprintf("%s!%s@%s", client.nickCasefolded, strings.ToLower(client.username), cfhostname)
 }
 
+// AlternateNickMaskCasefolded returns the client's casefolded nickmask with its
+// cloak computed from the other secret, during the grace period after a cloak
+// secret rotation; otherwise (or if the cloak isn't displayed), it returns "".
+func (client *Client) AlternateNickMaskCasefolded() string {
+	client.stateMutex.RLock()
+	nick := client.nickCasefolded
+	username := client.username
+	hostname := client.hostname
+	cloakedHostname := client.cloakedHostname
+	client.stateMutex.RUnlock()
+
+	if cloakedHostname == "" || hostname != cloakedHostname {
+		return ""
+	}
+	alternate := client.server.Config().Server.Cloaks.AlternateCloak(client.IP(), cloakedHostname)
+	if alternate == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s!%s@%s", nick, strings.ToLower(username), alternate)
+}
+
 // AllNickmasks returns all the possible nickmasks for the client.
 func (client *Client) AllNickmasks() (masks []string) {
 	client.stateMutex.RLock()
@@ -1311,6 +1509,11 @@ func (client *Client) AllNickmasks() (masks []string) {
 
 	if cloakedHostname != "" {
 		masks = append(masks, fmt.Sprintf("%s!%s@%s", nick, username, cloakedHostname))
+		// during the grace period after the cloak secret is rotated,
+		// bans on either the old or the new cloak should match
+		if alternate := client.server.Config().Server.Cloaks.AlternateCloak(client.IP(), cloakedHostname); alternate != "" {
+			masks = append(masks, fmt.Sprintf("%s!%s@%s", nick, username, alternate))
+		}
 	}
 
 	ipmask := fmt.Sprintf("%s!%s@%s", nick, username, client.IPString())
@@ -1343,7 +1546,10 @@ func (client *Client) Quit(message string, session *Session) {
 		errorMsgBytes, _ := errorMsg.LineBytesStrict(false, MaxLineLen)
 		finalData = append(finalData, errorMsgBytes...)
 
-		sess.socket.SetFinalData(finalData)
+		// a puppet's socket belongs to its bridge
+		if sess.bridgeController == nil {
+			sess.socket.SetFinalData(finalData)
+		}
 	}
 
 	client.stateMutex.Lock()
@@ -1432,8 +1638,9 @@ func (client *Client) destroy(session *Session) {
 		autoAway = true
 		client.autoAway = true
 		client.away = true
-		awayMessage = config.languageManager.Translate(client.languages, `User is currently disconnected`)
+		awayMessage = autoAwayMessage(config, client.languages)
 		client.awayMessage = awayMessage
+		client.setAutoDeaf(config)
 	}
 
 	if client.registrationTimer != nil {
@@ -1463,11 +1670,28 @@ func (client *Client) destroy(session *Session) {
 		client.Quit("", session)
 		quitMessage = session.quitMessage
 		session.SetDestroyed()
-		session.socket.Close()
 
 		// clean up monitor state
 		client.server.monitorManager.RemoveAll(session)
 
+		if controller := session.bridgeController; controller != nil {
+			// puppets share the bridge's socket and aren't subject to connection limits,
+			// but the bridge needs to know they're gone (e.g., if they were killed):
+			controller.bridge.remove(client)
+			if !controller.Destroyed() {
+				reason := quitMessage
+				if reason == "" {
+					reason = "Exited"
+				}
+				controller.Send(nil, client.server.name, "BRIDGE", "REMOVE", details.nick, reason)
+			}
+			continue
+		}
+		session.socket.Close()
+		if session.bridge != nil {
+			session.bridge.removePuppets(fmt.Sprintf("Bridge %s disconnected", session.bridge.name))
+		}
+
 		// remove from connection limits
 		var source string
 		if session.isTor {
@@ -1479,6 +1703,7 @@ func (client *Client) destroy(session *Session) {
 				ip = session.proxiedIP
 			}
 			client.server.connectionLimiter.RemoveClient(flatip.FromNetIP(ip))
+			session.releaseUnregistered()
 			source = ip.String()
 		}
 		client.server.logger.Info("connect-ip", fmt.Sprintf("disconnecting session of %s from %s", details.nick, source))
@@ -1499,6 +1724,8 @@ func (client *Client) destroy(session *Session) {
 		return
 	}
 
+	client.stopBlockedReport()
+
 	splitQuitMessage := utils.MakeMessage(quitMessage)
 	quitItem := history.Item{
 		Type:        history.Quit,
@@ -1537,8 +1764,11 @@ func (client *Client) destroy(session *Session) {
 	// clean up channels
 	// (note that if this is a reattach, client has no channels and therefore no friends)
 	friends := make(ClientSet)
-	channels = client.Channels()
-	for _, channel := range channels {
+	for _, channel := range client.Channels() {
+		// a member whose join was hidden by +D leaves no trace in history
+		if !channel.joinIsDelayed(client) {
+			channels = append(channels, channel)
+		}
 		for _, member := range channel.auditoriumFriends(client) {
 			friends.Add(member)
 		}
@@ -1577,6 +1807,10 @@ func (client *Client) destroy(session *Session) {
 
 	if registered {
 		client.server.snomasks.Send(sno.LocalQuits, fmt.Sprintf(ircfmt.Unescape("%s$r exited the network"), details.nick))
+		client.server.webhooks.Send(WebhookDisconnect, webhookData{
+			"client": webhookClientData(client, details),
+			"reason": quitMessage,
+		})
 	}
 }
 
@@ -1587,7 +1821,18 @@ func (session *Session) sendSplitMsgFromClientInternal(blocking bool, nickmask,
 		session.sendFromClientInternal(blocking, message.Time, message.Msgid, nickmask, accountName, tags, command, target, message.Message)
 	} else {
 		if session.capabilities.Has(caps.Multiline) {
-			for _, msg := range composeMultilineBatch(session.generateBatchID(), nickmask, accountName, tags, command, target, message) {
+			batch := composeMultilineBatch(session.generateBatchID(), nickmask, accountName, tags, command, target, message)
+			if session.bridgeController != nil {
+				// the BATCH lines don't name the recipient, so a puppet's multiline
+				// batch is forwarded (or not) as a whole, based on its first message:
+				if 1 < len(batch) && session.shouldForward(&batch[1]) {
+					for _, msg := range batch {
+						session.relayToBridge(msg, blocking)
+					}
+				}
+				return
+			}
+			for _, msg := range batch {
 				session.SendRawMessage(msg, blocking)
 			}
 		} else {
@@ -1675,6 +1920,10 @@ var (
 
 // SendRawMessage sends a raw message to the client.
 func (session *Session) SendRawMessage(message ircmsg.IrcMessage, blocking bool) error {
+	if session.bridgeController != nil {
+		return session.forwardToBridge(message, blocking)
+	}
+
 	// use dumb hack to force the last param to be a trailing param if required
 	config := session.client.server.Config()
 	if config.Server.Compatibility.forceTrailing && commandsThatMustUseTrailing[message.Command] {
@@ -1704,7 +1953,7 @@ func (session *Session) SendRawMessage(message ircmsg.IrcMessage, blocking bool)
 
 func (session *Session) sendBytes(line []byte, blocking bool) (err error) {
 	if session.client.server.logger.IsLoggingRawIO() {
-		logline := string(line[:len(line)-2]) // strip "\r\n"
+		logline := redactRawLine(string(line[:len(line)-2]), true, nil) // strip "\r\n"
 		session.client.server.logger.Debug("useroutput", session.client.Nick(), " ->", logline)
 	}
 
@@ -1763,7 +2012,7 @@ func (client *Client) addChannel(channel *Channel, simulated bool) (err error) {
 	alwaysOn := client.alwaysOn
 	if client.destroyed {
 		err = errClientDestroyed
-	} else if client.oper == nil && len(client.channels) >= config.Channels.MaxChannelsPerClient {
+	} else if client.oper == nil && len(client.channels) >= client.maxChannelsNoMutex(config) {
 		err = errTooManyChannels
 	} else {
 		client.channels[channel] = empty{} // success
@@ -1842,9 +2091,9 @@ func (client *Client) attemptAutoOper(session *Session) {
 		return
 	}
 	for _, oper := range client.server.Config().operators {
-		if oper.Auto && oper.Pass == nil && oper.Certfp != "" && oper.Certfp == session.certfp {
+		if oper.Auto && oper.Pass == nil && oper.PublicKey == nil && oper.Certfp != "" && oper.Certfp == session.certfp {
 			rb := NewResponseBuffer(session)
-			applyOper(client, oper, rb)
+			applyOper(client, oper, oper.Duration, rb)
 			rb.Send(true)
 			return
 		}
@@ -1857,6 +2106,66 @@ func (client *Client) checkLoginThrottle() (throttled bool, remainingTime time.D
 	return client.loginThrottle.Touch()
 }
 
+// checkDefconJoinThrottle returns whether a JOIN must be refused because of
+// the join throttle imposed at DEFCON 3 and below
+func (client *Client) checkDefconJoinThrottle() (throttled bool) {
+	if client.server.Defcon() > 3 || client.HasRoleCapabs("chanreg") {
+		return false
+	}
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if client.joinThrottle.Limit == 0 {
+		client.joinThrottle.Duration = defconJoinWindow
+		client.joinThrottle.Limit = defconJoinLimit
+	}
+	throttled, _ = client.joinThrottle.Touch()
+	return
+}
+
+// checkNickThrottle returns whether a nick change must be refused because of
+// the limit on how often clients can change their nicknames
+func (client *Client) checkNickThrottle(config *Config) (throttled bool, remainingTime time.Duration) {
+	if client.HasMode(modes.Operator) {
+		return
+	}
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	// pick up any change to the limit from a rehash:
+	client.nickThrottle.Duration = config.Limits.NickChanges.Window
+	client.nickThrottle.Limit = config.Limits.NickChanges.MaxChanges
+	return client.nickThrottle.Touch()
+}
+
+func (client *Client) checkAnnounceThrottle(config *Config) (throttled bool, remainingTime time.Duration) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	client.announceThrottle.Duration = config.Limits.Announcements.Window
+	client.announceThrottle.Limit = config.Limits.Announcements.MaxAnnouncements
+	return client.announceThrottle.Touch()
+}
+
+// reserveChathistory checks how many of the `limit` messages requested by a
+// CHATHISTORY query the client may retrieve under the per-minute limit;
+// if none, it returns the time until more can be retrieved.
+func (client *Client) reserveChathistory(config *Config, limit int) (granted int, remainingTime time.Duration) {
+	if client.HasMode(modes.Operator) {
+		return limit, 0
+	}
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	client.chathistoryThrottle.Duration = chathistoryThrottleWindow
+	client.chathistoryThrottle.Limit = config.History.ChathistoryMaxPerMinute
+	return client.chathistoryThrottle.Reserve(limit)
+}
+
+// releaseChathistory gives back the part of a reservation that wasn't used,
+// because the query returned fewer messages than it could have.
+func (client *Client) releaseChathistory(unused int) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	client.chathistoryThrottle.Release(unused)
+}
+
 func (client *Client) historyStatus(config *Config) (status HistoryStatus, target string) {
 	if !config.History.Enabled {
 		return HistoryDisabled, ""
@@ -1889,6 +2198,10 @@ func (client *Client) addHistoryItem(target *Client, item history.Item, details,
 
 	cStatus, _ := client.historyStatus(config)
 	tStatus, _ := target.historyStatus(config)
+	// the author may have limited where their messages can be stored
+	authorLimit := client.AccountSettings().AuthoredHistory
+	cStatus = limitHistoryStatus(cStatus, authorLimit)
+	tStatus = limitHistoryStatus(tStatus, authorLimit)
 	// add to ephemeral history
 	if cStatus == HistoryEphemeral {
 		targetedItem.CfCorrespondent = tDetails.nickCasefolded
@@ -1900,13 +2213,20 @@ func (client *Client) addHistoryItem(target *Client, item history.Item, details,
 	}
 	if cStatus == HistoryPersistent || tStatus == HistoryPersistent {
 		targetedItem.CfCorrespondent = ""
-		client.server.historyDB.AddDirectMessage(details.nickCasefolded, details.account, tDetails.nickCasefolded, tDetails.account, targetedItem)
+		client.server.historyQueue.Enqueue(client.server, history.PersistentWrite{
+			Item:             targetedItem,
+			Sender:           details.nickCasefolded,
+			SenderAccount:    details.account,
+			Recipient:        tDetails.nickCasefolded,
+			RecipientAccount: tDetails.account,
+		})
 	}
 	return nil
 }
 
-func (client *Client) handleRegisterTimeout() {
-	client.Quit(fmt.Sprintf("Registration timeout: %v", RegisterTimeout), nil)
+func (client *Client) handleRegisterTimeout(timeout time.Duration) {
+	atomic.AddUint64(&client.server.reapStats.registration, 1)
+	client.Quit(fmt.Sprintf("Registration timeout: %v", timeout), nil)
 	client.destroy(nil)
 }
 
@@ -1948,8 +2268,11 @@ func (client *Client) wakeWriter() {
 
 func (client *Client) writeLoop() {
 	for {
-		client.performWrite(0)
+		err := client.performWrite(0)
 		client.writerSemaphore.Release()
+		if err == errReadOnly {
+			return // we'll be woken up again when read-only mode is disabled
+		}
 
 		client.stateMutex.RLock()
 		isDirty := client.dirtyBits != 0
@@ -1961,11 +2284,17 @@ func (client *Client) writeLoop() {
 	}
 }
 
-func (client *Client) performWrite(additionalDirtyBits uint) {
+func (client *Client) performWrite(additionalDirtyBits uint) (err error) {
 	client.stateMutex.Lock()
+	if client.server.ReadOnly() {
+		client.dirtyBits = client.dirtyBits | additionalDirtyBits
+		client.stateMutex.Unlock()
+		return errReadOnly
+	}
 	dirtyBits := client.dirtyBits | additionalDirtyBits
 	client.dirtyBits = 0
 	account := client.account
+	autoDeaf := client.autoDeaf
 	client.stateMutex.Unlock()
 
 	if account == "" {
@@ -1991,6 +2320,11 @@ func (client *Client) performWrite(additionalDirtyBits uint) {
 			switch m {
 			case modes.Operator, modes.ServerNotice:
 				// these can't be persisted because they depend on the operator block
+			case modes.UserDeaf:
+				// don't persist +D if auto-away set it; it's unset on reattach
+				if !autoDeaf && client.HasMode(m) {
+					uModes = append(uModes, m)
+				}
 			default:
 				if client.HasMode(m) {
 					uModes = append(uModes, m)
@@ -2002,6 +2336,7 @@ func (client *Client) performWrite(additionalDirtyBits uint) {
 	if (dirtyBits & IncludeRealname) != 0 {
 		client.server.accounts.saveRealname(account, client.realname)
 	}
+	return
 }
 
 // Blocking store; see Channel.Store and Socket.BlockingWrite
@@ -2018,6 +2353,5 @@ func (client *Client) Store(dirtyBits uint) (err error) {
 
 	client.writerSemaphore.Acquire()
 	defer client.writerSemaphore.Release()
-	client.performWrite(dirtyBits)
-	return nil
+	return client.performWrite(dirtyBits)
 }
@@ -7,47 +7,132 @@ package irc
 import (
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/oragono/oragono/irc/caps"
 	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/utils"
 )
 
-// ClientManager keeps track of clients by nick, enforcing uniqueness of casefolded nicks
+const (
+	// number of shards of the ClientManager; must be a power of 2
+	clientManagerShards = 64
+)
+
+// ClientManager keeps track of clients by nick, enforcing uniqueness of casefolded nicks.
+// To avoid lock contention with large numbers of clients, it is split into shards,
+// each with its own lock: the entries for a casefolded nick or a skeleton are
+// stored in the shard that the string hashes to. Operations that involve
+// several shards (e.g., a nick change) lock them in increasing order.
 type ClientManager struct {
+	shards [clientManagerShards]clientShard
+	count  int64 // number of clients, accessed atomically
+}
+
+type clientShard struct {
 	sync.RWMutex // tier 2
 	byNick       map[string]*Client
 	bySkeleton   map[string]*Client
+	// nicknames recently vacated by their owners, keyed by skeleton:
+	nickDelays map[string]nickDelay
+}
+
+// nickDelay holds a nickname for its owner's account after the owner quits.
+type nickDelay struct {
+	account string
+	expires time.Time
 }
 
 // Initialize initializes a ClientManager.
 func (clients *ClientManager) Initialize() {
-	clients.byNick = make(map[string]*Client)
-	clients.bySkeleton = make(map[string]*Client)
+	for i := range clients.shards {
+		shard := &clients.shards[i]
+		shard.byNick = make(map[string]*Client)
+		shard.bySkeleton = make(map[string]*Client)
+		shard.nickDelays = make(map[string]nickDelay)
+	}
+}
+
+// shardIndex returns the index of the shard for a casefolded nick or skeleton
+// (FNV-1a, inlined to avoid allocating)
+func shardIndex(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash & (clientManagerShards - 1))
+}
+
+func (clients *ClientManager) shard(key string) *clientShard {
+	return &clients.shards[shardIndex(key)]
+}
+
+// lockShards write-locks the shards for the given keys, in increasing order,
+// and returns a function that unlocks them again.
+func (clients *ClientManager) lockShards(keys ...string) (unlock func()) {
+	var locked [clientManagerShards]bool
+	for _, key := range keys {
+		locked[shardIndex(key)] = true
+	}
+	for i := range locked {
+		if locked[i] {
+			clients.shards[i].Lock()
+		}
+	}
+	return func() {
+		for i := range locked {
+			if locked[i] {
+				clients.shards[i].Unlock()
+			}
+		}
+	}
+}
+
+// lockClientShards locks the shards for the client's current nick and
+// skeleton, together with any others given, and returns the nick and skeleton.
+func (clients *ClientManager) lockClientShards(client *Client, keys ...string) (cfnick, skeleton string, unlock func()) {
+	for {
+		cfnick, skeleton = client.uniqueIdentifiers()
+		unlock = clients.lockShards(append(keys, cfnick, skeleton)...)
+		// the client may have changed nicks before we acquired the locks:
+		if currentCfnick, currentSkeleton := client.uniqueIdentifiers(); currentCfnick == cfnick && currentSkeleton == skeleton {
+			return
+		}
+		unlock()
+	}
 }
 
 // Get retrieves a client from the manager, if they exist.
 func (clients *ClientManager) Get(nick string) *Client {
 	casefoldedName, err := CasefoldName(nick)
 	if err == nil {
-		clients.RLock()
-		defer clients.RUnlock()
-		cli := clients.byNick[casefoldedName]
+		shard := clients.shard(casefoldedName)
+		shard.RLock()
+		defer shard.RUnlock()
+		cli := shard.byNick[casefoldedName]
 		return cli
 	}
 	return nil
 }
 
+// Count returns the number of clients.
+func (clients *ClientManager) Count() int {
+	return int(atomic.LoadInt64(&clients.count))
+}
+
 func (clients *ClientManager) removeInternal(client *Client, oldcfnick, oldskeleton string) (err error) {
-	// requires holding the writable Lock()
+	// requires holding the writable Lock() of both shards
 	if oldcfnick == "*" || oldcfnick == "" {
 		return errNickMissing
 	}
 
-	currentEntry, present := clients.byNick[oldcfnick]
+	nickShard := clients.shard(oldcfnick)
+	currentEntry, present := nickShard.byNick[oldcfnick]
 	if present {
 		if currentEntry == client {
-			delete(clients.byNick, oldcfnick)
+			delete(nickShard.byNick, oldcfnick)
+			atomic.AddInt64(&clients.count, -1)
 		} else {
 			// this shouldn't happen, but we can ignore it
 			client.server.logger.Warning("internal", "clients for nick out of sync", oldcfnick)
@@ -57,10 +142,11 @@ func (clients *ClientManager) removeInternal(client *Client, oldcfnick, oldskele
 		err = errNickMissing
 	}
 
-	currentEntry, present = clients.bySkeleton[oldskeleton]
+	skeletonShard := clients.shard(oldskeleton)
+	currentEntry, present = skeletonShard.bySkeleton[oldskeleton]
 	if present {
 		if currentEntry == client {
-			delete(clients.bySkeleton, oldskeleton)
+			delete(skeletonShard.bySkeleton, oldskeleton)
 		} else {
 			client.server.logger.Warning("internal", "clients for skeleton out of sync", oldskeleton)
 			err = errNickMissing
@@ -72,24 +158,55 @@ func (clients *ClientManager) removeInternal(client *Client, oldcfnick, oldskele
 	return
 }
 
-// Remove removes a client from the lookup set.
+// Remove removes a client from the lookup set. If the client is quitting from
+// a nickname owned by its account, the nickname is held for the account for
+// the configured nick delay.
 func (clients *ClientManager) Remove(client *Client) error {
-	clients.Lock()
-	defer clients.Unlock()
+	details := client.Details()
+	var delayUntil time.Time
+	if delay := client.server.Config().Accounts.NickReservation.NickDelay; delay != 0 &&
+		details.account != "" && client.server.accounts.NickToAccount(details.nick) == details.account {
+		delayUntil = time.Now().UTC().Add(delay)
+	}
+
+	oldcfnick, oldskeleton, unlock := clients.lockClientShards(client)
+	defer unlock()
+
+	err := clients.removeInternal(client, oldcfnick, oldskeleton)
+	if err == nil && !delayUntil.IsZero() {
+		shard := clients.shard(oldskeleton)
+		shard.pruneNickDelays()
+		shard.nickDelays[oldskeleton] = nickDelay{account: details.account, expires: delayUntil}
+	}
+	return err
+}
+
+// pruneNickDelays removes expired nick delays; it requires holding the writable Lock()
+func (shard *clientShard) pruneNickDelays() {
+	now := time.Now().UTC()
+	for skeleton, delay := range shard.nickDelays {
+		if now.After(delay.expires) {
+			delete(shard.nickDelays, skeleton)
+		}
+	}
+}
 
-	oldcfnick, oldskeleton := client.uniqueIdentifiers()
-	return clients.removeInternal(client, oldcfnick, oldskeleton)
+// nickIsDelayed returns whether a nick delay prevents `account` from using
+// the nickname with `skeleton`; it requires holding the Lock() of the
+// skeleton's shard
+func (clients *ClientManager) nickIsDelayed(skeleton, account string) bool {
+	delay, ok := clients.shard(skeleton).nickDelays[skeleton]
+	return ok && delay.account != account && time.Now().UTC().Before(delay.expires)
 }
 
 // Handles a RESUME by attaching a session to a designated client. It is the
 // caller's responsibility to verify that the resume is allowed (checking tokens,
 // TLS status, etc.) before calling this.
 func (clients *ClientManager) Resume(oldClient *Client, session *Session) (err error) {
-	clients.Lock()
-	defer clients.Unlock()
+	cfnick, _, unlock := clients.lockClientShards(oldClient)
+	defer unlock()
 
-	cfnick := oldClient.NickCasefolded()
-	if _, ok := clients.byNick[cfnick]; !ok {
+	if _, ok := clients.shard(cfnick).byNick[cfnick]; !ok {
 		return errNickMissing
 	}
 
@@ -119,7 +236,7 @@ func (clients *ClientManager) SetNick(client *Client, session *Session, newNick
 
 	// recompute always-on status, because client.alwaysOn is not set for unregistered clients
 	var alwaysOn, useAccountName bool
-	if account != "" {
+	if account != "" && client.bridge == "" {
 		alwaysOn = persistenceEnabled(config.Accounts.Multiclient.AlwaysOn, settings.AlwaysOn)
 		useAccountName = alwaysOn || config.Accounts.NickReservation.ForceNickEqualsAccount
 	}
@@ -169,7 +286,7 @@ func (clients *ClientManager) SetNick(client *Client, session *Session, newNick
 			return "", errNicknameInvalid, false
 		}
 
-		if restrictedCasefoldedNicks.Has(newCfNick) || restrictedSkeletons.Has(newSkeleton) {
+		if config.isRestrictedNick(newCfNick, newSkeleton) {
 			return "", errNicknameInvalid, false
 		}
 
@@ -177,6 +294,15 @@ func (clients *ClientManager) SetNick(client *Client, session *Session, newNick
 		if method == NickEnforcementStrict && reservedAccount != "" && reservedAccount != account {
 			return "", errNicknameReserved, false
 		}
+
+		// opers with accreg may need to take such a nickname, e.g., to investigate impersonation
+		if config.Accounts.NickReservation.Enabled && config.Accounts.NickReservation.ForbidConfusableNicks &&
+			!client.HasRoleCapabs("accreg") {
+			confusable := client.server.accounts.ConfusableAccount(newCfNick, newSkeleton)
+			if confusable != "" && confusable != account {
+				return "", errNicknameReserved, false
+			}
+		}
 	}
 
 	var bouncerAllowed bool
@@ -192,10 +318,14 @@ func (clients *ClientManager) SetNick(client *Client, session *Session, newNick
 		}
 	}
 
-	clients.Lock()
-	defer clients.Unlock()
+	formercfnick, formerskeleton, unlock := clients.lockClientShards(client, newCfNick, newSkeleton)
+	defer unlock()
+
+	if clients.nickIsDelayed(newSkeleton, account) {
+		return "", errNicknameReserved, false
+	}
 
-	currentClient := clients.byNick[newCfNick]
+	currentClient := clients.shard(newCfNick).byNick[newCfNick]
 	// the client may just be changing case
 	if currentClient != nil && currentClient != client {
 		// these conditions forbid reattaching to an existing session:
@@ -232,7 +362,7 @@ func (clients *ClientManager) SetNick(client *Client, session *Session, newNick
 		return "", errNoop, false
 	}
 	// analogous checks for skeletons
-	skeletonHolder := clients.bySkeleton[newSkeleton]
+	skeletonHolder := clients.shard(newSkeleton).bySkeleton[newSkeleton]
 	if skeletonHolder != nil && skeletonHolder != client {
 		return "", errNicknameInUse, false
 	}
@@ -241,43 +371,47 @@ func (clients *ClientManager) SetNick(client *Client, session *Session, newNick
 		return "", nil, false
 	}
 
-	formercfnick, formerskeleton := client.uniqueIdentifiers()
 	if changeSuccess := client.SetNick(newNick, newCfNick, newSkeleton); !changeSuccess {
 		return "", errClientDestroyed, false
 	}
 	clients.removeInternal(client, formercfnick, formerskeleton)
-	clients.byNick[newCfNick] = client
-	clients.bySkeleton[newSkeleton] = client
+	clients.shard(newCfNick).byNick[newCfNick] = client
+	clients.shard(newSkeleton).bySkeleton[newSkeleton] = client
+	atomic.AddInt64(&clients.count, 1)
 	return newNick, nil, false
 }
 
+// AllClients returns a snapshot of the list of clients. Where possible,
+// use Range instead, which doesn't need to copy the whole list.
 func (clients *ClientManager) AllClients() (result []*Client) {
-	clients.RLock()
-	defer clients.RUnlock()
-	result = make([]*Client, len(clients.byNick))
-	i := 0
-	for _, client := range clients.byNick {
-		result[i] = client
-		i++
-	}
+	result = make([]*Client, 0, clients.Count())
+	clients.Range(func(client *Client) bool {
+		result = append(result, client)
+		return true
+	})
 	return
 }
 
-// AllWithCapsNotify returns all clients with the given capabilities, and that support cap-notify.
-func (clients *ClientManager) AllWithCapsNotify(capabs ...caps.Capability) (sessions []*Session) {
-	capabs = append(capabs, caps.CapNotify)
-	clients.RLock()
-	defer clients.RUnlock()
-	for _, client := range clients.byNick {
-		for _, session := range client.Sessions() {
-			// cap-notify is implicit in cap version 302 and above
-			if session.capabilities.HasAll(capabs...) || 302 <= session.capVersion {
-				sessions = append(sessions, session)
+// Range calls f for each client, stopping if f returns false. The shards are
+// visited one at a time, and f is called without holding any locks, so it's
+// safe for f to call back into the ClientManager; clients that are added or
+// removed during the iteration may or may not be visited.
+func (clients *ClientManager) Range(f func(client *Client) bool) {
+	var buf []*Client
+	for i := range clients.shards {
+		shard := &clients.shards[i]
+		shard.RLock()
+		buf = buf[:0]
+		for _, client := range shard.byNick {
+			buf = append(buf, client)
+		}
+		shard.RUnlock()
+		for _, client := range buf {
+			if !f(client) {
+				return
 			}
 		}
 	}
-
-	return
 }
 
 // FindAll returns all clients that match the given userhost mask.
@@ -294,13 +428,12 @@ func (clients *ClientManager) FindAll(userhost string) (set ClientSet) {
 		return
 	}
 
-	clients.RLock()
-	defer clients.RUnlock()
-	for _, client := range clients.byNick {
+	clients.Range(func(client *Client) bool {
 		if matcher.MatchString(client.NickMaskCasefolded()) {
 			set.Add(client)
 		}
-	}
+		return true
+	})
 
 	return set
 }
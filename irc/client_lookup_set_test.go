@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newTestClientManager() *Server {
+	server := newTestServer()
+	server.Config().Limits.NickLen = 32
+	server.accounts.server = server
+	server.clients.Initialize()
+	return server
+}
+
+func addTestClients(t testing.TB, server *Server, count int) (result []*Client) {
+	result = make([]*Client, count)
+	var wg sync.WaitGroup
+	for i := range result {
+		result[i] = newTestClient(server, "*")
+		wg.Add(1)
+		go func(client *Client, nick string) {
+			defer wg.Done()
+			if _, err, _ := server.clients.SetNick(client, nil, nick, false); err != nil {
+				t.Errorf("couldn't set nick %s: %v", nick, err)
+			}
+		}(result[i], fmt.Sprintf("User%d", i))
+	}
+	wg.Wait()
+	return
+}
+
+func TestClientManager(t *testing.T) {
+	server := newTestClientManager()
+	clients := &server.clients
+	added := addTestClients(t, server, 1000)
+	assertEqual(clients.Count(), 1000, t)
+	assertEqual(len(clients.AllClients()), 1000, t)
+	assertEqual(clients.Get("user123"), added[123], t)
+	assertEqual(clients.Get("USER123"), added[123], t)
+
+	// nicks and skeletons remain unique:
+	if _, err, _ := clients.SetNick(added[0], nil, "user1", false); err != errNicknameInUse {
+		t.Errorf("expected nick collision, got %v", err)
+	}
+	if _, err, _ := clients.SetNick(added[0], nil, "userl", false); err != errNicknameInUse {
+		t.Errorf("expected skeleton collision, got %v", err)
+	}
+
+	// concurrent nick changes (each moving between shards) and removals:
+	var wg sync.WaitGroup
+	for i, client := range added {
+		wg.Add(1)
+		go func(i int, client *Client) {
+			defer wg.Done()
+			if i%2 == 0 {
+				clients.Remove(client)
+			} else {
+				clients.SetNick(client, nil, fmt.Sprintf("renamed%d", i), false)
+			}
+		}(i, client)
+	}
+	wg.Wait()
+	assertEqual(clients.Count(), 500, t)
+	assertEqual(clients.Get("user1"), (*Client)(nil), t)
+	assertEqual(clients.Get("renamed1"), added[1], t)
+	assertEqual(clients.Get("renamed2"), (*Client)(nil), t)
+	// the old nick is free again:
+	if _, err, _ := clients.SetNick(added[3], nil, "User1", false); err != nil {
+		t.Error(err)
+	}
+
+	visited := 0
+	clients.Range(func(client *Client) bool {
+		visited++
+		return visited < 10
+	})
+	assertEqual(visited, 10, t)
+}
+
+const benchmarkClients = 50000
+
+func BenchmarkClientManagerGet(b *testing.B) {
+	server := newTestClientManager()
+	addTestClients(b, server, benchmarkClients)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			server.clients.Get(fmt.Sprintf("user%d", i%benchmarkClients))
+			i++
+		}
+	})
+}
+
+func BenchmarkClientManagerSetNick(b *testing.B) {
+	server := newTestClientManager()
+	added := addTestClients(b, server, benchmarkClients)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			client := added[i%benchmarkClients]
+			server.clients.SetNick(client, nil, fmt.Sprintf("nick%d-%d", i%benchmarkClients, i), false)
+			i++
+		}
+	})
+}
+
+func BenchmarkClientManagerRange(b *testing.B) {
+	server := newTestClientManager()
+	addTestClients(b, server, benchmarkClients)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		server.clients.Range(func(client *Client) bool {
+			return true
+		})
+	}
+}
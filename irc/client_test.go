@@ -5,7 +5,12 @@ package irc
 
 import (
 	"testing"
+	"time"
 
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/connection_limits"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/utils"
 )
 
@@ -88,3 +93,155 @@ func TestWhoFields(t *testing.T) {
 		t.Error("failed to set and get")
 	}
 }
+
+func TestMultilineBatchValidation(t *testing.T) {
+	server := newTestServer()
+	server.Config().Limits.Multiline.MaxBytes = 4096
+	client := newTestClient(server, "alice")
+	session := &Session{client: client}
+	rb := NewResponseBuffer(session)
+
+	absorb := func(command, target, line string) {
+		msg := ircmsg.MakeMessage(map[string]string{"batch": "b"}, "", command, target, line)
+		absorbBatchedMessage(server, client, msg, "b", history.Privmsg, rb)
+	}
+
+	session.StartMultilineBatch("b", "#test", "", nil)
+	absorb("PRIVMSG", "#test", "hello")
+	absorb("PRIVMSG", "#test", "world")
+	batch, err := session.EndMultilineBatch("b")
+	if err != nil || batch.message.LenLines() != 2 {
+		t.Errorf("valid batch was rejected: %v", err)
+	}
+
+	session.StartMultilineBatch("b", "#test", "", nil)
+	absorb("PRIVMSG", "#test", "hello")
+	absorb("PRIVMSG", "#other", "world")
+	if session.batch.label != "" {
+		t.Errorf("batch with mismatched targets was accepted")
+	}
+
+	session.StartMultilineBatch("b", "#test", "", nil)
+	absorb("PRIVMSG", "#test", "hello")
+	absorb("NOTICE", "#test", "world")
+	if session.batch.label != "" {
+		t.Errorf("batch with mixed commands was accepted")
+	}
+}
+
+func TestDefconJoinThrottle(t *testing.T) {
+	server := newTestServer()
+	client := newTestClient(server, "dan")
+
+	server.SetDefcon(5)
+	for i := 0; i < 2*defconJoinLimit; i++ {
+		if client.checkDefconJoinThrottle() {
+			t.Fatalf("joins should not be throttled at DEFCON 5")
+		}
+	}
+
+	server.SetDefcon(3)
+	for i := 0; i < defconJoinLimit; i++ {
+		if client.checkDefconJoinThrottle() {
+			t.Errorf("join %d should be allowed", i)
+		}
+	}
+	if !client.checkDefconJoinThrottle() {
+		t.Errorf("joins over the limit should be throttled at DEFCON 3")
+	}
+}
+
+func TestAnnounceThrottle(t *testing.T) {
+	server := newTestServer()
+	config := server.Config()
+	client := newTestClient(server, "dan")
+
+	for i := 0; i < 10; i++ {
+		if throttled, _ := client.checkAnnounceThrottle(config); throttled {
+			t.Fatalf("announcements should not be throttled without a limit")
+		}
+	}
+
+	config.Limits.Announcements.Window = time.Hour
+	config.Limits.Announcements.MaxAnnouncements = 2
+	client.announceThrottle = connection_limits.GenericThrottle{}
+	for i := 0; i < 2; i++ {
+		if throttled, _ := client.checkAnnounceThrottle(config); throttled {
+			t.Errorf("announcement %d should be allowed", i)
+		}
+	}
+	throttled, remaining := client.checkAnnounceThrottle(config)
+	assertEqual(throttled, true, t)
+	if remaining <= 0 || remaining > time.Hour {
+		t.Errorf("unexpected remaining time %v", remaining)
+	}
+}
+
+func TestNickDelay(t *testing.T) {
+	var clients ClientManager
+	clients.Initialize()
+
+	clients.shard("shivaram").nickDelays["shivaram"] = nickDelay{account: "shivaram", expires: time.Now().UTC().Add(time.Minute)}
+	clients.shard("dan").nickDelays["dan"] = nickDelay{account: "dan", expires: time.Now().UTC().Add(-time.Second)}
+
+	assertEqual(clients.nickIsDelayed("shivaram", ""), true, t)
+	assertEqual(clients.nickIsDelayed("shivaram", "slingamn"), true, t)
+	assertEqual(clients.nickIsDelayed("shivaram", "shivaram"), false, t)
+	assertEqual(clients.nickIsDelayed("dan", ""), false, t)
+	assertEqual(clients.nickIsDelayed("slingamn", ""), false, t)
+
+	remaining := 0
+	for i := range clients.shards {
+		clients.shards[i].pruneNickDelays()
+		remaining += len(clients.shards[i].nickDelays)
+	}
+	assertEqual(remaining, 1, t)
+}
+
+func TestOperExpiration(t *testing.T) {
+	server := newTestServer()
+	client := newTestClient(server, "dan")
+
+	client.setOperExpiration(time.Hour)
+	expiresAt := client.OperExpiresAt()
+	if time.Until(expiresAt) <= 59*time.Minute {
+		t.Errorf("unexpected expiration time %v", expiresAt)
+	}
+	// a non-operator has nothing to expire:
+	client.operExpiresAt = time.Now().Add(-time.Second)
+	client.expireOper()
+
+	// re-granting replaces the pending expiration, and de-opering cancels it:
+	client.setOperExpiration(time.Hour)
+	client.setOperExpiration(0)
+	assertEqual(client.OperExpiresAt().IsZero(), true, t)
+	assertEqual(client.operExpiration == nil, true, t)
+}
+
+func TestWhoisPrivacy(t *testing.T) {
+	server := newTestServer()
+	alice := newTestClient(server, "alice")
+	bob := newTestClient(server, "bob")
+	carol := newTestClient(server, "carol")
+	shared := newTestChannel(server, "#shared")
+	other := newTestChannel(server, "#other")
+	addTestMember(shared, alice, 0)
+	addTestMember(shared, bob, 0)
+	addTestMember(other, alice, 0)
+	alice.channels = ChannelSet{shared: empty{}, other: empty{}}
+	bob.channels = ChannelSet{shared: empty{}}
+
+	assertEqual(len(bob.WhoisChannelsNames(alice, false, false)), 2, t)
+	alice.SetAccountSettings(AccountSettings{HideChannels: true, HideIdle: true})
+	privacy := bob.whoisPrivacy(alice)
+	assertEqual(privacy.HideChannels, true, t)
+	assertEqual(privacy.HideIdle, true, t)
+	assertEqual(privacy.HideTLS, false, t)
+	assertEqual(bob.WhoisChannelsNames(alice, false, privacy.HideChannels), []string{"#shared"}, t)
+	assertEqual(len(carol.WhoisChannelsNames(alice, false, carol.whoisPrivacy(alice).HideChannels)), 0, t)
+
+	// the settings don't apply to yourself or to opers:
+	assertEqual(alice.whoisPrivacy(alice).HideIdle, false, t)
+	carol.modes.SetMode(modes.Operator, true)
+	assertEqual(carol.whoisPrivacy(alice).HideIdle, false, t)
+}
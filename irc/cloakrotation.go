@@ -0,0 +1,75 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"time"
+
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// loadCloakSecrets loads the cloak secrets from the datastore into the config,
+// then schedules the next automatic rotation of the secret and/or the end of
+// the current grace period. It runs during (re)hash, before SetConfig.
+func (server *Server) loadCloakSecrets(config *Config) {
+	cloakConfig := &config.Server.Cloaks
+	secret, previous, rotated := LoadCloakSecrets(server.store)
+	interval := time.Duration(cloakConfig.Rotation.Interval)
+	grace := time.Duration(cloakConfig.Rotation.GracePeriod)
+	now := time.Now().UTC()
+
+	if interval != 0 && rotated.IsZero() {
+		// start the clock for the first rotation, without changing the secret
+		StoreCloakSecret(server.store, secret)
+		rotated = now
+	}
+
+	cloakConfig.SetSecret(secret)
+	graceEnd := rotated.Add(grace)
+	if previous != "" && now.Before(graceEnd) {
+		cloakConfig.SetPreviousSecret(previous)
+	} else {
+		graceEnd = time.Time{}
+	}
+
+	var next time.Time
+	if interval != 0 {
+		next = rotated.Add(interval)
+	}
+	if !graceEnd.IsZero() && (next.IsZero() || graceEnd.Before(next)) {
+		next = graceEnd
+	}
+
+	if server.cloakRotation != nil {
+		server.cloakRotation.Stop()
+		server.cloakRotation = nil
+	}
+	if !next.IsZero() {
+		// if a rotation came due while the server was down, don't rehash
+		// while startup is still in progress
+		delay := next.Sub(now)
+		if delay < time.Minute {
+			delay = time.Minute
+		}
+		server.cloakRotation = time.AfterFunc(delay, server.cloakRotationTimeout)
+	}
+}
+
+// cloakRotationTimeout rotates the cloak secret if it's due, then rehashes
+// to apply the new secret (or to discard the previous one, at the end of the
+// grace period); the rehash schedules the next timeout.
+func (server *Server) cloakRotationTimeout() {
+	config := server.Config()
+	interval := time.Duration(config.Server.Cloaks.Rotation.Interval)
+	_, _, rotated := LoadCloakSecrets(server.store)
+	if interval != 0 && !time.Now().Before(rotated.Add(interval)) {
+		StoreCloakSecret(server.store, utils.GenerateSecretKey())
+		server.logger.Info("server", "Rotated the cloak secret")
+		server.snomasks.Send(sno.LocalAnnouncements, "Rotated the cloak secret; new connections will receive new cloaks")
+	}
+	if err := server.rehash(); err != nil {
+		server.snomasks.Send(sno.LocalAnnouncements, "Couldn't apply the rotated cloak secret; rehash failed")
+	}
+}
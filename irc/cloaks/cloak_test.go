@@ -96,6 +96,28 @@ func TestCloakDisabled(t *testing.T) {
 	assertEqual(config.ComputeCloak(v4ip), "", t)
 }
 
+func TestAlternateCloak(t *testing.T) {
+	config := cloakConfForTesting()
+	v4ip := easyParseIP("8.8.8.8").To4()
+	oldCloak := config.ComputeCloak(v4ip)
+
+	// no rotation, no alternate cloak
+	assertEqual(config.AlternateCloak(v4ip, oldCloak), "", t)
+
+	config.SetPreviousSecret(config.secret)
+	config.SetSecret("HJcXK4lLawxBE4-9SIdPji_21YiL3N5r5f5-SPNrGVY")
+	newCloak := config.ComputeCloak(v4ip)
+	assertEqual(newCloak, "4khy3usk8mfu42pe.oragono", t)
+	assertEqual(config.AlternateCloak(v4ip, oldCloak), newCloak, t)
+	assertEqual(config.AlternateCloak(v4ip, newCloak), oldCloak, t)
+	// unrelated hostnames (e.g., account cloaks) have no alternate
+	assertEqual(config.AlternateCloak(v4ip, "8yu8kunudb45ztxm.oragono"), "", t)
+
+	// grace period is over
+	config.SetPreviousSecret("")
+	assertEqual(config.AlternateCloak(v4ip, oldCloak), "", t)
+}
+
 func BenchmarkCloaks(b *testing.B) {
 	config := cloakConfForTesting()
 	v6ip := easyParseIP("2001:0db8::1")
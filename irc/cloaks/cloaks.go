@@ -8,6 +8,7 @@ import (
 
 	"golang.org/x/crypto/sha3"
 
+	"github.com/oragono/oragono/irc/custime"
 	"github.com/oragono/oragono/irc/utils"
 )
 
@@ -19,11 +20,16 @@ type CloakConfig struct {
 	CidrLenIPv6        int    `yaml:"cidr-len-ipv6"`
 	NumBits            int    `yaml:"num-bits"`
 	LegacySecretValue  string `yaml:"secret"`
+	Rotation           struct {
+		Interval    custime.Duration
+		GracePeriod custime.Duration `yaml:"grace-period"`
+	}
 
-	secret   string
-	numBytes int
-	ipv4Mask net.IPMask
-	ipv6Mask net.IPMask
+	secret         string
+	previousSecret string
+	numBytes       int
+	ipv4Mask       net.IPMask
+	ipv6Mask       net.IPMask
 }
 
 func (cloakConfig *CloakConfig) Initialize() {
@@ -49,6 +55,12 @@ func (cloakConfig *CloakConfig) SetSecret(secret string) {
 	cloakConfig.secret = secret
 }
 
+// SetPreviousSecret sets the secret that was in use before the most recent
+// rotation; it should only be set during the grace period after the rotation.
+func (cloakConfig *CloakConfig) SetPreviousSecret(secret string) {
+	cloakConfig.previousSecret = secret
+}
+
 // simple cloaking algorithm: normalize the IP to its CIDR,
 // then hash the resulting bytes with a secret key,
 // then truncate to the desired length, b32encode, and append the fake TLD.
@@ -58,23 +70,43 @@ func (config *CloakConfig) ComputeCloak(ip net.IP) string {
 	} else if config.NumBits == 0 || config.secret == "" {
 		return config.Netname
 	}
+	return config.macAndCompose(config.secret, config.maskIP(ip))
+}
+
+// AlternateCloak supports the grace period after a rotation of the secret: if
+// `cloak` is the IP's cloak under either the current or the previous secret,
+// it returns the IP's cloak under the other one. Otherwise, it returns "".
+func (config *CloakConfig) AlternateCloak(ip net.IP, cloak string) string {
+	if !config.Enabled || config.NumBits == 0 || config.secret == "" || config.previousSecret == "" {
+		return ""
+	}
+	masked := config.maskIP(ip)
+	current := config.macAndCompose(config.secret, masked)
+	previous := config.macAndCompose(config.previousSecret, masked)
+	switch cloak {
+	case current:
+		return previous
+	case previous:
+		return current
+	default:
+		return ""
+	}
+}
 
-	var masked net.IP
+func (config *CloakConfig) maskIP(ip net.IP) net.IP {
 	v4ip := ip.To4()
 	if v4ip != nil {
-		masked = v4ip.Mask(config.ipv4Mask)
-	} else {
-		masked = ip.Mask(config.ipv6Mask)
+		return v4ip.Mask(config.ipv4Mask)
 	}
-	return config.macAndCompose(masked)
+	return ip.Mask(config.ipv6Mask)
 }
 
-func (config *CloakConfig) macAndCompose(b []byte) string {
+func (config *CloakConfig) macAndCompose(secret string, b []byte) string {
 	// SHA3(K || M):
 	// https://crypto.stackexchange.com/questions/17735/is-hmac-needed-for-a-sha-3-based-mac
-	input := make([]byte, len(config.secret)+len(b))
-	copy(input, config.secret[:])
-	copy(input[len(config.secret):], b)
+	input := make([]byte, len(secret)+len(b))
+	copy(input, secret[:])
+	copy(input[len(secret):], b)
 	digest := sha3.Sum512(input)
 	b32digest := utils.B32Encoder.EncodeToString(digest[:config.numBytes])
 	return fmt.Sprintf("%s.%s", b32digest, config.Netname)
@@ -91,5 +123,5 @@ func (config *CloakConfig) ComputeAccountCloak(accountName string) string {
 	// with a masked IP that could be an input to ComputeCloak:
 	paddedAccountName := make([]byte, 16+len(accountName))
 	copy(paddedAccountName[16:], accountName[:])
-	return config.macAndCompose(paddedAccountName)
+	return config.macAndCompose(config.secret, paddedAccountName)
 }
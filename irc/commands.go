@@ -7,6 +7,7 @@ package irc
 
 import (
 	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/oragono/oragono/irc/caps"
 	"github.com/oragono/oragono/irc/modes"
 )
 
@@ -16,6 +17,7 @@ type Command struct {
 	oper           bool
 	usablePreReg   bool
 	allowedInBatch bool // allowed in client-to-server batches
+	modifiesState  bool // rejected while the server is in read-only mode
 	minParams      int
 	capabs         []string
 }
@@ -29,23 +31,30 @@ func (cmd *Command) Run(server *Server, client *Client, session *Session, msg ir
 		defer rb.Send(true)
 
 		if !client.registered && !cmd.usablePreReg {
-			rb.Add(nil, server.name, ERR_NOTREGISTERED, "*", client.t("You need to register before you can use that command"))
+			rb.FailNumeric(ERR_NOTREGISTERED, msg.Command, "NOT_REGISTERED", client.t("You need to register before you can use that command"))
 			return false
 		}
 		if cmd.oper && !client.HasMode(modes.Operator) {
-			rb.Add(nil, server.name, ERR_NOPRIVILEGES, client.Nick(), client.t("Permission Denied - You're not an IRC operator"))
+			rb.FailNumeric(ERR_NOPRIVILEGES, msg.Command, "NO_PRIVILEGES", client.t("Permission Denied - You're not an IRC operator"))
 			return false
 		}
 		if len(cmd.capabs) > 0 && !client.HasRoleCapabs(cmd.capabs...) {
-			rb.Add(nil, server.name, ERR_NOPRIVILEGES, client.Nick(), client.t("Permission Denied"))
+			rb.FailNumeric(ERR_NOPRIVILEGES, msg.Command, "NO_PRIVILEGES", client.t("Permission Denied"))
 			return false
 		}
 		if len(msg.Params) < cmd.minParams {
-			rb.Add(nil, server.name, ERR_NEEDMOREPARAMS, client.Nick(), msg.Command, rb.target.t("Not enough parameters"))
+			if session.capabilities.Has(caps.StandardReplies) {
+				rb.Fail(msg.Command, "NEED_MORE_PARAMS", client.t("Not enough parameters"))
+			} else {
+				rb.Add(nil, server.name, ERR_NEEDMOREPARAMS, client.Nick(), msg.Command, client.t("Not enough parameters"))
+			}
+			return false
+		}
+		if cmd.modifiesState && rejectReadOnly(server, client, msg.Command, rb) {
 			return false
 		}
 		if session.batch.label != "" && !cmd.allowedInBatch {
-			rb.Add(nil, server.name, "FAIL", "BATCH", "MULTILINE_INVALID", client.t("Command not allowed during a multiline batch"))
+			rb.Fail("BATCH", "MULTILINE_INVALID", client.t("Command not allowed during a multiline batch"))
 			session.EndMultilineBatch("")
 			return false
 		}
@@ -85,6 +94,12 @@ func init() {
 			handler:   sceneHandler,
 			minParams: 2,
 		},
+		"ANNOUNCE": {
+			handler:   announceHandler,
+			minParams: 2,
+			oper:      true,
+			capabs:    []string{"announce"},
+		},
 		"AUTHENTICATE": {
 			handler:      authenticateHandler,
 			usablePreReg: true,
@@ -94,6 +109,15 @@ func init() {
 			handler:   awayHandler,
 			minParams: 0,
 		},
+		"BACKUP": {
+			handler: backupHandler,
+			capabs:  []string{"backup"},
+		},
+		"BANS": {
+			handler:   bansHandler,
+			minParams: 1,
+			capabs:    []string{"ban"},
+		},
 		"BATCH": {
 			handler:        batchHandler,
 			minParams:      1,
@@ -103,15 +127,28 @@ func init() {
 			handler:   brbHandler,
 			minParams: 0,
 		},
+		"BRIDGE": {
+			handler:   bridgeHandler,
+			minParams: 1,
+		},
 		"CAP": {
 			handler:      capHandler,
 			usablePreReg: true,
 			minParams:    1,
 		},
+		"CHALLENGE": {
+			handler:   challengeHandler,
+			minParams: 1,
+		},
 		"CHATHISTORY": {
 			handler:   chathistoryHandler,
 			minParams: 4,
 		},
+		"DEANONYMIZE": {
+			handler:   deanonymizeHandler,
+			minParams: 2,
+			capabs:    []string{"deanonymize"},
+		},
 		"DEBUG": {
 			handler:   debugHandler,
 			minParams: 1,
@@ -131,10 +168,19 @@ func init() {
 			minParams: 1,
 			oper:      true,
 		},
+		"DRAFTS": {
+			handler:   draftsHandler,
+			minParams: 1,
+		},
 		"EXTJWT": {
 			handler:   extjwtHandler,
 			minParams: 1,
 		},
+		"GRANTOPER": {
+			handler:   grantoperHandler,
+			minParams: 2,
+			capabs:    []string{"grantoper"},
+		},
 		"HELP": {
 			handler:   helpHandler,
 			minParams: 0,
@@ -170,7 +216,7 @@ func init() {
 			handler:   killHandler,
 			minParams: 1,
 			oper:      true,
-			capabs:    []string{"local_kill"}, //TODO(dan): when we have S2S, this will be checked in the command handler itself
+			capabs:    []string{"kill"}, //TODO(dan): when we have S2S, this will be checked in the command handler itself
 		},
 		"KLINE": {
 			handler:   klineHandler,
@@ -186,10 +232,18 @@ func init() {
 			handler:   listHandler,
 			minParams: 0,
 		},
+		"LISTMODE": {
+			handler:   listmodeHandler,
+			minParams: 2,
+		},
 		"LUSERS": {
 			handler:   lusersHandler,
 			minParams: 0,
 		},
+		"MAINTENANCE": {
+			handler: maintenanceHandler,
+			capabs:  []string{"maintenance"},
+		},
 		"MODE": {
 			handler:   modeHandler,
 			minParams: 1,
@@ -224,6 +278,11 @@ func init() {
 			handler:   npcaHandler,
 			minParams: 3,
 		},
+		"OJOIN": {
+			handler:   ojoinHandler,
+			minParams: 1,
+			capabs:    []string{"ojoin"},
+		},
 		"OPER": {
 			handler:   operHandler,
 			minParams: 1,
@@ -252,18 +311,33 @@ func init() {
 			minParams:      2,
 			allowedInBatch: true,
 		},
+		"REDACT": {
+			handler:       redactHandler,
+			minParams:     2,
+			modifiesState: true,
+		},
+		"RELATIONS": {
+			handler:   relationsHandler,
+			minParams: 3,
+		},
 		"RELAYMSG": {
 			handler:   relaymsgHandler,
 			minParams: 3,
 		},
+		"READONLY": {
+			handler: readonlyHandler,
+			capabs:  []string{"readonly"},
+		},
 		"REGISTER": {
-			handler:      registerHandler,
-			minParams:    2,
-			usablePreReg: true,
+			handler:       registerHandler,
+			minParams:     2,
+			usablePreReg:  true,
+			modifiesState: true,
 		},
 		"RENAME": {
-			handler:   renameHandler,
-			minParams: 2,
+			handler:       renameHandler,
+			minParams:     2,
+			modifiesState: true,
 		},
 		"RESUME": {
 			handler:      resumeHandler,
@@ -285,14 +359,27 @@ func init() {
 			minParams: 1,
 			capabs:    []string{"samode"},
 		},
+		"SAPART": {
+			handler:   sapartHandler,
+			minParams: 2,
+			capabs:    []string{"sapart"},
+		},
 		"SCENE": {
 			handler:   sceneHandler,
 			minParams: 2,
 		},
+		"SESSION": {
+			handler:      sessionHandler,
+			usablePreReg: true,
+			minParams:    1,
+		},
 		"SETNAME": {
 			handler:   setnameHandler,
 			minParams: 1,
 		},
+		"SILENCE": {
+			handler: silenceHandler,
+		},
 		"SUMMON": {
 			handler: summonHandler,
 		},
@@ -305,6 +392,10 @@ func init() {
 			usablePreReg: true,
 			minParams:    0,
 		},
+		"REMOVE": {
+			handler:   removeHandler,
+			minParams: 2,
+		},
 		"REHASH": {
 			handler:   rehashHandler,
 			minParams: 0,
@@ -315,23 +406,29 @@ func init() {
 			handler:   timeHandler,
 			minParams: 0,
 		},
+		"TIMEDMODE": {
+			handler:   timedmodeHandler,
+			minParams: 3,
+		},
 		"TOPIC": {
 			handler:   topicHandler,
 			minParams: 1,
 		},
 		"UNDLINE": {
-			handler:   unDLineHandler,
-			minParams: 1,
-			oper:      true,
+			handler:       unDLineHandler,
+			minParams:     1,
+			oper:          true,
+			modifiesState: true,
 		},
 		"UNINVITE": {
 			handler:   inviteHandler,
 			minParams: 2,
 		},
 		"UNKLINE": {
-			handler:   unKLineHandler,
-			minParams: 1,
-			oper:      true,
+			handler:       unKLineHandler,
+			minParams:     1,
+			oper:          true,
+			modifiesState: true,
 		},
 		"USER": {
 			handler:      userHandler,
@@ -346,9 +443,10 @@ func init() {
 			handler: usersHandler,
 		},
 		"VERIFY": {
-			handler:      verifyHandler,
-			usablePreReg: true,
-			minParams:    2,
+			handler:       verifyHandler,
+			usablePreReg:  true,
+			minParams:     2,
+			modifiesState: true,
 		},
 		"VERSION": {
 			handler:   versionHandler,
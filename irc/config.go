@@ -7,6 +7,7 @@ package irc
 
 import (
 	"bytes"
+	"crypto/rsa"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -17,6 +18,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -37,6 +39,7 @@ import (
 	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/mysql"
 	"github.com/oragono/oragono/irc/passwd"
+	"github.com/oragono/oragono/irc/postgresql"
 	"github.com/oragono/oragono/irc/utils"
 )
 
@@ -60,6 +63,24 @@ type listenerConfigBlock struct {
 	STSOnly   bool `yaml:"sts-only"`
 	WebSocket bool
 	HideSTS   bool `yaml:"hide-sts"`
+	// serve the built-in web client (websocket listeners only):
+	Webchat bool
+	// presentation overrides for clients connecting to this listener:
+	NetworkName  string   `yaml:"network-name"`
+	MOTD         string   `yaml:"motd"`
+	DisabledCaps []string `yaml:"disabled-caps"`
+	// replaces server.websockets.allowed-origins for this (websocket) listener:
+	AllowedOrigins []string `yaml:"allowed-origins"`
+	// type of a custom PROXY v2 TLV carrying the client certificate fingerprint:
+	ProxyCertfpTLV int `yaml:"proxy-certfp-tlv"`
+}
+
+// listenerOverrides is the processed form of a listener's presentation
+// overrides; fields that weren't overridden are zero.
+type listenerOverrides struct {
+	networkName   string
+	motdLines     []string
+	supportedCaps *caps.Set
 }
 
 type PersistentStatus uint
@@ -185,6 +206,20 @@ func historyStatusToString(status HistoryStatus) string {
 	}
 }
 
+// limitHistoryStatus applies an author's AuthoredHistory setting to the
+// status with which their message would otherwise be stored.
+func limitHistoryStatus(status, authorLimit HistoryStatus) HistoryStatus {
+	switch authorLimit {
+	case HistoryDisabled:
+		return HistoryDisabled
+	case HistoryEphemeral:
+		if status == HistoryPersistent {
+			return HistoryEphemeral
+		}
+	}
+	return status
+}
+
 // XXX you must have already checked History.Enabled before calling this
 func historyEnabled(serverSetting PersistentStatus, localSetting HistoryStatus) (result HistoryStatus) {
 	switch serverSetting {
@@ -227,6 +262,8 @@ type MulticlientConfig struct {
 	AllowedByDefault bool             `yaml:"allowed-by-default"`
 	AlwaysOn         PersistentStatus `yaml:"always-on"`
 	AutoAway         PersistentStatus `yaml:"auto-away"`
+	AutoAwayMessage  string           `yaml:"auto-away-message"`
+	AutoAwayDeaf     bool             `yaml:"auto-away-deaf"`
 }
 
 type throttleConfig struct {
@@ -265,6 +302,7 @@ type AccountConfig struct {
 	LoginThrottling     ThrottleConfig `yaml:"login-throttling"`
 	SkipServerPassword  bool           `yaml:"skip-server-password"`
 	LoginViaPassCommand bool           `yaml:"login-via-pass-command"`
+	MaxCertfps          int            `yaml:"max-certfps"`
 	NickReservation     struct {
 		Enabled                bool
 		AdditionalNickLimit    int `yaml:"additional-nick-limit"`
@@ -278,9 +316,16 @@ type AccountConfig struct {
 		ForceGuestFormat       bool `yaml:"force-guest-format"`
 		ForceNickEqualsAccount bool `yaml:"force-nick-equals-account"`
 		ForbidAnonNickChanges  bool `yaml:"forbid-anonymous-nick-changes"`
+		// forbid nicknames that are confusable with registered accounts' nicknames
+		// (e.g., using homoglyphs), regardless of the enforcement method:
+		ForbidConfusableNicks bool `yaml:"forbid-confusable-nicks"`
+		// hold a nickname for its owner's account for this long after they quit,
+		// regardless of the enforcement settings:
+		NickDelay time.Duration `yaml:"nick-delay"`
 	} `yaml:"nick-reservation"`
 	Multiclient MulticlientConfig
 	Bouncer     *MulticlientConfig // # handle old name for 'multiclient'
+	Drafts      DraftsConfig
 	VHosts      VHostConfig
 	AuthScript  AuthScriptConfig `yaml:"auth-script"`
 }
@@ -297,6 +342,30 @@ type ScriptConfig struct {
 type AuthScriptConfig struct {
 	ScriptConfig `yaml:",inline"`
 	Autocreate   bool
+	// if set, POST the script's input to this URL instead of running the command
+	URL           string
+	OAuth2        OAuth2Config
+	CacheDuration time.Duration     `yaml:"cache-duration"`
+	AccountMap    map[string]string `yaml:"account-mapping"`
+}
+
+// OAuth2Config configures passphrase checking via an OAuth2 token endpoint
+// that supports the resource owner password credentials grant.
+type OAuth2Config struct {
+	Enabled      bool
+	TokenURL     string `yaml:"token-url"`
+	ClientID     string `yaml:"client-id"`
+	ClientSecret string `yaml:"client-secret"`
+	Scopes       []string
+}
+
+// mapAccount translates an external identity into a local account name,
+// per accounts.auth-script.account-mapping.
+func (asc *AuthScriptConfig) mapAccount(external string) string {
+	if account, ok := asc.AccountMap[strings.ToLower(external)]; ok {
+		return account
+	}
+	return external
 }
 
 // AccountRegistrationConfig controls account registration.
@@ -305,7 +374,8 @@ type AccountRegistrationConfig struct {
 	AllowBeforeConnect bool `yaml:"allow-before-connect"`
 	Throttling         ThrottleConfig
 	// new-style (v2.4 email verification config):
-	EmailVerification email.MailtoConfig `yaml:"email-verification"`
+	EmailVerification email.MailtoConfig  `yaml:"email-verification"`
+	PasswordReset     PasswordResetConfig `yaml:"password-reset"`
 	// old-style email verification config, with "callbacks":
 	LegacyEnabledCallbacks []string `yaml:"enabled-callbacks"`
 	LegacyCallbacks        struct {
@@ -320,6 +390,10 @@ type VHostConfig struct {
 	MaxLength      int    `yaml:"max-length"`
 	ValidRegexpRaw string `yaml:"valid-regexp"`
 	validRegexp    *regexp.Regexp
+	// vhosts that users can take for themselves with HS TAKE;
+	// `$account` is replaced by the user's account name
+	OfferList    []string      `yaml:"offer-list"`
+	TakeCooldown time.Duration `yaml:"take-cooldown"`
 }
 
 type NickEnforcementMethod int
@@ -420,24 +494,67 @@ type OperConfig struct {
 	Auto        bool
 	Hidden      bool
 	Modes       string
+	// RSA public key in a PEM file, for CHALLENGE
+	PublicKeyFile string `yaml:"public-key-file"`
+	// if set, operator status granted by this block expires after this long
+	Duration time.Duration
+	// if set, the block needs no credentials and can only be granted with GRANTOPER
+	GrantOnly bool `yaml:"grant-only"`
 }
 
 // Various server-enforced limits on data size.
 type Limits struct {
 	AwayLen              int `yaml:"awaylen"`
 	ChanListModes        int `yaml:"chan-list-modes"`
+	ChanListPageSize     int `yaml:"chan-list-page-size"`
 	ChannelLen           int `yaml:"channellen"`
 	IdentLen             int `yaml:"identlen"`
 	KickLen              int `yaml:"kicklen"`
 	MonitorEntries       int `yaml:"monitor-entries"`
 	NickLen              int `yaml:"nicklen"`
+	SilenceEntries       int `yaml:"silence-entries"`
 	TopicLen             int `yaml:"topiclen"`
 	WhowasEntries        int `yaml:"whowas-entries"`
 	RegistrationMessages int `yaml:"registration-messages"`
+	RegistrationBytes    int `yaml:"registration-bytes"`
 	Multiline            struct {
 		MaxBytes int `yaml:"max-bytes"`
 		MaxLines int `yaml:"max-lines"`
 	}
+	Typing struct {
+		MinInterval time.Duration `yaml:"min-interval"`
+	}
+	NickChanges struct {
+		Window     time.Duration
+		MaxChanges int `yaml:"max-changes"`
+	} `yaml:"nick-changes"`
+	Announcements struct {
+		Window           time.Duration
+		MaxAnnouncements int `yaml:"max-announcements"`
+	}
+	Targmax TargmaxConfig
+}
+
+// TargmaxConfig is the maximum number of comma-separated targets for
+// each command that accepts several.
+type TargmaxConfig struct {
+	Privmsg int
+	Notice  int
+	Tagmsg  int
+	Kick    int
+}
+
+func (t *TargmaxConfig) forCommand(command string) int {
+	switch command {
+	case "NOTICE":
+		return t.Notice
+	case "TAGMSG":
+		return t.Tagmsg
+	case "KICK":
+		return t.Kick
+	default:
+		return t.Privmsg
+	}
 }
 
 // STSConfig controls the STS configuration/
@@ -477,6 +594,19 @@ type TorListenersConfig struct {
 	MaxConnections            int           `yaml:"max-connections"`
 	ThrottleDuration          time.Duration `yaml:"throttle-duration"`
 	MaxConnectionsPerDuration int           `yaml:"max-connections-per-duration"`
+
+	// publish a Tor listener as an onion service, via Tor's control port:
+	OnionService OnionServiceConfig `yaml:"onion-service"`
+}
+
+type OnionServiceConfig struct {
+	Enabled         bool
+	ControlAddress  string `yaml:"control-address"`
+	ControlPassword string `yaml:"control-password"`
+	Listener        string
+	Port            int
+	// the address Tor should forward connections to, derived from Listener
+	target string
 }
 
 // Config defines the overall configuration.
@@ -496,18 +626,32 @@ type Config struct {
 		Listeners    map[string]listenerConfigBlock
 		UnixBindMode os.FileMode        `yaml:"unix-bind-mode"`
 		TorListeners TorListenersConfig `yaml:"tor-listeners"`
-		WebSockets   struct {
+		// TLS session resumption, with ticket keys shared across listeners and rehashes:
+		TLSSessionTickets struct {
+			Enabled     *bool
+			enabled     bool
+			KeyRotation time.Duration `yaml:"key-rotation"`
+		} `yaml:"tls-session-tickets"`
+		WebSockets struct {
 			AllowedOrigins       []string `yaml:"allowed-origins"`
 			allowedOriginRegexps []*regexp.Regexp
+			// per-listener replacements for allowedOriginRegexps:
+			listenerAllowedOriginRegexps map[string][]*regexp.Regexp
+			// negotiate permessage-deflate with clients that support it:
+			Compression bool
+			ServerInfo  bool `yaml:"server-info"`
 		}
+		Webchat WebchatConfig
 		// they get parsed into this internal representation:
 		trueListeners           map[string]utils.ListenerConfig
+		listenerOverrides       map[string]*listenerOverrides
 		STS                     STSConfig
 		LookupHostnames         *bool `yaml:"lookup-hostnames"`
 		lookupHostnames         bool
-		ForwardConfirmHostnames bool   `yaml:"forward-confirm-hostnames"`
-		CheckIdent              bool   `yaml:"check-ident"`
-		CoerceIdent             string `yaml:"coerce-ident"`
+		ForwardConfirmHostnames bool                 `yaml:"forward-confirm-hostnames"`
+		HostnameLookup          HostnameLookupConfig `yaml:"hostname-lookup"`
+		CheckIdent              bool                 `yaml:"check-ident"`
+		CoerceIdent             string               `yaml:"coerce-ident"`
 		MOTD                    string
 		motdLines               []string
 		MOTDFormatting          bool `yaml:"motd-formatting"`
@@ -521,8 +665,13 @@ type Config struct {
 		WebIRC               []webircConfig `yaml:"webirc"`
 		MaxSendQString       string         `yaml:"max-sendq"`
 		MaxSendQBytes        int
-		AllowPlaintextResume bool `yaml:"allow-plaintext-resume"`
-		Compatibility        struct {
+		ShutdownGracePeriod  time.Duration `yaml:"shutdown-grace-period"`
+		AllowPlaintextResume bool          `yaml:"allow-plaintext-resume"`
+		Fanout               struct {
+			ParallelThreshold int `yaml:"parallel-threshold"`
+			MaxWorkers        int `yaml:"max-workers"`
+		}
+		Compatibility struct {
 			ForceTrailing      *bool `yaml:"force-trailing"`
 			forceTrailing      bool
 			SendUnprefixedSasl bool `yaml:"send-unprefixed-sasl"`
@@ -535,11 +684,22 @@ type Config struct {
 		supportedCaps            *caps.Set
 		supportedCapsWithoutSTS  *caps.Set
 		capValues                caps.Values
+		serverInfo               []byte // JSON document served by websocket listeners
 		Casemapping              Casemapping
 		EnforceUtf8              bool         `yaml:"enforce-utf8"`
 		OutputPath               string       `yaml:"output-path"`
 		IPCheckScript            ScriptConfig `yaml:"ip-check-script"`
 		OverrideServicesHostname string       `yaml:"override-services-hostname"`
+		RestrictedNicknames      []string     `yaml:"restricted-nicknames"`
+		restrictedNicks          utils.StringSet
+		restrictedSkeletons      utils.StringSet
+		RestrictedRealnames      []string `yaml:"restricted-realnames"`
+		restrictedRealnames      *regexp.Regexp
+		ReasonMacros             map[string]string `yaml:"reason-macros"`
+		CTCP                     CTCPConfig
+		Maintenance              MaintenanceConfig
+		ASNDatabase              string `yaml:"asn-database"`
+		asnDatabase              *ASNDatabase
 	}
 
 	Roleplay struct {
@@ -563,10 +723,16 @@ type Config struct {
 
 	languageManager *languages.Manager
 
+	Help struct {
+		Path string
+	}
+	customHelp customHelp
+
 	Datastore struct {
 		Path        string
 		AutoUpgrade bool
 		MySQL       mysql.Config
+		PostgreSQL  postgresql.Config
 	}
 
 	Accounts AccountConfig
@@ -580,9 +746,25 @@ type Config struct {
 			Enabled               bool
 			OperatorOnly          bool `yaml:"operator-only"`
 			MaxChannelsPerAccount int  `yaml:"max-channels-per-account"`
+
+			ExpireTime    custime.Duration `yaml:"expire-time"`
+			ExpireWarning custime.Duration `yaml:"expire-warning"`
 		}
 		ListDelay        time.Duration    `yaml:"list-delay"`
 		InviteExpiration custime.Duration `yaml:"invite-expiration"`
+		// channels that clients are joined to after registration
+		AutoJoin []string `yaml:"auto-join"`
+		// number of previous topics to remember per channel (CS TOPIC)
+		TopicHistoryLength int `yaml:"topic-history-length"`
+		// words that channel mode +G replaces with asterisks
+		CensorWords    []string `yaml:"censor-words"`
+		censorMatchers []badwordMatcher
+
+		// WHO and NAMES replies for large channels are cached for this long
+		WhoCache struct {
+			Duration   time.Duration
+			MinMembers int `yaml:"min-members"`
+		} `yaml:"who-cache"`
 	}
 
 	OperClasses map[string]*OperClassConfig `yaml:"oper-classes"`
@@ -592,6 +774,8 @@ type Config struct {
 	// parsed operator definitions, unexported so they can't be defined
 	// directly in YAML:
 	operators map[string]*Oper
+	// ciphertext lengths of their CHALLENGE keys, for decoy challenges:
+	operKeySizes []int
 
 	Logging []logger.LoggingConfig
 
@@ -605,28 +789,47 @@ type Config struct {
 
 	Fakelag FakelagConfig
 
+	ConnectionClasses []ConnectionClassConfig `yaml:"connection-classes"`
+	connectionClasses map[string]*ConnectionClassConfig
+
+	Aliases map[string]string
+	aliases map[string]*commandAlias
+
+	ServicesLink ServicesLinkConfig `yaml:"services-link"`
+
+	Webhooks []WebhookConfig
+
+	Snomasks struct {
+		Routes []SnomaskRouteConfig
+	}
+
+	Bridges map[string]BridgeConfig
+
 	History struct {
-		Enabled          bool
-		ChannelLength    int              `yaml:"channel-length"`
-		ClientLength     int              `yaml:"client-length"`
-		AutoresizeWindow custime.Duration `yaml:"autoresize-window"`
-		AutoreplayOnJoin int              `yaml:"autoreplay-on-join"`
-		ChathistoryMax   int              `yaml:"chathistory-maxmessages"`
-		ZNCMax           int              `yaml:"znc-maxmessages"`
-		Restrictions     struct {
+		Enabled                 bool
+		ChannelLength           int              `yaml:"channel-length"`
+		ClientLength            int              `yaml:"client-length"`
+		AutoresizeWindow        custime.Duration `yaml:"autoresize-window"`
+		AutoreplayOnJoin        int              `yaml:"autoreplay-on-join"`
+		ChathistoryMax          int              `yaml:"chathistory-maxmessages"`
+		ChathistoryMaxPerMinute int              `yaml:"chathistory-maxmessages-per-minute"`
+		ZNCMax                  int              `yaml:"znc-maxmessages"`
+		Restrictions            struct {
 			ExpireTime              custime.Duration `yaml:"expire-time"`
 			EnforceRegistrationDate bool             `yaml:"enforce-registration-date"`
 			GracePeriod             custime.Duration `yaml:"grace-period"`
 		}
 		Persistent struct {
 			Enabled              bool
-			UnregisteredChannels bool             `yaml:"unregistered-channels"`
-			RegisteredChannels   PersistentStatus `yaml:"registered-channels"`
-			DirectMessages       PersistentStatus `yaml:"direct-messages"`
+			UnregisteredChannels bool                    `yaml:"unregistered-channels"`
+			RegisteredChannels   PersistentStatus        `yaml:"registered-channels"`
+			DirectMessages       PersistentStatus        `yaml:"direct-messages"`
+			WriteQueue           HistoryWriteQueueConfig `yaml:"write-queue"`
 		}
 		Retention struct {
 			AllowIndividualDelete bool `yaml:"allow-individual-delete"`
 			EnableAccountIndexing bool `yaml:"enable-account-indexing"`
+			AllowChannelOptOut    bool `yaml:"allow-channel-opt-out"`
 		}
 		TagmsgStorage struct {
 			Default   bool
@@ -645,10 +848,52 @@ type OperClass struct {
 	Capabilities utils.StringSet // map to make lookups much easier
 }
 
+var (
+	// operCapabilities are the capabilities that an oper class can grant,
+	// each gating a specific set of commands or privileges:
+	operCapabilities = map[string]string{
+		"kill":        "KILL, and NS CLIENTS LOGOUT on other users",
+		"ban":         "KLINE, DLINE, UNKLINE, UNDLINE, BANS, and HS UNCLOAK",
+		"rehash":      "REHASH, DEBUG CRASHSERVER, and HS SETCLOAKSECRET",
+		"view-ips":    "other users' IPs and private details in WHOIS, WHO, USERHOST, and NS CLIENTS LIST",
+		"history":     "HistServ administration",
+		"defcon":      "DEFCON",
+		"accreg":      "account administration via NickServ",
+		"chanreg":     "channel administration via ChanServ",
+		"vhosts":      "vhost administration via HostServ",
+		"sajoin":      "SAJOIN",
+		"sapart":      "SAPART",
+		"samode":      "SAMODE",
+		"ojoin":       "OJOIN",
+		"nofakelag":   "exemption from fakelag",
+		"roleplay":    "roleplay commands when roleplay.require-oper is set",
+		"relaymsg":    "RELAYMSG without channel operator status",
+		"readonly":    "READONLY",
+		"maintenance": "MAINTENANCE",
+		"backup":      "BACKUP",
+		"deanonymize": "DEANONYMIZE",
+		"grantoper":   "GRANTOPER, for oper blocks with no capabilities beyond the granter's own",
+		"announce":    "ANNOUNCE",
+	}
+
+	// legacyOperCapabilities maps the coarse capability names of older configs
+	// to their replacements (every oper could see IPs before view-ips existed,
+	// so ban management keeps that ability):
+	legacyOperCapabilities = map[string][]string{
+		"local_kill":  {"kill"},
+		"local_ban":   {"ban", "view-ips"},
+		"local_unban": {"ban"},
+	}
+)
+
 // OperatorClasses returns a map of assembled operator classes from the given config.
 func (conf *Config) OperatorClasses() (map[string]*OperClass, error) {
-	fixupCapability := func(capab string) string {
-		return strings.TrimPrefix(capab, "oper:") // #868
+	fixupCapability := func(capab string) []string {
+		capab = strings.TrimPrefix(capab, "oper:") // #868
+		if replacements, ok := legacyOperCapabilities[capab]; ok {
+			return replacements
+		}
+		return []string{capab}
 	}
 
 	ocs := make(map[string]*OperClass)
@@ -687,14 +932,19 @@ func (conf *Config) OperatorClasses() (map[string]*OperClass, error) {
 				einfo := ocs[info.Extends]
 
 				for capab := range einfo.Capabilities {
-					oc.Capabilities.Add(fixupCapability(capab))
+					oc.Capabilities.Add(capab)
 				}
 			}
 
 			// add our own info
 			oc.Title = info.Title
-			for _, capab := range info.Capabilities {
-				oc.Capabilities.Add(fixupCapability(capab))
+			for _, rawCapab := range info.Capabilities {
+				for _, capab := range fixupCapability(rawCapab) {
+					if _, ok := operCapabilities[capab]; !ok {
+						return nil, fmt.Errorf("Operclass [%s] has unknown capability [%s]", name, capab)
+					}
+					oc.Capabilities.Add(capab)
+				}
 			}
 			if len(info.WhoisLine) > 0 {
 				oc.WhoisLine = info.WhoisLine
@@ -727,9 +977,17 @@ type Oper struct {
 	Vhost     string
 	Pass      []byte
 	Certfp    string
+	PublicKey *rsa.PublicKey
 	Auto      bool
 	Hidden    bool
 	Modes     []modes.ModeChange
+	Duration  time.Duration
+}
+
+// HasRoleCapab returns whether the oper has the given capability; it is
+// false for a nil oper.
+func (oper *Oper) HasRoleCapab(capab string) bool {
+	return oper != nil && oper.Class.Capabilities.Has(capab)
 }
 
 // Operators returns a map of operator configs from the given OperClass and config.
@@ -761,11 +1019,21 @@ func (conf *Config) Operators(oc map[string]*OperClass) (map[string]*Oper, error
 				return nil, fmt.Errorf("Oper %s has an invalid fingerprint: %s", oper.Name, err.Error())
 			}
 		}
+		if opConf.PublicKeyFile != "" {
+			oper.PublicKey, err = loadOperPublicKey(opConf.PublicKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("Oper %s has an invalid public key: %s", oper.Name, err.Error())
+			}
+		}
 		oper.Auto = opConf.Auto
 		oper.Hidden = opConf.Hidden
+		if opConf.Duration < 0 {
+			return nil, fmt.Errorf("Oper %s has a negative duration", name)
+		}
+		oper.Duration = opConf.Duration
 
-		if oper.Pass == nil && oper.Certfp == "" {
-			return nil, fmt.Errorf("Oper %s has neither a password nor a fingerprint", name)
+		if oper.Pass == nil && oper.Certfp == "" && oper.PublicKey == nil && !opConf.GrantOnly {
+			return nil, fmt.Errorf("Oper %s has no password, fingerprint, or public key", name)
 		}
 
 		oper.Vhost = opConf.Vhost
@@ -835,13 +1103,78 @@ func (conf *Config) prepareListeners() (err error) {
 			lconf.TLSConfig = tlsConfig
 		}
 		lconf.RequireProxy = block.TLS.Proxy || block.Proxy
+		if block.ProxyCertfpTLV < 0 || 0xff < block.ProxyCertfpTLV || (block.ProxyCertfpTLV != 0 && !lconf.RequireProxy) {
+			return fmt.Errorf("invalid proxy-certfp-tlv for listener %s", addr)
+		}
+		lconf.ProxyCertfpTLV = byte(block.ProxyCertfpTLV)
 		lconf.WebSocket = block.WebSocket
 		lconf.HideSTS = block.HideSTS
+		if block.Webchat && !block.WebSocket {
+			return fmt.Errorf("the web client can only be served from websocket listeners: %s", addr)
+		}
+		lconf.Webchat = block.Webchat
+		lconf.Name = addr
 		conf.Server.trueListeners[addr] = lconf
 	}
 	return nil
 }
 
+func compileAllowedOrigins(globs []string) (result []*regexp.Regexp, err error) {
+	for _, glob := range globs {
+		globre, err := utils.CompileGlob(glob, false)
+		if err != nil {
+			return nil, fmt.Errorf("invalid websocket allowed-origin expression: %s", glob)
+		}
+		result = append(result, globre)
+	}
+	return
+}
+
+// allowedOrigins returns the origin restrictions for a websocket listener;
+// an empty result means there are none.
+func (conf *Config) allowedOrigins(addr string) []*regexp.Regexp {
+	if regexps, ok := conf.Server.WebSockets.listenerAllowedOriginRegexps[addr]; ok {
+		return regexps
+	}
+	return conf.Server.WebSockets.allowedOriginRegexps
+}
+
+// prepareListenerOverrides processes the per-listener overrides of the network
+// name, MOTD, and supported capabilities. It must run after the server-wide
+// set of supported capabilities is final.
+func (conf *Config) prepareListenerOverrides() (err error) {
+	conf.Server.listenerOverrides = make(map[string]*listenerOverrides)
+	for addr, block := range conf.Server.Listeners {
+		if block.NetworkName == "" && block.MOTD == "" && len(block.DisabledCaps) == 0 {
+			continue
+		}
+		overrides := &listenerOverrides{networkName: block.NetworkName}
+		if block.MOTD != "" {
+			overrides.motdLines, err = readMOTD(block.MOTD, conf.Server.MOTDFormatting)
+			if err != nil {
+				return fmt.Errorf("couldn't load MOTD for listener %s: %v", addr, err)
+			}
+		}
+		if len(block.DisabledCaps) != 0 {
+			overrides.supportedCaps = caps.NewSet()
+			if block.Tor || block.HideSTS {
+				overrides.supportedCaps.Union(conf.Server.supportedCapsWithoutSTS)
+			} else {
+				overrides.supportedCaps.Union(conf.Server.supportedCaps)
+			}
+			for _, capName := range block.DisabledCaps {
+				capab, err := caps.NameToCapability(capName)
+				if err != nil {
+					return fmt.Errorf("invalid capability for listener %s: %s", addr, capName)
+				}
+				overrides.supportedCaps.Disable(capab)
+			}
+		}
+		conf.Server.listenerOverrides[addr] = overrides
+	}
+	return nil
+}
+
 func (config *Config) processExtjwt() (err error) {
 	// first process the default service, which may be disabled
 	err = config.Extjwt.Default.Postprocess()
@@ -1025,6 +1358,20 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if config.Limits.RegistrationMessages == 0 {
 		config.Limits.RegistrationMessages = 1024
 	}
+	if config.Limits.RegistrationBytes == 0 {
+		config.Limits.RegistrationBytes = 64 * 1024
+	}
+	if config.Limits.SilenceEntries == 0 {
+		config.Limits.SilenceEntries = 32
+	}
+	if config.Limits.ChanListPageSize <= 0 {
+		config.Limits.ChanListPageSize = defaultChanListPageSize
+	}
+	for _, targmax := range []*int{&config.Limits.Targmax.Privmsg, &config.Limits.Targmax.Notice, &config.Limits.Targmax.Tagmsg, &config.Limits.Targmax.Kick} {
+		if *targmax <= 0 {
+			*targmax = defaultMaxTargets
+		}
+	}
 	if config.Datastore.MySQL.Enabled {
 		if config.Limits.NickLen > mysql.MaxTargetLength || config.Limits.ChannelLen > mysql.MaxTargetLength {
 			return nil, fmt.Errorf("to use MySQL, nick and channel length limits must be %d or lower", mysql.MaxTargetLength)
@@ -1050,13 +1397,27 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to prepare listeners: %v", err)
 	}
+	err = config.Server.TorListeners.OnionService.prepare(config.Server.trueListeners)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, glob := range config.Server.WebSockets.AllowedOrigins {
-		globre, err := utils.CompileGlob(glob, false)
+	config.Server.WebSockets.allowedOriginRegexps, err = compileAllowedOrigins(config.Server.WebSockets.AllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+	config.Server.WebSockets.listenerAllowedOriginRegexps = make(map[string][]*regexp.Regexp)
+	for addr, block := range config.Server.Listeners {
+		if len(block.AllowedOrigins) == 0 {
+			continue
+		}
+		if !block.WebSocket {
+			return nil, fmt.Errorf("allowed-origins is only valid for websocket listeners: %s", addr)
+		}
+		config.Server.WebSockets.listenerAllowedOriginRegexps[addr], err = compileAllowedOrigins(block.AllowedOrigins)
 		if err != nil {
-			return nil, fmt.Errorf("invalid websocket allowed-origin expression: %s", glob)
+			return nil, err
 		}
-		config.Server.WebSockets.allowedOriginRegexps = append(config.Server.WebSockets.allowedOriginRegexps, globre)
 	}
 
 	if config.Server.STS.Enabled {
@@ -1078,6 +1439,20 @@ func LoadConfig(filename string) (config *Config, err error) {
 	config.Server.capValues[caps.STS] = config.Server.STS.Value()
 
 	config.Server.lookupHostnames = utils.BoolDefaultTrue(config.Server.LookupHostnames)
+	config.Server.TLSSessionTickets.enabled = utils.BoolDefaultTrue(config.Server.TLSSessionTickets.Enabled)
+	if config.Server.TLSSessionTickets.KeyRotation == 0 {
+		config.Server.TLSSessionTickets.KeyRotation = 24 * time.Hour
+	} else if config.Server.TLSSessionTickets.KeyRotation < time.Minute {
+		return nil, errors.New("server.tls-session-tickets.key-rotation must be at least 1m")
+	}
+	config.Server.HostnameLookup.postprocess()
+
+	if config.Server.ASNDatabase != "" {
+		config.Server.asnDatabase, err = LoadASNDatabase(config.Server.ASNDatabase)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load ASN database: %v", err)
+		}
+	}
 
 	// process webirc blocks
 	var newWebIRC []webircConfig
@@ -1126,6 +1501,14 @@ func LoadConfig(filename string) (config *Config, err error) {
 		return nil, errors.New("force-nick-equals-account requires enabling multiclient as well")
 	}
 
+	if config.Accounts.MaxCertfps <= 0 {
+		config.Accounts.MaxCertfps = defaultMaxCertfps
+	}
+
+	if err = config.Accounts.Drafts.prepare(); err != nil {
+		return nil, err
+	}
+
 	// handle guest format, including the legacy key rename-prefix
 	if config.Accounts.NickReservation.GuestFormat == "" {
 		renamePrefix := config.Accounts.NickReservation.RenamePrefix
@@ -1155,6 +1538,21 @@ func LoadConfig(filename string) (config *Config, err error) {
 		logConfig.MethodStdout = methods["stdout"]
 		logConfig.MethodStderr = methods["stderr"]
 
+		// rotation
+		if logConfig.RotateSizeString != "" {
+			rotateSize, err := bytefmt.ToBytes(logConfig.RotateSizeString)
+			if err != nil {
+				return nil, fmt.Errorf("Could not parse log rotation size: %s", err.Error())
+			}
+			logConfig.RotateSize = int64(rotateSize)
+		}
+		if (logConfig.RotateSize != 0 || logConfig.RotateAge != 0) && !logConfig.MethodFile {
+			return nil, errors.New("Logging configuration specifies rotation but not the 'file' method")
+		}
+		if logConfig.Keep < 0 || logConfig.RotateAge < 0 {
+			return nil, errors.New("Logging rotation settings cannot be negative")
+		}
+
 		// levels
 		level, exists := logger.LogLevelNames[strings.ToLower(logConfig.LevelString)]
 		if !exists {
@@ -1210,6 +1608,8 @@ func LoadConfig(filename string) (config *Config, err error) {
 		}
 	}
 
+	config.Accounts.Registration.PasswordReset.prepare()
+
 	config.Accounts.defaultUserModes = ParseDefaultUserModes(config.Accounts.DefaultUserModes)
 
 	config.Accounts.RequireSasl.exemptedNets, err = utils.ParseNetList(config.Accounts.RequireSasl.Exempted)
@@ -1227,6 +1627,18 @@ func LoadConfig(filename string) (config *Config, err error) {
 		return nil, fmt.Errorf("Could not parse secure-nets: %v\n", err.Error())
 	}
 
+	if config.Accounts.AuthScript.Enabled {
+		authScript := &config.Accounts.AuthScript
+		if authScript.OAuth2.Enabled && authScript.OAuth2.TokenURL == "" {
+			return nil, fmt.Errorf("auth-script.oauth2 is enabled but token-url is not set")
+		}
+		accountMap := make(map[string]string, len(authScript.AccountMap))
+		for external, account := range authScript.AccountMap {
+			accountMap[strings.ToLower(external)] = account
+		}
+		authScript.AccountMap = accountMap
+	}
+
 	rawRegexp := config.Accounts.VHosts.ValidRegexpRaw
 	if rawRegexp != "" {
 		regexp, err := regexp.Compile(rawRegexp)
@@ -1240,6 +1652,8 @@ func LoadConfig(filename string) (config *Config, err error) {
 		config.Accounts.VHosts.validRegexp = defaultValidVhostRegex
 	}
 
+	config.Server.CTCP.postprocess()
+
 	config.Server.capValues[caps.SASL] = "PLAIN,EXTERNAL"
 	if !config.Accounts.AuthenticationEnabled {
 		config.Server.supportedCaps.Disable(caps.SASL)
@@ -1269,12 +1683,62 @@ func LoadConfig(filename string) (config *Config, err error) {
 	}
 	config.Server.MaxSendQBytes = int(maxSendQBytes)
 
+	if config.Server.Fanout.ParallelThreshold == 0 {
+		config.Server.Fanout.ParallelThreshold = defaultFanoutThreshold
+	}
+	if config.Server.Fanout.MaxWorkers <= 0 {
+		config.Server.Fanout.MaxWorkers = runtime.NumCPU()
+		if config.Server.Fanout.MaxWorkers > MaxServerSemaphoreCapacity {
+			config.Server.Fanout.MaxWorkers = MaxServerSemaphoreCapacity
+		}
+	}
+
+	if err = config.processConnectionClasses(); err != nil {
+		return nil, err
+	}
+
+	if err = config.processAliases(); err != nil {
+		return nil, err
+	}
+
+	for i := range config.Webhooks {
+		if err = config.Webhooks[i].prepare(); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range config.Snomasks.Routes {
+		if err = config.Snomasks.Routes[i].prepare(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, chname := range config.Channels.AutoJoin {
+		if _, err := CasefoldChannel(chname); err != nil {
+			return nil, fmt.Errorf("invalid auto-join channel: %s", chname)
+		}
+	}
+
+	for name, bridge := range config.Bridges {
+		if bridge.Token == "" {
+			return nil, fmt.Errorf("bridge %s has no token", name)
+		}
+		if bridge.Hostname != "" && !utils.IsHostname(bridge.Hostname) {
+			return nil, fmt.Errorf("bridge %s has an invalid hostname: %s", name, bridge.Hostname)
+		}
+	}
+
 	config.languageManager, err = languages.NewManager(config.Languages.Enabled, config.Languages.Path, config.Languages.Default)
 	if err != nil {
 		return nil, fmt.Errorf("Could not load languages: %s", err.Error())
 	}
 	config.Server.capValues[caps.Languages] = config.languageManager.CapValue()
 
+	config.customHelp, err = loadCustomHelp(config.Help.Path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load help topics: %s", err.Error())
+	}
+
 	if config.Server.Relaymsg.Enabled {
 		for _, char := range protocolBreakingNameCharacters {
 			if strings.ContainsRune(config.Server.Relaymsg.Separators, char) {
@@ -1298,10 +1762,16 @@ func LoadConfig(filename string) (config *Config, err error) {
 		return nil, err
 	}
 	config.operators = opers
+	config.operKeySizes = operChallengeKeySizes(opers)
 
 	// parse default channel modes
 	config.Channels.defaultModes = ParseDefaultChannelModes(config.Channels.DefaultModes)
 
+	config.Channels.censorMatchers, err = compileCensorWords(config.Channels.CensorWords)
+	if err != nil {
+		return nil, err
+	}
+
 	if config.Server.Password != "" {
 		config.Server.passwordBytes, err = decodeLegacyPasswordHash(config.Server.Password)
 		if err != nil {
@@ -1322,6 +1792,12 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if config.Channels.Registration.MaxChannelsPerAccount == 0 {
 		config.Channels.Registration.MaxChannelsPerAccount = 15
 	}
+	if config.Channels.Registration.ExpireTime < 0 || config.Channels.Registration.ExpireWarning < 0 {
+		return nil, errors.New("channels.registration.expire-time and expire-warning cannot be negative")
+	}
+	if config.Channels.Registration.ExpireTime != 0 && config.Channels.Registration.ExpireWarning >= config.Channels.Registration.ExpireTime {
+		return nil, errors.New("channels.registration.expire-warning must be shorter than expire-time")
+	}
 
 	config.Server.Compatibility.forceTrailing = utils.BoolDefaultTrue(config.Server.Compatibility.ForceTrailing)
 
@@ -1342,8 +1818,14 @@ func LoadConfig(filename string) (config *Config, err error) {
 		config.History.Persistent.DirectMessages = PersistentDisabled
 	}
 
-	if config.History.Persistent.Enabled && !config.Datastore.MySQL.Enabled {
-		return nil, fmt.Errorf("You must configure a MySQL server in order to enable persistent history")
+	if config.Datastore.MySQL.Enabled && config.Datastore.PostgreSQL.Enabled {
+		return nil, fmt.Errorf("MySQL and PostgreSQL cannot both be enabled")
+	}
+	if config.History.Persistent.Enabled && !(config.Datastore.MySQL.Enabled || config.Datastore.PostgreSQL.Enabled) {
+		return nil, fmt.Errorf("You must configure a MySQL or PostgreSQL server in order to enable persistent history")
+	}
+	if err = config.History.Persistent.WriteQueue.prepare(); err != nil {
+		return nil, err
 	}
 
 	if config.History.ZNCMax == 0 {
@@ -1354,6 +1836,19 @@ func LoadConfig(filename string) (config *Config, err error) {
 
 	config.Datastore.MySQL.ExpireTime = time.Duration(config.History.Restrictions.ExpireTime)
 	config.Datastore.MySQL.TrackAccountMessages = config.History.Retention.EnableAccountIndexing
+	config.Datastore.PostgreSQL.ExpireTime = config.Datastore.MySQL.ExpireTime
+	config.Datastore.PostgreSQL.TrackAccountMessages = config.Datastore.MySQL.TrackAccountMessages
+
+	err = config.processRestrictedNames()
+	if err != nil {
+		return nil, err
+	}
+
+	reasonMacros := make(map[string]string, len(config.Server.ReasonMacros))
+	for name, text := range config.Server.ReasonMacros {
+		reasonMacros[strings.ToLower(strings.TrimPrefix(name, "!"))] = text
+	}
+	config.Server.ReasonMacros = reasonMacros
 
 	config.Server.Cloaks.Initialize()
 	if config.Server.Cloaks.Enabled {
@@ -1372,6 +1867,10 @@ func LoadConfig(filename string) (config *Config, err error) {
 	if err != nil {
 		return nil, err
 	}
+	err = config.generateServerInfo()
+	if err != nil {
+		return nil, err
+	}
 
 	err = config.prepareListeners()
 	if err != nil {
@@ -1383,6 +1882,11 @@ func LoadConfig(filename string) (config *Config, err error) {
 	config.Server.supportedCapsWithoutSTS.Union(config.Server.supportedCaps)
 	config.Server.supportedCapsWithoutSTS.Disable(caps.STS)
 
+	err = config.prepareListenerOverrides()
+	if err != nil {
+		return nil, err
+	}
+
 	return config, nil
 }
 
@@ -1390,6 +1894,79 @@ func (config *Config) getOutputPath(filename string) string {
 	return filepath.Join(config.Server.OutputPath, filename)
 }
 
+// processRestrictedNames populates the configurable nickname and realname blacklists;
+// the network name is always reserved, since it's a common source for notices
+func (config *Config) processRestrictedNames() (err error) {
+	config.Server.restrictedNicks = make(utils.StringSet)
+	config.Server.restrictedSkeletons = make(utils.StringSet)
+	restrictedNicknames := config.Server.RestrictedNicknames
+	if _, err := CasefoldName(config.Network.Name); err == nil {
+		restrictedNicknames = append(restrictedNicknames, config.Network.Name)
+	}
+	for _, nick := range restrictedNicknames {
+		cfName, err := CasefoldName(nick)
+		if err != nil {
+			return fmt.Errorf("invalid restricted nickname `%s`: %v", nick, err)
+		}
+		skeleton, err := Skeleton(nick)
+		if err != nil {
+			return fmt.Errorf("invalid restricted nickname `%s`: %v", nick, err)
+		}
+		config.Server.restrictedNicks.Add(cfName)
+		config.Server.restrictedSkeletons.Add(skeleton)
+	}
+
+	if len(config.Server.RestrictedRealnames) != 0 {
+		globs := make([]string, len(config.Server.RestrictedRealnames))
+		for i, glob := range config.Server.RestrictedRealnames {
+			globs[i] = strings.ToLower(glob)
+		}
+		config.Server.restrictedRealnames, err = utils.CompileMasks(globs)
+		if err != nil {
+			return fmt.Errorf("invalid restricted-realnames: %v", err)
+		}
+	}
+	return nil
+}
+
+// isRestrictedNick returns whether a nickname is reserved, either for one of the
+// built-in services or by the config. It takes the casefolded name and skeleton.
+func (config *Config) isRestrictedNick(cfName, skeleton string) bool {
+	return restrictedCasefoldedNicks.Has(cfName) || restrictedSkeletons.Has(skeleton) ||
+		config.Server.restrictedNicks.Has(cfName) || config.Server.restrictedSkeletons.Has(skeleton)
+}
+
+// isRestrictedRealname returns whether a realname is forbidden by the config,
+// e.g., because it impersonates operators or services
+func (config *Config) isRestrictedRealname(realname string) bool {
+	if config.Server.restrictedRealnames == nil {
+		return false
+	}
+	return config.Server.restrictedRealnames.MatchString(strings.ToLower(realname))
+}
+
+// expandReasonMacro expands a moderation reason of the form `!macro [details]`
+// using server.reason-macros; details, if any, are appended in parentheses.
+// It returns the name of the macro that was used, or "" if there was none.
+func (config *Config) expandReasonMacro(reason string) (expanded, macro string) {
+	if !strings.HasPrefix(reason, "!") {
+		return reason, ""
+	}
+	name, details := reason[1:], ""
+	if space := strings.IndexByte(name, ' '); space != -1 {
+		name, details = name[:space], strings.TrimSpace(name[space+1:])
+	}
+	name = strings.ToLower(name)
+	text, ok := config.Server.ReasonMacros[name]
+	if !ok {
+		return reason, ""
+	}
+	if details != "" {
+		text = fmt.Sprintf("%s (%s)", text, details)
+	}
+	return text, name
+}
+
 func (config *Config) isRelaymsgIdentifier(nick string) bool {
 	if !config.Server.Relaymsg.Enabled {
 		return false
@@ -1405,7 +1982,7 @@ func (config *Config) isRelaymsgIdentifier(nick string) bool {
 
 // setISupport sets up our RPL_ISUPPORT reply.
 func (config *Config) generateISupport() (err error) {
-	maxTargetsString := strconv.Itoa(maxTargets)
+	targmax := &config.Limits.Targmax
 
 	// add RPL_ISUPPORT tokens
 	isupport := &config.Server.isupport
@@ -1425,11 +2002,11 @@ func (config *Config) generateISupport() (err error) {
 	if config.Extjwt.Default.Enabled() || len(config.Extjwt.Services) != 0 {
 		isupport.Add("EXTJWT", "1")
 	}
-	isupport.Add("EXTBAN", ",m")
+	isupport.Add("EXTBAN", extbanISupport)
 	isupport.Add("INVEX", "")
 	isupport.Add("KICKLEN", strconv.Itoa(config.Limits.KickLen))
 	isupport.Add("MAXLIST", fmt.Sprintf("beI:%s", strconv.Itoa(config.Limits.ChanListModes)))
-	isupport.Add("MAXTARGETS", maxTargetsString)
+	isupport.Add("MAXTARGETS", strconv.Itoa(targmax.Privmsg))
 	isupport.Add("MODES", "")
 	isupport.Add("MONITOR", strconv.Itoa(config.Limits.MonitorEntries))
 	isupport.Add("NETWORK", config.Network.Name)
@@ -1439,8 +2016,9 @@ func (config *Config) generateISupport() (err error) {
 		isupport.Add("RPCHAN", "E")
 		isupport.Add("RPUSER", "E")
 	}
+	isupport.Add("SILENCE", strconv.Itoa(config.Limits.SilenceEntries))
 	isupport.Add("STATUSMSG", "~&@%+")
-	isupport.Add("TARGMAX", fmt.Sprintf("NAMES:1,LIST:1,KICK:1,WHOIS:1,USERHOST:10,PRIVMSG:%s,TAGMSG:%s,NOTICE:%s,MONITOR:%d", maxTargetsString, maxTargetsString, maxTargetsString, config.Limits.MonitorEntries))
+	isupport.Add("TARGMAX", fmt.Sprintf("NAMES:1,LIST:,KICK:%d,WHOIS:1,USERHOST:%d,PRIVMSG:%d,TAGMSG:%d,NOTICE:%d,MONITOR:%d", targmax.Kick, maxUserhostTargets, targmax.Privmsg, targmax.Tagmsg, targmax.Notice, config.Limits.MonitorEntries))
 	isupport.Add("TOPICLEN", strconv.Itoa(config.Limits.TopicLen))
 	if config.Server.Casemapping == CasemappingPRECIS {
 		isupport.Add("UTF8MAPPING", precisUTF8MappingToken)
@@ -1525,33 +2103,39 @@ func compileGuestRegexp(guestFormat string, casemapping Casemapping) (standard,
 	return
 }
 
-func (config *Config) loadMOTD() error {
+func (config *Config) loadMOTD() (err error) {
 	if config.Server.MOTD != "" {
-		file, err := os.Open(config.Server.MOTD)
-		if err != nil {
-			return err
-		}
-		defer file.Close()
-		contents, err := ioutil.ReadAll(file)
-		if err != nil {
-			return err
-		}
+		config.Server.motdLines, err = readMOTD(config.Server.MOTD, config.Server.MOTDFormatting)
+	}
+	return
+}
 
-		lines := bytes.Split(contents, []byte{'\n'})
-		for i, line := range lines {
-			lineToSend := string(bytes.TrimRight(line, "\r\n"))
-			if len(lineToSend) == 0 && i == len(lines)-1 {
-				// if the last line of the MOTD was properly terminated with \n,
-				// there's no need to send a blank line to clients
-				continue
-			}
-			if config.Server.MOTDFormatting {
-				lineToSend = ircfmt.Unescape(lineToSend)
-			}
-			// "- " is the required prefix for MOTD
-			lineToSend = fmt.Sprintf("- %s", lineToSend)
-			config.Server.motdLines = append(config.Server.motdLines, lineToSend)
+// readMOTD reads a MOTD file into lines ready to send as RPL_MOTD.
+func readMOTD(path string, formatting bool) (motdLines []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		return
+	}
+
+	lines := bytes.Split(contents, []byte{'\n'})
+	for i, line := range lines {
+		lineToSend := string(bytes.TrimRight(line, "\r\n"))
+		if len(lineToSend) == 0 && i == len(lines)-1 {
+			// if the last line of the MOTD was properly terminated with \n,
+			// there's no need to send a blank line to clients
+			continue
 		}
+		if formatting {
+			lineToSend = ircfmt.Unescape(lineToSend)
+		}
+		// "- " is the required prefix for MOTD
+		lineToSend = fmt.Sprintf("- %s", lineToSend)
+		motdLines = append(motdLines, lineToSend)
 	}
-	return nil
+	return
 }
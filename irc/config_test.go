@@ -5,7 +5,11 @@ package irc
 
 import (
 	"reflect"
+	"regexp"
 	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/caps"
 )
 
 func TestEnvironmentOverrides(t *testing.T) {
@@ -99,3 +103,196 @@ func TestEnvironmentOverrideErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestRestrictedNames(t *testing.T) {
+	var config Config
+	config.Network.Name = "ExampleNet"
+	config.Server.RestrictedNicknames = []string{"Staff"}
+	config.Server.RestrictedRealnames = []string{"*oper*"}
+	if err := config.processRestrictedNames(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, nick := range []string{"staff", "examplenet", "nickserv"} {
+		skeleton, _ := Skeleton(nick)
+		if !config.isRestrictedNick(nick, skeleton) {
+			t.Errorf("%s should be restricted", nick)
+		}
+	}
+	skeleton, _ := Skeleton("shivaram")
+	if config.isRestrictedNick("shivaram", skeleton) {
+		t.Errorf("shivaram should not be restricted")
+	}
+
+	if !config.isRestrictedRealname("Network OPERATOR") {
+		t.Errorf("realname should be restricted")
+	}
+	if config.isRestrictedRealname("Shivaram Lingamneni") {
+		t.Errorf("realname should not be restricted")
+	}
+}
+
+func TestLimitHistoryStatus(t *testing.T) {
+	cases := []struct {
+		status, limit, expected HistoryStatus
+	}{
+		{HistoryPersistent, HistoryDefault, HistoryPersistent},
+		{HistoryPersistent, HistoryPersistent, HistoryPersistent},
+		{HistoryPersistent, HistoryEphemeral, HistoryEphemeral},
+		{HistoryEphemeral, HistoryEphemeral, HistoryEphemeral},
+		{HistoryDisabled, HistoryEphemeral, HistoryDisabled},
+		{HistoryPersistent, HistoryDisabled, HistoryDisabled},
+		{HistoryEphemeral, HistoryDisabled, HistoryDisabled},
+	}
+	for _, c := range cases {
+		if result := limitHistoryStatus(c.status, c.limit); result != c.expected {
+			t.Errorf("limitHistoryStatus(%d, %d): expected %d, got %d", c.status, c.limit, c.expected, result)
+		}
+	}
+}
+
+func TestExpandReasonMacro(t *testing.T) {
+	var config Config
+	config.Server.ReasonMacros = map[string]string{
+		"spam": "Spamming is not permitted",
+	}
+	cases := []struct {
+		reason, expanded, macro string
+	}{
+		{"!spam", "Spamming is not permitted", "spam"},
+		{"!SPAM", "Spamming is not permitted", "spam"},
+		{"!spam  links in #help", "Spamming is not permitted (links in #help)", "spam"},
+		{"!flood", "!flood", ""},
+		{"spam", "spam", ""},
+		{"", "", ""},
+	}
+	for _, c := range cases {
+		expanded, macro := config.expandReasonMacro(c.reason)
+		if expanded != c.expanded || macro != c.macro {
+			t.Errorf("expandReasonMacro(%q): expected (%q, %q), got (%q, %q)", c.reason, c.expanded, c.macro, expanded, macro)
+		}
+	}
+}
+
+func TestListenerOverrides(t *testing.T) {
+	var config Config
+	config.Network.Name = "Oragono"
+	config.Server.supportedCaps = caps.NewCompleteSet()
+	config.Server.supportedCapsWithoutSTS = caps.NewCompleteSet()
+	config.Server.supportedCapsWithoutSTS.Disable(caps.STS)
+	config.Server.Listeners = map[string]listenerConfigBlock{
+		":6667": {},
+		":6668": {NetworkName: "OragonoGateway", DisabledCaps: []string{"sasl", "draft/chathistory"}},
+		":6669": {Tor: true, DisabledCaps: []string{"sasl"}},
+	}
+	if err := config.prepareListenerOverrides(); err != nil {
+		t.Fatal(err)
+	}
+
+	assertEqual(len(config.Server.listenerOverrides), 2, t)
+	public := &Session{listener: ":6667"}
+	assertEqual(public.listenerOverrides(&config) == nil, true, t)
+	assertEqual(public.networkName(&config), "Oragono", t)
+
+	gateway := &Session{listener: ":6668"}
+	assertEqual(gateway.networkName(&config), "OragonoGateway", t)
+	gatewayCaps := gateway.listenerOverrides(&config).supportedCaps
+	assertEqual(gatewayCaps.Has(caps.SASL), false, t)
+	assertEqual(gatewayCaps.Has(caps.Chathistory), false, t)
+	assertEqual(gatewayCaps.Has(caps.STS), true, t)
+	assertEqual(config.Server.supportedCaps.Has(caps.SASL), true, t)
+
+	tor := &Session{listener: ":6669"}
+	assertEqual(tor.networkName(&config), "Oragono", t)
+	torCaps := tor.listenerOverrides(&config).supportedCaps
+	assertEqual(torCaps.Has(caps.SASL), false, t)
+	assertEqual(torCaps.Has(caps.STS), false, t)
+
+	config.Server.Listeners[":6670"] = listenerConfigBlock{DisabledCaps: []string{"nonexistent"}}
+	if err := config.prepareListenerOverrides(); err == nil {
+		t.Errorf("accepted an invalid capability")
+	}
+}
+
+func TestListenerAllowedOrigins(t *testing.T) {
+	var config Config
+	config.Server.WebSockets.allowedOriginRegexps, _ = compileAllowedOrigins([]string{"https://oragono.io"})
+	webchat, err := compileAllowedOrigins([]string{"https://*.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Server.WebSockets.listenerAllowedOriginRegexps = map[string][]*regexp.Regexp{":8097": webchat}
+
+	matches := func(addr, origin string) bool {
+		for _, re := range config.allowedOrigins(addr) {
+			if re.MatchString(origin) {
+				return true
+			}
+		}
+		return false
+	}
+	assertEqual(matches(":8097", "https://chat.example.com"), true, t)
+	assertEqual(matches(":8097", "https://oragono.io"), false, t)
+	assertEqual(matches(":8098", "https://oragono.io"), true, t)
+	assertEqual(matches(":8098", "https://chat.example.com"), false, t)
+}
+
+func TestOperatorClasses(t *testing.T) {
+	var config Config
+	config.OperClasses = map[string]*OperClassConfig{
+		"moderator": {
+			Title:        "Moderator",
+			Capabilities: []string{"oper:local_kill", "local_ban", "local_unban"},
+		},
+		"admin": {
+			Title:        "Admin",
+			Extends:      "moderator",
+			Capabilities: []string{"rehash", "defcon"},
+		},
+	}
+	classes, err := config.OperatorClasses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	moderator := &Oper{Class: classes["moderator"]}
+	admin := &Oper{Class: classes["admin"]}
+	assertEqual(len(moderator.Class.Capabilities), 3, t)
+	assertEqual(moderator.HasRoleCapab("kill"), true, t)
+	assertEqual(moderator.HasRoleCapab("ban"), true, t)
+	assertEqual(moderator.HasRoleCapab("view-ips"), true, t)
+	assertEqual(moderator.HasRoleCapab("rehash"), false, t)
+	assertEqual(admin.HasRoleCapab("ban"), true, t)
+	assertEqual(admin.HasRoleCapab("defcon"), true, t)
+	assertEqual(admin.HasRoleCapab("history"), false, t)
+
+	var nobody *Oper
+	assertEqual(nobody.HasRoleCapab("kill"), false, t)
+
+	config.OperClasses["admin"].Capabilities = append(config.OperClasses["admin"].Capabilities, "everything")
+	if _, err := config.OperatorClasses(); err == nil {
+		t.Errorf("accepted an unknown capability")
+	}
+}
+
+func TestGrantOnlyOperators(t *testing.T) {
+	var config Config
+	config.OperClasses = map[string]*OperClassConfig{
+		"moderator": {Title: "Moderator", Capabilities: []string{"ban"}},
+	}
+	classes, err := config.OperatorClasses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Opers = map[string]*OperConfig{
+		"oncall": {Class: "moderator", Duration: 2 * time.Hour},
+	}
+	if _, err := config.Operators(classes); err == nil {
+		t.Errorf("accepted an oper block with no credentials")
+	}
+	config.Opers["oncall"].GrantOnly = true
+	opers, err := config.Operators(classes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(opers["oncall"].Duration, 2*time.Hour, t)
+}
@@ -0,0 +1,223 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"code.cloudfoundry.org/bytefmt"
+
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// ConnectionClassConfig describes a class of clients, selected by their IP,
+// TLS, account, or operator status, that receives different limits from the
+// server-wide defaults. Zero values mean that the default applies.
+type ConnectionClassConfig struct {
+	Name  string
+	Match struct {
+		IPs      []string `yaml:"ips"`
+		TLS      *bool    `yaml:"tls"`
+		Accounts []string // "*" matches any account
+		Opers    *bool
+	}
+	MaxSendQString string         `yaml:"max-sendq"`
+	Fakelag        *FakelagConfig // replaces the top-level fakelag config
+	MaxChannels    int            `yaml:"max-channels"`
+	IdleTimeout    time.Duration  `yaml:"idle-timeout"`
+	// replaces idle-timeout for clients that aren't logged into an account
+	UnidentifiedIdleTimeout time.Duration `yaml:"unidentified-idle-timeout"`
+	// how long after an unanswered PING we consider the connection dead
+	PingTimeout time.Duration `yaml:"ping-timeout"`
+	// how long unregistered connections have to complete registration
+	RegistrationTimeout time.Duration `yaml:"registration-timeout"`
+	// hide clients from WHO queries by non-operators, as with +i
+	HideFromWho bool `yaml:"hide-from-who"`
+
+	maxSendQBytes int
+	nets          []net.IPNet
+	accounts      utils.StringSet
+	anyAccount    bool
+}
+
+func (cc *ConnectionClassConfig) postprocess() (err error) {
+	if cc.Name == "" {
+		return fmt.Errorf("connection classes must have a name")
+	}
+	if cc.MaxSendQString != "" {
+		maxSendQBytes, err := bytefmt.ToBytes(cc.MaxSendQString)
+		if err != nil {
+			return fmt.Errorf("invalid max-sendq for connection class %s: %v", cc.Name, err)
+		}
+		cc.maxSendQBytes = int(maxSendQBytes)
+	}
+	cc.nets, err = utils.ParseNetList(cc.Match.IPs)
+	if err != nil {
+		return fmt.Errorf("invalid ips for connection class %s: %v", cc.Name, err)
+	}
+	cc.accounts = make(utils.StringSet)
+	for _, account := range cc.Match.Accounts {
+		if account == "*" {
+			cc.anyAccount = true
+			continue
+		}
+		cfAccount, err := CasefoldName(account)
+		if err != nil {
+			return fmt.Errorf("invalid account for connection class %s: %s", cc.Name, account)
+		}
+		cc.accounts.Add(cfAccount)
+	}
+	return nil
+}
+
+// matches returns whether a client belongs to the class; every criterion
+// that is specified must match.
+func (cc *ConnectionClassConfig) matches(ip net.IP, tls bool, account string, oper bool) bool {
+	if len(cc.nets) != 0 && !utils.IPInNets(ip, cc.nets) {
+		return false
+	}
+	if cc.Match.TLS != nil && *cc.Match.TLS != tls {
+		return false
+	}
+	if cc.anyAccount || len(cc.accounts) != 0 {
+		if account == "" || !(cc.anyAccount || cc.accounts.Has(account)) {
+			return false
+		}
+	}
+	if cc.Match.Opers != nil && *cc.Match.Opers != oper {
+		return false
+	}
+	return true
+}
+
+func (config *Config) processConnectionClasses() (err error) {
+	config.connectionClasses = make(map[string]*ConnectionClassConfig, len(config.ConnectionClasses))
+	for i := range config.ConnectionClasses {
+		class := &config.ConnectionClasses[i]
+		if err = class.postprocess(); err != nil {
+			return
+		}
+		if _, ok := config.connectionClasses[class.Name]; ok {
+			return fmt.Errorf("duplicate connection class: %s", class.Name)
+		}
+		config.connectionClasses[class.Name] = class
+	}
+	return nil
+}
+
+// ConnectionClass returns the client's connection class under the current
+// config, or nil if it has none (or its class was removed by a rehash).
+func (client *Client) ConnectionClass() *ConnectionClassConfig {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.connectionClassNoMutex()
+}
+
+func (client *Client) connectionClassNoMutex() *ConnectionClassConfig {
+	if client.connectionClass == "" {
+		return nil
+	}
+	return client.server.Config().connectionClasses[client.connectionClass]
+}
+
+// updateConnectionClass assigns the client to the first matching connection
+// class. This happens when the client connects (when only its IP and TLS
+// status are known), again when it completes registration (by which time
+// any SASL account is known), and when its operator status changes; callers
+// are responsible for resetting fakelag.
+func (client *Client) updateConnectionClass() {
+	config := client.server.Config()
+	ip, tls, account, oper := client.IP(), client.HasMode(modes.TLS), client.Account(), client.Oper() != nil
+
+	var class *ConnectionClassConfig
+	for i := range config.ConnectionClasses {
+		if config.ConnectionClasses[i].matches(ip, tls, account, oper) {
+			class = &config.ConnectionClasses[i]
+			break
+		}
+	}
+
+	maxSendQBytes := config.Server.MaxSendQBytes
+	client.stateMutex.Lock()
+	if class != nil {
+		client.connectionClass = class.Name
+		if class.maxSendQBytes != 0 {
+			maxSendQBytes = class.maxSendQBytes
+		}
+	} else {
+		client.connectionClass = ""
+	}
+	sessions := client.sessions
+	client.stateMutex.Unlock()
+
+	for _, session := range sessions {
+		if session.bridgeController == nil {
+			session.socket.SetMaxSendQ(maxSendQBytes)
+		}
+	}
+}
+
+// maxChannelsNoMutex returns how many channels a (non-operator) client may join.
+func (client *Client) maxChannelsNoMutex(config *Config) int {
+	if class := client.connectionClassNoMutex(); class != nil && class.MaxChannels != 0 {
+		return class.MaxChannels
+	}
+	return config.Channels.MaxChannelsPerClient
+}
+
+// idleTimeoutNoMutex returns how long a session may be idle before we PING it.
+func (session *Session) idleTimeoutNoMutex() time.Duration {
+	if session.isTor {
+		return TorIdleTimeout
+	}
+	if class := session.client.connectionClassNoMutex(); class != nil {
+		if class.UnidentifiedIdleTimeout != 0 && session.client.account == "" {
+			return class.UnidentifiedIdleTimeout
+		} else if class.IdleTimeout != 0 {
+			return class.IdleTimeout
+		}
+	}
+	return DefaultIdleTimeout
+}
+
+// totalTimeoutNoMutex returns how long a session may go without sending us
+// anything (including the PONG to our PING) before we disconnect it; this
+// is what reaps half-open connections.
+func (session *Session) totalTimeoutNoMutex() time.Duration {
+	if class := session.client.connectionClassNoMutex(); class != nil && class.PingTimeout != 0 {
+		return session.idleTimeoutNoMutex() + class.PingTimeout
+	}
+	if session.capabilities.Has(caps.Resume) {
+		return ResumeableTotalTimeout
+	}
+	return DefaultTotalTimeout
+}
+
+// registrationTimeout returns how long an unregistered client has to
+// complete registration before we disconnect it.
+func (client *Client) registrationTimeout() time.Duration {
+	if class := client.ConnectionClass(); class != nil && class.RegistrationTimeout != 0 {
+		return class.RegistrationTimeout
+	}
+	return RegisterTimeout
+}
+
+// reapStats counts sessions that were disconnected for inactivity.
+type reapStats struct {
+	// unregistered connections that timed out
+	registration uint64
+	// sessions that didn't answer our PING
+	ping uint64
+}
+
+// hiddenFromWho returns whether the client's connection class hides it from
+// WHO queries, as though it were invisible.
+func (client *Client) hiddenFromWho() bool {
+	class := client.ConnectionClass()
+	return class != nil && class.HideFromWho
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionClassMatching(t *testing.T) {
+	yes := true
+	var config Config
+	config.ConnectionClasses = make([]ConnectionClassConfig, 3)
+
+	opers := &config.ConnectionClasses[0]
+	opers.Name = "opers"
+	opers.Match.Opers = &yes
+
+	trusted := &config.ConnectionClasses[1]
+	trusted.Name = "trusted"
+	trusted.Match.IPs = []string{"10.0.0.0/8"}
+	trusted.Match.TLS = &yes
+	trusted.Match.Accounts = []string{"Shivaram", "dan"}
+	trusted.MaxSendQString = "1M"
+
+	accounts := &config.ConnectionClasses[2]
+	accounts.Name = "accounts"
+	accounts.Match.Accounts = []string{"*"}
+
+	if err := config.processConnectionClasses(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(trusted.maxSendQBytes, 1024*1024, t)
+	assertEqual(config.connectionClasses["trusted"], trusted, t)
+
+	internal, external := net.ParseIP("10.1.2.3"), net.ParseIP("8.8.8.8")
+	assertEqual(opers.matches(external, false, "", true), true, t)
+	assertEqual(opers.matches(external, false, "", false), false, t)
+
+	assertEqual(trusted.matches(internal, true, "shivaram", false), true, t)
+	assertEqual(trusted.matches(internal, true, "dan", true), true, t)
+	assertEqual(trusted.matches(internal, false, "shivaram", false), false, t)
+	assertEqual(trusted.matches(external, true, "shivaram", false), false, t)
+	assertEqual(trusted.matches(internal, true, "", false), false, t)
+	assertEqual(trusted.matches(internal, true, "slingamn", false), false, t)
+
+	assertEqual(accounts.matches(external, false, "slingamn", false), true, t)
+	assertEqual(accounts.matches(external, false, "", false), false, t)
+
+	config.ConnectionClasses = append(config.ConnectionClasses, ConnectionClassConfig{Name: "opers"})
+	if err := config.processConnectionClasses(); err == nil {
+		t.Errorf("accepted duplicate connection classes")
+	}
+}
+
+func TestConnectionClassTimeouts(t *testing.T) {
+	server := newTestServer()
+	config := server.Config()
+	config.ConnectionClasses = []ConnectionClassConfig{{
+		Name:                    "strict",
+		IdleTimeout:             5 * time.Minute,
+		UnidentifiedIdleTimeout: time.Minute,
+		PingTimeout:             30 * time.Second,
+		RegistrationTimeout:     20 * time.Second,
+	}}
+	if err := config.processConnectionClasses(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(server, "alice")
+	session := &Session{client: client}
+	assertEqual(client.registrationTimeout(), RegisterTimeout, t)
+	assertEqual(session.idleTimeoutNoMutex(), DefaultIdleTimeout, t)
+	assertEqual(session.totalTimeoutNoMutex(), DefaultTotalTimeout, t)
+
+	client.connectionClass = "strict"
+	assertEqual(client.registrationTimeout(), 20*time.Second, t)
+	assertEqual(session.idleTimeoutNoMutex(), time.Minute, t)
+	assertEqual(session.totalTimeoutNoMutex(), time.Minute+30*time.Second, t)
+	client.account = "alice"
+	assertEqual(session.idleTimeoutNoMutex(), 5*time.Minute, t)
+	assertEqual(session.totalTimeoutNoMutex(), 5*time.Minute+30*time.Second, t)
+}
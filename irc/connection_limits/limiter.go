@@ -5,8 +5,11 @@ package connection_limits
 
 import (
 	"crypto/md5"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -52,9 +55,20 @@ type rawLimiterConfig struct {
 	CidrLenIPv4 int `yaml:"cidr-len-ipv4"`
 	CidrLenIPv6 int `yaml:"cidr-len-ipv6"`
 
+	// maximum concurrent connections per IP/CIDR that haven't completed
+	// registration (0 for no limit)
+	MaxUnregistered int `yaml:"max-unregistered-connections"`
+
 	Exempted []string
 
 	CustomLimits map[string]CustomLimitConfig `yaml:"custom-limits"`
+
+	// limits on the sessions logged into a single account, from any IP;
+	// zero values disable the corresponding limit
+	Accounts struct {
+		MaxConcurrent int `yaml:"max-concurrent-sessions"`
+		MaxPerWindow  int `yaml:"max-sessions-per-window"`
+	}
 }
 
 type LimiterConfig struct {
@@ -120,6 +134,10 @@ type Limiter struct {
 	limiter map[limiterKey]int
 	// IP/CIDR -> throttle state:
 	throttler map[limiterKey]ThrottleDetails
+	// IP/CIDR -> count of connections from there that haven't registered yet:
+	unregistered map[limiterKey]int
+	// casefolded account name -> throttle state:
+	accountThrottler map[string]ThrottleDetails
 }
 
 // addrToKey canonicalizes `addr` to a string key, and returns
@@ -209,6 +227,76 @@ func (cl *Limiter) RemoveClient(addr flatip.IP) {
 	cl.limiter[addrString] = count
 }
 
+// AddUnregistered counts a new connection from `addr` that hasn't completed
+// registration, unless there are already too many of these.
+func (cl *Limiter) AddUnregistered(addr flatip.IP) error {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.config.MaxUnregistered == 0 || flatip.IPInNets(addr, cl.config.exemptedNets) {
+		return nil
+	}
+
+	key, _, _ := cl.addrToKey(addr)
+	count := cl.unregistered[key] + 1
+	if count > cl.config.MaxUnregistered {
+		return ErrLimitExceeded
+	}
+	cl.unregistered[key] = count
+	return nil
+}
+
+// RemoveUnregistered stops counting a connection from `addr`, either because
+// it completed registration or because it disconnected.
+func (cl *Limiter) RemoveUnregistered(addr flatip.IP) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if cl.config.MaxUnregistered == 0 || flatip.IPInNets(addr, cl.config.exemptedNets) {
+		return
+	}
+
+	key, _, _ := cl.addrToKey(addr)
+	if count := cl.unregistered[key] - 1; count > 0 {
+		cl.unregistered[key] = count
+	} else {
+		delete(cl.unregistered, key)
+	}
+}
+
+// AddAccountSession checks whether a new session from `addr` may log into
+// `account`, which already has `sessions` sessions, and counts it against
+// the account's throttle if so. The concurrent sessions of accounts are
+// tracked by the caller, not by the limiter.
+func (cl *Limiter) AddAccountSession(account string, addr flatip.IP, sessions int) error {
+	cl.Lock()
+	defer cl.Unlock()
+
+	if flatip.IPInNets(addr, cl.config.exemptedNets) {
+		return nil
+	}
+
+	limits := cl.config.Accounts
+	if limits.MaxConcurrent != 0 && limits.MaxConcurrent <= sessions {
+		return ErrLimitExceeded
+	}
+
+	if limits.MaxPerWindow != 0 {
+		g := GenericThrottle{
+			ThrottleDetails: cl.accountThrottler[account],
+			Duration:        cl.config.Window,
+			Limit:           limits.MaxPerWindow,
+		}
+		throttled, _ := g.Touch()
+		cl.accountThrottler[account] = g.ThrottleDetails
+		if throttled {
+			return ErrThrottleExceeded
+		}
+	}
+
+	return nil
+}
+
 // ResetThrottle resets the throttle count for an IP
 func (cl *Limiter) ResetThrottle(addr flatip.IP) {
 	cl.Lock()
@@ -222,6 +310,92 @@ func (cl *Limiter) ResetThrottle(addr flatip.IP) {
 	delete(cl.throttler, addrString)
 }
 
+// ThrottleState is a serializable snapshot of the throttle counters,
+// used to carry them across server restarts.
+type ThrottleState struct {
+	IPs      map[string]ThrottleDetails
+	Accounts map[string]ThrottleDetails
+}
+
+func (key limiterKey) String() string {
+	return fmt.Sprintf("%s/%d", hex.EncodeToString(key.maskedIP[:]), key.prefixLen)
+}
+
+func parseLimiterKey(str string) (key limiterKey, err error) {
+	slash := strings.IndexByte(str, '/')
+	if slash == -1 {
+		return key, fmt.Errorf("invalid limiter key %s", str)
+	}
+	ip, err := hex.DecodeString(str[:slash])
+	if err != nil || len(ip) != len(key.maskedIP) {
+		return key, fmt.Errorf("invalid limiter key %s", str)
+	}
+	prefixLen, err := strconv.ParseUint(str[slash+1:], 10, 8)
+	if err != nil {
+		return key, fmt.Errorf("invalid limiter key %s", str)
+	}
+	copy(key.maskedIP[:], ip)
+	key.prefixLen = uint8(prefixLen)
+	return key, nil
+}
+
+// a throttle entry whose window has elapsed has no effect on future
+// connections (see GenericThrottle.touch), so it can be discarded
+func (cl *Limiter) throttleExpired(details ThrottleDetails, now time.Time) bool {
+	return now.Sub(details.Start) > cl.config.Window || details.Start.After(now)
+}
+
+// ExportThrottles discards expired throttle entries, then returns
+// a snapshot of the remaining ones.
+func (cl *Limiter) ExportThrottles(now time.Time) (state ThrottleState) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	state.IPs = make(map[string]ThrottleDetails)
+	for key, details := range cl.throttler {
+		if cl.throttleExpired(details, now) {
+			delete(cl.throttler, key)
+		} else {
+			state.IPs[key.String()] = details
+		}
+	}
+	state.Accounts = make(map[string]ThrottleDetails)
+	for account, details := range cl.accountThrottler {
+		if cl.throttleExpired(details, now) {
+			delete(cl.accountThrottler, account)
+		} else {
+			state.Accounts[account] = details
+		}
+	}
+	return
+}
+
+// ImportThrottles restores throttle entries from a snapshot taken by
+// ExportThrottles. Entries whose window has elapsed in the meantime
+// are dropped, as are entries that would replace existing state.
+func (cl *Limiter) ImportThrottles(state ThrottleState, now time.Time) {
+	cl.Lock()
+	defer cl.Unlock()
+
+	for keyStr, details := range state.IPs {
+		key, err := parseLimiterKey(keyStr)
+		if err != nil || cl.throttleExpired(details, now) {
+			continue
+		}
+		if _, exists := cl.throttler[key]; !exists {
+			cl.throttler[key] = details
+		}
+	}
+	for account, details := range state.Accounts {
+		if cl.throttleExpired(details, now) {
+			continue
+		}
+		if _, exists := cl.accountThrottler[account]; !exists {
+			cl.accountThrottler[account] = details
+		}
+	}
+}
+
 // ApplyConfig atomically applies a config update to a connection limit handler
 func (cl *Limiter) ApplyConfig(config *LimiterConfig) {
 	cl.Lock()
@@ -233,6 +407,12 @@ func (cl *Limiter) ApplyConfig(config *LimiterConfig) {
 	if cl.throttler == nil {
 		cl.throttler = make(map[limiterKey]ThrottleDetails)
 	}
+	if cl.accountThrottler == nil {
+		cl.accountThrottler = make(map[string]ThrottleDetails)
+	}
+	if cl.unregistered == nil {
+		cl.unregistered = make(map[limiterKey]int)
+	}
 
 	cl.config = config
 }
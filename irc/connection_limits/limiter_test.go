@@ -93,3 +93,113 @@ func TestLimits(t *testing.T) {
 		t.Errorf("ip should not be blocked, but %v", err)
 	}
 }
+
+func TestAccountLimits(t *testing.T) {
+	regularIP := easyParseIP("2607:5301:201:3100::7426")
+	config := baseConfig
+	config.Accounts.MaxConcurrent = 2
+	config.Accounts.MaxPerWindow = 3
+	config.postprocess()
+	var limiter Limiter
+	limiter.ApplyConfig(&config)
+
+	assertEqual(limiter.AddAccountSession("dan", regularIP, 0), nil, t)
+	assertEqual(limiter.AddAccountSession("dan", regularIP, 1), nil, t)
+	assertEqual(limiter.AddAccountSession("dan", regularIP, 2), ErrLimitExceeded, t)
+	// rejections for the concurrent limit don't count against the throttle:
+	assertEqual(limiter.AddAccountSession("dan", regularIP, 1), nil, t)
+	assertEqual(limiter.AddAccountSession("dan", regularIP, 0), ErrThrottleExceeded, t)
+	// limits are per-account, and exempted IPs are not limited:
+	assertEqual(limiter.AddAccountSession("shivaram", regularIP, 0), nil, t)
+	assertEqual(limiter.AddAccountSession("dan", easyParseIP("127.0.0.1"), 5), nil, t)
+
+	// disabled limits:
+	config = baseConfig
+	config.postprocess()
+	limiter.ApplyConfig(&config)
+	for i := 0; i < 10; i++ {
+		assertEqual(limiter.AddAccountSession("dan", regularIP, i), nil, t)
+	}
+}
+
+func TestUnregisteredLimit(t *testing.T) {
+	regularIP := easyParseIP("2607:5301:201:3100::7426")
+	sameNetIP := easyParseIP("2607:5301:201:3100::1")
+	config := baseConfig
+	config.MaxUnregistered = 2
+	config.postprocess()
+	var limiter Limiter
+	limiter.ApplyConfig(&config)
+
+	assertEqual(limiter.AddUnregistered(regularIP), nil, t)
+	assertEqual(limiter.AddUnregistered(sameNetIP), nil, t)
+	assertEqual(limiter.AddUnregistered(regularIP), ErrLimitExceeded, t)
+	limiter.RemoveUnregistered(sameNetIP)
+	assertEqual(limiter.AddUnregistered(regularIP), nil, t)
+
+	// exempted:
+	localhost := easyParseIP("127.0.0.1")
+	for i := 0; i < 4; i++ {
+		assertEqual(limiter.AddUnregistered(localhost), nil, t)
+	}
+
+	// spurious removals don't go negative:
+	limiter.RemoveUnregistered(regularIP)
+	limiter.RemoveUnregistered(regularIP)
+	limiter.RemoveUnregistered(regularIP)
+	assertEqual(limiter.AddUnregistered(regularIP), nil, t)
+	assertEqual(limiter.AddUnregistered(regularIP), nil, t)
+	assertEqual(limiter.AddUnregistered(regularIP), ErrLimitExceeded, t)
+
+	config.MaxUnregistered = 0
+	for i := 0; i < 4; i++ {
+		assertEqual(limiter.AddUnregistered(regularIP), nil, t)
+	}
+}
+
+func TestThrottlePersistence(t *testing.T) {
+	regularIP := easyParseIP("2607:5301:201:3100::7426")
+	googleIP := easyParseIP("8.8.4.4")
+	config := baseConfig
+	config.MaxPerWindow = 2
+	config.Accounts.MaxPerWindow = 1
+	config.postprocess()
+	var limiter Limiter
+	limiter.ApplyConfig(&config)
+
+	assertEqual(limiter.AddClient(regularIP), nil, t)
+	assertEqual(limiter.AddClient(regularIP), nil, t)
+	assertEqual(limiter.AddClient(googleIP), nil, t)
+	assertEqual(limiter.AddAccountSession("dan", regularIP, 0), nil, t)
+
+	now := time.Now().UTC()
+	state := limiter.ExportThrottles(now)
+	assertEqual(len(state.IPs), 2, t)
+	assertEqual(len(state.Accounts), 1, t)
+
+	// a restarted limiter picks up where the old one left off:
+	var restored Limiter
+	restored.ApplyConfig(&config)
+	restored.ImportThrottles(state, now)
+	assertEqual(restored.AddClient(regularIP), ErrThrottleExceeded, t)
+	assertEqual(restored.AddAccountSession("dan", regularIP, 0), ErrThrottleExceeded, t)
+	key, _, _ := restored.addrToKey(googleIP)
+	assertEqual(restored.throttler[key].Count, 1, t)
+
+	// entries whose window has elapsed are dropped on load:
+	var later Limiter
+	later.ApplyConfig(&config)
+	later.ImportThrottles(state, now.Add(config.Window+time.Second))
+	assertEqual(len(later.throttler), 0, t)
+	assertEqual(len(later.accountThrottler), 0, t)
+	assertEqual(later.AddClient(regularIP), nil, t)
+
+	// and on export:
+	assertEqual(len(restored.ExportThrottles(now.Add(config.Window+time.Second)).IPs), 0, t)
+	assertEqual(len(restored.throttler), 0, t)
+
+	_, err := parseLimiterKey("bogus")
+	if err == nil {
+		t.Errorf("invalid key should not parse")
+	}
+}
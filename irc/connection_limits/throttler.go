@@ -49,3 +49,38 @@ func (g *GenericThrottle) touch(now time.Time) (throttled bool, remainingTime ti
 		return false, 0
 	}
 }
+
+// Reserve is like Touch, but for a quantity rather than a single event (e.g.,
+// a number of messages): it records and returns as much of `n` as the current
+// window allows. If none is allowed, it returns the time until the window resets.
+func (g *GenericThrottle) Reserve(n int) (granted int, remainingTime time.Duration) {
+	return g.reserve(time.Now().UTC(), n)
+}
+
+func (g *GenericThrottle) reserve(now time.Time, n int) (granted int, remainingTime time.Duration) {
+	if g.Limit == 0 {
+		return n, 0 // limit of 0 disables throttling
+	}
+
+	if now.Sub(g.Start) > g.Duration {
+		g.Start = now
+		g.Count = 0
+	}
+	granted = g.Limit - g.Count
+	if n < granted {
+		granted = n
+	}
+	if granted <= 0 {
+		return 0, g.Start.Add(g.Duration).Sub(now)
+	}
+	g.Count += granted
+	return granted, 0
+}
+
+// Release returns an unused part of a quantity obtained from Reserve.
+func (g *GenericThrottle) Release(n int) {
+	g.Count -= n
+	if g.Count < 0 {
+		g.Count = 0
+	}
+}
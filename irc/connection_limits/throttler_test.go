@@ -61,6 +61,42 @@ func TestGenericThrottleDisabled(t *testing.T) {
 	}
 }
 
+func TestGenericThrottleReserve(t *testing.T) {
+	throttler := GenericThrottle{
+		Duration: time.Minute,
+		Limit:    100,
+	}
+
+	now := time.Now()
+	granted, remaining := throttler.reserve(now, 60)
+	assertEqual(granted, 60, t)
+	assertEqual(remaining, time.Duration(0), t)
+
+	// only part of this is available:
+	now = now.Add(time.Second)
+	granted, _ = throttler.reserve(now, 60)
+	assertEqual(granted, 40, t)
+	throttler.Release(10)
+
+	now = now.Add(time.Second)
+	granted, _ = throttler.reserve(now, 60)
+	assertEqual(granted, 10, t)
+
+	now = now.Add(time.Second)
+	granted, remaining = throttler.reserve(now, 1)
+	assertEqual(granted, 0, t)
+	assertEqual(remaining, 57*time.Second, t)
+
+	// the window resets:
+	now = now.Add(time.Minute)
+	granted, _ = throttler.reserve(now, 60)
+	assertEqual(granted, 60, t)
+
+	throttler.Limit = 0
+	granted, _ = throttler.reserve(now, 1000)
+	assertEqual(granted, 1000, t)
+}
+
 func makeTestThrottler(v4len, v6len int) *Limiter {
 	minute, _ := time.ParseDuration("1m")
 	maxConnections := 3
@@ -9,6 +9,14 @@ const (
 	// maxLastArgLength is used to simply cap off the final argument when creating general messages where we need to select a limit.
 	// for instance, in MONITOR lists, RPL_ISUPPORT lists, etc.
 	maxLastArgLength = 400
-	// maxTargets is the maximum number of targets for PRIVMSG and NOTICE.
-	maxTargets = 4
+	// defaultMaxTargets is the default limit on targets for PRIVMSG, NOTICE,
+	// TAGMSG, and KICK (see limits.targmax).
+	defaultMaxTargets = 4
+	// maxUserhostTargets is the maximum number of nicknames for USERHOST.
+	maxUserhostTargets = 10
+	// defaultChanListPageSize is the default number of list mode entries
+	// sent at a time (see limits.chan-list-page-size).
+	defaultChanListPageSize = 100
+	// maxSessionLabelLen is the maximum length of a label set with SESSION LABEL.
+	maxSessionLabelLen = 64
 )
@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+
+	"github.com/oragono/oragono/irc/connection_limits"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/sno"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// CTCPAction is what happens to a CTCP that the server-wide policy disallows
+type CTCPAction uint
+
+const (
+	// CTCPActionBlock rejects the message with an error to the sender
+	CTCPActionBlock CTCPAction = iota
+	// CTCPActionStrip silently discards the message
+	CTCPActionStrip
+)
+
+func (action *CTCPAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var orig string
+	if err := unmarshal(&orig); err != nil {
+		return err
+	}
+	switch strings.ToLower(orig) {
+	case "", "block":
+		*action = CTCPActionBlock
+	case "strip":
+		*action = CTCPActionStrip
+	default:
+		return fmt.Errorf("invalid ctcp action: %s", orig)
+	}
+	return nil
+}
+
+type CTCPConfig struct {
+	BlockedTypes []string `yaml:"blocked-types"`
+	blockedTypes utils.StringSet
+	Action       CTCPAction
+	RateLimit    struct {
+		Window      time.Duration
+		MaxMessages int `yaml:"max-messages"`
+	} `yaml:"rate-limit"`
+	DCC struct {
+		BlockNonOpers     bool     `yaml:"block-non-opers"`
+		BlockedExtensions []string `yaml:"blocked-extensions"`
+		blockedExtensions utils.StringSet
+	}
+}
+
+func (cc *CTCPConfig) postprocess() {
+	cc.blockedTypes = make(utils.StringSet, len(cc.BlockedTypes))
+	for _, ctcpType := range cc.BlockedTypes {
+		cc.blockedTypes.Add(strings.ToUpper(ctcpType))
+	}
+	cc.DCC.blockedExtensions = make(utils.StringSet, len(cc.DCC.BlockedExtensions))
+	for _, extension := range cc.DCC.BlockedExtensions {
+		cc.DCC.blockedExtensions.Add("." + strings.TrimPrefix(strings.ToLower(extension), "."))
+	}
+}
+
+// ctcpType returns the (uppercased) type of a CTCP message, e.g., VERSION,
+// or the empty string if the message isn't a CTCP
+func ctcpType(message string) string {
+	if !strings.HasPrefix(message, "\x01") {
+		return ""
+	}
+	message = strings.TrimSuffix(message[1:], "\x01")
+	if space := strings.IndexByte(message, ' '); space != -1 {
+		message = message[:space]
+	}
+	return strings.ToUpper(message)
+}
+
+// checkCTCPPolicy enforces the server-wide CTCP policy on a message that is
+// known to be a restricted (i.e., non-ACTION) CTCP, returning whether it may
+// be relayed.
+func checkCTCPPolicy(client *Client, message string, histType history.ItemType, rb *ResponseBuffer) bool {
+	config := &client.server.Config().Server.CTCP
+	ctcp := ctcpType(message)
+
+	var errMsg string
+	if config.blockedTypes.Has(ctcp) {
+		errMsg = fmt.Sprintf(client.t("CTCP %s messages are not permitted on this server"), ctcp)
+	} else if config.RateLimit.MaxMessages != 0 && rb.session.checkCTCPThrottle(config) {
+		errMsg = client.t("You're sending CTCP messages too quickly; try again later")
+	} else {
+		return true
+	}
+
+	// note that error replies are never sent for NOTICE
+	if config.Action == CTCPActionBlock && histType != history.Notice {
+		rb.Notice(errMsg)
+	}
+	return false
+}
+
+// checkCTCPThrottle returns whether a CTCP from this session must be refused
+// because of the rate limit. Like fakelag, this is only accessed from the
+// session's own goroutine.
+func (session *Session) checkCTCPThrottle(config *CTCPConfig) (throttled bool) {
+	if session.ctcpThrottle == nil {
+		session.ctcpThrottle = &connection_limits.GenericThrottle{
+			Duration: config.RateLimit.Window,
+			Limit:    config.RateLimit.MaxMessages,
+		}
+	}
+	throttled, _ = session.ctcpThrottle.Touch()
+	return
+}
+
+// dccSendFilename returns the filename offered by a DCC SEND, e.g.,
+// \x01DCC SEND "my file.txt" 3232235777 5000 1024\x01, or "" for other messages
+func dccSendFilename(message string) (filename string) {
+	message = strings.TrimSuffix(strings.TrimPrefix(message, "\x01"), "\x01")
+	fields := strings.SplitN(message, " ", 3)
+	if len(fields) < 3 || strings.ToUpper(fields[0]) != "DCC" || strings.ToUpper(fields[1]) != "SEND" {
+		return ""
+	}
+	filename = fields[2]
+	if strings.HasPrefix(filename, "\"") {
+		if end := strings.IndexByte(filename[1:], '"'); end != -1 {
+			return filename[1 : end+1]
+		}
+		return filename[1:]
+	}
+	if space := strings.IndexByte(filename, ' '); space != -1 {
+		filename = filename[:space]
+	}
+	return
+}
+
+// dccExtension returns the lowercased extension of a filename, ignoring the
+// trailing dots and spaces that Windows would strip
+func dccExtension(filename string) string {
+	filename = strings.TrimRight(filename, ". ")
+	if dot := strings.LastIndexByte(filename, '.'); dot != -1 {
+		return strings.ToLower(filename[dot:])
+	}
+	return ""
+}
+
+// checkDCCPolicy enforces the server-wide DCC restrictions on a CTCP message
+// sent to `target`, which is nil when the target is a channel; it returns
+// whether the message may be relayed.
+func checkDCCPolicy(client *Client, target *Client, targetName string, message string, histType history.ItemType, rb *ResponseBuffer) bool {
+	if ctcpType(message) != "DCC" {
+		return true
+	}
+	config := &client.server.Config().Server.CTCP
+
+	var errMsg, logMsg string
+	if config.DCC.BlockNonOpers && client.Oper() == nil && (target == nil || target.Oper() == nil) {
+		errMsg = client.t("DCC is restricted to server operators on this server")
+		logMsg = "DCC"
+	} else if filename := dccSendFilename(message); filename != "" && config.DCC.blockedExtensions.Has(dccExtension(filename)) {
+		errMsg = fmt.Sprintf(client.t("DCC transfers of %s files are not permitted on this server"), dccExtension(filename))
+		logMsg = fmt.Sprintf("DCC SEND of %s", filename)
+	} else {
+		return true
+	}
+
+	client.server.snomasks.Send(sno.LocalDCC, fmt.Sprintf(ircfmt.Unescape("Blocked %[1]s from $c[grey][$r%[2]s$c[grey]] to $c[grey][$r%[3]s$c[grey]]"), logMsg, client.NickMaskString(), targetName))
+	if config.Action == CTCPActionBlock && histType != history.Notice {
+		rb.Notice(errMsg)
+	}
+	return false
+}
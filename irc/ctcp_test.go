@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+)
+
+func TestCTCPType(t *testing.T) {
+	assertEqual(ctcpType("\x01VERSION\x01"), "VERSION", t)
+	assertEqual(ctcpType("\x01version"), "VERSION", t)
+	assertEqual(ctcpType("\x01DCC SEND file 1 2 3\x01"), "DCC", t)
+	assertEqual(ctcpType("hello"), "", t)
+}
+
+func TestCTCPPolicy(t *testing.T) {
+	server := newTestServer()
+	config := server.Config()
+	config.Server.CTCP.BlockedTypes = []string{"finger"}
+	config.Server.CTCP.RateLimit.Window = time.Minute
+	config.Server.CTCP.RateLimit.MaxMessages = 2
+	config.Server.CTCP.postprocess()
+
+	client := newTestClient(server, "dan")
+	rb := NewResponseBuffer(&Session{client: client})
+
+	if checkCTCPPolicy(client, "\x01FINGER\x01", history.Privmsg, rb) {
+		t.Errorf("blocked CTCP types should be refused")
+	}
+	if len(rb.messages) != 1 {
+		t.Errorf("expected an error reply for a blocked CTCP, got %d messages", len(rb.messages))
+	}
+
+	for i := 0; i < 2; i++ {
+		if !checkCTCPPolicy(client, "\x01VERSION\x01", history.Privmsg, rb) {
+			t.Errorf("CTCP %d should be allowed", i)
+		}
+	}
+	if checkCTCPPolicy(client, "\x01VERSION\x01", history.Notice, rb) {
+		t.Errorf("CTCPs over the rate limit should be refused")
+	}
+	// no error replies are sent for NOTICE
+	if len(rb.messages) != 1 {
+		t.Errorf("expected no error reply for NOTICE, got %d messages", len(rb.messages))
+	}
+}
+
+func TestDCCSendFilename(t *testing.T) {
+	assertEqual(dccSendFilename("\x01DCC SEND file.txt 3232235777 5000 1024\x01"), "file.txt", t)
+	assertEqual(dccSendFilename("\x01DCC SEND \"my file.exe\" 3232235777 5000 1024\x01"), "my file.exe", t)
+	assertEqual(dccSendFilename("\x01dcc send evil.scr 0 0\x01"), "evil.scr", t)
+	assertEqual(dccSendFilename("\x01DCC CHAT chat 3232235777 5000\x01"), "", t)
+	assertEqual(dccSendFilename("\x01VERSION\x01"), "", t)
+
+	assertEqual(dccExtension("file.TXT"), ".txt", t)
+	assertEqual(dccExtension("evil.exe. . "), ".exe", t)
+	assertEqual(dccExtension("README"), "", t)
+}
+
+func TestDCCPolicy(t *testing.T) {
+	server := newTestServer()
+	config := server.Config()
+	config.Server.CTCP.DCC.BlockedExtensions = []string{"exe", ".SCR"}
+	config.Server.CTCP.postprocess()
+
+	client := newTestClient(server, "dan")
+	target := newTestClient(server, "evan")
+	rb := NewResponseBuffer(&Session{client: client})
+
+	if checkDCCPolicy(client, target, "evan", "\x01DCC SEND evil.exe 0 0\x01", history.Privmsg, rb) {
+		t.Errorf("DCC SEND of a blocked extension should be refused")
+	}
+	if checkDCCPolicy(client, target, "evan", "\x01DCC SEND \"evil.scr\" 0 0\x01", history.Privmsg, rb) {
+		t.Errorf("DCC SEND of a blocked extension should be refused")
+	}
+	if !checkDCCPolicy(client, target, "evan", "\x01DCC SEND photo.jpg 0 0\x01", history.Privmsg, rb) {
+		t.Errorf("DCC SEND of other files should be allowed")
+	}
+
+	config.Server.CTCP.DCC.BlockNonOpers = true
+	if checkDCCPolicy(client, target, "evan", "\x01DCC CHAT chat 0 0\x01", history.Privmsg, rb) {
+		t.Errorf("DCC between non-opers should be refused")
+	}
+	if !checkDCCPolicy(client, target, "evan", "\x01VERSION\x01", history.Privmsg, rb) {
+		t.Errorf("other CTCPs should be unaffected")
+	}
+	target.oper = &Oper{Name: "evan"}
+	if !checkDCCPolicy(client, target, "evan", "\x01DCC CHAT chat 0 0\x01", history.Privmsg, rb) {
+		t.Errorf("DCC to an oper should be allowed")
+	}
+}
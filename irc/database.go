@@ -5,9 +5,12 @@
 package irc
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
@@ -27,6 +30,15 @@ const (
 	latestDbSchema = 19
 
 	keyCloakSecret = "crypto.cloak_secret"
+	// the secret before the most recent rotation, and the time of the rotation
+	keyCloakSecretPrevious = "crypto.cloak_secret.previous"
+	keyCloakSecretRotated  = "crypto.cloak_secret.rotated"
+
+	// private key of the onion service published via Tor's control port
+	keyOnionServiceKey = "crypto.onion_service_key"
+
+	// connection and account throttle state, preserved across restarts
+	keyThrottleState = "limits.throttles"
 )
 
 type SchemaChanger func(*Config, *buntdb.Tx) error
@@ -141,74 +153,315 @@ func performAutoUpgrade(currentVersion int, config *Config) (err error) {
 		return err
 	}
 
-	err = UpgradeDB(config)
-	if err != nil {
-		// database upgrade is a single transaction, so we don't need to restore the backup;
+	applied, err := upgradeDB(config)
+	if err != nil && applied == 0 {
+		// nothing was committed, so we don't need to restore the backup;
 		// we can just delete it
 		os.Remove(backupPath)
+	} else if err != nil {
+		log.Printf("the backup of the database before the upgrade was retained at %s\n", backupPath)
 	}
 	return err
 }
 
 // UpgradeDB upgrades the datastore to the latest schema.
 func UpgradeDB(config *Config) (err error) {
+	_, err = upgradeDB(config)
+	return
+}
+
+// each schema change is committed in its own transaction: if one fails,
+// the datastore is left at the last version that was successfully reached,
+// and the next upgrade resumes from there.
+func upgradeDB(config *Config) (applied int, err error) {
 	// #715: test that the database exists
 	_, err = os.Stat(config.Datastore.Path)
 	if err != nil {
-		return err
+		return
 	}
 
 	store, err := buntdb.Open(config.Datastore.Path)
 	if err != nil {
-		return err
+		return
 	}
 	defer store.Close()
 
-	var version int
-	err = store.Update(func(tx *buntdb.Tx) error {
-		for {
-			vStr, _ := tx.Get(keySchemaVersion)
-			version, _ = strconv.Atoi(vStr)
-			if version == latestDbSchema {
-				// success!
-				break
-			}
-			change, ok := getSchemaChange(version)
-			if !ok {
-				// unable to upgrade to the desired version, roll back
-				return &utils.IncompatibleSchemaError{CurrentVersion: version, RequiredVersion: latestDbSchema}
-			}
-			log.Printf("attempting to update schema from version %d\n", version)
-			err := change.Changer(config, tx)
-			if err != nil {
-				return err
+	for {
+		var report MigrationReport
+		var done bool
+		err = store.Update(func(tx *buntdb.Tx) (err error) {
+			report, done, err = applyNextSchemaChange(config, tx, false)
+			return
+		})
+		if err != nil {
+			log.Printf("schema update failed and was rolled back: %v\n", err)
+			return
+		} else if done {
+			return
+		}
+		applied++
+		log.Printf("successfully updated schema to version %d\n", report.TargetVersion)
+	}
+}
+
+// MigrationReport describes the changes made by a single schema change.
+type MigrationReport struct {
+	InitialVersion int
+	TargetVersion  int
+	// numbers of keys created, changed, and removed (only counted
+	// for dry runs):
+	Added    int
+	Modified int
+	Deleted  int
+}
+
+// DryRunUpgradeDB applies the pending schema changes to an in-memory copy
+// of the datastore, implementing `oragono upgradedb --dry-run`. The datastore
+// itself is never modified, so this is safe to run while the server is running.
+func DryRunUpgradeDB(config *Config) (reports []MigrationReport, err error) {
+	store, err := loadDBSnapshot(config.Datastore.Path)
+	if err != nil {
+		return
+	}
+	defer store.Close()
+
+	for {
+		var report MigrationReport
+		var done bool
+		err = store.Update(func(tx *buntdb.Tx) (err error) {
+			report, done, err = applyNextSchemaChange(config, tx, true)
+			return
+		})
+		if err != nil || done {
+			return
+		}
+		reports = append(reports, report)
+	}
+}
+
+// applyNextSchemaChange applies the schema change for the datastore's current
+// version, or reports `done` if it is already at the latest version.
+func applyNextSchemaChange(config *Config, tx *buntdb.Tx, countChanges bool) (report MigrationReport, done bool, err error) {
+	vStr, _ := tx.Get(keySchemaVersion)
+	version, _ := strconv.Atoi(vStr)
+	if version == latestDbSchema {
+		return report, true, nil
+	}
+	change, ok := getSchemaChange(version)
+	if !ok {
+		// unable to upgrade to the desired version, roll back
+		err = &utils.IncompatibleSchemaError{CurrentVersion: version, RequiredVersion: latestDbSchema}
+		return
+	}
+	report.InitialVersion, report.TargetVersion = change.InitialVersion, change.TargetVersion
+
+	var before map[string]string
+	if countChanges {
+		before = dumpTx(tx)
+	} else {
+		log.Printf("attempting to update schema from version %d\n", version)
+	}
+	err = change.Changer(config, tx)
+	if err != nil {
+		return
+	}
+	if countChanges {
+		after := dumpTx(tx)
+		for key, value := range after {
+			if oldValue, ok := before[key]; !ok {
+				report.Added++
+			} else if oldValue != value {
+				report.Modified++
 			}
-			_, _, err = tx.Set(keySchemaVersion, strconv.Itoa(change.TargetVersion), nil)
-			if err != nil {
-				return err
+		}
+		for key := range before {
+			if _, ok := after[key]; !ok {
+				report.Deleted++
 			}
-			log.Printf("successfully updated schema to version %d\n", change.TargetVersion)
 		}
-		return nil
+	}
+	_, _, err = tx.Set(keySchemaVersion, strconv.Itoa(change.TargetVersion), nil)
+	return
+}
+
+func dumpTx(tx *buntdb.Tx) (result map[string]string) {
+	result = make(map[string]string)
+	tx.Ascend("", func(key, value string) bool {
+		result[key] = value
+		return true
 	})
+	return
+}
+
+// BackupDB writes a consistent snapshot of an open datastore to `path`,
+// implementing the BACKUP oper command. The snapshot blocks writes (but not
+// reads) while it is taken.
+func BackupDB(store *buntdb.DB, path string) error {
+	return writeDBSnapshot(store, path)
+}
 
+// BackupDBFile takes a snapshot of the configured datastore, implementing
+// the `oragono backup` command. It is safe to run while the server is running.
+func BackupDBFile(config *Config, path string) (version int, err error) {
+	store, err := loadDBSnapshot(config.Datastore.Path)
 	if err != nil {
-		log.Printf("database upgrade failed and was rolled back: %v\n", err)
+		return
 	}
-	return err
+	defer store.Close()
+
+	version, err = readSchemaVersion(store)
+	if err != nil {
+		return
+	}
+	err = writeDBSnapshot(store, path)
+	return
+}
+
+// RestoreDB replaces the configured datastore with the backup at `backupPath`,
+// implementing the `oragono restoredb` command. The server must be stopped.
+// Any existing datastore is moved aside rather than deleted, and is moved
+// back if the backup cannot be written in its place.
+func RestoreDB(config *Config, backupPath string) (version int, err error) {
+	store, err := loadDBSnapshot(backupPath)
+	if err != nil {
+		return
+	}
+	defer store.Close()
+
+	version, err = readSchemaVersion(store)
+	if err != nil {
+		return
+	}
+	if err = checkSchemaUpgradable(version); err != nil {
+		return
+	}
+
+	path := config.Datastore.Path
+	var previousPath string
+	if _, statErr := os.Stat(path); statErr == nil {
+		timestamp := time.Now().UTC().Format("2006-01-02-15:04:05.000Z")
+		previousPath = fmt.Sprintf("%s.%s.pre-restore.bak", path, timestamp)
+		log.Printf("moving current database to %s\n", previousPath)
+		if err = os.Rename(path, previousPath); err != nil {
+			return
+		}
+	}
+	err = writeDBSnapshot(store, path)
+	if err != nil && previousPath != "" {
+		if rbErr := os.Rename(previousPath, path); rbErr != nil {
+			log.Printf("could not move %s back to %s: %v\n", previousPath, path, rbErr)
+		}
+	}
+	return
+}
+
+// loadDBSnapshot reads a datastore file into memory without opening it for
+// writing, so that a live datastore is never modified. A read that races with
+// an in-progress append sees a truncated final record; retry in that case.
+func loadDBSnapshot(path string) (store *buntdb.DB, err error) {
+	for i := 0; i < 5; i++ {
+		var data []byte
+		data, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		store, err = buntdb.Open(":memory:")
+		if err != nil {
+			return nil, err
+		}
+		err = store.Load(bytes.NewReader(data))
+		if err == nil {
+			return store, nil
+		}
+		store.Close()
+		if err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("Could not read a consistent snapshot of %s: %w", path, err)
 }
 
-func LoadCloakSecret(db *buntdb.DB) (result string) {
+func readSchemaVersion(store *buntdb.DB) (version int, err error) {
+	err = store.View(func(tx *buntdb.Tx) error {
+		vStr, err := tx.Get(keySchemaVersion)
+		if err != nil {
+			return fmt.Errorf("Datastore has no schema version; is it an oragono database?")
+		}
+		version, err = strconv.Atoi(vStr)
+		return err
+	})
+	return
+}
+
+// checkSchemaUpgradable tests whether `oragono upgradedb` can bring a datastore
+// at `version` up to the latest schema.
+func checkSchemaUpgradable(version int) error {
+	for version != latestDbSchema {
+		change, ok := getSchemaChange(version)
+		if !ok {
+			return &utils.IncompatibleSchemaError{CurrentVersion: version, RequiredVersion: latestDbSchema}
+		}
+		version = change.TargetVersion
+	}
+	return nil
+}
+
+// writeDBSnapshot writes the contents of `store` to a new file at `path`;
+// the file only appears once it has been completely written.
+func writeDBSnapshot(store *buntdb.DB, path string) (err error) {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("Backup file already exists: %s", path)
+	}
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	err = store.Save(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	return
+}
+
+// LoadCloakSecrets returns the current cloak secret, together with the
+// previous secret and the time it was replaced (if it has been rotated)
+func LoadCloakSecrets(db *buntdb.DB) (secret, previous string, rotated time.Time) {
 	db.View(func(tx *buntdb.Tx) error {
-		result, _ = tx.Get(keyCloakSecret)
+		secret, _ = tx.Get(keyCloakSecret)
+		previous, _ = tx.Get(keyCloakSecretPrevious)
+		rotatedStr, _ := tx.Get(keyCloakSecretRotated)
+		if rotatedNanos, err := strconv.ParseInt(rotatedStr, 10, 64); err == nil {
+			rotated = time.Unix(0, rotatedNanos).UTC()
+		}
 		return nil
 	})
 	return
 }
 
+// StoreCloakSecret rotates the cloak secret, retaining the previous one
+// so that cloaks computed from it can still match bans for a grace period.
 func StoreCloakSecret(db *buntdb.DB, secret string) {
 	db.Update(func(tx *buntdb.Tx) error {
+		if previous, err := tx.Get(keyCloakSecret); err == nil && previous != secret {
+			tx.Set(keyCloakSecretPrevious, previous, nil)
+		}
 		tx.Set(keyCloakSecret, secret, nil)
+		tx.Set(keyCloakSecretRotated, strconv.FormatInt(time.Now().UnixNano(), 10), nil)
 		return nil
 	})
 }
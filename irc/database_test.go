@@ -0,0 +1,203 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+func setTestDBKey(t *testing.T, path, key, value string) {
+	store, err := buntdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	err = store.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(key, value, nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestDBKey(t *testing.T, path, key string) string {
+	store, err := loadDBSnapshot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var value string
+	store.View(func(tx *buntdb.Tx) error {
+		value, _ = tx.Get(key)
+		return nil
+	})
+	return value
+}
+
+func backupTestConfig(t *testing.T) (config *Config, dir string) {
+	dir, err := ioutil.TempDir("", "oragono-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = new(Config)
+	config.Datastore.Path = filepath.Join(dir, "ircd.db")
+	if err := InitDB(config.Datastore.Path); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestBackupRestoreRoundTrip(t *testing.T) {
+	config, dir := backupTestConfig(t)
+	defer os.RemoveAll(dir)
+	setTestDBKey(t, config.Datastore.Path, "test.key", "original")
+
+	backupPath := filepath.Join(dir, "backup.db")
+	version, err := BackupDBFile(config, backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestDbSchema {
+		t.Errorf("unexpected schema version %d", version)
+	}
+
+	// a backup never overwrites an existing file
+	if _, err := BackupDBFile(config, backupPath); err == nil {
+		t.Errorf("backup should refuse to overwrite an existing file")
+	}
+
+	// BackupDB snapshots a live datastore
+	store, err := buntdb.Open(config.Datastore.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	liveBackupPath := filepath.Join(dir, "live-backup.db")
+	err = BackupDB(store, liveBackupPath)
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getTestDBKey(t, liveBackupPath, "test.key") != "original" {
+		t.Errorf("live backup is missing data")
+	}
+
+	setTestDBKey(t, config.Datastore.Path, "test.key", "modified")
+	version, err = RestoreDB(config, backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != latestDbSchema {
+		t.Errorf("unexpected schema version %d", version)
+	}
+	if getTestDBKey(t, config.Datastore.Path, "test.key") != "original" {
+		t.Errorf("restore did not replace the datastore")
+	}
+
+	// the replaced datastore was moved aside, not deleted
+	matches, err := filepath.Glob(config.Datastore.Path + ".*.pre-restore.bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || getTestDBKey(t, matches[0], "test.key") != "modified" {
+		t.Errorf("previous datastore was not preserved: %v", matches)
+	}
+}
+
+func TestRestoreDBValidatesSchema(t *testing.T) {
+	config, dir := backupTestConfig(t)
+	defer os.RemoveAll(dir)
+
+	noSchemaPath := filepath.Join(dir, "noschema.db")
+	setTestDBKey(t, noSchemaPath, "test.key", "value")
+	if _, err := RestoreDB(config, noSchemaPath); err == nil {
+		t.Errorf("restore should reject a datastore with no schema version")
+	}
+
+	futurePath := filepath.Join(dir, "future.db")
+	setTestDBKey(t, futurePath, keySchemaVersion, strconv.Itoa(latestDbSchema+1))
+	if _, err := RestoreDB(config, futurePath); err == nil {
+		t.Errorf("restore should reject a datastore with an unknown schema version")
+	}
+
+	// the configured datastore is untouched by a rejected restore
+	matches, _ := filepath.Glob(config.Datastore.Path + ".*.pre-restore.bak")
+	if len(matches) != 0 {
+		t.Errorf("rejected restore moved the datastore aside: %v", matches)
+	}
+}
+
+func TestRestoreDBRollback(t *testing.T) {
+	config, dir := backupTestConfig(t)
+	defer os.RemoveAll(dir)
+	setTestDBKey(t, config.Datastore.Path, "test.key", "original")
+
+	backupPath := filepath.Join(dir, "backup.db")
+	if _, err := BackupDBFile(config, backupPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// a stale temporary file makes writing the snapshot fail
+	if err := ioutil.WriteFile(config.Datastore.Path+".tmp", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := RestoreDB(config, backupPath); err == nil {
+		t.Fatalf("restore should fail when the snapshot cannot be written")
+	}
+	if getTestDBKey(t, config.Datastore.Path, "test.key") != "original" {
+		t.Errorf("original datastore was not moved back after a failed restore")
+	}
+	matches, _ := filepath.Glob(config.Datastore.Path + ".*.pre-restore.bak")
+	if len(matches) != 0 {
+		t.Errorf("failed restore left the datastore moved aside: %v", matches)
+	}
+}
+
+func TestUpgradeDBResumable(t *testing.T) {
+	config, dir := backupTestConfig(t)
+	defer os.RemoveAll(dir)
+	path := config.Datastore.Path
+	setTestDBKey(t, path, keySchemaVersion, "18")
+	setTestDBKey(t, path, "account.joinedto alice", "#chat")
+
+	// a dry run reports the changes without making them:
+	reports, err := DryRunUpgradeDB(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(reports, []MigrationReport{{InitialVersion: 18, TargetVersion: 19, Added: 1, Deleted: 1}}, t)
+	assertEqual(getTestDBKey(t, path, keySchemaVersion), "18", t)
+	assertEqual(getTestDBKey(t, path, "account.joinedto alice"), "#chat", t)
+
+	// a failing change rolls back only itself, not the changes before it:
+	setTestDBKey(t, path, keySchemaVersion, "17")
+	realChanges := allChanges
+	allChanges = make([]SchemaChange, len(realChanges))
+	copy(allChanges, realChanges)
+	for i := range allChanges {
+		if allChanges[i].InitialVersion == 18 {
+			allChanges[i].Changer = func(*Config, *buntdb.Tx) error { return errInvalidParams }
+		}
+	}
+	applied, err := upgradeDB(config)
+	allChanges = realChanges
+	assertEqual(applied, 1, t)
+	assertEqual(err, errInvalidParams, t)
+	assertEqual(getTestDBKey(t, path, keySchemaVersion), "18", t)
+
+	// and the next upgrade resumes from there:
+	if err := UpgradeDB(config); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(getTestDBKey(t, path, keySchemaVersion), strconv.Itoa(latestDbSchema), t)
+	assertEqual(getTestDBKey(t, path, "account.joinedto alice"), "", t)
+	assertEqual(getTestDBKey(t, path, "account.channeltomodes alice"), `{"#chat":""}`, t)
+}
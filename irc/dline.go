@@ -55,14 +55,83 @@ func (info IPBanInfo) BanMessage(message string) string {
 	return message
 }
 
+// dlineTarget is what a D-line bans: an IP address or CIDR network, a glob
+// matching the hostnames that clients' IPs resolve to (e.g., *.vps.example.com),
+// or an autonomous system, identified by its number (e.g., AS64496).
+type dlineTarget struct {
+	network  flatip.IPNet // if this is a network ban
+	hostname string       // lowercased glob, if this is a hostname ban
+	asn      uint32       // if this is an ASN ban
+}
+
+func parseDlineTarget(str string) (target dlineTarget, err error) {
+	if asn, ok := parseASN(str); ok {
+		target.asn = asn
+		return
+	}
+	if network, netErr := utils.NormalizedNetFromString(str); netErr == nil {
+		target.network = flatip.FromNetIPNet(network)
+		return
+	}
+	// hostname globs must contain a letter, so they can't be confused
+	// with (mistyped) IPs or networks, and a dot, since resolved hostnames
+	// are fully qualified:
+	hostname := strings.ToLower(str)
+	if !strings.ContainsAny(hostname, "abcdefghijklmnopqrstuvwxyz") || !strings.Contains(hostname, ".") ||
+		strings.ContainsAny(hostname, "!@/: ") {
+		return target, errInvalidParams
+	}
+	if _, err = utils.CompileGlob(hostname, false); err != nil {
+		return target, errInvalidParams
+	}
+	target.hostname = hostname
+	return
+}
+
+// String returns the canonical form of the target, as used in the datastore.
+func (target dlineTarget) String() string {
+	if target.asn != 0 {
+		return fmt.Sprintf("AS%d", target.asn)
+	} else if target.hostname != "" {
+		return target.hostname
+	}
+	return target.network.String()
+}
+
+// Display returns the human-readable form of the target.
+func (target dlineTarget) Display() string {
+	if target.asn == 0 && target.hostname == "" {
+		return utils.NetToNormalizedString(target.network.ToNetIPNet())
+	}
+	return target.String()
+}
+
+// matchesSession returns whether the target covers an existing session,
+// for DLINE ANDKILL and the DLINE MYSELF check.
+func (target dlineTarget) matchesSession(session *Session, config *Config) bool {
+	ip := flatip.FromNetIP(session.IP())
+	if target.asn != 0 {
+		return config.Server.asnDatabase.Lookup(ip) == target.asn
+	} else if target.hostname != "" {
+		matcher, err := utils.CompileGlob(target.hostname, false)
+		return err == nil && matcher.MatchString(strings.ToLower(session.rawHostname))
+	}
+	return target.network.Contains(ip)
+}
+
 // DLineManager manages and dlines.
 type DLineManager struct {
 	sync.RWMutex                // tier 1
 	persistenceMutex sync.Mutex // tier 2
 	// networks that are dlined:
 	networks map[flatip.IPNet]IPBanInfo
-	// this keeps track of expiration timers for temporary bans
-	expirationTimers map[flatip.IPNet]*time.Timer
+	// hostname globs that are dlined (these reuse the K-line structure):
+	hostnames map[string]KLineInfo
+	// autonomous systems that are dlined:
+	asns map[uint32]IPBanInfo
+	// this keeps track of expiration timers for temporary bans,
+	// keyed by the canonical form of the target
+	expirationTimers map[string]*time.Timer
 	server           *Server
 }
 
@@ -70,7 +139,9 @@ type DLineManager struct {
 func NewDLineManager(server *Server) *DLineManager {
 	var dm DLineManager
 	dm.networks = make(map[flatip.IPNet]IPBanInfo)
-	dm.expirationTimers = make(map[flatip.IPNet]*time.Timer)
+	dm.hostnames = make(map[string]KLineInfo)
+	dm.asns = make(map[uint32]IPBanInfo)
+	dm.expirationTimers = make(map[string]*time.Timer)
 	dm.server = server
 
 	dm.loadFromDatastore()
@@ -88,12 +159,23 @@ func (dm *DLineManager) AllBans() map[string]IPBanInfo {
 	for key, info := range dm.networks {
 		allb[key.String()] = info
 	}
+	for hostname, kln := range dm.hostnames {
+		allb[hostname] = kln.Info
+	}
+	for asn, info := range dm.asns {
+		allb[dlineTarget{asn: asn}.String()] = info
+	}
 
 	return allb
 }
 
 // AddNetwork adds a network to the blocked list.
 func (dm *DLineManager) AddNetwork(network net.IPNet, duration time.Duration, reason, operReason, operName string) error {
+	return dm.AddTarget(dlineTarget{network: flatip.FromNetIPNet(network)}, duration, reason, operReason, operName)
+}
+
+// AddTarget adds a network, hostname glob, or ASN to the blocked list.
+func (dm *DLineManager) AddTarget(target dlineTarget, duration time.Duration, reason, operReason, operName string) error {
 	dm.persistenceMutex.Lock()
 	defer dm.persistenceMutex.Unlock()
 
@@ -106,14 +188,11 @@ func (dm *DLineManager) AddNetwork(network net.IPNet, duration time.Duration, re
 		Duration:    duration,
 	}
 
-	id := dm.addNetworkInternal(network, info)
-	return dm.persistDline(id, info)
+	dm.addTargetInternal(target, info)
+	return dm.persistDline(target, info)
 }
 
-func (dm *DLineManager) addNetworkInternal(network net.IPNet, info IPBanInfo) (id flatip.IPNet) {
-	flatnet := flatip.FromNetIPNet(network)
-	id = flatnet
-
+func (dm *DLineManager) addTargetInternal(target dlineTarget, info IPBanInfo) {
 	var timeLeft time.Duration
 	if info.Duration != 0 {
 		timeLeft = info.timeLeft()
@@ -122,12 +201,14 @@ func (dm *DLineManager) addNetworkInternal(network net.IPNet, info IPBanInfo) (i
 		}
 	}
 
+	id := target.String()
+
 	dm.Lock()
 	defer dm.Unlock()
 
-	dm.networks[flatnet] = info
+	dm.setNoMutex(target, info)
 
-	dm.cancelTimer(flatnet)
+	dm.cancelTimer(id)
 
 	if info.Duration == 0 {
 		return
@@ -139,44 +220,63 @@ func (dm *DLineManager) addNetworkInternal(network net.IPNet, info IPBanInfo) (i
 		dm.Lock()
 		defer dm.Unlock()
 
-		banInfo, ok := dm.networks[flatnet]
+		banInfo, ok := dm.getNoMutex(target)
 		if ok && banInfo.TimeCreated.Equal(timeCreated) {
-			delete(dm.networks, flatnet)
+			dm.deleteNoMutex(target)
 			// TODO(slingamn) here's where we'd remove it from the radix tree
-			delete(dm.expirationTimers, flatnet)
+			delete(dm.expirationTimers, id)
 		}
 	}
-	dm.expirationTimers[flatnet] = time.AfterFunc(timeLeft, processExpiration)
+	dm.expirationTimers[id] = time.AfterFunc(timeLeft, processExpiration)
+}
+
+func (dm *DLineManager) setNoMutex(target dlineTarget, info IPBanInfo) {
+	if target.asn != 0 {
+		dm.asns[target.asn] = info
+	} else if target.hostname != "" {
+		matcher, _ := utils.CompileGlob(target.hostname, false) // validated by parseDlineTarget
+		dm.hostnames[target.hostname] = KLineInfo{Mask: target.hostname, Matcher: matcher, Info: info}
+	} else {
+		dm.networks[target.network] = info
+	}
+}
 
+func (dm *DLineManager) getNoMutex(target dlineTarget) (info IPBanInfo, ok bool) {
+	if target.asn != 0 {
+		info, ok = dm.asns[target.asn]
+	} else if target.hostname != "" {
+		var kln KLineInfo
+		kln, ok = dm.hostnames[target.hostname]
+		info = kln.Info
+	} else {
+		info, ok = dm.networks[target.network]
+	}
 	return
 }
 
-func (dm *DLineManager) cancelTimer(flatnet flatip.IPNet) {
-	oldTimer := dm.expirationTimers[flatnet]
+func (dm *DLineManager) deleteNoMutex(target dlineTarget) {
+	if target.asn != 0 {
+		delete(dm.asns, target.asn)
+	} else if target.hostname != "" {
+		delete(dm.hostnames, target.hostname)
+	} else {
+		delete(dm.networks, target.network)
+	}
+}
+
+func (dm *DLineManager) cancelTimer(id string) {
+	oldTimer := dm.expirationTimers[id]
 	if oldTimer != nil {
 		oldTimer.Stop()
-		delete(dm.expirationTimers, flatnet)
+		delete(dm.expirationTimers, id)
 	}
 }
 
-func (dm *DLineManager) persistDline(id flatip.IPNet, info IPBanInfo) error {
+func (dm *DLineManager) persistDline(target dlineTarget, info IPBanInfo) error {
 	// save in datastore
-	dlineKey := fmt.Sprintf(keyDlineEntry, id.String())
-	// assemble json from ban info
-	b, err := json.Marshal(info)
-	if err != nil {
-		dm.server.logger.Error("internal", "couldn't marshal d-line", err.Error())
-		return err
-	}
-	bstr := string(b)
-	var setOptions *buntdb.SetOptions
-	if info.Duration != 0 {
-		setOptions = &buntdb.SetOptions{Expires: true, TTL: info.Duration}
-	}
-
-	err = dm.server.store.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(dlineKey, bstr, setOptions)
-		return err
+	dlineKey := fmt.Sprintf(keyDlineEntry, target.String())
+	err := dm.server.store.Update(func(tx *buntdb.Tx) error {
+		return persistBan(tx, dlineKey, info)
 	})
 	if err != nil {
 		dm.server.logger.Error("internal", "couldn't store d-line", err.Error())
@@ -184,8 +284,8 @@ func (dm *DLineManager) persistDline(id flatip.IPNet, info IPBanInfo) error {
 	return err
 }
 
-func (dm *DLineManager) unpersistDline(id flatip.IPNet) error {
-	dlineKey := fmt.Sprintf(keyDlineEntry, id.String())
+func (dm *DLineManager) unpersistDline(target dlineTarget) error {
+	dlineKey := fmt.Sprintf(keyDlineEntry, target.String())
 	return dm.server.store.Update(func(tx *buntdb.Tx) error {
 		_, err := tx.Delete(dlineKey)
 		return err
@@ -194,17 +294,20 @@ func (dm *DLineManager) unpersistDline(id flatip.IPNet) error {
 
 // RemoveNetwork removes a network from the blocked list.
 func (dm *DLineManager) RemoveNetwork(network net.IPNet) error {
+	return dm.RemoveTarget(dlineTarget{network: flatip.FromNetIPNet(network)})
+}
+
+// RemoveTarget removes a network, hostname glob, or ASN from the blocked list.
+func (dm *DLineManager) RemoveTarget(target dlineTarget) error {
 	dm.persistenceMutex.Lock()
 	defer dm.persistenceMutex.Unlock()
 
-	id := flatip.FromNetIPNet(network)
-
 	present := func() bool {
 		dm.Lock()
 		defer dm.Unlock()
-		_, ok := dm.networks[id]
-		delete(dm.networks, id)
-		dm.cancelTimer(id)
+		_, ok := dm.getNoMutex(target)
+		dm.deleteNoMutex(target)
+		dm.cancelTimer(target.String())
 		return ok
 	}()
 
@@ -212,7 +315,25 @@ func (dm *DLineManager) RemoveNetwork(network net.IPNet) error {
 		return errNoExistingBan
 	}
 
-	return dm.unpersistDline(id)
+	return dm.unpersistDline(target)
+}
+
+// ImportTarget adds a ban with existing ban info, e.g., from an imported
+// ban list. If a ban on the target already exists, it is replaced only if
+// `overwrite` is set. With `dryRun`, only the check for an existing ban is done.
+func (dm *DLineManager) ImportTarget(target dlineTarget, info IPBanInfo, overwrite, dryRun bool) (present bool, err error) {
+	dm.persistenceMutex.Lock()
+	defer dm.persistenceMutex.Unlock()
+
+	dm.RLock()
+	_, present = dm.getNoMutex(target)
+	dm.RUnlock()
+
+	if dryRun || (present && !overwrite) {
+		return
+	}
+	dm.addTargetInternal(target, info)
+	return present, dm.persistDline(target, info)
 }
 
 // AddIP adds an IP address to the blocked list.
@@ -245,6 +366,32 @@ func (dm *DLineManager) CheckIP(addr flatip.IP) (isBanned bool, info IPBanInfo)
 	return
 }
 
+// CheckHostname returns whether a (resolved) hostname is banned, and how long
+// it is banned for.
+func (dm *DLineManager) CheckHostname(hostname string) (isBanned bool, info IPBanInfo) {
+	hostname = strings.ToLower(hostname)
+
+	dm.RLock()
+	defer dm.RUnlock()
+
+	for _, kln := range dm.hostnames {
+		if kln.Matcher.MatchString(hostname) {
+			return true, kln.Info
+		}
+	}
+	return
+}
+
+// CheckASN returns whether an autonomous system is banned, and how long
+// it is banned for.
+func (dm *DLineManager) CheckASN(asn uint32) (isBanned bool, info IPBanInfo) {
+	dm.RLock()
+	defer dm.RUnlock()
+
+	info, isBanned = dm.asns[asn]
+	return
+}
+
 func (dm *DLineManager) loadFromDatastore() {
 	dlinePrefix := fmt.Sprintf(keyDlineEntry, "")
 	dm.server.store.View(func(tx *buntdb.Tx) error {
@@ -256,10 +403,10 @@ func (dm *DLineManager) loadFromDatastore() {
 			// get address name
 			key = strings.TrimPrefix(key, dlinePrefix)
 
-			// load addr/net
-			hostNet, err := utils.NormalizedNetFromString(key)
+			// load addr/net, hostname, or ASN
+			target, err := parseDlineTarget(key)
 			if err != nil {
-				dm.server.logger.Error("internal", "bad dline cidr", err.Error())
+				dm.server.logger.Error("internal", "bad dline target", key)
 				return true
 			}
 
@@ -277,7 +424,7 @@ func (dm *DLineManager) loadFromDatastore() {
 			}
 
 			// add to the server
-			dm.addNetworkInternal(hostNet, info)
+			dm.addTargetInternal(target, info)
 
 			return true
 		})
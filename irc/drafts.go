@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// drafts are a small per-account key-value store, which clients use via
+// the DRAFTS command to sync unsent messages, scroll positions, etc. across
+// devices. The keys and values are opaque to the server.
+
+const (
+	// the value is the last parameter of a DRAFTS ENTRY line, which must
+	// leave room for the server name, key, and timestamp:
+	maxDraftValueBytes     = 300
+	maxDraftKeyLength      = 64
+	defaultMaxDraftEntries = 100
+)
+
+var (
+	errDraftInvalidKey     = errors.New("invalid draft key")
+	errDraftValueTooLong   = errors.New("draft value is too long")
+	errDraftQuotaExceeded  = errors.New("too many drafts")
+	errDraftNoSuchKey      = errors.New("no such draft")
+	errDraftsInvalidConfig = fmt.Errorf("accounts.drafts.max-value-bytes cannot exceed %d", maxDraftValueBytes)
+)
+
+// DraftsConfig controls the DRAFTS command.
+type DraftsConfig struct {
+	Enabled       bool
+	MaxEntries    int `yaml:"max-entries"`
+	MaxValueBytes int `yaml:"max-value-bytes"`
+}
+
+func (conf *DraftsConfig) prepare() error {
+	if conf.MaxEntries <= 0 {
+		conf.MaxEntries = defaultMaxDraftEntries
+	}
+	if conf.MaxValueBytes <= 0 {
+		conf.MaxValueBytes = maxDraftValueBytes
+	} else if conf.MaxValueBytes > maxDraftValueBytes {
+		return errDraftsInvalidConfig
+	}
+	return nil
+}
+
+// DraftEntry is a single stored draft.
+type DraftEntry struct {
+	Value string
+	Time  time.Time
+}
+
+func validDraftKey(key string) bool {
+	return key != "" && len(key) <= maxDraftKeyLength && key[0] != ':' &&
+		!strings.ContainsAny(key, " ,\x00\r\n")
+}
+
+func loadDraftsTx(tx *buntdb.Tx, account string) (drafts map[string]DraftEntry) {
+	text, err := tx.Get(fmt.Sprintf(keyAccountDrafts, account))
+	if err == nil {
+		json.Unmarshal([]byte(text), &drafts)
+	}
+	if drafts == nil {
+		drafts = make(map[string]DraftEntry)
+	}
+	return
+}
+
+func saveDraftsTx(tx *buntdb.Tx, account string, drafts map[string]DraftEntry) {
+	key := fmt.Sprintf(keyAccountDrafts, account)
+	if len(drafts) == 0 {
+		tx.Delete(key)
+		return
+	}
+	text, _ := json.Marshal(drafts)
+	tx.Set(key, string(text), nil)
+}
+
+// LoadDrafts returns all of an account's drafts.
+func (am *AccountManager) LoadDrafts(account string) (drafts map[string]DraftEntry) {
+	am.server.store.View(func(tx *buntdb.Tx) error {
+		drafts = loadDraftsTx(tx, account)
+		return nil
+	})
+	return
+}
+
+// SetDraft stores a draft, or deletes it if the value is empty. Deleting
+// a nonexistent draft is an error.
+func (am *AccountManager) SetDraft(account, key, value string, config *DraftsConfig) (entry DraftEntry, err error) {
+	if !validDraftKey(key) {
+		return entry, errDraftInvalidKey
+	}
+	if config.MaxValueBytes < len(value) {
+		return entry, errDraftValueTooLong
+	}
+	entry = DraftEntry{Value: value, Time: time.Now().UTC()}
+
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		drafts := loadDraftsTx(tx, account)
+		_, exists := drafts[key]
+		if value == "" {
+			if !exists {
+				return errDraftNoSuchKey
+			}
+			delete(drafts, key)
+		} else {
+			if !exists && config.MaxEntries <= len(drafts) {
+				return errDraftQuotaExceeded
+			}
+			drafts[key] = entry
+		}
+		saveDraftsTx(tx, account, drafts)
+		return nil
+	})
+	return
+}
+
+// ClearDrafts deletes all of an account's drafts.
+func (am *AccountManager) ClearDrafts(account string) {
+	am.server.store.Update(func(tx *buntdb.Tx) error {
+		tx.Delete(fmt.Sprintf(keyAccountDrafts, account))
+		return nil
+	})
+}
+
+// subscribeDrafts makes the session receive changes to its account's
+// drafts made by other sessions.
+func (session *Session) subscribeDrafts() {
+	atomic.StoreUint32(&session.draftsSubscribed, 1)
+}
+
+// notifyDrafts sends a change to an account's drafts to every subscribed
+// session of that account, except `origin`, which has its own reply.
+func (server *Server) notifyDrafts(account string, origin *Session, params ...string) {
+	for _, client := range server.accounts.AccountToClients(account) {
+		for _, session := range client.Sessions() {
+			if session != origin && atomic.LoadUint32(&session.draftsSubscribed) == 1 {
+				session.Send(nil, server.name, "DRAFTS", params...)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+)
+
+func TestDrafts(t *testing.T) {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	server := newTestServer()
+	server.store = store
+	am := &AccountManager{server: server}
+	config := DraftsConfig{MaxEntries: 2}
+	if err := config.prepare(); err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := am.SetDraft("alice", "draft/#chat", "half-written message", &config)
+	assertEqual(err, nil, t)
+	assertEqual(entry.Value, "half-written message", t)
+	_, err = am.SetDraft("alice", "scroll/#chat", "msgid-1", &config)
+	assertEqual(err, nil, t)
+	// overwriting doesn't count against the quota:
+	_, err = am.SetDraft("alice", "scroll/#chat", "msgid-2", &config)
+	assertEqual(err, nil, t)
+	_, err = am.SetDraft("alice", "draft/bob", "hi", &config)
+	assertEqual(err, errDraftQuotaExceeded, t)
+
+	drafts := am.LoadDrafts("alice")
+	assertEqual(len(drafts), 2, t)
+	assertEqual(drafts["scroll/#chat"].Value, "msgid-2", t)
+	assertEqual(len(am.LoadDrafts("bob")), 0, t)
+
+	_, err = am.SetDraft("alice", "draft/#chat", "", &config)
+	assertEqual(err, nil, t)
+	_, err = am.SetDraft("alice", "draft/#chat", "", &config)
+	assertEqual(err, errDraftNoSuchKey, t)
+	_, err = am.SetDraft("alice", "has space", "x", &config)
+	assertEqual(err, errDraftInvalidKey, t)
+	_, err = am.SetDraft("alice", "long", strings.Repeat("x", maxDraftValueBytes+1), &config)
+	assertEqual(err, errDraftValueTooLong, t)
+
+	am.ClearDrafts("alice")
+	assertEqual(len(am.LoadDrafts("alice")), 0, t)
+
+	config.MaxValueBytes = maxDraftValueBytes + 1
+	assertEqual(config.prepare(), errDraftsInvalidConfig, t)
+}
@@ -28,7 +28,10 @@ var (
 	errAccountAlreadyLoggedIn         = errors.New("You're already logged into an account")
 	errAccountTooManyNicks            = errors.New("Account has too many reserved nicks")
 	errAccountUnverified              = errors.New(`Account is not yet verified`)
+	errAccountNoEmail                 = errors.New(`Account has no e-mail address`)
 	errAccountSuspended               = errors.New(`Account has been suspended`)
+	errAccountTooManySessions         = errors.New(`Too many sessions are logged into this account`)
+	errAccountSessionsThrottled       = errors.New(`Too many recent logins to this account; try again later`)
 	errAccountVerificationFailed      = errors.New("Account verification failed")
 	errAccountVerificationInvalidCode = errors.New("Invalid account verification code")
 	errAccountUpdateFailed            = errors.New(`Error while updating your account information`)
@@ -51,6 +54,7 @@ var (
 	errNickAccountMismatch            = errors.New(`Your nickname must match your account name; try logging out and logging back in with SASL`)
 	errNoExistingBan                  = errors.New("Ban does not exist")
 	errNoSuchChannel                  = errors.New(`No such channel`)
+	errNoSuchNick                     = errors.New(`No such nick`)
 	errChannelPurged                  = errors.New(`This channel was purged by the server operators and cannot be used`)
 	errConfusableIdentifier           = errors.New("This identifier is confusable with one already in use")
 	errInsufficientPrivs              = errors.New("Insufficient privileges")
@@ -59,6 +63,7 @@ var (
 	errBanned                         = errors.New("IP or nickmask banned")
 	errInvalidParams                  = utils.ErrInvalidParams
 	errNoVhost                        = errors.New(`You do not have an approved vhost`)
+	errVhostTakeCooldown              = errors.New(`You took a vhost too recently`)
 	errLimitExceeded                  = errors.New("Limit exceeded")
 	errNoop                           = errors.New("Action was a no-op")
 	errCASFailed                      = errors.New("Compare-and-swap update of database value failed")
@@ -73,7 +78,7 @@ var (
 	errInviteOnly                     = errors.New("Cannot join invite-only channel without an invite")
 	errRegisteredOnly                 = errors.New("Cannot join registered-only channel without an account")
 	errValidEmailRequired             = errors.New("A valid email address is required for account registration")
-	errInvalidAccountRename           = errors.New("Account renames can only change the casefolding of the account name")
+	errReadOnly                       = errors.New("The server is in read-only mode")
 )
 
 // String Errors
@@ -98,3 +103,20 @@ type ThrottleError struct {
 func (te *ThrottleError) Error() string {
 	return fmt.Sprintf(`Please wait at least %v and try again`, te.Duration)
 }
+
+// AccountSuspendedError is returned for a login to a suspended account;
+// its message includes the reason given by the suspending operator.
+type AccountSuspendedError struct {
+	AccountSuspension
+}
+
+func (se *AccountSuspendedError) Error() string {
+	message := errAccountSuspended.Error()
+	if se.Reason != "" {
+		message = fmt.Sprintf(`%s: %s`, message, se.Reason)
+	}
+	if se.Duration != 0 {
+		message = fmt.Sprintf(`%s (until %s)`, message, se.TimeCreated.Add(se.Duration).Format(time.RFC1123))
+	}
+	return message
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// extbans are list masks of the form ~x:argument, which match clients by
+// something other than (or in addition to) their nick!user@host
+const (
+	extbanPrefix = "~"
+
+	extbanAccount  = 'a' // ~a:account, matches the client's account name
+	extbanChannel  = 'c' // ~c:#channel, matches members of another channel
+	extbanJoin     = 'j' // ~j:mask, only prevents joining the channel
+	extbanMute     = 'q' // ~q:mask, prevents speaking in the channel
+	extbanRealname = 'r' // ~r:realname, matches the client's realname
+
+	// value of the EXTBAN isupport token
+	extbanISupport = "~,acjqr"
+)
+
+// extbanMatcher is a compiled extban that matches a client by an attribute
+// other than the nick!user@host (those are handled by UserMaskSet's regexps)
+type extbanMatcher struct {
+	kind    byte
+	pattern *regexp.Regexp
+}
+
+func (m extbanMatcher) Matches(client *Client) bool {
+	switch m.kind {
+	case extbanAccount:
+		account := client.Account()
+		return account != "" && m.pattern.MatchString(account)
+	case extbanRealname:
+		return m.pattern.MatchString(strings.ToLower(client.Realname()))
+	case extbanChannel:
+		for _, channel := range client.Channels() {
+			if m.pattern.MatchString(channel.NameCasefolded()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitExtban splits ~x:argument into the type and the argument
+func splitExtban(mask string) (kind byte, arg string, ok bool) {
+	if !strings.HasPrefix(mask, extbanPrefix) || len(mask) < 4 || mask[2] != ':' {
+		return
+	}
+	return mask[1], mask[3:], true
+}
+
+// canonicalizeListMask canonicalizes an entry for a channel list mode,
+// either a nick!user@host mask or an extban
+func canonicalizeListMask(mask string) (result string, err error) {
+	mask = strings.TrimSpace(mask)
+	if !strings.HasPrefix(mask, extbanPrefix) {
+		return CanonicalizeMaskWildcard(mask)
+	}
+	return canonicalizeExtban(mask, true)
+}
+
+func canonicalizeExtban(mask string, allowNested bool) (result string, err error) {
+	kind, arg, ok := splitExtban(mask)
+	if !ok {
+		return "", errInvalidParams
+	}
+	switch kind {
+	case extbanAccount:
+		arg, err = casefoldWildcard(arg, CasefoldName)
+	case extbanChannel:
+		arg, err = casefoldWildcard(arg, CasefoldChannel)
+	case extbanRealname:
+		arg = strings.ToLower(arg)
+	case extbanJoin, extbanMute:
+		// these wrap either a nick!user@host mask or another extban
+		if !allowNested {
+			return "", errInvalidParams
+		}
+		if strings.HasPrefix(arg, extbanPrefix) {
+			arg, err = canonicalizeExtban(arg, false)
+		} else {
+			arg, err = CanonicalizeMaskWildcard(arg)
+		}
+	default:
+		return "", errInvalidParams
+	}
+	if err != nil {
+		return
+	}
+	result = extbanPrefix + string(kind) + ":" + arg
+	if utils.SafeErrorParam(result) != result {
+		err = errInvalidCharacter
+	}
+	return
+}
+
+// casefoldWildcard casefolds a name that may contain wildcards; since the
+// wildcard characters break casefolding, those are only lowercased
+func casefoldWildcard(name string, casefold func(string) (string, error)) (string, error) {
+	if name == "" {
+		return "", errInvalidParams
+	}
+	if strings.ContainsAny(name, "*?") {
+		return strings.ToLower(name), nil
+	}
+	return casefold(name)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestCanonicalizeExtban(t *testing.T) {
+	cases := map[string]string{
+		"~a:Dan":          "~a:dan",
+		"~a:Dan*":         "~a:dan*",
+		"~c:#Oragono":     "~c:#oragono",
+		"~r:*Bot*":        "~r:*bot*",
+		"~q:Horse":        "~q:horse!*@*",
+		"~j:*!~evan@*":    "~j:*!~evan@*",
+		"~q:~a:Dan":       "~q:~a:dan",
+		"*!*@Example.COM": "*!*@example.com",
+		"m:horse!*@*":     "m:horse!*@*",
+		"  ~a:dan  ":      "~a:dan",
+	}
+	for input, expected := range cases {
+		result, err := canonicalizeListMask(input)
+		if err != nil || result != expected {
+			t.Errorf("canonicalizing %s: expected %s, got %s (%v)", input, expected, result, err)
+		}
+	}
+
+	for _, invalid := range []string{"~a:", "~x:foo", "~q:~q:dan", "~j:~q:dan", "~a"} {
+		if _, err := canonicalizeListMask(invalid); err == nil {
+			t.Errorf("%s should be an invalid extban", invalid)
+		}
+	}
+}
+
+func TestExtbanMatching(t *testing.T) {
+	server := newTestServer()
+	dan := newTestClient(server, "dan")
+	dan.nickMaskCasefolded = "dan!u@example.com"
+	dan.account = "dan"
+	dan.realname = "Dan the Bot"
+	other := newTestChannel(server, "#other")
+	dan.channels = ChannelSet{other: {}}
+
+	evan := newTestClient(server, "evan")
+	evan.nickMaskCasefolded = "evan!u@example.com"
+	evan.realname = "Evan"
+
+	matches := func(mask string, client *Client) bool {
+		set := NewUserMaskSet()
+		if _, err := set.Add(mask, "", ""); err != nil {
+			t.Fatal(err)
+		}
+		return set.MatchClient(client)
+	}
+
+	for _, mask := range []string{"~a:dan", "~a:d*", "~r:*bot*", "~c:#other", "~c:#oth*", "~j:dan", "~j:~a:dan"} {
+		if !matches(mask, dan) {
+			t.Errorf("%s should match dan", mask)
+		}
+		if matches(mask, evan) {
+			t.Errorf("%s should not match evan", mask)
+		}
+	}
+
+	// unregistered clients never match account extbans
+	if matches("~a:*", evan) {
+		t.Errorf("~a:* should not match an unregistered client")
+	}
+
+	// mutes match only as mutes
+	set := NewUserMaskSet()
+	set.Add("~q:~a:dan", "", "")
+	set.Add("~q:evan", "", "")
+	if set.MatchClient(dan) || set.MatchClient(evan) {
+		t.Errorf("mute extbans should not ban")
+	}
+	if !set.MatchMuteClient(dan) || !set.MatchMuteClient(evan) {
+		t.Errorf("mute extbans should mute")
+	}
+}
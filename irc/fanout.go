@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Delivering a message to a channel means copying it into the send queue of
+// every member's sessions; the actual writes happen asynchronously (see
+// Socket.Write). For large channels, even the copying adds visible latency
+// to the sender, so the members are split into chunks that are delivered in
+// parallel by a bounded number of workers. The sender waits for all the
+// chunks to be delivered, so messages from a single sender are not reordered.
+
+const (
+	// channels with at least this many members get parallel delivery, unless
+	// server.fanout.parallel-threshold says otherwise (a negative value disables it)
+	defaultFanoutThreshold = 1000
+	// the smallest number of members a worker will deliver to
+	minFanoutChunkSize = 64
+)
+
+type fanoutStats struct {
+	// number of deliveries that were split among workers
+	parallel uint64
+	// number of chunks delivered by the sender's goroutine because
+	// all the workers were busy
+	overflow uint64
+}
+
+// fanout calls deliver for each member, in parallel if there are at least
+// server.fanout.parallel-threshold of them. deliver must be safe for
+// concurrent use.
+func (server *Server) fanout(members []*Client, deliver func(member *Client)) {
+	threshold := server.Config().Server.Fanout.ParallelThreshold
+	if threshold <= 0 || len(members) < threshold {
+		for _, member := range members {
+			deliver(member)
+		}
+		return
+	}
+
+	atomic.AddUint64(&server.fanoutStats.parallel, 1)
+	chunkSize := threshold / 2
+	if chunkSize < minFanoutChunkSize {
+		chunkSize = minFanoutChunkSize
+	}
+	deliverChunk := func(chunk []*Client) {
+		for _, member := range chunk {
+			deliver(member)
+		}
+	}
+	var wg sync.WaitGroup
+	for start := chunkSize; start < len(members); start += chunkSize {
+		end := start + chunkSize
+		if end > len(members) {
+			end = len(members)
+		}
+		chunk := members[start:end]
+		if server.semaphores.Fanout.TryAcquire() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer server.semaphores.Fanout.Release()
+				deliverChunk(chunk)
+			}()
+		} else {
+			atomic.AddUint64(&server.fanoutStats.overflow, 1)
+			deliverChunk(chunk)
+		}
+	}
+	// the sender's goroutine always takes the first chunk:
+	if chunkSize > len(members) {
+		chunkSize = len(members)
+	}
+	deliverChunk(members[:chunkSize])
+	wg.Wait()
+}
+
+// sendQStats returns the number of sessions with data waiting in their
+// sendQ, and the total and largest sizes of the waiting data in bytes.
+func (server *Server) sendQStats() (backlogged, total, largest int) {
+	server.clients.Range(func(client *Client) bool {
+		for _, session := range client.Sessions() {
+			length := session.socket.QueueLength()
+			if length != 0 {
+				backlogged++
+				total += length
+				if largest < length {
+					largest = length
+				}
+			}
+		}
+		return true
+	})
+	return
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func testFanout(t *testing.T, server *Server, numMembers int) {
+	members := make([]*Client, numMembers)
+	for i := range members {
+		members[i] = newTestClient(server, fmt.Sprintf("user%d", i))
+	}
+	var mutex sync.Mutex
+	delivered := make(map[*Client]int)
+	server.fanout(members, func(member *Client) {
+		mutex.Lock()
+		delivered[member]++
+		mutex.Unlock()
+	})
+	if len(delivered) != numMembers {
+		t.Fatalf("expected %d deliveries, got %d", numMembers, len(delivered))
+	}
+	for _, member := range members {
+		if delivered[member] != 1 {
+			t.Errorf("%s received %d copies", member.nick, delivered[member])
+		}
+	}
+}
+
+func TestFanout(t *testing.T) {
+	server := newTestServer()
+	server.Config().Server.Fanout.ParallelThreshold = 100
+	server.semaphores.Fanout.Initialize(2)
+
+	testFanout(t, server, 0)
+	testFanout(t, server, 99)
+	assertEqual(server.fanoutStats.parallel, uint64(0), t)
+	// 10 chunks, the first delivered inline and at most 2 by workers at a time:
+	testFanout(t, server, 640)
+	assertEqual(server.fanoutStats.parallel, uint64(1), t)
+	testFanout(t, server, 1001)
+
+	// with no workers available, everything is delivered inline:
+	server.semaphores.Fanout.Initialize(0)
+	testFanout(t, server, 640)
+	assertEqual(server.fanoutStats.overflow >= 9, true, t)
+
+	server.Config().Server.Fanout.ParallelThreshold = -1
+	testFanout(t, server, 1001)
+	assertEqual(server.fanoutStats.parallel, uint64(3), t)
+}
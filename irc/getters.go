@@ -46,6 +46,14 @@ func (server *Server) SetDefcon(defcon uint32) {
 	atomic.StoreUint32(&server.defcon, defcon)
 }
 
+func (server *Server) ReadOnly() bool {
+	return atomic.LoadUint32(&server.readOnly) == 1
+}
+
+func (server *Server) Draining() bool {
+	return atomic.LoadUint32(&server.draining) == 1
+}
+
 func (client *Client) Sessions() (sessions []*Session) {
 	client.stateMutex.RLock()
 	sessions = client.sessions
@@ -72,6 +80,7 @@ type SessionData struct {
 	hostname  string
 	certfp    string
 	deviceID  string
+	label     string
 	connInfo  string
 	sessionID int64
 }
@@ -92,6 +101,7 @@ func (client *Client) AllSessionData(currentSession *Session, hasPrivs bool) (da
 			hostname:  session.rawHostname,
 			certfp:    session.certfp,
 			deviceID:  session.deviceID,
+			label:     session.label,
 			sessionID: session.sessionID,
 		}
 		if session.proxiedIP != nil {
@@ -106,6 +116,12 @@ func (client *Client) AllSessionData(currentSession *Session, hasPrivs bool) (da
 	return
 }
 
+func (session *Session) SetLabel(label string) {
+	session.client.stateMutex.Lock()
+	defer session.client.stateMutex.Unlock()
+	session.label = label
+}
+
 func (client *Client) AddSession(session *Session) (success bool, numSessions int, lastSeen time.Time, back bool) {
 	client.stateMutex.Lock()
 	defer client.stateMutex.Unlock()
@@ -132,6 +148,10 @@ func (client *Client) AddSession(session *Session) (success bool, numSessions in
 		client.away = false
 		client.awayMessage = ""
 	}
+	if client.autoDeaf {
+		client.autoDeaf = false
+		client.SetMode(modes.UserDeaf, false)
+	}
 	return true, len(client.sessions), lastSeen, back
 }
 
@@ -182,6 +202,12 @@ func (client *Client) NickMaskCasefolded() string {
 	return client.nickMaskCasefolded
 }
 
+func (client *Client) CloakedHostname() string {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.cloakedHostname
+}
+
 func (client *Client) Username() string {
 	client.stateMutex.RLock()
 	defer client.stateMutex.RUnlock()
@@ -294,16 +320,19 @@ func (client *Client) Login(account ClientAccount) {
 	client.account = account.NameCasefolded
 	client.accountName = account.Name
 	client.accountSettings = account.Settings
+	client.silenced = compileSilenceList(account.Settings.Silence)
 	// mark always-on here: it will not be respected until the client is registered
-	client.alwaysOn = alwaysOn
+	// (puppets can't be always-on, since they go away with their bridge)
+	client.alwaysOn = alwaysOn && client.bridge == ""
 	client.accountRegDate = account.RegisteredAt
 	return
 }
 
-func (client *Client) setAccountName(name string) {
+func (client *Client) setAccountName(account, name string) {
 	// XXX this assumes validation elsewhere
 	client.stateMutex.Lock()
 	defer client.stateMutex.Unlock()
+	client.account = account
 	client.accountName = name
 }
 
@@ -325,6 +354,7 @@ func (client *Client) Logout() {
 	client.alwaysOn = false
 	client.accountRegDate = time.Time{}
 	client.accountSettings = AccountSettings{}
+	client.silenced = nil
 	client.stateMutex.Unlock()
 }
 
@@ -342,7 +372,7 @@ func (client *Client) SetAccountSettings(settings AccountSettings) {
 	client.stateMutex.Lock()
 	if client.registered {
 		// only allow the client to become always-on if their nick equals their account name
-		alwaysOn = alwaysOn && client.nick == client.accountName
+		alwaysOn = alwaysOn && client.nick == client.accountName && client.bridge == ""
 		autoreplayMissedDisabled = (client.accountSettings.AutoreplayMissed && !settings.AutoreplayMissed)
 		becameAlwaysOn = (!client.alwaysOn && alwaysOn)
 		client.alwaysOn = alwaysOn
@@ -352,6 +382,7 @@ func (client *Client) SetAccountSettings(settings AccountSettings) {
 		}
 	}
 	client.accountSettings = settings
+	client.silenced = compileSilenceList(settings.Silence)
 	client.stateMutex.Unlock()
 	if becameAlwaysOn {
 		client.markDirty(IncludeAllAttrs)
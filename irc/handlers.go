@@ -10,14 +10,18 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"regexp"
 	"runtime"
 	"runtime/debug"
 	"runtime/pprof"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircfmt"
@@ -61,12 +65,23 @@ func parseCallback(spec string, config *Config) (callbackNamespace string, callb
 	return
 }
 
+// parseEmail validates and normalizes a new e-mail address for an existing account
+func parseEmail(spec string) (address string, err error) {
+	address = strings.TrimPrefix(strings.ToLower(spec), "mailto:")
+	if strings.IndexByte(address, '@') < 1 {
+		err = errValidEmailRequired
+	}
+	return
+}
+
 func registrationErrorToMessage(err error) (message string) {
 	switch err {
 	case errAccountAlreadyRegistered, errAccountAlreadyVerified, errAccountAlreadyUnregistered, errAccountAlreadyLoggedIn, errAccountCreation, errAccountMustHoldNick, errAccountBadPassphrase, errCertfpAlreadyExists, errFeatureDisabled, errAccountBadPassphrase:
 		message = err.Error()
 	case errLimitExceeded:
 		message = `There have been too many registration attempts recently; try again later`
+	case errConfusableIdentifier:
+		message = `That account name is too similar to the name of an existing account`
 	case errCallbackFailed:
 		message = `Could not dispatch verification email`
 	default:
@@ -86,6 +101,10 @@ func sendSuccessfulRegResponse(service *ircService, client *Client, rb *Response
 		rb.Add(nil, client.server.name, RPL_REG_SUCCESS, details.nick, details.accountName, client.t("Account created"))
 	}
 	client.server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] registered account $c[grey][$r%s$c[grey]] from IP %s"), details.nickMask, details.accountName, rb.session.IP().String()))
+	client.server.webhooks.Send(WebhookAccountRegister, webhookData{
+		"account": details.accountName,
+		"client":  webhookClientData(client, details),
+	})
 	sendSuccessfulAccountAuth(service, client, rb, false)
 }
 
@@ -114,6 +133,11 @@ func sendSuccessfulAccountAuth(service *ircService, client *Client, rb *Response
 			rb.Add(nil, details.nickMask, "ACCOUNT", details.accountName)
 		}
 		client.server.sendLoginSnomask(details.nickMask, details.accountName)
+		// the server default was applied on registration, but the account's own
+		// choice can only be applied now:
+		if channels := client.AccountSettings().AutoJoin; channels != nil {
+			client.server.autoJoin(client, *channels, rb)
+		}
 	}
 
 	client.server.logger.Info("accounts", "client", details.nick, "logged into account", details.accountName)
@@ -123,6 +147,66 @@ func (server *Server) sendLoginSnomask(nickMask, accountName string) {
 	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] logged into account $c[grey][$r%s$c[grey]]"), nickMask, accountName))
 }
 
+// ANNOUNCE <ALL | ACCOUNTS | #channel,...> <message>
+func announceHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	scope, message := msg.Params[0], msg.Params[1]
+	if strings.TrimSpace(message) == "" {
+		rb.Fail("ANNOUNCE", "BLANK_MSG", client.t("The message must not be blank"))
+		return false
+	}
+
+	recipients := make(ClientSet)
+	switch strings.ToUpper(scope) {
+	case "ALL":
+		server.clients.Range(func(target *Client) bool {
+			recipients.Add(target)
+			return true
+		})
+	case "ACCOUNTS":
+		server.clients.Range(func(target *Client) bool {
+			if target.Account() != "" {
+				recipients.Add(target)
+			}
+			return true
+		})
+	default:
+		var channels []*Channel
+		for _, chname := range strings.Split(scope, ",") {
+			channel := server.channels.Get(chname)
+			if channel == nil {
+				rb.FailNumeric(ERR_NOSUCHCHANNEL, "ANNOUNCE", "NO_SUCH_CHANNEL", utils.SafeErrorParam(chname), client.t("No such channel"))
+				return false
+			}
+			channels = append(channels, channel)
+		}
+		for _, channel := range channels {
+			for _, member := range channel.Members() {
+				recipients.Add(member)
+			}
+		}
+	}
+
+	if throttled, remainingTime := client.checkAnnounceThrottle(server.Config()); throttled {
+		rb.Fail("ANNOUNCE", "RATE_LIMITED", fmt.Sprintf(client.t("You're sending announcements too quickly; try again in %v"), remainingTime.Round(time.Second)))
+		return false
+	}
+
+	for target := range recipients {
+		target.Send(nil, server.name, "NOTICE", target.Nick(), fmt.Sprintf(target.t("[Network announcement] %s"), message))
+	}
+
+	rb.Notice(fmt.Sprintf(client.t("Your announcement was sent to %d users"), len(recipients)))
+	operName := client.Oper().Name
+	server.logger.Info("opers", fmt.Sprintf("Operator %s [%s] sent an announcement to %s (%d users): %s", client.Nick(), operName, scope, len(recipients), message))
+	server.snomasks.Send(sno.LocalAnnouncements, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] sent an announcement to %s (%d users): %s"), client.NickMaskString(), scope, len(recipients), message))
+	hookData := webhookOperData(client, "announce")
+	hookData["scope"] = scope
+	hookData["message"] = message
+	hookData["recipients"] = len(recipients)
+	server.webhooks.Send(WebhookOper, hookData)
+	return false
+}
+
 // AUTHENTICATE [<mechanism>|<data>|*]
 func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	session := rb.session
@@ -200,6 +284,13 @@ func authenticateHandler(server *Server, client *Client, msg ircmsg.IrcMessage,
 		}
 	}
 
+	// external services can replace our own account system
+	if server.servicesLink.BuiltinServicesDisabled() {
+		server.servicesLink.Authenticate(client, session.sasl.mechanism, data, rb)
+		session.sasl.Clear()
+		return false
+	}
+
 	// call actual handler
 	handler, handlerExists := EnabledSaslMechanisms[session.sasl.mechanism]
 
@@ -271,9 +362,13 @@ func authErrorToMessage(server *Server, err error) (msg string) {
 	if throttled, ok := err.(*ThrottleError); ok {
 		return throttled.Error()
 	}
+	if suspended, ok := err.(*AccountSuspendedError); ok {
+		return suspended.Error()
+	}
 
 	switch err {
-	case errAccountDoesNotExist, errAccountUnverified, errAccountInvalidCredentials, errAuthzidAuthcidMismatch, errNickAccountMismatch, errAccountSuspended:
+	case errAccountDoesNotExist, errAccountUnverified, errAccountInvalidCredentials, errAuthzidAuthcidMismatch, errNickAccountMismatch,
+		errAccountTooManySessions, errAccountSessionsThrottled:
 		return err.Error()
 	default:
 		// don't expose arbitrary error messages to the user
@@ -362,6 +457,101 @@ func dispatchAwayNotify(client *Client, isAway bool, awayMessage string) {
 	}
 }
 
+// BACKUP
+func backupHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	timestamp := time.Now().UTC().Format("2006-01-02-15:04:05.000Z")
+	path := fmt.Sprintf("%s.%s.bak", server.Config().Datastore.Path, timestamp)
+	err := BackupDB(server.store, path)
+	if err != nil {
+		server.logger.Error("server", "datastore backup failed", err.Error())
+		rb.Fail("BACKUP", "UNKNOWN_ERROR", client.t("Could not back up the datastore"))
+		return false
+	}
+	server.logger.Info("server", "datastore backed up to", path, "by", client.Oper().Name)
+	server.snomasks.Send(sno.LocalAnnouncements, fmt.Sprintf("%s [%s] backed up the datastore", client.Nick(), client.Oper().Name))
+	rb.Notice(fmt.Sprintf(client.t("Datastore backed up to %s"), path))
+	return false
+}
+
+// BANS IMPORT <filename> [OVERWRITE] [DRYRUN] [JSON|PLAIN]
+// BANS EXPORT <filename> [JSON|PLAIN]
+func bansHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	subcommand := strings.ToLower(msg.Params[0])
+	if (subcommand != "import" && subcommand != "export") || len(msg.Params) < 2 {
+		rb.Notice(client.t("Invalid parameters"))
+		return false
+	}
+	// ban lists are read from and written to the datastore's directory;
+	// opers shouldn't be able to read or write arbitrary files:
+	filename := msg.Params[1]
+	if filename != filepath.Base(filename) || filename == "." || filename == ".." {
+		rb.Notice(client.t("Filenames must not contain a directory"))
+		return false
+	}
+	path := filepath.Join(filepath.Dir(server.Config().Datastore.Path), filename)
+
+	var overwrite, dryRun bool
+	var format string
+	for _, param := range msg.Params[2:] {
+		switch param = strings.ToLower(param); param {
+		case "overwrite":
+			overwrite = true
+		case "dryrun":
+			dryRun = true
+		case banListFormatJSON, banListFormatPlain:
+			format = param
+		default:
+			rb.Notice(client.t("Invalid parameters"))
+			return false
+		}
+	}
+
+	operName := client.Oper().Name
+	if subcommand == "export" {
+		data, err := server.ExportBans(format)
+		if err == nil {
+			err = ioutil.WriteFile(path, data, 0600)
+		}
+		if err != nil {
+			server.logger.Error("server", "couldn't export bans", err.Error())
+			rb.Notice(fmt.Sprintf(client.t("Could not export bans: %s"), err.Error()))
+			return false
+		}
+		server.logger.Info("server", "bans exported to", path, "by", operName)
+		rb.Notice(fmt.Sprintf(client.t("Bans exported to %s"), path))
+		return false
+	}
+
+	if !dryRun && rejectReadOnly(server, client, msg.Command, rb) {
+		return false
+	}
+	data, err := ioutil.ReadFile(path)
+	var result BanImportResult
+	if err == nil {
+		result, err = server.ImportBans(data, format, operName, overwrite, dryRun)
+	}
+	if err != nil {
+		rb.Notice(fmt.Sprintf(client.t("Could not import bans: %s"), err.Error()))
+		return false
+	}
+	const maxErrorsShown = 10
+	for i, banErr := range result.Errors {
+		if i == maxErrorsShown {
+			rb.Notice(fmt.Sprintf(client.t("...and %d more invalid entries"), len(result.Errors)-maxErrorsShown))
+			break
+		}
+		rb.Notice(fmt.Sprintf(client.t("Invalid entry: %s"), banErr))
+	}
+	if dryRun {
+		rb.Notice(fmt.Sprintf(client.t("Dry run of import from %[1]s: %[2]s"), path, result.Summary()))
+	} else {
+		rb.Notice(fmt.Sprintf(client.t("Imported bans from %[1]s: %[2]s"), path, result.Summary()))
+		server.logger.Info("server", "bans imported from", path, "by", operName, result.Summary())
+		server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s [%s]$r imported bans from %s: %s"), client.Nick(), operName, filename, result.Summary()))
+	}
+	return false
+}
+
 // BATCH {+,-}reference-tag type [params...]
 func batchHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	tag := msg.Params[0]
@@ -399,7 +589,7 @@ func batchHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	if fail {
 		rb.session.EndMultilineBatch("")
 		if sendErrors {
-			rb.Add(nil, server.name, "FAIL", "BATCH", "MULTILINE_INVALID", client.t("Invalid multiline batch"))
+			rb.Fail("BATCH", "MULTILINE_INVALID", client.t("Invalid multiline batch"))
 		}
 	}
 
@@ -410,7 +600,7 @@ func batchHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 func brbHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	success, duration := client.brbTimer.Enable()
 	if !success {
-		rb.Add(nil, server.name, "FAIL", "BRB", "CANNOT_BRB", client.t("Your client does not support BRB"))
+		rb.Fail("BRB", "CANNOT_BRB", client.t("Your client does not support BRB"))
 		return false
 	} else {
 		rb.Add(nil, server.name, "BRB", strconv.Itoa(int(duration.Seconds())))
@@ -431,6 +621,111 @@ func brbHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Respo
 	return true
 }
 
+// commands that make no sense for a puppet, or that would let it escape its bridge
+var bridgeForbiddenCommands = utils.StringSet{
+	"AUTHENTICATE": {}, "BRB": {}, "BRIDGE": {}, "CAP": {}, "PASS": {}, "RESUME": {}, "USER": {}, "WEBIRC": {},
+}
+
+// BRIDGE AUTH <name> <token>
+// BRIDGE INTRODUCE <nick> <username> <realname>
+// BRIDGE AS <nick> <command> [<params>...]
+// BRIDGE REMOVE <nick> [<reason>]
+func bridgeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	subcommand := strings.ToUpper(msg.Params[0])
+	minParams := map[string]int{"AUTH": 3, "INTRODUCE": 4, "AS": 3, "REMOVE": 2}[subcommand]
+	if minParams == 0 {
+		rb.Fail("BRIDGE", "UNKNOWN_COMMAND", utils.SafeErrorParam(msg.Params[0]), client.t("Unknown subcommand"))
+		return false
+	} else if len(msg.Params) < minParams {
+		rb.Fail("BRIDGE", "NEED_MORE_PARAMS", subcommand, client.t("Not enough parameters"))
+		return false
+	}
+
+	if subcommand == "AUTH" {
+		switch err := server.authenticateBridge(rb.session, msg.Params[1], msg.Params[2]); err {
+		case nil:
+			rb.Add(nil, server.name, "BRIDGE", "AUTH", msg.Params[1])
+		case errBridgeNeedsTags:
+			rb.Fail("BRIDGE", "NEED_CAP", client.t("Bridges must negotiate the message-tags capability"))
+		case errBridgeAlreadyAuth:
+			rb.Fail("BRIDGE", "ALREADY_AUTHENTICATED", client.t("You are already authenticated as a bridge"))
+		case errBridgeAuth:
+			rb.Fail("BRIDGE", "INVALID_CREDENTIALS", client.t("Invalid bridge name or token"))
+		default:
+			rb.Fail("BRIDGE", "RATE_LIMITED", err.Error())
+		}
+		return false
+	}
+
+	if rb.session.bridge == nil {
+		rb.Fail("BRIDGE", "NOT_AUTHENTICATED", client.t("You must authenticate as a bridge first"))
+		return false
+	}
+
+	if subcommand == "INTRODUCE" {
+		nick, err := server.introducePuppet(rb.session, msg.Params[1], msg.Params[2], msg.Params[3])
+		switch err {
+		case nil:
+			rb.Add(nil, server.name, "BRIDGE", "INTRODUCE", nick)
+		case errBridgeTooMany:
+			rb.Fail("BRIDGE", "TOO_MANY_PUPPETS", client.t("This bridge has too many puppets"))
+		case errInvalidUsername:
+			rb.Fail("BRIDGE", "INVALID_USERNAME", utils.SafeErrorParam(msg.Params[2]), client.t("Invalid username"))
+		case errNicknameInUse:
+			rb.Fail("BRIDGE", "NICKNAME_IN_USE", utils.SafeErrorParam(msg.Params[1]), client.t("Nickname is already in use"))
+		case errNicknameReserved:
+			rb.Fail("BRIDGE", "NICKNAME_RESERVED", utils.SafeErrorParam(msg.Params[1]), client.t("Nickname is reserved by a different account"))
+		case errBanned:
+			rb.Fail("BRIDGE", "BANNED", utils.SafeErrorParam(msg.Params[1]), client.t("The puppet is banned from this server"))
+		default:
+			rb.Fail("BRIDGE", "INVALID_NICK", utils.SafeErrorParam(msg.Params[1]), client.t("Invalid nickname"))
+		}
+		return false
+	}
+
+	puppet, err := server.getPuppet(rb.session, msg.Params[1])
+	var session *Session
+	if err == nil {
+		session = puppet.puppetSession()
+	}
+	if session == nil {
+		rb.Fail("BRIDGE", "UNKNOWN_PUPPET", utils.SafeErrorParam(msg.Params[1]), client.t("No such puppet"))
+		return false
+	}
+
+	switch subcommand {
+	case "AS":
+		command := strings.ToUpper(msg.Params[2])
+		if bridgeForbiddenCommands.Has(command) {
+			rb.Fail("BRIDGE", "FORBIDDEN_COMMAND", command, client.t("Puppets cannot use that command"))
+			return false
+		}
+		// the label (if any) goes with the command, so the puppet's response is labeled:
+		inner := ircmsg.MakeMessage(msg.AllTags(), "", command, msg.Params[3:]...)
+		rb.Label = ""
+		cmd, exists := Commands[inner.Command]
+		if !exists {
+			if alias := server.Config().aliases[inner.Command]; alias != nil {
+				cmd, inner = alias.resolve(inner, puppet.Nick())
+			} else {
+				cmd = unknownCommand
+			}
+		}
+		if cmd.Run(server, puppet, session, inner) {
+			// QUIT
+			puppet.destroy(nil)
+		}
+	case "REMOVE":
+		reason := client.t("Removed by bridge")
+		if 2 < len(msg.Params) {
+			reason = msg.Params[2]
+		}
+		puppet.Quit(reason, nil)
+		puppet.destroy(nil)
+	}
+	return false
+}
+
 // CAP <subcmd> [<caps>]
 func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	details := client.Details()
@@ -443,6 +738,8 @@ func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Respo
 	supportedCaps := config.Server.supportedCaps
 	if client.isSTSOnly {
 		supportedCaps = stsOnlyCaps
+	} else if overrides := rb.session.listenerOverrides(config); overrides != nil && overrides.supportedCaps != nil {
+		supportedCaps = overrides.supportedCaps
 	} else if rb.session.hideSTS {
 		supportedCaps = config.Server.supportedCapsWithoutSTS
 	}
@@ -551,22 +848,37 @@ func capHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Respo
 // CHATHISTORY <target> BETWEEN <query> <query> <direction> [<limit>]
 // e.g., CHATHISTORY #ircv3 BETWEEN timestamp=YYYY-MM-DDThh:mm:ss.sssZ timestamp=YYYY-MM-DDThh:mm:ss.sssZ + 100
 func chathistoryHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) (exiting bool) {
+	if strings.ToLower(msg.Params[0]) == "targets" {
+		// TARGETS has no target of its own, so it's answered separately
+		return chathistoryTargetsHandler(server, client, msg, rb)
+	}
+
 	var items []history.Item
 	unknown_command := false
 	var target string
 	var channel *Channel
 	var sequence history.Sequence
 	var err error
+	var retryAfter time.Duration
+	var truncated bool
+	var start, end history.Selector
+	config := server.Config()
+	maxChathistoryLimit := config.History.ChathistoryMax
 	defer func() {
 		// errors are sent either without a batch, or in a draft/labeled-response batch as usual
 		if unknown_command {
-			rb.Add(nil, server.name, "FAIL", "CHATHISTORY", "UNKNOWN_COMMAND", utils.SafeErrorParam(msg.Params[0]), client.t("Unknown command"))
+			rb.Fail("CHATHISTORY", "UNKNOWN_COMMAND", utils.SafeErrorParam(msg.Params[0]), client.t("Unknown command"))
 		} else if err == utils.ErrInvalidParams {
-			rb.Add(nil, server.name, "FAIL", "CHATHISTORY", "INVALID_PARAMS", msg.Params[0], client.t("Invalid parameters"))
+			rb.Fail("CHATHISTORY", "INVALID_PARAMS", msg.Params[0], client.t("Invalid parameters"))
 		} else if sequence == nil {
-			rb.Add(nil, server.name, "FAIL", "CHATHISTORY", "INVALID_TARGET", utils.SafeErrorParam(target), client.t("Messages could not be retrieved"))
+			rb.Fail("CHATHISTORY", "INVALID_TARGET", utils.SafeErrorParam(target), client.t("Messages could not be retrieved"))
+		} else if retryAfter != 0 {
+			perMinute := config.History.ChathistoryMaxPerMinute
+			seconds := int(retryAfter.Round(time.Second) / time.Second)
+			rb.Fail("CHATHISTORY", "RATE_LIMITED", msg.Params[0], strconv.Itoa(perMinute), strconv.Itoa(seconds),
+				fmt.Sprintf(client.t("You can retrieve at most %[1]d messages per minute; try again in %[2]d seconds"), perMinute, seconds))
 		} else if err != nil {
-			rb.Add(nil, server.name, "FAIL", "CHATHISTORY", "MESSAGE_ERROR", msg.Params[0], client.t("Messages could not be retrieved"))
+			rb.Fail("CHATHISTORY", "MESSAGE_ERROR", msg.Params[0], client.t("Messages could not be retrieved"))
 		} else {
 			// successful responses are sent as a chathistory or history batch
 			if channel != nil {
@@ -574,11 +886,16 @@ func chathistoryHandler(server *Server, client *Client, msg ircmsg.IrcMessage, r
 			} else {
 				client.replayPrivmsgHistory(rb, items, target, true)
 			}
+			// if we returned fewer messages than they asked for, tell them how to get the rest
+			if truncated {
+				if params := chathistoryContinuation(msg.Params, start, end, items, maxChathistoryLimit); params != nil {
+					rb.Note("CHATHISTORY", "MORE_AVAILABLE", append(params,
+						fmt.Sprintf(client.t("Results were limited to %[1]d messages; use CHATHISTORY %[2]s to see more"), len(items), strings.Join(params, " ")))...)
+				}
+			}
 		}
 	}()
 
-	config := server.Config()
-	maxChathistoryLimit := config.History.ChathistoryMax
 	if maxChathistoryLimit == 0 {
 		return
 	}
@@ -591,27 +908,20 @@ func chathistoryHandler(server *Server, client *Client, msg ircmsg.IrcMessage, r
 			// using BEFORE * as a synonym for LATEST *
 			return
 		}
-		err = utils.ErrInvalidParams
-		pieces := strings.SplitN(param, "=", 2)
-		if len(pieces) < 2 {
-			return
-		}
-		identifier, value := strings.ToLower(pieces[0]), pieces[1]
-		if identifier == "msgid" {
-			msgid, err = value, nil
-			return
-		} else if identifier == "timestamp" {
-			timestamp, err = time.Parse(IRCv3TimestampFormat, value)
-			return
-		}
-		return
+		selector, err := parseChathistorySelector(param)
+		return selector.Msgid, selector.Time, err
 	}
 
+	// the number of messages the client asked for, which may be more than we allow:
+	requested := maxChathistoryLimit
 	parseHistoryLimit := func(paramIndex int) (limit int) {
 		if len(msg.Params) < (paramIndex + 1) {
 			return maxChathistoryLimit
 		}
 		limit, err := strconv.Atoi(msg.Params[paramIndex])
+		if err == nil && limit > 0 {
+			requested = limit
+		}
 		if err != nil || limit == 0 || limit > maxChathistoryLimit {
 			limit = maxChathistoryLimit
 		}
@@ -627,7 +937,6 @@ func chathistoryHandler(server *Server, client *Client, msg ircmsg.IrcMessage, r
 		return endpoint.Truncate(time.Millisecond).Add(time.Millisecond)
 	}
 
-	var start, end history.Selector
 	var limit int
 	switch preposition {
 	case "between":
@@ -679,14 +988,237 @@ func chathistoryHandler(server *Server, client *Client, msg ircmsg.IrcMessage, r
 		return
 	}
 
+	// charge the client for the whole limit up front, to bound the query,
+	// then give back whatever the query didn't use:
+	granted, retryAfter := client.reserveChathistory(config, limit)
+	if granted == 0 {
+		return
+	}
+	limit = granted
+
 	if preposition == "around" {
 		items, err = sequence.Around(start, limit)
 	} else {
 		items, _, err = sequence.Between(start, end, limit)
 	}
+	client.releaseChathistory(limit - len(items))
+	truncated = err == nil && preposition != "around" && len(items) == limit && limit < requested
+	return
+}
+
+// chathistoryContinuation returns the parameters of a CHATHISTORY query
+// for the messages after (in the direction of the query) a truncated result,
+// or nil if they can't be determined.
+func chathistoryContinuation(params []string, start, end history.Selector, items []history.Item, limit int) (result []string) {
+	if len(items) == 0 {
+		return nil
+	}
+	selector := func(item *history.Item) string {
+		if item.Message.Msgid != "" {
+			return "msgid=" + item.Message.Msgid
+		}
+		return "timestamp=" + item.Message.Time.Format(IRCv3TimestampFormat)
+	}
+	// items are in chronological order, regardless of the query's direction:
+	earliest, latest := &items[0], &items[len(items)-1]
+	startIsZero := start.Msgid == "" && start.Time.IsZero()
+	endIsZero := end.Msgid == "" && end.Time.IsZero()
+	target := params[1]
+	switch strings.ToLower(params[0]) {
+	case "latest", "before":
+		result = []string{"BEFORE", target, selector(earliest)}
+	case "after":
+		result = []string{"AFTER", target, selector(latest)}
+	case "between":
+		if startIsZero {
+			result = []string{"BEFORE", target, selector(earliest)}
+		} else if endIsZero {
+			result = []string{"AFTER", target, selector(latest)}
+		} else if start.Msgid == "" && end.Msgid == "" {
+			// the query started from `start`; continue from the far end of the results
+			if start.Time.Before(end.Time) {
+				result = []string{"BETWEEN", target, selector(latest), params[3]}
+			} else {
+				result = []string{"BETWEEN", target, selector(earliest), params[3]}
+			}
+		} else {
+			// we don't know which way the query went
+			return nil
+		}
+	default:
+		return nil
+	}
+	return append(result, strconv.Itoa(limit))
+}
+
+// CHATHISTORY TARGETS timestamp=<timestamp> timestamp=<timestamp> <limit>
+func chathistoryTargetsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) (exiting bool) {
+	maxChathistoryLimit := server.Config().History.ChathistoryMax
+	if maxChathistoryLimit == 0 {
+		rb.Fail("CHATHISTORY", "MESSAGE_ERROR", msg.Params[0], client.t("Messages could not be retrieved"))
+		return
+	}
+
+	var timestamps [2]time.Time
+	for i := range timestamps {
+		pieces := strings.SplitN(msg.Params[i+1], "=", 2)
+		var err error
+		if len(pieces) == 2 && strings.ToLower(pieces[0]) == "timestamp" {
+			timestamps[i], err = time.Parse(IRCv3TimestampFormat, pieces[1])
+		} else {
+			err = utils.ErrInvalidParams
+		}
+		if err != nil {
+			rb.Fail("CHATHISTORY", "INVALID_PARAMS", msg.Params[0], client.t("Invalid parameters"))
+			return
+		}
+	}
+	// as with BETWEEN, round up the chronologically first timestamp to make it exclusive
+	start, end := timestamps[0], timestamps[1]
+	if start.Before(end) {
+		start = start.Truncate(time.Millisecond).Add(time.Millisecond)
+	} else {
+		end = end.Truncate(time.Millisecond).Add(time.Millisecond)
+	}
+	limit, err := strconv.Atoi(msg.Params[3])
+	if err != nil || limit <= 0 || limit > maxChathistoryLimit {
+		limit = maxChathistoryLimit
+	}
+
+	targets := server.ListHistoryTargets(client, start, end, limit)
+	var batchID string
+	if rb.session.capabilities.Has(caps.Batch) {
+		batchID = rb.StartNestedBatch(caps.ChathistoryTargetsBatchType)
+	}
+	for _, target := range targets {
+		rb.Add(nil, server.name, "CHATHISTORY", "TARGETS", target.CfName, target.Time.Format(IRCv3TimestampFormat))
+	}
+	rb.EndNestedBatch(batchID)
+	return
+}
+
+// parseChathistorySelector parses a msgid=<msgid> or timestamp=<timestamp> selector
+func parseChathistorySelector(param string) (selector history.Selector, err error) {
+	err = utils.ErrInvalidParams
+	pieces := strings.SplitN(param, "=", 2)
+	if len(pieces) < 2 {
+		return
+	}
+	switch strings.ToLower(pieces[0]) {
+	case "msgid":
+		selector.Msgid, err = pieces[1], nil
+	case "timestamp":
+		selector.Time, err = time.Parse(IRCv3TimestampFormat, pieces[1])
+	}
 	return
 }
 
+// number of reply msgids sent for each message; clients can fetch
+// the rest of the thread with CHATHISTORY
+const relationsMaxReplies = 5
+
+// RELATIONS <target> <start> <end> [<limit>]
+func relationsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) (exiting bool) {
+	config := server.Config()
+	maxLimit := config.History.ChathistoryMax
+	if maxLimit == 0 {
+		rb.Fail("RELATIONS", "MESSAGE_ERROR", client.t("Messages could not be retrieved"))
+		return
+	}
+
+	start, startErr := parseChathistorySelector(msg.Params[1])
+	end, endErr := parseChathistorySelector(msg.Params[2])
+	if startErr != nil || endErr != nil {
+		rb.Fail("RELATIONS", "INVALID_PARAMS", client.t("Invalid parameters"))
+		return
+	}
+	// as with BETWEEN, round up the chronologically first timestamp to make it exclusive
+	if !start.Time.IsZero() && !end.Time.IsZero() {
+		if start.Time.Before(end.Time) {
+			start.Time = start.Time.Truncate(time.Millisecond).Add(time.Millisecond)
+		} else {
+			end.Time = end.Time.Truncate(time.Millisecond).Add(time.Millisecond)
+		}
+	}
+	limit := maxLimit
+	if len(msg.Params) > 3 {
+		if requested, err := strconv.Atoi(msg.Params[3]); err == nil && 0 < requested && requested < maxLimit {
+			limit = requested
+		}
+	}
+
+	target := msg.Params[0]
+	channel, sequence, err := server.GetHistorySequence(nil, client, target)
+	aggregator, ok := sequence.(history.Aggregator)
+	if err != nil || !ok {
+		rb.Fail("RELATIONS", "INVALID_TARGET", utils.SafeErrorParam(target), client.t("Messages could not be retrieved"))
+		return
+	}
+
+	granted, retryAfter := client.reserveChathistory(config, limit)
+	if granted == 0 {
+		perMinute := config.History.ChathistoryMaxPerMinute
+		seconds := int(retryAfter.Round(time.Second) / time.Second)
+		rb.Fail("RELATIONS", "RATE_LIMITED", strconv.Itoa(perMinute), strconv.Itoa(seconds),
+			fmt.Sprintf(client.t("You can retrieve at most %[1]d messages per minute; try again in %[2]d seconds"), perMinute, seconds))
+		return
+	}
+	items, _, err := sequence.Between(start, end, granted)
+	client.releaseChathistory(granted - len(items))
+	var aggregates []history.Aggregate
+	if err == nil {
+		msgids := make([]string, 0, len(items))
+		for i := range items {
+			item := &items[i]
+			if (item.Type == history.Privmsg || item.Type == history.Notice) && item.Message.Msgid != "" &&
+				(channel == nil || channel.historyItemIsVisible(client, item)) {
+				msgids = append(msgids, item.Message.Msgid)
+			}
+		}
+		aggregates, err = aggregator.Aggregate(msgids, relationsMaxReplies)
+	}
+	if err != nil {
+		rb.Fail("RELATIONS", "MESSAGE_ERROR", client.t("Messages could not be retrieved"))
+		return
+	}
+
+	var batchID string
+	if rb.session.capabilities.Has(caps.Batch) {
+		batchID = rb.StartNestedBatch(caps.RelationsBatchType, target)
+	}
+	for _, aggregate := range aggregates {
+		if aggregate.ReplyCount != 0 {
+			params := []string{target, aggregate.Msgid, "REPLIES", strconv.Itoa(aggregate.ReplyCount)}
+			if len(aggregate.Replies) != 0 {
+				params = append(params, strings.Join(aggregate.Replies, ","))
+			}
+			rb.Add(nil, server.name, "RELATIONS", params...)
+		}
+		for _, reaction := range aggregate.Reactions {
+			rb.Add(nil, server.name, "RELATIONS", target, aggregate.Msgid, "REACT", strconv.Itoa(reaction.Count), reaction.Reaction)
+		}
+	}
+	rb.EndNestedBatch(batchID)
+	return
+}
+
+// DEANONYMIZE <#channel> <pseudonym>
+func deanonymizeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	channel := server.channels.Get(msg.Params[0])
+	if channel == nil {
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		return false
+	}
+	source, ok := channel.deanonymize(msg.Params[1])
+	if !ok {
+		rb.Fail("DEANONYMIZE", "UNKNOWN_PSEUDONYM", channel.Name(), utils.SafeErrorParam(msg.Params[1]), client.t("No recent messages from that pseudonym"))
+		return false
+	}
+	logOperOverride(server, client, sno.LocalOpers, fmt.Sprintf("deanonymized %s in %s as %s [account: %s] [ip: %s]", msg.Params[1], channel.Name(), source.nickMask, source.accountName, source.ip))
+	rb.Notice(fmt.Sprintf(client.t("%[1]s in %[2]s is %[3]s (account: %[4]s, IP: %[5]s)"), msg.Params[1], channel.Name(), source.nickMask, source.accountName, source.ip))
+	return false
+}
+
 // DEBUG <subcmd>
 func debugHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	param := strings.ToUpper(msg.Params[0])
@@ -708,6 +1240,33 @@ func debugHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		rb.Notice(fmt.Sprintf("pause quantiles 75%%:  %s", stats.PauseQuantiles[3]))
 		rb.Notice(fmt.Sprintf("pause quantiles max%%: %s", stats.PauseQuantiles[4]))
 
+	case "BLOCKED":
+		total, ips, entries := server.blockedCounters.top(20)
+		rb.Notice(fmt.Sprintf("blocked direct messages: %d", total))
+		for i, entry := range entries {
+			rb.Notice(fmt.Sprintf("%d from %s [%s]", entry.count, ips[i], entry.nickMask))
+		}
+
+	case "FANOUT":
+		parallel := atomic.LoadUint64(&server.fanoutStats.parallel)
+		overflow := atomic.LoadUint64(&server.fanoutStats.overflow)
+		backlogged, total, largest := server.sendQStats()
+		rb.Notice(fmt.Sprintf("parallel channel deliveries: %d", parallel))
+		rb.Notice(fmt.Sprintf("chunks delivered inline (workers busy): %d", overflow))
+		rb.Notice(fmt.Sprintf("sessions with a sendq backlog: %d", backlogged))
+		rb.Notice(fmt.Sprintf("total sendq backlog: %d bytes (largest: %d bytes)", total, largest))
+
+	case "REAPED":
+		rb.Notice(fmt.Sprintf("registration timeouts: %d", atomic.LoadUint64(&server.reapStats.registration)))
+		rb.Notice(fmt.Sprintf("ping timeouts: %d", atomic.LoadUint64(&server.reapStats.ping)))
+
+	case "HISTORYQUEUE":
+		stats := server.historyQueue.Stats(server.Config())
+		rb.Notice(fmt.Sprintf("queued history writes: %d (capacity: %d)", stats.Depth, stats.Capacity))
+		rb.Notice(fmt.Sprintf("history items written: %d in %d batches (largest: %d)", stats.Written, stats.Batches, stats.Largest))
+		rb.Notice(fmt.Sprintf("history items dropped (queue full): %d", stats.Dropped))
+		rb.Notice(fmt.Sprintf("history items lost to database errors: %d", stats.Failed))
+
 	case "NUMGOROUTINE":
 		count := runtime.NumGoroutine()
 		rb.Notice(fmt.Sprintf("num goroutines: %d", count))
@@ -780,6 +1339,79 @@ func defconHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	return false
 }
 
+// READONLY [ON|OFF]
+func readonlyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if len(msg.Params) > 0 {
+		enabled, err := utils.StringToBool(msg.Params[0])
+		if err != nil {
+			rb.Fail("READONLY", "INVALID_PARAMS", client.t("Invalid parameters"))
+			return false
+		}
+		if server.SetReadOnly(enabled) {
+			status := "disabled"
+			if enabled {
+				status = "enabled"
+			}
+			server.snomasks.Send(sno.LocalAnnouncements, fmt.Sprintf("%s [%s] %s read-only mode", client.Nick(), client.Oper().Name, status))
+			server.logger.Info("server", "read-only mode", status, "by", client.Oper().Name)
+		}
+	}
+	if server.ReadOnly() {
+		rb.Notice(client.t("The server is in read-only mode"))
+	} else {
+		rb.Notice(client.t("The server is not in read-only mode"))
+	}
+	return false
+}
+
+// MAINTENANCE [ON [duration] [message] | OFF]
+func maintenanceHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if len(msg.Params) > 0 {
+		enabled, err := utils.StringToBool(msg.Params[0])
+		if err != nil {
+			rb.Fail("MAINTENANCE", "INVALID_PARAMS", client.t("Invalid parameters"))
+			return false
+		}
+		// defaults come from the config, and can be overridden:
+		mConf := server.Config().Server.Maintenance
+		retryAfter, message := mConf.RetryAfter, mConf.Message
+		if enabled && len(msg.Params) > 1 {
+			params := msg.Params[1:]
+			if duration, err := custime.ParseDuration(params[0]); err == nil {
+				retryAfter = duration
+				params = params[1:]
+			}
+			if len(params) > 0 {
+				message = strings.Join(params, " ")
+			}
+		}
+		server.maintenance.Set(enabled, message, retryAfter)
+		status := "disabled"
+		if enabled {
+			status = "enabled"
+		}
+		server.snomasks.Send(sno.LocalAnnouncements, fmt.Sprintf("%s [%s] %s maintenance mode", client.Nick(), client.Oper().Name, status))
+		server.logger.Info("server", "maintenance mode", status, "by", client.Oper().Name)
+	}
+
+	enabled, message, retryAt := server.maintenance.Get()
+	if enabled {
+		rb.Notice(fmt.Sprintf(client.t("The server is in maintenance mode; new connections are rejected with: %s"), maintenanceRejection(message, retryAt, time.Now().UTC())))
+	} else {
+		rb.Notice(client.t("The server is not in maintenance mode"))
+	}
+	return false
+}
+
+// rejectReadOnly warns the client and returns true if the server is read-only
+func rejectReadOnly(server *Server, client *Client, command string, rb *ResponseBuffer) bool {
+	if server.ReadOnly() {
+		rb.Warn(command, "READ_ONLY", client.t("The server is in read-only mode; try again later"))
+		return true
+	}
+	return false
+}
+
 // helper for parsing the reason args to DLINE and KLINE
 func getReasonsFromParams(params []string, currentArg int) (reason, operReason string) {
 	reason = "No reason given"
@@ -796,6 +1428,16 @@ func getReasonsFromParams(params []string, currentArg int) (reason, operReason s
 	return
 }
 
+// expandReasonMacro expands a reason macro (see server.reason-macros) that
+// `client` used in `command` against `target`, recording the expansion.
+func expandReasonMacro(server *Server, client *Client, command, target, reason string) string {
+	expanded, macro := server.Config().expandReasonMacro(reason)
+	if macro != "" {
+		server.logger.Info("moderation", fmt.Sprintf("%s used reason macro !%s in %s %s: %s", client.NickMaskString(), macro, command, target, expanded))
+	}
+	return expanded
+}
+
 func formatBanForListing(client *Client, key string, info IPBanInfo) string {
 	desc := info.Reason
 	if info.OperReason != "" && info.OperReason != info.Reason {
@@ -807,12 +1449,12 @@ func formatBanForListing(client *Client, key string, info IPBanInfo) string {
 	return fmt.Sprintf(client.t("Ban - %[1]s - added by %[2]s - %[3]s"), key, info.OperName, desc)
 }
 
-// DLINE [ANDKILL] [MYSELF] [duration] <ip>/<net> [ON <server>] [reason [| oper reason]]
+// DLINE [ANDKILL] [MYSELF] [duration] <ip>/<net>/<hostname>/<asn> [ON <server>] [reason [| oper reason]]
 // DLINE LIST
 func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// check oper permissions
 	oper := client.Oper()
-	if oper == nil || !oper.Class.Capabilities.Has("local_ban") {
+	if !oper.HasRoleCapab("ban") {
 		rb.Add(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, client.t("Insufficient oper privs"))
 		return false
 	}
@@ -834,6 +1476,10 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		return false
 	}
 
+	if rejectReadOnly(server, client, msg.Command, rb) {
+		return false
+	}
+
 	// when setting a ban, if they say "ANDKILL" we should also kill all users who match it
 	var andKill bool
 	if len(msg.Params) > currentArg+1 && strings.ToLower(msg.Params[currentArg]) == "andkill" {
@@ -866,14 +1512,20 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	currentArg++
 
 	// check host
-	hostNet, err := utils.NormalizedNetFromString(hostString)
+	target, err := parseDlineTarget(hostString)
 
 	if err != nil {
-		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("Could not parse IP address or CIDR network"))
+		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("Could not parse IP address, CIDR network, hostname, or ASN"))
+		return false
+	}
+
+	config := server.Config()
+	if target.asn != 0 && config.Server.asnDatabase == nil {
+		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("No ASN database is configured, so ASN bans can't be enforced"))
 		return false
 	}
 
-	if !dlineMyself && hostNet.Contains(rb.session.IP()) {
+	if !dlineMyself && target.matchesSession(rb.session, config) {
 		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("This ban matches you. To DLINE yourself, you must use the command:  /DLINE MYSELF <arguments>"))
 		return false
 	}
@@ -886,13 +1538,14 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 
 	// get comment(s)
 	reason, operReason := getReasonsFromParams(msg.Params, currentArg)
+	reason = expandReasonMacro(server, client, "DLINE", hostString, reason)
 
 	operName := oper.Name
 	if operName == "" {
 		operName = server.name
 	}
 
-	err = server.dlines.AddNetwork(hostNet, duration, reason, operReason, operName)
+	err = server.dlines.AddTarget(target, duration, reason, operReason, operName)
 
 	if err != nil {
 		rb.Notice(fmt.Sprintf(client.t("Could not successfully save new D-LINE: %s"), err.Error()))
@@ -900,7 +1553,7 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	}
 
 	var snoDescription string
-	hostString = utils.NetToNormalizedString(hostNet)
+	hostString = target.Display()
 	if duration != 0 {
 		rb.Notice(fmt.Sprintf(client.t("Added temporary (%[1]s) D-Line for %[2]s"), duration.String(), hostString))
 		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s [%s]$r added temporary (%s) D-Line for %s"), client.nick, operName, duration.String(), hostString)
@@ -909,6 +1562,12 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s [%s]$r added D-Line for %s"), client.nick, operName, hostString)
 	}
 	server.snomasks.Send(sno.LocalXline, snoDescription)
+	hookData := webhookOperData(client, "dline")
+	hookData["mask"] = hostString
+	hookData["duration"] = duration.String()
+	hookData["reason"] = reason
+	hookData["oper-reason"] = operReason
+	server.webhooks.Send(WebhookOper, hookData)
 
 	var killClient bool
 	if andKill {
@@ -918,7 +1577,7 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		for _, mcl := range server.clients.AllClients() {
 			nickKilled := false
 			for _, session := range mcl.Sessions() {
-				if hostNet.Contains(session.IP()) {
+				if target.matchesSession(session, config) {
 					sessionsToKill = append(sessionsToKill, session)
 					if !nickKilled {
 						killedClientNicks = append(killedClientNicks, mcl.Nick())
@@ -947,6 +1606,99 @@ func dlineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	return killClient
 }
 
+// DRAFTS LIST
+// DRAFTS GET <key>
+// DRAFTS SET <key> <value>
+// DRAFTS DEL <key>
+// DRAFTS CLEAR
+func draftsHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	config := server.Config()
+	if !config.Accounts.Drafts.Enabled {
+		rb.Fail("DRAFTS", "DISABLED", client.t("Drafts are disabled on this server"))
+		return false
+	}
+	account := client.Account()
+	if account == "" {
+		rb.Fail("DRAFTS", "ACCOUNT_REQUIRED", client.t("You must be logged into an account to use drafts"))
+		return false
+	}
+
+	subcommand := strings.ToUpper(msg.Params[0])
+	minParams := map[string]int{"GET": 2, "SET": 3, "DEL": 2}[subcommand]
+	if len(msg.Params) < minParams {
+		rb.Fail("DRAFTS", "NEED_MORE_PARAMS", client.t("Not enough parameters"))
+		return false
+	}
+
+	switch subcommand {
+	case "LIST":
+		// sessions that have seen the full list need to hear about changes to it:
+		rb.session.subscribeDrafts()
+		drafts := server.accounts.LoadDrafts(account)
+		keys := make([]string, 0, len(drafts))
+		for key := range drafts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			entry := drafts[key]
+			rb.Add(nil, server.name, "DRAFTS", "ENTRY", key, entry.Time.Format(IRCv3TimestampFormat), entry.Value)
+		}
+		rb.Add(nil, server.name, "DRAFTS", "END")
+	case "GET":
+		entry, ok := server.accounts.LoadDrafts(account)[msg.Params[1]]
+		if !ok {
+			rb.Fail("DRAFTS", "UNKNOWN_KEY", utils.SafeErrorParam(msg.Params[1]), client.t("No such draft"))
+			return false
+		}
+		rb.Add(nil, server.name, "DRAFTS", "ENTRY", msg.Params[1], entry.Time.Format(IRCv3TimestampFormat), entry.Value)
+	case "SET", "DEL":
+		if rejectReadOnly(server, client, "DRAFTS", rb) {
+			return false
+		}
+		key, value := msg.Params[1], ""
+		if subcommand == "SET" {
+			value = msg.Params[2]
+		}
+		entry, err := server.accounts.SetDraft(account, key, value, &config.Accounts.Drafts)
+		switch err {
+		case nil:
+		case errDraftInvalidKey:
+			rb.Fail("DRAFTS", "INVALID_KEY", utils.SafeErrorParam(key), client.t("Invalid draft key"))
+			return false
+		case errDraftValueTooLong:
+			rb.Fail("DRAFTS", "VALUE_TOO_LONG", utils.SafeErrorParam(key), fmt.Sprintf(client.t("Drafts can be at most %d bytes long"), config.Accounts.Drafts.MaxValueBytes))
+			return false
+		case errDraftQuotaExceeded:
+			rb.Fail("DRAFTS", "QUOTA_EXCEEDED", utils.SafeErrorParam(key), fmt.Sprintf(client.t("You can store at most %d drafts"), config.Accounts.Drafts.MaxEntries))
+			return false
+		case errDraftNoSuchKey:
+			rb.Fail("DRAFTS", "UNKNOWN_KEY", utils.SafeErrorParam(key), client.t("No such draft"))
+			return false
+		default:
+			server.logger.Error("internal", "couldn't store draft", account, err.Error())
+			rb.Fail("DRAFTS", "UNKNOWN_ERROR", utils.SafeErrorParam(key), client.t("An error occurred"))
+			return false
+		}
+		params := []string{"ENTRY", key, entry.Time.Format(IRCv3TimestampFormat), value}
+		if value == "" {
+			params = []string{"DELETED", key, entry.Time.Format(IRCv3TimestampFormat)}
+		}
+		rb.Add(nil, server.name, "DRAFTS", params...)
+		server.notifyDrafts(account, rb.session, params...)
+	case "CLEAR":
+		if rejectReadOnly(server, client, "DRAFTS", rb) {
+			return false
+		}
+		server.accounts.ClearDrafts(account)
+		rb.Add(nil, server.name, "DRAFTS", "CLEARED")
+		server.notifyDrafts(account, rb.session, "CLEARED")
+	default:
+		rb.Fail("DRAFTS", "UNKNOWN_COMMAND", utils.SafeErrorParam(msg.Params[0]), client.t("Unknown subcommand"))
+	}
+	return false
+}
+
 // EXTJWT <target> [service_name]
 func extjwtHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	accountName := client.AccountName()
@@ -964,7 +1716,7 @@ func extjwtHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	if msg.Params[0] != "*" {
 		channel := server.channels.Get(msg.Params[0])
 		if channel == nil {
-			rb.Add(nil, server.name, "FAIL", "EXTJWT", "NO_SUCH_CHANNEL", client.t("No such channel"))
+			rb.Fail("EXTJWT", "NO_SUCH_CHANNEL", client.t("No such channel"))
 			return false
 		}
 
@@ -993,7 +1745,7 @@ func extjwtHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	}
 
 	if !sConfig.Enabled() {
-		rb.Add(nil, server.name, "FAIL", "EXTJWT", "NO_SUCH_SERVICE", client.t("No such service"))
+		rb.Fail("EXTJWT", "NO_SUCH_SERVICE", client.t("No such service"))
 		return false
 	}
 
@@ -1008,12 +1760,63 @@ func extjwtHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		}
 		rb.Add(nil, server.name, "EXTJWT", msg.Params[0], serviceName, tokenString)
 	} else {
-		rb.Add(nil, server.name, "FAIL", "EXTJWT", "UNKNOWN_ERROR", client.t("Could not generate EXTJWT token"))
+		rb.Fail("EXTJWT", "UNKNOWN_ERROR", client.t("Could not generate EXTJWT token"))
 	}
 
 	return false
 }
 
+// GRANTOPER <nick> <duration> [<oper name>]
+func grantoperHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	details := client.Details()
+	granter := client.Oper()
+	target := server.clients.Get(msg.Params[0])
+	if target == nil {
+		rb.Add(nil, server.name, ERR_NOSUCHNICK, details.nick, utils.SafeErrorParam(msg.Params[0]), client.t("No such nick"))
+		return false
+	}
+	duration, err := custime.ParseDuration(msg.Params[1])
+	if err != nil || duration <= 0 {
+		rb.Notice(client.t("Invalid duration"))
+		return false
+	}
+	operName := granter.Name
+	if len(msg.Params) > 2 {
+		operName = msg.Params[2]
+	}
+	oper := server.GetOperator(operName)
+	if oper == nil {
+		rb.Notice(client.t("No such oper block"))
+		return false
+	}
+	// opers can't grant privileges they don't have themselves
+	for capab := range oper.Class.Capabilities {
+		if !granter.HasRoleCapab(capab) {
+			rb.Add(nil, server.name, ERR_NOPRIVS, details.nick, msg.Command, client.t("Insufficient oper privs"))
+			return false
+		}
+	}
+	tDetails := target.Details()
+	if target.HasMode(modes.Operator) {
+		rb.Notice(fmt.Sprintf(client.t("%s is already an operator"), tDetails.nick))
+		return false
+	}
+	sessions := target.Sessions()
+	if !target.Registered() || len(sessions) == 0 {
+		rb.Notice(fmt.Sprintf(client.t("%s is not connected"), tDetails.nick))
+		return false
+	}
+
+	targetRb := NewResponseBuffer(sessions[0])
+	applyOper(target, oper, duration, targetRb)
+	targetRb.Send(true)
+
+	rb.Notice(fmt.Sprintf(client.t("Granted operator status (%[1]s) to %[2]s for %[3]s"), oper.Name, tDetails.nick, duration.String()))
+	server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("%[1]s [%[2]s]$r granted operator status (%[3]s) to %[4]s for %[5]s"), details.nick, granter.Name, oper.Name, tDetails.nick, duration.String()))
+	server.logger.Info("opers", details.nick, "granted operator status", oper.Name, "to", tDetails.nick, "for", duration.String())
+	return false
+}
+
 // HELP [<query>]
 func helpHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	argument := strings.ToLower(strings.TrimSpace(strings.Join(msg.Params, " ")))
@@ -1031,10 +1834,12 @@ Get an explanation of <argument>, or "index" for a list of help topics.`), rb)
 		return false
 	}
 
-	helpHandler, exists := Help[argument]
+	helpHandler, overlay, exists := server.helpIndexManager.GetTopic(argument, client.Languages())
 
 	if exists && (!helpHandler.oper || (helpHandler.oper && client.HasMode(modes.Operator))) {
-		if helpHandler.textGenerator != nil {
+		if overlay != "" {
+			client.sendHelp(strings.ToUpper(argument), overlay, rb)
+		} else if helpHandler.textGenerator != nil {
 			client.sendHelp(strings.ToUpper(argument), helpHandler.textGenerator(client), rb)
 		} else {
 			client.sendHelp(strings.ToUpper(argument), client.t(helpHandler.text), rb)
@@ -1062,10 +1867,10 @@ func historyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 	items, channel, err := easySelectHistory(server, client, msg.Params)
 
 	if err == errNoSuchChannel {
-		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "INVALID_TARGET", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
 		return false
 	} else if err != nil {
-		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.Nick(), msg.Command, client.t("Could not retrieve history"))
+		rb.FailUnknownError(msg.Command, "MESSAGE_ERROR", client.t("Could not retrieve history"))
 		return false
 	}
 
@@ -1127,13 +1932,13 @@ func inviteHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 
 	target := server.clients.Get(nickname)
 	if target == nil {
-		rb.Add(nil, server.name, ERR_NOSUCHNICK, client.Nick(), utils.SafeErrorParam(nickname), client.t("No such nick"))
+		rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(nickname), client.t("No such nick"))
 		return false
 	}
 
 	channel := server.channels.Get(channelName)
 	if channel == nil {
-		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), utils.SafeErrorParam(channelName), client.t("No such channel"))
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(channelName), client.t("No such channel"))
 		return false
 	}
 
@@ -1192,6 +1997,10 @@ func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		if len(keys) > i {
 			key = keys[i]
 		}
+		if client.checkDefconJoinThrottle() {
+			rb.Fail("JOIN", "RATE_LIMITED", utils.SafeErrorParam(name), client.t("You're joining channels too quickly; try again later"))
+			continue
+		}
 		err := server.channels.Join(client, name, key, false, rb)
 		if err != nil {
 			sendJoinError(client, name, rb, err)
@@ -1201,35 +2010,44 @@ func joinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 }
 
 func sendJoinError(client *Client, name string, rb *ResponseBuffer, err error) {
-	var code, errMsg, forbiddingMode string
+	if closedErr, ok := err.(*channelClosedError); ok {
+		if closedErr.nextOpen.IsZero() {
+			rb.Fail("JOIN", "CHANNEL_CLOSED", utils.SafeErrorParam(name), client.t("The channel is closed"))
+		} else {
+			nextOpen := closedErr.nextOpen.UTC().Format(IRCv3TimestampFormat)
+			rb.Fail("JOIN", "CHANNEL_CLOSED", utils.SafeErrorParam(name), nextOpen, fmt.Sprintf(client.t("The channel is closed; it will next open at %s"), nextOpen))
+		}
+		return
+	}
+	var numeric, code, errMsg, forbiddingMode string
 	switch err {
 	case errInsufficientPrivs:
-		code, errMsg = ERR_NOSUCHCHANNEL, `Only server operators can create new channels`
+		numeric, code, errMsg = ERR_NOSUCHCHANNEL, "CANNOT_CREATE_CHANNEL", `Only server operators can create new channels`
 	case errConfusableIdentifier:
-		code, errMsg = ERR_NOSUCHCHANNEL, `That channel name is too close to the name of another channel`
+		numeric, code, errMsg = ERR_NOSUCHCHANNEL, "CONFUSABLE_CHANNEL_NAME", `That channel name is too close to the name of another channel`
 	case errChannelPurged:
-		code, errMsg = ERR_NOSUCHCHANNEL, err.Error()
+		numeric, code, errMsg = ERR_NOSUCHCHANNEL, "CHANNEL_PURGED", err.Error()
 	case errTooManyChannels:
-		code, errMsg = ERR_TOOMANYCHANNELS, `You have joined too many channels`
+		numeric, code, errMsg = ERR_TOOMANYCHANNELS, "TOO_MANY_CHANNELS", `You have joined too many channels`
 	case errLimitExceeded:
-		code, forbiddingMode = ERR_CHANNELISFULL, "l"
+		numeric, code, forbiddingMode = ERR_CHANNELISFULL, "CHANNEL_IS_FULL", "l"
 	case errWrongChannelKey:
-		code, forbiddingMode = ERR_BADCHANNELKEY, "k"
+		numeric, code, forbiddingMode = ERR_BADCHANNELKEY, "BAD_CHANNEL_KEY", "k"
 	case errInviteOnly:
-		code, forbiddingMode = ERR_INVITEONLYCHAN, "i"
+		numeric, code, forbiddingMode = ERR_INVITEONLYCHAN, "INVITE_ONLY", "i"
 	case errBanned:
-		code, forbiddingMode = ERR_BANNEDFROMCHAN, "b"
+		numeric, code, forbiddingMode = ERR_BANNEDFROMCHAN, "BANNED", "b"
 	case errRegisteredOnly:
-		code, errMsg = ERR_NEEDREGGEDNICK, `You must be registered to join that channel`
+		numeric, code, errMsg = ERR_NEEDREGGEDNICK, "ACCOUNT_REQUIRED", `You must be registered to join that channel`
 	default:
-		code, errMsg = ERR_NOSUCHCHANNEL, `No such channel`
+		numeric, code, errMsg = ERR_NOSUCHCHANNEL, "NO_SUCH_CHANNEL", `No such channel`
 	}
 	if forbiddingMode != "" {
 		errMsg = fmt.Sprintf(client.t("Cannot join channel (+%s)"), forbiddingMode)
 	} else {
 		errMsg = client.t(errMsg)
 	}
-	rb.Add(nil, client.server.name, code, client.Nick(), utils.SafeErrorParam(name), errMsg)
+	rb.FailNumeric(numeric, "JOIN", code, utils.SafeErrorParam(name), errMsg)
 }
 
 // SAJOIN [nick] #channel{,#channel}
@@ -1246,7 +2064,7 @@ func sajoinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		} else {
 			target = server.clients.Get(msg.Params[0])
 			if target == nil {
-				rb.Add(nil, server.name, ERR_NOSUCHNICK, client.Nick(), utils.SafeErrorParam(msg.Params[0]), "No such nick")
+				rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(msg.Params[0]), "No such nick")
 				return false
 			}
 			channelString = msg.Params[1]
@@ -1258,16 +2076,93 @@ func sajoinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		err := server.channels.Join(target, chname, "", true, rb)
 		if err != nil {
 			sendJoinError(client, chname, rb, err)
+		} else {
+			logOperOverride(server, client, sno.LocalChannels, fmt.Sprintf("forced %s to join %s", target.Nick(), chname))
 		}
 	}
 	return false
 }
 
+// OJOIN #channel{,#channel}
+func ojoinHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	nick := client.Nick()
+	for _, chname := range strings.Split(msg.Params[0], ",") {
+		if chname == "" {
+			continue
+		}
+		err := server.channels.Join(client, chname, "", true, rb)
+		if err != nil {
+			sendJoinError(client, chname, rb, err)
+			continue
+		}
+		channel := server.channels.Get(chname)
+		if channel == nil {
+			continue
+		}
+		// unlike SAJOIN, OJOIN is never silent: the channel's ops are told
+		for _, member := range channel.Members() {
+			if member != client && channel.ClientIsAtLeast(member, modes.ChannelOperator) {
+				member.Send(nil, server.name, "NOTICE", member.Nick(), fmt.Sprintf(member.t("Server operator %[1]s joined %[2]s, overriding its restrictions"), nick, channel.Name()))
+			}
+		}
+		logOperOverride(server, client, sno.LocalChannels, fmt.Sprintf("used OJOIN to join %s", channel.Name()))
+	}
+	return false
+}
+
+// SAPART <nick> #channel{,#channel} [reason]
+func sapartHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	target := server.clients.Get(msg.Params[0])
+	if target == nil {
+		rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(msg.Params[0]), client.t("No such nick"))
+		return false
+	}
+	var reason string
+	if len(msg.Params) > 2 {
+		reason = msg.Params[2]
+	}
+
+	for _, chname := range strings.Split(msg.Params[1], ",") {
+		if chname == "" {
+			continue
+		}
+		channel := server.channels.Get(chname)
+		if channel == nil {
+			rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(chname), client.t("No such channel"))
+			continue
+		}
+		if !channel.hasClient(target) {
+			rb.FailNumeric(ERR_USERNOTINCHANNEL, msg.Command, "USER_NOT_IN_CHANNEL", target.Nick(), channel.Name(), client.t("They aren't on that channel"))
+			continue
+		}
+		if target == client {
+			channel.Part(target, reason, rb)
+		} else {
+			channel.ForcePart(target, reason)
+		}
+		logOperOverride(server, client, sno.LocalChannels, fmt.Sprintf("forced %s to part %s", target.Nick(), channel.Name()))
+	}
+	return false
+}
+
+// logOperOverride records a use of an oper override command (SAJOIN, SAPART,
+// SAMODE, OJOIN, DEANONYMIZE) to the snomasks and the audit log.
+func logOperOverride(server *Server, client *Client, mask sno.Mask, description string) {
+	details := client.Details()
+	operName := "<unknown>"
+	if oper := client.Oper(); oper != nil {
+		operName = oper.Name
+	}
+	server.snomasks.Send(mask, fmt.Sprintf(ircfmt.Unescape("Operator %s [%s] $c[grey]%s"), details.nick, operName, description))
+	server.logger.Info("opers", "override by", details.nick, "oper", operName, description)
+}
+
 // KICK <channel>{,<channel>} <user>{,<user>} [<comment>]
 func kickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	channels := strings.Split(msg.Params[0], ",")
 	users := strings.Split(msg.Params[1], ",")
-	if (len(channels) != len(users)) && (len(users) != 1) {
+	// either the lists are paired, or one of them has a single entry:
+	if len(channels) != len(users) && len(channels) != 1 && len(users) != 1 {
 		rb.Add(nil, server.name, ERR_NEEDMOREPARAMS, client.nick, "KICK", client.t("Not enough parameters"))
 		return false
 	}
@@ -1276,75 +2171,156 @@ func kickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		channel string
 		nick    string
 	}
-	kicks := make([]kickCmd, 0, len(channels))
-	for index, channel := range channels {
-		if channel == "" {
-			continue // #679
+	numKicks := len(channels)
+	if len(users) > numKicks {
+		numKicks = len(users)
+	}
+	kicks := make([]kickCmd, 0, numKicks)
+	for i := 0; i < numKicks; i++ {
+		var kick kickCmd
+		if len(channels) == 1 {
+			kick.channel = channels[0]
+		} else {
+			kick.channel = channels[i]
 		}
 		if len(users) == 1 {
-			kicks = append(kicks, kickCmd{channel, users[0]})
+			kick.nick = users[0]
 		} else {
-			kicks = append(kicks, kickCmd{channel, users[index]})
+			kick.nick = users[i]
+		}
+		if kick.channel == "" || kick.nick == "" {
+			continue // #679
 		}
+		kicks = append(kicks, kick)
+	}
+	maxKicks := server.Config().Limits.Targmax.Kick
+	if len(kicks) > maxKicks {
+		rb.FailNumeric(ERR_TOOMANYTARGETS, msg.Command, "TOO_MANY_TARGETS", utils.SafeErrorParam(kicks[maxKicks].nick), fmt.Sprintf(client.t("Too many targets; the maximum is %d"), maxKicks))
+		return false
+	}
+	if len(kicks) > 1 {
+		rb.session.deferredFakelagCount += len(kicks) - 1
 	}
 
 	var comment string
 	if len(msg.Params) > 2 {
-		comment = msg.Params[2]
+		comment = expandReasonMacro(server, client, "KICK", msg.Params[0]+" "+msg.Params[1], msg.Params[2])
 	}
 	for _, kick := range kicks {
 		channel := server.channels.Get(kick.channel)
 		if channel == nil {
-			rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, utils.SafeErrorParam(kick.channel), client.t("No such channel"))
+			rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(kick.channel), client.t("No such channel"))
 			continue
 		}
 
 		target := server.clients.Get(kick.nick)
 		if target == nil {
-			rb.Add(nil, server.name, ERR_NOSUCHNICK, client.nick, utils.SafeErrorParam(kick.nick), client.t("No such nick"))
+			rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(kick.nick), client.t("No such nick"))
 			continue
 		}
 
-		if comment == "" {
-			comment = kick.nick
+		reason := comment
+		if reason == "" {
+			reason = kick.nick
 		}
-		channel.Kick(client, target, comment, rb, false)
+		channel.Kick(client, target, reason, rb, false)
+	}
+	return false
+}
+
+// REMOVE <channel> <user> [<reason>]
+func removeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	channel := server.channels.Get(msg.Params[0])
+	if channel == nil {
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		return false
+	}
+	target := server.clients.Get(msg.Params[1])
+	if target == nil {
+		rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(msg.Params[1]), client.t("No such nick"))
+		return false
+	}
+	var reason string
+	if len(msg.Params) > 2 {
+		reason = expandReasonMacro(server, client, "REMOVE", msg.Params[0]+" "+msg.Params[1], msg.Params[2])
 	}
+	channel.Remove(client, target, reason, rb)
 	return false
 }
 
-// KILL <nickname> <comment>
+// checkProtectedAction implements the confirmation required to KILL or KLINE
+// protected clients: the oper must use FORCE, then a second oper must repeat
+// the same command. It returns whether the action may go ahead.
+func checkProtectedAction(server *Server, client *Client, command, action string, protected []string, force bool, rb *ResponseBuffer) bool {
+	if len(protected) == 0 {
+		return true
+	}
+	sort.Strings(protected)
+	protectedList := strings.Join(protected, ",")
+	if !force {
+		rb.Fail(command, "PROTECTED", utils.SafeErrorParam(protectedList), client.t("Protected clients would be affected; to proceed, use FORCE and have another operator confirm"))
+		return false
+	}
+	details := client.Details()
+	operName := client.Oper().Name
+	if server.protectedActions.confirm(action, operName, time.Now()) {
+		server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s [%s]$r confirmed $c[grey][$r%s$c[grey]]$r against protected clients: %s"), details.nick, operName, action, protectedList))
+		server.logger.Info("opers", "protected action confirmed by", details.nick, "oper", operName, action, protectedList)
+		return true
+	}
+	rb.Notice(fmt.Sprintf(client.t("Another operator must confirm within %[1]v by issuing: %[2]s"), protectedConfirmTimeout, action))
+	server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s [%s]$r requested $c[grey][$r%s$c[grey]]$r against protected clients %s; another operator must confirm"), details.nick, operName, action, protectedList))
+	server.logger.Info("opers", "protected action requested by", details.nick, "oper", operName, action, protectedList)
+	return false
+}
+
+// KILL [FORCE] <nickname> <comment>
 func killHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
-	nickname := msg.Params[0]
+	params := msg.Params
+	force := len(params) > 1 && strings.ToLower(params[0]) == "force"
+	if force {
+		params = params[1:]
+	}
+	nickname := params[0]
 	comment := "<no reason supplied>"
-	if len(msg.Params) > 1 {
-		comment = msg.Params[1]
+	if len(params) > 1 {
+		comment = expandReasonMacro(server, client, "KILL", nickname, params[1])
 	}
 
 	target := server.clients.Get(nickname)
 	if target == nil {
-		rb.Add(nil, client.server.name, ERR_NOSUCHNICK, client.Nick(), utils.SafeErrorParam(nickname), client.t("No such nick"))
+		rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(nickname), client.t("No such nick"))
 		return false
-	} else if target.AlwaysOn() {
+	}
+	if target.IsProtected() {
+		if !checkProtectedAction(server, client, "KILL", "KILL FORCE "+target.NickCasefolded(), []string{target.Nick()}, force, rb) {
+			return false
+		}
+	}
+	if target.AlwaysOn() {
 		rb.Add(nil, client.server.name, ERR_UNKNOWNERROR, client.Nick(), "KILL", fmt.Sprintf(client.t("Client %s is always-on and cannot be fully removed by /KILL; consider /NS SUSPEND instead"), target.Nick()))
 	}
 
 	quitMsg := fmt.Sprintf("Killed (%s (%s))", client.nick, comment)
 
 	server.snomasks.Send(sno.LocalKills, fmt.Sprintf(ircfmt.Unescape("%s$r was killed by %s $c[grey][$r%s$c[grey]]"), target.nick, client.nick, comment))
+	hookData := webhookOperData(client, "kill")
+	hookData["target"] = webhookClientData(target, target.Details())
+	hookData["reason"] = comment
+	server.webhooks.Send(WebhookOper, hookData)
 
 	target.Quit(quitMsg, nil)
 	target.destroy(nil)
 	return false
 }
 
-// KLINE [ANDKILL] [MYSELF] [duration] <mask> [ON <server>] [reason [| oper reason]]
+// KLINE [ANDKILL] [MYSELF] [FORCE] [duration] <mask> [ON <server>] [reason [| oper reason]]
 // KLINE LIST
 func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	details := client.Details()
 	// check oper permissions
 	oper := client.Oper()
-	if oper == nil || !oper.Class.Capabilities.Has("local_ban") {
+	if !oper.HasRoleCapab("ban") {
 		rb.Add(nil, server.name, ERR_NOPRIVS, details.nick, msg.Command, client.t("Insufficient oper privs"))
 		return false
 	}
@@ -1366,6 +2342,10 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		return false
 	}
 
+	if rejectReadOnly(server, client, msg.Command, rb) {
+		return false
+	}
+
 	// when setting a ban, if they say "ANDKILL" we should also kill all users who match it
 	var andKill bool
 	if len(msg.Params) > currentArg+1 && strings.ToLower(msg.Params[currentArg]) == "andkill" {
@@ -1381,6 +2361,14 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		currentArg++
 	}
 
+	// likewise, a ban that covers protected clients requires "KLINE FORCE"
+	// and a second oper's confirmation
+	var force bool
+	if len(msg.Params) > currentArg+1 && strings.ToLower(msg.Params[currentArg]) == "force" {
+		force = true
+		currentArg++
+	}
+
 	// duration
 	duration, err := custime.ParseDuration(msg.Params[currentArg])
 	if err != nil {
@@ -1423,6 +2411,22 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		return false
 	}
 
+	var protected []string
+	for _, mcl := range server.clients.AllClients() {
+		if !mcl.IsProtected() {
+			continue
+		}
+		for _, clientMask := range mcl.AllNickmasks() {
+			if matcher.MatchString(clientMask) {
+				protected = append(protected, mcl.Nick())
+				break
+			}
+		}
+	}
+	if !checkProtectedAction(server, client, "KLINE", "KLINE FORCE "+mask, protected, force, rb) {
+		return false
+	}
+
 	// get oper name
 	operName := oper.Name
 	if operName == "" {
@@ -1431,6 +2435,7 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 
 	// get comment(s)
 	reason, operReason := getReasonsFromParams(msg.Params, currentArg)
+	reason = expandReasonMacro(server, client, "KLINE", mask, reason)
 
 	err = server.klines.AddMask(mask, duration, reason, operReason, operName)
 	if err != nil {
@@ -1447,6 +2452,12 @@ func klineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		snoDescription = fmt.Sprintf(ircfmt.Unescape("%s [%s]$r added K-Line for %s"), details.nick, operName, mask)
 	}
 	server.snomasks.Send(sno.LocalXline, snoDescription)
+	hookData := webhookOperData(client, "kline")
+	hookData["mask"] = mask
+	hookData["duration"] = duration.String()
+	hookData["reason"] = reason
+	hookData["oper-reason"] = operReason
+	server.webhooks.Send(WebhookOper, hookData)
 
 	var killClient bool
 	if andKill {
@@ -1607,20 +2618,87 @@ func listHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 			channels = channels[:1]
 		}
 
-		for _, chname := range channels {
-			channel := server.channels.Get(chname)
-			if channel == nil || (!clientIsOp && channel.flags.HasMode(modes.Secret)) {
-				if len(chname) > 0 {
-					rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, utils.SafeErrorParam(chname), client.t("No such channel"))
-				}
-				continue
+		for _, chname := range channels {
+			channel := server.channels.Get(chname)
+			if channel == nil || (!clientIsOp && channel.flags.HasMode(modes.Secret)) {
+				if len(chname) > 0 {
+					rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(chname), client.t("No such channel"))
+				}
+				continue
+			}
+			if matcher.Matches(channel) {
+				rplList(channel)
+			}
+		}
+	}
+	rb.Add(nil, server.name, RPL_LISTEND, client.nick, client.t("End of LIST"))
+	return false
+}
+
+// LISTMODE <channel> <b|e|I> [MATCH <pattern>] [AFTER <mask>] [LIMIT <count>]
+func listmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	channel := server.channels.Get(msg.Params[0])
+	if channel == nil {
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		return false
+	}
+	var mode modes.Mode
+	switch strings.TrimPrefix(msg.Params[1], "+") {
+	case "b":
+		mode = modes.BanMask
+	case "e":
+		mode = modes.ExceptMask
+	case "I":
+		mode = modes.InviteMask
+	default:
+		rb.Fail("LISTMODE", "INVALID_MODE", utils.SafeErrorParam(msg.Params[1]), client.t("Invalid list mode"))
+		return false
+	}
+
+	var matcher *regexp.Regexp
+	var after string
+	var limit int
+	options := msg.Params[2:]
+	for len(options) != 0 {
+		if len(options) < 2 {
+			rb.Fail("LISTMODE", "INVALID_PARAMS", client.t("Invalid parameters"))
+			return false
+		}
+		var err error
+		switch strings.ToUpper(options[0]) {
+		case "MATCH":
+			matcher, err = utils.CompileGlob(options[1], false)
+			if err == nil {
+				// masks are stored casefolded, but search patterns might not be:
+				matcher, err = regexp.Compile("(?i)" + matcher.String())
 			}
-			if matcher.Matches(channel) {
-				rplList(channel)
+		case "AFTER":
+			after = options[1]
+		case "LIMIT":
+			limit, err = strconv.Atoi(options[1])
+			if err == nil && limit <= 0 {
+				err = errInvalidParams
 			}
+		default:
+			err = errInvalidParams
+		}
+		if err != nil {
+			rb.Fail("LISTMODE", "INVALID_PARAMS", utils.SafeErrorParam(options[0]), client.t("Invalid parameters"))
+			return false
 		}
+		options = options[2:]
 	}
-	rb.Add(nil, server.name, RPL_LISTEND, client.nick, client.t("End of LIST"))
+
+	// as with MODE, anyone can list bans, but exceptions and invite
+	// exceptions are private to channel operators:
+	details := client.Details()
+	if mode != modes.BanMask && !channel.ClientIsAtLeast(client, modes.ChannelOperator) &&
+		!(details.account != "" && details.account == channel.Founder()) {
+		rb.Add(nil, server.name, ERR_CHANOPRIVSNEEDED, details.nick, channel.Name(), client.t("You're not a channel operator"))
+		return false
+	}
+
+	channel.ShowMaskList(client, mode, matcher, after, limit, rb)
 	return false
 }
 
@@ -1643,7 +2721,7 @@ func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	channel := server.channels.Get(msg.Params[0])
 
 	if channel == nil {
-		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
 		return false
 	}
 
@@ -1662,14 +2740,25 @@ func cmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 			return false
 		}
 	}
+	if server.ReadOnly() && channel.IsRegistered() && modesArePersistent(changes) {
+		rb.Warn("MODE", "READ_ONLY", channel.Name(), client.t("The server is in read-only mode; try again later"))
+		return false
+	}
+
 	// process mode changes, include list operations (an empty set of changes does a list)
-	applied := channel.ApplyChannelModeChanges(client, msg.Command == "SAMODE", changes, rb)
+	isSamode := msg.Command == "SAMODE"
+	applied := channel.ApplyChannelModeChanges(client, isSamode, changes, rb)
+	if isSamode && len(applied) != 0 {
+		logOperOverride(server, client, sno.LocalChannels, fmt.Sprintf("set modes on %s: %s", channel.Name(), strings.Join(applied.Strings(), " ")))
+	}
 	details := client.Details()
 	announceCmodeChanges(channel, applied, details.nickMask, details.accountName, details.account, rb)
 
 	return false
 }
 
+// announceCmodeChanges sends out mode changes to channel members;
+// rb may be nil for changes the server makes on its own (e.g., expirations)
 func announceCmodeChanges(channel *Channel, applied modes.ModeChanges, source, accountName, account string, rb *ResponseBuffer) {
 	// send out changes
 	if len(applied) > 0 {
@@ -1679,10 +2768,12 @@ func announceCmodeChanges(channel *Channel, applied modes.ModeChanges, source, a
 			message.Split = append(message.Split, utils.MessagePair{Message: changeString})
 		}
 		args := append([]string{channel.name}, changeStrings...)
-		rb.AddFromClient(message.Time, message.Msgid, source, accountName, nil, "MODE", args...)
+		if rb != nil {
+			rb.AddFromClient(message.Time, message.Msgid, source, accountName, nil, "MODE", args...)
+		}
 		for _, member := range channel.Members() {
 			for _, session := range member.Sessions() {
-				if session != rb.session {
+				if rb == nil || session != rb.session {
 					session.sendFromClientInternal(false, message.Time, message.Msgid, source, accountName, nil, "MODE", args...)
 				}
 			}
@@ -1701,7 +2792,7 @@ func umodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	cDetails := client.Details()
 	target := server.clients.Get(msg.Params[0])
 	if target == nil {
-		rb.Add(nil, server.name, ERR_NOSUCHNICK, cDetails.nick, utils.SafeErrorParam(msg.Params[0]), client.t("No such nick"))
+		rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(msg.Params[0]), client.t("No such nick"))
 		return false
 	}
 
@@ -1735,6 +2826,9 @@ func umodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 
 		// apply mode changes
 		applied = ApplyUserModeChanges(target, changes, msg.Command == "SAMODE", nil)
+		if msg.Command == "SAMODE" && target != client && len(applied) != 0 {
+			logOperOverride(server, client, sno.LocalOpers, fmt.Sprintf("set modes on %s: %s", targetNick, strings.Join(applied.Strings(), " ")))
+		}
 	}
 
 	if len(applied) > 0 {
@@ -1940,10 +3034,21 @@ func namesHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 // NICK <nickname>
 func nickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if client.registered {
-		if client.account == "" && server.Config().Accounts.NickReservation.ForbidAnonNickChanges {
+		config := server.Config()
+		if client.account == "" && config.Accounts.NickReservation.ForbidAnonNickChanges {
 			rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.Nick(), client.t("You may not change your nickname"))
 			return false
 		}
+		for _, channel := range client.Channels() {
+			if channel.flags.HasMode(modes.NoNickChange) && !channel.ClientIsAtLeast(client, modes.Voice) {
+				rb.Add(nil, server.name, ERR_NONICKCHANGE, client.Nick(), channel.Name(), client.t("Cannot change nickname while in this channel (+N)"))
+				return false
+			}
+		}
+		if throttled, remainingTime := client.checkNickThrottle(config); throttled {
+			rb.Add(nil, server.name, ERR_NICKTOOFAST, client.Nick(), utils.SafeErrorParam(msg.Params[0]), fmt.Sprintf(client.t("Nick change too fast; please wait %v"), remainingTime.Round(time.Second)))
+			return false
+		}
 		performNickChange(server, client, client, nil, msg.Params[0], rb)
 	} else {
 		client.preregNick = msg.Params[0]
@@ -1957,7 +3062,7 @@ func absorbBatchedMessage(server *Server, client *Client, msg ircmsg.IrcMessage,
 	defer func() {
 		if errorCode != "" {
 			if histType != history.Notice {
-				rb.Add(nil, server.name, "FAIL", "BATCH", errorCode, errorMessage)
+				rb.Fail("BATCH", errorCode, errorMessage)
 			}
 			rb.session.EndMultilineBatch("")
 		}
@@ -1969,6 +3074,12 @@ func absorbBatchedMessage(server *Server, client *Client, msg ircmsg.IrcMessage,
 	} else if len(msg.Params) < 2 {
 		errorCode, errorMessage = "MULTILINE_INVALID", client.t("Invalid multiline batch")
 		return
+	} else if msg.Params[0] != rb.session.batch.target {
+		errorCode, errorMessage = "MULTILINE_INVALID_TARGET", client.t("Message target does not match the batch target")
+		return
+	} else if rb.session.batch.command != "" && rb.session.batch.command != msg.Command {
+		errorCode, errorMessage = "MULTILINE_INVALID", client.t("Cannot mix PRIVMSG and NOTICE in a multiline batch")
+		return
 	}
 	rb.session.batch.command = msg.Command
 	isConcat, _ := msg.GetTag(caps.MultilineConcatTag)
@@ -2009,8 +3120,16 @@ func messageHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 		// nothing to do
 		return false
 	}
+	isTyping := histType == history.Tagmsg && isTypingNotification(clientOnlyTags)
+	if isTyping && client.HasMode(modes.UserNoTyping) {
+		// the user opted out of typing notifications in both directions
+		return false
+	}
 
-	targets := strings.Split(msg.Params[0], ",")
+	targets, ok := splitTargets(client, msg.Command, msg.Params[0], rb)
+	if !ok {
+		return false
+	}
 	var message string
 	if len(msg.Params) > 1 {
 		message = msg.Params[1]
@@ -2033,21 +3152,24 @@ func messageHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 		return false
 	}
 
-	for i, targetString := range targets {
-		// max of four targets per privmsg
-		if i == maxTargets {
-			break
-		}
+	if isCTCP && !checkCTCPPolicy(client, message, histType, rb) {
+		return false
+	}
 
+	for _, targetString := range targets {
 		config := server.Config()
 		if config.isRelaymsgIdentifier(targetString) {
 			if histType == history.Privmsg {
-				rb.Add(nil, server.name, ERR_NOSUCHNICK, client.Nick(), targetString, client.t("Relayed users cannot receive private messages"))
+				rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", targetString, client.t("Relayed users cannot receive private messages"))
 			}
 			// TAGMSG/NOTICEs are intentionally silently dropped
 			continue
 		}
 
+		if isTyping && !rb.session.typingLimiter.Allow(strings.ToLower(targetString), clientOnlyTags, config.Limits.Typing.MinInterval, time.Now()) {
+			continue
+		}
+
 		// each target gets distinct msgids
 		splitMsg := utils.MakeMessage(message)
 		dispatchMessageToTarget(client, clientOnlyTags, histType, msg.Command, targetString, splitMsg, rb)
@@ -2055,6 +3177,45 @@ func messageHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 	return false
 }
 
+// splitTargets splits the comma-separated targets of PRIVMSG, NOTICE or
+// TAGMSG, dropping empty and duplicate entries. If there are more than TARGMAX
+// allows, it sends ERR_TOOMANYTARGETS and fails; otherwise, each target beyond
+// the first counts as an additional message against fakelag.
+func splitTargets(client *Client, command, param string, rb *ResponseBuffer) (targets []string, ok bool) {
+	seen := make(utils.StringSet)
+	for _, target := range strings.Split(param, ",") {
+		if target == "" {
+			continue
+		}
+		key, err := CasefoldChannel(target)
+		if err != nil {
+			key, err = CasefoldName(target)
+		}
+		if err != nil {
+			key = target
+		}
+		if seen.Has(key) {
+			continue
+		}
+		seen.Add(key)
+		targets = append(targets, target)
+	}
+
+	if len(targets) == 0 {
+		rb.FailNumeric(ERR_NORECIPIENT, command, "NO_RECIPIENT", fmt.Sprintf(client.t("No recipient given (%s)"), command))
+		return nil, false
+	}
+	maxTargets := client.server.Config().Limits.Targmax.forCommand(command)
+	if len(targets) > maxTargets {
+		rb.FailNumeric(ERR_TOOMANYTARGETS, command, "TOO_MANY_TARGETS", utils.SafeErrorParam(targets[maxTargets]), fmt.Sprintf(client.t("Too many targets; the maximum is %d"), maxTargets))
+		return nil, false
+	}
+	if len(targets) > 1 {
+		rb.session.deferredFakelagCount += len(targets) - 1
+	}
+	return targets, true
+}
+
 func dispatchMessageToTarget(client *Client, tags map[string]string, histType history.ItemType, command, target string, message utils.SplitMessage, rb *ResponseBuffer) {
 	server := client.server
 
@@ -2067,12 +3228,22 @@ func dispatchMessageToTarget(client *Client, tags map[string]string, histType hi
 		channel := server.channels.Get(target)
 		if channel == nil {
 			if histType != history.Notice {
-				rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), utils.SafeErrorParam(target), client.t("No such channel"))
+				rb.FailNumeric(ERR_NOSUCHCHANNEL, command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(target), client.t("No such channel"))
 			}
 			return
 		}
+		if !checkDCCPolicy(client, nil, channel.Name(), message.Message, histType, rb) {
+			return
+		}
 		channel.SendSplitMessage(command, lowestPrefix, tags, client, message, rb)
 	} else {
+		// pseudo-clients introduced by external services take precedence
+		if histType != history.Tagmsg && server.servicesLink.Relay(client, command, target, message.Message) {
+			details := client.Details()
+			rb.addEchoMessage(tags, details.nickMask, details.accountName, command, target, message)
+			return
+		}
+
 		lowercaseTarget := strings.ToLower(target)
 		service, isService := OragonoServices[lowercaseTarget]
 		_, isZNC := zncHandlers[lowercaseTarget]
@@ -2094,13 +3265,22 @@ func dispatchMessageToTarget(client *Client, tags map[string]string, histType hi
 		user := server.clients.Get(target)
 		if user == nil {
 			if histType != history.Notice {
-				rb.Add(nil, server.name, ERR_NOSUCHNICK, client.Nick(), target, "No such nick")
+				rb.FailNumeric(ERR_NOSUCHNICK, command, "NO_SUCH_NICK", target, "No such nick")
 			}
 			return
 		}
 
 		// Restrict CTCP message for target user with +T
 		if user.modes.HasMode(modes.UserNoCTCP) && message.IsRestrictedCTCPMessage() {
+			user.recordBlockedMessage(client)
+			return
+		}
+		if !checkDCCPolicy(client, user, user.Nick(), message.Message, histType, rb) {
+			return
+		}
+
+		// typing notifications are dropped for users who opted out (+Y)
+		if histType == history.Tagmsg && isTypingNotification(tags) && user.HasMode(modes.UserNoTyping) {
 			return
 		}
 
@@ -2118,7 +3298,9 @@ func dispatchMessageToTarget(client *Client, tags map[string]string, histType hi
 		// restrict messages appropriately when +R is set
 		// intentionally make the sending user think the message went through fine
 		allowedPlusR := details.account != "" || !user.HasMode(modes.RegisteredOnly)
-		if allowedPlusR {
+		// likewise if the target has the sender on their SILENCE list
+		silenced := user.isSilencing(client)
+		if allowedPlusR && !silenced {
 			deliverySessions = append(deliverySessions, user.Sessions()...)
 		}
 		// all sessions of the sender, except the originating session, get a copy as well:
@@ -2154,6 +3336,12 @@ func dispatchMessageToTarget(client *Client, tags map[string]string, histType hi
 		}
 
 		if !allowedPlusR {
+			// TAGMSG (typing notifications etc.) isn't worth reporting
+			if histType != history.Tagmsg {
+				user.recordBlockedMessage(client)
+			}
+			return
+		} else if silenced {
 			return
 		}
 
@@ -2173,6 +3361,10 @@ func dispatchMessageToTarget(client *Client, tags map[string]string, histType hi
 func itemIsStorable(item *history.Item, config *Config) bool {
 	switch item.Type {
 	case history.Tagmsg:
+		// typing notifications are ephemeral and never worth storing
+		if isTypingNotification(item.Tags) {
+			return false
+		}
 		if config.History.TagmsgStorage.Default {
 			for _, blacklistedTag := range config.History.TagmsgStorage.Blacklist {
 				if _, ok := item.Tags[blacklistedTag]; ok {
@@ -2218,6 +3410,57 @@ func npcaHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 	return false
 }
 
+// CHALLENGE <name>
+// CHALLENGE +<response>
+func challengeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	if client.HasMode(modes.Operator) {
+		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.Nick(), "CHALLENGE", client.t("You're already opered-up!"))
+		return false
+	}
+
+	param := msg.Params[0]
+	if !strings.HasPrefix(param, "+") {
+		challenge, encoded, err := newOperChallenge(param, server.GetOperator(param), server.Config().operKeySizes)
+		if err != nil {
+			server.logger.Error("internal", "couldn't create oper challenge", err.Error())
+			rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.Nick(), "CHALLENGE", client.t("Could not create a challenge"))
+			return false
+		}
+		rb.session.operChallenge = challenge
+		for len(encoded) != 0 {
+			line := encoded
+			if operChallengeLineLength < len(line) {
+				line = line[:operChallengeLineLength]
+			}
+			encoded = encoded[len(line):]
+			rb.Add(nil, server.name, RPL_RSACHALLENGE2, client.Nick(), line)
+		}
+		rb.Add(nil, server.name, RPL_ENDOFRSACHALLENGE2, client.Nick(), client.t("End of CHALLENGE"))
+		return false
+	}
+
+	// challenges can only be answered once:
+	challenge := rb.session.operChallenge
+	rb.session.operChallenge = nil
+	if challenge == nil {
+		rb.Fail("CHALLENGE", "NO_CHALLENGE", client.t("You have no pending challenge"))
+		return false
+	}
+
+	// the operator must still exist with the same key, and their certfp
+	// must match, if they have one:
+	oper := server.GetOperator(challenge.operName)
+	if !challenge.check(param[1:]) || oper == nil || oper.PublicKey == nil ||
+		!oper.PublicKey.Equal(challenge.publicKey) || (oper.Certfp != "" && oper.Certfp != rb.session.certfp) {
+		rb.FailNumeric(ERR_PASSWDMISMATCH, "CHALLENGE", "PASSWORD_MISMATCH", client.t("Password incorrect"))
+		client.Quit(client.t("Password incorrect"), rb.session)
+		return true
+	}
+
+	applyOper(client, oper, oper.Duration, rb)
+	return false
+}
+
 // OPER <name> [password]
 func operHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	if client.HasMode(modes.Operator) {
@@ -2249,7 +3492,7 @@ func operHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 	}
 
 	if !checkPassed || checkFailed {
-		rb.Add(nil, server.name, ERR_PASSWDMISMATCH, client.Nick(), client.t("Password incorrect"))
+		rb.FailNumeric(ERR_PASSWDMISMATCH, "OPER", "PASSWORD_MISMATCH", client.t("Password incorrect"))
 		// #951: only disconnect them if we actually tried to check a password for them
 		if passwordFailed {
 			client.Quit(client.t("Password incorrect"), rb.session)
@@ -2260,18 +3503,22 @@ func operHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 	}
 
 	if oper != nil {
-		applyOper(client, oper, rb)
+		applyOper(client, oper, oper.Duration, rb)
 	}
 	return false
 }
 
-// adds or removes operator status
+// adds or removes operator status; a nonzero duration makes the status temporary
 // XXX: to add oper, this calls into ApplyUserModeChanges, but to remove oper,
 // ApplyUserModeChanges calls into this, because the commands are asymmetric
 // (/OPER to add, /MODE self -o to remove)
-func applyOper(client *Client, oper *Oper, rb *ResponseBuffer) {
+func applyOper(client *Client, oper *Oper, duration time.Duration, rb *ResponseBuffer) {
 	details := client.Details()
 	client.SetOper(oper)
+	if oper == nil {
+		duration = 0
+	}
+	client.setOperExpiration(duration)
 	newDetails := client.Details()
 	if details.nickMask != newDetails.nickMask {
 		client.sendChghost(details.nickMask, newDetails.hostname)
@@ -2288,14 +3535,21 @@ func applyOper(client *Client, oper *Oper, rb *ResponseBuffer) {
 		applied := ApplyUserModeChanges(client, modeChanges, true, oper)
 
 		client.server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Client opered up $c[grey][$r%s$c[grey], $r%s$c[grey]]"), newDetails.nickMask, oper.Name))
+		client.server.webhooks.Send(WebhookOper, webhookOperData(client, "oper-up"))
 
 		rb.Broadcast(nil, client.server.name, RPL_YOUREOPER, details.nick, client.t("You are now an IRC operator"))
 		args := append([]string{details.nick}, applied.Strings()...)
 		rb.Broadcast(nil, client.server.name, "MODE", args...)
+		if duration != 0 {
+			rb.Broadcast(nil, client.server.name, "NOTICE", details.nick, fmt.Sprintf(client.t("Your operator status will expire in %s"), duration.String()))
+		}
 	} else {
 		client.server.snomasks.Send(sno.LocalOpers, fmt.Sprintf(ircfmt.Unescape("Client deopered $c[grey][$r%s$c[grey]]"), newDetails.nickMask))
+		client.server.webhooks.Send(WebhookOper, webhookOperData(client, "oper-down"))
 	}
 
+	// operator status may change the connection class
+	client.updateConnectionClass()
 	for _, session := range client.Sessions() {
 		// client may now be unthrottled by the fakelag system
 		session.resetFakelag()
@@ -2323,7 +3577,7 @@ func partHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		}
 		err := server.channels.Part(client, chname, reason, rb)
 		if err == errNoSuchChannel {
-			rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, utils.SafeErrorParam(chname), client.t("No such channel"))
+			rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(chname), client.t("No such channel"))
 		}
 	}
 	return false
@@ -2410,15 +3664,15 @@ func quitHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 func registerHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) (exiting bool) {
 	config := server.Config()
 	if !config.Accounts.Registration.Enabled {
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "DISALLOWED", client.t("Account registration is disabled"))
+		rb.Fail("REGISTER", "DISALLOWED", client.t("Account registration is disabled"))
 		return
 	}
 	if !client.registered && !config.Accounts.Registration.AllowBeforeConnect {
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "DISALLOWED", client.t("You must complete the connection before registering your account"))
+		rb.Fail("REGISTER", "DISALLOWED", client.t("You must complete the connection before registering your account"))
 		return
 	}
 	if client.registerCmdSent || client.Account() != "" {
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "ALREADY_REGISTERED", client.t("You have already registered or attempted to register"))
+		rb.Fail("REGISTER", "ALREADY_REGISTERED", client.t("You have already registered or attempted to register"))
 		return
 	}
 
@@ -2427,13 +3681,13 @@ func registerHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *
 		accountName = client.preregNick
 	}
 	if accountName == "" || accountName == "*" {
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "INVALID_USERNAME", client.t("Username invalid or not given"))
+		rb.Fail("REGISTER", "INVALID_USERNAME", client.t("Username invalid or not given"))
 		return
 	}
 
 	callbackNamespace, callbackValue, err := parseCallback(msg.Params[0], config)
 	if err != nil {
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "INVALID_EMAIL", client.t("A valid e-mail address is required"))
+		rb.Fail("REGISTER", "INVALID_EMAIL", client.t("A valid e-mail address is required"))
 		return
 	}
 
@@ -2455,20 +3709,20 @@ func registerHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *
 			}
 			if err != nil {
 				server.logger.Error("internal", "accounts", "failed autoverification", accountName, err.Error())
-				rb.Add(nil, server.name, "FAIL", "REGISTER", "UNKNOWN_ERROR", client.t("An error occurred"))
+				rb.Fail("REGISTER", "UNKNOWN_ERROR", client.t("An error occurred"))
 			}
 		} else {
 			rb.Add(nil, server.name, "REGISTER", "VERIFICATION_REQUIRED", accountName, fmt.Sprintf(client.t("Account created, pending verification; verification code has been sent to %s"), callbackValue))
 			client.registerCmdSent = true
 		}
 	case errAccountAlreadyRegistered, errAccountAlreadyUnregistered, errAccountMustHoldNick:
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "USERNAME_EXISTS", client.t("Username is already registered or otherwise unavailable"))
+		rb.Fail("REGISTER", "USERNAME_EXISTS", client.t("Username is already registered or otherwise unavailable"))
 	case errAccountBadPassphrase:
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "INVALID_PASSWORD", client.t("Password was invalid"))
+		rb.Fail("REGISTER", "INVALID_PASSWORD", client.t("Password was invalid"))
 	case errCallbackFailed:
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "UNACCEPTABLE_EMAIL", client.t("Could not dispatch verification e-mail"))
+		rb.Fail("REGISTER", "UNACCEPTABLE_EMAIL", client.t("Could not dispatch verification e-mail"))
 	default:
-		rb.Add(nil, server.name, "FAIL", "REGISTER", "UNKNOWN_ERROR", client.t("Could not register"))
+		rb.Fail("REGISTER", "UNKNOWN_ERROR", client.t("Could not register"))
 	}
 	return
 }
@@ -2477,15 +3731,15 @@ func registerHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *
 func verifyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) (exiting bool) {
 	config := server.Config()
 	if !config.Accounts.Registration.Enabled {
-		rb.Add(nil, server.name, "FAIL", "VERIFY", "DISALLOWED", client.t("Account registration is disabled"))
+		rb.Fail("VERIFY", "DISALLOWED", client.t("Account registration is disabled"))
 		return
 	}
 	if !client.registered && !config.Accounts.Registration.AllowBeforeConnect {
-		rb.Add(nil, server.name, "FAIL", "VERIFY", "DISALLOWED", client.t("You must complete the connection before verifying your account"))
+		rb.Fail("VERIFY", "DISALLOWED", client.t("You must complete the connection before verifying your account"))
 		return
 	}
 	if client.Account() != "" {
-		rb.Add(nil, server.name, "FAIL", "VERIFY", "ALREADY_REGISTERED", client.t("You have already registered or attempted to register"))
+		rb.Fail("VERIFY", "ALREADY_REGISTERED", client.t("You have already registered or attempted to register"))
 		return
 	}
 
@@ -2501,9 +3755,9 @@ func verifyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		rb.Add(nil, server.name, "VERIFY", "SUCCESS", accountName, client.t("Account successfully registered"))
 		sendSuccessfulRegResponse(nil, client, rb)
 	case errAccountVerificationInvalidCode:
-		rb.Add(nil, server.name, "FAIL", "VERIFY", "INVALID_CODE", client.t("Invalid verification code"))
+		rb.Fail("VERIFY", "INVALID_CODE", client.t("Invalid verification code"))
 	default:
-		rb.Add(nil, server.name, "FAIL", "VERIFY", "UNKNOWN_ERROR", client.t("Failed to verify account"))
+		rb.Fail("VERIFY", "UNKNOWN_ERROR", client.t("Failed to verify account"))
 	}
 
 	if err != nil && !client.registered {
@@ -2515,6 +3769,73 @@ func verifyHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	return
 }
 
+// REDACT <target> <msgid> [:<reason>]
+func redactHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) (exiting bool) {
+	target, msgid := msg.Params[0], msg.Params[1]
+	var reason string
+	if len(msg.Params) > 2 {
+		reason = msg.Params[2]
+	}
+
+	var channel *Channel
+	var correspondent *Client
+	privileged := client.HasRoleCapabs("history")
+	if strings.HasPrefix(target, "#") {
+		channel = server.channels.Get(target)
+		if channel == nil || !channel.hasClient(client) {
+			rb.Fail("REDACT", "INVALID_TARGET", utils.SafeErrorParam(target), client.t("You are not on that channel"))
+			return
+		}
+		target = channel.Name()
+		privileged = privileged || channel.ClientIsAtLeast(client, modes.ChannelOperator)
+	} else {
+		correspondent = server.clients.Get(target)
+		if correspondent == nil {
+			rb.Fail("REDACT", "INVALID_TARGET", utils.SafeErrorParam(target), client.t("No such nick"))
+			return
+		}
+		target = correspondent.Nick()
+	}
+
+	switch server.RedactMessage(client, channel, correspondent, msgid, privileged) {
+	case nil:
+	case errInsufficientPrivs:
+		rb.Fail("REDACT", "REDACT_FORBIDDEN", target, utils.SafeErrorParam(msgid), client.t("You are not authorised to delete this message"))
+		return
+	default:
+		rb.Fail("REDACT", "UNKNOWN_MSGID", target, utils.SafeErrorParam(msgid), client.t("This message does not exist or is too old"))
+		return
+	}
+
+	params := []string{target, msgid}
+	if reason != "" {
+		params = append(params, reason)
+	}
+	var sessions []*Session
+	if channel != nil {
+		for _, member := range channel.Members() {
+			sessions = append(sessions, member.Sessions()...)
+		}
+	} else {
+		sessions = client.Sessions()
+		if correspondent != client {
+			sessions = append(sessions, correspondent.Sessions()...)
+		}
+	}
+	nickMask := client.NickMaskString()
+	for _, session := range sessions {
+		if !session.capabilities.Has(caps.MessageRedaction) {
+			continue
+		}
+		if session == rb.session {
+			rb.Add(nil, nickMask, "REDACT", params...)
+		} else {
+			session.Send(nil, nickMask, "REDACT", params...)
+		}
+	}
+	return
+}
+
 // REHASH
 func rehashHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	nick := client.Nick()
@@ -2537,25 +3858,25 @@ func rehashHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 func relaymsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) (result bool) {
 	config := server.Config()
 	if !config.Server.Relaymsg.Enabled {
-		rb.Add(nil, server.name, "FAIL", "RELAYMSG", "NOT_ENABLED", client.t("RELAYMSG has been disabled"))
+		rb.Fail("RELAYMSG", "NOT_ENABLED", client.t("RELAYMSG has been disabled"))
 		return false
 	}
 
 	channel := server.channels.Get(msg.Params[0])
 	if channel == nil {
-		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
 		return false
 	}
 
 	allowedToRelay := client.HasRoleCapabs("relaymsg") || (config.Server.Relaymsg.AvailableToChanops && channel.ClientIsAtLeast(client, modes.ChannelOperator))
 	if !allowedToRelay {
-		rb.Add(nil, server.name, "FAIL", "RELAYMSG", "PRIVS_NEEDED", client.t("You cannot relay messages to this channel"))
+		rb.Fail("RELAYMSG", "PRIVS_NEEDED", client.t("You cannot relay messages to this channel"))
 		return false
 	}
 
 	rawMessage := msg.Params[2]
 	if strings.TrimSpace(rawMessage) == "" {
-		rb.Add(nil, server.name, "FAIL", "RELAYMSG", "BLANK_MSG", client.t("The message must not be blank"))
+		rb.Fail("RELAYMSG", "BLANK_MSG", client.t("The message must not be blank"))
 		return false
 	}
 	message := utils.MakeMessage(rawMessage)
@@ -2563,19 +3884,19 @@ func relaymsgHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *
 	nick := msg.Params[1]
 	_, err := CasefoldName(nick)
 	if err != nil {
-		rb.Add(nil, server.name, "FAIL", "RELAYMSG", "INVALID_NICK", client.t("Invalid nickname"))
+		rb.Fail("RELAYMSG", "INVALID_NICK", client.t("Invalid nickname"))
 		return false
 	}
 	if !config.isRelaymsgIdentifier(nick) {
-		rb.Add(nil, server.name, "FAIL", "RELAYMSG", "INVALID_NICK", fmt.Sprintf(client.t("Relayed nicknames MUST contain a relaymsg separator from this set: %s"), config.Server.Relaymsg.Separators))
+		rb.Fail("RELAYMSG", "INVALID_NICK", fmt.Sprintf(client.t("Relayed nicknames MUST contain a relaymsg separator from this set: %s"), config.Server.Relaymsg.Separators))
 		return false
 	}
 
-	channel.AddHistoryItem(history.Item{
+	channel.addLimitedHistoryItem(history.Item{
 		Type:    history.Privmsg,
 		Message: message,
 		Nick:    nick,
-	}, "")
+	}, "", client.authoredHistoryLimit())
 
 	// send msg
 	channelName := channel.Name()
@@ -2609,37 +3930,37 @@ func renameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 
 	channel := server.channels.Get(oldName)
 	if channel == nil {
-		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), utils.SafeErrorParam(oldName), client.t("No such channel"))
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(oldName), client.t("No such channel"))
 		return false
 	}
 	oldName = channel.Name()
 
 	if !(channel.ClientIsAtLeast(client, modes.ChannelOperator) || client.HasRoleCapabs("chanreg")) {
-		rb.Add(nil, server.name, ERR_CHANOPRIVSNEEDED, client.Nick(), oldName, client.t("You're not a channel operator"))
+		rb.FailNumeric(ERR_CHANOPRIVSNEEDED, msg.Command, "PRIVS_NEEDED", oldName, client.t("You're not a channel operator"))
 		return false
 	}
 
 	founder := channel.Founder()
 	if founder != "" && founder != client.Account() {
-		rb.Add(nil, server.name, "FAIL", "RENAME", "CANNOT_RENAME", oldName, utils.SafeErrorParam(newName), client.t("Only channel founders can change registered channels"))
+		rb.Fail("RENAME", "CANNOT_RENAME", oldName, utils.SafeErrorParam(newName), client.t("Only channel founders can change registered channels"))
 		return false
 	}
 
 	config := server.Config()
 	status, _ := channel.historyStatus(config)
 	if status == HistoryPersistent {
-		rb.Add(nil, server.name, "FAIL", "RENAME", "CANNOT_RENAME", oldName, utils.SafeErrorParam(newName), client.t("Channels with persistent history cannot be renamed"))
+		rb.Fail("RENAME", "CANNOT_RENAME", oldName, utils.SafeErrorParam(newName), client.t("Channels with persistent history cannot be renamed"))
 		return false
 	}
 
 	// perform the channel rename
 	err := server.channels.Rename(oldName, newName)
 	if err == errInvalidChannelName {
-		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.Nick(), utils.SafeErrorParam(newName), client.t(err.Error()))
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(newName), client.t(err.Error()))
 	} else if err == errChannelNameInUse {
-		rb.Add(nil, server.name, "FAIL", "RENAME", "CHANNEL_NAME_IN_USE", oldName, utils.SafeErrorParam(newName), client.t(err.Error()))
+		rb.Fail("RENAME", "CHANNEL_NAME_IN_USE", oldName, utils.SafeErrorParam(newName), client.t(err.Error()))
 	} else if err != nil {
-		rb.Add(nil, server.name, "FAIL", "RENAME", "CANNOT_RENAME", oldName, utils.SafeErrorParam(newName), client.t("Cannot rename channel"))
+		rb.Fail("RENAME", "CANNOT_RENAME", oldName, utils.SafeErrorParam(newName), client.t("Cannot rename channel"))
 	}
 	if err != nil {
 		return false
@@ -2692,7 +4013,7 @@ func resumeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	}
 
 	if client.registered {
-		rb.Add(nil, server.name, "FAIL", "RESUME", "REGISTRATION_IS_COMPLETED", client.t("Cannot resume connection, connection registration has already been completed"))
+		rb.Fail("RESUME", "REGISTRATION_IS_COMPLETED", client.t("Cannot resume connection, connection registration has already been completed"))
 		return false
 	}
 
@@ -2701,7 +4022,7 @@ func resumeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 		if err == nil {
 			details.Timestamp = ts
 		} else {
-			rb.Add(nil, server.name, "WARN", "RESUME", "HISTORY_LOST", client.t("Timestamp is not in 2006-01-02T15:04:05.999Z format, ignoring it"))
+			rb.Warn("RESUME", "HISTORY_LOST", client.t("Timestamp is not in 2006-01-02T15:04:05.999Z format, ignoring it"))
 		}
 	}
 
@@ -2714,7 +4035,7 @@ func sanickHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Re
 	targetNick := msg.Params[0]
 	target := server.clients.Get(targetNick)
 	if target == nil {
-		rb.Add(nil, server.name, "FAIL", "SANICK", "NO_SUCH_NICKNAME", utils.SafeErrorParam(targetNick), client.t("No such nick"))
+		rb.Fail("SANICK", "NO_SUCH_NICKNAME", utils.SafeErrorParam(targetNick), client.t("No such nick"))
 		return false
 	}
 	performNickChange(server, client, target, nil, msg.Params[1], rb)
@@ -2731,6 +4052,97 @@ func sceneHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	return false
 }
 
+// SESSION LIST
+// SESSION KILL <session ID>
+// SESSION LABEL <label>
+func sessionHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	subcommand := strings.ToUpper(msg.Params[0])
+	if subcommand == "LABEL" {
+		// this can be used during registration, to name the new session
+		if len(msg.Params) < 2 {
+			rb.Fail("SESSION", "NEED_MORE_PARAMS", client.t("Not enough parameters"))
+			return false
+		}
+		label := strings.Join(msg.Params[1:], " ")
+		if label == "*" {
+			label = ""
+		} else if !validSessionLabel(label) {
+			rb.Fail("SESSION", "INVALID_LABEL", utils.SafeErrorParam(label), client.t("Invalid session label"))
+			return false
+		}
+		rb.session.SetLabel(label)
+		rb.Note("SESSION", "LABEL_SET", client.t("Session label set"))
+		return false
+	}
+	if !client.registered {
+		rb.FailNumeric(ERR_NOTREGISTERED, "SESSION", "NOT_REGISTERED", client.t("You need to register before you can use that command"))
+		return false
+	}
+
+	switch subcommand {
+	case "LIST":
+		sessionData, currentIndex := client.AllSessionData(rb.session, false)
+		for i, session := range sessionData {
+			label := session.label
+			if label == "" {
+				label = session.deviceID
+			}
+			if label == "" {
+				label = "*"
+			}
+			params := []string{"ENTRY", strconv.FormatInt(session.sessionID, 10), label, session.ip.String(),
+				session.ctime.UTC().Format(IRCv3TimestampFormat), session.atime.UTC().Format(IRCv3TimestampFormat)}
+			if i == currentIndex {
+				params = append(params, "CURRENT")
+			}
+			rb.Add(nil, server.name, "SESSION", params...)
+		}
+		rb.Add(nil, server.name, "SESSION", "END")
+	case "KILL":
+		if len(msg.Params) < 2 {
+			rb.Fail("SESSION", "NEED_MORE_PARAMS", client.t("Not enough parameters"))
+			return false
+		}
+		sessionID, err := strconv.ParseInt(msg.Params[1], 10, 64)
+		var target *Session
+		if err == nil {
+			for _, session := range client.Sessions() {
+				if session.sessionID == sessionID {
+					target = session
+				}
+			}
+		}
+		if target == nil {
+			rb.Fail("SESSION", "UNKNOWN_SESSION", utils.SafeErrorParam(msg.Params[1]), client.t("Specified session ID does not exist"))
+			return false
+		}
+		if target == rb.session {
+			client.Quit(client.t("Session killed"), rb.session)
+			return true
+		}
+		client.Quit(client.t("Session killed"), target)
+		client.destroy(target)
+		rb.Note("SESSION", "KILLED", msg.Params[1], client.t("Session disconnected"))
+	default:
+		rb.Fail("SESSION", "UNKNOWN_COMMAND", utils.SafeErrorParam(msg.Params[0]), client.t("Unknown subcommand"))
+	}
+	return false
+}
+
+// validSessionLabel returns whether a session label can be displayed as a
+// single parameter of SESSION LIST
+func validSessionLabel(label string) bool {
+	if label == "" || len(label) > maxSessionLabelLen || label[0] == ':' {
+		return false
+	}
+	for _, r := range label {
+		if r <= ' ' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
 // SETNAME <realname>
 func setnameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	realname := msg.Params[0]
@@ -2739,8 +4151,8 @@ func setnameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 		// so you can do `/setname Jane Doe` in the client and get the expected result
 		realname = strings.Join(msg.Params, " ")
 	}
-	if realname == "" {
-		rb.Add(nil, server.name, "FAIL", "SETNAME", "INVALID_REALNAME", client.t("Realname is not valid"))
+	if realname == "" || (server.Config().isRestrictedRealname(realname) && !client.HasMode(modes.Operator)) {
+		rb.Fail("SETNAME", "INVALID_REALNAME", client.t("Realname is not valid"))
 		return false
 	}
 
@@ -2759,6 +4171,71 @@ func setnameHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 	return false
 }
 
+// SILENCE [{+|-}<mask>{,{+|-}<mask>}]
+func silenceHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	account := client.Account()
+	if account == "" {
+		rb.Fail("SILENCE", "ACCOUNT_REQUIRED", client.t("You must be logged in to use SILENCE"))
+		return false
+	}
+
+	if len(msg.Params) == 0 {
+		nick := client.Nick()
+		for _, mask := range client.AccountSettings().Silence {
+			rb.Add(nil, server.name, RPL_SILELIST, nick, mask)
+		}
+		rb.Add(nil, server.name, RPL_ENDOFSILELIST, nick, client.t("End of silence list"))
+		return false
+	}
+
+	if rejectReadOnly(server, client, msg.Command, rb) {
+		return false
+	}
+
+	for _, entry := range strings.Split(msg.Params[0], ",") {
+		add := true
+		if len(entry) != 0 && (entry[0] == '+' || entry[0] == '-') {
+			add = entry[0] == '+'
+			entry = entry[1:]
+		}
+		if entry == "" {
+			continue
+		}
+		mask, err := CanonicalizeMaskWildcard(entry)
+		if err != nil {
+			rb.Fail("SILENCE", "INVALID_MASK", utils.SafeErrorParam(entry), client.t("Invalid mask"))
+			continue
+		}
+		changed, err := client.modifySilenceList(mask, add)
+		if err == errSilenceListFull {
+			rb.Add(nil, server.name, ERR_SILELISTFULL, client.Nick(), mask, client.t("Your silence list is full"))
+			continue
+		} else if err != nil {
+			server.logger.Error("internal", "couldn't update silence list", account, err.Error())
+			rb.Fail("SILENCE", "UNKNOWN_ERROR", client.t("An error occurred"))
+			continue
+		}
+		if !changed {
+			continue
+		}
+		// confirm the change to every session of the account
+		change := "-" + mask
+		if add {
+			change = "+" + mask
+		}
+		for _, accountClient := range server.accounts.AccountToClients(account) {
+			for _, session := range accountClient.Sessions() {
+				if session == rb.session {
+					rb.Add(nil, client.NickMaskString(), "SILENCE", change)
+				} else {
+					session.Send(nil, accountClient.NickMaskString(), "SILENCE", change)
+				}
+			}
+		}
+	}
+	return false
+}
+
 // SUMMON [parameters]
 func summonHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	rb.Add(nil, server.name, ERR_SUMMONDISABLED, client.Nick(), client.t("SUMMON has been disabled"))
@@ -2771,15 +4248,57 @@ func timeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 	return false
 }
 
+// TIMEDMODE <channel> <duration> <modestring> [<mode arguments>...]
+func timedmodeHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
+	channel := server.channels.Get(msg.Params[0])
+	if channel == nil {
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		return false
+	}
+	duration, err := custime.ParseDuration(msg.Params[1])
+	if err != nil || duration <= 0 {
+		rb.Fail("TIMEDMODE", "INVALID_DURATION", utils.SafeErrorParam(msg.Params[1]), client.t("Invalid duration"))
+		return false
+	}
+
+	changes, unknown := modes.ParseChannelModeChanges(msg.Params[2:]...)
+	for char := range unknown {
+		rb.Add(nil, server.name, ERR_UNKNOWNMODE, client.nick, string(char), client.t("is an unknown mode character to me"))
+	}
+	for _, change := range changes {
+		if !timedModeSupported(change) {
+			rb.Fail("TIMEDMODE", "UNSUPPORTED_MODE", string(change.Op)+string(change.Mode), client.t("That mode cannot be set temporarily"))
+			return false
+		}
+	}
+	if len(changes) == 0 {
+		return false
+	}
+	if server.ReadOnly() && channel.IsRegistered() {
+		rb.Warn("TIMEDMODE", "READ_ONLY", channel.Name(), client.t("The server is in read-only mode; try again later"))
+		return false
+	}
+
+	applied := channel.ApplyChannelModeChanges(client, false, changes, rb)
+	channel.setTimedModes(applied, time.Now().UTC().Add(duration))
+	details := client.Details()
+	announceCmodeChanges(channel, applied, details.nickMask, details.accountName, details.account, rb)
+	return false
+}
+
 // TOPIC <channel> [<topic>]
 func topicHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	channel := server.channels.Get(msg.Params[0])
 	if channel == nil {
-		rb.Add(nil, server.name, ERR_NOSUCHCHANNEL, client.nick, utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
+		rb.FailNumeric(ERR_NOSUCHCHANNEL, msg.Command, "NO_SUCH_CHANNEL", utils.SafeErrorParam(msg.Params[0]), client.t("No such channel"))
 		return false
 	}
 
 	if len(msg.Params) > 1 {
+		if server.ReadOnly() && channel.IsRegistered() {
+			rb.Warn("TOPIC", "READ_ONLY", channel.Name(), client.t("The server is in read-only mode; try again later"))
+			return false
+		}
 		channel.SetTopic(client, msg.Params[1], rb)
 	} else {
 		channel.SendTopic(client, rb, true)
@@ -2787,11 +4306,10 @@ func topicHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 	return false
 }
 
-// UNDLINE <ip>|<net>
+// UNDLINE <ip>|<net>|<hostname>|<asn>
 func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	// check oper permissions
-	oper := client.Oper()
-	if oper == nil || !oper.Class.Capabilities.Has("local_unban") {
+	if !client.HasRoleCapabs("ban") {
 		rb.Add(nil, server.name, ERR_NOPRIVS, client.nick, msg.Command, client.t("Insufficient oper privs"))
 		return false
 	}
@@ -2805,21 +4323,21 @@ func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 	}
 
 	// check host
-	hostNet, err := utils.NormalizedNetFromString(hostString)
+	target, err := parseDlineTarget(hostString)
 
 	if err != nil {
-		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("Could not parse IP address or CIDR network"))
+		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, client.t("Could not parse IP address, CIDR network, hostname, or ASN"))
 		return false
 	}
 
-	err = server.dlines.RemoveNetwork(hostNet)
+	err = server.dlines.RemoveTarget(target)
 
 	if err != nil {
 		rb.Add(nil, server.name, ERR_UNKNOWNERROR, client.nick, msg.Command, fmt.Sprintf(client.t("Could not remove ban [%s]"), err.Error()))
 		return false
 	}
 
-	hostString = utils.NetToNormalizedString(hostNet)
+	hostString = target.Display()
 	rb.Notice(fmt.Sprintf(client.t("Removed D-Line for %s"), hostString))
 	server.snomasks.Send(sno.LocalXline, fmt.Sprintf(ircfmt.Unescape("%s$r removed D-Line for %s"), client.nick, hostString))
 	return false
@@ -2829,8 +4347,7 @@ func unDLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *R
 func unKLineHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
 	details := client.Details()
 	// check oper permissions
-	oper := client.Oper()
-	if oper == nil || !oper.Class.Capabilities.Has("local_unban") {
+	if !client.HasRoleCapabs("ban") {
 		rb.Add(nil, server.name, ERR_NOPRIVS, details.nick, msg.Command, client.t("Insufficient oper privs"))
 		return false
 	}
@@ -2867,6 +4384,10 @@ func userHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Resp
 		rb.Add(nil, server.name, ERR_NEEDMOREPARAMS, client.Nick(), client.t("Not enough parameters"))
 		return false
 	}
+	if server.Config().isRestrictedRealname(realname) {
+		rb.Fail("USER", "INVALID_REALNAME", client.t("Realname is not valid"))
+		return false
+	}
 
 	// #843: we accept either: `USER user:pass@clientid` or `USER user@clientid`
 	if strudelIndex := strings.IndexByte(username, '@'); strudelIndex != -1 {
@@ -2912,13 +4433,13 @@ func operStatusVisible(client, target *Client, hasPrivs bool) bool {
 
 // USERHOST <nickname>{ <nickname>}
 func userhostHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
-	hasPrivs := client.HasMode(modes.Operator) // TODO(#1176) figure out the right capab for this
+	hasPrivs := client.HasRoleCapabs("view-ips")
 	returnedClients := make(ClientSet)
 
 	var tl utils.TokenLineBuilder
 	tl.Initialize(400, " ")
 	for i, nickname := range msg.Params {
-		if i >= 10 {
+		if i >= maxUserhostTargets {
 			break
 		}
 
@@ -3052,8 +4573,13 @@ func (fields whoxFields) Has(field rune) bool {
 // whox format:
 // <type> <channel> <user> <ip> <host> <server> <nick> <H|G>[*][~|&|@|%|+][B] <hops> <idle> <account> <rank> :<real name>
 func (client *Client) rplWhoReply(channel *Channel, target *Client, rb *ResponseBuffer, hasPrivs, includeRFlag, isWhox bool, fields whoxFields, whoType string) {
-	params := []string{client.Nick()}
+	params := client.whoReplyParams(channel, target, rb.session.capabilities.Has(caps.MultiPrefix), hasPrivs, includeRFlag, isWhox, fields, whoType)
+	sendWhoReply(client, rb, isWhox, params)
+}
 
+// whoReplyParams returns the parameters of a WHO(X) reply, after the
+// recipient's nickname
+func (client *Client) whoReplyParams(channel *Channel, target *Client, isMultiPrefix, hasPrivs, includeRFlag, isWhox bool, fields whoxFields, whoType string) (params []string) {
 	details := target.Details()
 
 	if fields.Has('t') {
@@ -3072,7 +4598,7 @@ func (client *Client) rplWhoReply(channel *Channel, target *Client, rb *Response
 	if fields.Has('i') {
 		fIP := "255.255.255.255"
 		if hasPrivs || client == target {
-			// you can only see a target's IP if they're you or you're an oper
+			// you can only see a target's IP if they're you or you have view-ips
 			fIP = target.IPString()
 		}
 		params = append(params, fIP)
@@ -3099,7 +4625,7 @@ func (client *Client) rplWhoReply(channel *Channel, target *Client, rb *Response
 		}
 
 		if channel != nil {
-			flags.WriteString(channel.ClientPrefixes(target, rb.session.capabilities.Has(caps.MultiPrefix)))
+			flags.WriteString(channel.ClientPrefixes(target, isMultiPrefix))
 		}
 
 		if target.HasMode(modes.Bot) {
@@ -3117,7 +4643,11 @@ func (client *Client) rplWhoReply(channel *Channel, target *Client, rb *Response
 		params = append(params, "0")
 	}
 	if fields.Has('l') {
-		params = append(params, fmt.Sprintf("%d", target.IdleSeconds()))
+		fIdle := "0"
+		if !client.whoisPrivacy(target).HideIdle {
+			fIdle = fmt.Sprintf("%d", target.IdleSeconds())
+		}
+		params = append(params, fIdle)
 	}
 	if fields.Has('a') {
 		fAccount := "0"
@@ -3127,22 +4657,32 @@ func (client *Client) rplWhoReply(channel *Channel, target *Client, rb *Response
 		}
 		params = append(params, fAccount)
 	}
-	if fields.Has('o') { // target's channel power level
-		//TODO: implement this
-		params = append(params, "0")
+	if fields.Has('o') { // target's channel oplevel; as in ircu, lower is more powerful
+		oplevel := "n/a"
+		if channel != nil {
+			if level, ok := modes.ChannelOplevel(channel.HighestUserMode(target)); ok {
+				oplevel = strconv.Itoa(level)
+			}
+		}
+		params = append(params, oplevel)
 	}
 	if fields.Has('r') {
 		params = append(params, details.realname)
 	}
 
-	numeric := RPL_WHOSPCRPL
 	if !isWhox {
-		numeric = RPL_WHOREPLY
 		// if this isn't WHOX, stick hops + realname at the end
 		params = append(params, "0 "+details.realname)
 	}
+	return
+}
 
-	rb.Add(nil, client.server.name, numeric, params...)
+func sendWhoReply(client *Client, rb *ResponseBuffer, isWhox bool, params []string) {
+	numeric := RPL_WHOSPCRPL
+	if !isWhox {
+		numeric = RPL_WHOREPLY
+	}
+	rb.Add(nil, client.server.name, numeric, append([]string{client.Nick()}, params...)...)
 }
 
 // WHO <mask> [<filter>%<fields>,<type>]
@@ -3198,24 +4738,40 @@ func whoHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Respo
 	//}
 
 	isOper := client.HasMode(modes.Operator)
+	hasPrivs := client.HasRoleCapabs("view-ips")
 	if mask[0] == '#' {
 		// TODO implement wildcard matching
 		//TODO(dan): ^ only for opers
 		channel := server.channels.Get(mask)
+		var view memberListView
+		var cacheable bool
 		if channel != nil {
-			isJoined := channel.hasClient(client)
-			if !channel.flags.HasMode(modes.Secret) || isJoined || isOper {
-				var members []*Client
-				if isOper {
-					members = channel.Members()
+			view, cacheable = channel.cacheableMemberListView(client, hasPrivs)
+		}
+		if cacheable {
+			isMultiPrefix := rb.session.capabilities.Has(caps.MultiPrefix)
+			kind := fmt.Sprintf("WHO %t %t %t %q %q", isMultiPrefix, includeRFlag, isWhox, sFields, whoType)
+			rows := channel.cachedMemberList(client, view, kind, func(member *Client) ([]string, bool) {
+				if !view.isJoined && client.whoisPrivacy(member).HideChannels {
+					return nil, false
+				}
+				return client.whoReplyParams(channel, member, isMultiPrefix, hasPrivs, includeRFlag, isWhox, fields, whoType), true
+			})
+			for _, row := range rows {
+				if row.params != nil {
+					sendWhoReply(client, rb, isWhox, row.params)
 				} else {
-					members = channel.auditoriumFriends(client)
+					client.rplWhoReply(channel, row.member, rb, hasPrivs, includeRFlag, isWhox, fields, whoType)
 				}
-				for _, member := range members {
-					if !member.HasMode(modes.Invisible) || isJoined || isOper {
-						client.rplWhoReply(channel, member, rb, isOper, includeRFlag, isWhox, fields, whoType)
-					}
+			}
+		} else if channel != nil {
+			isMember := channel.hasClient(client)
+			for _, member := range channel.visibleMembers(client) {
+				// members who hide their channels are only listed to fellow members
+				if !isMember && client.whoisPrivacy(member).HideChannels {
+					continue
 				}
+				client.rplWhoReply(channel, member, rb, hasPrivs, includeRFlag, isWhox, fields, whoType)
 			}
 		}
 	} else {
@@ -3232,10 +4788,7 @@ func whoHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Respo
 			}
 
 			for _, channel := range otherClient.Channels() {
-				if channel.flags.HasMode(modes.Auditorium) {
-					return false // TODO this should respect +v etc.
-				}
-				if _, present := userChannels[channel]; present {
+				if _, present := userChannels[channel]; present && channel.canSeeMember(client, otherClient) {
 					return true
 				}
 			}
@@ -3243,8 +4796,8 @@ func whoHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Respo
 		}
 
 		for mclient := range server.clients.FindAll(mask) {
-			if isOper || !mclient.HasMode(modes.Invisible) || isFriend(mclient) {
-				client.rplWhoReply(nil, mclient, rb, isOper, includeRFlag, isWhox, fields, whoType)
+			if isOper || !(mclient.HasMode(modes.Invisible) || mclient.hiddenFromWho()) || isFriend(mclient) {
+				client.rplWhoReply(nil, mclient, rb, hasPrivs, includeRFlag, isWhox, fields, whoType)
 			}
 		}
 	}
@@ -3287,12 +4840,12 @@ func whoisHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		return true
 	}
 
-	hasPrivs := client.HasMode(modes.Operator) // TODO(#1176) figure out the right capab for this
-	if hasPrivs {
+	hasPrivs := client.HasRoleCapabs("view-ips")
+	if client.HasMode(modes.Operator) {
 		for _, mask := range strings.Split(masksString, ",") {
 			matches := server.clients.FindAll(mask)
 			if len(matches) == 0 && !handleService(mask) {
-				rb.Add(nil, client.server.name, ERR_NOSUCHNICK, client.Nick(), utils.SafeErrorParam(mask), client.t("No such nick"))
+				rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(mask), client.t("No such nick"))
 				continue
 			}
 			for mclient := range matches {
@@ -3306,7 +4859,7 @@ func whoisHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *Res
 		if mclient != nil {
 			client.getWhoisOf(mclient, hasPrivs, rb)
 		} else if !handleService(nick) {
-			rb.Add(nil, client.server.name, ERR_NOSUCHNICK, client.Nick(), utils.SafeErrorParam(masksString), client.t("No such nick"))
+			rb.FailNumeric(ERR_NOSUCHNICK, msg.Command, "NO_SUCH_NICK", utils.SafeErrorParam(masksString), client.t("No such nick"))
 		}
 		// fall through, ENDOFWHOIS is always sent
 	}
@@ -3367,6 +4920,6 @@ func unknownCommandHandler(server *Server, client *Client, msg ircmsg.IrcMessage
 
 // fake handler for invalid utf8
 func invalidUtf8Handler(server *Server, client *Client, msg ircmsg.IrcMessage, rb *ResponseBuffer) bool {
-	rb.Add(nil, server.name, "FAIL", utils.SafeErrorParam(msg.Command), "INVALID_UTF8", client.t("Message rejected for containing invalid UTF-8"))
+	rb.Fail(utils.SafeErrorParam(msg.Command), "INVALID_UTF8", client.t("Message rejected for containing invalid UTF-8"))
 	return false
 }
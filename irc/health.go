@@ -0,0 +1,143 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/tidwall/buntdb"
+)
+
+// debugHandler serves pprof (via the default mux, where net/http/pprof
+// registers itself), together with health and readiness checks suitable
+// for container orchestrators.
+func (server *Server) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", server.handleHealthz)
+	mux.HandleFunc("/readyz", server.handleReadyz)
+	mux.Handle("/", http.DefaultServeMux)
+	return mux
+}
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func writeHealthReport(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleHealthz reports liveness: the server is running and can respond.
+func (server *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealthReport(w, healthReport{Status: "ok"})
+}
+
+// handleReadyz reports readiness: the server is accepting new clients
+// and its datastores are available.
+func (server *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := healthReport{
+		Status: "ok",
+		Checks: make(map[string]string),
+	}
+	fail := func(check, message string) {
+		report.Status = "unavailable"
+		report.Checks[check] = message
+	}
+
+	if server.Draining() {
+		fail("server", "draining for shutdown")
+	} else {
+		report.Checks["server"] = "ok"
+	}
+
+	err := server.store.View(func(tx *buntdb.Tx) error {
+		_, err := tx.Get(keySchemaVersion)
+		return err
+	})
+	if err != nil {
+		fail("datastore", err.Error())
+	} else {
+		report.Checks["datastore"] = "ok"
+	}
+
+	for _, backend := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"mysql", server.Config().Datastore.MySQL.Enabled},
+		{"postgresql", server.Config().Datastore.PostgreSQL.Enabled},
+	} {
+		if !backend.enabled {
+			report.Checks[backend.name] = "disabled"
+		} else if err := server.historyDB.Ping(); err != nil {
+			fail(backend.name, err.Error())
+		} else {
+			report.Checks[backend.name] = "ok"
+		}
+	}
+
+	writeHealthReport(w, report)
+}
+
+// drain stops accepting new connections, announces the impending shutdown
+// (or restart, for a graceful upgrade), and waits (up to
+// server.shutdown-grace-period) for clients to quit.
+// Another exit signal ends the wait immediately.
+func (server *Server) drain(restarting bool) {
+	gracePeriod := server.Config().Server.ShutdownGracePeriod
+	if gracePeriod <= 0 {
+		return
+	}
+	atomic.StoreUint32(&server.draining, 1)
+	server.logger.Info("server", "Draining clients before shutdown", gracePeriod.String())
+
+	for _, listener := range server.listeners {
+		listener.Stop()
+	}
+	for _, client := range server.clients.AllClients() {
+		if restarting {
+			client.Notice(fmt.Sprintf(client.t("Server is restarting in %v; please reconnect shortly"), gracePeriod))
+		} else {
+			client.Notice(fmt.Sprintf(client.t("Server is shutting down in %v; please reconnect later"), gracePeriod))
+		}
+	}
+
+	deadline := time.NewTimer(gracePeriod)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.signals:
+			return
+		case <-deadline.C:
+			return
+		case <-ticker.C:
+			if server.connectedClientCount() == 0 {
+				return
+			}
+		}
+	}
+}
+
+// connectedClientCount counts the clients that still have sessions
+// (always-on clients persist without any).
+func (server *Server) connectedClientCount() (count int) {
+	server.clients.Range(func(client *Client) bool {
+		if len(client.Sessions()) != 0 {
+			count++
+		}
+		return true
+	})
+	return
+}
@@ -5,6 +5,9 @@ package irc
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
@@ -58,6 +61,18 @@ Oragono supports the following channel modes:
          from unvoiced clients.
   +U  |  Op-moderated mode: messages from unprivileged clients are sent
          only to channel operators.
+  +D  |  Delayed-join mode: JOIN lines for unprivileged clients are hidden
+         until they first speak in the channel.
+  +A  |  Anonymous mode: JOIN, PART, QUIT, NAMES, and WHO are hidden for
+         unprivileged clients, and their messages are sent from rotating
+         pseudonyms.
+  +Q  |  No-REMOVE mode: REMOVE can't be used in the channel (KICK still
+         can).
+  +Y  |  No-typing mode: typing notifications aren't relayed to the channel.
+  +N  |  No-nick-change mode: unprivileged clients can't change their
+         nicknames while in the channel.
+  +G  |  Censor mode: words on the network's censor list are replaced
+         with asterisks in messages to the channel.
 
 = Prefixes =
 
@@ -78,13 +93,15 @@ Oragono supports the following user modes:
   +Z  |  User is connected via TLS.
   +B  |  User is a bot.
   +E  |  User can receive roleplaying commands.
-  +T  |  CTCP messages to the user are blocked.`
+  +T  |  CTCP messages to the user are blocked.
+  +Y  |  Typing notifications to and from the user aren't relayed.`
 	snomaskHelpText = `== Server Notice Masks ==
 
 Oragono supports the following server notice masks for operators:
 
   a  |  Local announcements.
   c  |  Local client connections.
+  d  |  Local blocked DCC transfers.
   j  |  Local channel actions.
   k  |  Local kills.
   n  |  Local nick changes.
@@ -119,6 +136,15 @@ https://oragono.io/specs.html`,
 		text: `AMBIANCE <target> <text to be sent>
 
 The AMBIANCE command is used to send a scene notification to the given target.`,
+	},
+	"announce": {
+		oper: true,
+		text: `ANNOUNCE <ALL | ACCOUNTS | #channel,...> <message>
+
+Sends a notice from the server to every connected user (ALL), to users who
+are logged into an account (ACCOUNTS), or to the members of the given
+channels. Announcements are rate-limited, and are logged and reported to
+operators subscribed to the 'a' snomask.`,
 	},
 	"authenticate": {
 		text: `AUTHENTICATE
@@ -131,6 +157,32 @@ http://ircv3.net/specs/extensions/sasl-3.1.html`,
 
 If [message] is sent, marks you away. If [message] is not sent, marks you no
 longer away.`,
+	},
+	"backup": {
+		oper: true,
+		text: `BACKUP
+
+Writes a consistent snapshot of the datastore to a new file next to the
+existing one, without stopping the server. To restore it, stop the server
+and run "oragono restoredb".`,
+	},
+	"bans": {
+		oper: true,
+		text: `BANS IMPORT <filename> [OVERWRITE] [DRYRUN] [JSON|PLAIN]
+BANS EXPORT <filename> [JSON|PLAIN]
+
+Imports or exports K-lines and D-lines in bulk, e.g., to migrate a ban list
+from another server. Files are read from and written to the directory
+containing the datastore.
+
+The PLAIN format has one IP, CIDR or mask per line, optionally followed by
+a reason and "| oper reason"; lines starting with # are ignored. The JSON format keeps the
+expiration time and oper reason of each ban. If no format is given, EXPORT
+uses JSON and IMPORT detects the format from the file's contents.
+
+By default, bans that already exist are kept; with OVERWRITE, they are
+replaced by the imported ones. With DRYRUN, the file is only validated.
+Clients matching the imported bans are not disconnected.`,
 	},
 	"batch": {
 		text: `BATCH {+,-}reference-tag type [params...]
@@ -145,6 +197,18 @@ Disconnects you from the server, while instructing the server to keep you
 present for a short time window. During this window, you can either resume
 or reattach to your nickname. If [message] is sent, it is used as your away
 message (and as your quit message if you don't return in time).`,
+	},
+	"bridge": {
+		text: `BRIDGE AUTH <name> <token>
+BRIDGE INTRODUCE <nick> <username> <realname>
+BRIDGE AS <nick> <command> [<params>...]
+BRIDGE REMOVE <nick> [<reason>]
+
+Used by bridges (e.g., to Matrix) to control "puppet" clients representing
+remote users over a single connection. AUTH authenticates with a token from
+the server config; INTRODUCE creates a puppet, AS runs a command as one, and
+REMOVE disconnects one. Lines addressed to puppets are forwarded to the bridge
+with the oragono.io/bridge-puppet tag. See the manual for details.`,
 	},
 	"cap": {
 		text: `CAP <subcommand> [:<capabilities>]
@@ -152,6 +216,16 @@ message (and as your quit message if you don't return in time).`,
 Used in capability negotiation. See the IRCv3 specs for more info:
 http://ircv3.net/specs/core/capability-negotiation-3.1.html
 http://ircv3.net/specs/core/capability-negotiation-3.2.html`,
+	},
+	"challenge": {
+		text: `CHALLENGE <name>
+CHALLENGE +<response>
+
+Authenticates you as the operator <name> with their RSA public key, without
+sending a password. The server replies with a challenge encrypted with the
+key; decrypt it and send the base64-encoded SHA-1 digest of the plaintext
+back with CHALLENGE +<response>. Tools for the CHALLENGE command of ratbox
+and charybdis can compute the response.`,
 	},
 	"chathistory": {
 		text: `CHATHISTORY [params]
@@ -159,6 +233,13 @@ http://ircv3.net/specs/core/capability-negotiation-3.2.html`,
 CHATHISTORY is a history replay command associated with the IRCv3
 specification draft/chathistory. See this document:
 https://github.com/ircv3/ircv3-specifications/pull/393`,
+	},
+	"deanonymize": {
+		oper: true,
+		text: `DEANONYMIZE <#channel> <pseudonym>
+
+Reveals which user recently sent messages under the given pseudonym in an
+anonymous (+A) channel. Every use is logged and sent to operators.`,
 	},
 	"debug": {
 		oper: true,
@@ -166,8 +247,12 @@ https://github.com/ircv3/ircv3-specifications/pull/393`,
 
 Provides various debugging commands for the IRCd. <option> can be one of:
 
+* BLOCKED: Senders with the most direct messages blocked by +R or +T.
+* FANOUT: Parallel channel delivery statistics, and sendq backlogs.
 * GCSTATS: Garbage control statistics.
+* HISTORYQUEUE: Persistent history write queue depth, throughput, and losses.
 * NUMGOROUTINE: Number of goroutines in use.
+* REAPED: Number of connections disconnected by registration and ping timeouts.
 * STARTCPUPROFILE: Starts the CPU profiler.
 * STOPCPUPROFILE: Stops the CPU profiler.
 * PROFILEHEAP: Writes a memory profile.
@@ -183,7 +268,7 @@ spam or other hostile activity. It has five levels, which are cumulative
 
 5: Normal operation
 4: No new account or channel registrations
-3: All users are +R; no changes to vhosts
+3: All users are +R; no changes to vhosts; no new channels; joins are throttled
 2: No new unauthenticated connections; all channels are +R
 1: No new connections except from localhost or other trusted IPs`,
 	},
@@ -195,10 +280,11 @@ DEOPER removes the IRCop privileges granted to you by a successful /OPER.`,
 	},
 	"dline": {
 		oper: true,
-		text: `DLINE [ANDKILL] [MYSELF] [duration] <ip>/<net> [ON <server>] [reason [| oper reason]]
+		text: `DLINE [ANDKILL] [MYSELF] [duration] <ip>/<net>/<hostname>/<asn> [ON <server>] [reason [| oper reason]]
 DLINE LIST
 
-Bans an IP address or network from connecting to the server. If the duration is
+Bans an IP address, network, hostname pattern, or autonomous system from
+connecting to the server. If the duration is
 given then only for that long. The reason is shown to the user themselves, but
 everyone else will see a standard message. The oper reason is shown to
 operators getting info about the DLINEs that exist.
@@ -217,6 +303,13 @@ from. If "MYSELF" is not given, trying to DLINE yourself will result in an error
 	127.0.0.1/8
 	8.8.8.8/24
 
+<hostname> is a pattern matched against the hostnames that clients' IPs
+resolve to, once they are looked up. For example:
+	*.vps.example.com
+
+<asn> is an autonomous system number, for example AS64496. This requires
+server.asn-database to be configured.
+
 ON <server> specifies that the ban is to be set on that specific server.
 
 [reason] and [oper reason], if they exist, are separated by a vertical bar (|).
@@ -224,11 +317,32 @@ ON <server> specifies that the ban is to be set on that specific server.
 If "DLINE LIST" is sent, the server sends back a list of our current DLINEs.
 
 To remove a DLINE, use the "UNDLINE" command.`,
+	},
+	"drafts": {
+		text: `DRAFTS LIST
+DRAFTS GET <key>
+DRAFTS SET <key> <value>
+DRAFTS DEL <key>
+DRAFTS CLEAR
+
+DRAFTS stores small pieces of data with your account, so that your clients
+can share unsent messages, scroll positions, etc. across devices. The keys and
+values are chosen by the client. LIST returns all stored drafts, and also
+subscribes the session to changes made by your other sessions. SET with an
+empty value deletes the key, like DEL. You must be logged into an account.`,
 	},
 	"extjwt": {
 		text: `EXTJWT <target> [service_name]
 
 Get a JSON Web Token for target (either * or a channel name).`,
+	},
+	"grantoper": {
+		oper: true,
+		text: `GRANTOPER <nick> <duration> [oper name]
+
+Temporarily makes <nick> an operator, using the named oper block (by default,
+your own). Once the duration (e.g., 2h or 1d) has passed, they are de-opered
+and notified. You can only grant oper blocks whose capabilities you also have.`,
 	},
 	"help": {
 		text: `HELP <argument>
@@ -274,18 +388,23 @@ Joins the given channels with the matching keys.`,
 		text: `KICK <channel> <user> [reason]
 
 Removes the user from the given channel, so long as you have the appropriate
-channel privs.`,
+channel privs. If the server defines reason macros, a reason like !spam is
+expanded to the server's standard text.`,
 	},
 	"kill": {
 		oper: true,
-		text: `KILL <nickname> [reason]
+		text: `KILL [FORCE] <nickname> [reason]
 
 Removes the given user from the network, showing them the reason if it is
-supplied.`,
+supplied.
+
+If the user's account is protected (see /NS HELP PROTECT), "FORCE" is
+required, and the kill only happens once a second operator confirms it by
+sending the same command.`,
 	},
 	"kline": {
 		oper: true,
-		text: `KLINE [ANDKILL] [MYSELF] [duration] <mask> [ON <server>] [reason [| oper reason]]
+		text: `KLINE [ANDKILL] [MYSELF] [FORCE] [duration] <mask> [ON <server>] [reason [| oper reason]]
 KLINE LIST
 
 Bans a mask from connecting to the server. If the duration is given then only for that
@@ -299,6 +418,10 @@ Bans are saved across subsequent launches of the server.
 "MYSELF" is required when the KLINE matches the address the person applying it is connected
 from. If "MYSELF" is not given, trying to KLINE yourself will result in an error.
 
+"FORCE" is required when the KLINE matches a client whose account is protected
+(see /NS HELP PROTECT); the KLINE is only added once a second operator confirms
+it by sending "KLINE FORCE <mask>" as well.
+
 [duration] can be of the following forms:
 	1y 12mo 31d 10h 8m 13s
 
@@ -326,12 +449,33 @@ Shows information on the given channels (or if none are given, then on all
 channels). <elistcond>s modify how the channels are selected.`,
 		//TODO(dan): Explain <elistcond>s in more specific detail
 	},
+	"listmode": {
+		text: `LISTMODE <channel> <b|e|I> [MATCH <pattern>] [AFTER <mask>] [LIMIT <count>]
+
+Lists a channel's bans (b), ban exceptions (e), or invite exceptions (I), like
+MODE does, but one page at a time. Entries are sorted by mask; MATCH shows only
+masks matching a pattern with wildcards, AFTER shows only masks that sort after
+the given one (e.g., the last one you received), and LIMIT sets the page size
+(at most the server's limit). When a page is truncated, a NOTE with the last
+mask is sent before the end of the list.`,
+	},
 	"lusers": {
 		text: `LUSERS [<mask> [<server>]]
 
 Shows statistics about the size of the network. If <mask> is given, only
 returns stats for servers matching the given mask.  If <server> is given, the
 command is processed by that server.`,
+	},
+	"maintenance": {
+		oper: true,
+		text: `MAINTENANCE [ON [duration] [message] | OFF]
+
+MAINTENANCE puts the server into maintenance mode, e.g., during a migration
+or to shed load in an emergency. In maintenance mode, new connections are
+rejected (except from localhost and secure-nets) with the given message and
+a hint to try again after the given duration; existing sessions are not
+affected. The defaults are taken from server.maintenance in the config. With
+no argument, shows the current status.`,
 	},
 	"mode": {
 		text: `MODE <target> [<modestring> [<mode arguments>...]]
@@ -395,11 +539,20 @@ Requires the roleplay mode (+E) to be set on the target.`,
 The NPC command is used to send an action to the target as the source.
 
 Requires the roleplay mode (+E) to be set on the target.`,
+	},
+	"ojoin": {
+		oper: true,
+		text: `OJOIN #channel{,#channel}
+
+Joins you to a channel, ignoring restrictions like bans, user limits and
+channel keys. Unlike SAJOIN, it notifies the channel's operators; every use is
+logged to the audit log and snomasks.`,
 	},
 	"oper": {
 		text: `OPER <name> [password]
 
-If the correct details are given, gives you IRCop privs.`,
+If the correct details are given, gives you IRCop privs. Operators with a
+public key configured can use CHALLENGE instead.`,
 	},
 	"part": {
 		text: `PART <channel>{,<channel>} [reason]
@@ -426,6 +579,32 @@ Replies to a PING. Used to check link connectivity.`,
 		text: `PRIVMSG <target>{,<target>} <text to be sent>
 
 Sends the text to the given targets as a PRIVMSG.`,
+	},
+	"redact": {
+		text: `REDACT <target> <msgid> [:<reason>]
+
+Deletes a message you sent to a channel or user, removing it from history.
+Channel operators can delete any message sent to their channel. Clients
+that support the draft/message-redaction capability are told to hide
+the message.
+
+For example:
+	REDACT #ircv3 Ma1lo4nCzrBx0Fv6 :Wrong channel`,
+	},
+	"relations": {
+		text: `RELATIONS <target> <start> <end> [<limit>]
+
+Summarizes the replies and reactions to the messages in <target>'s history
+between <start> and <end>, which are msgid=<msgid> or timestamp=<timestamp>
+as with CHATHISTORY BETWEEN. For each message that has any, the server
+sends:
+
+	RELATIONS <target> <msgid> REPLIES <count> [<msgid>,<msgid>,...]
+	RELATIONS <target> <msgid> REACT <count> :<reaction>
+
+listing the latest replies, and the number of users who reacted with each
+reaction, most popular first. Retrieving the messages counts towards the
+CHATHISTORY limits.`,
 	},
 	"relaymsg": {
 		text: `RELAYMSG <channel> <spoofed nick> :<message>
@@ -457,6 +636,12 @@ and channel keys. If [nick] is omitted, it defaults to the operator.`,
 		text: `SANICK <currentnick> <newnick>
 
 Gives the given user a new nickname.`,
+	},
+	"sapart": {
+		oper: true,
+		text: `SAPART <nick> #channel{,#channel} [reason]
+
+Forcibly parts a user from the given channels.`,
 	},
 	"samode": {
 		oper: true,
@@ -470,11 +655,36 @@ opers. For more specific information on mode characters, see the help for
 		text: `SCENE <target> <text to be sent>
 
 The SCENE command is used to send a scene notification to the given target.`,
+	},
+	"session": {
+		text: `SESSION LIST
+SESSION KILL <session ID>
+SESSION LABEL <label>
+
+SESSION manages the sessions (connections) attached to your client, e.g.,
+when several devices share a nickname via multiclient. LIST shows each
+session's ID, label (or device ID), IP, connection time, and last activity;
+KILL disconnects a session. LABEL names the current session (use * to clear
+the label); it can be sent before connection registration completes.`,
 	},
 	"setname": {
 		text: `SETNAME <realname>
 
 The SETNAME command updates the realname to be the newly-given one.`,
+	},
+	"silence": {
+		text: `SILENCE [{+|-}<mask>{,{+|-}<mask>}]
+
+SILENCE manages your account's server-side ignore list. Direct messages
+(PRIVMSG, NOTICE, and TAGMSG) and invites from users matching a mask on the
+list are silently dropped, for all your clients and sessions. With no
+arguments, it lists the current masks. Examples:
+
+    /SILENCE +spammer!*@*        - ignore the nickname spammer
+    /SILENCE +*!*@*.example.com  - ignore everyone from example.com
+    /SILENCE -spammer!*@*        - stop ignoring spammer
+
+You must be logged into an account to use this command.`,
 	},
 	"summon": {
 		text: `SUMMON [parameters]
@@ -491,11 +701,29 @@ specs for more info: http://ircv3.net/specs/core/message-tags-3.3.html`,
 		text: `QUIT [reason]
 
 Indicates that you're leaving the server, and shows everyone the given reason.`,
+	},
+	"readonly": {
+		oper: true,
+		text: `READONLY [ON|OFF]
+
+READONLY puts the whole server into read-only mode, e.g., during datastore
+maintenance or failover. In read-only mode, commands that would modify
+persistent state (account and channel registrations, channel settings,
+bans, etc.) are rejected, and writes to persistent history are queued until
+read-only mode is disabled. With no argument, shows the current status.`,
 	},
 	"register": {
 		text: `REGISTER <email | *> <password>
 
 Registers an account in accordance with the draft/register capability.`,
+	},
+	"remove": {
+		text: `REMOVE <channel> <user> [reason]
+
+Removes the user from the given channel as KICK does, except that the user
+is shown to PART the channel, which discourages automatic rejoining. It
+requires the same channel privs as KICK, and is unavailable in channels
+with mode +Q.`,
 	},
 	"rehash": {
 		oper: true,
@@ -513,6 +741,15 @@ resume their old connection <oldnick>.`,
 		text: `TIME [server]
 
 Shows the time of the current, or the given, server.`,
+	},
+	"timedmode": {
+		text: `TIMEDMODE <channel> <duration> <modestring> [<mode arguments>...]
+
+TIMEDMODE changes channel modes like MODE does, then changes them back after
+the given duration, e.g., "TIMEDMODE #chan 10m +m" moderates #chan for ten
+minutes. Flag modes (e.g., +m, -n) and list masks (e.g., +b) can be changed
+this way; timed list masks are removed when they expire. Changing a flag mode
+again in the meantime cancels its expiration.`,
 	},
 	"topic": {
 		text: `TOPIC <channel> [topic]
@@ -522,9 +759,10 @@ given, views the current topic on the channel.`,
 	},
 	"undline": {
 		oper: true,
-		text: `UNDLINE <ip>/<net>
+		text: `UNDLINE <ip>/<net>/<hostname>/<asn>
 
-Removes an existing ban on an IP address or a network.
+Removes an existing ban on an IP address, a network, a hostname pattern, or an
+autonomous system.
 
 <net> is specified in typical CIDR notation. For example:
 	127.0.0.1/8
@@ -676,16 +914,116 @@ type HelpIndexManager struct {
 
 	langToIndex     map[string]string
 	langToOperIndex map[string]string
+	// built-in topics merged with the custom ones from the help directory
+	topics map[string]HelpEntry
+	// language code to topic to localized text
+	overlays map[string]map[string]string
+}
+
+// customHelp holds the HELP topics loaded from the help directory.
+type customHelp struct {
+	topics   map[string]HelpEntry
+	overlays map[string]map[string]string
+}
+
+// loadCustomHelp loads HELP topics from a directory of text or markdown files,
+// one topic per file, named after the topic (e.g., `rules.txt`). Topics in the
+// `oper` subdirectory are only shown to operators; every other subdirectory is
+// named for a language code and contains translations of existing topics.
+// A file for a built-in topic replaces its text.
+func loadCustomHelp(path string) (result customHelp, err error) {
+	result.topics = make(map[string]HelpEntry)
+	result.overlays = make(map[string]map[string]string)
+	if path == "" {
+		return
+	}
+
+	err = loadHelpFiles(path, func(topic, text string) {
+		result.topics[topic] = HelpEntry{text: text, helpType: InformationHelpEntry}
+	})
+	if err != nil {
+		return
+	}
+	err = loadHelpFiles(filepath.Join(path, "oper"), func(topic, text string) {
+		result.topics[topic] = HelpEntry{text: text, helpType: InformationHelpEntry, oper: true}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return
+	}
+
+	subdirs, err := ioutil.ReadDir(path)
+	if err != nil {
+		return
+	}
+	for _, subdir := range subdirs {
+		if !subdir.IsDir() || subdir.Name() == "oper" {
+			continue
+		}
+		langCode := strings.ToLower(subdir.Name())
+		overlay := make(map[string]string)
+		err = loadHelpFiles(filepath.Join(path, subdir.Name()), func(topic, text string) {
+			overlay[topic] = text
+		})
+		if err != nil {
+			return
+		}
+		result.overlays[langCode] = overlay
+	}
+	return
+}
+
+// loadHelpFiles calls `add` for each topic file directly inside a directory.
+func loadHelpFiles(dir string, add func(topic, text string)) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		extension := filepath.Ext(file.Name())
+		if file.IsDir() || (extension != ".txt" && extension != ".md") {
+			continue
+		}
+		topic := strings.ToLower(strings.TrimSuffix(file.Name(), extension))
+		if topic == "" || topic == "index" || strings.ContainsAny(topic, " \t") {
+			return fmt.Errorf("invalid help topic name: %s", file.Name())
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		text := strings.TrimRight(strings.Replace(string(data), "\r\n", "\n", -1), "\n ")
+		add(topic, text)
+	}
+	return nil
+}
+
+// mergeHelpTopics overlays the custom topics on the built-in ones; a custom
+// file for a built-in topic keeps its type and oper restriction.
+func mergeHelpTopics(custom map[string]HelpEntry) map[string]HelpEntry {
+	result := make(map[string]HelpEntry, len(Help)+len(custom))
+	for name, entry := range Help {
+		result[name] = entry
+	}
+	for name, entry := range custom {
+		if builtin, ok := result[name]; ok {
+			builtin.text = entry.text
+			builtin.textGenerator = nil
+			builtin.oper = builtin.oper || entry.oper
+			entry = builtin
+		}
+		result[name] = entry
+	}
+	return result
 }
 
 // GenerateHelpIndex is used to generate HelpIndex.
 // Returns: a map from language code to the help index in that language.
-func GenerateHelpIndex(lm *languages.Manager, forOpers bool) map[string]string {
+func GenerateHelpIndex(lm *languages.Manager, topics map[string]HelpEntry, forOpers bool) map[string]string {
 	// generate the help entry lists
 	var commands, isupport, information []string
 
 	var line string
-	for name, info := range Help {
+	for name, info := range topics {
 		if info.duplicate {
 			continue
 		}
@@ -738,16 +1076,38 @@ Information:
 	return newHelpIndex
 }
 
-// GenerateIndices regenerates our help indexes for each currently enabled language.
-func (hm *HelpIndexManager) GenerateIndices(lm *languages.Manager) {
+// GenerateIndices regenerates our help indexes for each currently enabled
+// language, incorporating the custom topics from the help directory.
+func (hm *HelpIndexManager) GenerateIndices(lm *languages.Manager, custom customHelp) {
+	topics := mergeHelpTopics(custom.topics)
 	// generate help indexes
-	langToIndex := GenerateHelpIndex(lm, false)
-	langToOperIndex := GenerateHelpIndex(lm, true)
+	langToIndex := GenerateHelpIndex(lm, topics, false)
+	langToOperIndex := GenerateHelpIndex(lm, topics, true)
 
 	hm.Lock()
 	defer hm.Unlock()
 	hm.langToIndex = langToIndex
 	hm.langToOperIndex = langToOperIndex
+	hm.topics = topics
+	hm.overlays = custom.overlays
+}
+
+// GetTopic returns the help entry for a topic, and its text in the first of
+// the given languages that has a translation in the help directory, if any.
+func (hm *HelpIndexManager) GetTopic(name string, languages []string) (entry HelpEntry, overlay string, exists bool) {
+	hm.RLock()
+	defer hm.RUnlock()
+
+	entry, exists = hm.topics[name]
+	if !exists {
+		return
+	}
+	for _, lang := range languages {
+		if text, ok := hm.overlays[strings.ToLower(lang)][name]; ok {
+			return entry, text, true
+		}
+	}
+	return
 }
 
 // sendHelp sends the client help of the given string.
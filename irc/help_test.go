@@ -0,0 +1,83 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oragono/oragono/irc/languages"
+)
+
+func writeHelpFile(t *testing.T, path, text string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCustomHelp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oragono-help-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeHelpFile(t, filepath.Join(dir, "rules.txt"), "Be excellent to each other.\r\n\r\n")
+	writeHelpFile(t, filepath.Join(dir, "oper", "policy.md"), "# Oper policy\nDon't abuse KILL.")
+	writeHelpFile(t, filepath.Join(dir, "fr-FR", "rules.txt"), "Soyez excellents les uns envers les autres.")
+	writeHelpFile(t, filepath.Join(dir, "fr-FR", "away.txt"), "AWAY [message] (fr)")
+	writeHelpFile(t, filepath.Join(dir, "README"), "ignored")
+
+	custom, err := loadCustomHelp(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lm, _ := languages.NewManager(false, "", "en")
+	var hm HelpIndexManager
+	hm.GenerateIndices(lm, custom)
+
+	entry, overlay, exists := hm.GetTopic("rules", []string{"en"})
+	assertEqual(exists, true, t)
+	assertEqual(overlay, "", t)
+	assertEqual(entry.text, "Be excellent to each other.", t)
+	assertEqual(entry.oper, false, t)
+
+	_, overlay, _ = hm.GetTopic("rules", []string{"de-DE", "fr-FR"})
+	assertEqual(overlay, "Soyez excellents les uns envers les autres.", t)
+
+	entry, _, exists = hm.GetTopic("policy", nil)
+	assertEqual(exists, true, t)
+	assertEqual(entry.oper, true, t)
+
+	// translations apply to the built-in topics too
+	entry, overlay, exists = hm.GetTopic("away", []string{"fr-fr"})
+	assertEqual(exists, true, t)
+	assertEqual(entry.helpType, CommandHelpEntry, t)
+	assertEqual(overlay, "AWAY [message] (fr)", t)
+
+	_, _, exists = hm.GetTopic("readme", nil)
+	assertEqual(exists, false, t)
+
+	if !strings.Contains(hm.GetIndex([]string{"en"}, false), "   rules\n") {
+		t.Errorf("custom topic missing from the index")
+	}
+	if strings.Contains(hm.GetIndex([]string{"en"}, false), "policy") {
+		t.Errorf("oper topic in the user index")
+	}
+	if !strings.Contains(hm.GetIndex([]string{"en"}, true), "   policy") {
+		t.Errorf("oper topic missing from the oper index")
+	}
+
+	// an invalid topic name is an error
+	writeHelpFile(t, filepath.Join(dir, "index.txt"), "")
+	if _, err := loadCustomHelp(dir); err == nil {
+		t.Errorf("loaded a topic named index")
+	}
+}
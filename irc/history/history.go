@@ -45,6 +45,9 @@ type Item struct {
 	// an incoming or outgoing message). this lets us emulate the "query buffer" functionality
 	// required by CHATHISTORY:
 	CfCorrespondent string
+	// for a STATUSMSG (e.g., PRIVMSG @#channel), this is the prefix it was sent to;
+	// only channel members with at least that prefix can see it
+	StatusPrefix string `json:",omitempty"`
 }
 
 // HasMsgid tests whether a message has the message id `msgid`.
@@ -230,6 +233,22 @@ func (seq *bufferSequence) Around(start Selector, limit int) (results []Item, er
 	return GenericAround(seq, start, limit)
 }
 
+// Aggregate implements Aggregator by scanning the whole buffer.
+func (seq *bufferSequence) Aggregate(msgids []string, maxReplies int) (results []Aggregate, err error) {
+	builder := NewAggregateBuilder(msgids, maxReplies)
+	seq.list.RLock()
+	seq.list.matchInternal(func(item *Item) bool {
+		if item.Message.Time.After(seq.cutoff) && (seq.pred == nil || seq.pred(item)) {
+			if relation, ok := ItemRelation(item); ok {
+				builder.Add(relation, item.Message.Msgid)
+			}
+		}
+		return false
+	}, true, 0)
+	seq.list.RUnlock()
+	return builder.Results(), nil
+}
+
 // you must be holding the read lock to call this
 func (list *Buffer) matchInternal(predicate Predicate, ascending bool, limit int) (results []Item) {
 	if list.start == -1 || len(list.buffer) == 0 {
@@ -288,6 +307,32 @@ func (list *Buffer) Delete(predicate Predicate) (count int) {
 	return
 }
 
+// Update modifies, in place, messages matching some predicate.
+func (list *Buffer) Update(predicate Predicate, update func(item *Item)) (count int) {
+	list.Lock()
+	defer list.Unlock()
+
+	if list.start == -1 || len(list.buffer) == 0 {
+		return
+	}
+
+	pos := list.start
+	stop := list.prev(list.end)
+
+	for {
+		if predicate(&list.buffer[pos]) {
+			update(&list.buffer[pos])
+			count++
+		}
+		if pos == stop {
+			break
+		}
+		pos = list.next(pos)
+	}
+
+	return
+}
+
 // latest returns the items most recently added, up to `limit`. If `limit` is 0,
 // it returns all items.
 func (list *Buffer) latest(limit int) (results []Item) {
@@ -241,6 +241,27 @@ func TestDisabledByResize(t *testing.T) {
 	assertEqual(len(items), 0, t)
 }
 
+func TestUpdate(t *testing.T) {
+	buf := NewHistoryBuffer(4, 0)
+	for i, nick := range []string{"alice", "bob", "alice", "carol", "alice"} {
+		item := autoItem(i, easyParse("2006-01-01 00:00:00Z"))
+		item.AccountName = nick
+		buf.Add(item)
+	}
+
+	count := buf.Update(
+		func(item *Item) bool { return item.AccountName == "alice" },
+		func(item *Item) { item.AccountName = "Amanda" },
+	)
+	assertEqual(count, 2, t)
+
+	var accounts []string
+	for _, item := range buf.latest(0) {
+		accounts = append(accounts, item.AccountName)
+	}
+	assertEqual(accounts, []string{"bob", "Amanda", "carol", "Amanda"}, t)
+}
+
 func BenchmarkInsert(b *testing.B) {
 	buf := NewHistoryBuffer(1024, 0)
 	b.ResetTimer()
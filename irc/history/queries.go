@@ -4,15 +4,29 @@
 package history
 
 import (
+	"errors"
 	"time"
 )
 
+var (
+	// ErrDisallowed is returned by the persistent history databases when
+	// a client attempts to delete a message it did not send.
+	ErrDisallowed = errors.New("disallowed")
+)
+
 // Selector represents a parameter to a CHATHISTORY command
 type Selector struct {
 	Msgid string
 	Time  time.Time
 }
 
+// RetentionPolicy limits the persistent history of a single target, in addition
+// to the global expire-time. Zero values impose no limit.
+type RetentionPolicy struct {
+	MaxAge   time.Duration
+	MaxLines int
+}
+
 // Sequence is an abstract sequence of history entries that can be queried;
 // it encapsulates restrictions such as registration time cutoffs, or
 // only looking at a single "query buffer" (DMs with a particular correspondent)
@@ -68,3 +82,19 @@ func MinMaxAsc(after, before, cutoff time.Time) (min, max time.Time, ascending b
 	}
 	return after, before, ascending
 }
+
+// PersistentWrite is a single item to be stored in a persistent history
+// database: a channel message if Channel is set, otherwise a direct message.
+type PersistentWrite struct {
+	Item Item
+	// for channel messages: the casefolded channel name, and the casefolded
+	// account of the author (if any), for account indexing
+	Channel string
+	Account string
+	// for direct messages: the casefolded nicknames and accounts of
+	// the participants (at least one of whom must have an account)
+	Sender           string
+	SenderAccount    string
+	Recipient        string
+	RecipientAccount string
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package history
+
+import (
+	"sort"
+	"strings"
+)
+
+// replies and reactions refer to an earlier message by its msgid, in the
+// +draft/reply tag; a reaction is a TAGMSG that also has a +draft/react tag.
+// Aggregates summarize them, so that clients can display reaction counts
+// and reply threads without replaying everything that referred to a message.
+
+const (
+	ReplyTag = "+draft/reply"
+	ReactTag = "+draft/react"
+
+	// longer reactions are not aggregated
+	MaxReactionLength = 64
+)
+
+// Relation describes how an item refers to an earlier message.
+type Relation struct {
+	Parent   string // msgid of the message replied or reacted to
+	Reaction string // empty for a reply
+	Sender   string // account name, or nickname if there isn't one
+}
+
+// ItemRelation returns the relation of an item to an earlier message, if any.
+// STATUSMSG items are ignored, since not everyone who can see the earlier
+// message can see them.
+func ItemRelation(item *Item) (relation Relation, ok bool) {
+	if item.StatusPrefix != "" || item.Message.Msgid == "" {
+		return
+	}
+	relation.Parent = item.Tags[ReplyTag]
+	if relation.Parent == "" || relation.Parent == item.Message.Msgid {
+		return
+	}
+	switch item.Type {
+	case Tagmsg:
+		relation.Reaction = item.Tags[ReactTag]
+		if relation.Reaction == "" || MaxReactionLength < len(relation.Reaction) ||
+			strings.ContainsAny(relation.Reaction, "\x00\r\n") {
+			return
+		}
+	case Privmsg, Notice:
+	default:
+		return
+	}
+	if item.AccountName != "" && item.AccountName != "*" {
+		relation.Sender = item.AccountName
+	} else {
+		relation.Sender = item.Nick
+		if idx := strings.IndexByte(relation.Sender, '!'); idx != -1 {
+			relation.Sender = relation.Sender[:idx]
+		}
+	}
+	return relation, true
+}
+
+// ReactionCount is the number of distinct senders who reacted to a message
+// with a given reaction.
+type ReactionCount struct {
+	Reaction string
+	Count    int
+}
+
+// Aggregate summarizes the replies and reactions to a message.
+type Aggregate struct {
+	Msgid      string
+	ReplyCount int
+	// msgids of the latest replies, in chronological order
+	Replies   []string
+	Reactions []ReactionCount
+}
+
+// Aggregator is implemented by Sequences that can summarize the replies and
+// reactions to the messages in them. Aggregates are returned in the order of
+// `msgids`, omitting messages that have neither replies nor reactions; at
+// most `maxReplies` reply msgids are returned for each message.
+type Aggregator interface {
+	Aggregate(msgids []string, maxReplies int) (results []Aggregate, err error)
+}
+
+// AggregateBuilder accumulates relations (in chronological order)
+// into Aggregates; it is shared by the Aggregator implementations.
+type AggregateBuilder struct {
+	order      []string
+	aggregates map[string]*Aggregate
+	reactions  map[string]map[string]map[string]bool // parent -> reaction -> set of senders
+	maxReplies int
+}
+
+// NewAggregateBuilder returns an AggregateBuilder for the messages `msgids`.
+func NewAggregateBuilder(msgids []string, maxReplies int) (builder *AggregateBuilder) {
+	builder = &AggregateBuilder{
+		order:      make([]string, 0, len(msgids)),
+		aggregates: make(map[string]*Aggregate, len(msgids)),
+		reactions:  make(map[string]map[string]map[string]bool),
+		maxReplies: maxReplies,
+	}
+	for _, msgid := range msgids {
+		if _, ok := builder.aggregates[msgid]; !ok {
+			builder.order = append(builder.order, msgid)
+			builder.aggregates[msgid] = &Aggregate{Msgid: msgid}
+		}
+	}
+	return
+}
+
+// Wants returns whether the builder is accumulating relations to `parent`.
+func (builder *AggregateBuilder) Wants(parent string) bool {
+	_, ok := builder.aggregates[parent]
+	return ok
+}
+
+// AddReplies records `count` replies to `parent`, the latest of which (at
+// most maxReplies, in chronological order) are `msgids`.
+func (builder *AggregateBuilder) AddReplies(parent string, count int, msgids []string) {
+	aggregate, ok := builder.aggregates[parent]
+	if !ok {
+		return
+	}
+	aggregate.ReplyCount += count
+	aggregate.Replies = append(aggregate.Replies, msgids...)
+	if builder.maxReplies < len(aggregate.Replies) {
+		aggregate.Replies = aggregate.Replies[len(aggregate.Replies)-builder.maxReplies:]
+	}
+}
+
+// AddReactions records that `count` distinct senders reacted to `parent` with `reaction`.
+func (builder *AggregateBuilder) AddReactions(parent, reaction string, count int) {
+	aggregate, ok := builder.aggregates[parent]
+	if !ok {
+		return
+	}
+	aggregate.Reactions = append(aggregate.Reactions, ReactionCount{Reaction: reaction, Count: count})
+}
+
+// Add records a single relation, from an item with msgid `msgid`.
+func (builder *AggregateBuilder) Add(relation Relation, msgid string) {
+	if !builder.Wants(relation.Parent) {
+		return
+	}
+	if relation.Reaction == "" {
+		builder.AddReplies(relation.Parent, 1, []string{msgid})
+		return
+	}
+	byReaction := builder.reactions[relation.Parent]
+	if byReaction == nil {
+		byReaction = make(map[string]map[string]bool)
+		builder.reactions[relation.Parent] = byReaction
+	}
+	senders := byReaction[relation.Reaction]
+	if senders == nil {
+		senders = make(map[string]bool)
+		byReaction[relation.Reaction] = senders
+	}
+	senders[relation.Sender] = true
+}
+
+// Results returns the accumulated Aggregates; it can only be called once.
+func (builder *AggregateBuilder) Results() (results []Aggregate) {
+	for parent, byReaction := range builder.reactions {
+		for reaction, senders := range byReaction {
+			builder.AddReactions(parent, reaction, len(senders))
+		}
+	}
+	for _, msgid := range builder.order {
+		aggregate := builder.aggregates[msgid]
+		if aggregate.ReplyCount == 0 && len(aggregate.Reactions) == 0 {
+			continue
+		}
+		// most popular reactions first:
+		sort.Slice(aggregate.Reactions, func(i, j int) bool {
+			ri, rj := aggregate.Reactions[i], aggregate.Reactions[j]
+			if ri.Count != rj.Count {
+				return ri.Count > rj.Count
+			}
+			return ri.Reaction < rj.Reaction
+		})
+		results = append(results, *aggregate)
+	}
+	return
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package history
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+func relationTestItem(itemType ItemType, nick, account, msgid string, tags map[string]string) Item {
+	return Item{
+		Type:        itemType,
+		Nick:        nick + "!u@h",
+		AccountName: account,
+		Message:     utils.SplitMessage{Msgid: msgid, Time: time.Now().UTC()},
+		Tags:        tags,
+	}
+}
+
+func TestItemRelation(t *testing.T) {
+	reply := relationTestItem(Privmsg, "alice", "*", "b", map[string]string{ReplyTag: "a"})
+	relation, ok := ItemRelation(&reply)
+	assertEqual(ok, true, t)
+	assertEqual(relation, Relation{Parent: "a", Sender: "alice"}, t)
+
+	react := relationTestItem(Tagmsg, "bob", "bob_account", "c", map[string]string{ReplyTag: "a", ReactTag: "👍"})
+	relation, ok = ItemRelation(&react)
+	assertEqual(ok, true, t)
+	assertEqual(relation, Relation{Parent: "a", Reaction: "👍", Sender: "bob_account"}, t)
+
+	// a TAGMSG without a reaction is just typing notifications or similar:
+	typing := relationTestItem(Tagmsg, "bob", "*", "d", map[string]string{ReplyTag: "a"})
+	_, ok = ItemRelation(&typing)
+	assertEqual(ok, false, t)
+
+	long := relationTestItem(Tagmsg, "bob", "*", "e", map[string]string{ReplyTag: "a", ReactTag: strings.Repeat("x", MaxReactionLength+1)})
+	_, ok = ItemRelation(&long)
+	assertEqual(ok, false, t)
+
+	statusmsg := relationTestItem(Privmsg, "alice", "*", "f", map[string]string{ReplyTag: "a"})
+	statusmsg.StatusPrefix = "@"
+	_, ok = ItemRelation(&statusmsg)
+	assertEqual(ok, false, t)
+
+	self := relationTestItem(Privmsg, "alice", "*", "g", map[string]string{ReplyTag: "g"})
+	_, ok = ItemRelation(&self)
+	assertEqual(ok, false, t)
+}
+
+func TestBufferAggregate(t *testing.T) {
+	buf := NewHistoryBuffer(16, 0)
+	buf.Add(relationTestItem(Privmsg, "alice", "*", "a", nil))
+	buf.Add(relationTestItem(Privmsg, "alice", "*", "b", nil))
+	for _, msgid := range []string{"r1", "r2", "r3"} {
+		buf.Add(relationTestItem(Privmsg, "bob", "*", msgid, map[string]string{ReplyTag: "a"}))
+	}
+	buf.Add(relationTestItem(Tagmsg, "bob", "*", "x1", map[string]string{ReplyTag: "a", ReactTag: "👍"}))
+	// the same sender reacting twice only counts once:
+	buf.Add(relationTestItem(Tagmsg, "bob", "*", "x2", map[string]string{ReplyTag: "a", ReactTag: "👍"}))
+	buf.Add(relationTestItem(Tagmsg, "carol", "*", "x3", map[string]string{ReplyTag: "a", ReactTag: "👍"}))
+	buf.Add(relationTestItem(Tagmsg, "carol", "*", "x4", map[string]string{ReplyTag: "a", ReactTag: "🎉"}))
+	buf.Add(relationTestItem(Tagmsg, "carol", "*", "x5", map[string]string{ReplyTag: "zzz", ReactTag: "🎉"}))
+
+	aggregator := buf.MakeSequence("", time.Time{}).(Aggregator)
+	results, err := aggregator.Aggregate([]string{"a", "b", "a"}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b has no relations, so it's omitted, and a is only reported once:
+	assertEqual(results, []Aggregate{
+		{
+			Msgid:      "a",
+			ReplyCount: 3,
+			Replies:    []string{"r2", "r3"},
+			Reactions:  []ReactionCount{{Reaction: "👍", Count: 2}, {Reaction: "🎉", Count: 1}},
+		},
+	}, t)
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package history
+
+import (
+	"sort"
+	"time"
+)
+
+// TargetListing is a history target (a channel, or a DM correspondent) together
+// with the time of its latest message, as returned by CHATHISTORY TARGETS
+type TargetListing struct {
+	CfName string
+	Time   time.Time
+}
+
+// MergeTargets combines listings from multiple sources, keeping those whose
+// latest message is strictly between `start` and `end` (either of which may be
+// zero). As with CHATHISTORY BETWEEN, the `limit` listings nearest to `start`
+// are selected, then returned in chronological order.
+func MergeTargets(base, extra []TargetListing, start, end time.Time, limit int) (results []TargetListing) {
+	after, before, ascending := MinMaxAsc(start, end, time.Time{})
+
+	results = make([]TargetListing, 0, len(base)+len(extra))
+	for _, listings := range [][]TargetListing{base, extra} {
+		for _, listing := range listings {
+			if (after.IsZero() || listing.Time.After(after)) && (before.IsZero() || listing.Time.Before(before)) {
+				results = append(results, listing)
+			}
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Time.Before(results[j].Time)
+	})
+	if limit != 0 && limit < len(results) {
+		if ascending {
+			results = results[:limit]
+		} else {
+			results = results[len(results)-limit:]
+		}
+	}
+	return
+}
+
+// ListCorrespondents lists the correspondents of the DMs in the buffer,
+// each with the time of its latest message no earlier than `cutoff`.
+func (list *Buffer) ListCorrespondents(cutoff time.Time) (results []TargetListing) {
+	list.RLock()
+	defer list.RUnlock()
+
+	seen := make(map[string]struct{})
+	// items are visited newest first, so the first one seen for each
+	// correspondent is their latest message:
+	list.matchInternal(func(item *Item) bool {
+		if item.CfCorrespondent == "" || item.Message.Time.Before(cutoff) {
+			return false
+		}
+		if _, ok := seen[item.CfCorrespondent]; !ok {
+			seen[item.CfCorrespondent] = struct{}{}
+			results = append(results, TargetListing{CfName: item.CfCorrespondent, Time: item.Message.Time})
+		}
+		return false
+	}, false, 0)
+	return
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package history
+
+import (
+	"testing"
+	"time"
+)
+
+func toNames(listings []TargetListing) (result []string) {
+	for _, listing := range listings {
+		result = append(result, listing.CfName)
+	}
+	return
+}
+
+func TestMergeTargets(t *testing.T) {
+	base := []TargetListing{
+		{CfName: "alice", Time: easyParse("2006-01-01 00:00:00Z")},
+		{CfName: "bob", Time: easyParse("2006-01-03 00:00:00Z")},
+	}
+	extra := []TargetListing{
+		{CfName: "#chan1", Time: easyParse("2006-01-02 00:00:00Z")},
+		{CfName: "#chan2", Time: easyParse("2006-01-04 00:00:00Z")},
+	}
+
+	result := MergeTargets(base, extra, time.Time{}, time.Time{}, 0)
+	assertEqual(toNames(result), []string{"alice", "#chan1", "bob", "#chan2"}, t)
+
+	// bounds are exclusive:
+	result = MergeTargets(base, extra, easyParse("2006-01-01 00:00:00Z"), easyParse("2006-01-04 00:00:00Z"), 0)
+	assertEqual(toNames(result), []string{"#chan1", "bob"}, t)
+
+	// going forwards, the earliest listings are kept:
+	result = MergeTargets(base, extra, easyParse("2005-01-01 00:00:00Z"), easyParse("2007-01-01 00:00:00Z"), 2)
+	assertEqual(toNames(result), []string{"alice", "#chan1"}, t)
+
+	// going backwards, the latest listings are kept, still in chronological order:
+	result = MergeTargets(base, extra, easyParse("2007-01-01 00:00:00Z"), easyParse("2005-01-01 00:00:00Z"), 2)
+	assertEqual(toNames(result), []string{"bob", "#chan2"}, t)
+}
+
+func TestListCorrespondents(t *testing.T) {
+	buf := NewHistoryBuffer(16, 0)
+	add := func(correspondent, timestamp string) {
+		item := easyItem("testnick", timestamp)
+		item.CfCorrespondent = correspondent
+		buf.Add(item)
+	}
+	add("alice", "2006-01-01 00:00:00Z")
+	add("bob", "2006-01-02 00:00:00Z")
+	add("", "2006-01-03 00:00:00Z")
+	add("alice", "2006-01-04 00:00:00Z")
+
+	result := buf.ListCorrespondents(time.Time{})
+	expected := []TargetListing{
+		{CfName: "alice", Time: easyParse("2006-01-04 00:00:00Z")},
+		{CfName: "bob", Time: easyParse("2006-01-02 00:00:00Z")},
+	}
+	assertEqual(result, expected, t)
+
+	// messages before the cutoff are excluded:
+	result = buf.ListCorrespondents(easyParse("2006-01-03 00:00:00Z"))
+	assertEqual(toNames(result), []string{"alice"}, t)
+}
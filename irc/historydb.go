@@ -0,0 +1,27 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"io"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+)
+
+// historyDatabase is a persistent history backend: MySQL or PostgreSQL.
+// Until the backend is opened, its methods do nothing.
+type historyDatabase interface {
+	AddItems(writes []history.PersistentWrite) error
+	DeleteMsgid(msgid, accountName, target string) error
+	Forget(account string)
+	RenameAccount(oldAccount, newAccount, newAccountName string) error
+	Export(account string, writer io.Writer)
+	MakeSequence(target, correspondent string, cutoff time.Time) history.Sequence
+	ListChannels(cfchannels []string) ([]history.TargetListing, error)
+	ListCorrespondents(target string, start, end, cutoff time.Time, limit int) ([]history.TargetListing, error)
+	SetRetentionPolicy(target string, policy history.RetentionPolicy)
+	Ping() error
+	Close()
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+)
+
+// writes to persistent history are taken off the hot path: they go into
+// a bounded queue, and a single writer goroutine stores them in batches,
+// one transaction per batch. the writer starts a batch as soon as anything
+// is queued, so batches only grow when the database can't keep up.
+
+const (
+	defaultHistoryWriteQueueSize = 4096
+	defaultHistoryWriteBatchSize = 64
+)
+
+var (
+	errHistoryQueueInvalidOverflow = errors.New("history.persistent.write-queue.overflow must be drop-oldest or block")
+)
+
+// HistoryWriteQueueConfig controls the persistent history write queue.
+type HistoryWriteQueueConfig struct {
+	// maximum number of queued items
+	Size int
+	// maximum number of items written in a single transaction
+	BatchSize int `yaml:"batch-size"`
+	// what to do when the queue is full: drop-oldest or block
+	Overflow        string
+	blockOnOverflow bool
+}
+
+func (conf *HistoryWriteQueueConfig) prepare() error {
+	if conf.Size <= 0 {
+		conf.Size = defaultHistoryWriteQueueSize
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = defaultHistoryWriteBatchSize
+	}
+	switch conf.Overflow {
+	case "", "drop-oldest":
+		conf.blockOnOverflow = false
+	case "block":
+		conf.blockOnOverflow = true
+	default:
+		return errHistoryQueueInvalidOverflow
+	}
+	return nil
+}
+
+// HistoryQueueStats are the write queue's metrics, for DEBUG HISTORYQUEUE.
+type HistoryQueueStats struct {
+	Depth    int
+	Capacity int
+	Written  uint64 // items committed to the database
+	Failed   uint64 // items in batches that the database rejected
+	Dropped  uint64 // items discarded because the queue was full
+	Batches  uint64
+	Largest  int // largest batch written
+}
+
+type historyWriteQueue struct {
+	sync.Mutex
+	server *Server
+	items  []history.PersistentWrite
+	// signaled when items are added, or when the queue is closed:
+	wake chan struct{}
+	// broadcast when items are removed (for the block overflow policy):
+	space *sync.Cond
+	// closed when the writer has exited after the queue is closed:
+	done    chan struct{}
+	running bool
+	closed  bool
+	stats   HistoryQueueStats
+}
+
+// Initialize starts the writer; until then, writes are performed synchronously.
+func (q *historyWriteQueue) Initialize(server *Server) {
+	q.Lock()
+	defer q.Unlock()
+	q.server = server
+	q.wake = make(chan struct{}, 1)
+	q.space = sync.NewCond(&q.Mutex)
+	q.done = make(chan struct{})
+	q.running = true
+	go q.writeLoop()
+}
+
+// Enqueue adds a write to the queue, applying the overflow policy if it is full.
+func (q *historyWriteQueue) Enqueue(server *Server, write history.PersistentWrite) {
+	config := &server.Config().History.Persistent.WriteQueue
+	q.Lock()
+	if !q.running || q.closed {
+		q.Unlock()
+		// not started, or flushed for shutdown: write it directly
+		server.writeHistory(func() error {
+			return server.historyDB.AddItems([]history.PersistentWrite{write})
+		})
+		return
+	}
+	for config.Size <= len(q.items) {
+		if config.blockOnOverflow {
+			q.space.Wait()
+			if q.closed {
+				q.Unlock()
+				server.writeHistory(func() error {
+					return server.historyDB.AddItems([]history.PersistentWrite{write})
+				})
+				return
+			}
+		} else {
+			q.items[0] = history.PersistentWrite{} // allow GC
+			q.items = q.items[1:]
+			q.stats.Dropped++
+		}
+	}
+	q.items = append(q.items, write)
+	q.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// takeBatch removes up to `size` items from the front of the queue.
+func (q *historyWriteQueue) takeBatch(size int) (batch []history.PersistentWrite, closed bool) {
+	q.Lock()
+	defer q.Unlock()
+	if size < len(q.items) {
+		batch = make([]history.PersistentWrite, size)
+		copy(batch, q.items)
+		// don't let the backing array grow without bound:
+		q.items = append([]history.PersistentWrite(nil), q.items[size:]...)
+	} else {
+		batch = q.items
+		q.items = nil
+	}
+	if len(batch) != 0 {
+		q.space.Broadcast()
+	}
+	return batch, q.closed
+}
+
+func (q *historyWriteQueue) writeLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			q.server.logger.Error("internal",
+				fmt.Sprintf("Panic in history write routine: %v\n%s", r, debug.Stack()))
+			time.Sleep(time.Second)
+			go q.writeLoop()
+		}
+	}()
+
+	for {
+		batch, closed := q.takeBatch(q.server.Config().History.Persistent.WriteQueue.BatchSize)
+		if len(batch) != 0 {
+			q.writeBatch(batch)
+			continue
+		}
+		if closed {
+			close(q.done)
+			return
+		}
+		<-q.wake
+	}
+}
+
+func (q *historyWriteQueue) writeBatch(batch []history.PersistentWrite) {
+	// in read-only mode, writeHistory defers the write:
+	err := q.server.writeHistory(func() error {
+		return q.server.historyDB.AddItems(batch)
+	})
+	q.Lock()
+	defer q.Unlock()
+	if err == nil {
+		q.stats.Written += uint64(len(batch))
+	} else {
+		q.stats.Failed += uint64(len(batch))
+	}
+	q.stats.Batches++
+	if q.stats.Largest < len(batch) {
+		q.stats.Largest = len(batch)
+	}
+}
+
+// Close flushes the queue, waiting until everything in it has been written;
+// later writes are performed synchronously.
+func (q *historyWriteQueue) Close() {
+	q.Lock()
+	if !q.running || q.closed {
+		q.Unlock()
+		return
+	}
+	q.closed = true
+	q.space.Broadcast()
+	q.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	<-q.done
+}
+
+// Stats returns the queue's current metrics.
+func (q *historyWriteQueue) Stats(config *Config) (stats HistoryQueueStats) {
+	q.Lock()
+	defer q.Unlock()
+	stats = q.stats
+	stats.Depth = len(q.items)
+	stats.Capacity = config.History.Persistent.WriteQueue.Size
+	return
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+)
+
+// fakeHistoryDB records batches; the first batch blocks until `gate` is closed
+type fakeHistoryDB struct {
+	historyDatabase
+	sync.Mutex
+	started chan struct{}
+	gate    chan struct{}
+	batches [][]string
+}
+
+func newFakeHistoryDB() *fakeHistoryDB {
+	return &fakeHistoryDB{
+		started: make(chan struct{}),
+		gate:    make(chan struct{}),
+	}
+}
+
+func (db *fakeHistoryDB) AddItems(writes []history.PersistentWrite) error {
+	db.Lock()
+	first := len(db.batches) == 0
+	var batch []string
+	for _, write := range writes {
+		batch = append(batch, write.Channel)
+	}
+	db.batches = append(db.batches, batch)
+	db.Unlock()
+	if first {
+		close(db.started)
+		<-db.gate
+	}
+	return nil
+}
+
+func newHistoryQueueTestServer(t *testing.T, size, batchSize int, overflow string) (server *Server, db *fakeHistoryDB) {
+	server = newTestServer()
+	config := server.Config()
+	config.History.Persistent.WriteQueue = HistoryWriteQueueConfig{
+		Size:      size,
+		BatchSize: batchSize,
+		Overflow:  overflow,
+	}
+	if err := config.History.Persistent.WriteQueue.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	db = newFakeHistoryDB()
+	server.historyDB = db
+	server.historyQueue.Initialize(server)
+	return
+}
+
+func enqueueTestWrite(server *Server, i int) {
+	server.historyQueue.Enqueue(server, history.PersistentWrite{Channel: fmt.Sprintf("#%d", i)})
+}
+
+func TestHistoryQueueDropOldest(t *testing.T) {
+	server, db := newHistoryQueueTestServer(t, 4, 2, "drop-oldest")
+
+	enqueueTestWrite(server, 1)
+	<-db.started
+	// the writer is stuck on #1; #2 is dropped to make room for #6
+	for i := 2; i <= 6; i++ {
+		enqueueTestWrite(server, i)
+	}
+	stats := server.historyQueue.Stats(server.Config())
+	assertEqual(stats.Depth, 4, t)
+	assertEqual(stats.Dropped, uint64(1), t)
+
+	close(db.gate)
+	server.historyQueue.Close()
+	expected := [][]string{{"#1"}, {"#3", "#4"}, {"#5", "#6"}}
+	if !reflect.DeepEqual(db.batches, expected) {
+		t.Errorf("unexpected batches: %v", db.batches)
+	}
+	stats = server.historyQueue.Stats(server.Config())
+	assertEqual(stats.Depth, 0, t)
+	assertEqual(stats.Written, uint64(5), t)
+	assertEqual(stats.Batches, uint64(3), t)
+	assertEqual(stats.Largest, 2, t)
+
+	// after Close, writes go directly to the database
+	enqueueTestWrite(server, 7)
+	assertEqual(len(db.batches), 4, t)
+}
+
+func TestHistoryQueueBlock(t *testing.T) {
+	server, db := newHistoryQueueTestServer(t, 2, 8, "block")
+
+	enqueueTestWrite(server, 1)
+	<-db.started
+	enqueueTestWrite(server, 2)
+	enqueueTestWrite(server, 3)
+	blocked := make(chan struct{})
+	go func() {
+		enqueueTestWrite(server, 4)
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+		t.Fatal("enqueue to a full queue should block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(db.gate)
+	<-blocked
+	server.historyQueue.Close()
+	var written []string
+	for _, batch := range db.batches {
+		written = append(written, batch...)
+	}
+	if !reflect.DeepEqual(written, []string{"#1", "#2", "#3", "#4"}) {
+		t.Errorf("unexpected writes: %v", written)
+	}
+	assertEqual(server.historyQueue.Stats(server.Config()).Dropped, uint64(0), t)
+}
+
+func TestHistoryQueueConfig(t *testing.T) {
+	var config HistoryWriteQueueConfig
+	if err := config.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.Size, defaultHistoryWriteQueueSize, t)
+	assertEqual(config.BatchSize, defaultHistoryWriteBatchSize, t)
+	assertEqual(config.blockOnOverflow, false, t)
+
+	config.Overflow = "drop-newest"
+	assertEqual(config.prepare(), errHistoryQueueInvalidOverflow, t)
+}
@@ -35,11 +35,12 @@ var (
 			help: `Syntax: $bFORGET <account>$b
 
 FORGET deletes all history messages sent by an account.`,
-			helpShort: `$bFORGET$b deletes all history messages sent by an account.`,
-			capabs:    []string{"history"},
-			enabled:   histservEnabled,
-			minParams: 1,
-			maxParams: 1,
+			helpShort:     `$bFORGET$b deletes all history messages sent by an account.`,
+			capabs:        []string{"history"},
+			enabled:       histservEnabled,
+			minParams:     1,
+			maxParams:     1,
+			modifiesState: true,
 		},
 		"delete": {
 			handler: histservDeleteHandler,
@@ -48,10 +49,11 @@ FORGET deletes all history messages sent by an account.`,
 DELETE deletes an individual message by its msgid. The target is a channel
 name or nickname; depending on the history implementation, this may or may not
 be necessary to locate the message.`,
-			helpShort: `$bDELETE$b deletes an individual message by its msgid.`,
-			enabled:   histservEnabled,
-			minParams: 1,
-			maxParams: 2,
+			helpShort:     `$bDELETE$b deletes an individual message by its msgid.`,
+			enabled:       histservEnabled,
+			minParams:     1,
+			maxParams:     2,
+			modifiesState: true,
 		},
 		"export": {
 			handler: histservExportHandler,
@@ -234,5 +236,14 @@ func easySelectHistory(server *Server, client *Client, params []string) (items [
 		end := history.Selector{Time: now.Add(-duration)}
 		items, _, err = sequence.Between(start, end, limit)
 	}
+	if channel != nil {
+		visibleItems := items[:0]
+		for _, item := range items {
+			if channel.historyItemIsVisible(client, &item) {
+				visibleItems = append(visibleItems, item)
+			}
+		}
+		items = visibleItems
+	}
 	return
 }
@@ -0,0 +1,195 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// Reverse DNS lookups of connecting clients run asynchronously, starting as
+// soon as the client's IP is known (i.e., after any PROXY or WEBIRC line) and
+// proceeding while the client negotiates capabilities, etc.; registration
+// only waits for the result if it isn't ready yet. Results, including
+// failures, are cached, concurrent lookups of the same IP are combined, and
+// the number of lookups in progress is bounded, so that a connection flood
+// can't tie up unbounded numbers of goroutines waiting on slow DNS.
+
+const (
+	defaultHostnameLookupTimeout       = 5 * time.Second
+	defaultHostnameLookupConcurrency   = 64
+	defaultHostnameCacheDuration       = 10 * time.Minute
+	defaultHostnameNegativeCacheLength = time.Minute
+	// prune expired cache entries after this many insertions
+	hostnameCachePruneInterval = 1024
+)
+
+type HostnameLookupConfig struct {
+	Timeout               time.Duration
+	MaxConcurrency        int           `yaml:"max-concurrency"`
+	CacheDuration         time.Duration `yaml:"cache-duration"`
+	NegativeCacheDuration time.Duration `yaml:"negative-cache-duration"`
+}
+
+func (config *HostnameLookupConfig) postprocess() {
+	if config.Timeout <= 0 {
+		config.Timeout = defaultHostnameLookupTimeout
+	}
+	if config.MaxConcurrency <= 0 {
+		config.MaxConcurrency = defaultHostnameLookupConcurrency
+	}
+	if config.CacheDuration == 0 {
+		config.CacheDuration = defaultHostnameCacheDuration
+	}
+	if config.NegativeCacheDuration == 0 {
+		config.NegativeCacheDuration = defaultHostnameNegativeCacheLength
+	}
+}
+
+// hostnameLookup is a (possibly still running) lookup of an IP's hostname.
+type hostnameLookup struct {
+	done     chan empty
+	hostname string // valid after `done` is closed; "" if the lookup failed
+}
+
+func completedHostnameLookup(hostname string) *hostnameLookup {
+	result := &hostnameLookup{done: make(chan empty), hostname: hostname}
+	close(result.done)
+	return result
+}
+
+// Wait returns the hostname, or "" if the lookup failed or doesn't complete
+// within `timeout`.
+func (lookup *hostnameLookup) Wait(timeout time.Duration) string {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-lookup.done:
+		return lookup.hostname
+	case <-timer.C:
+		return ""
+	}
+}
+
+type hostnameCacheEntry struct {
+	hostname string
+	expires  time.Time
+}
+
+// HostnameResolver looks up and caches the hostnames of clients.
+type HostnameResolver struct {
+	sync.Mutex // tier 1
+
+	cache    map[string]hostnameCacheEntry
+	inFlight map[string]*hostnameLookup
+	inserts  int
+	workers  utils.Semaphore
+}
+
+func (resolver *HostnameResolver) Initialize(config *Config) {
+	resolver.cache = make(map[string]hostnameCacheEntry)
+	resolver.inFlight = make(map[string]*hostnameLookup)
+	resolver.workers.Initialize(config.Server.HostnameLookup.MaxConcurrency)
+}
+
+// ClearCache discards the cached results, e.g., because a rehash changed
+// how they're computed.
+func (resolver *HostnameResolver) ClearCache() {
+	resolver.Lock()
+	defer resolver.Unlock()
+	resolver.cache = make(map[string]hostnameCacheEntry)
+}
+
+// Lookup starts looking up the hostname of `ip`, or joins a lookup of it that
+// is already in progress. If too many lookups are already in progress, the
+// returned lookup fails immediately.
+func (resolver *HostnameResolver) Lookup(ip net.IP, config *Config) *hostnameLookup {
+	ipString := ip.String()
+	now := time.Now()
+
+	resolver.Lock()
+	defer resolver.Unlock()
+
+	if entry, ok := resolver.cache[ipString]; ok && now.Before(entry.expires) {
+		return completedHostnameLookup(entry.hostname)
+	}
+	if lookup, ok := resolver.inFlight[ipString]; ok {
+		return lookup
+	}
+	if !resolver.workers.TryAcquire() {
+		return completedHostnameLookup("")
+	}
+	lookup := &hostnameLookup{done: make(chan empty)}
+	resolver.inFlight[ipString] = lookup
+	go resolver.resolve(ipString, lookup, config)
+	return lookup
+}
+
+func (resolver *HostnameResolver) resolve(ipString string, lookup *hostnameLookup, config *Config) {
+	defer resolver.workers.Release()
+
+	lookupConfig := &config.Server.HostnameLookup
+	ctx, cancel := context.WithTimeout(context.Background(), lookupConfig.Timeout)
+	defer cancel()
+	hostname := lookupHostname(ctx, ipString, config.Server.ForwardConfirmHostnames)
+
+	cacheDuration := lookupConfig.CacheDuration
+	if hostname == "" {
+		cacheDuration = lookupConfig.NegativeCacheDuration
+	}
+
+	resolver.Lock()
+	delete(resolver.inFlight, ipString)
+	if 0 < cacheDuration {
+		resolver.cache[ipString] = hostnameCacheEntry{hostname: hostname, expires: time.Now().Add(cacheDuration)}
+		resolver.inserts++
+		if resolver.inserts%hostnameCachePruneInterval == 0 {
+			resolver.pruneCache()
+		}
+	}
+	resolver.Unlock()
+
+	lookup.hostname = hostname
+	close(lookup.done)
+}
+
+// pruneCache removes expired entries; it requires holding the Lock()
+func (resolver *HostnameResolver) pruneCache() {
+	now := time.Now()
+	for ip, entry := range resolver.cache {
+		if now.After(entry.expires) {
+			delete(resolver.cache, ip)
+		}
+	}
+}
+
+// lookupHostname resolves an IP to an IRC-ready hostname using reverse DNS,
+// forward-confirming it if necessary; it returns "" on failure.
+func lookupHostname(ctx context.Context, ipString string, forwardConfirm bool) (hostname string) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ipString)
+	if err != nil || len(names) == 0 {
+		return ""
+	}
+	candidate := strings.TrimSuffix(names[0], ".")
+	if !utils.IsHostname(candidate) {
+		return ""
+	}
+	if !forwardConfirm {
+		return candidate
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, candidate)
+	if err == nil {
+		for _, addr := range addrs {
+			if addr == ipString {
+				return candidate // successful forward confirmation
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestHostnameResolver(maxConcurrency int) (*HostnameResolver, *Config) {
+	config := &Config{}
+	config.Server.HostnameLookup.MaxConcurrency = maxConcurrency
+	config.Server.HostnameLookup.postprocess()
+	var resolver HostnameResolver
+	resolver.Initialize(config)
+	return &resolver, config
+}
+
+func TestHostnameLookupCache(t *testing.T) {
+	resolver, config := newTestHostnameResolver(1)
+	ip := net.ParseIP("192.0.2.1")
+	resolver.cache[ip.String()] = hostnameCacheEntry{hostname: "irc.example.com", expires: time.Now().Add(time.Minute)}
+	assertEqual(resolver.Lookup(ip, config).Wait(time.Second), "irc.example.com", t)
+
+	// negative results are cached too:
+	resolver.cache[ip.String()] = hostnameCacheEntry{hostname: "", expires: time.Now().Add(time.Minute)}
+	assertEqual(resolver.Lookup(ip, config).Wait(time.Second), "", t)
+
+	// concurrent lookups of the same IP share a single lookup:
+	resolver.ClearCache()
+	lookup := &hostnameLookup{done: make(chan empty)}
+	resolver.inFlight[ip.String()] = lookup
+	assertEqual(resolver.Lookup(ip, config) == lookup, true, t)
+	// which is given up on after the timeout:
+	assertEqual(lookup.Wait(10*time.Millisecond), "", t)
+}
+
+func TestHostnameLookupConcurrency(t *testing.T) {
+	resolver, config := newTestHostnameResolver(1)
+	// occupy the only worker:
+	resolver.workers.Acquire()
+	lookup := resolver.Lookup(net.ParseIP("192.0.2.2"), config)
+	select {
+	case <-lookup.done:
+	default:
+		t.Errorf("lookup should fail immediately when no workers are available")
+	}
+	assertEqual(lookup.hostname, "", t)
+	assertEqual(len(resolver.inFlight), 0, t)
+	// failures due to load aren't cached:
+	assertEqual(len(resolver.cache), 0, t)
+}
+
+func TestHostnameCachePrune(t *testing.T) {
+	resolver, _ := newTestHostnameResolver(1)
+	now := time.Now()
+	resolver.cache["192.0.2.1"] = hostnameCacheEntry{hostname: "a.example.com", expires: now.Add(-time.Second)}
+	resolver.cache["192.0.2.2"] = hostnameCacheEntry{hostname: "b.example.com", expires: now.Add(time.Minute)}
+	resolver.pruneCache()
+	assertEqual(len(resolver.cache), 1, t)
+	_, ok := resolver.cache["192.0.2.2"]
+	assertEqual(ok, true, t)
+}
@@ -7,9 +7,11 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/goshuirc/irc-go/ircfmt"
 
+	"github.com/oragono/oragono/irc/sno"
 	"github.com/oragono/oragono/irc/utils"
 )
 
@@ -36,18 +38,20 @@ var (
 			help: `Syntax: $bON$b
 
 ON enables your vhost, if you have one approved.`,
-			helpShort:    `$bON$b enables your vhost, if you have one approved.`,
-			authRequired: true,
-			enabled:      hostservEnabled,
+			helpShort:     `$bON$b enables your vhost, if you have one approved.`,
+			authRequired:  true,
+			enabled:       hostservEnabled,
+			modifiesState: true,
 		},
 		"off": {
 			handler: hsOnOffHandler,
 			help: `Syntax: $bOFF$b
 
 OFF disables your vhost, if you have one approved.`,
-			helpShort:    `$bOFF$b disables your vhost, if you have one approved.`,
-			authRequired: true,
-			enabled:      hostservEnabled,
+			helpShort:     `$bOFF$b disables your vhost, if you have one approved.`,
+			authRequired:  true,
+			enabled:       hostservEnabled,
+			modifiesState: true,
 		},
 		"status": {
 			handler: hsStatusHandler,
@@ -63,20 +67,42 @@ request for a new one. A server operator can view someone else's status.`,
 			help: `Syntax: $bSET <user> <vhost>$b
 
 SET sets a user's vhost, bypassing the request system.`,
-			helpShort: `$bSET$b sets a user's vhost.`,
-			capabs:    []string{"vhosts"},
-			enabled:   hostservEnabled,
-			minParams: 2,
+			helpShort:     `$bSET$b sets a user's vhost.`,
+			capabs:        []string{"vhosts"},
+			enabled:       hostservEnabled,
+			minParams:     2,
+			modifiesState: true,
 		},
 		"del": {
 			handler: hsSetHandler,
 			help: `Syntax: $bDEL <user>$b
 
 DEL deletes a user's vhost.`,
-			helpShort: `$bDEL$b deletes a user's vhost.`,
-			capabs:    []string{"vhosts"},
+			helpShort:     `$bDEL$b deletes a user's vhost.`,
+			capabs:        []string{"vhosts"},
+			enabled:       hostservEnabled,
+			minParams:     1,
+			modifiesState: true,
+		},
+		"offerlist": {
+			handler: hsOfferListHandler,
+			help: `Syntax: $bOFFERLIST$b
+
+OFFERLIST lists vhosts that you can take for yourself with $bTAKE$b.`,
+			helpShort: `$bOFFERLIST$b lists vhosts you can take without approval.`,
 			enabled:   hostservEnabled,
-			minParams: 1,
+		},
+		"take": {
+			handler: hsTakeHandler,
+			help: `Syntax: $bTAKE <vhost>$b
+
+TAKE sets your vhost to one of the vhosts listed by $bOFFERLIST$b, without
+needing a server operator's approval.`,
+			helpShort:     `$bTAKE$b sets your vhost to one from the offer list.`,
+			enabled:       hostservEnabled,
+			authRequired:  true,
+			minParams:     1,
+			modifiesState: true,
 		},
 		"setcloaksecret": {
 			handler: hsSetCloakSecretHandler,
@@ -85,11 +111,24 @@ DEL deletes a user's vhost.`,
 SETCLOAKSECRET can be used to set or rotate the cloak secret. You should use
 a cryptographically strong secret. To prevent accidental modification, a
 verification code is required; invoking the command without a code will
-display the necessary code.`,
-			helpShort: `$bSETCLOAKSECRET$b modifies the IP cloaking secret.`,
-			capabs:    []string{"vhosts", "rehash"},
+display the necessary code. Bans on cloaks computed with the previous secret
+continue to match until the end of the configured grace period.`,
+			helpShort:     `$bSETCLOAKSECRET$b modifies the IP cloaking secret.`,
+			capabs:        []string{"vhosts", "rehash"},
+			minParams:     1,
+			maxParams:     2,
+			modifiesState: true,
+		},
+		"uncloak": {
+			handler: hsUncloakHandler,
+			help: `Syntax: $bUNCLOAK <cloak>$b
+
+UNCLOAK shows the IP addresses of the connected clients with the given cloaked
+hostname. After the cloak secret is rotated, clients can be found by either
+their old or their new cloak until the grace period is over.`,
+			helpShort: `$bUNCLOAK$b reveals the IPs behind a cloaked hostname.`,
+			capabs:    []string{"ban"},
 			minParams: 1,
-			maxParams: 2,
 		},
 	}
 )
@@ -181,14 +220,98 @@ func hsSetHandler(service *ircService, server *Server, client *Client, command s
 	}
 }
 
+// expandVhostOffer substitutes the account name into an offer-list entry
+func expandVhostOffer(offer, account string) string {
+	return strings.Replace(offer, "$account", account, -1)
+}
+
+// vhostOffers returns the offer list as it applies to a particular account,
+// omitting entries that aren't valid vhosts once the account name is filled in
+func vhostOffers(server *Server, account string) (result []string) {
+	for _, offer := range server.Config().Accounts.VHosts.OfferList {
+		vhost := expandVhostOffer(offer, account)
+		if validateVhost(server, vhost, false) == nil {
+			result = append(result, vhost)
+		}
+	}
+	return
+}
+
+func hsOfferListHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	var offers []string
+	if account := client.Account(); account != "" {
+		offers = vhostOffers(server, account)
+	} else {
+		offers = server.Config().Accounts.VHosts.OfferList
+	}
+	if len(offers) == 0 {
+		service.Notice(rb, client.t("There are no vhosts on offer"))
+		return
+	}
+	for i, vhost := range offers {
+		service.Notice(rb, fmt.Sprintf("%d. %s", i+1, vhost))
+	}
+	service.Notice(rb, client.t("To take one of these vhosts, use /HS TAKE <vhost>"))
+}
+
+func hsTakeHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	vhost := params[0]
+	offered := false
+	for _, offer := range vhostOffers(server, client.Account()) {
+		if offer == vhost {
+			offered = true
+			break
+		}
+	}
+	if !offered {
+		service.Notice(rb, client.t("That vhost isn't being offered"))
+		return
+	}
+
+	config := server.Config()
+	_, err := server.accounts.VHostTake(client, vhost, config.Accounts.VHosts.TakeCooldown)
+	switch err {
+	case nil:
+		service.Notice(rb, client.t("Successfully set vhost"))
+		server.snomasks.Send(sno.LocalVhosts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] (account $c[grey][$r%s$c[grey]]) took vhost $c[grey][$r%s$c[grey]]"), client.NickMaskString(), client.AccountName(), vhost))
+	case errVhostTakeCooldown:
+		service.Notice(rb, fmt.Sprintf(client.t("You must wait %v between taking vhosts"), config.Accounts.VHosts.TakeCooldown))
+	case errFeatureDisabled:
+		service.Notice(rb, client.t(err.Error()))
+	default:
+		service.Notice(rb, client.t("An error occurred"))
+	}
+}
+
 func hsSetCloakSecretHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	secret := params[0]
 	expectedCode := utils.ConfirmationCode(secret, server.ctime)
 	if len(params) == 1 || params[1] != expectedCode {
-		service.Notice(rb, ircfmt.Unescape(client.t("$bWarning: changing the cloak secret will invalidate stored ban/invite/exception lists.$b")))
+		service.Notice(rb, ircfmt.Unescape(client.t("$bWarning: changing the cloak secret will invalidate stored ban/invite/exception lists once the grace period is over.$b")))
 		service.Notice(rb, fmt.Sprintf(client.t("To confirm, run this command: %s"), fmt.Sprintf("/HS SETCLOAKSECRET %s %s", secret, expectedCode)))
 		return
 	}
 	StoreCloakSecret(server.store, secret)
 	service.Notice(rb, client.t("Rotated the cloak secret; you must rehash or restart the server for it to take effect"))
 }
+
+func hsUncloakHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	cloak := strings.ToLower(params[0])
+	cloaks := &server.Config().Server.Cloaks
+	found := 0
+	for _, target := range server.clients.AllClients() {
+		cloakedHostname := target.CloakedHostname()
+		if cloakedHostname == "" {
+			continue
+		}
+		ip := target.IP()
+		if cloak == cloakedHostname || cloak == cloaks.AlternateCloak(ip, cloakedHostname) {
+			service.Notice(rb, fmt.Sprintf(client.t("%[1]s is connected from %[2]s"), target.NickMaskString(), utils.IPStringToHostname(ip.String())))
+			found++
+		}
+	}
+	if found == 0 {
+		service.Notice(rb, client.t("No connected clients have that cloak"))
+	}
+	server.logger.Info("opers", "Client", client.Nick(), "uncloaked", cloak)
+}
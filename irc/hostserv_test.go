@@ -0,0 +1,30 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVhostOffers(t *testing.T) {
+	server := newTestServer()
+	config := server.Config()
+	config.Accounts.VHosts.MaxLength = 64
+	config.Accounts.VHosts.validRegexp = defaultValidVhostRegex
+	config.Accounts.VHosts.OfferList = []string{"oragono.test", "$account.users.oragono.test"}
+
+	offers := vhostOffers(server, "dan")
+	expected := []string{"oragono.test", "dan.users.oragono.test"}
+	if !reflect.DeepEqual(offers, expected) {
+		t.Errorf("expected %v, got %v", expected, offers)
+	}
+
+	// account names that don't make valid vhosts don't get the templated offer
+	offers = vhostOffers(server, "dan[away]")
+	expected = []string{"oragono.test"}
+	if !reflect.DeepEqual(offers, expected) {
+		t.Errorf("expected %v, got %v", expected, offers)
+	}
+}
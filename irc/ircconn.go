@@ -131,23 +131,53 @@ func (cc *IRCStreamConn) Close() (err error) {
 	return cc.conn.Close()
 }
 
+// websocket subprotocols we negotiate; a client that requests none of them
+// gets the text protocol.
+const (
+	// one line per text message, as per the IRCv3 websocket spec
+	wsTextSubprotocol = "text.ircv3.net"
+	// one line per binary message, which need not be valid UTF-8
+	wsBinarySubprotocol = "binary.ircv3.net"
+	// binary messages containing one or more lines, each preceded by its
+	// length as a 16-bit big-endian integer; this lets us send a large batch
+	// of lines (e.g., a history replay) as a single message, which also
+	// compresses much better under permessage-deflate
+	wsLinesSubprotocol = "lines.oragono.io"
+)
+
+var (
+	wsSubprotocols = []string{wsLinesSubprotocol, wsBinarySubprotocol, wsTextSubprotocol}
+
+	errInvalidLengthPrefix = errors.New("invalid length-prefixed line")
+)
+
 // IRCWSConn is an IRCConn over a websocket.
 type IRCWSConn struct {
-	conn *websocket.Conn
+	conn        *websocket.Conn
+	subprotocol string
+	pending     [][]byte // lines received but not yet read (lines subprotocol only)
+	// account to log into, from the web client's login token:
+	webchatAccount string
 }
 
-func NewIRCWSConn(conn *websocket.Conn) IRCWSConn {
-	return IRCWSConn{conn: conn}
+func NewIRCWSConn(conn *websocket.Conn) *IRCWSConn {
+	return &IRCWSConn{conn: conn, subprotocol: conn.Subprotocol()}
 }
 
-func (wc IRCWSConn) UnderlyingConn() *utils.WrappedConn {
+func (wc *IRCWSConn) UnderlyingConn() *utils.WrappedConn {
 	// just assume that the type is OK
 	wConn, _ := wc.conn.UnderlyingConn().(*utils.WrappedConn)
 	return wConn
 }
 
-func (wc IRCWSConn) WriteLine(buf []byte) (err error) {
+func (wc *IRCWSConn) WriteLine(buf []byte) (err error) {
 	buf = bytes.TrimSuffix(buf, crlf)
+	switch wc.subprotocol {
+	case wsBinarySubprotocol:
+		return wc.conn.WriteMessage(websocket.BinaryMessage, buf)
+	case wsLinesSubprotocol:
+		return wc.conn.WriteMessage(websocket.BinaryMessage, appendLengthPrefixed(nil, buf))
+	}
 	if !globalUtf8EnforcementSetting && !utf8.Valid(buf) {
 		// there's not much we can do about this;
 		// silently drop the message
@@ -156,7 +186,14 @@ func (wc IRCWSConn) WriteLine(buf []byte) (err error) {
 	return wc.conn.WriteMessage(websocket.TextMessage, buf)
 }
 
-func (wc IRCWSConn) WriteLines(buffers [][]byte) (err error) {
+func (wc *IRCWSConn) WriteLines(buffers [][]byte) (err error) {
+	if wc.subprotocol == wsLinesSubprotocol {
+		var message []byte
+		for _, buf := range buffers {
+			message = appendLengthPrefixed(message, bytes.TrimSuffix(buf, crlf))
+		}
+		return wc.conn.WriteMessage(websocket.BinaryMessage, message)
+	}
 	for _, buf := range buffers {
 		err = wc.WriteLine(buf)
 		if err != nil {
@@ -166,12 +203,26 @@ func (wc IRCWSConn) WriteLines(buffers [][]byte) (err error) {
 	return
 }
 
-func (wc IRCWSConn) ReadLine() (line []byte, err error) {
+func (wc *IRCWSConn) ReadLine() (line []byte, err error) {
+	if len(wc.pending) != 0 {
+		line = wc.pending[0]
+		wc.pending = wc.pending[1:]
+		return line, nil
+	}
+
 	messageType, line, err := wc.conn.ReadMessage()
 	if err == nil {
-		if messageType == websocket.TextMessage {
+		switch {
+		case wc.subprotocol == wsLinesSubprotocol && messageType == websocket.BinaryMessage:
+			lines, err := splitLengthPrefixed(line)
+			if err != nil || len(lines) == 0 {
+				return nil, err
+			}
+			wc.pending = lines[1:]
+			return lines[0], nil
+		case messageType == websocket.TextMessage, wc.subprotocol == wsBinarySubprotocol:
 			return line, nil
-		} else {
+		default:
 			// for purposes of fakelag, treat non-text message as an empty line
 			return nil, nil
 		}
@@ -182,6 +233,33 @@ func (wc IRCWSConn) ReadLine() (line []byte, err error) {
 	}
 }
 
-func (wc IRCWSConn) Close() (err error) {
+func (wc *IRCWSConn) Close() (err error) {
 	return wc.conn.Close()
 }
+
+// appendLengthPrefixed appends a line, preceded by its length, to buf.
+func appendLengthPrefixed(buf, line []byte) []byte {
+	if len(line) > 0xffff {
+		// can't happen: lines are bounded by the tag and message length limits
+		line = line[:0xffff]
+	}
+	buf = append(buf, byte(len(line)>>8), byte(len(line)))
+	return append(buf, line...)
+}
+
+// splitLengthPrefixed splits a message of the lines subprotocol into lines.
+func splitLengthPrefixed(message []byte) (lines [][]byte, err error) {
+	for len(message) != 0 {
+		if len(message) < 2 {
+			return nil, errInvalidLengthPrefix
+		}
+		length := int(message[0])<<8 | int(message[1])
+		message = message[2:]
+		if len(message) < length {
+			return nil, errInvalidLengthPrefix
+		}
+		lines = append(lines, message[:length])
+		message = message[length:]
+	}
+	return
+}
@@ -8,6 +8,7 @@ import (
 	"math/rand"
 	"net"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -133,3 +134,29 @@ func TestLineReader(t *testing.T) {
 		doLineReaderTest(counts, t)
 	}
 }
+
+func TestLengthPrefixedLines(t *testing.T) {
+	lines := [][]byte{[]byte("PING 1"), []byte(""), []byte(strings.Repeat("a", 300))}
+	var message []byte
+	for _, line := range lines {
+		message = appendLengthPrefixed(message, line)
+	}
+	assertEqual(len(message), 6+0+300+3*2, t)
+	assertEqual(message[:2], []byte{0, 6}, t)
+
+	split, err := splitLengthPrefixed(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(split, lines) {
+		t.Errorf("expected %v, got %v", lines, split)
+	}
+
+	// truncated length or line
+	if _, err := splitLengthPrefixed(message[:len(message)-1]); err != errInvalidLengthPrefix {
+		t.Errorf("accepted a truncated line: %v", err)
+	}
+	if _, err := splitLengthPrefixed([]byte{0}); err != errInvalidLengthPrefix {
+		t.Errorf("accepted a truncated length: %v", err)
+	}
+}
@@ -137,24 +137,9 @@ func (km *KLineManager) cancelTimer(id string) {
 func (km *KLineManager) persistKLine(mask string, info IPBanInfo) error {
 	// save in datastore
 	klineKey := fmt.Sprintf(keyKlineEntry, mask)
-	// assemble json from ban info
-	b, err := json.Marshal(info)
-	if err != nil {
-		return err
-	}
-	bstr := string(b)
-	var setOptions *buntdb.SetOptions
-	if info.Duration != 0 {
-		setOptions = &buntdb.SetOptions{Expires: true, TTL: info.Duration}
-	}
-
-	err = km.server.store.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(klineKey, bstr, setOptions)
-		return err
+	return km.server.store.Update(func(tx *buntdb.Tx) error {
+		return persistBan(tx, klineKey, info)
 	})
-
-	return err
-
 }
 
 func (km *KLineManager) unpersistKLine(mask string) error {
@@ -166,6 +151,23 @@ func (km *KLineManager) unpersistKLine(mask string) error {
 	})
 }
 
+// ImportMask adds a ban with existing ban info, e.g., from an imported
+// ban list; see ImportNetwork. The mask must already be canonicalized.
+func (km *KLineManager) ImportMask(mask string, info IPBanInfo, overwrite, dryRun bool) (present bool, err error) {
+	km.persistenceMutex.Lock()
+	defer km.persistenceMutex.Unlock()
+
+	km.RLock()
+	_, present = km.entries[mask]
+	km.RUnlock()
+
+	if dryRun || (present && !overwrite) {
+		return
+	}
+	km.addMaskInternal(mask, info)
+	return present, km.persistKLine(mask, info)
+}
+
 // RemoveMask removes a mask from the blocked list.
 func (km *KLineManager) RemoveMask(mask string) error {
 	km.persistenceMutex.Lock()
@@ -25,6 +25,7 @@ var (
 type IRCListener interface {
 	Reload(config utils.ListenerConfig) error
 	Stop() error
+	File() (*os.File, error)
 }
 
 // NewListener creates a new listener according to the specifications in the config file
@@ -44,6 +45,11 @@ func NewListener(server *Server, addr string, config utils.ListenerConfig, bindM
 }
 
 func createBaseListener(addr string, bindMode os.FileMode) (listener net.Listener, err error) {
+	// take over the socket from the previous process, after a graceful upgrade
+	if listener = takeInheritedListener(addr); listener != nil {
+		return
+	}
+
 	addr = strings.TrimPrefix(addr, "unix:")
 	if strings.HasPrefix(addr, "/") {
 		// https://stackoverflow.com/a/34881585
@@ -87,6 +93,10 @@ func (nl *NetListener) Stop() error {
 	return nl.listener.Close()
 }
 
+func (nl *NetListener) File() (*os.File, error) {
+	return nl.listener.File()
+}
+
 func (nl *NetListener) serve() {
 	for {
 		conn, err := nl.listener.Accept()
@@ -144,28 +154,67 @@ func (wl *WSListener) Stop() error {
 	return wl.httpServer.Close()
 }
 
+func (wl *WSListener) File() (*os.File, error) {
+	return wl.listener.File()
+}
+
 func (wl *WSListener) handle(w http.ResponseWriter, r *http.Request) {
 	config := wl.server.Config()
 	remoteAddr := r.RemoteAddr
 	xff := r.Header.Get("X-Forwarded-For")
 	xfp := r.Header.Get("X-Forwarded-Proto")
 
+	if config.Server.WebSockets.ServerInfo && r.URL.Path == serverInfoPath && !websocket.IsWebSocketUpgrade(r) {
+		serveServerInfo(config, w, r)
+		return
+	}
+
+	webchat := config.Server.trueListeners[wl.addr].Webchat
+	if webchat && !websocket.IsWebSocketUpgrade(r) {
+		wl.server.webchat.serveWebchat(config, w, r)
+		return
+	}
+	// a TLS-terminating proxy may forward a request it received as TLS 1.3
+	// early data, which can be replayed; since an upgrade starts an IRC session
+	// (and may redeem a one-time login token), have the client retry after the
+	// handshake completes (RFC 8470):
+	if r.Header.Get("Early-Data") == "1" {
+		http.Error(w, "request sent in TLS early data", http.StatusTooEarly)
+		return
+	}
+	var webchatAccount string
+	if token := r.URL.Query().Get(webchatTokenParam); webchat && token != "" {
+		var ok bool
+		webchatAccount, ok = wl.server.webchat.RedeemToken(token, webchatClientIP(r, config).String())
+		if !ok {
+			http.Error(w, "invalid or expired login token", http.StatusForbidden)
+			return
+		}
+	}
+
+	allowedOrigins := config.allowedOrigins(wl.addr)
 	wsUpgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
-			if len(config.Server.WebSockets.allowedOriginRegexps) == 0 {
+			if len(allowedOrigins) == 0 {
+				return true
+			}
+			// the built-in web client connects back to where it was served from:
+			if webchat && isSameOrigin(r) {
 				return true
 			}
 			origin := strings.TrimSpace(r.Header.Get("Origin"))
 			if len(origin) == 0 {
 				return false
 			}
-			for _, re := range config.Server.WebSockets.allowedOriginRegexps {
+			for _, re := range allowedOrigins {
 				if re.MatchString(origin) {
 					return true
 				}
 			}
 			return false
 		},
+		Subprotocols:      wsSubprotocols,
+		EnableCompression: config.Server.WebSockets.Compression,
 	}
 
 	conn, err := wsUpgrader.Upgrade(w, r, nil)
@@ -186,7 +235,9 @@ func (wl *WSListener) handle(w http.ResponseWriter, r *http.Request) {
 	// avoid a DoS attack from buffering excessively large messages:
 	conn.SetReadLimit(maxReadQBytes)
 
-	go wl.server.RunClient(NewIRCWSConn(conn))
+	wsConn := NewIRCWSConn(conn)
+	wsConn.webchatAccount = webchatAccount
+	go wl.server.RunClient(wsConn)
 }
 
 // validate conn.ProxiedIP and conn.Secure against config, HTTP headers, etc.
@@ -194,6 +245,7 @@ func confirmProxyData(conn *utils.WrappedConn, remoteAddr, xForwardedFor, xForwa
 	if conn.ProxiedIP != nil {
 		if !utils.IPInNets(utils.AddrToIP(conn.RemoteAddr()), config.Server.proxyAllowedFromNets) {
 			conn.ProxiedIP = nil
+			conn.ProxiedTLS = nil
 		}
 	} else if xForwardedFor != "" {
 		proxiedIP := utils.HandleXForwardedFor(remoteAddr, xForwardedFor, config.Server.proxyAllowedFromNets)
@@ -206,6 +258,9 @@ func confirmProxyData(conn *utils.WrappedConn, remoteAddr, xForwardedFor, xForwa
 	if conn.Config.TLSConfig != nil || conn.Config.Tor {
 		// we terminated our own encryption:
 		conn.Secure = true
+	} else if conn.ProxiedTLS != nil {
+		// a trusted proxy terminated the client's TLS and told us so:
+		conn.Secure = true
 	} else if !conn.Config.WebSocket {
 		// plaintext normal connection: loopback and secureNets are secure
 		realIP := utils.AddrToIP(conn.RemoteAddr())
@@ -4,7 +4,6 @@
 package logger
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"os"
@@ -12,6 +11,8 @@ import (
 
 	"sync"
 	"sync/atomic"
+
+	"github.com/oragono/oragono/irc/custime"
 )
 
 // Level represents the level to log messages at.
@@ -84,6 +85,11 @@ type LoggingConfig struct {
 	ExcludedTypes []string `yaml:"real-excluded-types"`
 	LevelString   string   `yaml:"level"`
 	Level         Level    `yaml:"level-real"`
+	// rotation of file logs; zero values disable it
+	RotateSizeString string           `yaml:"rotate-size"`
+	RotateSize       int64            `yaml:"rotate-size-real"`
+	RotateAge        custime.Duration `yaml:"rotate-age"`
+	Keep             int
 }
 
 // NewManager returns a new log manager.
@@ -141,13 +147,11 @@ func (logger *Manager) ApplyConfig(config []LoggingConfig) error {
 			atomic.StoreUint32(&logger.loggingRawIO, 1)
 		}
 		if sLogger.MethodFile.Enabled {
-			file, err := os.OpenFile(sLogger.MethodFile.Filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+			file, err := openLogFile(logConfig.Filename, logConfig.RotateSize, time.Duration(logConfig.RotateAge), logConfig.Keep)
 			if err != nil {
-				lastErr = fmt.Errorf("Could not open log file %s [%s]", sLogger.MethodFile.Filename, err.Error())
+				lastErr = err
 			}
-			writer := bufio.NewWriter(file)
 			sLogger.MethodFile.File = file
-			sLogger.MethodFile.Writer = writer
 		}
 		logger.loggers = append(logger.loggers, sLogger)
 	}
@@ -155,6 +159,24 @@ func (logger *Manager) ApplyConfig(config []LoggingConfig) error {
 	return lastErr
 }
 
+// ReopenFiles closes and reopens all log files, e.g., after they were moved
+// by an external log rotation tool.
+func (logger *Manager) ReopenFiles() (err error) {
+	logger.configMutex.RLock()
+	defer logger.configMutex.RUnlock()
+	logger.fileWriteLock.Lock()
+	defer logger.fileWriteLock.Unlock()
+
+	for _, sLogger := range logger.loggers {
+		if sLogger.MethodFile.Enabled {
+			if reopenErr := sLogger.MethodFile.File.Reopen(); reopenErr != nil {
+				err = reopenErr
+			}
+		}
+	}
+	return
+}
+
 // IsLoggingRawIO returns true if raw user input and output is being logged.
 func (logger *Manager) IsLoggingRawIO() bool {
 	return atomic.LoadUint32(&logger.loggingRawIO) == 1
@@ -193,8 +215,7 @@ func (logger *Manager) Error(logType string, messageParts ...string) {
 type fileMethod struct {
 	Enabled  bool
 	Filename string
-	File     *os.File
-	Writer   *bufio.Writer
+	File     *logFile
 }
 
 // singleLogger represents a single logger instance.
@@ -211,12 +232,7 @@ type singleLogger struct {
 
 func (logger *singleLogger) Close() error {
 	if logger.MethodFile.Enabled {
-		flushErr := logger.MethodFile.Writer.Flush()
-		closeErr := logger.MethodFile.File.Close()
-		if flushErr != nil {
-			return flushErr
-		}
-		return closeErr
+		return logger.MethodFile.File.Close()
 	}
 	return nil
 }
@@ -267,8 +283,7 @@ func (logger *singleLogger) Log(level Level, logType string, messageParts ...str
 	}
 	if logger.MethodFile.Enabled {
 		logger.fileWriteLock.Lock()
-		logger.MethodFile.Writer.Write(rawBuf.Bytes())
-		logger.MethodFile.Writer.Flush()
+		logger.MethodFile.File.Write(rawBuf.Bytes())
 		logger.fileWriteLock.Unlock()
 	}
 }
@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package logger
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// file logging with built-in rotation: once a log file exceeds its maximum
+// size or age, it is renamed to `<filename>.<timestamp>` and compressed in
+// the background, and a fresh file is opened in its place. Only the newest
+// `keep` archives are retained.
+
+const (
+	archiveTimeFormat = "20060102T150405.000Z"
+)
+
+// logFile is a log file that can be rotated and reopened; all its methods
+// must be called with the manager's fileWriteLock held.
+type logFile struct {
+	filename string
+	maxSize  int64         // 0 for no size limit
+	maxAge   time.Duration // 0 for no age limit
+	keep     int           // 0 to keep all archives
+
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+func openLogFile(filename string, maxSize int64, maxAge time.Duration, keep int) (lf *logFile, err error) {
+	lf = &logFile{
+		filename: filename,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		keep:     keep,
+	}
+	err = lf.open()
+	return
+}
+
+func (lf *logFile) open() error {
+	file, err := os.OpenFile(lf.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0666)
+	lf.file = file
+	lf.writer = bufio.NewWriter(file)
+	lf.size = 0
+	lf.opened = time.Now().UTC()
+	if err != nil {
+		return fmt.Errorf("Could not open log file %s [%s]", lf.filename, err.Error())
+	}
+	if info, statErr := file.Stat(); statErr == nil {
+		lf.size = info.Size()
+	}
+	return nil
+}
+
+// Write writes a line to the file, rotating it first if necessary.
+func (lf *logFile) Write(line []byte) {
+	if lf.needsRotation(int64(len(line))) {
+		lf.rotate()
+	}
+	n, _ := lf.writer.Write(line)
+	lf.writer.Flush()
+	lf.size += int64(n)
+}
+
+func (lf *logFile) needsRotation(incoming int64) bool {
+	if lf.file == nil || lf.size == 0 {
+		return false
+	}
+	return (lf.maxSize != 0 && lf.size+incoming > lf.maxSize) ||
+		(lf.maxAge != 0 && time.Since(lf.opened) >= lf.maxAge)
+}
+
+// rotate moves the current file aside and opens a new one.
+func (lf *logFile) rotate() {
+	lf.Close()
+	archive := fmt.Sprintf("%s.%s", lf.filename, time.Now().UTC().Format(archiveTimeFormat))
+	renameErr := os.Rename(lf.filename, archive)
+	if err := lf.open(); err != nil || renameErr != nil {
+		fmt.Fprintf(os.Stderr, "Could not rotate log file %s [%v]\n", lf.filename, renameErr)
+		return
+	}
+	go compressArchive(archive, lf.filename, lf.keep)
+}
+
+// Reopen closes and reopens the file, e.g., after it was moved by an
+// external log rotation tool.
+func (lf *logFile) Reopen() error {
+	lf.Close()
+	return lf.open()
+}
+
+func (lf *logFile) Close() error {
+	flushErr := lf.writer.Flush()
+	closeErr := lf.file.Close()
+	if flushErr != nil {
+		return flushErr
+	}
+	return closeErr
+}
+
+// compressArchive gzips a rotated log file, then prunes the oldest archives
+func compressArchive(archive, filename string, keep int) {
+	if err := gzipFile(archive); err != nil {
+		fmt.Fprintf(os.Stderr, "Could not compress log archive %s [%s]\n", archive, err.Error())
+		return
+	}
+	if keep != 0 {
+		pruneArchives(filename, keep)
+	}
+}
+
+func gzipFile(path string) (err error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0666)
+	if err != nil {
+		return
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return
+	}
+	return os.Remove(path)
+}
+
+// pruneArchives deletes all but the newest `keep` compressed archives;
+// their timestamps sort lexicographically.
+func pruneArchives(filename string, keep int) {
+	archives, err := filepath.Glob(filename + ".*.gz")
+	if err != nil || len(archives) <= keep {
+		return
+	}
+	sort.Strings(archives)
+	for _, archive := range archives[:len(archives)-keep] {
+		os.Remove(archive)
+	}
+}
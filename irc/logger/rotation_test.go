@@ -0,0 +1,78 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package logger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLogFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oragono-logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ircd.log")
+
+	lf, err := openLogFile(filename, 20, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := []byte("0123456789abcdef\n")
+	for i := 0; i < 4; i++ {
+		lf.Write(line)
+		// keep archive names distinct
+		time.Sleep(2 * time.Millisecond)
+	}
+	lf.Close()
+
+	if info, err := os.Stat(filename); err != nil || info.Size() != int64(len(line)) {
+		t.Errorf("current log file should hold a single line: %v %v", info, err)
+	}
+
+	// compression and pruning happen in the background:
+	var archives []string
+	for i := 0; i < 100; i++ {
+		archives, _ = filepath.Glob(filename + ".*")
+		if len(archives) == 2 && filepath.Ext(archives[0]) == ".gz" && filepath.Ext(archives[1]) == ".gz" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(archives) != 2 {
+		t.Errorf("expected 2 compressed archives, got %v", archives)
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "oragono-logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "ircd.log")
+
+	lf, err := openLogFile(filename, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("before\n"))
+	os.Rename(filename, filename+".1")
+	if err := lf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	lf.Write([]byte("after\n"))
+	lf.Close()
+
+	if contents, _ := ioutil.ReadFile(filename); string(contents) != "after\n" {
+		t.Errorf("unexpected contents of reopened file: %q", contents)
+	}
+	if contents, _ := ioutil.ReadFile(filename + ".1"); string(contents) != "before\n" {
+		t.Errorf("unexpected contents of moved file: %q", contents)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// in maintenance mode, new connections are rejected (except from loopback
+// and secure-nets), while existing sessions are unaffected. Unlike DEFCON 1,
+// it can be enabled from the config file and tells clients when to come back.
+
+const (
+	defaultMaintenanceMessage = "This server is undergoing maintenance"
+)
+
+// MaintenanceConfig is the initial state of maintenance mode; it is applied
+// at startup, and again whenever a rehash changes it.
+type MaintenanceConfig struct {
+	Enabled    bool
+	Message    string
+	RetryAfter time.Duration `yaml:"retry-after"`
+}
+
+// MaintenanceMode is the current state of maintenance mode.
+type MaintenanceMode struct {
+	sync.Mutex // tier 1
+	enabled    bool
+	message    string
+	retryAt    time.Time // zero if no estimate was given
+}
+
+// Set enables or disables maintenance mode, returning whether it was toggled.
+// retryAfter is the estimated length of the maintenance, or 0 if unknown.
+func (mm *MaintenanceMode) Set(enabled bool, message string, retryAfter time.Duration) (changed bool) {
+	if message == "" {
+		message = defaultMaintenanceMessage
+	}
+	var retryAt time.Time
+	if enabled && retryAfter > 0 {
+		retryAt = time.Now().UTC().Add(retryAfter)
+	}
+
+	mm.Lock()
+	defer mm.Unlock()
+	changed = mm.enabled != enabled
+	mm.enabled = enabled
+	mm.message = message
+	mm.retryAt = retryAt
+	return
+}
+
+// Get returns whether maintenance mode is enabled, and if so, the message
+// for rejected clients and the time they should try again.
+func (mm *MaintenanceMode) Get() (enabled bool, message string, retryAt time.Time) {
+	mm.Lock()
+	defer mm.Unlock()
+	return mm.enabled, mm.message, mm.retryAt
+}
+
+// maintenanceRejection formats the message sent to clients rejected by maintenance mode.
+func maintenanceRejection(message string, retryAt, now time.Time) string {
+	remaining := retryAt.Sub(now)
+	if retryAt.IsZero() || remaining <= 0 {
+		return message
+	}
+	if remaining > time.Minute {
+		remaining = remaining.Round(time.Minute)
+	} else {
+		remaining = remaining.Round(time.Second)
+	}
+	return fmt.Sprintf("%s; please try again in %v", message, remaining)
+}
+
+// checkMaintenance determines whether a new connection from ipaddr must be
+// rejected because of maintenance mode. ipaddr is nil for Tor connections.
+func (server *Server) checkMaintenance(ipaddr net.IP) (banned bool, message string) {
+	enabled, message, retryAt := server.maintenance.Get()
+	if !enabled {
+		return false, ""
+	}
+	if ipaddr != nil && (ipaddr.IsLoopback() || utils.IPInNets(ipaddr, server.Config().Server.secureNets)) {
+		return false, ""
+	}
+	return true, maintenanceRejection(message, retryAt, time.Now().UTC())
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaintenanceRejection(t *testing.T) {
+	now := time.Now().UTC()
+	assertEqual(maintenanceRejection("Down", time.Time{}, now), "Down", t)
+	assertEqual(maintenanceRejection("Down", now.Add(-time.Minute), now), "Down", t)
+	assertEqual(maintenanceRejection("Down", now.Add(90*time.Minute+10*time.Second), now), "Down; please try again in 1h30m0s", t)
+	assertEqual(maintenanceRejection("Down", now.Add(40*time.Second), now), "Down; please try again in 40s", t)
+}
+
+func TestCheckMaintenance(t *testing.T) {
+	server := newTestServer()
+	remote := net.ParseIP("8.8.8.8")
+
+	banned, _ := server.checkMaintenance(remote)
+	assertEqual(banned, false, t)
+
+	assertEqual(server.maintenance.Set(true, "", 0), true, t)
+	banned, message := server.checkMaintenance(remote)
+	assertEqual(banned, true, t)
+	assertEqual(message, defaultMaintenanceMessage, t)
+	banned, _ = server.checkMaintenance(net.ParseIP("127.0.0.1"))
+	assertEqual(banned, false, t)
+	// Tor:
+	banned, _ = server.checkMaintenance(nil)
+	assertEqual(banned, true, t)
+
+	assertEqual(server.maintenance.Set(true, "Migrating", time.Hour), false, t)
+	_, message = server.checkMaintenance(remote)
+	assertEqual(message, "Migrating; please try again in 1h0m0s", t)
+
+	assertEqual(server.maintenance.Set(false, "", 0), true, t)
+	banned, _ = server.checkMaintenance(remote)
+	assertEqual(banned, false, t)
+}
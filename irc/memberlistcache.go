@@ -0,0 +1,169 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+// many clients poll WHO #channel (e.g., every 30 seconds, to keep track of
+// who is away), and clients with userhost-in-names request a NAMES reply
+// with every member's full hostmask; for a large channel, each of these means
+// rendering the whole member list. memberListCache keeps the rendered rows
+// for a short time (channels.who-cache), shared by every viewer who would
+// see the same thing. Opers and clients with view-ips see more than other
+// viewers, so they always get a fresh reply; each viewer's own row is always
+// rendered for them, since it can include their IP and hidden oper status.
+// Changes to membership, member modes, channel modes, and nicknames discard
+// the cache; other changes (e.g., to away status) can take up to its
+// duration to appear.
+
+const (
+	// limits the number of distinct WHOX field selections cached per channel
+	maxMemberListCacheEntries = 16
+)
+
+// memberListRow is the rendered WHO or NAMES entry for one member
+type memberListRow struct {
+	member *Client
+	params []string // nil if the row must be rendered for each viewer
+}
+
+type memberListCacheEntry struct {
+	rows    []memberListRow
+	expires time.Time
+}
+
+type memberListCache struct {
+	sync.Mutex
+	// incremented whenever the cache is discarded, so that rows rendered
+	// before a change aren't stored after it:
+	generation uint64
+	entries    map[string]memberListCacheEntry
+}
+
+// Invalidate discards the cached rows.
+func (cache *memberListCache) Invalidate() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.generation++
+	cache.entries = nil
+}
+
+func (cache *memberListCache) get(key string, now time.Time) (rows []memberListRow, generation uint64, ok bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	entry, ok := cache.entries[key]
+	if ok && now.After(entry.expires) {
+		delete(cache.entries, key)
+		ok = false
+	}
+	return entry.rows, cache.generation, ok
+}
+
+func (cache *memberListCache) set(key string, generation uint64, rows []memberListRow, expires time.Time) {
+	cache.Lock()
+	defer cache.Unlock()
+	if generation != cache.generation {
+		return
+	}
+	if cache.entries == nil {
+		cache.entries = make(map[string]memberListCacheEntry)
+	}
+	if maxMemberListCacheEntries <= len(cache.entries) {
+		now := time.Now()
+		for existingKey, entry := range cache.entries {
+			if now.After(entry.expires) {
+				delete(cache.entries, existingKey)
+			}
+		}
+		if maxMemberListCacheEntries <= len(cache.entries) {
+			return
+		}
+	}
+	cache.entries[key] = memberListCacheEntry{rows: rows, expires: expires}
+}
+
+// memberListView describes everything about a viewer that affects what they
+// see of the channel's member list, other than their own entry.
+type memberListView struct {
+	isJoined     bool
+	isPrivileged bool
+}
+
+// cacheableMemberListView returns the viewer's view, or ok=false if their
+// replies shouldn't be cached.
+func (channel *Channel) cacheableMemberListView(client *Client, hasPrivs bool) (view memberListView, ok bool) {
+	config := &channel.server.Config().Channels.WhoCache
+	if config.Duration <= 0 || hasPrivs || client.HasMode(modes.Operator) {
+		return
+	}
+	channel.stateMutex.RLock()
+	clientModes, isJoined := channel.members[client]
+	memberCount := len(channel.members)
+	channel.stateMutex.RUnlock()
+	if memberCount < config.MinMembers {
+		return
+	}
+	return memberListView{isJoined: isJoined, isPrivileged: clientModes.HighestChannelUserMode() != modes.Mode(0)}, true
+}
+
+// viewVisibleMembers is visibleMembers for a view.
+func (channel *Channel) viewVisibleMembers(view memberListView) (result []*Client) {
+	members := channel.Members()
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	for _, member := range members {
+		if channel.viewCanSeeMemberNoMutex(view.isJoined, view.isPrivileged, member) {
+			result = append(result, member)
+		}
+	}
+	return
+}
+
+// cachedMemberList returns the rows of type `kind` for a view of the member
+// list, calling `render` (which can also omit a member) for each visible member
+// if they aren't cached. Rows with nil params, including `client`'s own row
+// (they always see themself, if they're a member), must be rendered by the
+// caller.
+func (channel *Channel) cachedMemberList(client *Client, view memberListView, kind string, render func(member *Client) (params []string, ok bool)) []memberListRow {
+	key := fmt.Sprintf("%s %t %t", kind, view.isJoined, view.isPrivileged)
+	now := time.Now()
+	rows, generation, ok := channel.memberListCache.get(key, now)
+	if !ok {
+		members := channel.viewVisibleMembers(view)
+		rows = make([]memberListRow, 0, len(members))
+		for _, member := range members {
+			if params, ok := render(member); ok {
+				if member == client {
+					// rendered for `client`, not for the view
+					params = nil
+				}
+				rows = append(rows, memberListRow{member: member, params: params})
+			}
+		}
+		expires := now.Add(channel.server.Config().Channels.WhoCache.Duration)
+		channel.memberListCache.set(key, generation, rows, expires)
+	}
+
+	// the caller renders `client`'s row, which might not be visible to the view
+	// (e.g., for an unprivileged member of an auditorium channel):
+	result := make([]memberListRow, 0, len(rows)+1)
+	sawSelf := false
+	for _, row := range rows {
+		if row.member == client {
+			sawSelf = true
+			row.params = nil
+		}
+		result = append(result, row)
+	}
+	if !sawSelf && view.isJoined {
+		result = append(result, memberListRow{member: client})
+	}
+	return result
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+// memberListNicks returns the nicks in `rows`, marking the rows that
+// the caller must render with a *
+func memberListNicks(rows []memberListRow) (result []string) {
+	for _, row := range rows {
+		if row.params == nil {
+			result = append(result, "*"+row.member.nick)
+		} else {
+			result = append(result, row.params[0])
+		}
+	}
+	sort.Strings(result)
+	return
+}
+
+func TestMemberListCache(t *testing.T) {
+	server := newTestServer()
+	server.Config().Channels.WhoCache.Duration = time.Minute
+	channel := newTestChannel(server, "#test")
+	channel.flags.SetMode(modes.Auditorium, true)
+	op := newTestClient(server, "op")
+	alice := newTestClient(server, "alice")
+	bob := newTestClient(server, "bob")
+	addTestMember(channel, op, modes.ChannelOperator)
+	addTestMember(channel, alice, modes.Mode(0))
+	addTestMember(channel, bob, modes.Mode(0))
+
+	renders := 0
+	render := func(member *Client) ([]string, bool) {
+		renders++
+		return []string{member.nick}, true
+	}
+	list := func(viewer *Client) []string {
+		view, ok := channel.cacheableMemberListView(viewer, false)
+		if !ok {
+			t.Fatalf("%s's view should be cacheable", viewer.nick)
+		}
+		return memberListNicks(channel.cachedMemberList(viewer, view, "test", render))
+	}
+
+	// under +u, unprivileged members only see the op, and themselves:
+	assertEqual(list(alice), []string{"*alice", "op"}, t)
+	assertEqual(renders, 1, t)
+	assertEqual(list(bob), []string{"*bob", "op"}, t)
+	assertEqual(renders, 1, t)
+	// the op has a different view, which sees everyone:
+	assertEqual(list(op), []string{"*op", "alice", "bob"}, t)
+	assertEqual(renders, 4, t)
+
+	// membership changes discard the cache:
+	carol := newTestClient(server, "carol")
+	addTestMember(channel, carol, modes.Voice)
+	assertEqual(list(alice), []string{"*alice", "carol", "op"}, t)
+	assertEqual(renders, 6, t)
+
+	// rows rendered before a change aren't stored after it:
+	_, generation, _ := channel.memberListCache.get("stale", time.Now())
+	channel.memberListCache.Invalidate()
+	channel.memberListCache.set("stale", generation, nil, time.Now().Add(time.Minute))
+	_, _, ok := channel.memberListCache.get("stale", time.Now())
+	assertEqual(ok, false, t)
+
+	// nor are opers' views, or views of small channels:
+	op.SetMode(modes.Operator, true)
+	_, ok = channel.cacheableMemberListView(op, false)
+	assertEqual(ok, false, t)
+	_, ok = channel.cacheableMemberListView(alice, true)
+	assertEqual(ok, false, t)
+	server.Config().Channels.WhoCache.MinMembers = 5
+	_, ok = channel.cacheableMemberListView(alice, false)
+	assertEqual(ok, false, t)
+}
+
+func TestMemberListCacheExpiry(t *testing.T) {
+	var cache memberListCache
+	now := time.Now()
+	for i := 0; i < maxMemberListCacheEntries; i++ {
+		cache.set(string(rune('a'+i)), 0, nil, now.Add(-time.Second))
+	}
+	_, _, ok := cache.get("a", now)
+	assertEqual(ok, false, t)
+
+	// expired entries make room for new ones, up to the limit:
+	rows := []memberListRow{{params: []string{"x"}}}
+	cache.set("new", 0, rows, now.Add(time.Minute))
+	result, _, ok := cache.get("new", now)
+	assertEqual(ok, true, t)
+	if !reflect.DeepEqual(result, rows) {
+		t.Errorf("unexpected rows: %v", result)
+	}
+	for i := 0; i < 2*maxMemberListCacheEntries; i++ {
+		cache.set(string(rune('A'+i)), 0, rows, now.Add(time.Minute))
+	}
+	assertEqual(len(cache.entries), maxMemberListCacheEntries, t)
+}
@@ -4,6 +4,7 @@
 package irc
 
 import (
+	"sync"
 	"time"
 
 	"github.com/goshuirc/irc-go/ircmsg"
@@ -40,6 +41,32 @@ type MessageCache struct {
 
 	target       string
 	splitMessage utils.SplitMessage
+
+	forceTrailing bool
+	// sessions that negotiated server-time or account-tag, but not message-tags,
+	// need a version with only those tags; each such version is built the first
+	// time it's needed, then shared by all the sessions that need it. these are
+	// indexed by tagVariant.
+	variantOnce [numTagVariants]sync.Once
+	variants    [numTagVariants][][]byte
+}
+
+const (
+	variantServerTime = 1 << iota
+	variantAccountTag
+	numTagVariants = 1 << iota
+)
+
+// tagVariant returns which of the tags understood by legacy clients
+// (i.e., ones without message-tags) the session has negotiated.
+func tagVariant(session *Session) (variant int) {
+	if session.capabilities.Has(caps.ServerTime) {
+		variant |= variantServerTime
+	}
+	if session.capabilities.Has(caps.AccountTag) {
+		variant |= variantAccountTag
+	}
+	return
 }
 
 func addAllTags(msg *ircmsg.IrcMessage, tags map[string]string, serverTime time.Time, msgid, accountName string) {
@@ -75,7 +102,8 @@ func (m *MessageCache) Initialize(server *Server, serverTime time.Time, msgid st
 
 	var msg ircmsg.IrcMessage
 	config := server.Config()
-	if config.Server.Compatibility.forceTrailing && commandsThatMustUseTrailing[command] {
+	m.forceTrailing = config.Server.Compatibility.forceTrailing && commandsThatMustUseTrailing[command]
+	if m.forceTrailing {
 		msg.ForceTrailing()
 	}
 	msg.Prefix = nickmask
@@ -107,6 +135,7 @@ func (m *MessageCache) InitializeSplitMessage(server *Server, nickmask, accountN
 
 	config := server.Config()
 	forceTrailing := config.Server.Compatibility.forceTrailing && commandsThatMustUseTrailing[command]
+	m.forceTrailing = forceTrailing
 
 	if message.Is512() {
 		isTagmsg := command == "TAGMSG"
@@ -171,14 +200,26 @@ func (m *MessageCache) InitializeSplitMessage(server *Server, nickmask, accountN
 }
 
 func (m *MessageCache) Send(session *Session) {
+	if session.bridgeController != nil {
+		// a puppet's lines are filtered and tagged on their way to its bridge,
+		// so the serialized versions can't be used
+		if m.fullTags != nil {
+			session.sendFromClientInternal(false, m.time, m.msgid, m.source, m.accountName, m.tags, m.command, m.params...)
+		} else if m.fullTagsMultiline != nil {
+			session.sendSplitMsgFromClientInternal(false, m.source, m.accountName, m.tags, m.command, m.target, m.splitMessage)
+		}
+		return
+	}
 	if m.fullTags != nil {
 		// Initialize() path:
 		if session.capabilities.Has(caps.MessageTags) {
 			session.sendBytes(m.fullTags, false)
 		} else if m.plain != nil {
 			// plain == nil indicates a TAGMSG
-			if !(session.capabilities.Has(caps.ServerTime) || session.capabilities.Has(caps.AccountTag)) {
+			if variant := tagVariant(session); variant == 0 {
 				session.sendBytes(m.plain, false)
+			} else if lines := m.variantLines(variant); lines != nil {
+				session.sendBytes(lines[0], false)
 			} else {
 				// slowpath
 				session.sendFromClientInternal(false, m.time, m.msgid, m.source, m.accountName, nil, m.command, m.params...)
@@ -190,13 +231,68 @@ func (m *MessageCache) Send(session *Session) {
 			for _, line := range m.fullTagsMultiline {
 				session.sendBytes(line, false)
 			}
-		} else if !(session.capabilities.Has(caps.ServerTime) || session.capabilities.Has(caps.AccountTag)) {
+		} else if variant := tagVariant(session); variant == 0 {
 			for _, line := range m.plainMultiline {
 				session.sendBytes(line, false)
 			}
+		} else if lines := m.variantLines(variant); lines != nil {
+			for _, line := range lines {
+				session.sendBytes(line, false)
+			}
 		} else {
 			// slowpath
 			session.sendSplitMsgFromClientInternal(false, m.source, m.accountName, m.tags, m.command, m.target, m.splitMessage)
 		}
 	}
 }
+
+// variantLines returns the serialized lines of the message for sessions with
+// the given tagVariant, or nil if it can't be serialized.
+func (m *MessageCache) variantLines(variant int) [][]byte {
+	m.variantOnce[variant].Do(func() {
+		m.variants[variant] = m.buildVariant(variant)
+	})
+	return m.variants[variant]
+}
+
+func (m *MessageCache) buildVariant(variant int) (lines [][]byte) {
+	var msg ircmsg.IrcMessage
+	if m.forceTrailing {
+		msg.ForceTrailing()
+	}
+	msg.Prefix = m.source
+	msg.Command = m.command
+	if variant&variantServerTime != 0 {
+		serverTime := m.time
+		if serverTime.IsZero() {
+			serverTime = time.Now()
+		}
+		msg.SetTag("time", serverTime.UTC().Format(IRCv3TimestampFormat))
+	}
+	if variant&variantAccountTag != 0 && m.accountName != "*" {
+		msg.SetTag("account", m.accountName)
+	}
+
+	if m.fullTags != nil {
+		msg.Params = m.params
+		line, err := msg.LineBytesStrict(false, MaxLineLen)
+		if err != nil {
+			return nil
+		}
+		return [][]byte{line}
+	}
+
+	lines = make([][]byte, 0, len(m.splitMessage.Split))
+	for _, pair := range m.splitMessage.Split {
+		if len(pair.Message) == 0 {
+			continue
+		}
+		msg.Params = []string{m.target, pair.Message}
+		line, err := msg.LineBytesStrict(false, MaxLineLen)
+		if err != nil {
+			return nil
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+func parseVariant(t *testing.T, line []byte) ircmsg.IrcMessage {
+	t.Helper()
+	msg, err := ircmsg.ParseLine(string(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestMessageCacheVariants(t *testing.T) {
+	server := newTestServer()
+	serverTime := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	var cache MessageCache
+	cache.Initialize(server, serverTime, "msgid", "alice!u@example.com", "alice", map[string]string{"+draft/reply": "x"}, "PRIVMSG", "#chan", "hi")
+
+	for variant := 1; variant < numTagVariants; variant++ {
+		lines := cache.variantLines(variant)
+		if len(lines) != 1 {
+			t.Fatalf("expected one line, got %d", len(lines))
+		}
+		msg := parseVariant(t, lines[0])
+		assertEqual(msg.Prefix, "alice!u@example.com", t)
+		assertEqual(msg.Params, []string{"#chan", "hi"}, t)
+		hasTime, timeTag := msg.GetTag("time")
+		assertEqual(hasTime, variant&variantServerTime != 0, t)
+		if hasTime {
+			assertEqual(timeTag, "2020-06-01T12:00:00.000Z", t)
+		}
+		hasAccount, _ := msg.GetTag("account")
+		assertEqual(hasAccount, variant&variantAccountTag != 0, t)
+		// msgid and client-only tags require message-tags:
+		assertEqual(len(msg.AllTags()), btoi(hasTime)+btoi(hasAccount), t)
+	}
+	// built once, then shared:
+	assertEqual(&cache.variantLines(variantServerTime)[0][0], &cache.variants[variantServerTime][0][0], t)
+}
+
+func TestMessageCacheMultilineVariants(t *testing.T) {
+	server := newTestServer()
+	var message utils.SplitMessage
+	message.Time = time.Now().UTC()
+	message.Msgid = "msgid"
+	message.Split = []utils.MessagePair{{Message: "first"}, {Message: ""}, {Message: "second", Concat: true}}
+	var cache MessageCache
+	cache.InitializeSplitMessage(server, "alice!u@example.com", "*", nil, "PRIVMSG", "#chan", message)
+
+	lines := cache.variantLines(variantServerTime | variantAccountTag)
+	assertEqual(len(lines), 2, t)
+	for i, expected := range []string{"first", "second"} {
+		msg := parseVariant(t, lines[i])
+		assertEqual(msg.Params, []string{"#chan", expected}, t)
+		hasAccount, _ := msg.GetTag("account")
+		assertEqual(hasAccount, false, t)
+		assertEqual(len(msg.AllTags()), 1, t)
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -4,8 +4,12 @@
 package irc
 
 import (
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/utils"
 )
 
 func TestZncTimestampParser(t *testing.T) {
@@ -15,3 +19,66 @@ func TestZncTimestampParser(t *testing.T) {
 	assertEqual(zncWireTimeToTime(".988"), time.Unix(0, 988000000).UTC(), t)
 	assertEqual(zncWireTimeToTime("garbage"), time.Unix(0, 0).UTC(), t)
 }
+
+func TestZncTimestampSerializer(t *testing.T) {
+	assertEqual(timeToZncWireTime(time.Unix(1558338348, 988000000)), "1558338348.988000000", t)
+	assertEqual(timeToZncWireTime(time.Unix(1558338348, 5000000)), "1558338348.005000000", t)
+	now := time.Unix(1558338348, 123456789).UTC()
+	assertEqual(zncWireTimeToTime(timeToZncWireTime(now)), now, t)
+}
+
+func TestValidSessionLabel(t *testing.T) {
+	assertEqual(validSessionLabel("laptop"), true, t)
+	assertEqual(validSessionLabel("weechat@home"), true, t)
+	assertEqual(validSessionLabel("ünïcode"), true, t)
+	assertEqual(validSessionLabel(""), false, t)
+	assertEqual(validSessionLabel("my laptop"), false, t)
+	assertEqual(validSessionLabel(":laptop"), false, t)
+	assertEqual(validSessionLabel("lap\x01top"), false, t)
+	assertEqual(validSessionLabel(strings.Repeat("a", maxSessionLabelLen+1)), false, t)
+}
+
+func TestSplitTargets(t *testing.T) {
+	server := newTestServer()
+	server.Config().Limits.Targmax = TargmaxConfig{Privmsg: 3, Notice: 1}
+	session := &Session{client: newTestClient(server, "alice")}
+	rb := NewResponseBuffer(session)
+
+	targets, ok := splitTargets(session.client, "PRIVMSG", "#chat,bob,,#Chat,BOB,carol", rb)
+	assertEqual(ok, true, t)
+	assertEqual(targets, []string{"#chat", "bob", "carol"}, t)
+	// the extra targets are billed to fakelag:
+	assertEqual(session.deferredFakelagCount, 2, t)
+
+	_, ok = splitTargets(session.client, "NOTICE", "bob,carol", rb)
+	assertEqual(ok, false, t)
+	_, ok = splitTargets(session.client, "PRIVMSG", ",", rb)
+	assertEqual(ok, false, t)
+	assertEqual(session.deferredFakelagCount, 2, t)
+}
+
+func TestChathistoryContinuation(t *testing.T) {
+	t1 := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Minute)
+	items := []history.Item{
+		{Message: utils.SplitMessage{Msgid: "a", Time: t1}},
+		{Message: utils.SplitMessage{Time: t2}},
+	}
+	var none history.Selector
+	early := history.Selector{Time: t1.Add(-time.Hour)}
+	late := history.Selector{Time: t2.Add(time.Hour)}
+
+	assertEqual(chathistoryContinuation([]string{"LATEST", "#chan", "*", "1000"}, none, none, items, 100),
+		[]string{"BEFORE", "#chan", "msgid=a", "100"}, t)
+	assertEqual(chathistoryContinuation([]string{"after", "#chan", "msgid=x"}, history.Selector{Msgid: "x"}, none, items, 100),
+		[]string{"AFTER", "#chan", "timestamp=2020-06-01T12:01:00.000Z", "100"}, t)
+	// BETWEEN forwards and backwards:
+	assertEqual(chathistoryContinuation([]string{"BETWEEN", "#chan", "timestamp=early", "timestamp=late"}, early, late, items, 100),
+		[]string{"BETWEEN", "#chan", "timestamp=2020-06-01T12:01:00.000Z", "timestamp=late", "100"}, t)
+	assertEqual(chathistoryContinuation([]string{"BETWEEN", "#chan", "timestamp=late", "timestamp=early"}, late, early, items, 100),
+		[]string{"BETWEEN", "#chan", "msgid=a", "timestamp=early", "100"}, t)
+	// direction unknown:
+	assertEqual(chathistoryContinuation([]string{"BETWEEN", "#chan", "msgid=x", "msgid=y"}, history.Selector{Msgid: "x"}, history.Selector{Msgid: "y"}, items, 100),
+		[]string(nil), t)
+	assertEqual(chathistoryContinuation([]string{"LATEST", "#chan", "*"}, none, none, nil, 100), []string(nil), t)
+}
@@ -57,7 +57,7 @@ func ApplyUserModeChanges(client *Client, changes modes.ModeChanges, force bool,
 					} else if change.Mode == modes.Operator || change.Mode == modes.LocalOperator {
 						removedSnomasks = client.server.snomasks.String(client)
 						client.server.stats.ChangeOperators(-1)
-						applyOper(client, nil, nil)
+						applyOper(client, nil, 0, nil)
 						if removedSnomasks != "" {
 							client.server.snomasks.RemoveClient(client)
 						}
@@ -138,6 +138,24 @@ func ParseDefaultUserModes(rawModes *string) modes.Modes {
 	return parseDefaultModes(*rawModes, modes.ParseUserModeChanges)
 }
 
+// modesArePersistent returns whether any of the changes would modify state that is
+// written back to the datastore for registered channels (i.e., anything other than
+// listing modes or changing channel-user modes)
+func modesArePersistent(changes modes.ModeChanges) bool {
+	for _, change := range changes {
+		if change.Op == modes.List {
+			continue
+		}
+		switch change.Mode {
+		case modes.ChannelFounder, modes.ChannelAdmin, modes.ChannelOperator, modes.Halfop, modes.Voice:
+			continue
+		default:
+			return true
+		}
+	}
+	return false
+}
+
 // #1021: channel key must be valid as a non-final parameter
 func validateChannelKey(key string) bool {
 	// empty string is valid in this context because it unsets the mode
@@ -201,7 +219,7 @@ func (channel *Channel) ApplyChannelModeChanges(client *Client, isSamode bool, c
 		case modes.BanMask, modes.ExceptMask, modes.InviteMask:
 			maskOpCount += 1
 			if change.Op == modes.List {
-				channel.ShowMaskList(client, change.Mode, rb)
+				channel.ShowMaskList(client, change.Mode, nil, "", 0, rb)
 				continue
 			}
 
@@ -291,6 +309,12 @@ func (channel *Channel) ApplyChannelModeChanges(client *Client, isSamode bool, c
 			}
 
 			if channel.flags.SetMode(change.Mode, change.Op == modes.Add) {
+				// a manual change supersedes any pending TIMEDMODE expiration
+				channel.clearTimedMode(change.Mode)
+				if (change.Mode == modes.DelayedJoin || change.Mode == modes.Anonymous) && change.Op == modes.Remove &&
+					!channel.flags.HasMode(modes.DelayedJoin) {
+					channel.revealAllDelayedJoins()
+				}
 				applied = append(applied, change)
 			}
 		}
@@ -310,6 +334,9 @@ func (channel *Channel) ApplyChannelModeChanges(client *Client, isSamode bool, c
 	if includeFlags != 0 {
 		channel.MarkDirty(includeFlags)
 	}
+	if len(applied) != 0 {
+		channel.memberListCache.Invalidate()
+	}
 
 	// #649: don't send 324 RPL_CHANNELMODEIS if we were only working with mask lists
 	if len(applied) == 0 && !alreadySentPrivError && (maskOpCount == 0 || maskOpCount < len(changes)) {
@@ -17,14 +17,15 @@ var (
 	// SupportedUserModes are the user modes that we actually support (modifying).
 	SupportedUserModes = Modes{
 		Bot, Invisible, Operator, RegisteredOnly, ServerNotice, UserRoleplaying,
-		UserNoCTCP,
+		UserNoCTCP, UserNoTyping, UserDeaf,
 	}
 
 	// SupportedChannelModes are the channel modes that we support.
 	SupportedChannelModes = Modes{
 		BanMask, ChanRoleplaying, ExceptMask, InviteMask, InviteOnly, Key,
 		Moderated, NoOutside, OpOnlyTopic, RegisteredOnly, RegisteredOnlySpeak,
-		Secret, UserLimit, NoCTCP, Auditorium, OpModerated,
+		Secret, UserLimit, NoCTCP, Auditorium, OpModerated, DelayedJoin, Anonymous,
+		NoRemove, NoTyping, NoNickChange, Censor,
 	}
 )
 
@@ -107,22 +108,28 @@ const (
 	RegisteredOnly  Mode = 'R'
 	ServerNotice    Mode = 's'
 	TLS             Mode = 'Z'
+	UserDeaf        Mode = 'D'
 	UserNoCTCP      Mode = 'T'
+	UserNoTyping    Mode = 'Y'
 	UserRoleplaying Mode = 'E'
 	WallOps         Mode = 'w'
 )
 
 // Channel Modes
 const (
+	Anonymous       Mode = 'A' // flag
 	Auditorium      Mode = 'u' // flag
 	BanMask         Mode = 'b' // arg
 	ChanRoleplaying Mode = 'E' // flag
+	DelayedJoin     Mode = 'D' // flag
 	ExceptMask      Mode = 'e' // arg
 	InviteMask      Mode = 'I' // arg
 	InviteOnly      Mode = 'i' // flag
 	Key             Mode = 'k' // flag arg
 	Moderated       Mode = 'm' // flag
 	NoOutside       Mode = 'n' // flag
+	NoRemove        Mode = 'Q' // flag
+	NoTyping        Mode = 'Y' // flag
 	OpOnlyTopic     Mode = 't' // flag
 	// RegisteredOnly mode is reused here from umode definition
 	RegisteredOnlySpeak Mode = 'M' // flag
@@ -130,6 +137,8 @@ const (
 	UserLimit           Mode = 'l' // flag arg
 	NoCTCP              Mode = 'C' // flag
 	OpModerated         Mode = 'U' // flag
+	NoNickChange        Mode = 'N' // flag
+	Censor              Mode = 'G' // flag
 )
 
 var (
@@ -426,6 +435,21 @@ func (set *ModeSet) HighestChannelUserMode() (result Mode) {
 	return
 }
 
+// ChannelOplevel returns the WHOX oplevel of a channel user mode. As in
+// ircu, lower levels are more powerful (0 for founder, 1 for admin, 2 for
+// operator), and only operators have a level; ok is false otherwise.
+func ChannelOplevel(mode Mode) (level int, ok bool) {
+	for i, userMode := range ChannelUserModes {
+		if userMode == Halfop {
+			break
+		}
+		if mode == userMode {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 type ByCodepoint Modes
 
 func (a ByCodepoint) Len() int           { return len(a) }
@@ -461,7 +485,7 @@ func ChanmodesToken() (result string) {
 	// type C: modes that take a parameter only when set, never when unset
 	C := Modes{UserLimit}
 	// type D: modes without parameters
-	D := Modes{InviteOnly, Moderated, NoOutside, OpOnlyTopic, ChanRoleplaying, Secret, NoCTCP, RegisteredOnly, RegisteredOnlySpeak, Auditorium, OpModerated}
+	D := Modes{InviteOnly, Moderated, NoOutside, OpOnlyTopic, ChanRoleplaying, Secret, NoCTCP, RegisteredOnly, RegisteredOnlySpeak, Auditorium, OpModerated, DelayedJoin, Anonymous, NoRemove, NoTyping, NoNickChange, Censor}
 
 	sort.Sort(ByCodepoint(A))
 	sort.Sort(ByCodepoint(B))
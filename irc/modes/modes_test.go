@@ -220,6 +220,20 @@ func TestHighestChannelUserMode(t *testing.T) {
 	}
 }
 
+func TestChannelOplevel(t *testing.T) {
+	expected := map[Mode]int{ChannelFounder: 0, ChannelAdmin: 1, ChannelOperator: 2}
+	for mode, expectedLevel := range expected {
+		if level, ok := ChannelOplevel(mode); !ok || level != expectedLevel {
+			t.Errorf("unexpected oplevel for %s: %d", mode, level)
+		}
+	}
+	for _, mode := range []Mode{Mode(0), Voice, Halfop, Secret} {
+		if _, ok := ChannelOplevel(mode); ok {
+			t.Errorf("%s should not have an oplevel", mode)
+		}
+	}
+}
+
 func TestChanmodesToken(t *testing.T) {
 	tok := ChanmodesToken()
 	for _, mode := range SupportedChannelModes {
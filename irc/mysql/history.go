@@ -22,10 +22,6 @@ import (
 	"github.com/oragono/oragono/irc/utils"
 )
 
-var (
-	ErrDisallowed = errors.New("disallowed")
-)
-
 const (
 	// maximum length in bytes of any message target (nickname or channel name) in its
 	// canonicalized (i.e., casefolded) state:
@@ -36,7 +32,7 @@ const (
 	keySchemaVersion = "db.version"
 	// minor version indicates rollback-safe upgrades, i.e.,
 	// you can downgrade oragono and everything will work
-	latestDbMinorVersion  = "1"
+	latestDbMinorVersion  = "3"
 	keySchemaMinorVersion = "db.minorversion"
 	cleanupRowLimit       = 50
 	cleanupPauseTime      = 10 * time.Minute
@@ -53,10 +49,13 @@ type MySQL struct {
 	insertHistory        *sql.Stmt
 	insertSequence       *sql.Stmt
 	insertConversation   *sql.Stmt
+	insertCorrespondent  *sql.Stmt
 	insertAccountMessage *sql.Stmt
+	insertRelation       *sql.Stmt
 
 	stateMutex sync.Mutex
 	config     Config
+	retention  map[string]history.RetentionPolicy // target to policy
 
 	wakeForgetter chan e
 }
@@ -86,6 +85,31 @@ func (mysql *MySQL) getExpireTime() (expireTime time.Duration) {
 	return
 }
 
+// SetRetentionPolicy sets the retention policy of a target; the zero policy
+// removes it.
+func (mysql *MySQL) SetRetentionPolicy(target string, policy history.RetentionPolicy) {
+	mysql.stateMutex.Lock()
+	defer mysql.stateMutex.Unlock()
+	if policy == (history.RetentionPolicy{}) {
+		delete(mysql.retention, target)
+		return
+	}
+	if mysql.retention == nil {
+		mysql.retention = make(map[string]history.RetentionPolicy)
+	}
+	mysql.retention[target] = policy
+}
+
+func (mysql *MySQL) getRetentionPolicies() (result map[string]history.RetentionPolicy) {
+	mysql.stateMutex.Lock()
+	defer mysql.stateMutex.Unlock()
+	result = make(map[string]history.RetentionPolicy, len(mysql.retention))
+	for target, policy := range mysql.retention {
+		result[target] = policy
+	}
+	return
+}
+
 func (m *MySQL) Open() (err error) {
 	var address string
 	if m.config.SocketPath != "" {
@@ -150,18 +174,48 @@ func (mysql *MySQL) fixSchemas() (err error) {
 	var minorVersion string
 	err = mysql.db.QueryRow(`select value from metadata where key_name = ?;`, keySchemaMinorVersion).Scan(&minorVersion)
 	if err == sql.ErrNoRows {
-		// XXX for now, the only minor version upgrade is the account tracking tables
+		// minor version 1 added the account tracking tables
 		err = mysql.createComplianceTables()
 		if err != nil {
 			return
 		}
-		_, err = mysql.db.Exec(`insert into metadata (key_name, value) values (?, ?);`, keySchemaMinorVersion, latestDbMinorVersion)
+		_, err = mysql.db.Exec(`insert into metadata (key_name, value) values (?, ?);`, keySchemaMinorVersion, "1")
+		if err != nil {
+			return
+		}
+		minorVersion = "1"
+	} else if err != nil {
+		return
+	}
+	// if latestDbMinorVersion < minorVersion, ignore because backwards compatible
+	if minorVersion == "1" {
+		// minor version 2 added the correspondents table
+		err = mysql.createCorrespondentsTable()
+		if err != nil {
+			return
+		}
+		_, err = mysql.db.Exec(`INSERT INTO correspondents (target, correspondent, nanotime)
+			SELECT target, correspondent, MAX(nanotime) FROM conversations GROUP BY target, correspondent;`)
+		if err != nil {
+			return
+		}
+		_, err = mysql.db.Exec(`update metadata set value = ? where key_name = ?;`, "2", keySchemaMinorVersion)
+		if err != nil {
+			return
+		}
+		minorVersion = "2"
+	}
+	if minorVersion == "2" {
+		// minor version 3 added the relations table; replies and reactions
+		// stored before the upgrade are not aggregated
+		err = mysql.createRelationsTable()
+		if err != nil {
+			return
+		}
+		_, err = mysql.db.Exec(`update metadata set value = ? where key_name = ?;`, latestDbMinorVersion, keySchemaMinorVersion)
 		if err != nil {
 			return
 		}
-	} else if err == nil && minorVersion != latestDbMinorVersion {
-		// TODO: if minorVersion < latestDbMinorVersion, upgrade,
-		// if latestDbMinorVersion < minorVersion, ignore because backwards compatible
 	}
 	return
 }
@@ -207,9 +261,56 @@ func (mysql *MySQL) createTables() (err error) {
 		return err
 	}
 
+	err = mysql.createCorrespondentsTable()
+	if err != nil {
+		return err
+	}
+
+	err = mysql.createRelationsTable()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// the correspondents table records the time of the latest message in each DM
+// conversation, so CHATHISTORY TARGETS can be answered without scanning the
+// conversations themselves
+func (mysql *MySQL) createCorrespondentsTable() (err error) {
+	_, err = mysql.db.Exec(fmt.Sprintf(`CREATE TABLE correspondents (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		target VARBINARY(%[1]d) NOT NULL,
+		correspondent VARBINARY(%[1]d) NOT NULL,
+		nanotime BIGINT UNSIGNED NOT NULL,
+		UNIQUE KEY (target, correspondent),
+		KEY (target, nanotime),
+		KEY (nanotime)
+	) CHARSET=ascii COLLATE=ascii_bin;`, MaxTargetLength))
+	return
+}
+
+// the relations table indexes replies and reactions by the msgid of the message
+// they refer to (the parent), so they can be aggregated without scanning the
+// history that follows it. like the sequence and conversations tables, it has
+// an entry for each target whose history contains the reply or reaction.
+func (mysql *MySQL) createRelationsTable() (err error) {
+	_, err = mysql.db.Exec(fmt.Sprintf(`CREATE TABLE relations (
+		id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		target VARBINARY(%[1]d) NOT NULL,
+		correspondent VARBINARY(%[1]d) NOT NULL,
+		parent BINARY(16) NOT NULL,
+		reaction VARBINARY(%[2]d) NOT NULL,
+		sender VARBINARY(%[1]d) NOT NULL,
+		msgid BINARY(16) NOT NULL,
+		nanotime BIGINT UNSIGNED NOT NULL,
+		history_id BIGINT NOT NULL,
+		KEY (target, parent),
+		KEY (history_id)
+	) CHARSET=ascii COLLATE=ascii_bin;`, MaxTargetLength, history.MaxReactionLength))
+	return
+}
+
 func (mysql *MySQL) createComplianceTables() (err error) {
 	_, err = mysql.db.Exec(fmt.Sprintf(`CREATE TABLE account_messages (
 		history_id BIGINT UNSIGNED NOT NULL PRIMARY KEY,
@@ -259,6 +360,18 @@ func (mysql *MySQL) cleanupLoop() {
 				time.Sleep(elapsed)
 			}
 		}
+		for target, policy := range mysql.getRetentionPolicies() {
+			for {
+				startTime := time.Now()
+				rowsDeleted, err := mysql.doRetentionCleanup(target, policy)
+				elapsed := time.Now().Sub(startTime)
+				mysql.logError("error during retention cleanup", err)
+				if rowsDeleted < cleanupRowLimit {
+					break
+				}
+				time.Sleep(elapsed)
+			}
+		}
 		time.Sleep(cleanupPauseTime)
 	}
 }
@@ -275,7 +388,13 @@ func (mysql *MySQL) doCleanup(age time.Duration) (count int, err error) {
 
 	mysql.logger.Debug("mysql", fmt.Sprintf("deleting %d history rows, max age %s", len(ids), utils.NanoToTimestamp(maxNanotime)))
 
-	return len(ids), mysql.deleteHistoryIDs(ctx, ids)
+	err = mysql.deleteHistoryIDs(ctx, ids)
+	if err != nil {
+		return
+	}
+	// every message in these conversations has expired:
+	_, err = mysql.db.ExecContext(ctx, `DELETE FROM correspondents WHERE nanotime < ?;`, time.Now().Add(-age).UnixNano())
+	return len(ids), err
 }
 
 func (mysql *MySQL) deleteHistoryIDs(ctx context.Context, ids []uint64) (err error) {
@@ -298,6 +417,10 @@ func (mysql *MySQL) deleteHistoryIDs(ctx context.Context, ids []uint64) (err err
 	if err != nil {
 		return
 	}
+	_, err = mysql.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM relations WHERE history_id in %s;`, inBuf.Bytes()))
+	if err != nil {
+		return
+	}
 	if mysql.isTrackingAccountMessages() {
 		_, err = mysql.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM account_messages WHERE history_id in %s;`, inBuf.Bytes()))
 		if err != nil {
@@ -351,6 +474,60 @@ func (mysql *MySQL) selectCleanupIDs(ctx context.Context, age time.Duration) (id
 	return
 }
 
+// doRetentionCleanup deletes a batch of a target's messages that are older than
+// its policy's maximum age, or beyond its maximum number of lines.
+func (mysql *MySQL) doRetentionCleanup(target string, policy history.RetentionPolicy) (count int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+	defer cancel()
+
+	var ids []uint64
+	if policy.MaxAge != 0 {
+		threshold := time.Now().Add(-policy.MaxAge).UnixNano()
+		ids, err = mysql.selectHistoryIDs(ctx, `
+			SELECT history_id FROM sequence
+			WHERE target = ? AND nanotime < ?
+			LIMIT ?;`, target, threshold, cleanupRowLimit)
+		if err != nil {
+			return
+		}
+	}
+	if policy.MaxLines != 0 && len(ids) < cleanupRowLimit {
+		var excessIDs []uint64
+		excessIDs, err = mysql.selectHistoryIDs(ctx, `
+			SELECT history_id FROM sequence
+			WHERE target = ?
+			ORDER BY nanotime DESC LIMIT ?, ?;`, target, policy.MaxLines, cleanupRowLimit-len(ids))
+		if err != nil {
+			return
+		}
+		ids = append(ids, excessIDs...)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	mysql.logger.Debug("mysql", fmt.Sprintf("deleting %d history rows from %s under its retention policy", len(ids), target))
+	return len(ids), mysql.deleteHistoryIDs(ctx, ids)
+}
+
+func (mysql *MySQL) selectHistoryIDs(ctx context.Context, query string, args ...interface{}) (ids []uint64, err error) {
+	rows, err := mysql.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id uint64
+		err = rows.Scan(&id)
+		if err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 // wait for forget queue items and process them one by one
 func (mysql *MySQL) forgetLoop() {
 	defer func() {
@@ -470,11 +647,23 @@ func (mysql *MySQL) prepareStatements() (err error) {
 	if err != nil {
 		return
 	}
+	mysql.insertCorrespondent, err = mysql.db.Prepare(`INSERT INTO correspondents
+		(target, correspondent, nanotime) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE nanotime = GREATEST(nanotime, VALUES(nanotime));`)
+	if err != nil {
+		return
+	}
 	mysql.insertAccountMessage, err = mysql.db.Prepare(`INSERT INTO account_messages
 		(history_id, account) VALUES (?, ?);`)
 	if err != nil {
 		return
 	}
+	mysql.insertRelation, err = mysql.db.Prepare(`INSERT INTO relations
+		(target, correspondent, parent, reaction, sender, msgid, nanotime, history_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?);`)
+	if err != nil {
+		return
+	}
 
 	return
 }
@@ -515,60 +704,248 @@ func (mysql *MySQL) Forget(account string) {
 	}
 }
 
-func (mysql *MySQL) AddChannelItem(target string, item history.Item, account string) (err error) {
-	if mysql.db == nil {
+// RenameAccount moves the stored history of the casefolded account `oldAccount`
+// to `newAccount` (which may already have history of its own, if the accounts
+// are being merged), and (where account messages are tracked) rewrites the
+// attributions of the messages it sent to `newAccountName`.
+func (mysql *MySQL) RenameAccount(oldAccount, newAccount, newAccountName string) (err error) {
+	if mysql.db == nil || oldAccount == "" || newAccount == "" {
+		return
+	}
+
+	if oldAccount != newAccount {
+		err = func() (err error) {
+			ctx, cancel := context.WithTimeout(context.Background(), mysql.getTimeout())
+			defer cancel()
+
+			tx, err := mysql.db.BeginTx(ctx, nil)
+			if err != nil {
+				return
+			}
+			defer func() {
+				if err != nil {
+					tx.Rollback()
+				}
+			}()
+
+			// when merging, a conversation may already exist under the new name:
+			_, err = tx.ExecContext(ctx, `UPDATE correspondents AS n JOIN correspondents AS o
+				ON n.correspondent = o.correspondent
+				SET n.nanotime = GREATEST(n.nanotime, o.nanotime)
+				WHERE n.target = ? AND o.target = ?;`, newAccount, oldAccount)
+			if err != nil {
+				return
+			}
+			for _, query := range []string{
+				`UPDATE sequence SET target = ? WHERE target = ?;`,
+				`UPDATE conversations SET target = ? WHERE target = ?;`,
+				`UPDATE relations SET target = ? WHERE target = ?;`,
+				`UPDATE IGNORE correspondents SET target = ? WHERE target = ?;`,
+				`UPDATE account_messages SET account = ? WHERE account = ?;`,
+			} {
+				_, err = tx.ExecContext(ctx, query, newAccount, oldAccount)
+				if err != nil {
+					return
+				}
+			}
+			_, err = tx.ExecContext(ctx, `DELETE FROM correspondents WHERE target = ?;`, oldAccount)
+			if err != nil {
+				return
+			}
+			return tx.Commit()
+		}()
+		if mysql.logError("could not rename account", err) {
+			return
+		}
+	}
+
+	var lastSeen uint64
+	for {
+		var count int
+		count, lastSeen, err = mysql.renameAccountIteration(newAccount, newAccountName, lastSeen)
+		if count == 0 || err != nil {
+			break
+		}
+	}
+	mysql.logError("could not rewrite account names", err)
+	return
+}
+
+func (mysql *MySQL) renameAccountIteration(account, accountName string, lastSeen uint64) (count int, maxID uint64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+	defer cancel()
+
+	maxID = lastSeen
+	rows, err := mysql.db.QueryContext(ctx, `
+		SELECT account_messages.history_id, history.data FROM account_messages
+		INNER JOIN history ON history.id = account_messages.history_id
+		WHERE account_messages.account = ? AND account_messages.history_id > ?
+		ORDER BY account_messages.history_id LIMIT ?;`, account, lastSeen, cleanupRowLimit)
+	if err != nil {
 		return
 	}
 
-	if target == "" {
-		return utils.ErrInvalidParams
+	ids := make([]uint64, 0, cleanupRowLimit)
+	blobs := make([][]byte, 0, cleanupRowLimit)
+	for rows.Next() {
+		var id uint64
+		var blob []byte
+		err = rows.Scan(&id, &blob)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ids = append(ids, id)
+		blobs = append(blobs, blob)
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		count++
+		maxID = id
+		var item history.Item
+		if unmarshalItem(blobs[i], &item) != nil || item.AccountName == accountName {
+			continue
+		}
+		item.AccountName = accountName
+		blob, mErr := marshalItem(&item)
+		if mErr != nil {
+			continue
+		}
+		_, err = mysql.db.ExecContext(ctx, `UPDATE history SET data = ? WHERE id = ?;`, blob, id)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+var errInvalidItem = errors.New("invalid history item")
+
+// insertStatements are the prepared insert statements, bound to a transaction
+type insertStatements struct {
+	history        *sql.Stmt
+	sequence       *sql.Stmt
+	conversation   *sql.Stmt
+	correspondent  *sql.Stmt
+	accountMessage *sql.Stmt
+	relation       *sql.Stmt
+}
+
+// AddItems stores a batch of channel and direct messages in a single
+// transaction. Items that can't be serialized are logged and skipped;
+// any database error rolls back the whole batch.
+func (mysql *MySQL) AddItems(writes []history.PersistentWrite) (err error) {
+	if mysql.db == nil || len(writes) == 0 {
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), mysql.getTimeout())
 	defer cancel()
 
-	id, err := mysql.insertBase(ctx, item)
+	tx, err := mysql.db.BeginTx(ctx, nil)
+	if mysql.logError("could not begin history transaction", err) {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	stmts := insertStatements{
+		history:        tx.StmtContext(ctx, mysql.insertHistory),
+		sequence:       tx.StmtContext(ctx, mysql.insertSequence),
+		conversation:   tx.StmtContext(ctx, mysql.insertConversation),
+		correspondent:  tx.StmtContext(ctx, mysql.insertCorrespondent),
+		accountMessage: tx.StmtContext(ctx, mysql.insertAccountMessage),
+		relation:       tx.StmtContext(ctx, mysql.insertRelation),
+	}
+
+	for i := range writes {
+		if writes[i].Channel != "" {
+			err = mysql.addChannelItem(ctx, &stmts, &writes[i])
+		} else {
+			err = mysql.addDirectMessage(ctx, &stmts, &writes[i])
+		}
+		if err == errInvalidItem {
+			err = nil
+		} else if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	mysql.logError("could not commit history transaction", err)
+	return
+}
+
+func (mysql *MySQL) addChannelItem(ctx context.Context, stmts *insertStatements, write *history.PersistentWrite) (err error) {
+	id, err := mysql.insertBase(ctx, stmts, write.Item)
 	if err != nil {
 		return
 	}
 
-	err = mysql.insertSequenceEntry(ctx, target, item.Message.Time.UnixNano(), id)
+	err = mysql.insertSequenceEntry(ctx, stmts, write.Channel, write.Item.Message.Time.UnixNano(), id)
 	if err != nil {
 		return
 	}
 
-	err = mysql.insertAccountMessageEntry(ctx, id, account)
+	err = mysql.insertRelationEntry(ctx, stmts, &write.Item, write.Channel, "", id)
 	if err != nil {
 		return
 	}
 
-	return
+	return mysql.insertAccountMessageEntry(ctx, stmts, id, write.Account)
 }
 
-func (mysql *MySQL) insertSequenceEntry(ctx context.Context, target string, messageTime int64, id int64) (err error) {
-	_, err = mysql.insertSequence.ExecContext(ctx, target, messageTime, id)
+func (mysql *MySQL) insertSequenceEntry(ctx context.Context, stmts *insertStatements, target string, messageTime int64, id int64) (err error) {
+	_, err = stmts.sequence.ExecContext(ctx, target, messageTime, id)
 	mysql.logError("could not insert sequence entry", err)
 	return
 }
 
-func (mysql *MySQL) insertConversationEntry(ctx context.Context, target, correspondent string, messageTime int64, id int64) (err error) {
-	_, err = mysql.insertConversation.ExecContext(ctx, target, correspondent, messageTime, id)
-	mysql.logError("could not insert conversations entry", err)
+func (mysql *MySQL) insertConversationEntry(ctx context.Context, stmts *insertStatements, target, correspondent string, messageTime int64, id int64) (err error) {
+	_, err = stmts.conversation.ExecContext(ctx, target, correspondent, messageTime, id)
+	if mysql.logError("could not insert conversations entry", err) {
+		return
+	}
+	_, err = stmts.correspondent.ExecContext(ctx, target, correspondent, messageTime)
+	mysql.logError("could not insert correspondents entry", err)
 	return
 }
 
-func (mysql *MySQL) insertBase(ctx context.Context, item history.Item) (id int64, err error) {
+// insertRelationEntry indexes the item if it's a reply or reaction
+func (mysql *MySQL) insertRelationEntry(ctx context.Context, stmts *insertStatements, item *history.Item, target, correspondent string, id int64) (err error) {
+	relation, ok := history.ItemRelation(item)
+	if !ok {
+		return
+	}
+	parent, pErr := decodeMsgid(relation.Parent)
+	msgid, mErr := decodeMsgid(item.Message.Msgid)
+	if pErr != nil || mErr != nil || len(parent) != 16 || len(msgid) != 16 {
+		return // not a reply to one of our messages
+	}
+	sender := relation.Sender
+	if MaxTargetLength < len(sender) {
+		sender = sender[:MaxTargetLength]
+	}
+	_, err = stmts.relation.ExecContext(ctx, target, correspondent, parent, relation.Reaction, sender, msgid, item.Message.Time.UnixNano(), id)
+	mysql.logError("could not insert relations entry", err)
+	return
+}
+
+func (mysql *MySQL) insertBase(ctx context.Context, stmts *insertStatements, item history.Item) (id int64, err error) {
 	value, err := marshalItem(&item)
 	if mysql.logError("could not marshal item", err) {
-		return
+		return 0, errInvalidItem
 	}
 
 	msgidBytes, err := decodeMsgid(item.Message.Msgid)
 	if mysql.logError("could not decode msgid", err) {
-		return
+		return 0, errInvalidItem
 	}
 
-	result, err := mysql.insertHistory.ExecContext(ctx, value, msgidBytes)
+	result, err := stmts.history.ExecContext(ctx, value, msgidBytes)
 	if mysql.logError("could not insert item", err) {
 		return
 	}
@@ -580,70 +957,68 @@ func (mysql *MySQL) insertBase(ctx context.Context, item history.Item) (id int64
 	return
 }
 
-func (mysql *MySQL) insertAccountMessageEntry(ctx context.Context, id int64, account string) (err error) {
+func (mysql *MySQL) insertAccountMessageEntry(ctx context.Context, stmts *insertStatements, id int64, account string) (err error) {
 	if account == "" || !mysql.isTrackingAccountMessages() {
 		return
 	}
-	_, err = mysql.insertAccountMessage.ExecContext(ctx, id, account)
+	_, err = stmts.accountMessage.ExecContext(ctx, id, account)
 	mysql.logError("could not insert account-message entry", err)
 	return
 }
 
-func (mysql *MySQL) AddDirectMessage(sender, senderAccount, recipient, recipientAccount string, item history.Item) (err error) {
-	if mysql.db == nil {
-		return
-	}
-
-	if senderAccount == "" && recipientAccount == "" {
+func (mysql *MySQL) addDirectMessage(ctx context.Context, stmts *insertStatements, write *history.PersistentWrite) (err error) {
+	if write.SenderAccount == "" && write.RecipientAccount == "" {
 		return
 	}
 
-	if sender == "" || recipient == "" {
-		return utils.ErrInvalidParams
+	if write.Sender == "" || write.Recipient == "" {
+		return errInvalidItem
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), mysql.getTimeout())
-	defer cancel()
-
-	id, err := mysql.insertBase(ctx, item)
+	id, err := mysql.insertBase(ctx, stmts, write.Item)
 	if err != nil {
 		return
 	}
 
-	nanotime := item.Message.Time.UnixNano()
+	nanotime := write.Item.Message.Time.UnixNano()
 
-	if senderAccount != "" {
-		err = mysql.insertSequenceEntry(ctx, senderAccount, nanotime, id)
+	if write.SenderAccount != "" {
+		err = mysql.insertSequenceEntry(ctx, stmts, write.SenderAccount, nanotime, id)
 		if err != nil {
 			return
 		}
-		err = mysql.insertConversationEntry(ctx, senderAccount, recipient, nanotime, id)
+		err = mysql.insertConversationEntry(ctx, stmts, write.SenderAccount, write.Recipient, nanotime, id)
+		if err != nil {
+			return
+		}
+		err = mysql.insertRelationEntry(ctx, stmts, &write.Item, write.SenderAccount, write.Recipient, id)
 		if err != nil {
 			return
 		}
 	}
 
-	if recipientAccount != "" && sender != recipient {
-		err = mysql.insertSequenceEntry(ctx, recipientAccount, nanotime, id)
+	if write.RecipientAccount != "" && write.Sender != write.Recipient {
+		err = mysql.insertSequenceEntry(ctx, stmts, write.RecipientAccount, nanotime, id)
 		if err != nil {
 			return
 		}
-		err = mysql.insertConversationEntry(ctx, recipientAccount, sender, nanotime, id)
+		err = mysql.insertConversationEntry(ctx, stmts, write.RecipientAccount, write.Sender, nanotime, id)
+		if err != nil {
+			return
+		}
+		err = mysql.insertRelationEntry(ctx, stmts, &write.Item, write.RecipientAccount, write.Sender, id)
 		if err != nil {
 			return
 		}
 	}
 
-	err = mysql.insertAccountMessageEntry(ctx, id, senderAccount)
-	if err != nil {
-		return
-	}
-
-	return
+	return mysql.insertAccountMessageEntry(ctx, stmts, id, write.SenderAccount)
 }
 
-// note that accountName is the unfolded name
-func (mysql *MySQL) DeleteMsgid(msgid, accountName string) (err error) {
+// note that accountName is the unfolded name. if target is nonempty,
+// the message must be in its history (i.e., in that channel, or in the DMs
+// of that account).
+func (mysql *MySQL) DeleteMsgid(msgid, accountName, target string) (err error) {
 	if mysql.db == nil {
 		return nil
 	}
@@ -656,12 +1031,20 @@ func (mysql *MySQL) DeleteMsgid(msgid, accountName string) (err error) {
 		return
 	}
 
+	if target != "" {
+		var found int
+		err = mysql.db.QueryRowContext(ctx, `SELECT 1 FROM sequence WHERE history_id = ? AND target = ? LIMIT 1;`, id, target).Scan(&found)
+		if err != nil {
+			return
+		}
+	}
+
 	if accountName != "*" {
 		var item history.Item
 		err = unmarshalItem(data, &item)
 		// delete if the entry is corrupt
 		if err == nil && item.AccountName != accountName {
-			return ErrDisallowed
+			return history.ErrDisallowed
 		}
 	}
 
@@ -835,6 +1218,110 @@ func (mysql *MySQL) betweenTimestamps(ctx context.Context, target, correspondent
 	return
 }
 
+// ListCorrespondents lists the DM correspondents of `target` whose latest
+// message falls between `start` and `end`, with the same ordering and limit
+// semantics as history.MergeTargets.
+func (mysql *MySQL) ListCorrespondents(target string, start, end, cutoff time.Time, limit int) (results []history.TargetListing, err error) {
+	if mysql.db == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mysql.getTimeout())
+	defer cancel()
+
+	after, before, ascending := history.MinMaxAsc(start, end, cutoff)
+	direction := "ASC"
+	if !ascending {
+		direction = "DESC"
+	}
+
+	var queryBuf bytes.Buffer
+	args := make([]interface{}, 0, 4)
+	fmt.Fprintf(&queryBuf, "SELECT correspondent, nanotime FROM correspondents WHERE target = ?")
+	args = append(args, target)
+	if !after.IsZero() {
+		fmt.Fprintf(&queryBuf, " AND nanotime > ?")
+		args = append(args, after.UnixNano())
+	}
+	if !before.IsZero() {
+		fmt.Fprintf(&queryBuf, " AND nanotime < ?")
+		args = append(args, before.UnixNano())
+	}
+	fmt.Fprintf(&queryBuf, " ORDER BY nanotime %s LIMIT ?;", direction)
+	args = append(args, limit)
+
+	rows, err := mysql.db.QueryContext(ctx, queryBuf.String(), args...)
+	if mysql.logError("could not list correspondents", err) {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var correspondent string
+		var nanotime int64
+		err = rows.Scan(&correspondent, &nanotime)
+		if mysql.logError("could not scan correspondents", err) {
+			return
+		}
+		results = append(results, history.TargetListing{
+			CfName: correspondent,
+			Time:   time.Unix(0, nanotime).UTC(),
+		})
+	}
+	return
+}
+
+// ListChannels returns the time of the latest message in each of the given
+// (casefolded) channels that has any history, in a single query.
+func (mysql *MySQL) ListChannels(cfchannels []string) (results []history.TargetListing, err error) {
+	if mysql.db == nil || len(cfchannels) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mysql.getTimeout())
+	defer cancel()
+
+	var queryBuf bytes.Buffer
+	args := make([]interface{}, len(cfchannels))
+	queryBuf.WriteString("SELECT target, MAX(nanotime) FROM sequence WHERE target IN (")
+	for i, chname := range cfchannels {
+		if i != 0 {
+			queryBuf.WriteString(", ")
+		}
+		queryBuf.WriteByte('?')
+		args[i] = chname
+	}
+	queryBuf.WriteString(") GROUP BY target;")
+
+	rows, err := mysql.db.QueryContext(ctx, queryBuf.String(), args...)
+	if mysql.logError("could not list channels", err) {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var target string
+		var nanotime int64
+		err = rows.Scan(&target, &nanotime)
+		if mysql.logError("could not scan channels", err) {
+			return
+		}
+		results = append(results, history.TargetListing{
+			CfName: target,
+			Time:   time.Unix(0, nanotime).UTC(),
+		})
+	}
+	return
+}
+
+// Ping checks that the database is reachable.
+func (mysql *MySQL) Ping() (err error) {
+	if mysql.db == nil {
+		return errors.New("database is not open")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), mysql.getTimeout())
+	defer cancel()
+	return mysql.db.PingContext(ctx)
+}
+
 func (mysql *MySQL) Close() {
 	// closing the database will close our prepared statements as well
 	if mysql.db != nil {
@@ -879,6 +1366,118 @@ func (s *mySQLHistorySequence) Around(start history.Selector, limit int) (result
 	return history.GenericAround(s, start, limit)
 }
 
+func (s *mySQLHistorySequence) Aggregate(msgids []string, maxReplies int) (results []history.Aggregate, err error) {
+	return s.mysql.aggregate(s.target, s.correspondent, s.cutoff, msgids, maxReplies)
+}
+
+// aggregate implements history.Aggregator from the relations table
+func (mysql *MySQL) aggregate(target, correspondent string, cutoff time.Time, msgids []string, maxReplies int) (results []history.Aggregate, err error) {
+	builder := history.NewAggregateBuilder(msgids, maxReplies)
+	if mysql.db == nil {
+		return builder.Results(), nil
+	}
+
+	// the conditions common to both queries: relations visible in this sequence
+	var whereBuf bytes.Buffer
+	whereArgs := make([]interface{}, 0, 3)
+	whereBuf.WriteString("target = ?")
+	whereArgs = append(whereArgs, target)
+	if correspondent != "" {
+		whereBuf.WriteString(" AND correspondent = ?")
+		whereArgs = append(whereArgs, correspondent)
+	}
+	if !cutoff.IsZero() {
+		whereBuf.WriteString(" AND nanotime > ?")
+		whereArgs = append(whereArgs, cutoff.UnixNano())
+	}
+	where := whereBuf.String()
+
+	args := append([]interface{}(nil), whereArgs...)
+	var inBuf bytes.Buffer
+	for _, msgid := range msgids {
+		parent, err := decodeMsgid(msgid)
+		if err != nil {
+			continue
+		}
+		if len(args) != len(whereArgs) {
+			inBuf.WriteByte(',')
+		}
+		inBuf.WriteByte('?')
+		args = append(args, parent)
+	}
+	if len(args) == len(whereArgs) {
+		return builder.Results(), nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mysql.getTimeout())
+	defer cancel()
+
+	rows, err := mysql.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT parent, reaction, COUNT(*), COUNT(DISTINCT sender) FROM relations
+		WHERE %s AND parent IN (%s)
+		GROUP BY parent, reaction;`, where, inBuf.String()), args...)
+	if mysql.logError("could not aggregate relations", err) {
+		return
+	}
+	replyCounts := make(map[string]int)
+	for rows.Next() {
+		var parent []byte
+		var reaction string
+		var count, senders int
+		err = rows.Scan(&parent, &reaction, &count, &senders)
+		if mysql.logError("could not scan relations", err) {
+			rows.Close()
+			return
+		}
+		if reaction == "" {
+			replyCounts[encodeMsgid(parent)] = count
+		} else {
+			builder.AddReactions(encodeMsgid(parent), reaction, senders)
+		}
+	}
+	rows.Close()
+
+	for parent, count := range replyCounts {
+		var replies []string
+		if 0 < maxReplies {
+			replies, err = mysql.latestReplies(ctx, where, whereArgs, parent, maxReplies)
+			if err != nil {
+				return
+			}
+		}
+		builder.AddReplies(parent, count, replies)
+	}
+	return builder.Results(), nil
+}
+
+func (mysql *MySQL) latestReplies(ctx context.Context, where string, whereArgs []interface{}, parent string, limit int) (replies []string, err error) {
+	parentBytes, err := decodeMsgid(parent)
+	if err != nil {
+		return
+	}
+	args := append(append([]interface{}(nil), whereArgs...), parentBytes, limit)
+	rows, err := mysql.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT msgid FROM relations WHERE %s AND parent = ? AND reaction = ''
+		ORDER BY nanotime DESC LIMIT ?;`, where), args...)
+	if mysql.logError("could not select replies", err) {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msgid []byte
+		err = rows.Scan(&msgid)
+		if mysql.logError("could not scan replies", err) {
+			return
+		}
+		replies = append(replies, encodeMsgid(msgid))
+	}
+	// chronological order:
+	for i, j := 0, len(replies)-1; i < j; i, j = i+1, j-1 {
+		replies[i], replies[j] = replies[j], replies[i]
+	}
+	return
+}
+
 func (mysql *MySQL) MakeSequence(target, correspondent string, cutoff time.Time) history.Sequence {
 	return &mySQLHistorySequence{
 		target:        target,
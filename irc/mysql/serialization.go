@@ -21,3 +21,7 @@ func unmarshalItem(data []byte, result *history.Item) (err error) {
 func decodeMsgid(msgid string) ([]byte, error) {
 	return utils.B32Encoder.DecodeString(msgid)
 }
+
+func encodeMsgid(msgid []byte) string {
+	return utils.B32Encoder.EncodeToString(msgid)
+}
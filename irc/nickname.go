@@ -36,48 +36,48 @@ func performNickChange(server *Server, client *Client, target *Client, session *
 	assignedNickname, err, back := client.server.clients.SetNick(target, session, nickname, false)
 	if err == errNicknameInUse {
 		if !isSanick {
-			rb.Add(nil, server.name, ERR_NICKNAMEINUSE, details.nick, utils.SafeErrorParam(nickname), client.t("Nickname is already in use"))
+			rb.FailNumeric(ERR_NICKNAMEINUSE, "NICK", "NICKNAME_IN_USE", utils.SafeErrorParam(nickname), client.t("Nickname is already in use"))
 		} else {
-			rb.Add(nil, server.name, "FAIL", "SANICK", "NICKNAME_IN_USE", utils.SafeErrorParam(nickname), client.t("Nickname is already in use"))
+			rb.Fail("SANICK", "NICKNAME_IN_USE", utils.SafeErrorParam(nickname), client.t("Nickname is already in use"))
 		}
 	} else if err == errNicknameReserved {
 		if !isSanick {
-			rb.Add(nil, server.name, ERR_NICKNAMEINUSE, details.nick, utils.SafeErrorParam(nickname), client.t("Nickname is reserved by a different account"))
+			rb.FailNumeric(ERR_NICKNAMEINUSE, "NICK", "NICKNAME_RESERVED", utils.SafeErrorParam(nickname), client.t("Nickname is reserved by a different account"))
 		} else {
-			rb.Add(nil, server.name, "FAIL", "SANICK", "NICKNAME_RESERVED", utils.SafeErrorParam(nickname), client.t("Nickname is reserved by a different account"))
+			rb.Fail("SANICK", "NICKNAME_RESERVED", utils.SafeErrorParam(nickname), client.t("Nickname is reserved by a different account"))
 		}
 	} else if err == errNicknameInvalid {
 		if !isSanick {
-			rb.Add(nil, server.name, ERR_ERRONEUSNICKNAME, details.nick, utils.SafeErrorParam(nickname), client.t("Erroneous nickname"))
+			rb.FailNumeric(ERR_ERRONEUSNICKNAME, "NICK", "NICKNAME_INVALID", utils.SafeErrorParam(nickname), client.t("Erroneous nickname"))
 		} else {
-			rb.Add(nil, server.name, "FAIL", "SANICK", "NICKNAME_INVALID", utils.SafeErrorParam(nickname), client.t("Erroneous nickname"))
+			rb.Fail("SANICK", "NICKNAME_INVALID", utils.SafeErrorParam(nickname), client.t("Erroneous nickname"))
 		}
 	} else if err == errNickAccountMismatch {
 		// this used to use ERR_NICKNAMEINUSE, but it displayed poorly in some clients;
 		// ERR_UNKNOWNERROR at least has a better chance of displaying our error text
 		if !isSanick {
-			rb.Add(nil, server.name, ERR_UNKNOWNERROR, details.nick, "NICK", client.t("You must use your account name as your nickname"))
+			rb.FailUnknownError("NICK", "NICKNAME_ACCOUNT_MISMATCH", utils.SafeErrorParam(nickname), client.t("You must use your account name as your nickname"))
 		} else {
-			rb.Add(nil, server.name, "FAIL", "SANICK", "UNKNOWN_ERROR", utils.SafeErrorParam(nickname), client.t("This user's nickname and account name need to be equal"))
+			rb.Fail("SANICK", "UNKNOWN_ERROR", utils.SafeErrorParam(nickname), client.t("This user's nickname and account name need to be equal"))
 		}
 	} else if err == errNickMissing {
 		if !isSanick {
-			rb.Add(nil, server.name, ERR_NONICKNAMEGIVEN, details.nick, client.t("No nickname given"))
+			rb.FailNumeric(ERR_NONICKNAMEGIVEN, "NICK", "NICKNAME_INVALID", client.t("No nickname given"))
 		} else {
-			rb.Add(nil, server.name, "FAIL", "SANICK", "NICKNAME_INVALID", utils.SafeErrorParam(nickname), client.t("No nickname given"))
+			rb.Fail("SANICK", "NICKNAME_INVALID", utils.SafeErrorParam(nickname), client.t("No nickname given"))
 		}
 	} else if err == errNoop {
 		if !isSanick {
 			// no message
 		} else {
-			rb.Add(nil, server.name, "NOTE", "SANICK", "NOOP", utils.SafeErrorParam(nickname), client.t("Client already had the desired nickname"))
+			rb.Note("SANICK", "NOOP", utils.SafeErrorParam(nickname), client.t("Client already had the desired nickname"))
 		}
 	} else if err != nil {
 		client.server.logger.Error("internal", "couldn't change nick", nickname, err.Error())
 		if !isSanick {
-			rb.Add(nil, server.name, ERR_UNKNOWNERROR, details.nick, "NICK", client.t("Could not set or change nickname"))
+			rb.FailUnknownError("NICK", "UNKNOWN_ERROR", utils.SafeErrorParam(nickname), client.t("Could not set or change nickname"))
 		} else {
-			rb.Add(nil, server.name, "FAIL", "SANICK", "UNKNOWN_ERROR", utils.SafeErrorParam(nickname), client.t("Could not set or change nickname"))
+			rb.Fail("SANICK", "UNKNOWN_ERROR", utils.SafeErrorParam(nickname), client.t("Could not set or change nickname"))
 		}
 	}
 	if err != nil {
@@ -115,6 +115,7 @@ func performNickChange(server *Server, client *Client, target *Client, session *
 
 	for _, channel := range target.Channels() {
 		channel.AddHistoryItem(histItem, details.account)
+		channel.memberListCache.Invalidate()
 	}
 
 	newCfnick := target.NickCasefolded()
@@ -61,10 +61,12 @@ administrator can use this command to logout another user's clients.`,
 			handler: nsDropHandler,
 			help: `Syntax: $bDROP [nickname]$b
 
-DROP de-links the given (or your current) nickname from your user account.`,
-			helpShort:    `$bDROP$b de-links your current (or the given) nickname from your user account.`,
-			enabled:      servCmdRequiresNickRes,
-			authRequired: true,
+DROP de-links the given (or your current) nickname from your user account.
+It is equivalent to $bUNGROUP$b.`,
+			helpShort:     `$bDROP$b de-links your current (or the given) nickname from your user account.`,
+			enabled:       servCmdRequiresNickRes,
+			authRequired:  true,
+			modifiesState: true,
 		},
 		"enforce": {
 			hidden:  true,
@@ -73,15 +75,18 @@ DROP de-links the given (or your current) nickname from your user account.`,
 
 ENFORCE is an alias for $bGET enforce$b and $bSET enforce$b. See the help
 entry for $bSET$b for more information.`,
-			authRequired: true,
-			enabled:      servCmdRequiresNickRes,
+			authRequired:  true,
+			enabled:       servCmdRequiresNickRes,
+			modifiesState: true,
 		},
 		"ghost": {
 			handler: nsGhostHandler,
 			help: `Syntax: $bGHOST <nickname>$b
 
 GHOST disconnects the given user from the network if they're logged in with the
-same user account, letting you reclaim your nickname.`,
+same user account, or if they're using a nickname that belongs to your account,
+letting you reclaim your nickname. To take the nickname at the same time, use
+$bREGAIN$b instead.`,
 			helpShort:    `$bGHOST$b reclaims your nickname.`,
 			enabled:      servCmdRequiresNickRes,
 			authRequired: true,
@@ -92,10 +97,13 @@ same user account, letting you reclaim your nickname.`,
 			help: `Syntax: $bGROUP$b
 
 GROUP links your current nickname with your logged-in account, so other people
-will not be able to use it.`,
-			helpShort:    `$bGROUP$b links your current nickname to your user account.`,
-			enabled:      servCmdRequiresNickRes,
-			authRequired: true,
+will not be able to use it. Grouped nicknames are protected in the same way as
+your primary nickname. To see your grouped nicknames, use $bINFO$b; to remove
+one, use $bUNGROUP$b.`,
+			helpShort:     `$bGROUP$b links your current nickname to your user account.`,
+			enabled:       servCmdRequiresNickRes,
+			authRequired:  true,
+			modifiesState: true,
 		},
 		"identify": {
 			handler: nsIdentifyHandler,
@@ -125,6 +133,20 @@ If no regex is provided, all registered nicknames are returned.`,
 INFO gives you information about the given (or your own) user account.`,
 			helpShort: `$bINFO$b gives you information on a user account.`,
 		},
+		"regain": {
+			handler: nsRegainHandler,
+			help: `Syntax: $bREGAIN <nickname>$b
+
+REGAIN takes a nickname that belongs to your account and changes your own
+nickname to it. If another of your clients is using the nickname, it is
+disconnected, as with $bGHOST$b; if someone else is using it, and the
+nickname is protected (see $bENFORCE$b), they are renamed to a guest nickname.`,
+			helpShort:     `$bREGAIN$b reclaims your nickname and switches to it.`,
+			enabled:       servCmdRequiresNickRes,
+			authRequired:  true,
+			minParams:     1,
+			modifiesState: true,
+		},
 		"register": {
 			handler: nsRegisterHandler,
 			// TODO: "email" is an oversimplification here; it's actually any callback, e.g.,
@@ -136,20 +158,22 @@ server allows anonymous registration, you can omit the e-mail address.
 
 If you are currently logged in with a TLS client certificate and wish to use
 it instead of a password to log in, send * as the password.`,
-			helpShort: `$bREGISTER$b lets you register a user account.`,
-			enabled:   servCmdRequiresAccreg,
-			minParams: 1,
-			maxParams: 2,
+			helpShort:     `$bREGISTER$b lets you register a user account.`,
+			enabled:       servCmdRequiresAccreg,
+			minParams:     1,
+			maxParams:     2,
+			modifiesState: true,
 		},
 		"sadrop": {
 			handler: nsDropHandler,
 			help: `Syntax: $bSADROP <nickname>$b
 
 SADROP forcibly de-links the given nickname from the attached user account.`,
-			helpShort: `$bSADROP$b forcibly de-links the given nickname from its user account.`,
-			capabs:    []string{"accreg"},
-			enabled:   servCmdRequiresNickRes,
-			minParams: 1,
+			helpShort:     `$bSADROP$b forcibly de-links the given nickname from its user account.`,
+			capabs:        []string{"accreg"},
+			enabled:       servCmdRequiresNickRes,
+			minParams:     1,
+			modifiesState: true,
 		},
 		"saregister": {
 			handler: nsSaregisterHandler,
@@ -158,10 +182,11 @@ SADROP forcibly de-links the given nickname from the attached user account.`,
 SAREGISTER registers an account on someone else's behalf.
 This is for use in configurations that require SASL for all connections;
 an administrator can set use this command to set up user accounts.`,
-			helpShort: `$bSAREGISTER$b registers an account on someone else's behalf.`,
-			enabled:   servCmdRequiresAuthEnabled,
-			capabs:    []string{"accreg"},
-			minParams: 1,
+			helpShort:     `$bSAREGISTER$b registers an account on someone else's behalf.`,
+			enabled:       servCmdRequiresAuthEnabled,
+			capabs:        []string{"accreg"},
+			minParams:     1,
+			modifiesState: true,
 		},
 		"sessions": {
 			hidden:  true,
@@ -172,6 +197,18 @@ SESSIONS is an alias for $bCLIENTS LIST$b. See the help entry for $bCLIENTS$b
 for more information.`,
 			enabled: servCmdRequiresBouncerEnabled,
 		},
+		"ungroup": {
+			handler: nsDropHandler,
+			help: `Syntax: $bUNGROUP [nickname]$b
+
+UNGROUP de-links the given (or your current) nickname from your user account,
+so that other people can use it again. Your primary nickname (the one you
+registered with) can't be ungrouped.`,
+			helpShort:     `$bUNGROUP$b de-links your current (or the given) nickname from your user account.`,
+			enabled:       servCmdRequiresNickRes,
+			authRequired:  true,
+			modifiesState: true,
+		},
 		"unregister": {
 			handler: nsUnregisterHandler,
 			help: `Syntax: $bUNREGISTER <username> [code]$b
@@ -180,9 +217,10 @@ UNREGISTER lets you delete your user account (or someone else's, if you're an
 IRC operator with the correct permissions). To prevent accidental
 unregistrations, a verification code is required; invoking the command without
 a code will display the necessary code.`,
-			helpShort: `$bUNREGISTER$b lets you delete your user account.`,
-			enabled:   servCmdRequiresAuthEnabled,
-			minParams: 1,
+			helpShort:     `$bUNREGISTER$b lets you delete your user account.`,
+			enabled:       servCmdRequiresAuthEnabled,
+			minParams:     1,
+			modifiesState: true,
 		},
 		"erase": {
 			handler: nsUnregisterHandler,
@@ -193,10 +231,11 @@ This should be used with caution, because it violates an expectation that
 account names are permanent identifiers. Typically, UNREGISTER should be
 used instead. A confirmation code is required; invoking the command
 without a code will display the necessary code.`,
-			helpShort: `$bERASE$b erases all records of an account, allowing reuse.`,
-			enabled:   servCmdRequiresAuthEnabled,
-			capabs:    []string{"accreg"},
-			minParams: 1,
+			helpShort:     `$bERASE$b erases all records of an account, allowing reuse.`,
+			enabled:       servCmdRequiresAuthEnabled,
+			capabs:        []string{"accreg"},
+			minParams:     1,
+			modifiesState: true,
 		},
 		"verify": {
 			handler: nsVerifyHandler,
@@ -204,9 +243,35 @@ without a code will display the necessary code.`,
 
 VERIFY lets you complete an account registration, if the server requires email
 or other verification.`,
-			helpShort: `$bVERIFY$b lets you complete account registration.`,
-			enabled:   servCmdRequiresAccreg,
-			minParams: 2,
+			helpShort:     `$bVERIFY$b lets you complete account registration.`,
+			enabled:       servCmdRequiresAccreg,
+			minParams:     2,
+			modifiesState: true,
+		},
+		"sendpass": {
+			handler: nsSendpassHandler,
+			help: `Syntax: $bSENDPASS <account>$b
+
+SENDPASS e-mails a password reset code to the address associated with an
+account, if you've forgotten its password. The code can then be used with
+$bRESETPASS$b; it can only be used once, and expires after a while.`,
+			helpShort:     `$bSENDPASS$b sends a password reset code to an account's e-mail address.`,
+			enabled:       passwordResetEnabled,
+			minParams:     1,
+			maxParams:     1,
+			modifiesState: true,
+		},
+		"resetpass": {
+			handler: nsResetpassHandler,
+			help: `Syntax: $bRESETPASS <account> <code> <new password>$b
+
+RESETPASS sets a new password for an account, using a code that was sent to
+its e-mail address by $bSENDPASS$b.`,
+			helpShort:     `$bRESETPASS$b sets a new password with a code from SENDPASS.`,
+			enabled:       passwordResetEnabled,
+			minParams:     3,
+			maxParams:     3,
+			modifiesState: true,
 		},
 		"passwd": {
 			handler: nsPasswdHandler,
@@ -218,9 +283,10 @@ password and confirm the new one by typing it twice. If you're an IRC operator
 with the correct permissions, you can use PASSWD to reset someone else's
 password by supplying their username and then the desired password. To
 indicate an empty password, use * instead.`,
-			helpShort: `$bPASSWD$b lets you change your password.`,
-			enabled:   servCmdRequiresAuthEnabled,
-			minParams: 2,
+			helpShort:     `$bPASSWD$b lets you change your password.`,
+			enabled:       servCmdRequiresAuthEnabled,
+			minParams:     2,
+			modifiesState: true,
 		},
 		"get": {
 			handler: nsGetHandler,
@@ -299,10 +365,44 @@ how the history of your direct messages is stored. Your options are:
 'auto-away' is only effective for always-on clients. If enabled, you will
 automatically be marked away when all your sessions are disconnected, and
 automatically return from away when you connect again.`,
+				`$bHISTORY$b
+'history' limits how the messages you send are stored, overriding the
+settings of your correspondents (and, if the server allows it, of channels).
+Your choice is shown in your WHOIS. Your options are:
+1. 'off'        [your messages are not stored in history at all]
+2. 'ephemeral'  [your messages are only stored temporarily, not on disk]
+3. 'persistent' [no limit on storage; this is the default]`,
+				`$bBLOCKED-REPORTS$b
+'blocked-reports' controls whether you receive hourly summaries of direct
+messages that were blocked by your user modes (+R or +T). Your options are
+'on' (the default) and 'off'.`,
+				`$bAUTO-JOIN$b
+'auto-join' lists channels you will be joined to automatically when you
+connect and log in, replacing the server's default list. Your options are
+a list of channels (e.g., '#chat,#help'), 'none', and 'default'.`,
+				`$bHIDE-CHANNELS$b
+If 'hide-channels' is enabled, your WHOIS only lists channels that the person
+asking is also in, and you are omitted from WHO queries on a channel by people
+who aren't in it. Opers can still see your channels. Your options are 'on' and
+'off' (the default).`,
+				`$bHIDE-IDLE$b
+If 'hide-idle' is enabled, your idle time and signon time are hidden from
+WHOIS and WHO queries by anyone except you and opers. Your options are 'on'
+and 'off' (the default).`,
+				`$bHIDE-TLS$b
+If 'hide-tls' is enabled, WHOIS won't show whether you are using a secure
+connection to anyone except you and opers. Your options are 'on' and 'off'
+(the default).`,
+				`$bEMAIL$b
+'email' changes the e-mail address associated with your account, which is
+used to recover it. $bSET EMAIL <address>$b sends a confirmation code to the
+new address; the change takes effect once you confirm it with
+$bSET EMAIL <address> <code>$b. The old address is notified of the change.`,
 			},
-			authRequired: true,
-			enabled:      servCmdRequiresAuthEnabled,
-			minParams:    2,
+			authRequired:  true,
+			enabled:       servCmdRequiresAuthEnabled,
+			minParams:     2,
+			modifiesState: true,
 		},
 		"saset": {
 			handler: nsSetHandler,
@@ -310,10 +410,11 @@ automatically return from away when you connect again.`,
 
 SASET modifies the values of someone else's account settings. For more
 information on the settings and their possible values, see HELP SET.`,
-			helpShort: `$bSASET$b modifies another user's account settings`,
-			enabled:   servCmdRequiresAuthEnabled,
-			minParams: 3,
-			capabs:    []string{"accreg"},
+			helpShort:     `$bSASET$b modifies another user's account settings`,
+			enabled:       servCmdRequiresAuthEnabled,
+			minParams:     3,
+			capabs:        []string{"accreg"},
+			modifiesState: true,
 		},
 		"cert": {
 			handler: nsCertHandler,
@@ -322,7 +423,8 @@ information on the settings and their possible values, see HELP SET.`,
 CERT examines or modifies the TLS certificate fingerprints that can be used to
 log into an account. Specifically, $bCERT LIST$b lists the authorized
 fingerprints, $bCERT ADD <fingerprint>$b adds a new fingerprint, and
-$bCERT DEL <fingerprint>$b removes a fingerprint. If you're an IRC operator
+$bCERT DEL <fingerprint>$b removes a fingerprint. Any of the fingerprints can
+be used to log in with SASL EXTERNAL. If you're an IRC operator
 with the correct permissions, you can act on another user's account, for
 example with $bCERT ADD <account> <fingerprint>$b.`,
 			helpShort: `$bCERT$b controls a user account's certificate fingerprints`,
@@ -337,22 +439,59 @@ example with $bCERT ADD <account> <fingerprint>$b.`,
 
 Suspending an account disables it (preventing new logins) and disconnects
 all associated clients. You can specify a time limit or a reason for
-the suspension. The $bDEL$b subcommand reverses a suspension, and the $bLIST$b
+the suspension; the reason is shown to anyone who tries to log in. The
+account's data is kept, and the $bDEL$b subcommand reverses a suspension
+(restoring the account's always-on client, if it had one). The $bLIST$b
 command lists all current suspensions.`,
 			helpShort: `$bSUSPEND$b manages account suspensions`,
 			minParams: 1,
 			capabs:    []string{"accreg"},
 		},
+		"protect": {
+			handler: nsProtectHandler,
+			help: `Syntax: $bPROTECT <account> [ON|OFF]$b
+
+PROTECT marks an account (typically one used by a service or an important
+bot) as protected: its clients can't be KILLed or KLINEd unless the operator
+uses $bKILL FORCE$b or $bKLINE FORCE$b and a second operator confirms by
+repeating the command. With no argument, it shows whether the account is
+protected.`,
+			helpShort: `$bPROTECT$b protects an account's clients from KILL and KLINE`,
+			minParams: 1,
+			maxParams: 2,
+			capabs:    []string{"accreg"},
+		},
+		"merge": {
+			handler: nsMergeHandler,
+			help: `Syntax: $bMERGE <source> <target> [<source password> <target password>]$b
+
+MERGE merges the account <source> into the account <target>, then deletes
+<source>. The source's name and reserved nicknames become reserved nicknames
+of the target, its certificate fingerprints can be used to log into the
+target, its channel registrations and access pass to the target, and its
+message history is attributed to the target. Clients logged into the source
+are logged into the target instead. The passwords of both accounts are
+required, unless you're an IRC operator with the correct permissions.`,
+			helpShort:     `$bMERGE$b merges one account into another`,
+			enabled:       servCmdRequiresAuthEnabled,
+			minParams:     2,
+			maxParams:     4,
+			modifiesState: true,
+		},
 		"rename": {
 			handler: nsRenameHandler,
 			help: `Syntax: $bRENAME <account> <newname>$b
 
-RENAME allows a server administrator to change the name of an account.
-Currently, you can only change the canonical casefolding of an account
-(e.g., you can change "Alice" to "alice", but not "Alice" to "Amanda").`,
-			helpShort: `$bRENAME$b renames an account`,
-			minParams: 2,
-			capabs:    []string{"accreg"},
+RENAME changes the name of your account (or someone else's, if you're an IRC
+operator with the correct permissions). Your channel registrations and access,
+vhost, certificate fingerprints, reserved nicknames, and message history all
+move to the new name. The old name is released and can be registered by
+someone else. If you're using the old name as your nickname, you'll be renamed
+to the new one.`,
+			helpShort:     `$bRENAME$b changes the name of your account`,
+			enabled:       servCmdRequiresAuthEnabled,
+			minParams:     2,
+			modifiesState: true,
 		},
 	}
 )
@@ -375,6 +514,15 @@ func nsGetHandler(service *ircService, server *Server, client *Client, command s
 		return
 	}
 
+	if strings.ToLower(params[0]) == "email" {
+		if accountData.Email != "" {
+			service.Notice(rb, fmt.Sprintf(client.t("Your e-mail address is: %s"), accountData.Email))
+		} else {
+			service.Notice(rb, client.t("Your account has no e-mail address"))
+		}
+		return
+	}
+
 	displaySetting(service, params[0], accountData.Settings, client, rb)
 }
 
@@ -456,6 +604,47 @@ func displaySetting(service *ircService, settingName string, settings AccountSet
 		effectiveValue := historyEnabled(config.History.Persistent.DirectMessages, settings.DMHistory)
 		service.Notice(rb, fmt.Sprintf(client.t("Your stored direct message history setting is: %s"), historyStatusToString(settings.DMHistory)))
 		service.Notice(rb, fmt.Sprintf(client.t("Given current server settings, your direct message history setting is: %s"), historyStatusToString(effectiveValue)))
+	case "history":
+		service.Notice(rb, fmt.Sprintf(client.t("Your stored setting for the history of messages you send is: %s"), historyStatusToString(settings.AuthoredHistory)))
+		if !config.History.Retention.AllowChannelOptOut {
+			service.Notice(rb, client.t("Given current server settings, this setting only applies to direct messages"))
+		}
+	case "blocked-reports":
+		if settings.BlockedReportsDisabled {
+			service.Notice(rb, client.t("You will not receive reports of blocked direct messages"))
+		} else {
+			service.Notice(rb, client.t("You will receive reports of blocked direct messages"))
+		}
+	case "auto-join":
+		channels := config.Channels.AutoJoin
+		if settings.AutoJoin != nil {
+			channels = *settings.AutoJoin
+		} else {
+			service.Notice(rb, client.t("You are using the server default for automatically joined channels"))
+		}
+		if len(channels) == 0 {
+			service.Notice(rb, client.t("You will not be joined to any channels automatically"))
+		} else {
+			service.Notice(rb, fmt.Sprintf(client.t("You will be joined to these channels automatically: %s"), strings.Join(channels, ", ")))
+		}
+	case "hide-channels":
+		if settings.HideChannels {
+			service.Notice(rb, client.t("Your channels are hidden from users who aren't in them"))
+		} else {
+			service.Notice(rb, client.t("Your channels are visible in WHOIS and WHO"))
+		}
+	case "hide-idle":
+		if settings.HideIdle {
+			service.Notice(rb, client.t("Your idle time is hidden"))
+		} else {
+			service.Notice(rb, client.t("Your idle time is visible in WHOIS and WHO"))
+		}
+	case "hide-tls":
+		if settings.HideTLS {
+			service.Notice(rb, client.t("Your use of a secure connection is hidden"))
+		} else {
+			service.Notice(rb, client.t("Your use of a secure connection is visible in WHOIS"))
+		}
 
 	default:
 		service.Notice(rb, client.t("No such setting"))
@@ -478,6 +667,9 @@ func nsSetHandler(service *ircService, server *Server, client *Client, command s
 	case "pass", "password":
 		service.Notice(rb, client.t("To change a password, use the PASSWD command. For details, /msg NickServ HELP PASSWD"))
 		return
+	case "email":
+		nsSetEmail(service, server, client, command, account, params[1:], rb)
+		return
 	case "enforce":
 		var method NickEnforcementMethod
 		method, err = nickReservationFromString(params[1])
@@ -591,6 +783,54 @@ func nsSetHandler(service *ircService, server *Server, client *Client, command s
 				return
 			}
 		}
+	case "history":
+		var newValue HistoryStatus
+		newValue, err = historyStatusFromString(params[1])
+		if err == nil {
+			munger = func(in AccountSettings) (out AccountSettings, err error) {
+				out = in
+				out.AuthoredHistory = newValue
+				return
+			}
+		}
+	case "blocked-reports":
+		var newValue bool
+		newValue, err = utils.StringToBool(params[1])
+		if err == nil {
+			munger = func(in AccountSettings) (out AccountSettings, err error) {
+				out = in
+				out.BlockedReportsDisabled = !newValue
+				return
+			}
+		}
+	case "auto-join":
+		var newValue *[]string
+		newValue, err = parseAutoJoinSetting(server.Config(), params[1:])
+		if err == nil {
+			munger = func(in AccountSettings) (out AccountSettings, err error) {
+				out = in
+				out.AutoJoin = newValue
+				return
+			}
+		}
+	case "hide-channels", "hide-idle", "hide-tls":
+		var newValue bool
+		newValue, err = utils.StringToBool(params[1])
+		if err == nil {
+			setting := strings.ToLower(params[0])
+			munger = func(in AccountSettings) (out AccountSettings, err error) {
+				out = in
+				switch setting {
+				case "hide-channels":
+					out.HideChannels = newValue
+				case "hide-idle":
+					out.HideIdle = newValue
+				case "hide-tls":
+					out.HideTLS = newValue
+				}
+				return
+			}
+		}
 	default:
 		err = errInvalidParams
 	}
@@ -613,6 +853,36 @@ func nsSetHandler(service *ircService, server *Server, client *Client, command s
 	}
 }
 
+// parseAutoJoinSetting parses the value of NS SET AUTO-JOIN: nil is the server default
+func parseAutoJoinSetting(config *Config, params []string) (result *[]string, err error) {
+	value := strings.Join(params, ",")
+	switch strings.ToLower(value) {
+	case "default":
+		return nil, nil
+	case "none":
+		return &[]string{}, nil
+	}
+	var channels []string
+	seen := make(utils.StringSet)
+	for _, chname := range strings.Split(value, ",") {
+		if chname == "" {
+			continue
+		}
+		cfname, err := CasefoldChannel(chname)
+		if err != nil {
+			return nil, errInvalidParams
+		}
+		if !seen.Has(cfname) {
+			seen.Add(cfname)
+			channels = append(channels, chname)
+		}
+	}
+	if len(channels) == 0 || (config.Channels.MaxChannelsPerClient != 0 && config.Channels.MaxChannelsPerClient < len(channels)) {
+		return nil, errInvalidParams
+	}
+	return &channels, nil
+}
+
 func nsDropHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	sadrop := command == "sadrop"
 	var nick string
@@ -664,13 +934,51 @@ func nsGhostHandler(service *ircService, server *Server, client *Client, command
 	ghost.destroy(nil)
 }
 
+func nsRegainHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	nick := params[0]
+	cfnick, err := CasefoldName(nick)
+	skeleton, skelErr := Skeleton(nick)
+	if err != nil || skelErr != nil {
+		service.Notice(rb, client.t("Invalid nickname"))
+		return
+	}
+
+	account := client.Account()
+	squatter := server.clients.Get(nick)
+	if squatter == client {
+		service.Notice(rb, client.t("You're already using that nickname"))
+		return
+	} else if squatter != nil && squatter.AlwaysOn() {
+		service.Notice(rb, client.t("You can't GHOST an always-on client"))
+		return
+	}
+
+	// clients logged into the same account can always be displaced; anyone
+	// else only if the nick is reserved to the account and enforced
+	owner, method := server.accounts.EnforcementStatus(cfnick, skeleton)
+	if !(owner == account && method != NickEnforcementNone) && !(squatter != nil && squatter.Account() == account) {
+		service.Notice(rb, client.t("You don't own that nick"))
+		return
+	}
+
+	if squatter != nil {
+		if squatter.Account() == account {
+			squatter.Quit(fmt.Sprintf(squatter.t("GHOSTed by %s"), client.Nick()), nil)
+			squatter.destroy(nil)
+		} else {
+			server.RandomlyRename(squatter)
+		}
+	}
+	performNickChange(server, client, client, nil, nick, rb)
+}
+
 func nsGroupHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	nick := client.Nick()
 	err := server.accounts.SetNickReserved(client, nick, false, true)
 	if err == nil {
 		service.Notice(rb, fmt.Sprintf(client.t("Successfully grouped nick %s with your account"), nick))
 	} else if err == errAccountTooManyNicks {
-		service.Notice(rb, client.t("You have too many nicks reserved already (you can remove some with /NS DROP)"))
+		service.Notice(rb, fmt.Sprintf(client.t("You have too many nicks reserved already (the limit is %d; you can remove some with /NS UNGROUP)"), server.Config().Accounts.NickReservation.AdditionalNickLimit))
 	} else if err == errNicknameReserved {
 		service.Notice(rb, client.t("That nickname is already reserved by someone else"))
 	} else {
@@ -813,6 +1121,45 @@ func nsInfoHandler(service *ircService, server *Server, client *Client, command
 	}
 }
 
+func nsSetEmail(service *ircService, server *Server, client *Client, command, account string, params []string, rb *ResponseBuffer) {
+	address, err := parseEmail(params[0])
+	if err != nil {
+		service.Notice(rb, client.t("Invalid e-mail address"))
+		return
+	}
+	if command == "saset" {
+		// opers can change the address directly
+		err = server.accounts.SetEmail(client, account, address)
+	} else if len(params) > 1 {
+		err = server.accounts.ConfirmEmailChange(client, account, address, params[1])
+	} else {
+		err = server.accounts.RequestEmailChange(client, account, address)
+		if err == nil {
+			service.Notice(rb, fmt.Sprintf(client.t("A confirmation code has been sent to %s. To complete the change, use: /MSG %s SET EMAIL %s <code>"), address, service.Name, address))
+			return
+		}
+	}
+
+	switch err {
+	case nil:
+		service.Notice(rb, fmt.Sprintf(client.t("Successfully changed the e-mail address to %s"), address))
+	case errValidEmailRequired:
+		service.Notice(rb, client.t("Invalid e-mail address"))
+	case errFeatureDisabled:
+		service.Notice(rb, client.t("E-mail verification is disabled on this server"))
+	case errNoop:
+		service.Notice(rb, client.t("That is already the account's e-mail address"))
+	case errAccountVerificationInvalidCode:
+		service.Notice(rb, client.t("Invalid or expired confirmation code"))
+	case errLimitExceeded:
+		service.Notice(rb, client.t("A confirmation code was sent recently; please check your e-mail or try again later"))
+	case errCallbackFailed, errAccountDoesNotExist, errAccountUnverified:
+		service.Notice(rb, client.t(err.Error()))
+	default:
+		service.Notice(rb, client.t("An error occurred"))
+	}
+}
+
 func nsRegisterHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	details := client.Details()
 	passphrase := params[0]
@@ -901,6 +1248,10 @@ func nsSaregisterHandler(service *ircService, server *Server, client *Client, co
 	} else {
 		service.Notice(rb, fmt.Sprintf(client.t("Successfully registered account %s"), account))
 		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Operator $c[grey][$r%s$c[grey]] registered account $c[grey][$r%s$c[grey]] with SAREGISTER"), client.Oper().Name, account))
+		server.webhooks.Send(WebhookAccountRegister, webhookData{
+			"account": account,
+			"oper":    client.Oper().Name,
+		})
 	}
 }
 
@@ -1057,6 +1408,52 @@ func nsPasswdHandler(service *ircService, server *Server, client *Client, comman
 	}
 }
 
+func nsSendpassHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	if !nsLoginThrottleCheck(service, client, rb) {
+		return
+	}
+
+	account := params[0]
+	err := server.accounts.SendPasswordReset(client, account)
+	// don't reveal whether the account exists, or anything about its e-mail:
+	switch err {
+	case nil:
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] requested a password reset for account $c[grey][$r%s$c[grey]]"), client.NickMaskString(), account))
+	case errAccountDoesNotExist, errAccountUnverified, errAccountNoEmail, errLimitExceeded:
+	case errCallbackFailed:
+		server.logger.Error("internal", "couldn't send password reset e-mail for", account)
+	default:
+		service.Notice(rb, client.t("An error occurred"))
+		return
+	}
+	service.Notice(rb, client.t("If that account has a verified e-mail address, a password reset code was sent to it"))
+}
+
+func nsResetpassHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	if !nsLoginThrottleCheck(service, client, rb) {
+		return
+	}
+
+	account, code, newPassword := params[0], params[1], params[2]
+	err := server.accounts.ResetPassword(account, code, newPassword)
+	switch err {
+	case nil:
+		service.Notice(rb, client.t("Password changed"))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] reset the password of account $c[grey][$r%s$c[grey]]"), client.NickMaskString(), account))
+	case errAccountVerificationInvalidCode:
+		service.Notice(rb, client.t("Invalid or expired reset code"))
+	case errAccountBadPassphrase:
+		service.Notice(rb, client.t("Passphrase contains forbidden characters or is otherwise invalid"))
+	case errAccountDoesNotExist:
+		service.Notice(rb, client.t(err.Error()))
+	case errCredsExternallyManaged:
+		service.Notice(rb, client.t("Your account credentials are managed externally and cannot be changed here"))
+	default:
+		server.logger.Error("internal", "could not reset user password:", err.Error())
+		service.Notice(rb, client.t("Password could not be changed due to server error"))
+	}
+}
+
 func nsEnforceHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	newParams := []string{"enforce"}
 	if len(params) == 0 {
@@ -1090,7 +1487,7 @@ func nsClientsHandler(service *ircService, server *Server, client *Client, comma
 
 func nsClientsListHandler(service *ircService, server *Server, client *Client, params []string, rb *ResponseBuffer) {
 	target := client
-	hasPrivs := client.HasRoleCapabs("local_ban")
+	hasPrivs := client.HasRoleCapabs("view-ips")
 	if 0 < len(params) {
 		target = server.clients.Get(params[0])
 		if target == nil {
@@ -1114,6 +1511,9 @@ func nsClientsListHandler(service *ircService, server *Server, client *Client, p
 		if session.deviceID != "" {
 			service.Notice(rb, fmt.Sprintf(client.t("Device ID:   %s"), session.deviceID))
 		}
+		if session.label != "" {
+			service.Notice(rb, fmt.Sprintf(client.t("Label:       %s"), session.label))
+		}
 		service.Notice(rb, fmt.Sprintf(client.t("IP address:  %s"), session.ip.String()))
 		service.Notice(rb, fmt.Sprintf(client.t("Hostname:    %s"), session.hostname))
 		if hasPrivs {
@@ -1141,10 +1541,9 @@ func nsClientsLogoutHandler(service *ircService, server *Server, client *Client,
 			service.Notice(rb, client.t("No such nick"))
 			return
 		}
-		// User must have "local_kill" privileges to logout other user sessions.
+		// User must have "kill" privileges to logout other user sessions.
 		if target != client {
-			oper := client.Oper()
-			if oper == nil || !oper.Class.Capabilities.Has("local_kill") {
+			if !client.HasRoleCapabs("kill") {
 				service.Notice(rb, client.t("Insufficient oper privs"))
 				return
 			}
@@ -1237,6 +1636,12 @@ func nsCertHandler(service *ircService, server *Server, client *Client, command
 			service.Notice(rb, fmt.Sprintf("%d: %s", i+1, certfp))
 		}
 		return
+	}
+
+	if serviceReadOnly(service, server, client, rb) {
+		return
+	}
+	switch verb {
 	case "add":
 		err = server.accounts.addRemoveCertfp(target, certfp, true, hasPrivs)
 	case "del":
@@ -1247,8 +1652,10 @@ func nsCertHandler(service *ircService, server *Server, client *Client, command
 	case nil:
 		if verb == "add" {
 			service.Notice(rb, client.t("Certificate fingerprint successfully added"))
+			server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] added a certificate fingerprint to account $c[grey][$r%s$c[grey]]"), client.NickMaskString(), target))
 		} else {
 			service.Notice(rb, client.t("Certificate fingerprint successfully removed"))
+			server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] removed a certificate fingerprint from account $c[grey][$r%s$c[grey]]"), client.NickMaskString(), target))
 		}
 	case errNoop:
 		if verb == "add" {
@@ -1259,7 +1666,7 @@ func nsCertHandler(service *ircService, server *Server, client *Client, command
 	case errAccountDoesNotExist:
 		service.Notice(rb, client.t("Account does not exist"))
 	case errLimitExceeded:
-		service.Notice(rb, client.t("You already have too many certificate fingerprints"))
+		service.Notice(rb, fmt.Sprintf(client.t("You already have too many certificate fingerprints (the limit is %d)"), server.Config().Accounts.MaxCertfps))
 	case utils.ErrInvalidCertfp:
 		service.Notice(rb, client.t("Invalid certificate fingerprint"))
 	case errCertfpAlreadyExists:
@@ -1280,6 +1687,12 @@ func nsSuspendHandler(service *ircService, server *Server, client *Client, comma
 	subCmd := strings.ToLower(params[0])
 	params = params[1:]
 	switch subCmd {
+	case "add", "del", "delete", "remove":
+		if serviceReadOnly(service, server, client, rb) {
+			return
+		}
+	}
+	switch subCmd {
 	case "add":
 		nsSuspendAddHandler(service, server, client, command, params, rb)
 	case "del", "delete", "remove":
@@ -1291,6 +1704,55 @@ func nsSuspendHandler(service *ircService, server *Server, client *Client, comma
 	}
 }
 
+func nsProtectHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	accountData, err := server.accounts.LoadAccount(params[0])
+	if err == errAccountDoesNotExist {
+		service.Notice(rb, client.t("No such account"))
+		return
+	} else if err != nil {
+		service.Notice(rb, client.t("An error occurred"))
+		return
+	}
+	account := accountData.Name
+
+	if len(params) == 1 {
+		if accountData.Settings.Protected {
+			service.Notice(rb, fmt.Sprintf(client.t("Account %s is protected"), account))
+		} else {
+			service.Notice(rb, fmt.Sprintf(client.t("Account %s is not protected"), account))
+		}
+		return
+	}
+
+	protected, err := utils.StringToBool(params[1])
+	if err != nil {
+		service.Notice(rb, client.t("Invalid parameters"))
+		return
+	}
+	if serviceReadOnly(service, server, client, rb) {
+		return
+	}
+	_, err = server.accounts.ModifyAccountSettings(account, func(in AccountSettings) (out AccountSettings, err error) {
+		out = in
+		out.Protected = protected
+		return
+	})
+	if err != nil {
+		service.Notice(rb, client.t("An error occurred"))
+		return
+	}
+
+	operName := client.Oper().Name
+	if protected {
+		service.Notice(rb, fmt.Sprintf(client.t("Account %s is now protected"), account))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s [%s]$r protected account $c[grey][$r%s$c[grey]]"), client.Nick(), operName, account))
+	} else {
+		service.Notice(rb, fmt.Sprintf(client.t("Account %s is no longer protected"), account))
+		server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("%s [%s]$r unprotected account $c[grey][$r%s$c[grey]]"), client.Nick(), operName, account))
+	}
+	server.logger.Info("opers", "protection of account", account, "set to", strconv.FormatBool(protected), "by oper", operName)
+}
+
 func nsSuspendAddHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
 	if len(params) == 0 {
 		service.Notice(rb, client.t("Invalid parameters"))
@@ -1378,22 +1840,100 @@ func suspensionToString(client *Client, suspension AccountSuspension) (result st
 	return fmt.Sprintf(client.t("Account %[1]s suspended at %[2]s. Duration: %[3]s. %[4]s"), suspension.AccountName, ts, duration, reason)
 }
 
-func nsRenameHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
-	oldName, newName := params[0], params[1]
-	err := server.accounts.Rename(oldName, newName)
+func nsMergeHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	sourceName, targetName := params[0], params[1]
 
-	if err != nil {
-		service.Notice(rb, fmt.Sprintf(client.t("Couldn't rename account: %s"), client.t(err.Error())))
+	if !client.HasRoleCapabs("accreg") {
+		if len(params) < 4 {
+			service.Notice(rb, client.t("You must supply the passwords of both accounts"))
+			return
+		}
+		if !nsLoginThrottleCheck(service, client, rb) {
+			return
+		}
+		for i, accountName := range []string{sourceName, targetName} {
+			if _, err := server.accounts.checkPassphrase(accountName, params[i+2]); err != nil {
+				service.Notice(rb, fmt.Sprintf(client.t("Couldn't merge accounts: %s"), client.t(err.Error())))
+				return
+			}
+		}
+	}
+
+	source, err := server.accounts.LoadAccount(sourceName)
+	if err == nil {
+		var target ClientAccount
+		target, err = server.accounts.LoadAccount(targetName)
+		sourceName, targetName = source.Name, target.Name
+	}
+	if err == nil {
+		err = server.accounts.Merge(sourceName, targetName)
+	}
+	switch err {
+	case nil:
+	case errAccountDoesNotExist, errAccountUnverified, errNoop:
+		service.Notice(rb, fmt.Sprintf(client.t("Couldn't merge accounts: %s"), client.t(err.Error())))
+		return
+	default:
+		server.logger.Error("internal", "couldn't merge accounts", sourceName, targetName, err.Error())
+		service.Notice(rb, client.t("Couldn't merge accounts: an error occurred"))
 		return
 	}
 
-	service.Notice(rb, client.t("Successfully renamed account"))
+	service.Notice(rb, fmt.Sprintf(client.t("Successfully merged account %[1]s into %[2]s"), sourceName, targetName))
+	server.logger.Info("accounts", "client", client.Nick(), "merged account", sourceName, "into", targetName)
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] merged account $c[grey][$r%s$c[grey]] into $c[grey][$r%s$c[grey]]"), client.NickMaskString(), sourceName, targetName))
+
 	if server.Config().Accounts.NickReservation.ForceNickEqualsAccount {
-		if curClient := server.clients.Get(oldName); curClient != nil {
-			renameErr := performNickChange(client.server, client, curClient, nil, newName, rb)
+		for _, curClient := range server.accounts.AccountToClients(targetName) {
+			renameErr := performNickChange(server, client, curClient, nil, targetName, rb)
 			if renameErr != nil && renameErr != errNoop {
-				service.Notice(rb, fmt.Sprintf(client.t("Warning: could not rename affected client: %v"), err))
+				service.Notice(rb, fmt.Sprintf(client.t("Warning: could not rename affected client %[1]s: %[2]s"), curClient.Nick(), client.t(renameErr.Error())))
 			}
 		}
 	}
 }
+
+func nsRenameHandler(service *ircService, server *Server, client *Client, command string, params []string, rb *ResponseBuffer) {
+	oldName, newName := params[0], params[1]
+	account, err := server.accounts.LoadAccount(oldName)
+	if err != nil {
+		service.Notice(rb, client.t("Invalid account name"))
+		return
+	}
+	oldName = account.Name
+
+	if !(oldName == client.AccountName() || client.HasRoleCapabs("accreg")) {
+		service.Notice(rb, client.t("Insufficient oper privs"))
+		return
+	}
+
+	err = server.accounts.Rename(oldName, newName)
+	switch err {
+	case nil:
+	case errAccountAlreadyRegistered, errConfusableIdentifier, errNicknameInvalid, errNoop, errAccountUnverified:
+		service.Notice(rb, fmt.Sprintf(client.t("Couldn't rename account: %s"), client.t(err.Error())))
+		return
+	default:
+		server.logger.Error("internal", "couldn't rename account", oldName, newName, err.Error())
+		service.Notice(rb, client.t("Couldn't rename account: an error occurred"))
+		return
+	}
+
+	service.Notice(rb, fmt.Sprintf(client.t("Successfully renamed account %[1]s to %[2]s"), oldName, newName))
+	server.logger.Info("accounts", "client", client.Nick(), "renamed account", oldName, "to", newName)
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] renamed account $c[grey][$r%s$c[grey]] to $c[grey][$r%s$c[grey]]"), client.NickMaskString(), oldName, newName))
+
+	// clients using the old account name as their nickname take the new one
+	// (always-on clients must do so to keep their nickname equal to the account name):
+	oldCfName := account.NameCasefolded
+	forceNick := server.Config().Accounts.NickReservation.ForceNickEqualsAccount
+	for _, curClient := range server.accounts.AccountToClients(newName) {
+		if !(forceNick || curClient.AlwaysOn() || curClient.NickCasefolded() == oldCfName) {
+			continue
+		}
+		renameErr := performNickChange(server, client, curClient, nil, newName, rb)
+		if renameErr != nil && renameErr != errNoop {
+			service.Notice(rb, fmt.Sprintf(client.t("Warning: could not rename affected client %[1]s: %[2]s"), curClient.Nick(), client.t(renameErr.Error())))
+		}
+	}
+}
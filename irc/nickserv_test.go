@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestParseAutoJoinSetting(t *testing.T) {
+	config := &Config{}
+	config.Channels.MaxChannelsPerClient = 3
+
+	result, err := parseAutoJoinSetting(config, []string{"#chat,#help", "#Chat", "#dev"})
+	assertEqual(err, nil, t)
+	assertEqual(*result, []string{"#chat", "#help", "#dev"}, t)
+
+	result, err = parseAutoJoinSetting(config, []string{"none"})
+	assertEqual(err, nil, t)
+	assertEqual(*result, []string{}, t)
+
+	result, err = parseAutoJoinSetting(config, []string{"DEFAULT"})
+	assertEqual(err, nil, t)
+	assertEqual(result == nil, true, t)
+
+	_, err = parseAutoJoinSetting(config, []string{"chat"})
+	assertEqual(err, errInvalidParams, t)
+	_, err = parseAutoJoinSetting(config, []string{"#a,#b,#c,#d"})
+	assertEqual(err, errInvalidParams, t)
+	_, err = parseAutoJoinSetting(config, []string{","})
+	assertEqual(err, errInvalidParams, t)
+}
+
+func TestAutoJoinChannels(t *testing.T) {
+	server := newTestServer()
+	config := server.Config()
+	config.Channels.AutoJoin = []string{"#lobby"}
+	client := newTestClient(server, "alice")
+
+	assertEqual(client.autoJoinChannels(config), []string{"#lobby"}, t)
+	client.accountSettings.AutoJoin = &[]string{}
+	assertEqual(client.autoJoinChannels(config), []string{}, t)
+	client.accountSettings.AutoJoin = &[]string{"#chat"}
+	assertEqual(client.autoJoinChannels(config), []string{"#chat"}, t)
+}
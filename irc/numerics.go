@@ -52,6 +52,8 @@ const (
 	RPL_TRYAGAIN                  = "263"
 	RPL_LOCALUSERS                = "265"
 	RPL_GLOBALUSERS               = "266"
+	RPL_SILELIST                  = "271"
+	RPL_ENDOFSILELIST             = "272"
 	RPL_WHOISCERTFP               = "276"
 	RPL_AWAY                      = "301"
 	RPL_USERHOST                  = "302"
@@ -66,6 +68,7 @@ const (
 	RPL_WHOISIDLE                 = "317"
 	RPL_ENDOFWHOIS                = "318"
 	RPL_WHOISCHANNELS             = "319"
+	RPL_WHOISSPECIAL              = "320"
 	RPL_LIST                      = "322"
 	RPL_LISTEND                   = "323"
 	RPL_CHANNELMODEIS             = "324"
@@ -133,6 +136,7 @@ const (
 	ERR_NICKNAMEINUSE             = "433"
 	ERR_NICKCOLLISION             = "436"
 	ERR_UNAVAILRESOURCE           = "437"
+	ERR_NICKTOOFAST               = "438"
 	ERR_REG_UNAVAILABLE           = "440"
 	ERR_USERNOTINCHANNEL          = "441"
 	ERR_NOTONCHANNEL              = "442"
@@ -140,6 +144,7 @@ const (
 	ERR_NOLOGIN                   = "444"
 	ERR_SUMMONDISABLED            = "445"
 	ERR_USERSDISABLED             = "446"
+	ERR_NONICKCHANGE              = "447"
 	ERR_NOTREGISTERED             = "451"
 	ERR_NEEDMOREPARAMS            = "461"
 	ERR_ALREADYREGISTRED          = "462"
@@ -165,6 +170,7 @@ const (
 	ERR_NOOPERHOST                = "491"
 	ERR_UMODEUNKNOWNFLAG          = "501"
 	ERR_USERSDONTMATCH            = "502"
+	ERR_SILELISTFULL              = "511"
 	ERR_HELPNOTFOUND              = "524"
 	ERR_CANNOTSENDRP              = "573"
 	RPL_WHOISSECURE               = "671"
@@ -181,6 +187,8 @@ const (
 	RPL_MONLIST                   = "732"
 	RPL_ENDOFMONLIST              = "733"
 	ERR_MONLISTFULL               = "734"
+	RPL_RSACHALLENGE2             = "740"
+	RPL_ENDOFRSACHALLENGE2        = "741"
 	RPL_LOGGEDIN                  = "900"
 	RPL_LOGGEDOUT                 = "901"
 	ERR_NICKLOCKED                = "902"
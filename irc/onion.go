@@ -0,0 +1,352 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/buntdb"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+const (
+	defaultTorControlAddress = "127.0.0.1:9051"
+	// timeout for each exchange with the control port
+	torControlTimeout = 30 * time.Second
+	// how long to wait before retrying after failing to publish, or after
+	// losing the connection to Tor (e.g., because it was restarted)
+	onionRetryInterval = time.Minute
+)
+
+var (
+	errNoTorAuthMethod = errors.New("Tor's control port offers no supported authentication method; set control-password")
+)
+
+// prepare validates the onion service config and determines which address
+// Tor should forward connections to.
+func (conf *OnionServiceConfig) prepare(listeners map[string]utils.ListenerConfig) (err error) {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.ControlAddress == "" {
+		conf.ControlAddress = defaultTorControlAddress
+	}
+	if conf.Port == 0 {
+		conf.Port = 6667
+	} else if conf.Port < 1 || 65535 < conf.Port {
+		return fmt.Errorf("invalid onion-service port %d", conf.Port)
+	}
+
+	if conf.Listener == "" {
+		// default to the only Tor listener
+		for addr, lconf := range listeners {
+			if lconf.Tor {
+				if conf.Listener != "" {
+					return errors.New("there are multiple Tor listeners; set onion-service.listener to choose one")
+				}
+				conf.Listener = addr
+			}
+		}
+	}
+	if lconf, ok := listeners[conf.Listener]; !ok || !lconf.Tor {
+		return fmt.Errorf("onion-service.listener must be a listener with tor: true, not `%s`", conf.Listener)
+	}
+
+	addr := strings.TrimPrefix(conf.Listener, "unix:")
+	if strings.HasPrefix(addr, "/") {
+		conf.target = "unix:" + addr
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid Tor listener address %s: %v", conf.Listener, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	conf.target = net.JoinHostPort(host, port)
+	return nil
+}
+
+// OnionService publishes a Tor listener as a v3 onion service, via ADD_ONION
+// on Tor's control port. The service only exists for as long as the control
+// connection that created it stays open, so the connection is held open (and
+// reestablished if Tor restarts) until the service is disabled. The service's
+// private key is kept in the datastore, so its address is stable.
+type OnionService struct {
+	sync.Mutex // tier 1
+
+	server *Server
+	config OnionServiceConfig
+	stop   chan struct{}
+}
+
+func (svc *OnionService) Initialize(server *Server) {
+	svc.server = server
+}
+
+// Apply publishes, republishes, or withdraws the service after a config change.
+func (svc *OnionService) Apply(config *Config) {
+	conf := config.Server.TorListeners.OnionService
+
+	svc.Lock()
+	defer svc.Unlock()
+
+	if conf == svc.config {
+		return
+	}
+	if svc.stop != nil {
+		close(svc.stop)
+		svc.stop = nil
+	}
+	svc.config = conf
+	if conf.Enabled {
+		svc.stop = make(chan struct{})
+		go svc.run(conf, svc.stop)
+	}
+}
+
+func (svc *OnionService) run(conf OnionServiceConfig, stop chan struct{}) {
+	for {
+		conn, err := svc.publish(conf)
+		if err != nil {
+			svc.server.logger.Error("tor", "Couldn't publish onion service", err.Error())
+		} else {
+			closed := make(chan struct{})
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				close(closed)
+			}()
+			select {
+			case <-stop:
+				conn.Close()
+				return
+			case <-closed:
+				svc.server.logger.Warning("tor", "Lost connection to Tor's control port; the onion service will be republished")
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(onionRetryInterval):
+		}
+	}
+}
+
+// publish creates the onion service, returning the control connection that
+// keeps it alive.
+func (svc *OnionService) publish(conf OnionServiceConfig) (conn net.Conn, err error) {
+	if strings.HasPrefix(conf.ControlAddress, "/") || strings.HasPrefix(conf.ControlAddress, "unix:") {
+		conn, err = net.DialTimeout("unix", strings.TrimPrefix(conf.ControlAddress, "unix:"), torControlTimeout)
+	} else {
+		conn, err = net.DialTimeout("tcp", conf.ControlAddress, torControlTimeout)
+	}
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			conn.Close()
+			conn = nil
+		}
+	}()
+
+	tc := torControlConn{conn: conn, reader: bufio.NewReader(conn)}
+	if err = tc.authenticate(conf.ControlPassword); err != nil {
+		return
+	}
+	key := LoadOnionServiceKey(svc.server.store)
+	serviceID, newKey, err := tc.addOnion(key, conf.Port, conf.target)
+	if err != nil {
+		return
+	}
+	if newKey != "" {
+		if err = StoreOnionServiceKey(svc.server.store, newKey); err != nil {
+			return
+		}
+	}
+	svc.server.logger.Info("tor", "Published onion service", fmt.Sprintf("%s.onion:%d", serviceID, conf.Port), "for listener", conf.Listener)
+	return
+}
+
+// LoadOnionServiceKey returns the onion service's private key, in the
+// format used by ADD_ONION, or "" if none has been generated yet.
+func LoadOnionServiceKey(db *buntdb.DB) (key string) {
+	db.View(func(tx *buntdb.Tx) error {
+		key, _ = tx.Get(keyOnionServiceKey)
+		return nil
+	})
+	return
+}
+
+func StoreOnionServiceKey(db *buntdb.DB, key string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(keyOnionServiceKey, key, nil)
+		return err
+	})
+}
+
+// torControlConn speaks the Tor control protocol:
+// https://gitweb.torproject.org/torspec.git/tree/control-spec.txt
+type torControlConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// command sends a command and returns the lines of a successful reply,
+// without their status codes.
+func (tc *torControlConn) command(line string) (reply []string, err error) {
+	tc.conn.SetDeadline(time.Now().Add(torControlTimeout))
+	defer tc.conn.SetDeadline(time.Time{})
+
+	if _, err = io.WriteString(tc.conn, line+"\r\n"); err != nil {
+		return
+	}
+	for {
+		replyLine, err := tc.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(replyLine) < 4 {
+			return nil, fmt.Errorf("malformed reply from Tor: %q", replyLine)
+		}
+		status, separator, text := replyLine[:3], replyLine[3], replyLine[4:]
+		if status != "250" {
+			// don't include the command, which may contain a password
+			return nil, fmt.Errorf("Tor rejected the command: %s %s", status, text)
+		}
+		reply = append(reply, text)
+		switch separator {
+		case ' ':
+			return reply, nil
+		case '+':
+			// a data block follows, terminated by a line containing only "."
+			for {
+				data, err := tc.readLine()
+				if err != nil {
+					return nil, err
+				}
+				if data == "." {
+					break
+				}
+				reply = append(reply, strings.TrimPrefix(data, "."))
+			}
+		}
+	}
+}
+
+func (tc *torControlConn) readLine() (line string, err error) {
+	line, err = tc.reader.ReadString('\n')
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (tc *torControlConn) authenticate(password string) (err error) {
+	reply, err := tc.command("PROTOCOLINFO 1")
+	if err != nil {
+		return
+	}
+	var methods []string
+	var cookieFile string
+	for _, line := range reply {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if strings.HasPrefix(field, "METHODS=") {
+				methods = strings.Split(strings.TrimPrefix(field, "METHODS="), ",")
+			}
+		}
+		if idx := strings.Index(line, "COOKIEFILE="); idx != -1 {
+			cookieFile, _ = unquoteTorString(line[idx+len("COOKIEFILE="):])
+		}
+	}
+
+	hasMethod := func(method string) bool {
+		for _, m := range methods {
+			if m == method {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case password != "":
+		_, err = tc.command("AUTHENTICATE " + quoteTorString(password))
+	case hasMethod("NULL"):
+		_, err = tc.command("AUTHENTICATE")
+	case hasMethod("COOKIE") && cookieFile != "":
+		var cookie []byte
+		cookie, err = ioutil.ReadFile(cookieFile)
+		if err == nil {
+			_, err = tc.command("AUTHENTICATE " + hex.EncodeToString(cookie))
+		}
+	default:
+		err = errNoTorAuthMethod
+	}
+	return
+}
+
+// addOnion creates an onion service from an existing key, or from a new key,
+// which is then returned.
+func (tc *torControlConn) addOnion(key string, port int, target string) (serviceID, newKey string, err error) {
+	keyArg, flags := key, " Flags=DiscardPK"
+	if key == "" {
+		keyArg, flags = "NEW:ED25519-V3", ""
+	}
+	reply, err := tc.command(fmt.Sprintf("ADD_ONION %s%s Port=%d,%s", keyArg, flags, port, target))
+	if err != nil {
+		return
+	}
+	for _, line := range reply {
+		if strings.HasPrefix(line, "ServiceID=") {
+			serviceID = strings.TrimPrefix(line, "ServiceID=")
+		} else if strings.HasPrefix(line, "PrivateKey=") {
+			newKey = strings.TrimPrefix(line, "PrivateKey=")
+		}
+	}
+	if serviceID == "" || (key == "" && newKey == "") {
+		err = errors.New("incomplete ADD_ONION reply from Tor")
+	}
+	return
+}
+
+func quoteTorString(str string) string {
+	str = strings.Replace(str, `\`, `\\`, -1)
+	str = strings.Replace(str, `"`, `\"`, -1)
+	return `"` + str + `"`
+}
+
+// unquoteTorString parses a QuotedString at the start of `str`
+func unquoteTorString(str string) (result string, ok bool) {
+	if !strings.HasPrefix(str, `"`) {
+		return
+	}
+	var buf strings.Builder
+	for i := 1; i < len(str); i++ {
+		switch str[i] {
+		case '\\':
+			i++
+			if i < len(str) {
+				buf.WriteByte(str[i])
+			}
+		case '"':
+			return buf.String(), true
+		default:
+			buf.WriteByte(str[i])
+		}
+	}
+	return
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/buntdb"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+func TestOnionServiceConfig(t *testing.T) {
+	listeners := map[string]utils.ListenerConfig{
+		":6697":                    {},
+		"/hidden_service/oragono":  {Tor: true},
+		"unix:/hidden_service/alt": {Tor: true},
+		":6668":                    {Tor: true},
+	}
+	targets := map[string]string{
+		"/hidden_service/oragono":  "unix:/hidden_service/oragono",
+		"unix:/hidden_service/alt": "unix:/hidden_service/alt",
+		":6668":                    "127.0.0.1:6668",
+	}
+	for listener, target := range targets {
+		conf := OnionServiceConfig{Enabled: true, Listener: listener}
+		if err := conf.prepare(listeners); err != nil {
+			t.Fatal(err)
+		}
+		assertEqual(conf.target, target, t)
+		assertEqual(conf.Port, 6667, t)
+		assertEqual(conf.ControlAddress, defaultTorControlAddress, t)
+	}
+
+	for _, listener := range []string{"", ":6697", ":1234"} {
+		conf := OnionServiceConfig{Enabled: true, Listener: listener}
+		if conf.prepare(listeners) == nil {
+			t.Errorf("listener `%s` should have been rejected", listener)
+		}
+	}
+
+	// with a single Tor listener, it's chosen by default:
+	conf := OnionServiceConfig{Enabled: true}
+	if err := conf.prepare(map[string]utils.ListenerConfig{"127.0.0.2:6668": {Tor: true}}); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(conf.target, "127.0.0.2:6668", t)
+}
+
+// fakeTorControl serves one control connection, requiring a password
+func fakeTorControl(listener net.Listener, commands chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		commands <- line
+		switch {
+		case line == "PROTOCOLINFO 1":
+			fmt.Fprint(conn, "250-PROTOCOLINFO 1\r\n250-AUTH METHODS=HASHEDPASSWORD\r\n250-VERSION Tor=\"0.4.5.7\"\r\n250 OK\r\n")
+		case line == `AUTHENTICATE "pass\"word"`:
+			fmt.Fprint(conn, "250 OK\r\n")
+		case strings.HasPrefix(line, "AUTHENTICATE"):
+			fmt.Fprint(conn, "515 Authentication failed\r\n")
+		case strings.HasPrefix(line, "ADD_ONION NEW:ED25519-V3 "):
+			fmt.Fprint(conn, "250-ServiceID=abcdefg\r\n250-PrivateKey=ED25519-V3:c2VjcmV0\r\n250 OK\r\n")
+		case strings.HasPrefix(line, "ADD_ONION ED25519-V3:c2VjcmV0 "):
+			fmt.Fprint(conn, "250-ServiceID=abcdefg\r\n250 OK\r\n")
+		default:
+			fmt.Fprint(conn, "510 Unrecognized command\r\n")
+		}
+	}
+}
+
+func TestOnionServicePublish(t *testing.T) {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	server := newTestServer()
+	server.store = store
+	svc := OnionService{server: server}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conf := OnionServiceConfig{
+		Enabled:         true,
+		ControlAddress:  listener.Addr().String(),
+		ControlPassword: `pass"word`,
+		Listener:        "/hidden_service/oragono",
+	}
+	if err := conf.prepare(map[string]utils.ListenerConfig{conf.Listener: {Tor: true}}); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := make(chan string, 16)
+	go fakeTorControl(listener, commands)
+	conn, err := svc.publish(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	assertEqual(<-commands, "PROTOCOLINFO 1", t)
+	assertEqual(<-commands, `AUTHENTICATE "pass\"word"`, t)
+	assertEqual(<-commands, "ADD_ONION NEW:ED25519-V3 Port=6667,unix:/hidden_service/oragono", t)
+	assertEqual(LoadOnionServiceKey(store), "ED25519-V3:c2VjcmV0", t)
+
+	// the stored key is reused, so the address doesn't change:
+	go fakeTorControl(listener, commands)
+	conn, err = svc.publish(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-commands
+	<-commands
+	assertEqual(<-commands, "ADD_ONION ED25519-V3:c2VjcmV0 Flags=DiscardPK Port=6667,unix:/hidden_service/oragono", t)
+
+	// authentication failures are reported:
+	conf.ControlPassword = "wrong"
+	go fakeTorControl(listener, commands)
+	if _, err = svc.publish(conf); err == nil {
+		t.Errorf("publishing with the wrong password should fail")
+	}
+}
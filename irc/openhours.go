@@ -0,0 +1,264 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidOpenHours = errors.New("Invalid open hours specification")
+
+	weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+	// OpenHours values are deserialized from channel settings, so timezones
+	// are cached by name rather than on the OpenHours itself
+	openHoursLocationsMutex sync.Mutex
+	openHoursLocations      = make(map[string]*time.Location)
+)
+
+const allWeekdays = 1<<7 - 1
+
+// OpenWindow is a recurring window of time during which a channel can be joined.
+// If End <= Start, the window runs past midnight into the following day.
+type OpenWindow struct {
+	Days  uint8 // bitmask indexed by time.Weekday
+	Start int   // minutes after midnight
+	End   int
+}
+
+// OpenHours restricts joins to a registered channel to scheduled windows
+// (CS SET OPENHOURS). The zero value places no restriction on joins.
+type OpenHours struct {
+	Windows  []OpenWindow `json:",omitempty"`
+	Timezone string       `json:",omitempty"`
+}
+
+// channelClosedError is returned when a join is attempted outside a channel's
+// open hours; it records when the channel will next open.
+type channelClosedError struct {
+	nextOpen time.Time
+}
+
+func (err *channelClosedError) Error() string {
+	return "Channel is closed"
+}
+
+// ParseOpenHours parses a specification like `mon-fri/18:00-22:00 sat/10:00-02:00 Europe/Berlin`:
+// a list of day ranges with time ranges, optionally followed by a timezone.
+// The specification `off` removes all restrictions.
+func ParseOpenHours(spec string) (result OpenHours, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 {
+		return result, errInvalidOpenHours
+	}
+	if len(fields) == 1 && strings.ToLower(fields[0]) == "off" {
+		return
+	}
+	for i, field := range fields {
+		if i == len(fields)-1 && !strings.Contains(field, ":") {
+			if _, err := loadOpenHoursLocation(field); err != nil {
+				return result, errInvalidOpenHours
+			}
+			result.Timezone = field
+			break
+		}
+		window, err := parseOpenWindow(field)
+		if err != nil {
+			return result, err
+		}
+		result.Windows = append(result.Windows, window)
+	}
+	if len(result.Windows) == 0 {
+		return result, errInvalidOpenHours
+	}
+	return
+}
+
+func parseOpenWindow(field string) (window OpenWindow, err error) {
+	dayStr, timeStr := "daily", field
+	if slash := strings.IndexByte(field, '/'); slash != -1 {
+		dayStr, timeStr = field[:slash], field[slash+1:]
+	}
+	if window.Days, err = parseWeekdays(dayStr); err != nil {
+		return
+	}
+	times := strings.Split(timeStr, "-")
+	if len(times) != 2 {
+		return window, errInvalidOpenHours
+	}
+	if window.Start, err = parseClockTime(times[0]); err != nil {
+		return
+	}
+	window.End, err = parseClockTime(times[1])
+	return
+}
+
+func parseWeekdays(str string) (days uint8, err error) {
+	str = strings.ToLower(str)
+	if str == "daily" {
+		return allWeekdays, nil
+	}
+	for _, dayRange := range strings.Split(str, ",") {
+		bounds := strings.Split(dayRange, "-")
+		if len(bounds) > 2 {
+			return 0, errInvalidOpenHours
+		}
+		start, ok := parseWeekday(bounds[0])
+		if !ok {
+			return 0, errInvalidOpenHours
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, ok = parseWeekday(bounds[1]); !ok {
+				return 0, errInvalidOpenHours
+			}
+		}
+		for day := start; ; day = (day + 1) % 7 {
+			days |= 1 << day
+			if day == end {
+				break
+			}
+		}
+	}
+	return
+}
+
+func parseWeekday(str string) (day int, ok bool) {
+	for i, name := range weekdayNames {
+		if str == name {
+			return i, true
+		}
+	}
+	return
+}
+
+func parseClockTime(str string) (minutes int, err error) {
+	parts := strings.Split(str, ":")
+	if len(parts) != 2 {
+		return 0, errInvalidOpenHours
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || 24 < hours {
+		return 0, errInvalidOpenHours
+	}
+	mins, err := strconv.Atoi(parts[1])
+	if err != nil || mins < 0 || 59 < mins || (hours == 24 && mins != 0) {
+		return 0, errInvalidOpenHours
+	}
+	return hours*60 + mins, nil
+}
+
+// loadOpenHoursLocation is time.LoadLocation, but reads the tz database
+// only once per timezone name.
+func loadOpenHoursLocation(name string) (loc *time.Location, err error) {
+	openHoursLocationsMutex.Lock()
+	defer openHoursLocationsMutex.Unlock()
+	loc, ok := openHoursLocations[name]
+	if ok {
+		return loc, nil
+	}
+	loc, err = time.LoadLocation(name)
+	if err == nil {
+		openHoursLocations[name] = loc
+	}
+	return
+}
+
+func (hours *OpenHours) location() *time.Location {
+	if hours.Timezone != "" {
+		if loc, err := loadOpenHoursLocation(hours.Timezone); err == nil {
+			return loc
+		}
+	}
+	return time.UTC
+}
+
+// IsRestricted returns whether any open hours are configured.
+func (hours *OpenHours) IsRestricted() bool {
+	return len(hours.Windows) != 0
+}
+
+// IsOpen returns whether the channel may be joined at `now`.
+func (hours *OpenHours) IsOpen(now time.Time) bool {
+	if !hours.IsRestricted() {
+		return true
+	}
+	now = now.In(hours.location())
+	day := uint8(now.Weekday())
+	yesterday := (day + 6) % 7
+	minute := now.Hour()*60 + now.Minute()
+	for _, window := range hours.Windows {
+		if window.Start < window.End {
+			if window.Days&(1<<day) != 0 && window.Start <= minute && minute < window.End {
+				return true
+			}
+		} else {
+			if window.Days&(1<<day) != 0 && window.Start <= minute {
+				return true
+			}
+			if window.Days&(1<<yesterday) != 0 && minute < window.End {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// NextOpen returns the start of the next open window after `now`,
+// or the zero time if there is none.
+func (hours *OpenHours) NextOpen(now time.Time) (result time.Time) {
+	loc := hours.location()
+	local := now.In(loc)
+	for offset := 0; offset <= 7; offset++ {
+		midnight := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, loc)
+		day := uint8(midnight.Weekday())
+		for _, window := range hours.Windows {
+			if window.Days&(1<<day) == 0 {
+				continue
+			}
+			start := time.Date(midnight.Year(), midnight.Month(), midnight.Day(), window.Start/60, window.Start%60, 0, 0, loc)
+			if start.After(now) && (result.IsZero() || start.Before(result)) {
+				result = start
+			}
+		}
+		if !result.IsZero() {
+			return
+		}
+	}
+	return
+}
+
+func (hours *OpenHours) String() string {
+	if !hours.IsRestricted() {
+		return "off"
+	}
+	fields := make([]string, 0, len(hours.Windows)+1)
+	for _, window := range hours.Windows {
+		fields = append(fields, fmt.Sprintf("%s/%02d:%02d-%02d:%02d", weekdaysToString(window.Days),
+			window.Start/60, window.Start%60, window.End/60, window.End%60))
+	}
+	if hours.Timezone != "" {
+		fields = append(fields, hours.Timezone)
+	}
+	return strings.Join(fields, " ")
+}
+
+func weekdaysToString(days uint8) string {
+	if days == allWeekdays {
+		return "daily"
+	}
+	var names []string
+	for i, name := range weekdayNames {
+		if days&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
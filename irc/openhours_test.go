@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseOpenHours(t *testing.T) {
+	hours, err := ParseOpenHours("mon-fri/18:00-22:00 sat,sun/22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hours.String() != "mon,tue,wed,thu,fri/18:00-22:00 sun,sat/22:00-02:00" {
+		t.Errorf("unexpected serialization: %s", hours.String())
+	}
+	hours, err = ParseOpenHours("09:00-17:00 UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hours.String() != "daily/09:00-17:00 UTC" {
+		t.Errorf("unexpected serialization: %s", hours.String())
+	}
+	hours, err = ParseOpenHours("OFF")
+	if err != nil || hours.IsRestricted() {
+		t.Errorf("off should remove restrictions")
+	}
+
+	for _, spec := range []string{"", "UTC", "mon/25:00-26:00", "xyz/10:00-11:00", "mon/10:00", "10:00-11:00 Not/AZone"} {
+		if _, err := ParseOpenHours(spec); err == nil {
+			t.Errorf("spec %#v should be invalid", spec)
+		}
+	}
+}
+
+func TestOpenHoursIsOpen(t *testing.T) {
+	hours, err := ParseOpenHours("fri/22:00-02:00 mon/09:00-10:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2021-01-01 is a Friday
+	fri := func(hour, minute int) time.Time {
+		return time.Date(2021, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	if hours.IsOpen(fri(21, 59)) {
+		t.Errorf("should be closed before the window")
+	}
+	if !hours.IsOpen(fri(22, 0)) {
+		t.Errorf("should be open at the start of the window")
+	}
+	if !hours.IsOpen(fri(25, 59)) {
+		t.Errorf("should be open past midnight")
+	}
+	if hours.IsOpen(fri(26, 0)) {
+		t.Errorf("should be closed at the end of the window")
+	}
+
+	next := hours.NextOpen(fri(12, 0))
+	if !next.Equal(fri(22, 0)) {
+		t.Errorf("unexpected next open time %v", next)
+	}
+	next = hours.NextOpen(fri(26, 0))
+	if !next.Equal(time.Date(2021, 1, 4, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected next open time %v", next)
+	}
+
+	var unrestricted OpenHours
+	if !unrestricted.IsOpen(fri(3, 0)) || !unrestricted.NextOpen(fri(3, 0)).IsZero() {
+		t.Errorf("zero value should be unrestricted")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package postgresql
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// these are intended to be written directly into the config file:
+	Enabled bool
+	Host    string
+	Port    int
+	// directory containing the server's Unix domain socket, e.g., /var/run/postgresql
+	SocketPath      string `yaml:"socket-path"`
+	User            string
+	Password        string
+	HistoryDatabase string `yaml:"history-database"`
+	// passed through to the driver: disable, require (the default),
+	// verify-ca, or verify-full
+	SSLMode string `yaml:"ssl-mode"`
+	Timeout time.Duration
+
+	// XXX these are copied from elsewhere in the config:
+	ExpireTime           time.Duration
+	TrackAccountMessages bool
+}
+
+// connectionString builds a libpq-style connection string for the config.
+func (config *Config) connectionString() string {
+	var buf strings.Builder
+	param := func(key, value string) {
+		if value == "" {
+			return
+		}
+		if buf.Len() != 0 {
+			buf.WriteByte(' ')
+		}
+		// values are single-quoted, with backslash escapes for ' and \
+		value = strings.ReplaceAll(value, `\`, `\\`)
+		value = strings.ReplaceAll(value, `'`, `\'`)
+		fmt.Fprintf(&buf, "%s='%s'", key, value)
+	}
+
+	if config.SocketPath != "" {
+		param("host", config.SocketPath)
+	} else {
+		param("host", config.Host)
+	}
+	if config.Port != 0 {
+		param("port", fmt.Sprintf("%d", config.Port))
+	}
+	param("user", config.User)
+	param("password", config.Password)
+	param("dbname", config.HistoryDatabase)
+	param("sslmode", config.SSLMode)
+	return buf.String()
+}
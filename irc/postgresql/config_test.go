@@ -0,0 +1,47 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package postgresql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnectionString(t *testing.T) {
+	config := Config{
+		Host:            "db.example.com",
+		Port:            5432,
+		User:            "oragono",
+		Password:        `it's a \secret`,
+		HistoryDatabase: "oragono_history",
+		SSLMode:         "verify-full",
+	}
+	expected := `host='db.example.com' port='5432' user='oragono' password='it\'s a \\secret' dbname='oragono_history' sslmode='verify-full'`
+	if result := config.connectionString(); result != expected {
+		t.Errorf("expected %s, got %s", expected, result)
+	}
+
+	config = Config{Host: "localhost", SocketPath: "/var/run/postgresql", User: "oragono"}
+	expected = `host='/var/run/postgresql' user='oragono'`
+	if result := config.connectionString(); result != expected {
+		t.Errorf("expected %s, got %s", expected, result)
+	}
+}
+
+func TestBetweenQuery(t *testing.T) {
+	after := time.Unix(0, 100)
+	before := time.Unix(0, 200)
+	q := buildBetweenQuery("alice", "bob", before, after, time.Time{}, 50)
+	expected := "SELECT history.data FROM history INNER JOIN conversations ON history.id = conversations.history_id WHERE conversations.target = $1 AND conversations.correspondent = $2 AND conversations.nanotime > $3 AND conversations.nanotime < $4 ORDER BY conversations.nanotime DESC LIMIT $5;"
+	if q.String() != expected {
+		t.Errorf("expected %s, got %s", expected, q.String())
+	}
+	if !reflect.DeepEqual(q.args, []interface{}{"alice", "bob", int64(100), int64(200), 50}) {
+		t.Errorf("unexpected arguments %v", q.args)
+	}
+	if q.ascending {
+		t.Errorf("BETWEEN with the later time first should be descending")
+	}
+}
@@ -0,0 +1,1378 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package postgresql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/logger"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// this is a port of the MySQL persistent history backend (irc/mysql),
+// with the same table layout and semantics. targets are stored as TEXT
+// with the "C" collation, so they compare bytewise, as in MySQL.
+
+const (
+	// latest schema of the db
+	latestDbSchema   = "1"
+	keySchemaVersion = "db.version"
+	// minor version indicates rollback-safe upgrades, as with MySQL
+	latestDbMinorVersion  = "1"
+	keySchemaMinorVersion = "db.minorversion"
+	cleanupRowLimit       = 50
+	cleanupPauseTime      = 10 * time.Minute
+)
+
+type e struct{}
+
+type PostgreSQL struct {
+	timeout              int64
+	trackAccountMessages uint32
+	db                   *sql.DB
+	logger               *logger.Manager
+
+	insertHistory        *sql.Stmt
+	insertSequence       *sql.Stmt
+	insertConversation   *sql.Stmt
+	insertCorrespondent  *sql.Stmt
+	insertAccountMessage *sql.Stmt
+	insertRelation       *sql.Stmt
+
+	stateMutex sync.Mutex
+	config     Config
+	retention  map[string]history.RetentionPolicy // target to policy
+
+	wakeForgetter chan e
+}
+
+func (pg *PostgreSQL) Initialize(logger *logger.Manager, config Config) {
+	pg.logger = logger
+	pg.wakeForgetter = make(chan e, 1)
+	pg.SetConfig(config)
+}
+
+func (pg *PostgreSQL) SetConfig(config Config) {
+	atomic.StoreInt64(&pg.timeout, int64(config.Timeout))
+	var trackAccountMessages uint32
+	if config.TrackAccountMessages {
+		trackAccountMessages = 1
+	}
+	atomic.StoreUint32(&pg.trackAccountMessages, trackAccountMessages)
+	pg.stateMutex.Lock()
+	pg.config = config
+	pg.stateMutex.Unlock()
+}
+
+func (pg *PostgreSQL) getExpireTime() (expireTime time.Duration) {
+	pg.stateMutex.Lock()
+	expireTime = pg.config.ExpireTime
+	pg.stateMutex.Unlock()
+	return
+}
+
+// SetRetentionPolicy sets the retention policy of a target; the zero policy
+// removes it.
+func (pg *PostgreSQL) SetRetentionPolicy(target string, policy history.RetentionPolicy) {
+	pg.stateMutex.Lock()
+	defer pg.stateMutex.Unlock()
+	if policy == (history.RetentionPolicy{}) {
+		delete(pg.retention, target)
+		return
+	}
+	if pg.retention == nil {
+		pg.retention = make(map[string]history.RetentionPolicy)
+	}
+	pg.retention[target] = policy
+}
+
+func (pg *PostgreSQL) getRetentionPolicies() (result map[string]history.RetentionPolicy) {
+	pg.stateMutex.Lock()
+	defer pg.stateMutex.Unlock()
+	result = make(map[string]history.RetentionPolicy, len(pg.retention))
+	for target, policy := range pg.retention {
+		result[target] = policy
+	}
+	return
+}
+
+func (pg *PostgreSQL) Open() (err error) {
+	pg.db, err = sql.Open("postgres", pg.config.connectionString())
+	if err != nil {
+		return err
+	}
+
+	err = pg.fixSchemas()
+	if err != nil {
+		return err
+	}
+
+	err = pg.prepareStatements()
+	if err != nil {
+		return err
+	}
+
+	go pg.cleanupLoop()
+	go pg.forgetLoop()
+
+	return nil
+}
+
+func (pg *PostgreSQL) fixSchemas() (err error) {
+	_, err = pg.db.Exec(`CREATE TABLE IF NOT EXISTS metadata (
+		key_name VARCHAR(32) PRIMARY KEY,
+		value VARCHAR(32) NOT NULL
+	);`)
+	if err != nil {
+		return err
+	}
+
+	var schema string
+	err = pg.db.QueryRow(`SELECT value FROM metadata WHERE key_name = $1;`, keySchemaVersion).Scan(&schema)
+	if err == sql.ErrNoRows {
+		// DDL is transactional in PostgreSQL, so either all the tables
+		// are created and the schema version is recorded, or nothing is:
+		var tx *sql.Tx
+		tx, err = pg.db.Begin()
+		if err != nil {
+			return
+		}
+		err = createTables(tx)
+		if err == nil {
+			err = createRelationsTable(tx)
+		}
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO metadata (key_name, value) VALUES ($1, $2), ($3, $4);`,
+				keySchemaVersion, latestDbSchema, keySchemaMinorVersion, latestDbMinorVersion)
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		return tx.Commit()
+	} else if err == nil && schema != latestDbSchema {
+		return fmt.Errorf("incompatible schema: got %s, expected %s", schema, latestDbSchema)
+	} else if err != nil {
+		return
+	}
+
+	var minorVersion string
+	err = pg.db.QueryRow(`SELECT value FROM metadata WHERE key_name = $1;`, keySchemaMinorVersion).Scan(&minorVersion)
+	if err == sql.ErrNoRows {
+		// minor version 1 added the relations table; replies and reactions
+		// stored before the upgrade are not aggregated
+		var tx *sql.Tx
+		tx, err = pg.db.Begin()
+		if err != nil {
+			return
+		}
+		err = createRelationsTable(tx)
+		if err == nil {
+			_, err = tx.Exec(`INSERT INTO metadata (key_name, value) VALUES ($1, $2);`, keySchemaMinorVersion, "1")
+		}
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		return tx.Commit()
+	}
+	return
+}
+
+// the relations table indexes replies and reactions by the msgid of the message
+// they refer to (the parent); see the MySQL backend. reactions are stored as
+// BYTEA because they're client-supplied and needn't be valid UTF-8.
+func createRelationsTable(tx *sql.Tx) (err error) {
+	for _, statement := range []string{
+		`CREATE TABLE relations (
+			id BIGSERIAL PRIMARY KEY,
+			target TEXT COLLATE "C" NOT NULL,
+			correspondent TEXT COLLATE "C" NOT NULL,
+			parent BYTEA NOT NULL,
+			reaction BYTEA NOT NULL,
+			sender TEXT COLLATE "C" NOT NULL,
+			msgid BYTEA NOT NULL,
+			nanotime BIGINT NOT NULL,
+			history_id BIGINT NOT NULL
+		);`,
+		`CREATE INDEX relations_target_parent ON relations (target, parent);`,
+		`CREATE INDEX relations_history_id ON relations (history_id);`,
+	} {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func createTables(tx *sql.Tx) (err error) {
+	for _, statement := range []string{
+		`CREATE TABLE history (
+			id BIGSERIAL PRIMARY KEY,
+			data BYTEA NOT NULL,
+			msgid BYTEA NOT NULL
+		);`,
+		// msgids are only ever looked up by equality, so a hash index suffices
+		// (and is much smaller than a btree over the full 16 bytes):
+		`CREATE INDEX history_msgid ON history USING HASH (msgid);`,
+
+		`CREATE TABLE sequence (
+			id BIGSERIAL PRIMARY KEY,
+			target TEXT COLLATE "C" NOT NULL,
+			nanotime BIGINT NOT NULL,
+			history_id BIGINT NOT NULL
+		);`,
+		`CREATE INDEX sequence_target_nanotime ON sequence (target, nanotime);`,
+		`CREATE INDEX sequence_history_id ON sequence (history_id);`,
+
+		`CREATE TABLE conversations (
+			id BIGSERIAL PRIMARY KEY,
+			target TEXT COLLATE "C" NOT NULL,
+			correspondent TEXT COLLATE "C" NOT NULL,
+			nanotime BIGINT NOT NULL,
+			history_id BIGINT NOT NULL
+		);`,
+		`CREATE INDEX conversations_target_correspondent_nanotime ON conversations (target, correspondent, nanotime);`,
+		`CREATE INDEX conversations_history_id ON conversations (history_id);`,
+
+		// the correspondents table records the time of the latest message in each DM
+		// conversation, so CHATHISTORY TARGETS can be answered without scanning the
+		// conversations themselves
+		`CREATE TABLE correspondents (
+			id BIGSERIAL PRIMARY KEY,
+			target TEXT COLLATE "C" NOT NULL,
+			correspondent TEXT COLLATE "C" NOT NULL,
+			nanotime BIGINT NOT NULL,
+			UNIQUE (target, correspondent)
+		);`,
+		`CREATE INDEX correspondents_target_nanotime ON correspondents (target, nanotime);`,
+		`CREATE INDEX correspondents_nanotime ON correspondents (nanotime);`,
+
+		`CREATE TABLE account_messages (
+			history_id BIGINT PRIMARY KEY,
+			account TEXT COLLATE "C" NOT NULL
+		);`,
+		`CREATE INDEX account_messages_account_history_id ON account_messages (account, history_id);`,
+
+		`CREATE TABLE forget (
+			id BIGSERIAL PRIMARY KEY,
+			account TEXT COLLATE "C" NOT NULL
+		);`,
+	} {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (pg *PostgreSQL) cleanupLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			pg.logger.Error("postgresql",
+				fmt.Sprintf("Panic in cleanup routine: %v\n%s", r, debug.Stack()))
+			time.Sleep(cleanupPauseTime)
+			go pg.cleanupLoop()
+		}
+	}()
+
+	for {
+		expireTime := pg.getExpireTime()
+		if expireTime != 0 {
+			for {
+				startTime := time.Now()
+				rowsDeleted, err := pg.doCleanup(expireTime)
+				elapsed := time.Now().Sub(startTime)
+				pg.logError("error during row cleanup", err)
+				// keep going as long as we're accomplishing significant work
+				// (don't busy-wait on small numbers of rows expiring):
+				if rowsDeleted < (cleanupRowLimit / 10) {
+					break
+				}
+				// crude backpressure mechanism: if the database is slow,
+				// give it time to process other queries
+				time.Sleep(elapsed)
+			}
+		}
+		for target, policy := range pg.getRetentionPolicies() {
+			for {
+				startTime := time.Now()
+				rowsDeleted, err := pg.doRetentionCleanup(target, policy)
+				elapsed := time.Now().Sub(startTime)
+				pg.logError("error during retention cleanup", err)
+				if rowsDeleted < cleanupRowLimit {
+					break
+				}
+				time.Sleep(elapsed)
+			}
+		}
+		time.Sleep(cleanupPauseTime)
+	}
+}
+
+func (pg *PostgreSQL) doCleanup(age time.Duration) (count int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+	defer cancel()
+
+	ids, maxNanotime, err := pg.selectCleanupIDs(ctx, age)
+	if len(ids) == 0 {
+		pg.logger.Debug("postgresql", "found no rows to clean up")
+		return
+	}
+
+	pg.logger.Debug("postgresql", fmt.Sprintf("deleting %d history rows, max age %s", len(ids), utils.NanoToTimestamp(maxNanotime)))
+
+	err = pg.deleteHistoryIDs(ctx, ids)
+	if err != nil {
+		return
+	}
+	// every message in these conversations has expired:
+	_, err = pg.db.ExecContext(ctx, `DELETE FROM correspondents WHERE nanotime < $1;`, time.Now().Add(-age).UnixNano())
+	return len(ids), err
+}
+
+func (pg *PostgreSQL) deleteHistoryIDs(ctx context.Context, ids []int64) (err error) {
+	idArray := pq.Array(ids)
+	_, err = pg.db.ExecContext(ctx, `DELETE FROM conversations WHERE history_id = ANY($1);`, idArray)
+	if err != nil {
+		return
+	}
+	_, err = pg.db.ExecContext(ctx, `DELETE FROM sequence WHERE history_id = ANY($1);`, idArray)
+	if err != nil {
+		return
+	}
+	_, err = pg.db.ExecContext(ctx, `DELETE FROM relations WHERE history_id = ANY($1);`, idArray)
+	if err != nil {
+		return
+	}
+	if pg.isTrackingAccountMessages() {
+		_, err = pg.db.ExecContext(ctx, `DELETE FROM account_messages WHERE history_id = ANY($1);`, idArray)
+		if err != nil {
+			return
+		}
+	}
+	_, err = pg.db.ExecContext(ctx, `DELETE FROM history WHERE id = ANY($1);`, idArray)
+	return
+}
+
+func (pg *PostgreSQL) selectCleanupIDs(ctx context.Context, age time.Duration) (ids []int64, maxNanotime int64, err error) {
+	rows, err := pg.db.QueryContext(ctx, `
+		SELECT history.id, sequence.nanotime
+		FROM history
+		LEFT JOIN sequence ON history.id = sequence.history_id
+		ORDER BY history.id LIMIT $1;`, cleanupRowLimit)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	// a history ID may have 0-2 rows in sequence: 1 for a channel entry,
+	// 2 for a DM, 0 if the data is inconsistent. therefore, deduplicate
+	// and delete anything that doesn't have a sequence entry:
+	idset := make(map[int64]struct{}, cleanupRowLimit)
+	threshold := time.Now().Add(-age).UnixNano()
+	for rows.Next() {
+		var id int64
+		var nanotime sql.NullInt64
+		err = rows.Scan(&id, &nanotime)
+		if err != nil {
+			return
+		}
+		if !nanotime.Valid || nanotime.Int64 < threshold {
+			idset[id] = struct{}{}
+			if nanotime.Valid && nanotime.Int64 > maxNanotime {
+				maxNanotime = nanotime.Int64
+			}
+		}
+	}
+	ids = make([]int64, 0, len(idset))
+	for id := range idset {
+		ids = append(ids, id)
+	}
+	return
+}
+
+// doRetentionCleanup deletes a batch of a target's messages that are older than
+// its policy's maximum age, or beyond its maximum number of lines.
+func (pg *PostgreSQL) doRetentionCleanup(target string, policy history.RetentionPolicy) (count int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+	defer cancel()
+
+	var ids []int64
+	if policy.MaxAge != 0 {
+		threshold := time.Now().Add(-policy.MaxAge).UnixNano()
+		ids, err = pg.selectHistoryIDs(ctx, `
+			SELECT history_id FROM sequence
+			WHERE target = $1 AND nanotime < $2
+			LIMIT $3;`, target, threshold, cleanupRowLimit)
+		if err != nil {
+			return
+		}
+	}
+	if policy.MaxLines != 0 && len(ids) < cleanupRowLimit {
+		var excessIDs []int64
+		excessIDs, err = pg.selectHistoryIDs(ctx, `
+			SELECT history_id FROM sequence
+			WHERE target = $1
+			ORDER BY nanotime DESC LIMIT $3 OFFSET $2;`, target, policy.MaxLines, cleanupRowLimit-len(ids))
+		if err != nil {
+			return
+		}
+		ids = append(ids, excessIDs...)
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	pg.logger.Debug("postgresql", fmt.Sprintf("deleting %d history rows from %s under its retention policy", len(ids), target))
+	return len(ids), pg.deleteHistoryIDs(ctx, ids)
+}
+
+func (pg *PostgreSQL) selectHistoryIDs(ctx context.Context, query string, args ...interface{}) (ids []int64, err error) {
+	rows, err := pg.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// wait for forget queue items and process them one by one
+func (pg *PostgreSQL) forgetLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			pg.logger.Error("postgresql",
+				fmt.Sprintf("Panic in forget routine: %v\n%s", r, debug.Stack()))
+			time.Sleep(cleanupPauseTime)
+			go pg.forgetLoop()
+		}
+	}()
+
+	for {
+		for {
+			found, err := pg.doForget()
+			pg.logError("error processing forget", err)
+			if err != nil {
+				time.Sleep(cleanupPauseTime)
+			}
+			if !found {
+				break
+			}
+		}
+
+		<-pg.wakeForgetter
+	}
+}
+
+// dequeue an item from the forget queue and process it
+func (pg *PostgreSQL) doForget() (found bool, err error) {
+	id, account, err := func() (id int64, account string, err error) {
+		ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+		defer cancel()
+
+		row := pg.db.QueryRowContext(ctx,
+			`SELECT forget.id, forget.account FROM forget LIMIT 1;`)
+		err = row.Scan(&id, &account)
+		if err == sql.ErrNoRows {
+			return 0, "", nil
+		}
+		return
+	}()
+
+	if err != nil || account == "" {
+		return false, err
+	}
+
+	found = true
+
+	var count int
+	for {
+		start := time.Now()
+		count, err = pg.doForgetIteration(account)
+		elapsed := time.Since(start)
+		if err != nil {
+			return true, err
+		}
+		if count == 0 {
+			break
+		}
+		time.Sleep(elapsed)
+	}
+
+	pg.logger.Debug("postgresql", "forget complete for account", account)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+	defer cancel()
+	_, err = pg.db.ExecContext(ctx, `DELETE FROM forget WHERE id = $1;`, id)
+	return
+}
+
+func (pg *PostgreSQL) doForgetIteration(account string) (count int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+	defer cancel()
+
+	ids, err := pg.selectHistoryIDs(ctx, `
+		SELECT account_messages.history_id
+		FROM account_messages
+		WHERE account_messages.account = $1
+		LIMIT $2;`, account, cleanupRowLimit)
+	if err != nil || len(ids) == 0 {
+		return
+	}
+
+	pg.logger.Debug("postgresql", fmt.Sprintf("deleting %d history rows from account %s", len(ids), account))
+	err = pg.deleteHistoryIDs(ctx, ids)
+	return len(ids), err
+}
+
+func (pg *PostgreSQL) prepareStatements() (err error) {
+	pg.insertHistory, err = pg.db.Prepare(`INSERT INTO history
+		(data, msgid) VALUES ($1, $2) RETURNING id;`)
+	if err != nil {
+		return
+	}
+	pg.insertSequence, err = pg.db.Prepare(`INSERT INTO sequence
+		(target, nanotime, history_id) VALUES ($1, $2, $3);`)
+	if err != nil {
+		return
+	}
+	pg.insertConversation, err = pg.db.Prepare(`INSERT INTO conversations
+		(target, correspondent, nanotime, history_id) VALUES ($1, $2, $3, $4);`)
+	if err != nil {
+		return
+	}
+	pg.insertCorrespondent, err = pg.db.Prepare(`INSERT INTO correspondents
+		(target, correspondent, nanotime) VALUES ($1, $2, $3)
+		ON CONFLICT (target, correspondent)
+		DO UPDATE SET nanotime = GREATEST(correspondents.nanotime, EXCLUDED.nanotime);`)
+	if err != nil {
+		return
+	}
+	pg.insertAccountMessage, err = pg.db.Prepare(`INSERT INTO account_messages
+		(history_id, account) VALUES ($1, $2);`)
+	if err != nil {
+		return
+	}
+	pg.insertRelation, err = pg.db.Prepare(`INSERT INTO relations
+		(target, correspondent, parent, reaction, sender, msgid, nanotime, history_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8);`)
+	if err != nil {
+		return
+	}
+
+	return
+}
+
+func (pg *PostgreSQL) getTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&pg.timeout))
+}
+
+func (pg *PostgreSQL) isTrackingAccountMessages() bool {
+	return atomic.LoadUint32(&pg.trackAccountMessages) != 0
+}
+
+func (pg *PostgreSQL) logError(context string, err error) (quit bool) {
+	if err != nil {
+		pg.logger.Error("postgresql", context, err.Error())
+		return true
+	}
+	return false
+}
+
+func (pg *PostgreSQL) Forget(account string) {
+	if pg.db == nil || account == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+	defer cancel()
+
+	_, err := pg.db.ExecContext(ctx, `INSERT INTO forget (account) VALUES ($1);`, account)
+	if pg.logError("can't insert into forget table", err) {
+		return
+	}
+
+	// wake up the forget goroutine if it's blocked:
+	select {
+	case pg.wakeForgetter <- e{}:
+	default:
+	}
+}
+
+// RenameAccount moves the stored history of the casefolded account `oldAccount`
+// to `newAccount` (which may already have history of its own, if the accounts
+// are being merged), and (where account messages are tracked) rewrites the
+// attributions of the messages it sent to `newAccountName`.
+func (pg *PostgreSQL) RenameAccount(oldAccount, newAccount, newAccountName string) (err error) {
+	if pg.db == nil || oldAccount == "" || newAccount == "" {
+		return
+	}
+
+	if oldAccount != newAccount {
+		err = func() (err error) {
+			ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+			defer cancel()
+
+			tx, err := pg.db.BeginTx(ctx, nil)
+			if err != nil {
+				return
+			}
+			defer func() {
+				if err != nil {
+					tx.Rollback()
+				}
+			}()
+
+			// when merging, a conversation may already exist under the new name:
+			_, err = tx.ExecContext(ctx, `UPDATE correspondents AS n
+				SET nanotime = GREATEST(n.nanotime, o.nanotime)
+				FROM correspondents AS o
+				WHERE n.correspondent = o.correspondent AND n.target = $1 AND o.target = $2;`, newAccount, oldAccount)
+			if err != nil {
+				return
+			}
+			for _, query := range []string{
+				`UPDATE sequence SET target = $1 WHERE target = $2;`,
+				`UPDATE conversations SET target = $1 WHERE target = $2;`,
+				`UPDATE relations SET target = $1 WHERE target = $2;`,
+				// skip the conversations that were merged above:
+				`UPDATE correspondents SET target = $1 WHERE target = $2 AND correspondent NOT IN
+					(SELECT correspondent FROM correspondents WHERE target = $1);`,
+				`UPDATE account_messages SET account = $1 WHERE account = $2;`,
+			} {
+				_, err = tx.ExecContext(ctx, query, newAccount, oldAccount)
+				if err != nil {
+					return
+				}
+			}
+			_, err = tx.ExecContext(ctx, `DELETE FROM correspondents WHERE target = $1;`, oldAccount)
+			if err != nil {
+				return
+			}
+			return tx.Commit()
+		}()
+		if pg.logError("could not rename account", err) {
+			return
+		}
+	}
+
+	var lastSeen int64
+	for {
+		var count int
+		count, lastSeen, err = pg.renameAccountIteration(newAccount, newAccountName, lastSeen)
+		if count == 0 || err != nil {
+			break
+		}
+	}
+	pg.logError("could not rewrite account names", err)
+	return
+}
+
+func (pg *PostgreSQL) renameAccountIteration(account, accountName string, lastSeen int64) (count int, maxID int64, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+	defer cancel()
+
+	maxID = lastSeen
+	rows, err := pg.db.QueryContext(ctx, `
+		SELECT account_messages.history_id, history.data FROM account_messages
+		INNER JOIN history ON history.id = account_messages.history_id
+		WHERE account_messages.account = $1 AND account_messages.history_id > $2
+		ORDER BY account_messages.history_id LIMIT $3;`, account, lastSeen, cleanupRowLimit)
+	if err != nil {
+		return
+	}
+
+	ids := make([]int64, 0, cleanupRowLimit)
+	blobs := make([][]byte, 0, cleanupRowLimit)
+	for rows.Next() {
+		var id int64
+		var blob []byte
+		err = rows.Scan(&id, &blob)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		ids = append(ids, id)
+		blobs = append(blobs, blob)
+	}
+	rows.Close()
+
+	for i, id := range ids {
+		count++
+		maxID = id
+		var item history.Item
+		if unmarshalItem(blobs[i], &item) != nil || item.AccountName == accountName {
+			continue
+		}
+		item.AccountName = accountName
+		blob, mErr := marshalItem(&item)
+		if mErr != nil {
+			continue
+		}
+		_, err = pg.db.ExecContext(ctx, `UPDATE history SET data = $1 WHERE id = $2;`, blob, id)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+var errInvalidItem = errors.New("invalid history item")
+
+// insertStatements are the prepared insert statements, bound to a transaction
+type insertStatements struct {
+	history        *sql.Stmt
+	sequence       *sql.Stmt
+	conversation   *sql.Stmt
+	correspondent  *sql.Stmt
+	accountMessage *sql.Stmt
+	relation       *sql.Stmt
+}
+
+// AddItems stores a batch of channel and direct messages in a single
+// transaction. Items that can't be serialized are logged and skipped;
+// any database error rolls back the whole batch.
+func (pg *PostgreSQL) AddItems(writes []history.PersistentWrite) (err error) {
+	if pg.db == nil || len(writes) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+	defer cancel()
+
+	tx, err := pg.db.BeginTx(ctx, nil)
+	if pg.logError("could not begin history transaction", err) {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	stmts := insertStatements{
+		history:        tx.StmtContext(ctx, pg.insertHistory),
+		sequence:       tx.StmtContext(ctx, pg.insertSequence),
+		conversation:   tx.StmtContext(ctx, pg.insertConversation),
+		correspondent:  tx.StmtContext(ctx, pg.insertCorrespondent),
+		accountMessage: tx.StmtContext(ctx, pg.insertAccountMessage),
+		relation:       tx.StmtContext(ctx, pg.insertRelation),
+	}
+
+	for i := range writes {
+		if writes[i].Channel != "" {
+			err = pg.addChannelItem(ctx, &stmts, &writes[i])
+		} else {
+			err = pg.addDirectMessage(ctx, &stmts, &writes[i])
+		}
+		if err == errInvalidItem {
+			err = nil
+		} else if err != nil {
+			return
+		}
+	}
+
+	err = tx.Commit()
+	pg.logError("could not commit history transaction", err)
+	return
+}
+
+func (pg *PostgreSQL) addChannelItem(ctx context.Context, stmts *insertStatements, write *history.PersistentWrite) (err error) {
+	id, err := pg.insertBase(ctx, stmts, write.Item)
+	if err != nil {
+		return
+	}
+
+	err = pg.insertSequenceEntry(ctx, stmts, write.Channel, write.Item.Message.Time.UnixNano(), id)
+	if err != nil {
+		return
+	}
+
+	err = pg.insertRelationEntry(ctx, stmts, &write.Item, write.Channel, "", id)
+	if err != nil {
+		return
+	}
+
+	return pg.insertAccountMessageEntry(ctx, stmts, id, write.Account)
+}
+
+func (pg *PostgreSQL) insertSequenceEntry(ctx context.Context, stmts *insertStatements, target string, messageTime int64, id int64) (err error) {
+	_, err = stmts.sequence.ExecContext(ctx, target, messageTime, id)
+	pg.logError("could not insert sequence entry", err)
+	return
+}
+
+func (pg *PostgreSQL) insertConversationEntry(ctx context.Context, stmts *insertStatements, target, correspondent string, messageTime int64, id int64) (err error) {
+	_, err = stmts.conversation.ExecContext(ctx, target, correspondent, messageTime, id)
+	if pg.logError("could not insert conversations entry", err) {
+		return
+	}
+	_, err = stmts.correspondent.ExecContext(ctx, target, correspondent, messageTime)
+	pg.logError("could not insert correspondents entry", err)
+	return
+}
+
+// insertRelationEntry indexes the item if it's a reply or reaction
+func (pg *PostgreSQL) insertRelationEntry(ctx context.Context, stmts *insertStatements, item *history.Item, target, correspondent string, id int64) (err error) {
+	relation, ok := history.ItemRelation(item)
+	if !ok {
+		return
+	}
+	parent, pErr := decodeMsgid(relation.Parent)
+	msgid, mErr := decodeMsgid(item.Message.Msgid)
+	if pErr != nil || mErr != nil || len(parent) != 16 || len(msgid) != 16 {
+		return // not a reply to one of our messages
+	}
+	_, err = stmts.relation.ExecContext(ctx, target, correspondent, parent, []byte(relation.Reaction), relation.Sender, msgid, item.Message.Time.UnixNano(), id)
+	pg.logError("could not insert relations entry", err)
+	return
+}
+
+func (pg *PostgreSQL) insertBase(ctx context.Context, stmts *insertStatements, item history.Item) (id int64, err error) {
+	value, err := marshalItem(&item)
+	if pg.logError("could not marshal item", err) {
+		return 0, errInvalidItem
+	}
+
+	msgidBytes, err := decodeMsgid(item.Message.Msgid)
+	if pg.logError("could not decode msgid", err) {
+		return 0, errInvalidItem
+	}
+
+	// the driver doesn't support LastInsertId; use RETURNING instead
+	err = stmts.history.QueryRowContext(ctx, value, msgidBytes).Scan(&id)
+	pg.logError("could not insert item", err)
+	return
+}
+
+func (pg *PostgreSQL) insertAccountMessageEntry(ctx context.Context, stmts *insertStatements, id int64, account string) (err error) {
+	if account == "" || !pg.isTrackingAccountMessages() {
+		return
+	}
+	_, err = stmts.accountMessage.ExecContext(ctx, id, account)
+	pg.logError("could not insert account-message entry", err)
+	return
+}
+
+func (pg *PostgreSQL) addDirectMessage(ctx context.Context, stmts *insertStatements, write *history.PersistentWrite) (err error) {
+	if write.SenderAccount == "" && write.RecipientAccount == "" {
+		return
+	}
+
+	if write.Sender == "" || write.Recipient == "" {
+		return errInvalidItem
+	}
+
+	id, err := pg.insertBase(ctx, stmts, write.Item)
+	if err != nil {
+		return
+	}
+
+	nanotime := write.Item.Message.Time.UnixNano()
+
+	if write.SenderAccount != "" {
+		err = pg.insertSequenceEntry(ctx, stmts, write.SenderAccount, nanotime, id)
+		if err != nil {
+			return
+		}
+		err = pg.insertConversationEntry(ctx, stmts, write.SenderAccount, write.Recipient, nanotime, id)
+		if err != nil {
+			return
+		}
+		err = pg.insertRelationEntry(ctx, stmts, &write.Item, write.SenderAccount, write.Recipient, id)
+		if err != nil {
+			return
+		}
+	}
+
+	if write.RecipientAccount != "" && write.Sender != write.Recipient {
+		err = pg.insertSequenceEntry(ctx, stmts, write.RecipientAccount, nanotime, id)
+		if err != nil {
+			return
+		}
+		err = pg.insertConversationEntry(ctx, stmts, write.RecipientAccount, write.Sender, nanotime, id)
+		if err != nil {
+			return
+		}
+		err = pg.insertRelationEntry(ctx, stmts, &write.Item, write.RecipientAccount, write.Sender, id)
+		if err != nil {
+			return
+		}
+	}
+
+	return pg.insertAccountMessageEntry(ctx, stmts, id, write.SenderAccount)
+}
+
+// note that accountName is the unfolded name. if target is nonempty,
+// the message must be in its history (i.e., in that channel, or in the DMs
+// of that account).
+func (pg *PostgreSQL) DeleteMsgid(msgid, accountName, target string) (err error) {
+	if pg.db == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+	defer cancel()
+
+	_, id, data, err := pg.lookupMsgid(ctx, msgid, true)
+	if err != nil {
+		return
+	}
+
+	if target != "" {
+		var found int
+		err = pg.db.QueryRowContext(ctx, `SELECT 1 FROM sequence WHERE history_id = $1 AND target = $2 LIMIT 1;`, id, target).Scan(&found)
+		if err != nil {
+			return
+		}
+	}
+
+	if accountName != "*" {
+		var item history.Item
+		err = unmarshalItem(data, &item)
+		// delete if the entry is corrupt
+		if err == nil && item.AccountName != accountName {
+			return history.ErrDisallowed
+		}
+	}
+
+	err = pg.deleteHistoryIDs(ctx, []int64{id})
+	pg.logError("couldn't delete msgid", err)
+	return
+}
+
+func (pg *PostgreSQL) Export(account string, writer io.Writer) {
+	if pg.db == nil {
+		return
+	}
+
+	var err error
+	var lastSeen int64
+	for {
+		rows := func() (count int) {
+			ctx, cancel := context.WithTimeout(context.Background(), cleanupPauseTime)
+			defer cancel()
+
+			rows, rowsErr := pg.db.QueryContext(ctx, `
+				SELECT account_messages.history_id, history.data, sequence.target FROM account_messages
+				INNER JOIN history ON history.id = account_messages.history_id
+				INNER JOIN sequence ON account_messages.history_id = sequence.history_id
+				WHERE account_messages.account = $1 AND account_messages.history_id > $2
+				ORDER BY account_messages.history_id LIMIT $3;`, account, lastSeen, cleanupRowLimit)
+			if rowsErr != nil {
+				err = rowsErr
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id int64
+				var blob, jsonBlob []byte
+				var target string
+				var item history.Item
+				err = rows.Scan(&id, &blob, &target)
+				if err != nil {
+					return
+				}
+				err = unmarshalItem(blob, &item)
+				if err != nil {
+					return
+				}
+				item.CfCorrespondent = target
+				jsonBlob, err = json.Marshal(item)
+				if err != nil {
+					return
+				}
+				count++
+				if lastSeen < id {
+					lastSeen = id
+				}
+				writer.Write(jsonBlob)
+				writer.Write([]byte{'\n'})
+			}
+			return
+		}()
+		if rows == 0 || err != nil {
+			break
+		}
+	}
+
+	pg.logError("could not export history", err)
+	return
+}
+
+func (pg *PostgreSQL) lookupMsgid(ctx context.Context, msgid string, includeData bool) (result time.Time, id int64, data []byte, err error) {
+	// as in the MySQL backend, resolve msgids to timestamps with a separate query
+	decoded, err := decodeMsgid(msgid)
+	if err != nil {
+		return
+	}
+	cols := `sequence.nanotime`
+	if includeData {
+		cols = `sequence.nanotime, sequence.history_id, history.data`
+	}
+	row := pg.db.QueryRowContext(ctx, fmt.Sprintf(`
+		SELECT %s FROM sequence
+		INNER JOIN history ON history.id = sequence.history_id
+		WHERE history.msgid = $1 LIMIT 1;`, cols), decoded)
+	var nanotime int64
+	if !includeData {
+		err = row.Scan(&nanotime)
+	} else {
+		err = row.Scan(&nanotime, &id, &data)
+	}
+	if err != sql.ErrNoRows {
+		pg.logError("could not resolve msgid to time", err)
+	}
+	if err != nil {
+		return
+	}
+
+	result = time.Unix(0, nanotime).UTC()
+	return
+}
+
+func (pg *PostgreSQL) selectItems(ctx context.Context, query string, args ...interface{}) (results []history.Item, err error) {
+	rows, err := pg.db.QueryContext(ctx, query, args...)
+	if pg.logError("could not select history items", err) {
+		return
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var blob []byte
+		var item history.Item
+		err = rows.Scan(&blob)
+		if pg.logError("could not scan history item", err) {
+			return
+		}
+		err = unmarshalItem(blob, &item)
+		if pg.logError("could not unmarshal history item", err) {
+			return
+		}
+		results = append(results, item)
+	}
+	return
+}
+
+// queryBuilder accumulates a query with numbered ($1, $2, ...) placeholders.
+type queryBuilder struct {
+	bytes.Buffer
+	args []interface{}
+}
+
+// arg records an argument and returns its placeholder
+func (q *queryBuilder) arg(value interface{}) string {
+	q.args = append(q.args, value)
+	return fmt.Sprintf("$%d", len(q.args))
+}
+
+func (pg *PostgreSQL) betweenTimestamps(ctx context.Context, target, correspondent string, after, before, cutoff time.Time, limit int) (results []history.Item, err error) {
+	q := buildBetweenQuery(target, correspondent, after, before, cutoff, limit)
+	results, err = pg.selectItems(ctx, q.String(), q.args...)
+	if err == nil && !q.ascending {
+		history.Reverse(results)
+	}
+	return
+}
+
+type betweenQuery struct {
+	queryBuilder
+	ascending bool
+}
+
+func buildBetweenQuery(target, correspondent string, after, before, cutoff time.Time, limit int) (q betweenQuery) {
+	useSequence := correspondent == ""
+	table := "sequence"
+	if !useSequence {
+		table = "conversations"
+	}
+
+	after, before, q.ascending = history.MinMaxAsc(after, before, cutoff)
+	direction := "ASC"
+	if !q.ascending {
+		direction = "DESC"
+	}
+
+	fmt.Fprintf(&q,
+		"SELECT history.data FROM history INNER JOIN %[1]s ON history.id = %[1]s.history_id WHERE", table)
+	if useSequence {
+		fmt.Fprintf(&q, " sequence.target = %s", q.arg(target))
+	} else {
+		fmt.Fprintf(&q, " conversations.target = %s AND conversations.correspondent = %s", q.arg(target), q.arg(correspondent))
+	}
+	if !after.IsZero() {
+		fmt.Fprintf(&q, " AND %s.nanotime > %s", table, q.arg(after.UnixNano()))
+	}
+	if !before.IsZero() {
+		fmt.Fprintf(&q, " AND %s.nanotime < %s", table, q.arg(before.UnixNano()))
+	}
+	fmt.Fprintf(&q, " ORDER BY %s.nanotime %s LIMIT %s;", table, direction, q.arg(limit))
+	return
+}
+
+// ListCorrespondents lists the DM correspondents of `target` whose latest
+// message falls between `start` and `end`, with the same ordering and limit
+// semantics as history.MergeTargets.
+func (pg *PostgreSQL) ListCorrespondents(target string, start, end, cutoff time.Time, limit int) (results []history.TargetListing, err error) {
+	if pg.db == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+	defer cancel()
+
+	after, before, ascending := history.MinMaxAsc(start, end, cutoff)
+	direction := "ASC"
+	if !ascending {
+		direction = "DESC"
+	}
+
+	var q queryBuilder
+	fmt.Fprintf(&q, "SELECT correspondent, nanotime FROM correspondents WHERE target = %s", q.arg(target))
+	if !after.IsZero() {
+		fmt.Fprintf(&q, " AND nanotime > %s", q.arg(after.UnixNano()))
+	}
+	if !before.IsZero() {
+		fmt.Fprintf(&q, " AND nanotime < %s", q.arg(before.UnixNano()))
+	}
+	fmt.Fprintf(&q, " ORDER BY nanotime %s LIMIT %s;", direction, q.arg(limit))
+
+	rows, err := pg.db.QueryContext(ctx, q.String(), q.args...)
+	if pg.logError("could not list correspondents", err) {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var correspondent string
+		var nanotime int64
+		err = rows.Scan(&correspondent, &nanotime)
+		if pg.logError("could not scan correspondents", err) {
+			return
+		}
+		results = append(results, history.TargetListing{
+			CfName: correspondent,
+			Time:   time.Unix(0, nanotime).UTC(),
+		})
+	}
+	return
+}
+
+// ListChannels returns the time of the latest message in each of the given
+// (casefolded) channels that has any history, in a single query.
+func (pg *PostgreSQL) ListChannels(cfchannels []string) (results []history.TargetListing, err error) {
+	if pg.db == nil || len(cfchannels) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+	defer cancel()
+
+	rows, err := pg.db.QueryContext(ctx, `
+		SELECT target, MAX(nanotime) FROM sequence
+		WHERE target = ANY($1) GROUP BY target;`, pq.Array(cfchannels))
+	if pg.logError("could not list channels", err) {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var target string
+		var nanotime int64
+		err = rows.Scan(&target, &nanotime)
+		if pg.logError("could not scan channels", err) {
+			return
+		}
+		results = append(results, history.TargetListing{
+			CfName: target,
+			Time:   time.Unix(0, nanotime).UTC(),
+		})
+	}
+	return
+}
+
+// Ping checks that the database is reachable.
+func (pg *PostgreSQL) Ping() (err error) {
+	if pg.db == nil {
+		return errors.New("database is not open")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+	defer cancel()
+	return pg.db.PingContext(ctx)
+}
+
+func (pg *PostgreSQL) Close() {
+	// closing the database will close our prepared statements as well
+	if pg.db != nil {
+		pg.db.Close()
+	}
+	pg.db = nil
+}
+
+// implements history.Sequence, emulating a single history buffer (for a channel,
+// a single user's DMs, or a DM conversation)
+type postgreSQLHistorySequence struct {
+	pg            *PostgreSQL
+	target        string
+	correspondent string
+	cutoff        time.Time
+}
+
+func (s *postgreSQLHistorySequence) Between(start, end history.Selector, limit int) (results []history.Item, complete bool, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.pg.getTimeout())
+	defer cancel()
+
+	startTime := start.Time
+	if start.Msgid != "" {
+		startTime, _, _, err = s.pg.lookupMsgid(ctx, start.Msgid, false)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	endTime := end.Time
+	if end.Msgid != "" {
+		endTime, _, _, err = s.pg.lookupMsgid(ctx, end.Msgid, false)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	results, err = s.pg.betweenTimestamps(ctx, s.target, s.correspondent, startTime, endTime, s.cutoff, limit)
+	return results, (err == nil), err
+}
+
+func (s *postgreSQLHistorySequence) Around(start history.Selector, limit int) (results []history.Item, err error) {
+	return history.GenericAround(s, start, limit)
+}
+
+func (s *postgreSQLHistorySequence) Aggregate(msgids []string, maxReplies int) (results []history.Aggregate, err error) {
+	return s.pg.aggregate(s.target, s.correspondent, s.cutoff, msgids, maxReplies)
+}
+
+// aggregate implements history.Aggregator from the relations table
+func (pg *PostgreSQL) aggregate(target, correspondent string, cutoff time.Time, msgids []string, maxReplies int) (results []history.Aggregate, err error) {
+	builder := history.NewAggregateBuilder(msgids, maxReplies)
+	if pg.db == nil {
+		return builder.Results(), nil
+	}
+
+	parents := make([][]byte, 0, len(msgids))
+	for _, msgid := range msgids {
+		if parent, err := decodeMsgid(msgid); err == nil {
+			parents = append(parents, parent)
+		}
+	}
+	if len(parents) == 0 {
+		return builder.Results(), nil
+	}
+
+	// the conditions common to both queries: relations visible in this sequence
+	var q queryBuilder
+	q.WriteString("target = " + q.arg(target))
+	if correspondent != "" {
+		q.WriteString(" AND correspondent = " + q.arg(correspondent))
+	}
+	if !cutoff.IsZero() {
+		q.WriteString(" AND nanotime > " + q.arg(cutoff.UnixNano()))
+	}
+	where, whereArgs := q.String(), q.args
+
+	ctx, cancel := context.WithTimeout(context.Background(), pg.getTimeout())
+	defer cancel()
+
+	rows, err := pg.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT parent, reaction, COUNT(*), COUNT(DISTINCT sender) FROM relations
+		WHERE %s AND parent = ANY($%d)
+		GROUP BY parent, reaction;`, where, len(whereArgs)+1), append(whereArgs, pq.ByteaArray(parents))...)
+	if pg.logError("could not aggregate relations", err) {
+		return
+	}
+	replyCounts := make(map[string]int)
+	for rows.Next() {
+		var parent, reaction []byte
+		var count, senders int
+		err = rows.Scan(&parent, &reaction, &count, &senders)
+		if pg.logError("could not scan relations", err) {
+			rows.Close()
+			return
+		}
+		if len(reaction) == 0 {
+			replyCounts[encodeMsgid(parent)] = count
+		} else {
+			builder.AddReactions(encodeMsgid(parent), string(reaction), senders)
+		}
+	}
+	rows.Close()
+
+	for parent, count := range replyCounts {
+		var replies []string
+		if 0 < maxReplies {
+			replies, err = pg.latestReplies(ctx, where, whereArgs, parent, maxReplies)
+			if err != nil {
+				return
+			}
+		}
+		builder.AddReplies(parent, count, replies)
+	}
+	return builder.Results(), nil
+}
+
+func (pg *PostgreSQL) latestReplies(ctx context.Context, where string, whereArgs []interface{}, parent string, limit int) (replies []string, err error) {
+	parentBytes, err := decodeMsgid(parent)
+	if err != nil {
+		return
+	}
+	n := len(whereArgs)
+	args := append(append([]interface{}(nil), whereArgs...), parentBytes, limit)
+	rows, err := pg.db.QueryContext(ctx, fmt.Sprintf(`
+		SELECT msgid FROM relations WHERE %s AND parent = $%d AND reaction = ''
+		ORDER BY nanotime DESC LIMIT $%d;`, where, n+1, n+2), args...)
+	if pg.logError("could not select replies", err) {
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var msgid []byte
+		err = rows.Scan(&msgid)
+		if pg.logError("could not scan replies", err) {
+			return
+		}
+		replies = append(replies, encodeMsgid(msgid))
+	}
+	// chronological order:
+	for i, j := 0, len(replies)-1; i < j; i, j = i+1, j-1 {
+		replies[i], replies[j] = replies[j], replies[i]
+	}
+	return
+}
+
+func (pg *PostgreSQL) MakeSequence(target, correspondent string, cutoff time.Time) history.Sequence {
+	return &postgreSQLHistorySequence{
+		target:        target,
+		correspondent: correspondent,
+		pg:            pg,
+		cutoff:        cutoff,
+	}
+}
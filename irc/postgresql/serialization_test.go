@@ -0,0 +1,46 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package postgresql
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+func TestItemTagsRoundTrip(t *testing.T) {
+	// replies and reactions are threaded by their client-only tags,
+	// which must survive the trip through the database
+	item := history.Item{
+		Type:        history.Privmsg,
+		Nick:        "alice!alice@example.com",
+		AccountName: "alice",
+		Message: utils.SplitMessage{
+			Message: "hi",
+			Msgid:   "x3bc6mcqd3vqqhsh7gkbcxb2de",
+			Time:    time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC),
+		},
+		Tags: map[string]string{
+			"+draft/reply":     "kbcxb2dex3bc6mcqd3vqqhsh7g",
+			"+draft/react":     "👍",
+			"+example/escapes": "a; b\\c",
+		},
+		Params: [1]string{"bob"},
+	}
+
+	data, err := marshalItem(&item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result history.Item
+	if err := unmarshalItem(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result, item) {
+		t.Errorf("item changed in serialization: %#v", result)
+	}
+}
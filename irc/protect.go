@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// a FORCE request against a protected client must be confirmed
+	// by a second oper within this long
+	protectedConfirmTimeout = 5 * time.Minute
+)
+
+type protectedConfirmation struct {
+	operName string
+	expires  time.Time
+}
+
+// protectedActions tracks pending KILL FORCE and KLINE FORCE requests against
+// protected clients (NS PROTECT), each of which needs a second oper to confirm.
+type protectedActions struct {
+	sync.Mutex
+	pending map[string]protectedConfirmation
+}
+
+// confirm records a request by `operName` to perform `action`. It returns
+// true if a different oper made the same request recently, i.e., if this
+// request confirms theirs and the action may go ahead.
+func (pa *protectedActions) confirm(action, operName string, now time.Time) (confirmed bool) {
+	pa.Lock()
+	defer pa.Unlock()
+
+	for key, request := range pa.pending {
+		if now.After(request.expires) {
+			delete(pa.pending, key)
+		}
+	}
+	if request, ok := pa.pending[action]; ok && request.operName != operName {
+		delete(pa.pending, action)
+		return true
+	}
+	if pa.pending == nil {
+		pa.pending = make(map[string]protectedConfirmation)
+	}
+	pa.pending[action] = protectedConfirmation{
+		operName: operName,
+		expires:  now.Add(protectedConfirmTimeout),
+	}
+	return false
+}
+
+// IsProtected returns whether the client is logged into an account that is
+// protected from KILL and KLINE (NS PROTECT).
+func (client *Client) IsProtected() bool {
+	return client.Account() != "" && client.AccountSettings().Protected
+}
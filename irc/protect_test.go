@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProtectedActionConfirmation(t *testing.T) {
+	var pa protectedActions
+	now := time.Now()
+
+	if pa.confirm("KILL FORCE bot", "alice", now) {
+		t.Errorf("first request should not be confirmed")
+	}
+	if pa.confirm("KILL FORCE bot", "alice", now) {
+		t.Errorf("an oper can't confirm their own request")
+	}
+	if pa.confirm("KILL FORCE otherbot", "bob", now) {
+		t.Errorf("a request for a different action should not confirm")
+	}
+	if !pa.confirm("KILL FORCE bot", "bob", now) {
+		t.Errorf("a second oper should confirm the request")
+	}
+	// the confirmation is consumed
+	if pa.confirm("KILL FORCE bot", "carol", now) {
+		t.Errorf("a confirmed request should not be reusable")
+	}
+
+	// requests expire
+	pa.confirm("KLINE FORCE *!*@example.com", "alice", now)
+	if pa.confirm("KLINE FORCE *!*@example.com", "bob", now.Add(protectedConfirmTimeout+time.Second)) {
+		t.Errorf("an expired request should not be confirmed")
+	}
+}
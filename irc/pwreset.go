@@ -0,0 +1,149 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/oragono/oragono/irc/custime"
+	"github.com/oragono/oragono/irc/utils"
+	"github.com/tidwall/buntdb"
+)
+
+// password resets let users who have forgotten their password regain access
+// to their account: NS SENDPASS mails a single-use token to the account's
+// e-mail address, and NS RESETPASS exchanges it for a new password.
+
+const (
+	defaultPasswordResetCooldown = time.Hour
+	defaultPasswordResetTimeout  = 24 * time.Hour
+)
+
+// PasswordResetConfig controls NS SENDPASS and NS RESETPASS.
+type PasswordResetConfig struct {
+	Enabled bool
+	// minimum time between two reset e-mails for the same account
+	Cooldown custime.Duration
+	// how long a reset token remains valid
+	Timeout custime.Duration
+}
+
+func (conf *PasswordResetConfig) prepare() {
+	if conf.Cooldown <= 0 {
+		conf.Cooldown = custime.Duration(defaultPasswordResetCooldown)
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = custime.Duration(defaultPasswordResetTimeout)
+	}
+}
+
+func passwordResetEnabled(config *Config) bool {
+	return config.Accounts.Registration.PasswordReset.Enabled &&
+		config.Accounts.Registration.EmailVerification.Enabled
+}
+
+type passwordResetToken struct {
+	Code      string
+	Timestamp time.Time
+}
+
+// SendPasswordReset mails a password reset token to the account's e-mail
+// address.
+func (am *AccountManager) SendPasswordReset(client *Client, account string) (err error) {
+	config := am.server.Config()
+	resetConfig := config.Accounts.Registration.PasswordReset
+	if !passwordResetEnabled(config) {
+		return errFeatureDisabled
+	} else if am.server.ReadOnly() {
+		return errReadOnly
+	}
+	accountData, err := am.LoadAccount(account)
+	if err != nil {
+		return
+	} else if !accountData.Verified {
+		return errAccountUnverified
+	} else if accountData.Email == "" {
+		return errAccountNoEmail
+	}
+	address := accountData.Email
+
+	now := time.Now().UTC()
+	code := utils.GenerateSecretToken()
+	tokenStr, err := json.Marshal(passwordResetToken{Code: code, Timestamp: now})
+	if err != nil {
+		return
+	}
+	resetKey := fmt.Sprintf(keyAccountPasswordReset, accountData.NameCasefolded)
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		if oldStr, err := tx.Get(resetKey); err == nil {
+			var old passwordResetToken
+			if json.Unmarshal([]byte(oldStr), &old) == nil && now.Sub(old.Timestamp) < time.Duration(resetConfig.Cooldown) {
+				return errLimitExceeded
+			}
+		}
+		_, _, err := tx.Set(resetKey, string(tokenStr), &buntdb.SetOptions{Expires: true, TTL: time.Duration(resetConfig.Timeout)})
+		return err
+	})
+	if err != nil {
+		return
+	}
+
+	subject := fmt.Sprintf(client.t("Reset your password on %s"), am.server.name)
+	err = am.sendMail(address, subject, []string{
+		fmt.Sprintf(client.t("Account: %s"), accountData.Name),
+		fmt.Sprintf(client.t("Reset code: %s"), code),
+		"",
+		client.t("To set a new password, issue the following command:"),
+		fmt.Sprintf("/MSG NickServ RESETPASS %s %s <new password>", accountData.Name, code),
+		"",
+		client.t("If you did not request a password reset, you can ignore this message."),
+	})
+	if err != nil {
+		// let them try again
+		am.server.store.Update(func(tx *buntdb.Tx) error {
+			tx.Delete(resetKey)
+			return nil
+		})
+		return errCallbackFailed
+	}
+	return
+}
+
+// ResetPassword sets a new password for an account, consuming a token
+// sent by SendPasswordReset.
+func (am *AccountManager) ResetPassword(account, code, newPassword string) (err error) {
+	config := am.server.Config()
+	if !passwordResetEnabled(config) {
+		return errFeatureDisabled
+	}
+	casefoldedAccount, err := CasefoldName(account)
+	if err != nil {
+		return errAccountDoesNotExist
+	}
+	// check this before consuming the token:
+	if validatePassphrase(newPassword) != nil {
+		return errAccountBadPassphrase
+	}
+
+	resetKey := fmt.Sprintf(keyAccountPasswordReset, casefoldedAccount)
+	err = am.server.store.Update(func(tx *buntdb.Tx) error {
+		var token passwordResetToken
+		tokenStr, err := tx.Get(resetKey)
+		if err == nil {
+			err = json.Unmarshal([]byte(tokenStr), &token)
+		}
+		if err != nil || !utils.SecretTokensMatch(token.Code, code) ||
+			time.Duration(config.Accounts.Registration.PasswordReset.Timeout) < time.Since(token.Timestamp) {
+			return errAccountVerificationInvalidCode
+		}
+		tx.Delete(resetKey)
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	return am.setPassword(casefoldedAccount, newPassword, false)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/passwd"
+	"github.com/tidwall/buntdb"
+)
+
+func TestResetPassword(t *testing.T) {
+	store, err := buntdb.Open(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	server := newTestServer()
+	server.store = store
+	am := &AccountManager{server: server}
+	assertEqual(am.ResetPassword("alice", "s3cret", "hunter2"), errFeatureDisabled, t)
+
+	config := server.Config()
+	config.Accounts.Registration.EmailVerification.Enabled = true
+	config.Accounts.Registration.PasswordReset.Enabled = true
+	config.Accounts.Registration.PasswordReset.prepare()
+	config.Accounts.Registration.BcryptCost = uint(passwd.MinCost)
+
+	setToken := func(issued time.Time) {
+		store.Update(func(tx *buntdb.Tx) error {
+			tx.Set(fmt.Sprintf(keyAccountPasswordReset, "alice"), fmt.Sprintf(`{"Code":"s3cret","Timestamp":"%s"}`, issued.Format(time.RFC3339)), nil)
+			return nil
+		})
+	}
+	creds := AccountCredentials{Version: 1}
+	creds.SetPassphrase("forgotten", uint(passwd.MinCost))
+	credStr, _ := creds.Serialize()
+	store.Update(func(tx *buntdb.Tx) error {
+		tx.Set(fmt.Sprintf(keyAccountExists, "alice"), "1", nil)
+		tx.Set(fmt.Sprintf(keyAccountVerified, "alice"), "1", nil)
+		tx.Set(fmt.Sprintf(keyAccountName, "alice"), "alice", nil)
+		tx.Set(fmt.Sprintf(keyAccountCredentials, "alice"), credStr, nil)
+		return nil
+	})
+	setToken(time.Now().UTC())
+
+	assertEqual(am.ResetPassword("alice", "wrong", "hunter2"), errAccountVerificationInvalidCode, t)
+	// an invalid password doesn't consume the token:
+	assertEqual(am.ResetPassword("alice", "s3cret", ""), errAccountBadPassphrase, t)
+	assertEqual(am.ResetPassword("alice", "s3cret", "hunter2"), nil, t)
+	account, err := am.LoadAccount("alice")
+	assertEqual(err, nil, t)
+	assertEqual(passwd.CompareHashAndPassword(account.Credentials.PassphraseHash, []byte("hunter2")), nil, t)
+	// tokens are single-use:
+	assertEqual(am.ResetPassword("alice", "s3cret", "hunter3"), errAccountVerificationInvalidCode, t)
+
+	// and expire:
+	setToken(time.Now().UTC().Add(-25 * time.Hour))
+	assertEqual(am.ResetPassword("alice", "s3cret", "hunter3"), errAccountVerificationInvalidCode, t)
+}
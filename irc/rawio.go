@@ -0,0 +1,142 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// when raw I/O logging is enabled, credentials are redacted from logged
+// lines: passwords, SASL payloads, and tokens that would let the holder of
+// the log impersonate a user.
+
+const redactedParam = "<redacted>"
+
+var (
+	// for each command sent by clients, the index of the first parameter
+	// to redact
+	rawInputRedactions = map[string]int{
+		"AUTHENTICATE": 0,
+		"OPER":         1,
+		"PASS":         0,
+		"REGISTER":     1,
+		"RESUME":       0,
+		"VERIFY":       1,
+		"WEBIRC":       0,
+	}
+
+	// likewise, for commands sent by the server
+	rawOutputRedactions = map[string]int{
+		"EXTJWT": 2,
+		"RESUME": 1,
+	}
+
+	// service commands whose parameters are redacted, by lowercase service name
+	sensitiveServiceCommands = map[string]map[string]bool{
+		"nickserv": {
+			"erase":      true,
+			"identify":   true,
+			"passwd":     true,
+			"register":   true,
+			"saregister": true,
+			"unregister": true,
+			"verify":     true,
+		},
+		"hostserv": {
+			"setcloaksecret": true,
+		},
+	}
+)
+
+// redactRawLine returns a raw protocol line, with any credentials it carries
+// replaced by a placeholder, for logging purposes. Client input may use
+// command aliases from `aliases`.
+func redactRawLine(line string, output bool, aliases map[string]*commandAlias) string {
+	msg, err := ircmsg.ParseLine(line)
+	if err != nil {
+		return line
+	}
+
+	redactions := rawInputRedactions
+	if output {
+		redactions = rawOutputRedactions
+	}
+	redacted := false
+	if index, ok := redactions[msg.Command]; ok {
+		redacted = redactParams(&msg, index)
+	} else if alias := aliases[msg.Command]; alias != nil && alias.sensitive {
+		redacted = redactParams(&msg, 0)
+	} else if service, ok := oragonoServicesByCommandAlias[msg.Command]; ok {
+		redacted = redactServiceCommand(&msg, 0, service)
+	} else if (msg.Command == "PRIVMSG" || msg.Command == "NOTICE") && len(msg.Params) != 0 {
+		// every service's name is also a command alias for it:
+		if service, ok := oragonoServicesByCommandAlias[strings.ToUpper(msg.Params[0])]; ok {
+			redacted = redactServiceCommand(&msg, 1, service)
+		}
+	}
+	if !redacted {
+		return line
+	}
+	result, err := msg.Line()
+	if err != nil {
+		return redactedParam
+	}
+	return strings.TrimSuffix(result, "\r\n")
+}
+
+func redactParams(msg *ircmsg.IrcMessage, index int) (redacted bool) {
+	for i := index; i < len(msg.Params); i++ {
+		// keep the framing of SASL exchanges, which is not sensitive:
+		if msg.Command == "AUTHENTICATE" && isSaslFraming(msg.Params[i]) {
+			continue
+		}
+		msg.Params[i] = redactedParam
+		redacted = true
+	}
+	return
+}
+
+// isSaslFraming returns whether an AUTHENTICATE parameter is an abort, an
+// empty response, or a mechanism name (these are in uppercase, unlike
+// base64-encoded payloads)
+func isSaslFraming(param string) bool {
+	if param == "+" || param == "*" {
+		return true
+	}
+	for _, r := range param {
+		if !(('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return param != ""
+}
+
+// redactServiceCommand redacts the arguments of a sensitive service command,
+// whose text begins at msg.Params[index].
+func redactServiceCommand(msg *ircmsg.IrcMessage, index int, service *ircService) (redacted bool) {
+	if len(msg.Params) <= index {
+		return false
+	}
+	fields := strings.Fields(strings.Join(msg.Params[index:], " "))
+	if len(fields) < 2 {
+		return false
+	}
+	subcommand := strings.ToLower(fields[0])
+	sensitive := sensitiveServiceCommands[strings.ToLower(service.Name)][subcommand]
+	if !sensitive && (subcommand == "set" || subcommand == "saset") {
+		// NS SET PASSWORD, NS SASET <account> PASSWORD
+		for i := 1; i < len(fields) && i < 3; i++ {
+			if key := strings.ToLower(fields[i]); key == "password" || key == "pass" {
+				sensitive = true
+			}
+		}
+	}
+	if !sensitive {
+		return false
+	}
+	msg.Params = append(msg.Params[:index], fields[0]+" "+redactedParam)
+	return true
+}
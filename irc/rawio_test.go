@@ -0,0 +1,40 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+)
+
+func TestRedactRawLine(t *testing.T) {
+	input := func(line, expected string) {
+		t.Helper()
+		assertEqual(redactRawLine(line, false, nil), expected, t)
+	}
+
+	// lines without credentials are untouched, even if not canonical:
+	input("PRIVMSG #chan :hi there", "PRIVMSG #chan :hi there")
+	input("PRIVMSG NickServ :info", "PRIVMSG NickServ :info")
+	input("NS INFO  shivaram", "NS INFO  shivaram")
+
+	input("PASS hunter2", "PASS <redacted>")
+	input("OPER admin :hunter2", "OPER admin <redacted>")
+	input("AUTHENTICATE PLAIN", "AUTHENTICATE PLAIN")
+	input("AUTHENTICATE AGRhbgBodW50ZXIy", "AUTHENTICATE <redacted>")
+	input("AUTHENTICATE +", "AUTHENTICATE +")
+	input("REGISTER * hunter2", "REGISTER * <redacted>")
+	input("WEBIRC password gateway host 1.2.3.4", "WEBIRC <redacted> <redacted> <redacted> <redacted>")
+
+	input("NS IDENTIFY dan hunter2", "NS :IDENTIFY <redacted>")
+	input("NICKSERV :register hunter2", "NICKSERV :register <redacted>")
+	input("@label=1 PRIVMSG nickserv :identify hunter2", "@label=1 PRIVMSG nickserv :identify <redacted>")
+	input("NS SET password hunter2", "NS :SET <redacted>")
+	input("NS SASET dan PASSWORD hunter2", "NS :SASET <redacted>")
+	input("NS SET email dan@example.com", "NS SET email dan@example.com")
+	input("HS SETCLOAKSECRET s3cr3t", "HS :SETCLOAKSECRET <redacted>")
+
+	assertEqual(redactRawLine(":irc.example.com RESUME TOKEN abcdef", true, nil), ":irc.example.com RESUME TOKEN <redacted>", t)
+	assertEqual(redactRawLine(":irc.example.com EXTJWT #chan * eyJhbGciOi", true, nil), ":irc.example.com EXTJWT #chan * <redacted>", t)
+	assertEqual(redactRawLine(":irc.example.com NOTICE dan :PASS hunter2", true, nil), ":irc.example.com NOTICE dan :PASS hunter2", t)
+}
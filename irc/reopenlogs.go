@@ -0,0 +1,19 @@
+// +build !windows,!plan9
+
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// on SIGUSR1, the server reopens its log files, e.g., after an external
+// log rotation tool has moved them aside
+
+func notifyReopenLogsSignal(reopenLogsSignal chan os.Signal) {
+	signal.Notify(reopenLogsSignal, syscall.SIGUSR1)
+}
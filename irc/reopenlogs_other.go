@@ -0,0 +1,15 @@
+// +build windows plan9
+
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"os"
+)
+
+// there is no SIGUSR1 on these platforms; log files are reopened on rehash
+
+func notifyReopenLogsSignal(reopenLogsSignal chan os.Signal) {
+}
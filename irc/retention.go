@@ -0,0 +1,100 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oragono/oragono/irc/custime"
+	"github.com/oragono/oragono/irc/history"
+)
+
+// HistoryRetention is a channel founder's limit on how much of the channel's
+// history is kept (CS SET RETENTION). It can only tighten the server-wide
+// limits; zero values mean that the server-wide limits apply.
+type HistoryRetention struct {
+	MaxAge   time.Duration `json:",omitempty"`
+	MaxLines int           `json:",omitempty"`
+}
+
+// ParseHistoryRetention parses a specification like `30d 500`: a maximum age,
+// a maximum number of lines, or both. The specification `default` removes
+// the limits.
+func ParseHistoryRetention(spec string) (result HistoryRetention, err error) {
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return result, errInvalidParams
+	}
+	if len(fields) == 1 && strings.ToLower(fields[0]) == "default" {
+		return
+	}
+	for _, field := range fields {
+		if lines, convErr := strconv.Atoi(field); convErr == nil {
+			if lines <= 0 || result.MaxLines != 0 {
+				return HistoryRetention{}, errInvalidParams
+			}
+			result.MaxLines = lines
+		} else if age, durErr := custime.ParseDuration(field); durErr == nil && age > 0 && result.MaxAge == 0 {
+			result.MaxAge = age
+		} else {
+			return HistoryRetention{}, errInvalidParams
+		}
+	}
+	return
+}
+
+func (retention HistoryRetention) String() string {
+	var limits []string
+	if retention.MaxAge != 0 {
+		limits = append(limits, fmt.Sprintf("at most %v old", retention.MaxAge))
+	}
+	if retention.MaxLines != 0 {
+		limits = append(limits, fmt.Sprintf("at most %d lines", retention.MaxLines))
+	}
+	if len(limits) == 0 {
+		return "default"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// limitLength applies the line limit to the length of an in-memory buffer.
+func (retention HistoryRetention) limitLength(length int) int {
+	if retention.MaxLines != 0 && retention.MaxLines < length {
+		return retention.MaxLines
+	}
+	return length
+}
+
+// limitCutoff applies the age limit to a cutoff for history playback.
+func (retention HistoryRetention) limitCutoff(cutoff time.Time) time.Time {
+	if retention.MaxAge != 0 {
+		ageCutoff := time.Now().UTC().Add(-retention.MaxAge)
+		if ageCutoff.After(cutoff) {
+			return ageCutoff
+		}
+	}
+	return cutoff
+}
+
+// setHistoryRetention informs the persistent history database of a channel's
+// retention limits, so that its expiration job can enforce them.
+func (server *Server) setHistoryRetention(cfchannel string, retention HistoryRetention) {
+	server.historyDB.SetRetentionPolicy(cfchannel, history.RetentionPolicy{
+		MaxAge:   retention.MaxAge,
+		MaxLines: retention.MaxLines,
+	})
+}
+
+// loadHistoryRetention registers the retention limits of every registered
+// channel, loaded or not, with the persistent history database.
+func (server *Server) loadHistoryRetention() {
+	for cfchannel, settings := range server.channelRegistry.AllSettings() {
+		if settings.Retention != (HistoryRetention{}) {
+			server.setHistoryRetention(cfchannel, settings.Retention)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseHistoryRetention(t *testing.T) {
+	retention, err := ParseHistoryRetention("30d 500")
+	assertEqual(err, nil, t)
+	assertEqual(retention, HistoryRetention{MaxAge: 30 * 24 * time.Hour, MaxLines: 500}, t)
+
+	retention, err = ParseHistoryRetention("100")
+	assertEqual(err, nil, t)
+	assertEqual(retention, HistoryRetention{MaxLines: 100}, t)
+
+	retention, err = ParseHistoryRetention("Default")
+	assertEqual(err, nil, t)
+	assertEqual(retention, HistoryRetention{}, t)
+	assertEqual(retention.String(), "default", t)
+
+	for _, spec := range []string{"", "0", "-5", "1h 2h", "5 10", "forever", "1h 5 10"} {
+		if _, err := ParseHistoryRetention(spec); err == nil {
+			t.Errorf("accepted invalid retention %#v", spec)
+		}
+	}
+}
+
+func TestHistoryRetentionLimits(t *testing.T) {
+	var none HistoryRetention
+	assertEqual(none.limitLength(1024), 1024, t)
+	cutoff := time.Now().UTC().Add(-time.Hour)
+	assertEqual(none.limitCutoff(cutoff), cutoff, t)
+
+	retention := HistoryRetention{MaxAge: 2 * time.Hour, MaxLines: 100}
+	assertEqual(retention.limitLength(1024), 100, t)
+	assertEqual(retention.limitLength(50), 50, t)
+	// the stricter of the two cutoffs applies:
+	assertEqual(retention.limitCutoff(cutoff), cutoff, t)
+	if limited := retention.limitCutoff(time.Time{}); time.Since(limited) > 2*time.Hour+time.Minute {
+		t.Errorf("age limit not applied to cutoff: %v", limited)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/oragono/oragono/irc/caps"
 	"github.com/oragono/oragono/irc/history"
 	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/utils"
@@ -29,13 +30,18 @@ func sendRoleplayMessage(server *Server, client *Client, source string, targetSt
 	}
 
 	var sourceMask string
+	// messages are tagged with the kind of roleplay command that sent them,
+	// and attributed to the sender's account, so that history replays them
+	// in the same way as they were originally delivered
+	tags := map[string]string{caps.RoleplayTagName: "npc"}
 	if isScene {
+		tags[caps.RoleplayTagName] = "scene"
 		sourceMask = fmt.Sprintf(sceneNickMask, client.Nick())
 	} else {
 		cfSource, cfSourceErr := CasefoldName(source)
 		skelSource, skelErr := Skeleton(source)
 		if cfSourceErr != nil || skelErr != nil ||
-			restrictedCasefoldedNicks.Has(cfSource) || restrictedSkeletons.Has(skelSource) {
+			config.isRestrictedNick(cfSource, skelSource) {
 			rb.Add(nil, client.server.name, ERR_CANNOTSENDRP, targetString, client.t("Invalid roleplay name"))
 			return
 		}
@@ -64,6 +70,7 @@ func sendRoleplayMessage(server *Server, client *Client, source string, targetSt
 	}
 
 	splitMessage := utils.MakeMessage(buf.String())
+	details := client.Details()
 
 	target, cerr := CasefoldChannel(targetString)
 	if cerr == nil {
@@ -95,18 +102,20 @@ func sendRoleplayMessage(server *Server, client *Client, source string, targetSt
 				// of roleplay commands, so send them a copy whether they have echo-message
 				// or not
 				if rb.session == session {
-					rb.AddSplitMessageFromClient(sourceMask, "", nil, "PRIVMSG", targetString, splitMessage)
+					rb.AddSplitMessageFromClient(sourceMask, details.accountName, tags, "PRIVMSG", targetString, splitMessage)
 				} else {
-					session.sendSplitMsgFromClientInternal(false, sourceMask, "*", nil, "PRIVMSG", targetString, splitMessage)
+					session.sendSplitMsgFromClientInternal(false, sourceMask, details.accountName, roleplayTagsFor(session, tags), "PRIVMSG", targetString, splitMessage)
 				}
 			}
 		}
 
-		channel.AddHistoryItem(history.Item{
-			Type:    history.Privmsg,
-			Message: splitMessage,
-			Nick:    sourceMask,
-		}, client.Account())
+		channel.addLimitedHistoryItem(history.Item{
+			Type:        history.Privmsg,
+			Message:     splitMessage,
+			Nick:        sourceMask,
+			AccountName: details.accountName,
+			Tags:        tags,
+		}, details.account, client.authoredHistoryLimit())
 	} else {
 		target, err := CasefoldName(targetString)
 		user := server.clients.Get(target)
@@ -121,13 +130,37 @@ func sendRoleplayMessage(server *Server, client *Client, source string, targetSt
 		}
 
 		cnick := client.Nick()
-		tnick := user.Nick()
+		tDetails := user.Details()
+		tnick := tDetails.nick
 		for _, session := range user.Sessions() {
-			session.sendSplitMsgFromClientInternal(false, sourceMask, "*", nil, "PRIVMSG", tnick, splitMessage)
+			session.sendSplitMsgFromClientInternal(false, sourceMask, details.accountName, roleplayTagsFor(session, tags), "PRIVMSG", tnick, splitMessage)
 		}
 		if away, awayMessage := user.Away(); away {
 			//TODO(dan): possibly implement cooldown of away notifications to users
 			rb.Add(nil, server.name, RPL_AWAY, cnick, tnick, awayMessage)
 		}
+
+		if config.History.Enabled {
+			// addHistoryItem attributes the item to details.nickMask:
+			details.nickMask = sourceMask
+			client.addHistoryItem(user, history.Item{
+				Type:    history.Privmsg,
+				Message: splitMessage,
+				Tags:    tags,
+			}, &details, &tDetails, config)
+		}
 	}
 }
+
+func roleplayTagsFor(session *Session, tags map[string]string) map[string]string {
+	if session.capabilities.Has(caps.MessageTags) {
+		return tags
+	}
+	return nil
+}
+
+// isRoleplayItem returns whether a history item was sent by a roleplay command.
+func isRoleplayItem(item *history.Item) bool {
+	_, ok := item.Tags[caps.RoleplayTagName]
+	return ok
+}
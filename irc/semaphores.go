@@ -29,6 +29,8 @@ type ServerSemaphores struct {
 	ClientDestroy utils.Semaphore
 	IPCheckScript utils.Semaphore
 	AuthScript    utils.Semaphore
+	// workers delivering messages to large channels (see fanout.go)
+	Fanout utils.Semaphore
 }
 
 // Initialize initializes a set of server semaphores.
@@ -15,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 	"unsafe"
@@ -28,6 +29,7 @@ import (
 	"github.com/oragono/oragono/irc/logger"
 	"github.com/oragono/oragono/irc/modes"
 	"github.com/oragono/oragono/irc/mysql"
+	"github.com/oragono/oragono/irc/postgresql"
 	"github.com/oragono/oragono/irc/sno"
 	"github.com/oragono/oragono/irc/utils"
 	"github.com/tidwall/buntdb"
@@ -74,37 +76,77 @@ type Server struct {
 	nameCasefolded    string
 	rehashMutex       sync.Mutex // tier 4
 	rehashSignal      chan os.Signal
+	upgradeSignal     chan os.Signal
+	reopenLogsSignal  chan os.Signal
 	pprofServer       *http.Server
+	cloakRotation     *time.Timer
 	resumeManager     ResumeManager
 	signals           chan os.Signal
 	snomasks          SnoManager
 	store             *buntdb.DB
-	historyDB         mysql.MySQL
+	historyDB         historyDatabase
+	mysqlHistory      mysql.MySQL
+	postgresHistory   postgresql.PostgreSQL
 	torLimiter        connection_limits.TorLimiter
 	whoWas            WhoWasList
 	stats             Stats
 	semaphores        ServerSemaphores
+	hostnames         HostnameResolver
+	broadcaster       clientBroadcaster
+	fanoutStats       fanoutStats
+	reapStats         reapStats
+	servicesLink      ServicesLink
+	webchat           WebchatManager
+	webhooks          WebhookManager
+	maintenance       MaintenanceMode
 	defcon            uint32
+	readOnly          uint32
+	draining          uint32
+	deferredHistory   deferredHistoryWrites
+	historyQueue      historyWriteQueue
+	blockedCounters   blockedMessageCounters
+	protectedActions  protectedActions
+	tlsTickets        TLSTicketKeys
+	onionService      OnionService
+}
+
+// maximum number of persistent history writes to queue during READONLY
+const maxDeferredHistoryWrites = 1 << 16
+
+// persistent history writes that were paused by READONLY
+type deferredHistoryWrites struct {
+	sync.Mutex
+	writes  []func() error
+	dropped int
 }
 
 // NewServer returns a new Oragono server.
 func NewServer(config *Config, logger *logger.Manager) (*Server, error) {
 	// initialize data structures
 	server := &Server{
-		ctime:        time.Now().UTC(),
-		listeners:    make(map[string]IRCListener),
-		logger:       logger,
-		rehashSignal: make(chan os.Signal, 1),
-		signals:      make(chan os.Signal, len(ServerExitSignals)),
-		defcon:       5,
+		ctime:            time.Now().UTC(),
+		listeners:        make(map[string]IRCListener),
+		logger:           logger,
+		rehashSignal:     make(chan os.Signal, 1),
+		upgradeSignal:    make(chan os.Signal, 1),
+		reopenLogsSignal: make(chan os.Signal, 1),
+		signals:          make(chan os.Signal, len(ServerExitSignals)),
+		defcon:           5,
 	}
 
 	server.clients.Initialize()
+	server.broadcaster.Initialize(server)
 	server.semaphores.Initialize()
 	server.resumeManager.Initialize(server)
+	server.servicesLink.Initialize(server)
+	server.webchat.Initialize(server)
+	server.webhooks.Initialize(server)
+	server.onionService.Initialize(server)
 	server.whoWas.Initialize(config.Limits.WhowasEntries)
 	server.monitorManager.Initialize()
-	server.snomasks.Initialize()
+	server.snomasks.Initialize(server)
+	// replaced by the PostgreSQL backend if it's configured:
+	server.historyDB = &server.mysqlHistory
 
 	if err := server.applyConfig(config); err != nil {
 		return nil, err
@@ -113,6 +155,8 @@ func NewServer(config *Config, logger *logger.Manager) (*Server, error) {
 	// Attempt to clean up when receiving these signals.
 	signal.Notify(server.signals, ServerExitSignals...)
 	signal.Notify(server.rehashSignal, syscall.SIGHUP)
+	notifyUpgradeSignal(server.upgradeSignal)
+	notifyReopenLogsSignal(server.reopenLogsSignal)
 
 	return server, nil
 }
@@ -127,10 +171,14 @@ func (server *Server) Shutdown() {
 		}
 	}
 
+	server.saveThrottles()
+
 	if err := server.store.Close(); err != nil {
 		server.logger.Error("shutdown", fmt.Sprintln("Could not close datastore:", err))
 	}
 
+	// flush queued history writes before closing the history database
+	server.historyQueue.Close()
 	server.historyDB.Close()
 }
 
@@ -142,6 +190,7 @@ func (server *Server) Run() {
 	for {
 		select {
 		case <-server.signals:
+			server.drain(false)
 			server.Shutdown()
 			return
 
@@ -150,8 +199,83 @@ func (server *Server) Run() {
 				server.logger.Info("server", "Rehashing due to SIGHUP")
 				server.rehash()
 			}()
+
+		case <-server.reopenLogsSignal:
+			if err := server.logger.ReopenFiles(); err != nil {
+				server.logger.Error("server", "Could not reopen log files", err.Error())
+			} else {
+				server.logger.Info("server", "Reopened log files due to SIGUSR1")
+			}
+
+		case <-server.upgradeSignal:
+			server.logger.Info("server", "Starting graceful upgrade due to SIGUSR2")
+			if err := server.gracefulUpgrade(); err != nil {
+				server.logger.Error("server", "Graceful upgrade failed", err.Error())
+			} else {
+				return
+			}
+		}
+	}
+}
+
+// SetReadOnly enables or disables the network-wide read-only mode. When it is
+// disabled, queued history writes are replayed and any state that could not
+// be persisted in the meantime is written back to the datastore.
+func (server *Server) SetReadOnly(enabled bool) (changed bool) {
+	var newValue uint32
+	if enabled {
+		newValue = 1
+	}
+
+	server.deferredHistory.Lock()
+	changed = atomic.SwapUint32(&server.readOnly, newValue) != newValue
+	writes, dropped := server.deferredHistory.writes, server.deferredHistory.dropped
+	if !enabled {
+		server.deferredHistory.writes, server.deferredHistory.dropped = nil, 0
+	}
+	server.deferredHistory.Unlock()
+
+	if !enabled && changed {
+		if dropped != 0 {
+			server.logger.Warning("history", "dropped persistent history writes during read-only mode", strconv.Itoa(dropped))
+		}
+		go server.flushDeferredWrites(writes)
+	}
+	return
+}
+
+func (server *Server) flushDeferredWrites(writes []func() error) {
+	for _, write := range writes {
+		if err := write(); err != nil {
+			server.logger.Error("history", "could not perform deferred history write", err.Error())
+		}
+	}
+	for _, channel := range server.channels.Channels() {
+		channel.wakeWriter()
+	}
+	server.clients.Range(func(client *Client) bool {
+		if client.AlwaysOn() {
+			client.wakeWriter()
 		}
+		return true
+	})
+}
+
+// writeHistory performs a write to persistent history, or, in read-only mode,
+// queues it to be performed once read-only mode is disabled
+func (server *Server) writeHistory(write func() error) (err error) {
+	server.deferredHistory.Lock()
+	if server.ReadOnly() {
+		if len(server.deferredHistory.writes) < maxDeferredHistoryWrites {
+			server.deferredHistory.writes = append(server.deferredHistory.writes, write)
+		} else {
+			server.deferredHistory.dropped++
+		}
+		server.deferredHistory.Unlock()
+		return nil
 	}
+	server.deferredHistory.Unlock()
+	return write()
 }
 
 func (server *Server) checkBans(config *Config, ipaddr net.IP, checkScripts bool) (banned bool, requireSASL bool, message string) {
@@ -160,6 +284,10 @@ func (server *Server) checkBans(config *Config, ipaddr net.IP, checkScripts bool
 			return true, false, "New connections to this server are temporarily restricted"
 		}
 	}
+	if banned, message := server.checkMaintenance(ipaddr); banned {
+		server.logger.Info("connect-ip", "Client rejected by maintenance mode", ipaddr.String())
+		return true, false, message
+	}
 
 	flat := flatip.FromNetIP(ipaddr)
 
@@ -170,6 +298,14 @@ func (server *Server) checkBans(config *Config, ipaddr net.IP, checkScripts bool
 		return true, false, info.BanMessage("You are banned from this server (%s)")
 	}
 
+	// check DLINEs on the IP's autonomous system
+	if asn := config.Server.asnDatabase.Lookup(flat); asn != 0 {
+		if isBanned, info := server.dlines.CheckASN(asn); isBanned {
+			server.logger.Info("connect-ip", "Client rejected by ASN d-line", ipaddr.String(), fmt.Sprintf("AS%d", asn))
+			return true, false, info.BanMessage("You are banned from this server (%s)")
+		}
+	}
+
 	// check connection limits
 	err := server.connectionLimiter.AddClient(flat)
 	if err == connection_limits.ErrLimitExceeded {
@@ -182,6 +318,12 @@ func (server *Server) checkBans(config *Config, ipaddr net.IP, checkScripts bool
 	} else if err != nil {
 		server.logger.Warning("internal", "unexpected ban result", err.Error())
 	}
+	// slow-loris hardening: limit connections that haven't completed registration
+	if server.connectionLimiter.AddUnregistered(flat) != nil {
+		server.connectionLimiter.RemoveClient(flat)
+		server.logger.Info("connect-ip", "Client rejected for unregistered connection limit", ipaddr.String())
+		return true, false, "Too many unregistered connections from your network"
+	}
 
 	if checkScripts && config.Server.IPCheckScript.Enabled {
 		output, err := CheckIPBan(server.semaphores.IPCheckScript, config.Server.IPCheckScript, ipaddr)
@@ -205,6 +347,7 @@ func (server *Server) checkBans(config *Config, ipaddr net.IP, checkScripts bool
 		if output.Result == IPBanned {
 			// XXX roll back IP connection/throttling addition for the IP
 			server.connectionLimiter.RemoveClient(flat)
+			server.connectionLimiter.RemoveUnregistered(flat)
 			server.logger.Info("connect-ip", "Rejected client due to ip-check-script", ipaddr.String())
 			return true, false, output.BanMessage
 		} else if output.Result == IPRequireSASL {
@@ -216,6 +359,20 @@ func (server *Server) checkBans(config *Config, ipaddr net.IP, checkScripts bool
 	return false, false, ""
 }
 
+// checkHostnameBans checks D-lines on hostnames, which can't be done in
+// checkBans because the client's hostname isn't known yet at that point.
+func (server *Server) checkHostnameBans(session *Session) (banned bool, message string) {
+	// only resolved hostnames are subject to these bans
+	if session.isTor || session.rawHostname == utils.IPStringToHostname(session.IP().String()) {
+		return false, ""
+	}
+	if isBanned, info := server.dlines.CheckHostname(session.rawHostname); isBanned {
+		server.logger.Info("connect-ip", "Client rejected by hostname d-line", session.IP().String(), session.rawHostname)
+		return true, info.BanMessage("You are banned from this server (%s)")
+	}
+	return false, ""
+}
+
 func (server *Server) checkTorLimits() (banned bool, message string) {
 	switch server.torLimiter.AddClient() {
 	case connection_limits.ErrLimitExceeded:
@@ -235,13 +392,17 @@ func (server *Server) tryRegister(c *Client, session *Session) (exiting bool) {
 	// if the session just sent us a RESUME line, try to resume
 	if session.resumeDetails != nil {
 		session.tryResume()
+		if session.client != c {
+			session.releaseUnregistered()
+		}
 		return // whether we succeeded or failed, either way `c` is not getting registered
 	}
 
 	// XXX PROXY or WEBIRC MUST be sent as the first line of the session;
-	// if we are here at all that means we have the final value of the IP
-	if session.rawHostname == "" {
-		session.client.lookupHostname(session, false)
+	// if we are here at all that means we have the final value of the IP,
+	// so we can start looking up the hostname while registration proceeds
+	if session.rawHostname == "" && session.hostnameLookup == nil {
+		session.startHostnameLookup()
 	}
 
 	// try to complete registration normally
@@ -256,6 +417,15 @@ func (server *Server) tryRegister(c *Client, session *Session) (exiting bool) {
 		return true
 	}
 
+	if session.rawHostname == "" {
+		c.lookupHostname(session, false)
+	}
+	if banned, message := server.checkHostnameBans(session); banned {
+		session.FailNumeric(ERR_YOUREBANNEDCREEP, "*", "BANNED", message)
+		c.Quit(message, nil)
+		return true
+	}
+
 	// client MUST send PASS if necessary, or authenticate with SASL if necessary,
 	// before completing the other registration commands
 	config := server.Config()
@@ -264,13 +434,13 @@ func (server *Server) tryRegister(c *Client, session *Session) (exiting bool) {
 	switch authOutcome {
 	case authFailPass:
 		quitMessage = c.t("Password incorrect")
-		c.Send(nil, server.name, ERR_PASSWDMISMATCH, "*", quitMessage)
+		session.FailNumeric(ERR_PASSWDMISMATCH, "PASS", "PASSWORD_MISMATCH", quitMessage)
 	case authFailSaslRequired, authFailTorSaslRequired:
 		quitMessage = c.requireSASLMessage
 		if quitMessage == "" {
 			quitMessage = c.t("You must log in with SASL to join this server")
 		}
-		c.Send(nil, c.server.name, "FAIL", "*", "ACCOUNT_REQUIRED", quitMessage)
+		session.Fail("*", "ACCOUNT_REQUIRED", quitMessage)
 	}
 	if authOutcome != authSuccess {
 		c.Quit(quitMessage, nil)
@@ -288,6 +458,8 @@ func (server *Server) tryRegister(c *Client, session *Session) (exiting bool) {
 		c.preregNick = ""
 		return false
 	}
+	// the session is registered, either as `c` or by reattaching to another client
+	session.releaseUnregistered()
 
 	if session.client != c {
 		// reattached, bail out.
@@ -310,14 +482,45 @@ func (server *Server) tryRegister(c *Client, session *Session) (exiting bool) {
 	// check KLINEs
 	isBanned, info := server.klines.CheckMasks(c.AllNickmasks()...)
 	if isBanned {
-		c.Quit(info.BanMessage(c.t("You are banned from this server (%s)")), nil)
+		banMessage := info.BanMessage(c.t("You are banned from this server (%s)"))
+		session.FailNumeric(ERR_YOUREBANNEDCREEP, "*", "BANNED", banMessage)
+		c.Quit(banMessage, nil)
 		return true
 	}
 
+	// now that any SASL account is known, apply the connection class
+	c.updateConnectionClass()
+	session.resetFakelag()
+
 	server.playRegistrationBurst(session)
+
+	// this is after the burst, so clients see the JOINs once they know they're registered
+	if channels := c.autoJoinChannels(config); len(channels) != 0 {
+		rb = NewResponseBuffer(session)
+		server.autoJoin(c, channels, rb)
+		rb.Send(true)
+	}
 	return false
 }
 
+// autoJoinChannels returns the channels a client is joined to on registration:
+// those chosen for its account with NS SET AUTO-JOIN, or the server default.
+func (client *Client) autoJoinChannels(config *Config) []string {
+	if channels := client.AccountSettings().AutoJoin; channels != nil {
+		return *channels
+	}
+	return config.Channels.AutoJoin
+}
+
+// autoJoin joins a client to channels on its behalf, reporting failures as JOIN would.
+func (server *Server) autoJoin(client *Client, channels []string, rb *ResponseBuffer) {
+	for _, chname := range channels {
+		if err := server.channels.Join(client, chname, "", false, rb); err != nil {
+			sendJoinError(client, chname, rb, err)
+		}
+	}
+}
+
 func (server *Server) playSTSBurst(session *Session) {
 	nick := utils.SafeErrorParam(session.client.preregNick)
 	session.Send(nil, server.name, RPL_WELCOME, nick, fmt.Sprintf("Welcome to the Internet Relay Network %s", nick))
@@ -337,6 +540,7 @@ func (server *Server) playRegistrationBurst(session *Session) {
 	d := c.Details()
 	server.logger.Info("connect", fmt.Sprintf("Client connected [%s] [u:%s] [r:%s]", d.nick, d.username, d.realname))
 	server.snomasks.Send(sno.LocalConnects, fmt.Sprintf("Client connected [%s] [u:%s] [h:%s] [ip:%s] [r:%s]", d.nick, d.username, session.rawHostname, session.IP().String(), d.realname))
+	server.webhooks.Send(WebhookConnect, webhookData{"client": webhookClientData(c, d)})
 	if d.account != "" {
 		server.sendLoginSnomask(d.nickMask, d.accountName)
 	}
@@ -345,7 +549,7 @@ func (server *Server) playRegistrationBurst(session *Session) {
 	//NOTE(dan): we specifically use the NICK here instead of the nickmask
 	// see http://modern.ircdocs.horse/#rplwelcome-001 for details on why we avoid using the nickmask
 	config := server.Config()
-	session.Send(nil, server.name, RPL_WELCOME, d.nick, fmt.Sprintf(c.t("Welcome to the %s IRC Network %s"), config.Network.Name, d.nick))
+	session.Send(nil, server.name, RPL_WELCOME, d.nick, fmt.Sprintf(c.t("Welcome to the %s IRC Network %s"), session.networkName(config), d.nick))
 	session.Send(nil, server.name, RPL_YOURHOST, d.nick, fmt.Sprintf(c.t("Your host is %[1]s, running version %[2]s"), server.name, Ver))
 	session.Send(nil, server.name, RPL_CREATED, d.nick, fmt.Sprintf(c.t("This server was created %s"), server.ctime.Format(time.RFC1123)))
 	session.Send(nil, server.name, RPL_MYINFO, d.nick, server.name, Ver, rplMyInfo1, rplMyInfo2, rplMyInfo3)
@@ -373,12 +577,22 @@ func (server *Server) RplISupport(client *Client, rb *ResponseBuffer) {
 	translatedISupport := client.t("are supported by this server")
 	nick := client.Nick()
 	config := server.Config()
+	// the listener may override the NETWORK token
+	networkToken := "NETWORK=" + config.Network.Name
+	listenerNetworkToken := "NETWORK=" + rb.session.networkName(config)
 	for _, cachedTokenLine := range config.Server.isupport.CachedReply {
 		length := len(cachedTokenLine) + 2
 		tokenline := make([]string, length)
 		tokenline[0] = nick
 		copy(tokenline[1:], cachedTokenLine)
 		tokenline[length-1] = translatedISupport
+		if networkToken != listenerNetworkToken {
+			for i, token := range tokenline {
+				if token == networkToken {
+					tokenline[i] = listenerNetworkToken
+				}
+			}
+		}
 		rb.Add(nil, server.name, RPL_ISUPPORT, tokenline...)
 	}
 }
@@ -400,7 +614,11 @@ func (server *Server) Lusers(client *Client, rb *ResponseBuffer) {
 
 // MOTD serves the Message of the Day.
 func (server *Server) MOTD(client *Client, rb *ResponseBuffer) {
-	motdLines := server.Config().Server.motdLines
+	config := server.Config()
+	motdLines := config.Server.motdLines
+	if overrides := rb.session.listenerOverrides(config); overrides != nil && overrides.motdLines != nil {
+		motdLines = overrides.motdLines
+	}
 
 	if len(motdLines) < 1 {
 		rb.Add(nil, server.name, ERR_NOMOTD, client.nick, client.t("MOTD File is missing"))
@@ -415,27 +633,36 @@ func (server *Server) MOTD(client *Client, rb *ResponseBuffer) {
 }
 
 // WhoisChannelsNames returns the common channel names between two users.
-func (client *Client) WhoisChannelsNames(target *Client, multiPrefix bool) []string {
+// If sharedOnly is set, it omits channels that client is not in.
+func (client *Client) WhoisChannelsNames(target *Client, multiPrefix, sharedOnly bool) []string {
 	var chstrs []string
 	for _, channel := range target.Channels() {
-		// channel is secret and the target can't see it
-		if !client.HasMode(modes.Operator) {
-			if (target.HasMode(modes.Invisible) || channel.flags.HasMode(modes.Secret)) && !channel.hasClient(client) {
-				continue
-			}
+		if !channel.canSeeMember(client, target) || (sharedOnly && !channel.hasClient(client)) {
+			continue
 		}
 		chstrs = append(chstrs, channel.ClientPrefixes(target, multiPrefix)+channel.name)
 	}
 	return chstrs
 }
 
+// whoisPrivacy returns the privacy settings of target that apply to WHOIS
+// and WHO replies sent to client; they don't apply to target itself or opers.
+func (client *Client) whoisPrivacy(target *Client) (privacy AccountSettings) {
+	if client == target || client.HasMode(modes.Operator) {
+		return
+	}
+	return target.AccountSettings()
+}
+
 func (client *Client) getWhoisOf(target *Client, hasPrivs bool, rb *ResponseBuffer) {
 	cnick := client.Nick()
 	targetInfo := target.Details()
 	rb.Add(nil, client.server.name, RPL_WHOISUSER, cnick, targetInfo.nick, targetInfo.username, targetInfo.hostname, "*", targetInfo.realname)
 	tnick := targetInfo.nick
 
-	whoischannels := client.WhoisChannelsNames(target, rb.session.capabilities.Has(caps.MultiPrefix))
+	privacy := client.whoisPrivacy(target)
+
+	whoischannels := client.WhoisChannelsNames(target, rb.session.capabilities.Has(caps.MultiPrefix), privacy.HideChannels)
 	if whoischannels != nil {
 		rb.Add(nil, client.server.name, RPL_WHOISCHANNELS, cnick, tnick, strings.Join(whoischannels, " "))
 	}
@@ -449,12 +676,23 @@ func (client *Client) getWhoisOf(target *Client, hasPrivs bool, rb *ResponseBuff
 		rb.Add(nil, client.server.name, RPL_WHOISACTUALLY, cnick, tnick, fmt.Sprintf("%s@%s", targetInfo.username, target.RawHostname()), target.IPString(), client.t("Actual user@host, Actual IP"))
 		rb.Add(nil, client.server.name, RPL_WHOISMODES, cnick, tnick, fmt.Sprintf(client.t("is using modes +%s"), target.modes.String()))
 	}
-	if target.HasMode(modes.TLS) {
+	if target.HasMode(modes.TLS) && !privacy.HideTLS {
 		rb.Add(nil, client.server.name, RPL_WHOISSECURE, cnick, tnick, client.t("is using a secure connection"))
 	}
 	if targetInfo.accountName != "*" {
 		rb.Add(nil, client.server.name, RPL_WHOISACCOUNT, cnick, tnick, targetInfo.accountName, client.t("is logged in as"))
 	}
+	if targetInfo.accountName != "*" {
+		switch target.AccountSettings().AuthoredHistory {
+		case HistoryDisabled:
+			rb.Add(nil, client.server.name, RPL_WHOISSPECIAL, cnick, tnick, client.t("has opted out of message history: messages they send are not stored"))
+		case HistoryEphemeral:
+			rb.Add(nil, client.server.name, RPL_WHOISSPECIAL, cnick, tnick, client.t("has opted out of persistent message history: messages they send are not stored on disk"))
+		}
+	}
+	if target.bridge != "" {
+		rb.Add(nil, client.server.name, RPL_WHOISSPECIAL, cnick, tnick, fmt.Sprintf(client.t("is connected via the %s bridge"), target.bridge))
+	}
 	if target.HasMode(modes.Bot) {
 		rb.Add(nil, client.server.name, RPL_WHOISBOT, cnick, tnick, ircfmt.Unescape(fmt.Sprintf(client.t("is a $bBot$b on %s"), client.server.Config().Network.Name)))
 	}
@@ -464,9 +702,14 @@ func (client *Client) getWhoisOf(target *Client, hasPrivs bool, rb *ResponseBuff
 			if session.certfp != "" {
 				rb.Add(nil, client.server.name, RPL_WHOISCERTFP, cnick, tnick, fmt.Sprintf(client.t("has client certificate fingerprint %s"), session.certfp))
 			}
+			if proxiedTLS := session.proxiedTLS; proxiedTLS != nil {
+				rb.Add(nil, client.server.name, RPL_WHOISSPECIAL, cnick, tnick, fmt.Sprintf(client.t("is using TLS via a proxy (version %[1]s, cipher %[2]s, server name %[3]s)"), proxiedTLS.Version, proxiedTLS.Cipher, proxiedTLS.SNI))
+			}
 		}
 	}
-	rb.Add(nil, client.server.name, RPL_WHOISIDLE, cnick, tnick, strconv.FormatUint(target.IdleSeconds(), 10), strconv.FormatInt(target.SignonTime(), 10), client.t("seconds idle, signon time"))
+	if !privacy.HideIdle {
+		rb.Add(nil, client.server.name, RPL_WHOISIDLE, cnick, tnick, strconv.FormatUint(target.IdleSeconds(), 10), strconv.FormatInt(target.SignonTime(), 10), client.t("seconds idle, signon time"))
+	}
 	if away, awayMessage := target.Away(); away {
 		rb.Add(nil, client.server.name, RPL_AWAY, cnick, tnick, awayMessage)
 	}
@@ -551,7 +794,7 @@ func (server *Server) applyConfig(config *Config) (err error) {
 
 	// Translations
 	server.logger.Debug("server", "Regenerating HELP indexes for new languages")
-	server.helpIndexManager.GenerateIndices(config.languageManager)
+	server.helpIndexManager.GenerateIndices(config.languageManager, config.customHelp)
 
 	if initial {
 		maxIPConc := int(config.Server.IPCheckScript.MaxConcurrency)
@@ -562,12 +805,20 @@ func (server *Server) applyConfig(config *Config) (err error) {
 		if maxAuthConc != 0 {
 			server.semaphores.AuthScript.Initialize(maxAuthConc)
 		}
+		server.semaphores.Fanout.Initialize(config.Server.Fanout.MaxWorkers)
+		server.hostnames.Initialize(config)
 
 		if err := overrideServicePrefixes(config.Server.OverrideServicesHostname); err != nil {
 			return err
 		}
 	}
 
+	// a rehash only overrides /MAINTENANCE if the maintenance config changed:
+	if initial || oldConfig.Server.Maintenance != config.Server.Maintenance {
+		mConf := config.Server.Maintenance
+		server.maintenance.Set(mConf.Enabled, mConf.Message, mConf.RetryAfter)
+	}
+
 	if oldConfig != nil {
 		// if certain features were enabled by rehash, we need to load the corresponding data
 		// from the store
@@ -582,13 +833,17 @@ func (server *Server) applyConfig(config *Config) (err error) {
 			for _, channel := range server.channels.Channels() {
 				channel.resizeHistory(config)
 			}
-			for _, client := range server.clients.AllClients() {
+			server.clients.Range(func(client *Client) bool {
 				client.resizeHistory(config)
-			}
+				return true
+			})
 		}
 		if oldConfig.Accounts.Registration.Throttling != config.Accounts.Registration.Throttling {
 			server.accounts.resetRegisterThrottle(config)
 		}
+		if oldConfig.Server.ForwardConfirmHostnames != config.Server.ForwardConfirmHostnames {
+			server.hostnames.ClearCache()
+		}
 	}
 
 	server.logger.Info("server", "Using datastore", config.Datastore.Path)
@@ -598,14 +853,17 @@ func (server *Server) applyConfig(config *Config) (err error) {
 		}
 	} else {
 		if config.Datastore.MySQL.Enabled && config.Datastore.MySQL != oldConfig.Datastore.MySQL {
-			server.historyDB.SetConfig(config.Datastore.MySQL)
+			server.mysqlHistory.SetConfig(config.Datastore.MySQL)
+		}
+		if config.Datastore.PostgreSQL.Enabled && config.Datastore.PostgreSQL != oldConfig.Datastore.PostgreSQL {
+			server.postgresHistory.SetConfig(config.Datastore.PostgreSQL)
 		}
 	}
 
 	// now that the datastore is initialized, we can load the cloak secret from it
 	// XXX this modifies config after the initial load, which is naughty,
 	// but there's no data race because we haven't done SetConfig yet
-	config.Server.Cloaks.SetSecret(LoadCloakSecret(server.store))
+	server.loadCloakSecrets(config)
 
 	// activate the new config
 	server.SetConfig(config)
@@ -615,38 +873,41 @@ func (server *Server) applyConfig(config *Config) (err error) {
 		if err := server.loadFromDatastore(config); err != nil {
 			return err
 		}
+		go server.channelExpiryLoop()
+		go server.throttleSaveLoop()
 	}
 
 	// burst new and removed caps
 	addedCaps, removedCaps := config.Diff(oldConfig)
-	var capBurstSessions []*Session
-	added := make(map[caps.Version][]string)
-	var removed []string
-
 	if !addedCaps.Empty() || !removedCaps.Empty() {
-		capBurstSessions = server.clients.AllWithCapsNotify()
-
+		added := make(map[caps.Version][]string)
 		added[caps.Cap301] = addedCaps.Strings(caps.Cap301, config.Server.capValues, 0)
 		added[caps.Cap302] = addedCaps.Strings(caps.Cap302, config.Server.capValues, 0)
 		// removed never has values, so we leave it as Cap301
-		removed = removedCaps.Strings(caps.Cap301, config.Server.capValues, 0)
-	}
+		removed := removedCaps.Strings(caps.Cap301, config.Server.capValues, 0)
 
-	for _, sSession := range capBurstSessions {
-		// DEL caps and then send NEW ones so that updated caps get removed/added correctly
-		if !removedCaps.Empty() {
-			for _, capStr := range removed {
-				sSession.Send(nil, server.name, "CAP", sSession.client.Nick(), "DEL", capStr)
-			}
-		}
-		if !addedCaps.Empty() {
-			for _, capStr := range added[sSession.capVersion] {
-				sSession.Send(nil, server.name, "CAP", sSession.client.Nick(), "NEW", capStr)
+		server.broadcaster.Broadcast("CAP DEL/NEW", func(client *Client) {
+			for _, sSession := range client.Sessions() {
+				if !sSession.hasCapNotify() {
+					continue
+				}
+				// DEL caps and then send NEW ones so that updated caps get removed/added correctly
+				if !removedCaps.Empty() {
+					for _, capStr := range removed {
+						sSession.Send(nil, server.name, "CAP", client.Nick(), "DEL", capStr)
+					}
+				}
+				if !addedCaps.Empty() {
+					for _, capStr := range added[sSession.capVersion] {
+						sSession.Send(nil, server.name, "CAP", client.Nick(), "NEW", capStr)
+					}
+				}
 			}
-		}
+		})
 	}
 
 	server.setupPprofListener(config)
+	server.setupServicesLink(config)
 
 	// set RPL_ISUPPORT
 	var newISupportReplies [][]string
@@ -658,20 +919,30 @@ func (server *Server) applyConfig(config *Config) (err error) {
 		server.logger.Info("server", "Proxied IPs will be accepted from", strings.Join(config.Server.ProxyAllowedFrom, ", "))
 	}
 
+	// share TLS session ticket keys with the previous config's listeners:
+	if err := server.tlsTickets.Apply(config); err != nil {
+		return err
+	}
+
 	// we are now open for business
 	err = server.setupListeners(config)
+	if initial {
+		closeInheritedListeners()
+	}
+	server.onionService.Apply(config)
 
-	if !initial {
-		// push new info to all of our clients
-		for _, sClient := range server.clients.AllClients() {
+	// push new info to all of our clients
+	if len(newISupportReplies) != 0 {
+		server.broadcaster.Broadcast("RPL_ISUPPORT", func(sClient *Client) {
 			for _, tokenline := range newISupportReplies {
-				sClient.Send(nil, server.name, RPL_ISUPPORT, append([]string{sClient.nick}, tokenline...)...)
-			}
-
-			if sendRawOutputNotice {
-				sClient.Notice(sClient.t("This server is in debug mode and is logging all user I/O. If you do not wish for everything you send to be readable by the server owner(s), please disconnect."))
+				sClient.Send(nil, server.name, RPL_ISUPPORT, append([]string{sClient.Nick()}, tokenline...)...)
 			}
-		}
+		})
+	}
+	if !initial && sendRawOutputNotice {
+		server.broadcaster.Broadcast("raw I/O logging notice", func(sClient *Client) {
+			sClient.Notice(sClient.t("This server is in debug mode and is logging all user I/O. If you do not wish for everything you send to be readable by the server owner(s), please disconnect."))
+		})
 	}
 
 	return err
@@ -691,7 +962,8 @@ func (server *Server) setupPprofListener(config *Config) {
 	}
 	if pprofListener != "" && server.pprofServer == nil {
 		ps := http.Server{
-			Addr: pprofListener,
+			Addr:    pprofListener,
+			Handler: server.debugHandler(),
 		}
 		go func() {
 			if err := ps.ListenAndServe(); err != nil {
@@ -730,18 +1002,31 @@ func (server *Server) loadFromDatastore(config *Config) (err error) {
 	server.logger.Debug("server", "Loading D/Klines")
 	server.loadDLines()
 	server.loadKLines()
+	server.loadThrottles()
 
 	server.channelRegistry.Initialize(server)
 	server.channels.Initialize(server)
 	server.accounts.Initialize(server)
 
 	if config.Datastore.MySQL.Enabled {
-		server.historyDB.Initialize(server.logger, config.Datastore.MySQL)
-		err = server.historyDB.Open()
+		server.mysqlHistory.Initialize(server.logger, config.Datastore.MySQL)
+		err = server.mysqlHistory.Open()
 		if err != nil {
 			server.logger.Error("internal", "could not connect to mysql", err.Error())
 			return err
 		}
+		server.loadHistoryRetention()
+		server.historyQueue.Initialize(server)
+	} else if config.Datastore.PostgreSQL.Enabled {
+		server.postgresHistory.Initialize(server.logger, config.Datastore.PostgreSQL)
+		err = server.postgresHistory.Open()
+		if err != nil {
+			server.logger.Error("internal", "could not connect to postgresql", err.Error())
+			return err
+		}
+		server.historyDB = &server.postgresHistory
+		server.loadHistoryRetention()
+		server.historyQueue.Initialize(server)
 	}
 
 	return nil
@@ -857,7 +1142,19 @@ func (server *Server) GetHistorySequence(providedChannel *Channel, client *Clien
 		}
 	}
 
-	var cutoff time.Time
+	cutoff := server.historyCutoff(config, client, channel)
+
+	if hist != nil {
+		sequence = hist.MakeSequence(correspondent, cutoff)
+	} else if target != "" {
+		sequence = server.historyDB.MakeSequence(target, correspondent, cutoff)
+	}
+	return
+}
+
+// historyCutoff returns the time before which `client` may not retrieve history,
+// either from `channel` or (if `channel` is nil) from its own DMs
+func (server *Server) historyCutoff(config *Config, client *Client, channel *Channel) (cutoff time.Time) {
 	if config.History.Restrictions.ExpireTime != 0 {
 		cutoff = time.Now().UTC().Add(-time.Duration(config.History.Restrictions.ExpireTime))
 	}
@@ -873,15 +1170,66 @@ func (server *Server) GetHistorySequence(providedChannel *Channel, client *Clien
 	if !cutoff.IsZero() && channel != nil {
 		cutoff = cutoff.Add(-time.Duration(config.History.Restrictions.GracePeriod))
 	}
-
-	if hist != nil {
-		sequence = hist.MakeSequence(correspondent, cutoff)
-	} else if target != "" {
-		sequence = server.historyDB.MakeSequence(target, correspondent, cutoff)
+	// the founder's retention limit is applied after the grace period,
+	// since it is a promise that older messages are gone
+	if channel != nil {
+		cutoff = channel.Settings().Retention.limitCutoff(cutoff)
 	}
 	return
 }
 
+// ListHistoryTargets answers CHATHISTORY TARGETS, listing the client's channels
+// and DM correspondents whose latest message is between `start` and `end`
+func (server *Server) ListHistoryTargets(client *Client, start, end time.Time, limit int) (results []history.TargetListing) {
+	config := server.Config()
+
+	var channelListings []history.TargetListing
+	var persistent []string
+	cutoffs := make(map[string]time.Time)
+	for _, channel := range client.Channels() {
+		status, target := channel.historyStatus(config)
+		cutoff := server.historyCutoff(config, client, channel)
+		switch status {
+		case HistoryEphemeral:
+			items, _, err := channel.history.MakeSequence("", cutoff).Between(history.Selector{}, history.Selector{}, 1)
+			if err == nil && len(items) != 0 {
+				channelListings = append(channelListings, history.TargetListing{CfName: target, Time: items[0].Message.Time})
+			}
+		case HistoryPersistent:
+			// all persistent channels are looked up in a single query:
+			persistent = append(persistent, target)
+			cutoffs[target] = cutoff
+		}
+	}
+	if len(persistent) != 0 {
+		listings, err := server.historyDB.ListChannels(persistent)
+		if err != nil {
+			server.logger.Error("history", "could not list channel history", err.Error())
+		}
+		for _, listing := range listings {
+			if !listing.Time.Before(cutoffs[listing.CfName]) {
+				channelListings = append(channelListings, listing)
+			}
+		}
+	}
+
+	var correspondents []history.TargetListing
+	status, target := client.historyStatus(config)
+	cutoff := server.historyCutoff(config, client, nil)
+	switch status {
+	case HistoryEphemeral:
+		correspondents = client.history.ListCorrespondents(cutoff)
+	case HistoryPersistent:
+		var err error
+		correspondents, err = server.historyDB.ListCorrespondents(target, start, end, cutoff, limit)
+		if err != nil {
+			server.logger.Error("history", "could not list correspondents", err.Error())
+		}
+	}
+
+	return history.MergeTargets(correspondents, channelListings, start, end, limit)
+}
+
 func (server *Server) ForgetHistory(accountName string) {
 	// sanity check
 	if accountName == "*" {
@@ -908,9 +1256,41 @@ func (server *Server) ForgetHistory(accountName string) {
 		channel.history.Delete(predicate)
 	}
 
-	for _, client := range server.clients.AllClients() {
+	server.clients.Range(func(client *Client) bool {
 		client.history.Delete(predicate)
+		return true
+	})
+}
+
+// renameHistoryAccount reattributes messages sent by a renamed account,
+// in both ephemeral and persistent history.
+func (server *Server) renameHistoryAccount(oldAccount, newAccount, newAccountName string) {
+	config := server.Config()
+	if !config.History.Enabled {
+		return
+	}
+
+	if config.History.Persistent.Enabled {
+		// rewriting the stored attributions can take a while:
+		go server.writeHistory(func() error {
+			return server.historyDB.RenameAccount(oldAccount, newAccount, newAccountName)
+		})
+	}
+
+	predicate := func(item *history.Item) bool {
+		cfAccount, err := CasefoldName(item.AccountName)
+		return err == nil && cfAccount == oldAccount
 	}
+	update := func(item *history.Item) { item.AccountName = newAccountName }
+
+	for _, channel := range server.channels.Channels() {
+		channel.history.Update(predicate, update)
+	}
+
+	server.clients.Range(func(client *Client) bool {
+		client.history.Update(predicate, update)
+		return true
+	})
 }
 
 // deletes a message. target is a hint about what buffer it's in (not required for
@@ -939,7 +1319,7 @@ func (server *Server) DeleteMessage(target, msgid, accountName string) (err erro
 	}
 
 	if hist == nil {
-		err = server.historyDB.DeleteMsgid(msgid, accountName)
+		err = server.historyDB.DeleteMsgid(msgid, accountName, "")
 	} else {
 		count := hist.Delete(func(item *history.Item) bool {
 			return item.Message.Msgid == msgid && (accountName == "*" || item.AccountName == accountName)
@@ -952,6 +1332,66 @@ func (server *Server) DeleteMessage(target, msgid, accountName string) (err erro
 	return
 }
 
+// RedactMessage deletes a message from the history of a channel, or (if channel
+// is nil) from the DMs between client and correspondent, on behalf of REDACT.
+// Unless privileged is set, the client must be logged in as the message's sender.
+func (server *Server) RedactMessage(client *Client, channel *Channel, correspondent *Client, msgid string, privileged bool) (err error) {
+	config := server.Config()
+	accountName := "*"
+	if !privileged {
+		accountName = client.AccountName()
+		if accountName == "*" || !config.History.Retention.AllowIndividualDelete {
+			return errInsufficientPrivs
+		}
+	}
+
+	// a message may be stored in more than one place (e.g., a DM in the
+	// ephemeral history of both participants), so delete it everywhere
+	var found, deleted bool
+	deleteFrom := func(status HistoryStatus, target string, hist *history.Buffer) {
+		switch status {
+		case HistoryEphemeral:
+			count := hist.Delete(func(item *history.Item) bool {
+				if item.Message.Msgid != msgid {
+					return false
+				}
+				found = true
+				return accountName == "*" || item.AccountName == accountName
+			})
+			if count != 0 {
+				deleted = true
+			}
+		case HistoryPersistent:
+			// check the target, since msgids are indexed together for all targets:
+			switch server.historyDB.DeleteMsgid(msgid, accountName, target) {
+			case nil:
+				found, deleted = true, true
+			case history.ErrDisallowed:
+				found = true
+			}
+		}
+	}
+
+	if channel != nil {
+		status, target := channel.historyStatus(config)
+		deleteFrom(status, target, &channel.history)
+	} else {
+		status, target := client.historyStatus(config)
+		deleteFrom(status, target, &client.history)
+		if correspondent != client {
+			status, target = correspondent.historyStatus(config)
+			deleteFrom(status, target, &correspondent.history)
+		}
+	}
+
+	if deleted {
+		return nil
+	} else if found {
+		return errInsufficientPrivs
+	}
+	return errNoop
+}
+
 // elistMatcher takes and matches ELIST conditions
 type elistMatcher struct {
 	MinClientsActive bool
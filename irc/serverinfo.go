@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/modes"
+)
+
+const (
+	// path on websocket listeners at which the server info document is served
+	serverInfoPath = "/server-info.json"
+)
+
+// serverInfoDocument is a machine-readable description of the server, for
+// client authors and bots. It is generated from the same sources as
+// RPL_ISUPPORT, CAP LS, and HELP.
+type serverInfoDocument struct {
+	Name         string              `json:"name"`
+	Network      string              `json:"network"`
+	Version      string              `json:"version"`
+	ISupport     map[string]string   `json:"isupport"`
+	Capabilities map[string]string   `json:"capabilities"`
+	Limits       map[string]int      `json:"limits"`
+	UserModes    string              `json:"user-modes"`
+	ChannelModes string              `json:"channel-modes"`
+	Commands     []serverInfoCommand `json:"commands"`
+	Services     []serverInfoService `json:"services"`
+}
+
+type serverInfoCommand struct {
+	Name      string `json:"name"`
+	MinParams int    `json:"min-params"`
+	Help      string `json:"help,omitempty"`
+}
+
+type serverInfoService struct {
+	Name     string                     `json:"name"`
+	Aliases  []string                   `json:"aliases"`
+	Commands []serverInfoServiceCommand `json:"commands"`
+}
+
+type serverInfoServiceCommand struct {
+	Name         string `json:"name"`
+	Help         string `json:"help,omitempty"`
+	AuthRequired bool   `json:"auth-required"`
+}
+
+// generateServerInfo builds the server info document; it must run after
+// generateISupport, since it includes the ISUPPORT tokens.
+func (config *Config) generateServerInfo() (err error) {
+	doc := serverInfoDocument{
+		Name:         config.Server.Name,
+		Network:      config.Network.Name,
+		Version:      Ver,
+		ISupport:     config.Server.isupport.Tokens,
+		Capabilities: make(map[string]string),
+		Limits: map[string]int{
+			"awaylen":                 config.Limits.AwayLen,
+			"channellen":              config.Limits.ChannelLen,
+			"chan-list-modes":         config.Limits.ChanListModes,
+			"identlen":                config.Limits.IdentLen,
+			"kicklen":                 config.Limits.KickLen,
+			"max-channels-per-client": config.Channels.MaxChannelsPerClient,
+			"monitor-entries":         config.Limits.MonitorEntries,
+			"multiline-max-bytes":     config.Limits.Multiline.MaxBytes,
+			"multiline-max-lines":     config.Limits.Multiline.MaxLines,
+			"nicklen":                 config.Limits.NickLen,
+			"silence-entries":         config.Limits.SilenceEntries,
+			"topiclen":                config.Limits.TopicLen,
+		},
+		UserModes:    modes.SupportedUserModes.String(),
+		ChannelModes: modes.SupportedChannelModes.String(),
+	}
+
+	// a single line is enough to hold every capability
+	for _, capString := range strings.Fields(config.Server.supportedCaps.Strings(caps.Cap302, config.Server.capValues, 1<<16)[0]) {
+		name, value := capString, ""
+		if eq := strings.IndexByte(capString, '='); eq != -1 {
+			name, value = capString[:eq], capString[eq+1:]
+		}
+		doc.Capabilities[name] = value
+	}
+
+	for name, command := range Commands {
+		if command.oper || len(command.capabs) != 0 {
+			continue
+		}
+		doc.Commands = append(doc.Commands, serverInfoCommand{
+			Name:      name,
+			MinParams: command.minParams,
+			Help:      Help[strings.ToLower(name)].text,
+		})
+	}
+	sort.Slice(doc.Commands, func(i, j int) bool { return doc.Commands[i].Name < doc.Commands[j].Name })
+
+	for _, service := range OragonoServices {
+		infoService := serverInfoService{
+			Name:    service.Name,
+			Aliases: service.CommandAliases,
+		}
+		for name, command := range service.Commands {
+			if command.hidden || command.aliasOf != "" || len(command.capabs) != 0 ||
+				(command.enabled != nil && !command.enabled(config)) {
+				continue
+			}
+			infoService.Commands = append(infoService.Commands, serverInfoServiceCommand{
+				Name:         name,
+				Help:         command.helpShort,
+				AuthRequired: command.authRequired,
+			})
+		}
+		sort.Slice(infoService.Commands, func(i, j int) bool { return infoService.Commands[i].Name < infoService.Commands[j].Name })
+		doc.Services = append(doc.Services, infoService)
+	}
+	sort.Slice(doc.Services, func(i, j int) bool { return doc.Services[i].Name < doc.Services[j].Name })
+
+	config.Server.serverInfo, err = json.Marshal(doc)
+	return
+}
+
+// serveServerInfo responds to an HTTP request for the server info document.
+func serveServerInfo(config *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Write(config.Server.serverInfo)
+}
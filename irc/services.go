@@ -36,6 +36,7 @@ type serviceCommand struct {
 	helpShort         string
 	enabled           func(*Config) bool // is this command enabled in the server config?
 	authRequired      bool
+	modifiesState     bool // rejected while the server is in read-only mode
 	hidden            bool
 	minParams         int
 	maxParams         int  // optional, if set it's an error if the user passes more than this many params
@@ -126,6 +127,9 @@ func serviceCmdHandler(server *Server, client *Client, msg ircmsg.IrcMessage, rb
 	if len(msg.Params) == 0 {
 		return false
 	}
+	if server.servicesLink.Relay(client, "PRIVMSG", service.Name, strings.Join(msg.Params, " ")) {
+		return false
+	}
 	commandName := strings.ToLower(msg.Params[0])
 	params := msg.Params[1:]
 	cmd := lookupServiceCommand(service.Commands, commandName)
@@ -187,6 +191,15 @@ func serviceCTCPHandler(service *ircService, client *Client, message string) {
 	}
 }
 
+// serviceReadOnly is rejectReadOnly for service commands
+func serviceReadOnly(service *ircService, server *Server, client *Client, rb *ResponseBuffer) bool {
+	if server.ReadOnly() {
+		service.Notice(rb, client.t("The server is in read-only mode; try again later"))
+		return true
+	}
+	return false
+}
+
 // actually execute a service command
 func serviceRunCommand(service *ircService, server *Server, client *Client, cmd *serviceCommand, commandName string, params []string, rb *ResponseBuffer) {
 	nick := rb.target.Nick()
@@ -194,6 +207,11 @@ func serviceRunCommand(service *ircService, server *Server, client *Client, cmd
 		rb.Add(nil, service.prefix, "NOTICE", nick, notice)
 	}
 
+	if server.servicesLink.BuiltinServicesDisabled() {
+		sendNotice(client.t("Services are currently unavailable; please try again later"))
+		return
+	}
+
 	if cmd == nil {
 		sendNotice(fmt.Sprintf(client.t("Unknown command. To see available commands, run: /%s HELP"), service.ShortName))
 		return
@@ -219,6 +237,10 @@ func serviceRunCommand(service *ircService, server *Server, client *Client, cmd
 		return
 	}
 
+	if cmd.modifiesState && serviceReadOnly(service, server, client, rb) {
+		return
+	}
+
 	server.logger.Debug("services", fmt.Sprintf("Client %s ran %s command %s", client.Nick(), service.Name, commandName))
 	if commandName == "help" {
 		serviceHelpHandler(service, server, client, params, rb)
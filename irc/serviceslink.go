@@ -0,0 +1,515 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircfmt"
+
+	"github.com/oragono/oragono/irc/caps"
+	"github.com/oragono/oragono/irc/sno"
+)
+
+// the services link lets an external services package (e.g., a port of Anope
+// or Atheme) provide pseudo-clients in place of the built-in services, and
+// manage the account state of users. The protocol is newline-delimited JSON;
+// see docs/MANUAL.md for details.
+
+const (
+	// messages queued for the services package before the link is dropped
+	servicesLinkQueueLength  = 1024
+	servicesLinkWriteTimeout = 30 * time.Second
+	// how long a client's SASL attempt waits for the services package to answer
+	servicesLinkSaslTimeout = 15 * time.Second
+)
+
+var (
+	errServicesLinkAuth          = errors.New("authentication required")
+	errServicesLinkNotAllowed    = errors.New("pseudo-client nicknames must be listed in server.restricted-nicknames")
+	errServicesLinkChannelTarget = errors.New("pseudo-clients can only message users")
+)
+
+// ServicesLinkConfig controls the services link listener.
+type ServicesLinkConfig struct {
+	Enabled bool
+	// a host:port, or a path for a unix domain socket
+	Listener string
+	Password string
+	// if set, the built-in services are unavailable even while the link is down,
+	// and SASL is handled by the services package
+	DisableBuiltinServices bool `yaml:"disable-builtin-services"`
+}
+
+// servicesLinkMessage is a single message in either direction.
+type servicesLinkMessage struct {
+	Type      string `json:"type"`
+	ID        uint64 `json:"id,omitempty"`
+	Password  string `json:"password,omitempty"`
+	Nick      string `json:"nick,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Account   string `json:"account,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Command   string `json:"command,omitempty"`
+	Mechanism string `json:"mechanism,omitempty"`
+	Certfp    string `json:"certfp,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// servicesLinkConn is a connection from a services package. Messages to it are
+// queued, and written by a separate goroutine, so that a stalled services
+// package can't block the clients that are messaging it.
+type servicesLinkConn struct {
+	conn     net.Conn
+	outgoing chan servicesLinkMessage
+	closed   chan struct{}
+}
+
+func newServicesLinkConn(conn net.Conn) *servicesLinkConn {
+	link := &servicesLinkConn{
+		conn:     conn,
+		outgoing: make(chan servicesLinkMessage, servicesLinkQueueLength),
+		closed:   make(chan struct{}),
+	}
+	go link.writeLoop()
+	return link
+}
+
+// send queues a message; if the queue is full, the link is dropped.
+func (link *servicesLinkConn) send(msg servicesLinkMessage) {
+	select {
+	case link.outgoing <- msg:
+	default:
+		link.conn.Close()
+	}
+}
+
+// close stops the writer once it has written the queued messages.
+func (link *servicesLinkConn) close() {
+	close(link.closed)
+}
+
+func (link *servicesLinkConn) writeLoop() {
+	defer link.conn.Close()
+	encoder := json.NewEncoder(link.conn)
+	write := func(msg servicesLinkMessage) error {
+		link.conn.SetWriteDeadline(time.Now().Add(servicesLinkWriteTimeout))
+		return encoder.Encode(msg)
+	}
+	for {
+		select {
+		case msg := <-link.outgoing:
+			if write(msg) != nil {
+				return
+			}
+		case <-link.closed:
+			for {
+				select {
+				case msg := <-link.outgoing:
+					if write(msg) != nil {
+						return
+					}
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// ServicesLink manages the (at most one) connection to external services.
+type ServicesLink struct {
+	server *Server
+
+	sync.Mutex    // tier 1
+	listener      net.Listener
+	listenerAddr  string
+	link          *servicesLinkConn
+	pseudoclients map[string]string // casefolded nickname to nickname
+	saslRequests  map[uint64]chan servicesLinkMessage
+	nextSaslID    uint64
+}
+
+func (sl *ServicesLink) Initialize(server *Server) {
+	sl.server = server
+}
+
+// setupServicesLink starts, stops, or moves the listener to match the config.
+func (server *Server) setupServicesLink(config *Config) {
+	sl := &server.servicesLink
+	linkConfig := config.ServicesLink
+
+	sl.Lock()
+	defer sl.Unlock()
+
+	if sl.listener != nil && (!linkConfig.Enabled || linkConfig.Listener != sl.listenerAddr) {
+		server.logger.Info("services-link", "Stopping services link listener", sl.listenerAddr)
+		sl.listener.Close()
+		sl.listener = nil
+	}
+	if !linkConfig.Enabled || sl.listener != nil {
+		return
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(linkConfig.Listener, "/") {
+		network = "unix"
+		os.Remove(linkConfig.Listener)
+	}
+	listener, err := net.Listen(network, linkConfig.Listener)
+	if err != nil {
+		server.logger.Error("services-link", "couldn't start services link listener", err.Error())
+		return
+	}
+	sl.listener = listener
+	sl.listenerAddr = linkConfig.Listener
+	server.logger.Info("services-link", "Started services link listener", linkConfig.Listener)
+	go sl.acceptLoop(listener)
+}
+
+func (sl *ServicesLink) acceptLoop(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go sl.handleConn(conn)
+	}
+}
+
+func (sl *ServicesLink) handleConn(conn net.Conn) {
+	link := newServicesLinkConn(conn)
+	defer link.close()
+	reader := bufio.NewReader(conn)
+	authenticated := false
+
+	defer func() {
+		if authenticated {
+			sl.disconnect(link)
+		}
+	}()
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var msg servicesLinkMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			link.send(servicesLinkMessage{Type: "error", Error: "invalid JSON"})
+			continue
+		}
+
+		if !authenticated {
+			authenticated = sl.authenticate(link, msg)
+			if !authenticated {
+				return
+			}
+			continue
+		}
+
+		if err := sl.handleMessage(msg); err != nil {
+			link.send(servicesLinkMessage{Type: "error", Command: msg.Type, Error: err.Error()})
+		}
+	}
+}
+
+func (sl *ServicesLink) authenticate(link *servicesLinkConn, msg servicesLinkMessage) bool {
+	password := sl.server.Config().ServicesLink.Password
+	if msg.Type != "auth" || password == "" || subtle.ConstantTimeCompare([]byte(msg.Password), []byte(password)) != 1 {
+		link.send(servicesLinkMessage{Type: "error", Error: errServicesLinkAuth.Error()})
+		return false
+	}
+
+	sl.Lock()
+	if sl.link != nil {
+		sl.Unlock()
+		link.send(servicesLinkMessage{Type: "error", Error: "services are already linked"})
+		return false
+	}
+	sl.link = link
+	sl.pseudoclients = make(map[string]string)
+	sl.saslRequests = make(map[uint64]chan servicesLinkMessage)
+	sl.Unlock()
+
+	link.send(servicesLinkMessage{Type: "ok"})
+	sl.server.snomasks.Send(sno.LocalAnnouncements, "External services linked")
+	sl.server.logger.Info("services-link", "External services linked from", link.conn.RemoteAddr().String())
+	return true
+}
+
+func (sl *ServicesLink) disconnect(link *servicesLinkConn) {
+	sl.Lock()
+	if sl.link == link {
+		sl.link = nil
+		sl.pseudoclients = nil
+		// fail any SASL attempts that are waiting for an answer:
+		for _, request := range sl.saslRequests {
+			close(request)
+		}
+		sl.saslRequests = nil
+	}
+	sl.Unlock()
+
+	if sl.BuiltinServicesDisabled() {
+		sl.server.snomasks.Send(sno.LocalAnnouncements, "External services unlinked; services are unavailable")
+	} else {
+		sl.server.snomasks.Send(sno.LocalAnnouncements, "External services unlinked; built-in services are active")
+	}
+	sl.server.logger.Info("services-link", "External services unlinked")
+}
+
+func (sl *ServicesLink) send(msg servicesLinkMessage) {
+	sl.Lock()
+	link := sl.link
+	sl.Unlock()
+	if link != nil {
+		link.send(msg)
+	}
+}
+
+// BuiltinServicesDisabled returns whether the built-in services have been
+// replaced entirely by a services package, whether or not it is linked.
+func (sl *ServicesLink) BuiltinServicesDisabled() bool {
+	config := &sl.server.Config().ServicesLink
+	return config.Enabled && config.DisableBuiltinServices
+}
+
+// pseudoclientPrefix returns the NUH source for a pseudo-client, if it exists.
+func (sl *ServicesLink) pseudoclientPrefix(nick string) (prefix string, ok bool) {
+	cfnick, err := CasefoldName(nick)
+	if err != nil {
+		return
+	}
+	sl.Lock()
+	nick, ok = sl.pseudoclients[cfnick]
+	sl.Unlock()
+	if ok {
+		prefix = fmt.Sprintf("%s!%s@%s", nick, nick, sl.server.name)
+	}
+	return
+}
+
+// Relay sends a message from a user to external services, if `target` is one of
+// their pseudo-clients; it returns whether the message was relayed.
+func (sl *ServicesLink) Relay(client *Client, command, target, message string) bool {
+	if _, ok := sl.pseudoclientPrefix(target); !ok {
+		return false
+	}
+	details := client.Details()
+	msg := servicesLinkMessage{
+		Type:    "message",
+		Command: command,
+		Source:  details.nickMask,
+		Target:  target,
+		Message: message,
+	}
+	if details.account != "" {
+		msg.Account = details.accountName
+	}
+	sl.send(msg)
+	return true
+}
+
+func (sl *ServicesLink) handleMessage(msg servicesLinkMessage) (err error) {
+	server := sl.server
+	switch msg.Type {
+	case "introduce":
+		cfnick, err := CasefoldName(msg.Nick)
+		if err != nil {
+			return errNicknameInvalid
+		}
+		skeleton, _ := Skeleton(msg.Nick)
+		if !server.Config().isRestrictedNick(cfnick, skeleton) {
+			return errServicesLinkNotAllowed
+		}
+		sl.Lock()
+		sl.pseudoclients[cfnick] = msg.Nick
+		sl.Unlock()
+	case "remove":
+		cfnick, _ := CasefoldName(msg.Nick)
+		sl.Lock()
+		delete(sl.pseudoclients, cfnick)
+		sl.Unlock()
+	case "privmsg", "notice":
+		prefix, ok := sl.pseudoclientPrefix(msg.Source)
+		if !ok {
+			return errNoSuchNick
+		}
+		// pseudo-clients aren't channel members, so they can't speak in channels:
+		if strings.HasPrefix(msg.Target, "#") {
+			return errServicesLinkChannelTarget
+		}
+		target := server.clients.Get(msg.Target)
+		if target == nil {
+			return errNoSuchNick
+		}
+		target.Send(nil, prefix, strings.ToUpper(msg.Type), target.Nick(), msg.Message)
+	case "login":
+		target := server.clients.Get(msg.Target)
+		if target == nil {
+			return errNoSuchNick
+		}
+		return sl.login(target, msg.Account)
+	case "logout":
+		target := server.clients.Get(msg.Target)
+		if target == nil {
+			return errNoSuchNick
+		}
+		sl.logout(target)
+	case "sasl":
+		sl.Lock()
+		request, ok := sl.saslRequests[msg.ID]
+		delete(sl.saslRequests, msg.ID)
+		sl.Unlock()
+		if !ok {
+			return errInvalidParams
+		}
+		request <- msg
+	case "kill":
+		target := server.clients.Get(msg.Target)
+		if target == nil {
+			return errNoSuchNick
+		}
+		target.Quit(fmt.Sprintf(target.t("Killed by services: %s"), msg.Message), nil)
+		target.destroy(nil)
+	default:
+		return errInvalidParams
+	}
+	return nil
+}
+
+// loadAccount returns the account that external services have logged a user
+// into; it need not exist in our own database.
+func (sl *ServicesLink) loadAccount(accountName string) (account ClientAccount, err error) {
+	cfAccount, err := CasefoldName(accountName)
+	if err != nil {
+		return account, errAccountDoesNotExist
+	}
+	account, err = sl.server.accounts.LoadAccount(cfAccount)
+	if err != nil {
+		account = ClientAccount{
+			Name:           accountName,
+			NameCasefolded: cfAccount,
+			Verified:       true,
+		}
+	}
+	return account, nil
+}
+
+// login logs a user into an account on behalf of external services.
+func (sl *ServicesLink) login(target *Client, accountName string) error {
+	server := sl.server
+	account, err := sl.loadAccount(accountName)
+	if err != nil {
+		return err
+	}
+	if target.Account() != "" {
+		server.accounts.Logout(target)
+	}
+	server.accounts.Login(target, account)
+
+	details := target.Details()
+	for _, session := range target.Sessions() {
+		session.Send(nil, server.name, RPL_LOGGEDIN, details.nick, details.nickMask, details.accountName, fmt.Sprintf(target.t("You are now logged in as %s"), details.accountName))
+	}
+	for friend := range target.Friends(caps.AccountNotify) {
+		friend.Send(nil, details.nickMask, "ACCOUNT", details.accountName)
+	}
+	server.sendLoginSnomask(details.nickMask, details.accountName)
+	server.logger.Info("accounts", "client", details.nick, "logged into account", details.accountName, "by external services")
+	return nil
+}
+
+func (sl *ServicesLink) logout(target *Client) {
+	server := sl.server
+	if target.Account() == "" {
+		return
+	}
+	server.accounts.Logout(target)
+
+	details := target.Details()
+	for _, session := range target.Sessions() {
+		session.Send(nil, server.name, RPL_LOGGEDOUT, details.nick, details.nickMask, target.t("You are now logged out"))
+	}
+	for friend := range target.Friends(caps.AccountNotify) {
+		friend.Send(nil, details.nickMask, "ACCOUNT", "*")
+	}
+	server.snomasks.Send(sno.LocalAccounts, fmt.Sprintf(ircfmt.Unescape("Client $c[grey][$r%s$c[grey]] was logged out by external services"), details.nickMask))
+}
+
+// Authenticate completes a SASL exchange by passing it to external services,
+// if they handle SASL (see BuiltinServicesDisabled), and waiting for their answer.
+func (sl *ServicesLink) Authenticate(client *Client, mechanism string, value []byte, rb *ResponseBuffer) {
+	server := sl.server
+	fail := func(message string) {
+		rb.Add(nil, server.name, ERR_SASLFAIL, client.Nick(), fmt.Sprintf("%s: %s", client.t("SASL authentication failed"), message))
+	}
+	if throttled, remainingTime := client.loginThrottle.Touch(); throttled {
+		fail(fmt.Sprintf(client.t("Please wait at least %v and try again"), remainingTime))
+		return
+	}
+
+	sl.Lock()
+	link := sl.link
+	var id uint64
+	request := make(chan servicesLinkMessage, 1)
+	if link != nil {
+		sl.nextSaslID++
+		id = sl.nextSaslID
+		sl.saslRequests[id] = request
+	}
+	sl.Unlock()
+	if link == nil {
+		fail(client.t("Services are currently unavailable"))
+		return
+	}
+
+	link.send(servicesLinkMessage{
+		Type:      "sasl",
+		ID:        id,
+		Source:    client.NickMaskString(),
+		Mechanism: mechanism,
+		Certfp:    rb.session.certfp,
+		Message:   base64.StdEncoding.EncodeToString(value),
+	})
+	var reply servicesLinkMessage
+	select {
+	case reply = <-request:
+	case <-time.After(servicesLinkSaslTimeout):
+		sl.Lock()
+		delete(sl.saslRequests, id)
+		sl.Unlock()
+	}
+	if reply.Account == "" {
+		if reply.Error != "" {
+			fail(reply.Error)
+		} else {
+			fail(client.t("Services are currently unavailable"))
+		}
+		return
+	}
+
+	account, err := sl.loadAccount(reply.Account)
+	if err != nil {
+		fail(client.t(err.Error()))
+		return
+	}
+	server.accounts.Login(client, account)
+	if !fixupNickEqualsAccount(client, rb, server.Config(), "") {
+		return
+	}
+	sendSuccessfulAccountAuth(nil, client, rb, true)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServicesLinkPseudoclients(t *testing.T) {
+	server := newTestServer()
+	server.servicesLink.Initialize(server)
+	sl := &server.servicesLink
+	alice := newTestClient(server, "alice")
+
+	// not linked: nothing is relayed
+	if sl.Relay(alice, "PRIVMSG", "NickServ", "help") {
+		t.Errorf("relayed a message without a link")
+	}
+
+	link := &servicesLinkConn{outgoing: make(chan servicesLinkMessage, 16)}
+	sl.link = link
+	sl.pseudoclients = make(map[string]string)
+	sl.saslRequests = make(map[uint64]chan servicesLinkMessage)
+
+	if err := sl.handleMessage(servicesLinkMessage{Type: "introduce", Nick: "alice"}); err != errServicesLinkNotAllowed {
+		t.Errorf("introduced an unrestricted nickname: %v", err)
+	}
+	if err := sl.handleMessage(servicesLinkMessage{Type: "introduce", Nick: "NickServ"}); err != nil {
+		t.Fatal(err)
+	}
+	prefix, ok := sl.pseudoclientPrefix("nickserv")
+	assertEqual(ok, true, t)
+	assertEqual(prefix, "NickServ!NickServ@oragono.test", t)
+
+	if !sl.Relay(alice, "PRIVMSG", "nickserv", "identify hunter2") {
+		t.Fatalf("didn't relay a message to a pseudo-client")
+	}
+	relayed := <-link.outgoing
+	assertEqual(relayed, servicesLinkMessage{
+		Type:    "message",
+		Command: "PRIVMSG",
+		Source:  "alice!u@example.com",
+		Target:  "nickserv",
+		Message: "identify hunter2",
+	}, t)
+
+	// pseudo-clients aren't channel members:
+	if err := sl.handleMessage(servicesLinkMessage{Type: "privmsg", Source: "NickServ", Target: "#chan", Message: "hi"}); err != errServicesLinkChannelTarget {
+		t.Errorf("sent a channel message from a pseudo-client: %v", err)
+	}
+
+	if err := sl.handleMessage(servicesLinkMessage{Type: "remove", Nick: "NICKSERV"}); err != nil {
+		t.Fatal(err)
+	}
+	if sl.Relay(alice, "PRIVMSG", "NickServ", "help") {
+		t.Errorf("relayed a message to a removed pseudo-client")
+	}
+	if err := sl.handleMessage(servicesLinkMessage{Type: "bogus"}); err != errInvalidParams {
+		t.Errorf("accepted an unknown message type: %v", err)
+	}
+}
+
+func TestServicesLinkSasl(t *testing.T) {
+	server := newTestServer()
+	server.servicesLink.Initialize(server)
+	sl := &server.servicesLink
+	sl.saslRequests = make(map[uint64]chan servicesLinkMessage)
+
+	// answers are routed to the waiting request, once:
+	request := make(chan servicesLinkMessage, 1)
+	sl.saslRequests[7] = request
+	if err := sl.handleMessage(servicesLinkMessage{Type: "sasl", ID: 7, Account: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual((<-request).Account, "alice", t)
+	if err := sl.handleMessage(servicesLinkMessage{Type: "sasl", ID: 7, Account: "alice"}); err != errInvalidParams {
+		t.Errorf("answered a SASL request twice: %v", err)
+	}
+
+	// unlinking fails any that are still waiting:
+	link := &servicesLinkConn{outgoing: make(chan servicesLinkMessage, 1)}
+	sl.link = link
+	request = make(chan servicesLinkMessage, 1)
+	sl.saslRequests[8] = request
+	sl.disconnect(link)
+	reply, ok := <-request
+	assertEqual(ok, false, t)
+	assertEqual(reply.Account, "", t)
+}
+
+func TestServicesLinkQueue(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	link := &servicesLinkConn{conn: local, outgoing: make(chan servicesLinkMessage, 1)}
+
+	// a services package that stops reading is dropped, rather than blocking us:
+	link.send(servicesLinkMessage{Type: "message"})
+	link.send(servicesLinkMessage{Type: "message"})
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Errorf("link wasn't dropped when its queue was full")
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"regexp"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+var (
+	errSilenceListFull = errors.New("Silence list is full")
+)
+
+// compileSilenceList compiles an account's server-side ignore list (SILENCE)
+// into a single regexp, or nil if it is empty.
+func compileSilenceList(masks []string) (result *regexp.Regexp) {
+	if len(masks) == 0 {
+		return nil
+	}
+	result, err := utils.CompileMasks(masks)
+	if err != nil {
+		// the masks were validated when they were added
+		return nil
+	}
+	return
+}
+
+// isSilencing returns whether `client` has `sender` on its SILENCE list;
+// if so, direct messages and invites from `sender` are silently dropped.
+func (client *Client) isSilencing(sender *Client) bool {
+	client.stateMutex.RLock()
+	silenced := client.silenced
+	client.stateMutex.RUnlock()
+	if silenced == nil || client == sender {
+		return false
+	}
+	for _, mask := range sender.AllNickmasks() {
+		if silenced.MatchString(mask) {
+			return true
+		}
+	}
+	return false
+}
+
+// modifySilenceList adds or removes a mask from the SILENCE list of
+// `client`'s account; the change applies to all of the account's clients.
+func (client *Client) modifySilenceList(mask string, add bool) (changed bool, err error) {
+	limit := client.server.Config().Limits.SilenceEntries
+	munger := func(in AccountSettings) (out AccountSettings, err error) {
+		out = in
+		out.Silence = make([]string, 0, len(in.Silence)+1)
+		present := false
+		for _, existing := range in.Silence {
+			if existing == mask {
+				present = true
+				if !add {
+					continue
+				}
+			}
+			out.Silence = append(out.Silence, existing)
+		}
+		if add && !present {
+			if len(in.Silence) >= limit {
+				return in, errSilenceListFull
+			}
+			out.Silence = append(out.Silence, mask)
+		}
+		changed = (add != present)
+		return
+	}
+	_, err = client.server.accounts.ModifyAccountSettings(client.Account(), munger)
+	return
+}
@@ -11,6 +11,7 @@ type Mask rune
 const (
 	LocalAnnouncements Mask = 'a'
 	LocalConnects      Mask = 'c'
+	LocalDCC           Mask = 'd'
 	LocalChannels      Mask = 'j'
 	LocalKills         Mask = 'k'
 	LocalNicks         Mask = 'n'
@@ -27,6 +28,7 @@ var (
 	NoticeMaskNames = map[Mask]string{
 		LocalAnnouncements: "ANNOUNCEMENT",
 		LocalConnects:      "CONNECT",
+		LocalDCC:           "DCC",
 		LocalChannels:      "CHANNEL",
 		LocalKills:         "KILL",
 		LocalNicks:         "NICK",
@@ -42,6 +44,7 @@ var (
 	ValidMasks = map[Mask]bool{
 		LocalAnnouncements: true,
 		LocalConnects:      true,
+		LocalDCC:           true,
 		LocalChannels:      true,
 		LocalKills:         true,
 		LocalNicks:         true,
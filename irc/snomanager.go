@@ -2,19 +2,79 @@ package irc
 
 import (
 	"fmt"
+	"strings"
 	"sync"
 
 	"github.com/goshuirc/irc-go/ircfmt"
 	"github.com/oragono/oragono/irc/sno"
 )
 
+const (
+	defaultSnomaskRouteFormat = "-$name- $message"
+)
+
+// SnomaskRouteConfig delivers some snomasks to a channel (typically an
+// oper-only channel) and/or to webhooks, in addition to the opers who have
+// subscribed to them, so that they aren't missed when nobody is.
+type SnomaskRouteConfig struct {
+	// the snomasks to route, as in `MODE +s`
+	Masks string
+	// the channel to send them to, as notices from the server
+	Channel string
+	// whether to deliver them to webhooks, as "snomask" events
+	Webhook bool
+	// the message: $name is the name of the snomask (e.g., CONNECT),
+	// $mask is its letter, and $message is the notice itself
+	Format string
+
+	masks   map[sno.Mask]bool
+	channel string // casefolded
+}
+
+func (route *SnomaskRouteConfig) prepare() (err error) {
+	route.masks = make(map[sno.Mask]bool)
+	for _, char := range route.Masks {
+		mask := sno.Mask(char)
+		if !sno.ValidMasks[mask] {
+			return fmt.Errorf("invalid snomask in snomask route: %c", char)
+		}
+		route.masks[mask] = true
+	}
+	if len(route.masks) == 0 {
+		return fmt.Errorf("snomask routes must have at least one mask")
+	}
+	if route.Channel != "" {
+		route.channel, err = CasefoldChannel(route.Channel)
+		if err != nil {
+			return fmt.Errorf("invalid channel in snomask route: %s", route.Channel)
+		}
+	} else if !route.Webhook {
+		return fmt.Errorf("snomask routes must have a channel or deliver to webhooks")
+	}
+	if route.Format == "" {
+		route.Format = defaultSnomaskRouteFormat
+	}
+	return nil
+}
+
+// format applies the route's template to a snomask.
+func (route *SnomaskRouteConfig) format(mask sno.Mask, name, content string) string {
+	return strings.NewReplacer(
+		"$name", name,
+		"$mask", string(mask),
+		"$message", content,
+	).Replace(route.Format)
+}
+
 // SnoManager keeps track of which clients to send snomasks to.
 type SnoManager struct {
+	server        *Server
 	sendListMutex sync.RWMutex // tier 2
 	sendLists     map[sno.Mask]map[*Client]bool
 }
 
-func (m *SnoManager) Initialize() {
+func (m *SnoManager) Initialize(server *Server) {
+	m.server = server
 	m.sendLists = make(map[sno.Mask]map[*Client]bool)
 }
 
@@ -77,8 +137,18 @@ func (m *SnoManager) RemoveClient(client *Client) {
 	}
 }
 
-// Send sends the given snomask to all users signed up for it.
+// Send sends the given snomask to all users signed up for it, and along any
+// configured routes.
 func (m *SnoManager) Send(mask sno.Mask, content string) {
+	name := sno.NoticeMaskNames[mask]
+	if name == "" {
+		name = string(mask)
+	}
+	m.sendToSubscribers(mask, name, content)
+	m.route(mask, name, content)
+}
+
+func (m *SnoManager) sendToSubscribers(mask sno.Mask, name, content string) {
 	m.sendListMutex.RLock()
 	defer m.sendListMutex.RUnlock()
 
@@ -89,10 +159,6 @@ func (m *SnoManager) Send(mask sno.Mask, content string) {
 	}
 
 	// make the message
-	name := sno.NoticeMaskNames[mask]
-	if name == "" {
-		name = string(mask)
-	}
 	message := fmt.Sprintf(ircfmt.Unescape("$c[grey]-$r%s$c[grey]-$c %s"), name, content)
 
 	// send it out
@@ -101,6 +167,36 @@ func (m *SnoManager) Send(mask sno.Mask, content string) {
 	}
 }
 
+// route delivers a snomask to the channels and webhooks configured for it.
+func (m *SnoManager) route(mask sno.Mask, name, content string) {
+	if m.server == nil {
+		return
+	}
+	config := m.server.Config()
+	for i := range config.Snomasks.Routes {
+		route := &config.Snomasks.Routes[i]
+		if !route.masks[mask] {
+			continue
+		}
+		message := route.format(mask, name, content)
+		if route.channel != "" {
+			if channel := m.server.channels.Get(route.channel); channel != nil {
+				chname := channel.Name()
+				for _, member := range channel.Members() {
+					member.Send(nil, m.server.name, "NOTICE", chname, message)
+				}
+			}
+		}
+		if route.Webhook {
+			m.server.webhooks.Send(WebhookSnomask, webhookData{
+				"mask":    string(mask),
+				"name":    name,
+				"message": ircfmt.Strip(message),
+			})
+		}
+	}
+}
+
 // String returns the snomasks currently enabled.
 func (m *SnoManager) String(client *Client) string {
 	m.sendListMutex.RLock()
@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/oragono/oragono/irc/sno"
+)
+
+func TestSnomaskRoutes(t *testing.T) {
+	route := SnomaskRouteConfig{Masks: "kx", Channel: "#Opers"}
+	if err := route.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(route.channel, "#opers", t)
+	assertEqual(route.masks[sno.LocalKills], true, t)
+	assertEqual(route.masks[sno.LocalConnects], false, t)
+	assertEqual(route.format(sno.LocalKills, "KILL", "alice was killed"), "-KILL- alice was killed", t)
+
+	route.Format = "[$mask/$name] $message"
+	assertEqual(route.format(sno.LocalXline, "XLINE", "added D-Line for $name"), "[x/XLINE] added D-Line for $name", t)
+
+	for _, invalid := range []SnomaskRouteConfig{
+		{Masks: "k"},
+		{Masks: "", Webhook: true},
+		{Masks: "Z", Webhook: true},
+		{Masks: "k", Channel: "opers"},
+	} {
+		if err := invalid.prepare(); err == nil {
+			t.Errorf("accepted invalid snomask route %#v", invalid)
+		}
+	}
+}
@@ -47,6 +47,13 @@ func NewSocket(conn IRCConn, maxSendQBytes int) *Socket {
 	return &result
 }
 
+// SetMaxSendQ changes the maximum size of the send queue.
+func (socket *Socket) SetMaxSendQ(maxSendQBytes int) {
+	socket.Lock()
+	socket.maxSendQBytes = maxSendQBytes
+	socket.Unlock()
+}
+
 // Close stops a Socket from being able to send/receive any more data.
 func (socket *Socket) Close() {
 	socket.Lock()
@@ -159,6 +166,13 @@ func (socket *Socket) SetFinalData(data []byte) {
 	socket.finalData = data
 }
 
+// QueueLength returns the number of bytes in the sendQ.
+func (socket *Socket) QueueLength() int {
+	socket.Lock()
+	defer socket.Unlock()
+	return socket.totalLength
+}
+
 // IsClosed returns whether the socket is closed.
 func (socket *Socket) IsClosed() bool {
 	socket.Lock()
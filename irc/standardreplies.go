@@ -0,0 +1,76 @@
+// Copyright (c) 2020 Shivaram Lingamneni
+// released under the MIT license
+
+package irc
+
+import (
+	"github.com/oragono/oragono/irc/caps"
+)
+
+// Standard replies (FAIL, WARN, and NOTE) report the outcome of a command in a
+// machine-readable form: `FAIL <command> <code> [<context>...] <description>`.
+// Where a standard reply replaces a legacy error numeric, sessions that have
+// negotiated the standard-replies capability receive only the standard reply,
+// and other sessions receive only the numeric.
+// See https://ircv3.net/specs/extensions/standard-replies
+
+func standardReplyParams(command, code string, params []string) []string {
+	return append([]string{command, code}, params...)
+}
+
+// Fail adds a FAIL standard reply; `params` are the context parameters, if
+// any, followed by the description.
+func (rb *ResponseBuffer) Fail(command, code string, params ...string) {
+	rb.Add(nil, rb.target.server.name, "FAIL", standardReplyParams(command, code, params)...)
+}
+
+// Warn adds a WARN standard reply.
+func (rb *ResponseBuffer) Warn(command, code string, params ...string) {
+	rb.Add(nil, rb.target.server.name, "WARN", standardReplyParams(command, code, params)...)
+}
+
+// Note adds a NOTE standard reply.
+func (rb *ResponseBuffer) Note(command, code string, params ...string) {
+	rb.Add(nil, rb.target.server.name, "NOTE", standardReplyParams(command, code, params)...)
+}
+
+// FailNumeric adds a FAIL standard reply for sessions that support them, and
+// the legacy numeric `numeric` otherwise; the numeric's parameters are the
+// client's nickname followed by `params`.
+func (rb *ResponseBuffer) FailNumeric(numeric, command, code string, params ...string) {
+	if rb.session.capabilities.Has(caps.StandardReplies) {
+		rb.Fail(command, code, params...)
+	} else {
+		rb.Add(nil, rb.target.server.name, numeric, append([]string{rb.target.Nick()}, params...)...)
+	}
+}
+
+// Fail sends a FAIL standard reply to the session.
+func (session *Session) Fail(command, code string, params ...string) {
+	session.Send(nil, session.client.server.name, "FAIL", standardReplyParams(command, code, params)...)
+}
+
+// Warn sends a WARN standard reply to the session.
+func (session *Session) Warn(command, code string, params ...string) {
+	session.Send(nil, session.client.server.name, "WARN", standardReplyParams(command, code, params)...)
+}
+
+// FailNumeric is the equivalent of ResponseBuffer.FailNumeric for a session.
+func (session *Session) FailNumeric(numeric, command, code string, params ...string) {
+	if session.capabilities.Has(caps.StandardReplies) {
+		session.Fail(command, code, params...)
+	} else {
+		session.Send(nil, session.client.server.name, numeric, append([]string{session.client.Nick()}, params...)...)
+	}
+}
+
+// FailUnknownError is like FailNumeric, but falls back to ERR_UNKNOWNERROR,
+// whose parameters are the command and the description; the context
+// parameters are only sent with FAIL.
+func (rb *ResponseBuffer) FailUnknownError(command, code string, params ...string) {
+	if rb.session.capabilities.Has(caps.StandardReplies) {
+		rb.Fail(command, code, params...)
+	} else if len(params) != 0 {
+		rb.Add(nil, rb.target.server.name, ERR_UNKNOWNERROR, rb.target.Nick(), command, params[len(params)-1])
+	}
+}
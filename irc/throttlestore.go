@@ -0,0 +1,81 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/oragono/oragono/irc/connection_limits"
+	"github.com/tidwall/buntdb"
+)
+
+// the connection and account throttles are kept in memory, but we save them
+// to the datastore periodically and on shutdown, so that restarting the
+// server doesn't re-admit a connection flood that was in progress.
+
+const (
+	throttleSaveInterval = time.Minute
+)
+
+// loadThrottles restores the throttle state saved by saveThrottles;
+// the limiter drops any entries that expired while we were down.
+func (server *Server) loadThrottles() {
+	var state connection_limits.ThrottleState
+	server.store.View(func(tx *buntdb.Tx) error {
+		stateStr, err := tx.Get(keyThrottleState)
+		if err == nil {
+			err = json.Unmarshal([]byte(stateStr), &state)
+			if err != nil {
+				server.logger.Error("internal", "invalid saved throttle state", err.Error())
+			}
+		}
+		return nil
+	})
+	server.connectionLimiter.ImportThrottles(state, time.Now().UTC())
+}
+
+// saveThrottles stores the current (unexpired) throttle state.
+func (server *Server) saveThrottles() {
+	config := server.Config()
+	state := server.connectionLimiter.ExportThrottles(time.Now().UTC())
+	if len(state.IPs) == 0 && len(state.Accounts) == 0 {
+		server.store.Update(func(tx *buntdb.Tx) error {
+			tx.Delete(keyThrottleState)
+			return nil
+		})
+		return
+	}
+	stateBytes, err := json.Marshal(state)
+	if err != nil {
+		server.logger.Error("internal", "couldn't serialize throttle state", err.Error())
+		return
+	}
+	err = server.store.Update(func(tx *buntdb.Tx) error {
+		// every entry expires within one window, so the whole state does too:
+		_, _, err := tx.Set(keyThrottleState, string(stateBytes), &buntdb.SetOptions{Expires: true, TTL: config.Server.IPLimits.Window})
+		return err
+	})
+	if err != nil {
+		server.logger.Error("internal", "couldn't save throttle state", err.Error())
+	}
+}
+
+func (server *Server) throttleSaveLoop() {
+	defer func() {
+		if r := recover(); r != nil {
+			server.logger.Error("internal",
+				fmt.Sprintf("Panic in throttle save routine: %v\n%s", r, debug.Stack()))
+			time.Sleep(throttleSaveInterval)
+			go server.throttleSaveLoop()
+		}
+	}()
+
+	for {
+		time.Sleep(throttleSaveInterval)
+		server.saveThrottles()
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"time"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+// TIMEDMODE sets channel modes that the server reverts by itself after a
+// while, e.g., an emergency +m. Timed list masks use the existing expiration
+// of list masks (see UserMaskSet); timed changes to flag modes are tracked
+// here, and persisted with the channel's modes if it is registered.
+
+// TimedMode is a change to a flag mode that will be undone when it expires.
+type TimedMode struct {
+	Mode    modes.Mode
+	Op      modes.ModeOp // the op that was applied; expiration applies the opposite op
+	Expires time.Time
+}
+
+// revert returns the change that undoes the timed change.
+func (tm TimedMode) revert() modes.ModeChange {
+	op := modes.Remove
+	if tm.Op == modes.Remove {
+		op = modes.Add
+	}
+	return modes.ModeChange{Mode: tm.Mode, Op: op}
+}
+
+// timedModeSupported returns whether a mode can be set with TIMEDMODE:
+// flag modes and list modes can be, but modes with arguments that aren't
+// lists (e.g., +k, +l, +o) cannot.
+func timedModeSupported(change modes.ModeChange) bool {
+	switch change.Mode {
+	case modes.BanMask, modes.ExceptMask, modes.InviteMask:
+		return change.Op == modes.Add
+	case modes.Key, modes.UserLimit, modes.ChannelFounder, modes.ChannelAdmin, modes.ChannelOperator, modes.Halfop, modes.Voice:
+		return false
+	default:
+		return change.Op == modes.Add || change.Op == modes.Remove
+	}
+}
+
+// TimedModes returns the pending timed changes to flag modes.
+func (channel *Channel) TimedModes() (result []TimedMode) {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	return append(result, channel.timedModes...)
+}
+
+// setTimedModes arranges for the applied changes to be undone at `expires`.
+func (channel *Channel) setTimedModes(applied modes.ModeChanges, expires time.Time) {
+	var includeFlags uint
+	for _, change := range applied {
+		switch change.Mode {
+		case modes.BanMask, modes.ExceptMask, modes.InviteMask:
+			if channel.lists[change.Mode].SetExpiration(change.Arg, expires) {
+				includeFlags |= IncludeLists
+			}
+		default:
+			channel.stateMutex.Lock()
+			channel.timedModes = append(removeTimedMode(channel.timedModes, change.Mode), TimedMode{
+				Mode:    change.Mode,
+				Op:      change.Op,
+				Expires: expires,
+			})
+			channel.stateMutex.Unlock()
+			includeFlags |= IncludeModes
+		}
+	}
+	if includeFlags != 0 {
+		channel.MarkDirty(includeFlags)
+		channel.scheduleExpiry()
+	}
+}
+
+// clearTimedMode cancels the pending expiration of a flag mode, because it
+// was changed again in the meantime.
+func (channel *Channel) clearTimedMode(mode modes.Mode) {
+	channel.stateMutex.Lock()
+	defer channel.stateMutex.Unlock()
+	channel.timedModes = removeTimedMode(channel.timedModes, mode)
+}
+
+func removeTimedMode(timedModes []TimedMode, mode modes.Mode) (result []TimedMode) {
+	for _, tm := range timedModes {
+		if tm.Mode != mode {
+			result = append(result, tm)
+		}
+	}
+	return
+}
+
+// nextTimedModeExpiration returns the earliest expiration time of any timed
+// mode, or the zero time if there are none.
+func (channel *Channel) nextTimedModeExpiration() (result time.Time) {
+	channel.stateMutex.RLock()
+	defer channel.stateMutex.RUnlock()
+	for _, tm := range channel.timedModes {
+		if result.IsZero() || tm.Expires.Before(result) {
+			result = tm.Expires
+		}
+	}
+	return
+}
+
+// expireTimedModes undoes the timed changes whose expiration time has passed,
+// returning the changes that were applied.
+func (channel *Channel) expireTimedModes(now time.Time) (applied modes.ModeChanges) {
+	channel.stateMutex.Lock()
+	var expired, remaining []TimedMode
+	for _, tm := range channel.timedModes {
+		if now.Before(tm.Expires) {
+			remaining = append(remaining, tm)
+		} else {
+			expired = append(expired, tm)
+		}
+	}
+	channel.timedModes = remaining
+	channel.stateMutex.Unlock()
+
+	for _, tm := range expired {
+		change := tm.revert()
+		if channel.flags.SetMode(change.Mode, change.Op == modes.Add) {
+			if (change.Mode == modes.DelayedJoin || change.Mode == modes.Anonymous) && change.Op == modes.Remove &&
+				!channel.flags.HasMode(modes.DelayedJoin) {
+				channel.revealAllDelayedJoins()
+			}
+			applied = append(applied, change)
+		}
+	}
+	if len(expired) != 0 {
+		channel.MarkDirty(IncludeModes)
+	}
+	return
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+
+	"github.com/oragono/oragono/irc/modes"
+)
+
+func TestTimedModeSupported(t *testing.T) {
+	changes, _ := modes.ParseChannelModeChanges("+mb-nk", "*!*@example.com", "key")
+	var supported []bool
+	for _, change := range changes {
+		supported = append(supported, timedModeSupported(change))
+	}
+	assertEqual(supported, []bool{true, true, true, false}, t)
+
+	changes, _ = modes.ParseChannelModeChanges("-b+l+v", "*!*@example.com", "10", "nick")
+	for _, change := range changes {
+		if timedModeSupported(change) {
+			t.Errorf("mode change %v should not be supported", change)
+		}
+	}
+}
+
+func TestTimedModeRevert(t *testing.T) {
+	moderated := TimedMode{Mode: modes.Moderated, Op: modes.Add}
+	assertEqual(moderated.revert(), modes.ModeChange{Mode: modes.Moderated, Op: modes.Remove}, t)
+	noOutside := TimedMode{Mode: modes.NoOutside, Op: modes.Remove}
+	assertEqual(noOutside.revert(), modes.ModeChange{Mode: modes.NoOutside, Op: modes.Add}, t)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// the current key plus the previous one: a ticket stays resumable until one
+// full rotation after its key stops being used to issue new tickets
+const tlsTicketKeyCount = 2
+
+// TLSTicketKeys manages the keys used to encrypt TLS session tickets. By
+// default, crypto/tls generates separate keys for each tls.Config, so a
+// rehash (which loads new tls.Configs) would invalidate every outstanding
+// ticket; instead, all listeners share the same keys for the life of the
+// process. The keys are never written to disk.
+//
+// Early data (0-RTT) is never accepted: crypto/tls doesn't implement it on
+// the server side, so a resumed session can't carry replayable commands.
+type TLSTicketKeys struct {
+	sync.Mutex // tier 1
+
+	keys      [][32]byte // newest first
+	rotatedAt time.Time
+	interval  time.Duration
+	configs   []*tls.Config
+	timer     *time.Timer
+}
+
+// Apply installs the current keys on the TLS listeners of a newly loaded
+// config, rotating them first if they're due.
+func (tk *TLSTicketKeys) Apply(config *Config) error {
+	var configs []*tls.Config
+	for _, lconf := range config.Server.trueListeners {
+		if lconf.TLSConfig != nil {
+			configs = append(configs, lconf.TLSConfig)
+		}
+	}
+
+	tk.Lock()
+	defer tk.Unlock()
+
+	if tk.timer != nil {
+		tk.timer.Stop()
+		tk.timer = nil
+	}
+
+	if !config.Server.TLSSessionTickets.enabled {
+		for _, tlsConfig := range configs {
+			tlsConfig.SessionTicketsDisabled = true
+		}
+		tk.configs = nil
+		return nil
+	}
+
+	tk.configs = configs
+	tk.interval = config.Server.TLSSessionTickets.KeyRotation
+	if len(tk.keys) == 0 || tk.interval <= time.Since(tk.rotatedAt) {
+		if err := tk.rotate(); err != nil {
+			return err
+		}
+	}
+	tk.install()
+	tk.timer = time.AfterFunc(time.Until(tk.rotatedAt.Add(tk.interval)), tk.rotationTimeout)
+	return nil
+}
+
+func (tk *TLSTicketKeys) rotationTimeout() {
+	tk.Lock()
+	defer tk.Unlock()
+
+	// if a rehash happened in the meantime, it either disabled tickets
+	// or armed a new timer that supersedes this one:
+	if tk.configs == nil || time.Since(tk.rotatedAt) < tk.interval {
+		return
+	}
+	if err := tk.rotate(); err == nil {
+		tk.install()
+	}
+	// on failure, retry after another interval with the old keys in place
+	tk.timer = time.AfterFunc(tk.interval, tk.rotationTimeout)
+}
+
+func (tk *TLSTicketKeys) rotate() (err error) {
+	var key [32]byte
+	if _, err = rand.Read(key[:]); err != nil {
+		return
+	}
+	keys := make([][32]byte, 0, tlsTicketKeyCount)
+	keys = append(keys, key)
+	for _, oldKey := range tk.keys {
+		if len(keys) == tlsTicketKeyCount {
+			break
+		}
+		keys = append(keys, oldKey)
+	}
+	tk.keys = keys
+	tk.rotatedAt = time.Now()
+	return
+}
+
+func (tk *TLSTicketKeys) install() {
+	// SetSessionTicketKeys is safe to call while the config is in use
+	for _, tlsConfig := range tk.configs {
+		tlsConfig.SetSessionTicketKeys(tk.keys)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/utils"
+)
+
+func tlsTicketTestConfig(enabled bool) *Config {
+	config := &Config{}
+	config.Server.trueListeners = map[string]utils.ListenerConfig{
+		":6697": {TLSConfig: &tls.Config{}},
+		":6667": {},
+	}
+	config.Server.TLSSessionTickets.enabled = enabled
+	config.Server.TLSSessionTickets.KeyRotation = time.Hour
+	return config
+}
+
+func TestTLSTicketKeys(t *testing.T) {
+	var tk TLSTicketKeys
+	defer func() {
+		if tk.timer != nil {
+			tk.timer.Stop()
+		}
+	}()
+
+	if err := tk.Apply(tlsTicketTestConfig(true)); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(len(tk.keys), 1, t)
+	assertEqual(len(tk.configs), 1, t)
+	key := tk.keys[0]
+
+	// a rehash reuses the same key:
+	if err := tk.Apply(tlsTicketTestConfig(true)); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(tk.keys, [][32]byte{key}, t)
+
+	// rotation keeps the previous key, so its tickets remain valid:
+	tk.rotatedAt = time.Now().Add(-2 * time.Hour)
+	tk.rotationTimeout()
+	assertEqual(len(tk.keys), 2, t)
+	assertEqual(tk.keys[1], key, t)
+	// a stale timer firing early doesn't rotate:
+	tk.timer.Stop()
+	tk.rotationTimeout()
+	assertEqual(tk.keys[1], key, t)
+	tk.rotatedAt = time.Now().Add(-2 * time.Hour)
+	tk.rotationTimeout()
+	assertEqual(len(tk.keys), tlsTicketKeyCount, t)
+	if tk.keys[1] == key {
+		t.Errorf("the oldest key should have been discarded")
+	}
+
+	config := tlsTicketTestConfig(false)
+	if err := tk.Apply(config); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(config.Server.trueListeners[":6697"].TLSConfig.SessionTicketsDisabled, true, t)
+	assertEqual(tk.timer == nil, true, t)
+}
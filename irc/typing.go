@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"time"
+)
+
+// typing notifications are TAGMSG carrying the `typing` client-only tag:
+// https://ircv3.net/specs/client-tags/typing
+const (
+	typingTag      = "+typing"
+	draftTypingTag = "+draft/typing"
+
+	typingActive = "active"
+
+	// bound on the number of targets tracked per session for rate limiting
+	maxTypingTargets = 16
+)
+
+func isTypingTag(tag string) bool {
+	return tag == typingTag || tag == draftTypingTag
+}
+
+// isTypingNotification returns whether a set of client-only tags consists
+// solely of a typing notification.
+func isTypingNotification(tags map[string]string) bool {
+	if len(tags) == 0 {
+		return false
+	}
+	for tag := range tags {
+		if !isTypingTag(tag) {
+			return false
+		}
+	}
+	return true
+}
+
+func typingState(tags map[string]string) (state string) {
+	if state = tags[typingTag]; state == "" {
+		state = tags[draftTypingTag]
+	}
+	return
+}
+
+// TypingLimiter rate-limits the "active" typing notifications sent by a single
+// session, independently of fakelag. Notifications that the user stopped
+// typing ("paused" and "done") are always relayed, so that recipients don't
+// display a stale indicator. It is only accessed from the session's own
+// goroutine, so it needs no synchronization.
+type TypingLimiter struct {
+	lastActive map[string]time.Time
+}
+
+// Allow returns whether a typing notification to the (casefolded) target
+// should be relayed.
+func (tl *TypingLimiter) Allow(target string, tags map[string]string, interval time.Duration, now time.Time) bool {
+	if interval <= 0 || typingState(tags) != typingActive {
+		return true
+	}
+	if last, ok := tl.lastActive[target]; ok && now.Sub(last) < interval {
+		return false
+	}
+	if tl.lastActive == nil || len(tl.lastActive) >= maxTypingTargets {
+		tl.lastActive = make(map[string]time.Time)
+	}
+	tl.lastActive[target] = now
+	return true
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/oragono/oragono/irc/history"
+)
+
+func TestIsTypingNotification(t *testing.T) {
+	cases := []struct {
+		tags     map[string]string
+		expected bool
+	}{
+		{nil, false},
+		{map[string]string{"+typing": "active"}, true},
+		{map[string]string{"+draft/typing": "done", "+typing": "done"}, true},
+		{map[string]string{"+typing": "active", "+draft/reply": "abc"}, false},
+		{map[string]string{"+draft/react": "lol"}, false},
+	}
+	for _, c := range cases {
+		if isTypingNotification(c.tags) != c.expected {
+			t.Errorf("isTypingNotification(%v) should be %t", c.tags, c.expected)
+		}
+	}
+}
+
+func TestTypingLimiter(t *testing.T) {
+	var tl TypingLimiter
+	active := map[string]string{"+typing": "active"}
+	done := map[string]string{"+typing": "done"}
+	now := time.Now()
+	interval := 2 * time.Second
+
+	if !tl.Allow("#chan", active, interval, now) {
+		t.Errorf("first notification should be allowed")
+	}
+	if tl.Allow("#chan", active, interval, now.Add(time.Second)) {
+		t.Errorf("repeated active notification should be limited")
+	}
+	if !tl.Allow("#other", active, interval, now.Add(time.Second)) {
+		t.Errorf("targets should be limited independently")
+	}
+	if !tl.Allow("#chan", done, interval, now.Add(time.Second)) {
+		t.Errorf("done notifications should never be limited")
+	}
+	if !tl.Allow("#chan", active, interval, now.Add(3*time.Second)) {
+		t.Errorf("notification after the interval should be allowed")
+	}
+	if !tl.Allow("#chan", active, 0, now.Add(3*time.Second)) {
+		t.Errorf("a zero interval should disable limiting")
+	}
+}
+
+func TestTypingNotStored(t *testing.T) {
+	config := new(Config)
+	config.History.TagmsgStorage.Default = true
+	if itemIsStorable(&history.Item{Type: history.Tagmsg, Tags: map[string]string{"+typing": "active"}}, config) {
+		t.Errorf("typing notifications should never be stored")
+	}
+	if !itemIsStorable(&history.Item{Type: history.Tagmsg, Tags: map[string]string{"+draft/react": "lol"}}, config) {
+		t.Errorf("other TAGMSG should be stored when default is true")
+	}
+}
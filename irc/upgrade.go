@@ -0,0 +1,170 @@
+// +build !windows,!plan9
+
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Graceful upgrade is a listener-only restart: on SIGUSR2, the running server
+// starts a new copy of its executable, handing over its listening sockets. Once the new process has
+// loaded its config and taken the sockets, the old process saves all state
+// (including always-on clients) to the datastore, releases it, and exits;
+// only then does the new process open the datastore and start serving. Since
+// the sockets are never closed, new connections are queued rather than refused.
+// Established client connections are not handed over (among other things, their
+// TLS state can't be): they are drained as for a normal shutdown, and reconnect
+// to the new process.
+
+const (
+	// newline-separated list of listener addresses, in the order of the inherited fds
+	upgradeListenersEnv = "ORAGONO_UPGRADE_LISTENERS"
+	// how long to wait for the new process to start up before giving up
+	upgradeStartTimeout = 30 * time.Second
+	// the first inherited fd (after stdin, stdout, stderr)
+	upgradeFirstFd = 3
+)
+
+var (
+	errUpgradeFailed = errors.New("The new process did not start successfully")
+
+	// listeners inherited from the previous process, by address
+	inheritedListeners map[string]net.Listener
+)
+
+func notifyUpgradeSignal(upgradeSignal chan os.Signal) {
+	signal.Notify(upgradeSignal, syscall.SIGUSR2)
+}
+
+// PrepareUpgradeHandoff is called by `oragono run` before the server starts.
+// If this process was started by a graceful upgrade, it takes over the
+// listeners of the previous process, tells it to finish up, and waits for it
+// to release the datastore.
+func PrepareUpgradeHandoff() (err error) {
+	addrs := os.Getenv(upgradeListenersEnv)
+	if addrs == "" {
+		return nil
+	}
+	os.Unsetenv(upgradeListenersEnv)
+
+	addrList := strings.Split(addrs, "\n")
+	inheritedListeners = make(map[string]net.Listener, len(addrList))
+	for i, addr := range addrList {
+		file := os.NewFile(uintptr(upgradeFirstFd+i), addr)
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("Could not inherit listener %s: %w", addr, err)
+		}
+		inheritedListeners[addr] = listener
+	}
+
+	ready := os.NewFile(uintptr(upgradeFirstFd+len(addrList)), "upgrade-ready")
+	handoff := os.NewFile(uintptr(upgradeFirstFd+len(addrList)+1), "upgrade-handoff")
+	defer handoff.Close()
+	_, err = ready.Write([]byte{0})
+	ready.Close()
+	if err != nil {
+		return
+	}
+	// the old process closes its end once the datastore is free
+	_, err = ioutil.ReadAll(handoff)
+	return
+}
+
+func takeInheritedListener(addr string) (listener net.Listener) {
+	listener = inheritedListeners[addr]
+	delete(inheritedListeners, addr)
+	return
+}
+
+// closeInheritedListeners closes any inherited listeners that are no longer
+// in the config.
+func closeInheritedListeners() {
+	for addr, listener := range inheritedListeners {
+		listener.Close()
+		delete(inheritedListeners, addr)
+	}
+}
+
+// gracefulUpgrade hands off to a new copy of the executable. On success,
+// the server has been shut down and the caller should exit; on failure,
+// the server keeps running normally.
+func (server *Server) gracefulUpgrade() (err error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return
+	}
+
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	for addr, listener := range server.listeners {
+		file, err := listener.File()
+		if err != nil {
+			return fmt.Errorf("Could not pass on listener %s: %w", addr, err)
+		}
+		addrs = append(addrs, addr)
+		files = append(files, file)
+	}
+
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	defer readyR.Close()
+	handoffR, handoffW, err := os.Pipe()
+	if err != nil {
+		readyW.Close()
+		return
+	}
+	// closing this tells the new process that the datastore is free
+	defer handoffW.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), upgradeListenersEnv+"="+strings.Join(addrs, "\n"))
+	cmd.ExtraFiles = append(append(files, readyW), handoffR)
+	err = cmd.Start()
+	readyW.Close()
+	handoffR.Close()
+	if err != nil {
+		return
+	}
+
+	readyR.SetReadDeadline(time.Now().Add(upgradeStartTimeout))
+	if _, err := readyR.Read(make([]byte, 1)); err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return errUpgradeFailed
+	}
+
+	server.logger.Info("server", "New process started; handing off", fmt.Sprintf("pid %d", cmd.Process.Pid))
+	for _, listener := range server.listeners {
+		listener.Stop()
+	}
+	// connections queue on the new process's copies of the listeners
+	// while existing clients are warned and given time to quit
+	server.drain(true)
+	for _, channel := range server.channels.Channels() {
+		channel.Store(0)
+	}
+	server.Shutdown()
+	return nil
+}
@@ -0,0 +1,32 @@
+// +build windows plan9
+
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// graceful upgrade is not supported on these platforms
+
+func notifyUpgradeSignal(upgradeSignal chan os.Signal) {
+}
+
+func PrepareUpgradeHandoff() error {
+	return nil
+}
+
+func takeInheritedListener(addr string) net.Listener {
+	return nil
+}
+
+func closeInheritedListeners() {
+}
+
+func (server *Server) gracefulUpgrade() error {
+	return errors.New("Graceful upgrade is not supported on this platform")
+}
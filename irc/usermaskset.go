@@ -20,6 +20,8 @@ type MaskInfo struct {
 	TimeCreated     time.Time
 	CreatorNickmask string
 	CreatorAccount  string
+	Reason          string    `json:",omitempty"`
+	Expires         time.Time // zero for masks that don't expire
 }
 
 // UserMaskSet holds a set of client masks and lets you match  hostnames to them.
@@ -29,6 +31,14 @@ type UserMaskSet struct {
 	masks                  map[string]MaskInfo
 	regexp                 unsafe.Pointer
 	muteRegexp             unsafe.Pointer
+	extbans                unsafe.Pointer // *extbanMatchers
+}
+
+// extbanMatchers holds the compiled extbans that can't be expressed as
+// nick!user@host regexps
+type extbanMatchers struct {
+	bans  []extbanMatcher
+	mutes []extbanMatcher
 }
 
 func NewUserMaskSet() *UserMaskSet {
@@ -37,7 +47,16 @@ func NewUserMaskSet() *UserMaskSet {
 
 // Add adds the given mask to this set.
 func (set *UserMaskSet) Add(mask, creatorNickmask, creatorAccount string) (maskAdded string, err error) {
-	casefoldedMask, err := CanonicalizeMaskWildcard(mask)
+	return set.AddWithInfo(mask, MaskInfo{
+		CreatorNickmask: creatorNickmask,
+		CreatorAccount:  creatorAccount,
+	})
+}
+
+// AddWithInfo adds the given mask to this set, with a reason and/or an
+// expiration time; the creation time is filled in automatically.
+func (set *UserMaskSet) AddWithInfo(mask string, info MaskInfo) (maskAdded string, err error) {
+	casefoldedMask, err := canonicalizeListMask(mask)
 	if err != nil {
 		return
 	}
@@ -52,11 +71,8 @@ func (set *UserMaskSet) Add(mask, creatorNickmask, creatorAccount string) (maskA
 	_, present := set.masks[casefoldedMask]
 	if !present {
 		maskAdded = casefoldedMask
-		set.masks[casefoldedMask] = MaskInfo{
-			TimeCreated:     time.Now().UTC(),
-			CreatorNickmask: creatorNickmask,
-			CreatorAccount:  creatorAccount,
-		}
+		info.TimeCreated = time.Now().UTC()
+		set.masks[casefoldedMask] = info
 	}
 	set.Unlock()
 
@@ -68,7 +84,7 @@ func (set *UserMaskSet) Add(mask, creatorNickmask, creatorAccount string) (maskA
 
 // Remove removes the given mask from this set.
 func (set *UserMaskSet) Remove(mask string) (maskRemoved string, err error) {
-	mask, err = CanonicalizeMaskWildcard(mask)
+	mask, err = canonicalizeListMask(mask)
 	if err != nil {
 		return
 	}
@@ -90,6 +106,53 @@ func (set *UserMaskSet) Remove(mask string) (maskRemoved string, err error) {
 	return
 }
 
+// Expire removes the masks whose expiration time has passed, returning them.
+func (set *UserMaskSet) Expire(now time.Time) (expired []string) {
+	set.serialCacheUpdateMutex.Lock()
+	defer set.serialCacheUpdateMutex.Unlock()
+
+	set.Lock()
+	for mask, info := range set.masks {
+		if !info.Expires.IsZero() && !now.Before(info.Expires) {
+			expired = append(expired, mask)
+			delete(set.masks, mask)
+		}
+	}
+	set.Unlock()
+
+	if len(expired) != 0 {
+		set.setRegexp()
+	}
+	return
+}
+
+// SetExpiration sets the expiration time of a mask that is already in the set.
+func (set *UserMaskSet) SetExpiration(mask string, expires time.Time) (ok bool) {
+	set.Lock()
+	defer set.Unlock()
+
+	info, ok := set.masks[mask]
+	if ok {
+		info.Expires = expires
+		set.masks[mask] = info
+	}
+	return
+}
+
+// NextExpiration returns the earliest expiration time of any mask in the set,
+// or the zero time if none of them expire.
+func (set *UserMaskSet) NextExpiration() (result time.Time) {
+	set.RLock()
+	defer set.RUnlock()
+
+	for _, info := range set.masks {
+		if !info.Expires.IsZero() && (result.IsZero() || info.Expires.Before(result)) {
+			result = info.Expires
+		}
+	}
+	return
+}
+
 func (set *UserMaskSet) SetMasks(masks map[string]MaskInfo) {
 	set.Lock()
 	set.masks = masks
@@ -128,6 +191,42 @@ func (set *UserMaskSet) MatchMute(userhost string) bool {
 	return regexp.MatchString(userhost)
 }
 
+// MatchClient matches the given client against the bans, including extbans.
+func (set *UserMaskSet) MatchClient(client *Client) bool {
+	if set.Match(client.NickMaskCasefolded()) {
+		return true
+	}
+	if alternate := client.AlternateNickMaskCasefolded(); alternate != "" && set.Match(alternate) {
+		return true
+	}
+	if extbans := (*extbanMatchers)(atomic.LoadPointer(&set.extbans)); extbans != nil {
+		for _, extban := range extbans.bans {
+			if extban.Matches(client) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchMuteClient matches the given client against the mute extbans.
+func (set *UserMaskSet) MatchMuteClient(client *Client) bool {
+	if set.MatchMute(client.NickMaskCasefolded()) {
+		return true
+	}
+	if alternate := client.AlternateNickMaskCasefolded(); alternate != "" && set.MatchMute(alternate) {
+		return true
+	}
+	if extbans := (*extbanMatchers)(atomic.LoadPointer(&set.extbans)); extbans != nil {
+		for _, extban := range extbans.mutes {
+			if extban.Matches(client) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (set *UserMaskSet) MuteRegexp() *regexp.Regexp {
 	return (*regexp.Regexp)(atomic.LoadPointer(&set.muteRegexp))
 }
@@ -142,11 +241,36 @@ func (set *UserMaskSet) setRegexp() {
 	set.RLock()
 	maskExprs := make([]string, 0, len(set.masks))
 	var muteExprs []string
+	var extbans extbanMatchers
+	addExtban := func(matchers *[]extbanMatcher, mask string) {
+		if kind, arg, ok := splitExtban(mask); ok {
+			if pattern, err := utils.CompileGlob(arg, false); err == nil {
+				*matchers = append(*matchers, extbanMatcher{kind: kind, pattern: pattern})
+			}
+		}
+	}
 	for mask := range set.masks {
+		kind, arg, isExtban := splitExtban(mask)
 		if strings.HasPrefix(mask, "m:") {
+			// legacy syntax for ~q:
 			muteExprs = append(muteExprs, mask[2:])
-		} else {
+		} else if !isExtban {
 			maskExprs = append(maskExprs, mask)
+		} else if kind == extbanMute {
+			if strings.HasPrefix(arg, extbanPrefix) {
+				addExtban(&extbans.mutes, arg)
+			} else {
+				muteExprs = append(muteExprs, arg)
+			}
+		} else if kind == extbanJoin {
+			// ordinary bans only prevent joining, so ~j: is equivalent to them
+			if strings.HasPrefix(arg, extbanPrefix) {
+				addExtban(&extbans.bans, arg)
+			} else {
+				maskExprs = append(maskExprs, arg)
+			}
+		} else {
+			addExtban(&extbans.bans, mask)
 		}
 	}
 	set.RUnlock()
@@ -164,4 +288,9 @@ func (set *UserMaskSet) setRegexp() {
 
 	atomic.StorePointer(&set.regexp, unsafe.Pointer(re))
 	atomic.StorePointer(&set.muteRegexp, unsafe.Pointer(muteRe))
+	var extbansPtr *extbanMatchers
+	if len(extbans.bans) != 0 || len(extbans.mutes) != 0 {
+		extbansPtr = &extbans
+	}
+	atomic.StorePointer(&set.extbans, unsafe.Pointer(extbansPtr))
 }
@@ -5,6 +5,7 @@ package irc
 
 import (
 	"testing"
+	"time"
 )
 
 func TestUserMaskSet(t *testing.T) {
@@ -34,3 +35,46 @@ func TestUserMaskSet(t *testing.T) {
 		t.Errorf("unexpected MatchMute() succeeded")
 	}
 }
+
+func TestUserMaskSetExpiry(t *testing.T) {
+	s := NewUserMaskSet()
+	now := time.Now().UTC()
+
+	s.Add("*!*@permanent.example.com", "", "")
+	if !s.NextExpiration().IsZero() {
+		t.Errorf("permanent masks should have no expiration")
+	}
+
+	s.AddWithInfo("*!*@soon.example.com", MaskInfo{Reason: "spam", Expires: now.Add(time.Minute)})
+	s.AddWithInfo("*!*@later.example.com", MaskInfo{Expires: now.Add(time.Hour)})
+	if next := s.NextExpiration(); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("unexpected next expiration %v", next)
+	}
+	if info := s.Masks()["*!*@soon.example.com"]; info.Reason != "spam" || info.TimeCreated.IsZero() {
+		t.Errorf("mask info was not stored: %#v", info)
+	}
+
+	if expired := s.Expire(now); len(expired) != 0 {
+		t.Errorf("nothing should have expired yet, got %v", expired)
+	}
+	expired := s.Expire(now.Add(2 * time.Minute))
+	if len(expired) != 1 || expired[0] != "*!*@soon.example.com" {
+		t.Errorf("unexpected expired masks %v", expired)
+	}
+	if s.Match("bob!~bob@soon.example.com") {
+		t.Errorf("expired mask should no longer match")
+	}
+	if !s.Match("bob!~bob@later.example.com") || s.Length() != 2 {
+		t.Errorf("unexpired masks should remain")
+	}
+
+	if !s.SetExpiration("*!*@permanent.example.com", now.Add(time.Second)) {
+		t.Errorf("could not set the expiration of an existing mask")
+	}
+	if s.SetExpiration("*!*@absent.example.com", now) {
+		t.Errorf("set the expiration of a nonexistent mask")
+	}
+	if next := s.NextExpiration(); !next.Equal(now.Add(time.Second)) {
+		t.Errorf("unexpected next expiration %v", next)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -19,6 +20,16 @@ const (
 	// "a 108-byte buffer is always enough to store all the line and a trailing zero
 	// for string processing."
 	maxProxyLineLenV1 = 107
+
+	// PROXY v2 TLV types and flags (section 2.2 of the specification):
+	pp2TypeAuthority     = 0x02
+	pp2TypeSSL           = 0x20
+	pp2SubtypeSSLVersion = 0x21
+	pp2SubtypeSSLCN      = 0x22
+	pp2SubtypeSSLCipher  = 0x23
+	pp2ClientSSL         = 0x01
+	pp2ClientCertConn    = 0x02
+	pp2ClientCertSess    = 0x04
 )
 
 // XXX implement net.Error with a Temporary() method that returns true;
@@ -41,20 +52,43 @@ var (
 	ErrBadProxyLine error = &proxyLineError{}
 	// TODO(golang/go#4373): replace this with the stdlib ErrNetClosing
 	ErrNetClosing = errors.New("use of closed network connection")
+
+	ErrListenerNotInheritable = errors.New("listener cannot be passed to another process")
 )
 
+// ProxiedTLS describes the TLS connection between the client and a
+// TLS-terminating proxy, as reported by the proxy in PROXY v2 TLVs.
+type ProxiedTLS struct {
+	Version string // e.g., "TLSv1.3"
+	Cipher  string
+	SNI     string // the server name requested by the client
+	// whether the client presented a certificate, and whether the proxy
+	// verified it:
+	ClientCert   bool
+	CertVerified bool
+	CertCN       string
+	// the client certificate fingerprint; there is no standard TLV for this,
+	// so it is only available from a custom TLV (see ListenerConfig)
+	CertFP string
+}
+
 // ListenerConfig is all the information about how to process
 // incoming IRC connections on a listener.
 type ListenerConfig struct {
 	TLSConfig     *tls.Config
 	ProxyDeadline time.Duration
 	RequireProxy  bool
+	// the type of a custom PROXY v2 TLV containing the SHA-256 fingerprint of
+	// the client certificate, in hex (0 if none is expected)
+	ProxyCertfpTLV byte
 	// these are just metadata for easier tracking,
 	// they are not used by ReloadableListener:
 	Tor       bool
 	STSOnly   bool
 	WebSocket bool
 	HideSTS   bool
+	Webchat   bool
+	Name      string // the listener's address in the config
 }
 
 // read a PROXY header (either v1 or v2), ensuring we don't read anything beyond
@@ -122,18 +156,20 @@ func readRawProxyLineV2(conn net.Conn, buf []byte) (result []byte, err error) {
 	return buf[0 : 16+addrLen], nil
 }
 
-// ParseProxyLine parses a PROXY protocol (v1 or v2) line and returns the remote IP.
-func ParseProxyLine(line []byte) (ip net.IP, err error) {
+// ParseProxyLine parses a PROXY protocol (v1 or v2) line and returns the remote IP,
+// and if the line carries TLS information (v2 only), the client's TLS status.
+func ParseProxyLine(line []byte, certfpTLV byte) (ip net.IP, tlsInfo *ProxiedTLS, err error) {
 	if len(line) == 0 {
-		return nil, ErrBadProxyLine
+		return nil, nil, ErrBadProxyLine
 	}
 	switch line[0] {
 	case 'P':
-		return ParseProxyLineV1(string(line))
+		ip, err = ParseProxyLineV1(string(line))
+		return
 	case '\r':
-		return parseProxyLineV2(line)
+		return parseProxyLineV2(line, certfpTLV)
 	default:
-		return nil, ErrBadProxyLine
+		return nil, nil, ErrBadProxyLine
 	}
 }
 
@@ -150,29 +186,29 @@ func ParseProxyLineV1(line string) (ip net.IP, err error) {
 	return ip.To16(), nil
 }
 
-func parseProxyLineV2(line []byte) (ip net.IP, err error) {
+func parseProxyLineV2(line []byte, certfpTLV byte) (ip net.IP, tlsInfo *ProxiedTLS, err error) {
 	if len(line) < 16 {
-		return nil, ErrBadProxyLine
+		return nil, nil, ErrBadProxyLine
 	}
 	// this doesn't allocate
 	if string(line[:12]) != "\x0d\x0a\x0d\x0a\x00\x0d\x0a\x51\x55\x49\x54\x0a" {
-		return nil, ErrBadProxyLine
+		return nil, nil, ErrBadProxyLine
 	}
 	// "The next byte (the 13th one) is the protocol version and command."
 	versionCmd := line[12]
 	// "The highest four bits contains the version [....] it must always be sent as \x2"
 	if (versionCmd >> 4) != 2 {
-		return nil, ErrBadProxyLine
+		return nil, nil, ErrBadProxyLine
 	}
 	// "The lowest four bits represents the command"
 	switch versionCmd & 0x0f {
 	case 0:
-		return nil, nil // LOCAL command
+		return nil, nil, nil // LOCAL command
 	case 1:
 		// PROXY command, continue below
 	default:
 		// "Receivers must drop connections presenting unexpected values here"
-		return nil, ErrBadProxyLine
+		return nil, nil, ErrBadProxyLine
 	}
 
 	var addrLen int
@@ -185,13 +221,13 @@ func parseProxyLineV2(line []byte) (ip net.IP, err error) {
 	case 2:
 		addrLen = 16 // AF_INET6
 	default:
-		return nil, nil // AF_UNSPEC or AF_UNIX, either way there's no IP address
+		return nil, nil, nil // AF_UNSPEC or AF_UNIX, either way there's no IP address
 	}
 
 	// header, source and destination address, two 16-bit port numbers:
 	expectedLen := 16 + 2*addrLen + 4
 	if len(line) < expectedLen {
-		return nil, ErrBadProxyLine
+		return nil, nil, ErrBadProxyLine
 	}
 
 	// "Starting from the 17th byte, addresses are presented in network byte order.
@@ -203,7 +239,76 @@ func parseProxyLineV2(line []byte) (ip net.IP, err error) {
 		ip = make(net.IP, addrLen)
 		copy(ip, line[16:16+addrLen])
 	}
-	return ip, nil
+
+	// any remaining bytes are TLVs
+	tlsInfo, err = parseProxyTLVs(line[expectedLen:], certfpTLV)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ip, tlsInfo, nil
+}
+
+// iterate over a sequence of PROXY v2 TLVs: a one-byte type, a two-byte
+// length in network byte order, and the value
+func forEachProxyTLV(tlvs []byte, f func(tlvType byte, value []byte)) error {
+	for len(tlvs) != 0 {
+		if len(tlvs) < 3 {
+			return ErrBadProxyLine
+		}
+		valueLen := int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+valueLen {
+			return ErrBadProxyLine
+		}
+		f(tlvs[0], tlvs[3:3+valueLen])
+		tlvs = tlvs[3+valueLen:]
+	}
+	return nil
+}
+
+// parseProxyTLVs extracts the client's TLS status from the TLVs following the
+// addresses; it returns nil unless the client connected to the proxy with TLS.
+func parseProxyTLVs(tlvs []byte, certfpTLV byte) (result *ProxiedTLS, err error) {
+	var sni, certfp string
+	var subErr error
+	err = forEachProxyTLV(tlvs, func(tlvType byte, value []byte) {
+		switch {
+		case tlvType == pp2TypeAuthority:
+			sni = string(value)
+		case tlvType == pp2TypeSSL:
+			// one byte of client flags, then a 32-bit verification result
+			// (0 for success), then sub-TLVs
+			if len(value) < 5 || value[0]&pp2ClientSSL == 0 {
+				return
+			}
+			result = &ProxiedTLS{
+				ClientCert:   value[0]&(pp2ClientCertConn|pp2ClientCertSess) != 0,
+				CertVerified: binary.BigEndian.Uint32(value[1:5]) == 0,
+			}
+			subErr = forEachProxyTLV(value[5:], func(subType byte, subValue []byte) {
+				switch subType {
+				case pp2SubtypeSSLVersion:
+					result.Version = string(subValue)
+				case pp2SubtypeSSLCN:
+					result.CertCN = string(subValue)
+				case pp2SubtypeSSLCipher:
+					result.Cipher = string(subValue)
+				}
+			})
+		case certfpTLV != 0 && tlvType == certfpTLV:
+			certfp = string(value)
+		}
+	})
+	if err == nil {
+		err = subErr
+	}
+	if err != nil || result == nil {
+		return nil, err
+	}
+	result.SNI = sni
+	if result.ClientCert {
+		result.CertFP, _ = NormalizeCertfp(certfp)
+	}
+	return result, nil
 }
 
 /// WrappedConn is a net.Conn with some additional data stapled to it;
@@ -212,7 +317,10 @@ func parseProxyLineV2(line []byte) (ip net.IP, err error) {
 type WrappedConn struct {
 	net.Conn
 	ProxiedIP net.IP
-	Config    ListenerConfig
+	// ProxiedTLS is the client's TLS status as reported by a TLS-terminating
+	// proxy via the PROXY protocol, if any:
+	ProxiedTLS *ProxiedTLS
+	Config     ListenerConfig
 	// Secure indicates whether we believe the connection between us and the client
 	// was secure against interception and modification (including all proxies):
 	Secure bool
@@ -260,6 +368,7 @@ func (rl *ReloadableListener) Accept() (conn net.Conn, err error) {
 	}
 
 	var proxiedIP net.IP
+	var proxiedTLS *ProxiedTLS
 	if config.RequireProxy {
 		// this will occur synchronously on the goroutine calling Accept(),
 		// but that's OK because this listener *requires* a PROXY line,
@@ -267,7 +376,7 @@ func (rl *ReloadableListener) Accept() (conn net.Conn, err error) {
 		// and we won't get slowloris'ed waiting for the client response
 		proxyLine, err := readRawProxyLine(conn, config.ProxyDeadline)
 		if err == nil {
-			proxiedIP, err = ParseProxyLine(proxyLine)
+			proxiedIP, proxiedTLS, err = ParseProxyLine(proxyLine, config.ProxyCertfpTLV)
 		}
 		if err != nil {
 			conn.Close()
@@ -280,9 +389,10 @@ func (rl *ReloadableListener) Accept() (conn net.Conn, err error) {
 	}
 
 	return &WrappedConn{
-		Conn:      conn,
-		ProxiedIP: proxiedIP,
-		Config:    config,
+		Conn:       conn,
+		ProxiedIP:  proxiedIP,
+		ProxiedTLS: proxiedTLS,
+		Config:     config,
 	}, nil
 }
 
@@ -297,3 +407,16 @@ func (rl *ReloadableListener) Close() error {
 func (rl *ReloadableListener) Addr() net.Addr {
 	return rl.realListener.Addr()
 }
+
+// File returns a duplicate of the underlying socket, which can be passed to
+// another process (see (*net.TCPListener).File).
+func (rl *ReloadableListener) File() (*os.File, error) {
+	if unixListener, ok := rl.realListener.(interface{ SetUnlinkOnClose(bool) }); ok {
+		// the socket path now belongs to whoever receives the file
+		unixListener.SetUnlinkOnClose(false)
+	}
+	if fileListener, ok := rl.realListener.(interface{ File() (*os.File, error) }); ok {
+		return fileListener.File()
+	}
+	return nil, ErrListenerNotInheritable
+}
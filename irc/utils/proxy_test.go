@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package utils
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func makeTLV(tlvType byte, value []byte) (result []byte) {
+	result = []byte{tlvType, 0, 0}
+	binary.BigEndian.PutUint16(result[1:], uint16(len(value)))
+	return append(result, value...)
+}
+
+// makeProxyLineV2 builds a PROXY v2 header for a TCP over IPv4 connection
+func makeProxyLineV2(src net.IP, tlvs ...[]byte) (result []byte) {
+	result = []byte("\x0d\x0a\x0d\x0a\x00\x0d\x0a\x51\x55\x49\x54\x0a\x21\x11\x00\x00")
+	result = append(result, src.To4()...)
+	result = append(result, 10, 0, 0, 1) // destination
+	result = append(result, 0x30, 0x39, 0x1a, 0x0b)
+	for _, tlv := range tlvs {
+		result = append(result, tlv...)
+	}
+	binary.BigEndian.PutUint16(result[14:16], uint16(len(result)-16))
+	return
+}
+
+func makeSSLTLV(clientFlags byte, verify uint32, subTLVs ...[]byte) []byte {
+	value := []byte{clientFlags, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(value[1:], verify)
+	for _, sub := range subTLVs {
+		value = append(value, sub...)
+	}
+	return makeTLV(pp2TypeSSL, value)
+}
+
+func TestParseProxyLineV1(t *testing.T) {
+	ip, tlsInfo, err := ParseProxyLine([]byte("PROXY TCP4 192.168.1.2 10.0.0.1 12345 6667\r\n"), 0)
+	if err != nil || !ip.Equal(net.ParseIP("192.168.1.2")) || tlsInfo != nil {
+		t.Errorf("bad v1 parse: %v %v %v", ip, tlsInfo, err)
+	}
+}
+
+func TestParseProxyLineV2(t *testing.T) {
+	src := net.ParseIP("192.168.1.2")
+
+	ip, tlsInfo, err := ParseProxyLine(makeProxyLineV2(src), 0)
+	if err != nil || !ip.Equal(src) || tlsInfo != nil {
+		t.Errorf("bad v2 parse: %v %v %v", ip, tlsInfo, err)
+	}
+
+	certfp := strings.Repeat("ab", 32)
+	line := makeProxyLineV2(src,
+		makeTLV(pp2TypeAuthority, []byte("irc.example.com")),
+		makeSSLTLV(pp2ClientSSL|pp2ClientCertConn, 1,
+			makeTLV(pp2SubtypeSSLVersion, []byte("TLSv1.3")),
+			makeTLV(pp2SubtypeSSLCN, []byte("dan")),
+			makeTLV(pp2SubtypeSSLCipher, []byte("TLS_AES_128_GCM_SHA256")),
+		),
+		makeTLV(0xe0, []byte(strings.ToUpper(certfp))),
+	)
+	ip, tlsInfo, err = ParseProxyLine(line, 0xe0)
+	if err != nil || !ip.Equal(src) {
+		t.Fatalf("bad v2 parse: %v %v", ip, err)
+	}
+	expected := ProxiedTLS{
+		Version:      "TLSv1.3",
+		Cipher:       "TLS_AES_128_GCM_SHA256",
+		SNI:          "irc.example.com",
+		ClientCert:   true,
+		CertVerified: false,
+		CertCN:       "dan",
+		CertFP:       certfp,
+	}
+	if tlsInfo == nil || !reflect.DeepEqual(*tlsInfo, expected) {
+		t.Errorf("expected %#v, got %#v", expected, tlsInfo)
+	}
+
+	// the certfp TLV is ignored unless it's configured:
+	_, tlsInfo, _ = ParseProxyLine(line, 0)
+	if tlsInfo == nil || tlsInfo.CertFP != "" {
+		t.Errorf("unexpected certfp: %#v", tlsInfo)
+	}
+
+	// an SSL TLV without the PP2_CLIENT_SSL flag means a plaintext connection:
+	_, tlsInfo, err = ParseProxyLine(makeProxyLineV2(src, makeSSLTLV(0, 0)), 0)
+	if err != nil || tlsInfo != nil {
+		t.Errorf("unexpected TLS status: %#v %v", tlsInfo, err)
+	}
+
+	// truncated TLVs are rejected:
+	line = makeProxyLineV2(src, makeTLV(pp2TypeAuthority, []byte("irc.example.com")))
+	line = line[:len(line)-2]
+	binary.BigEndian.PutUint16(line[14:16], uint16(len(line)-16))
+	if _, _, err = ParseProxyLine(line, 0); err != ErrBadProxyLine {
+		t.Errorf("expected truncated TLV to be rejected, got %v", err)
+	}
+	line = makeProxyLineV2(src, makeSSLTLV(pp2ClientSSL, 0, []byte{pp2SubtypeSSLVersion, 0, 10, 'T'}))
+	if _, _, err = ParseProxyLine(line, 0); err != ErrBadProxyLine {
+		t.Errorf("expected truncated sub-TLV to be rejected, got %v", err)
+	}
+}
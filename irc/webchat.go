@@ -0,0 +1,310 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/oragono/oragono/irc/connection_limits"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// the webchat gateway is an optional feature of websocket listeners: they serve
+// a minimal web client at /, and web users who log in through its form receive
+// a short-lived token that logs their websocket connection into their account.
+
+const (
+	webchatLoginPath = "/webchat/login"
+	// query parameter of the websocket URL that carries the login token:
+	webchatTokenParam = "token"
+
+	defaultWebchatTokenLifetime = time.Minute
+	// prune expired tokens and throttles when we have this many:
+	webchatPruneThreshold = 1024
+)
+
+// WebchatConfig controls the built-in web client.
+type WebchatConfig struct {
+	// channel that the web client offers to join
+	Channel       string
+	TokenLifetime time.Duration `yaml:"token-lifetime"`
+}
+
+type webchatToken struct {
+	account string // casefolded
+	ip      string
+	expires time.Time
+}
+
+// WebchatManager issues and redeems the login tokens of the web client.
+type WebchatManager struct {
+	server *Server
+
+	sync.Mutex // tier 1
+	tokens     map[string]webchatToken
+	throttles  map[string]*connection_limits.GenericThrottle // keyed by IP
+}
+
+func (wm *WebchatManager) Initialize(server *Server) {
+	wm.server = server
+	wm.tokens = make(map[string]webchatToken)
+	wm.throttles = make(map[string]*connection_limits.GenericThrottle)
+}
+
+// checkThrottle applies the login throttle to an IP, since web logins have no
+// client to hold it.
+func (wm *WebchatManager) checkThrottle(ip string, config *Config) (throttled bool) {
+	wm.Lock()
+	defer wm.Unlock()
+
+	throttle, ok := wm.throttles[ip]
+	if !ok {
+		if len(wm.throttles) >= webchatPruneThreshold {
+			wm.pruneThrottles()
+		}
+		throttle = &connection_limits.GenericThrottle{
+			Duration: config.Accounts.LoginThrottling.Duration,
+			Limit:    config.Accounts.LoginThrottling.MaxAttempts,
+		}
+		wm.throttles[ip] = throttle
+	}
+	throttled, _ = throttle.Touch()
+	return
+}
+
+func (wm *WebchatManager) pruneThrottles() {
+	now := time.Now().UTC()
+	for ip, throttle := range wm.throttles {
+		if now.Sub(throttle.Start) > throttle.Duration {
+			delete(wm.throttles, ip)
+		}
+	}
+}
+
+// IssueToken returns a token that logs a connection from `ip` into `account`.
+func (wm *WebchatManager) IssueToken(account, ip string, lifetime time.Duration) (token string) {
+	token = utils.GenerateSecretToken()
+	now := time.Now().UTC()
+
+	wm.Lock()
+	defer wm.Unlock()
+	if len(wm.tokens) >= webchatPruneThreshold {
+		for t, info := range wm.tokens {
+			if now.After(info.expires) {
+				delete(wm.tokens, t)
+			}
+		}
+	}
+	wm.tokens[token] = webchatToken{
+		account: account,
+		ip:      ip,
+		expires: now.Add(lifetime),
+	}
+	return
+}
+
+// RedeemToken consumes a token, returning the account it was issued for.
+func (wm *WebchatManager) RedeemToken(token, ip string) (account string, ok bool) {
+	wm.Lock()
+	info, ok := wm.tokens[token]
+	delete(wm.tokens, token)
+	wm.Unlock()
+
+	if !ok || info.ip != ip || time.Now().UTC().After(info.expires) {
+		return "", false
+	}
+	return info.account, true
+}
+
+// webchatClientIP returns the IP that a web client's requests (including its
+// eventual websocket connection) are attributed to.
+func webchatClientIP(r *http.Request, config *Config) net.IP {
+	return utils.HandleXForwardedFor(r.RemoteAddr, r.Header.Get("X-Forwarded-For"), config.Server.proxyAllowedFromNets)
+}
+
+// isSameOrigin checks that a request came from a page we served.
+func isSameOrigin(r *http.Request) bool {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && origin.Host != "" && origin.Host == r.Host
+}
+
+// serveWebchat handles the (non-websocket) HTTP requests of the web client.
+func (wm *WebchatManager) serveWebchat(config *Config, w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("X-Frame-Options", "DENY")
+		webchatTemplate.Execute(w, map[string]string{
+			"Network":   config.Network.Name,
+			"Channel":   config.Server.Webchat.Channel,
+			"LoginPath": webchatLoginPath,
+			"Token":     webchatTokenParam,
+		})
+	case webchatLoginPath:
+		wm.serveLogin(config, w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type webchatLoginResponse struct {
+	Token string `json:"token,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+func (wm *WebchatManager) serveLogin(config *Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	respond := func(status int, response webchatLoginResponse) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+
+	// only our own page may exchange credentials for tokens:
+	if !isSameOrigin(r) {
+		respond(http.StatusForbidden, webchatLoginResponse{Error: "cross-origin login requests are not allowed"})
+		return
+	}
+	if !config.Accounts.AuthenticationEnabled {
+		respond(http.StatusForbidden, webchatLoginResponse{Error: "authentication is disabled"})
+		return
+	}
+	ip := webchatClientIP(r, config).String()
+	if wm.checkThrottle(ip, config) {
+		respond(http.StatusTooManyRequests, webchatLoginResponse{Error: "too many login attempts, please try again later"})
+		return
+	}
+
+	account, err := wm.server.accounts.checkPassphrase(r.PostFormValue("account"), r.PostFormValue("password"))
+	if err != nil {
+		respond(http.StatusForbidden, webchatLoginResponse{Error: "invalid account credentials"})
+		return
+	}
+	lifetime := config.Server.Webchat.TokenLifetime
+	if lifetime == 0 {
+		lifetime = defaultWebchatTokenLifetime
+	}
+	respond(http.StatusOK, webchatLoginResponse{Token: wm.IssueToken(account.NameCasefolded, ip, lifetime)})
+}
+
+// applyWebchatLogin logs a new client into the account named by its webchat
+// token, as though it had completed SASL.
+func (server *Server) applyWebchatLogin(client *Client, session *Session, accountName string) {
+	account, err := server.accounts.LoadAccount(accountName)
+	if err != nil || !account.Verified || account.Suspended != nil {
+		return
+	}
+	server.accounts.Login(client, account)
+	details := client.Details()
+	session.Send(nil, server.name, RPL_LOGGEDIN, details.nick, details.nickMask, details.accountName, fmt.Sprintf(client.t("You are now logged in as %s"), details.accountName))
+	server.logger.Info("accounts", "webchat client logged into account", details.accountName)
+}
+
+// webchatTemplate is the built-in web client: a login form and a bare-bones
+// text interface, speaking IRC over the listener's own websocket endpoint.
+var webchatTemplate = template.Must(template.New("webchat").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Network}}</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; flex-direction: column; height: 100vh; }
+#login { padding: 1em; }
+#log { flex: 1; overflow-y: auto; font-family: monospace; white-space: pre-wrap; padding: 0.5em; }
+#input { display: none; border: 0; border-top: 1px solid #ccc; padding: 0.5em; font-size: 1em; }
+</style>
+</head>
+<body>
+<form id="login">
+<h1>{{.Network}}</h1>
+<p><input name="nick" placeholder="nickname" required></p>
+<p><input name="account" placeholder="account (optional)"> <input name="password" type="password" placeholder="password"></p>
+<p><input name="channel" placeholder="channel" value="{{.Channel}}"> <button>Connect</button></p>
+<p id="error"></p>
+</form>
+<div id="log"></div>
+<input id="input" placeholder="type a message, or /command">
+<script>
+const form = document.getElementById("login"), log = document.getElementById("log"), input = document.getElementById("input");
+let ws, channel;
+
+function show(text) {
+	const line = document.createElement("div");
+	line.textContent = text;
+	log.appendChild(line);
+	log.scrollTop = log.scrollHeight;
+}
+
+function parse(line) {
+	let prefix = "", params = [], trailing = null;
+	if (line[0] === "@") line = line.slice(line.indexOf(" ") + 1);
+	if (line[0] === ":") { prefix = line.slice(1, line.indexOf(" ")); line = line.slice(line.indexOf(" ") + 1); }
+	const i = line.indexOf(" :");
+	if (i !== -1) { trailing = line.slice(i + 2); line = line.slice(0, i); }
+	params = line.split(" ").filter(p => p);
+	if (trailing !== null) params.push(trailing);
+	return {nick: prefix.split("!")[0], command: params.shift().toUpperCase(), params: params};
+}
+
+function connect(nick, token) {
+	const scheme = location.protocol === "https:" ? "wss:" : "ws:";
+	ws = new WebSocket(scheme + "//" + location.host + "/" + (token ? "?{{.Token}}=" + encodeURIComponent(token) : ""), "text.ircv3.net");
+	ws.onopen = () => { ws.send("NICK " + nick); ws.send("USER webchat 0 * :" + nick); };
+	ws.onclose = () => show("*** Disconnected");
+	ws.onmessage = (event) => {
+		const msg = parse(event.data);
+		if (msg.command === "PING") { ws.send("PONG :" + msg.params[0]); return; }
+		if (msg.command === "001" && channel) ws.send("JOIN " + channel);
+		if (msg.command === "PRIVMSG" || msg.command === "NOTICE") {
+			show((msg.params[0].startsWith("#") ? msg.params[0] + " " : "") + "<" + (msg.nick || "*") + "> " + msg.params[1]);
+		} else {
+			show("*** " + (msg.nick ? msg.nick + " " : "") + msg.command + " " + msg.params.join(" "));
+		}
+	};
+	form.style.display = "none";
+	input.style.display = "block";
+	input.focus();
+}
+
+form.onsubmit = async (event) => {
+	event.preventDefault();
+	const data = new FormData(form);
+	channel = data.get("channel");
+	let token = "";
+	if (data.get("account")) {
+		const response = await fetch("{{.LoginPath}}", {method: "POST", body: new URLSearchParams({account: data.get("account"), password: data.get("password")})});
+		const result = await response.json();
+		if (!result.token) { document.getElementById("error").textContent = result.error; return; }
+		token = result.token;
+	}
+	connect(data.get("nick"), token);
+};
+
+input.onkeydown = (event) => {
+	if (event.key !== "Enter" || !input.value) return;
+	if (input.value[0] === "/") {
+		ws.send(input.value.slice(1));
+	} else if (channel) {
+		ws.send("PRIVMSG " + channel + " :" + input.value);
+		show(channel + " <me> " + input.value);
+	}
+	input.value = "";
+};
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebchatTokens(t *testing.T) {
+	var wm WebchatManager
+	wm.Initialize(newTestServer())
+
+	token := wm.IssueToken("shivaram", "10.0.0.1", time.Minute)
+	_, ok := wm.RedeemToken(token, "10.0.0.2")
+	assertEqual(ok, false, t)
+	// a failed redemption still consumes the token:
+	_, ok = wm.RedeemToken(token, "10.0.0.1")
+	assertEqual(ok, false, t)
+
+	token = wm.IssueToken("shivaram", "10.0.0.1", time.Minute)
+	account, ok := wm.RedeemToken(token, "10.0.0.1")
+	assertEqual(ok, true, t)
+	assertEqual(account, "shivaram", t)
+	_, ok = wm.RedeemToken(token, "10.0.0.1")
+	assertEqual(ok, false, t)
+
+	token = wm.IssueToken("shivaram", "10.0.0.1", -time.Second)
+	_, ok = wm.RedeemToken(token, "10.0.0.1")
+	assertEqual(ok, false, t)
+}
+
+func TestWebchatLoginOrigin(t *testing.T) {
+	server := newTestServer()
+	server.webchat.Initialize(server)
+	config := server.Config()
+	config.Accounts.AuthenticationEnabled = true
+
+	login := func(origin string) int {
+		form := url.Values{"account": {"shivaram"}, "password": {"hunter2"}}
+		r := httptest.NewRequest(http.MethodPost, "http://chat.example.com"+webchatLoginPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		server.webchat.serveWebchat(config, w, r)
+		return w.Code
+	}
+	assertEqual(login(""), http.StatusForbidden, t)
+	assertEqual(login("https://evil.example.com"), http.StatusForbidden, t)
+
+	config.Accounts.LoginThrottling.Duration = time.Minute
+	config.Accounts.LoginThrottling.MaxAttempts = 1
+	assertEqual(server.webchat.checkThrottle("192.0.2.1", config), false, t)
+	assertEqual(login("https://chat.example.com"), http.StatusTooManyRequests, t)
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/oragono/oragono/irc/modes"
+	"github.com/oragono/oragono/irc/utils"
+)
+
+// events that can be delivered to webhooks:
+const (
+	WebhookConnect         = "connect"
+	WebhookDisconnect      = "disconnect"
+	WebhookAccountRegister = "account-register"
+	WebhookChannelRegister = "channel-register"
+	WebhookOper            = "oper"
+	WebhookAutomod         = "automod"
+	WebhookSnomask         = "snomask"
+)
+
+var (
+	webhookEvents = utils.StringSet{
+		WebhookConnect:         {},
+		WebhookDisconnect:      {},
+		WebhookAccountRegister: {},
+		WebhookChannelRegister: {},
+		WebhookOper:            {},
+		WebhookAutomod:         {},
+		WebhookSnomask:         {},
+	}
+)
+
+const (
+	webhookEventHeader     = "X-Oragono-Event"
+	webhookSignatureHeader = "X-Oragono-Signature"
+	defaultWebhookTimeout  = 10 * time.Second
+	// deliveries in flight (including those waiting to retry); events beyond
+	// this are dropped rather than queued, so a dead endpoint can't exhaust memory
+	maxWebhookDeliveries = 64
+	// the delay before the first retry, doubling with each subsequent one
+	webhookRetryDelay = 2 * time.Second
+)
+
+type WebhookConfig struct {
+	URL string
+	// if set, each request is signed with HMAC-SHA256 under this secret
+	Secret string
+	// events to deliver; if empty, all events are delivered
+	Events     []string
+	events     utils.StringSet
+	Timeout    time.Duration
+	MaxRetries int `yaml:"max-retries"`
+}
+
+func (conf *WebhookConfig) prepare() (err error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook url: %s", conf.URL)
+	}
+	conf.events = make(utils.StringSet)
+	for _, event := range conf.Events {
+		event = strings.ToLower(event)
+		if !webhookEvents.Has(event) {
+			return fmt.Errorf("invalid webhook event: %s", event)
+		}
+		conf.events.Add(event)
+	}
+	if conf.Timeout == 0 {
+		conf.Timeout = defaultWebhookTimeout
+	}
+	if conf.MaxRetries < 0 {
+		return fmt.Errorf("invalid webhook max-retries: %d", conf.MaxRetries)
+	}
+	return nil
+}
+
+// webhookData is the event-specific part of a webhook payload
+type webhookData map[string]interface{}
+
+type webhookPayload struct {
+	Event  string      `json:"event"`
+	Time   string      `json:"time"`
+	Server string      `json:"server"`
+	Data   webhookData `json:"data"`
+}
+
+// webhookClientData describes a client, for inclusion in an event
+func webhookClientData(client *Client, details ClientDetails) webhookData {
+	return webhookData{
+		"nick":     details.nick,
+		"username": details.username,
+		"realname": details.realname,
+		"hostname": client.Hostname(),
+		"ip":       client.IP().String(),
+		"account":  details.account,
+		"tls":      client.HasMode(modes.TLS),
+	}
+}
+
+// webhookOperData describes an action taken by an operator
+func webhookOperData(client *Client, action string) webhookData {
+	data := webhookData{
+		"action": action,
+		"client": webhookClientData(client, client.Details()),
+	}
+	if oper := client.Oper(); oper != nil {
+		data["oper"] = oper.Name
+	}
+	return data
+}
+
+// WebhookManager POSTs JSON descriptions of server events to the webhooks
+// configured under `webhooks`, so that they can be fed into moderation
+// pipelines, bridges, and the like without polling.
+type WebhookManager struct {
+	server    *Server
+	semaphore utils.Semaphore
+}
+
+func (wm *WebhookManager) Initialize(server *Server) {
+	wm.server = server
+	wm.semaphore.Initialize(maxWebhookDeliveries)
+}
+
+// Send delivers an event, asynchronously, to every webhook subscribed to it.
+func (wm *WebhookManager) Send(event string, data webhookData) {
+	config := wm.server.Config()
+	if len(config.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(webhookPayload{
+		Event:  event,
+		Time:   time.Now().UTC().Format(IRCv3TimestampFormat),
+		Server: config.Server.Name,
+		Data:   data,
+	})
+	if err != nil {
+		wm.server.logger.Error("webhooks", "couldn't serialize event", event, err.Error())
+		return
+	}
+	for i := range config.Webhooks {
+		hook := &config.Webhooks[i]
+		if len(hook.events) != 0 && !hook.events.Has(event) {
+			continue
+		}
+		if !wm.semaphore.TryAcquire() {
+			wm.server.logger.Warning("webhooks", "too many deliveries in flight, dropping event", event)
+			return
+		}
+		go wm.deliver(hook, event, body)
+	}
+}
+
+func (wm *WebhookManager) deliver(hook *WebhookConfig, event string, body []byte) {
+	defer wm.semaphore.Release()
+	defer func() {
+		if r := recover(); r != nil {
+			wm.server.logger.Error("internal",
+				fmt.Sprintf("Panic while delivering webhook: %v\n%s", r, debug.Stack()))
+		}
+	}()
+
+	httpClient := http.Client{Timeout: hook.Timeout}
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := postWebhook(&httpClient, hook, event, body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= hook.MaxRetries {
+			wm.server.logger.Error("webhooks", "couldn't deliver event", event, "to", hook.URL, err.Error())
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postWebhook makes one attempt to deliver an event, returning an error
+// if it failed, and whether the failure was possibly transient.
+func postWebhook(httpClient *http.Client, hook *WebhookConfig, event string, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event)
+	if hook.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, "sha256="+webhookSignature(hook.Secret, body))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	resp.Body.Close()
+	if 200 <= resp.StatusCode && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// client errors won't go away on their own, except for these:
+	retry = resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+}
+
+// webhookSignature is the hex-encoded HMAC-SHA256 of the request body,
+// which receivers can use to authenticate deliveries
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
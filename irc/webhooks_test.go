@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Shivaram Lingamneni <slingamn@cs.stanford.edu>
+// released under the MIT license
+
+package irc
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookConfig(t *testing.T) {
+	conf := WebhookConfig{URL: "https://example.com/hook", Events: []string{"Connect", "oper"}}
+	if err := conf.prepare(); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(conf.events.Has(WebhookConnect), true, t)
+	assertEqual(conf.events.Has(WebhookDisconnect), false, t)
+	assertEqual(conf.Timeout, defaultWebhookTimeout, t)
+
+	for _, bad := range []WebhookConfig{
+		{URL: "ftp://example.com/hook"},
+		{URL: "/hook"},
+		{URL: "https://example.com/hook", Events: []string{"reboot"}},
+		{URL: "https://example.com/hook", MaxRetries: -1},
+	} {
+		if bad.prepare() == nil {
+			t.Errorf("config should have been rejected: %#v", bad)
+		}
+	}
+}
+
+type webhookRequest struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	requests := make(chan webhookRequest, 4)
+	failures := 1
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- webhookRequest{r.Header.Get(webhookEventHeader), r.Header.Get(webhookSignatureHeader), body}
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer httpServer.Close()
+
+	server := newTestServer()
+	config := server.Config()
+	config.Server.Name = "oragono.test"
+	config.Webhooks = []WebhookConfig{
+		{URL: httpServer.URL, Secret: "hunter2", Events: []string{"account-register"}, MaxRetries: 1},
+	}
+	if err := config.Webhooks[0].prepare(); err != nil {
+		t.Fatal(err)
+	}
+	server.webhooks.Initialize(server)
+
+	// not subscribed:
+	server.webhooks.Send(WebhookConnect, webhookData{})
+	server.webhooks.Send(WebhookAccountRegister, webhookData{"account": "alice"})
+
+	var request webhookRequest
+	for i := 0; i < 2; i++ {
+		// the first attempt fails and is retried
+		select {
+		case request = <-requests:
+		case <-time.After(2 * webhookRetryDelay):
+			t.Fatal("webhook was not delivered")
+		}
+	}
+	assertEqual(request.event, WebhookAccountRegister, t)
+	assertEqual(request.signature, "sha256="+webhookSignature("hunter2", request.body), t)
+	var payload webhookPayload
+	if err := json.Unmarshal(request.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	assertEqual(payload.Event, WebhookAccountRegister, t)
+	assertEqual(payload.Server, "oragono.test", t)
+	assertEqual(payload.Data["account"], "alice", t)
+
+	select {
+	case request = <-requests:
+		t.Errorf("unexpected delivery of %s", request.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
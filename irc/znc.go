@@ -57,7 +57,8 @@ func zncWireTimeToTime(str string) (result time.Time) {
 func timeToZncWireTime(t time.Time) (result string) {
 	secs := t.Unix()
 	nano := t.UnixNano() - (secs * 1000000000)
-	return fmt.Sprintf("%d.%d", secs, nano)
+	// the fractional part must be zero-padded, e.g., 5 milliseconds is .005000000
+	return fmt.Sprintf("%d.%09d", secs, nano)
 }
 
 type zncPlaybackTimes struct {
@@ -93,8 +94,23 @@ func zncPlaybackHandler(client *Client, command string, params []string, rb *Res
 		zncPlaybackPlayHandler(client, command, params, rb)
 	case "list":
 		zncPlaybackListHandler(client, command, params, rb)
+	case "clear", "clearall":
+		// ZNC deletes its buffers here; our history is shared with CHATHISTORY
+		// and other sessions, so this is an intentional no-op
 	default:
-		return
+		zncPlaybackHelp(client, rb)
+	}
+}
+
+func zncPlaybackHelp(client *Client, rb *ResponseBuffer) {
+	nick := client.Nick()
+	for _, line := range []string{
+		client.t("Supported commands:"),
+		client.t("play <target> [lower_bound] [upper_bound]"),
+		client.t("list"),
+		client.t("clear and clearall are accepted but have no effect"),
+	} {
+		rb.Add(nil, "*playback!znc@znc.in", "PRIVMSG", nick, line)
 	}
 }
 
@@ -95,8 +95,12 @@ func main() {
 	usage := `oragono.
 Usage:
 	oragono initdb [--conf <filename>] [--quiet]
-	oragono upgradedb [--conf <filename>] [--quiet]
+	oragono upgradedb [--dry-run] [--conf <filename>] [--quiet]
 	oragono importdb <database.json> [--conf <filename>] [--quiet]
+	oragono backup <backupfile> [--conf <filename>] [--quiet]
+	oragono restoredb <backupfile> [--conf <filename>] [--quiet]
+	oragono importbans <banfile> [--format <format>] [--overwrite] [--dry-run] [--conf <filename>] [--quiet]
+	oragono exportbans <banfile> [--format <format>] [--conf <filename>] [--quiet]
 	oragono genpasswd [--conf <filename>] [--quiet]
 	oragono mkcerts [--conf <filename>] [--quiet]
 	oragono run [--conf <filename>] [--quiet] [--smoke]
@@ -105,6 +109,9 @@ Usage:
 Options:
 	--conf <filename>  Configuration file to use [default: ircd.yaml].
 	--quiet            Don't show startup/shutdown lines.
+	--format <format>  Ban list format, plain or json (detected automatically on import).
+	--overwrite        Replace existing bans with imported ones.
+	--dry-run          Report what would change without changing anything.
 	-h --help          Show this screen.
 	--version          Show version.`
 
@@ -163,6 +170,18 @@ Options:
 		if !arguments["--quiet"].(bool) {
 			log.Println("database initialized: ", config.Datastore.Path)
 		}
+	} else if arguments["upgradedb"].(bool) && arguments["--dry-run"].(bool) {
+		reports, err := irc.DryRunUpgradeDB(config)
+		if err != nil {
+			log.Fatal("Error while checking db upgrade:", err.Error())
+		}
+		if len(reports) == 0 {
+			log.Println("database is already at the latest schema version: ", config.Datastore.Path)
+		}
+		for _, report := range reports {
+			log.Printf("schema change from version %d to %d: %d keys added, %d modified, %d deleted\n",
+				report.InitialVersion, report.TargetVersion, report.Added, report.Modified, report.Deleted)
+		}
 	} else if arguments["upgradedb"].(bool) {
 		err = irc.UpgradeDB(config)
 		if err != nil {
@@ -176,6 +195,48 @@ Options:
 		if err != nil {
 			log.Fatal("Error while importing db:", err.Error())
 		}
+	} else if arguments["backup"].(bool) {
+		version, err := irc.BackupDBFile(config, arguments["<backupfile>"].(string))
+		if err != nil {
+			log.Fatal("Error while backing up db:", err.Error())
+		}
+		if !arguments["--quiet"].(bool) {
+			log.Printf("database (schema v%d) backed up to: %s\n", version, arguments["<backupfile>"].(string))
+		}
+	} else if arguments["restoredb"].(bool) {
+		version, err := irc.RestoreDB(config, arguments["<backupfile>"].(string))
+		if err != nil {
+			log.Fatal("Error while restoring db:", err.Error())
+		}
+		if !arguments["--quiet"].(bool) {
+			log.Printf("database (schema v%d) restored to: %s\n", version, config.Datastore.Path)
+		}
+	} else if arguments["importbans"].(bool) {
+		format, _ := arguments["--format"].(string)
+		dryRun := arguments["--dry-run"].(bool)
+		result, err := irc.ImportBanListFile(config, arguments["<banfile>"].(string), format, arguments["--overwrite"].(bool), dryRun)
+		if err != nil {
+			log.Fatal("Error while importing bans:", err.Error())
+		}
+		for _, banErr := range result.Errors {
+			log.Println("invalid ban:", banErr)
+		}
+		if !arguments["--quiet"].(bool) || len(result.Errors) != 0 {
+			if dryRun {
+				log.Println("dry run of ban import:", result.Summary())
+			} else {
+				log.Println("bans imported:", result.Summary())
+			}
+		}
+	} else if arguments["exportbans"].(bool) {
+		format, _ := arguments["--format"].(string)
+		count, err := irc.ExportBanListFile(config, arguments["<banfile>"].(string), format)
+		if err != nil {
+			log.Fatal("Error while exporting bans:", err.Error())
+		}
+		if !arguments["--quiet"].(bool) {
+			log.Printf("%d bans exported to: %s\n", count, arguments["<banfile>"].(string))
+		}
 	} else if arguments["run"].(bool) {
 		if !arguments["--quiet"].(bool) {
 			logman.Info("server", fmt.Sprintf("%s starting", irc.Ver))
@@ -186,6 +247,12 @@ Options:
 			logman.Warning("server", "You are currently running an unreleased beta version of Oragono that may be unstable and could corrupt your database.\nIf you are running a production network, please download the latest build from https://oragono.io/downloads.html and run that instead.")
 		}
 
+		// if we were started by a graceful upgrade, wait for the old process to exit
+		if err := irc.PrepareUpgradeHandoff(); err != nil {
+			logman.Error("server", fmt.Sprintf("Could not take over from previous process: %s", err.Error()))
+			os.Exit(1)
+		}
+
 		server, err := irc.NewServer(config, logman)
 		if err != nil {
 			logman.Error("server", fmt.Sprintf("Could not load server: %s", err.Error()))